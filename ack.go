@@ -0,0 +1,176 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/xml" // https://golang.org/pkg/encoding/xml/
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// After each batch we write an acknowledgement (ACK) file for the vendor
+// that sent it, listing every record in file order with what happened to
+// it. ACKs go to "ack.dir" as <input name>.ack.xml and are signed when a
+// signing key is configured (see signing.go).
+func init() {
+	viper.SetDefault("ack.enabled", true)
+	viper.SetDefault("ack.dir", "./acks")
+}
+
+// Record statuses in an ACK.
+const (
+	ackAccepted    = "accepted"
+	ackPending     = "pending"
+	ackRejected    = "rejected"
+	ackDeactivated = "deactivated"
+)
+
+type ackFile struct {
+	XMLName     xml.Name    `xml:"EnrollmentAcknowledgement"`
+	Batch       int64       `xml:"Batch,omitempty"`
+	File        string      `xml:"File"`
+	SHA256      string      `xml:"SHA256"`
+	Status      string      `xml:"Status"`
+	Generated   *time.Time  `xml:"Generated,omitempty"` // nil with --golden
+	Language    string      `xml:"Language,omitempty"`  // of the messages, if not English (see messages.go)
+	Correlation string      `xml:"CorrelationId,omitempty"`
+	Records     []ackRecord `xml:"Record"`
+}
+
+type ackRecord struct {
+	Index        int        `xml:"Index"`
+	EFIN         string     `xml:"EFIN"`
+	Status       string     `xml:"Status"`
+	EnrollmentID int64      `xml:"EnrollmentId,omitempty"`
+	Confirmation string     `xml:"ConfirmationNumber,omitempty"`
+	Correlation  string     `xml:"CorrelationId,omitempty"`
+	Errors       []ackError `xml:"Error"`
+	Warnings     []ackError `xml:"Warning"`
+	Offices      []string   `xml:"DeactivatedOffices>EFIN,omitempty"`
+	Ruleset      string     `xml:"Ruleset,omitempty"` // see rules.go
+}
+
+type ackError struct {
+	Code    string `xml:"code,attr"`
+	Field   string `xml:"field,attr,omitempty"`
+	Message string `xml:",chardata"`
+}
+
+// newAck builds the ACK for a batch, records in file order.
+func newAck(job *batchJob, status string, summary loadSummary) ackFile {
+	ack := ackFile{
+		Batch:       job.ID,
+		File:        filepath.Base(job.File.Path),
+		SHA256:      job.File.SHA256,
+		Status:      status,
+		Correlation: job.Correlation,
+	}
+	lang := transmitterLanguage(job.File.Transmitter())
+	if lang != "en" {
+		ack.Language = lang
+	}
+	if golden() {
+		ack.Batch = 0
+		summary = summary.sorted()
+	} else {
+		now := time.Now()
+		ack.Generated = &now
+	}
+
+	for _, r := range summary.Loaded {
+		rec := ackRecord{Index: r.Index, EFIN: r.EFIN, Status: ackAccepted, EnrollmentID: r.ID, Confirmation: r.Confirmation, Ruleset: r.Ruleset}
+		if golden() {
+			rec.EnrollmentID, rec.Confirmation = 0, ""
+		}
+		if r.Flagged != "" {
+			rec.Status = ackPending
+		}
+		for _, e := range r.Warnings {
+			rec.Warnings = append(rec.Warnings, ackError{Code: e.Code, Field: e.Field, Message: localize(e, lang)})
+		}
+		ack.Records = append(ack.Records, rec)
+	}
+	for _, d := range summary.Deactivated {
+		ack.Records = append(ack.Records, ackRecord{Index: d.Index, EFIN: d.EFIN, Status: ackDeactivated, Offices: d.Offices})
+	}
+	for _, r := range summary.Rejected {
+		rec := ackRecord{Index: r.Index, EFIN: r.EFIN, Status: ackRejected, Ruleset: r.Ruleset}
+		for _, e := range r.Errors {
+			rec.Errors = append(rec.Errors, ackError{Code: e.Code, Field: e.Field, Message: localize(e, lang)})
+		}
+		ack.Records = append(ack.Records, rec)
+	}
+
+	for i := range ack.Records {
+		ack.Records[i].Correlation = job.recordCorrelation(ack.Records[i].Index)
+	}
+	sort.Slice(ack.Records, func(i, j int) bool { return ack.Records[i].Index < ack.Records[j].Index })
+	return ack
+}
+
+// writeAck writes (and signs) the ACK file and returns its path, or ""
+// if ACKs are turned off.
+func writeAck(job *batchJob, status string, summary loadSummary) (string, error) {
+	if !viper.GetBool("ack.enabled") {
+		return "", nil
+	}
+
+	dir := viper.GetString("ack.dir")
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+
+	b, err := xml.MarshalIndent(newAck(job, status, summary), "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	name := strings.TrimSuffix(filepath.Base(job.File.Path), filepath.Ext(job.File.Path))
+	path := filepath.Join(dir, fmt.Sprintf("%s.%d.ack.xml", name, job.ID))
+	if golden() {
+		path = filepath.Join(dir, name+".ack.xml")
+	}
+	if err := os.WriteFile(path, append([]byte(xml.Header), b...), 0640); err != nil {
+		return "", err
+	}
+
+	key, err := ackKey(job.File.Transmitter())
+	if err != nil {
+		return path, err
+	}
+	if key != nil {
+		if err := signFile(path, key); err != nil {
+			return path, fmt.Errorf("signing %s: %v", path, err)
+		}
+	}
+	return path, nil
+}
+
+// returnFiles lists the files to send back for an ACK: the ACK and, if it
+// was signed, its signature.
+func returnFiles(ack string) []string {
+	files := []string{ack}
+	if _, err := os.Stat(ack + ".sig"); err == nil {
+		files = append(files, ack+".sig")
+	}
+	return files
+}
@@ -0,0 +1,229 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Admin endpoints let ops look at and steer a running "enroll serve"
+// without shelling into the box:
+//
+//	GET  /v1/admin/batches?limit=20   recent batches
+//	GET  /v1/admin/queue              watcher state and queue depth
+//	GET  /v1/admin/pipeline           records, busy time and queue depth by stage
+//	POST /v1/admin/pause              stop starting new files
+//	POST /v1/admin/resume
+//	POST /v1/admin/drain?wait=5m      pause, then wait for the files loading
+//	POST /v1/admin/requeue            {"file": "ERO20160104.xml", "priority": true, "duplicate": true}
+//	POST /v1/admin/priority           {"file": "ERO20160104.xml"}  move to the urgent lane
+//
+// They are for operators, not vendors: callers must present a client
+// certificate whose CN is in server.tls.admins, or a bearer token whose
+// SHA-256 is in server.admins.
+
+// adminKey is one entry in server.admins.
+type adminKey struct {
+	Name   string `mapstructure:"name"`
+	SHA256 string `mapstructure:"sha256"`
+}
+
+// authenticateAdmin returns the operator making the request.
+func authenticateAdmin(r *http.Request) (string, error) {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cn := r.TLS.PeerCertificates[0].Subject.CommonName
+		for _, admin := range viper.GetStringSlice("server.tls.admins") {
+			if strings.EqualFold(admin, cn) {
+				return cn, nil
+			}
+		}
+	}
+
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return "", errUnauthenticated
+	}
+	sum := sha256.Sum256([]byte(strings.TrimSpace(h[len("Bearer "):])))
+
+	var keys []adminKey
+	if err := viper.UnmarshalKey("server.admins", &keys); err != nil {
+		return "", fmt.Errorf("config: server.admins: %v", err)
+	}
+	for _, k := range keys {
+		want, err := hex.DecodeString(k.SHA256)
+		if err == nil && subtle.ConstantTimeCompare(sum[:], want) == 1 {
+			return k.Name, nil
+		}
+	}
+	return "", errUnauthenticated
+}
+
+// adminOnly wraps an admin handler.
+func adminOnly(method string, next func(w http.ResponseWriter, r *http.Request, admin string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin, err := authenticateAdmin(r)
+		if err == errUnauthenticated {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="enroll-admin"`)
+			httpError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if r.Method != method {
+			httpError(w, http.StatusMethodNotAllowed, "use "+method)
+			return
+		}
+		next(w, r, admin)
+	}
+}
+
+// registerAdminRoutes adds the admin endpoints. w is nil when the inbox
+// watcher isn't running; the queue endpoints then answer 503.
+func registerAdminRoutes(mux *http.ServeMux, dbs *databases, w *watcher) {
+	mux.HandleFunc("/v1/admin/batches", adminOnly(http.MethodGet, func(rw http.ResponseWriter, r *http.Request, _ string) {
+		limit := 20
+		if s := r.URL.Query().Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 || n > 1000 {
+				httpError(rw, http.StatusBadRequest, "limit must be 1 to 1000")
+				return
+			}
+			limit = n
+		}
+		batches, err := recentBatches(dbs.reader(), limit)
+		if err != nil {
+			httpError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(rw, http.StatusOK, batches)
+	}))
+
+	mux.HandleFunc("/v1/admin/pipeline", adminOnly(http.MethodGet, func(rw http.ResponseWriter, r *http.Request, _ string) {
+		writeJSON(rw, http.StatusOK, pipelineStatus()) // see pipeline.go
+	}))
+
+	watching := func(next func(rw http.ResponseWriter, r *http.Request, admin string)) func(rw http.ResponseWriter, r *http.Request, admin string) {
+		return func(rw http.ResponseWriter, r *http.Request, admin string) {
+			if w == nil {
+				httpError(rw, http.StatusServiceUnavailable, "the inbox watcher is not running (watch.enabled)")
+				return
+			}
+			next(rw, r, admin)
+		}
+	}
+
+	mux.HandleFunc("/v1/admin/queue", adminOnly(http.MethodGet, watching(func(rw http.ResponseWriter, r *http.Request, _ string) {
+		st, err := w.status()
+		if err != nil {
+			httpError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(rw, http.StatusOK, st)
+	})))
+
+	mux.HandleFunc("/v1/admin/pause", adminOnly(http.MethodPost, watching(func(rw http.ResponseWriter, r *http.Request, admin string) {
+		w.pause()
+		logAdmin(admin, "paused the watcher")
+		st, _ := w.status()
+		writeJSON(rw, http.StatusOK, st)
+	})))
+
+	mux.HandleFunc("/v1/admin/resume", adminOnly(http.MethodPost, watching(func(rw http.ResponseWriter, r *http.Request, admin string) {
+		w.resume()
+		logAdmin(admin, "resumed the watcher")
+		st, _ := w.status()
+		writeJSON(rw, http.StatusOK, st)
+	})))
+
+	mux.HandleFunc("/v1/admin/drain", adminOnly(http.MethodPost, watching(func(rw http.ResponseWriter, r *http.Request, admin string) {
+		wait := 5 * time.Minute
+		if s := r.URL.Query().Get("wait"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				httpError(rw, http.StatusBadRequest, "wait must be a duration, e.g. 5m")
+				return
+			}
+			wait = d
+		}
+		logAdmin(admin, "is draining the watcher")
+
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		err := w.drain(ctx)
+		st, _ := w.status()
+		if err != nil {
+			// Still paused; the caller can poll /v1/admin/queue for idle.
+			writeJSON(rw, http.StatusAccepted, st)
+			return
+		}
+		writeJSON(rw, http.StatusOK, st)
+	})))
+
+	mux.HandleFunc("/v1/admin/requeue", adminOnly(http.MethodPost, watching(func(rw http.ResponseWriter, r *http.Request, admin string) {
+		var body struct {
+			File      string `json:"file"`
+			Priority  bool   `json:"priority"`
+			Duplicate bool   `json:"duplicate"` // load it even if it repeats a batch (see duplicates.go)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.File == "" {
+			httpError(rw, http.StatusBadRequest, `body must be {"file": "NAME"}`)
+			return
+		}
+		err := w.requeue(body.File, body.Priority, body.Duplicate)
+		switch {
+		case err == errNotFailed:
+			httpError(rw, http.StatusNotFound, err.Error())
+		case err != nil:
+			httpError(rw, http.StatusInternalServerError, err.Error())
+		default:
+			logAdmin(admin, "requeued "+body.File)
+			writeJSON(rw, http.StatusOK, map[string]string{"requeued": body.File})
+		}
+	})))
+	mux.HandleFunc("/v1/admin/priority", adminOnly(http.MethodPost, watching(func(rw http.ResponseWriter, r *http.Request, admin string) {
+		var body struct {
+			File string `json:"file"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.File == "" {
+			httpError(rw, http.StatusBadRequest, `body must be {"file": "NAME"}`)
+			return
+		}
+		err := w.prioritize(body.File)
+		switch {
+		case err == errNotQueued:
+			httpError(rw, http.StatusNotFound, err.Error())
+		case err != nil:
+			httpError(rw, http.StatusInternalServerError, err.Error())
+		default:
+			logAdmin(admin, "made "+body.File+" urgent")
+			st, _ := w.status()
+			writeJSON(rw, http.StatusOK, st)
+		}
+	})))
+}
@@ -0,0 +1,195 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls" // https://golang.org/pkg/crypto/tls/
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// "enroll admin ..." drives a running "enroll serve" through its admin
+// endpoints (admin.go), so ops can pause or drain it from a shell:
+//
+//	enroll admin queue
+//	enroll admin pause
+//	enroll admin resume
+//	enroll admin drain [--wait 10m]
+//	enroll admin requeue [--priority] [--duplicate] ERO20160104.xml
+//	enroll admin priority ERO20160104.xml
+//
+// admin.url is the server (default http://localhost:8080). Authenticate
+// with admin.token (or $ENROLL_ADMIN_TOKEN), or a client certificate in
+// admin.cert/admin.key; admin.ca is the CA that signed the server's.
+func init() {
+	viper.SetDefault("admin.url", "http://localhost:8080")
+	viper.SetDefault("admin.token", "")
+	viper.SetDefault("admin.cert", "")
+	viper.SetDefault("admin.key", "")
+	viper.SetDefault("admin.ca", "")
+}
+
+var adminCmd = &cobra.Command{
+	Use:   "admin",
+	Short: "Control a running server",
+}
+
+var (
+	adminDrainWait time.Duration
+	adminPriority  bool
+	adminDuplicate bool
+)
+
+func init() {
+	simple := func(use, short, method, path string) *cobra.Command {
+		return &cobra.Command{
+			Use:   use,
+			Short: short,
+			Args:  cobra.NoArgs,
+			Run: func(cmd *cobra.Command, args []string) {
+				check(adminCall(method, path, nil))
+			},
+		}
+	}
+	adminCmd.AddCommand(
+		simple("queue", "Show the watcher state and queue", http.MethodGet, "/v1/admin/queue"),
+		simple("batches", "List recent batches", http.MethodGet, "/v1/admin/batches"),
+		simple("pause", "Stop starting new files", http.MethodPost, "/v1/admin/pause"),
+		simple("resume", "Start taking files again", http.MethodPost, "/v1/admin/resume"),
+	)
+
+	drain := &cobra.Command{
+		Use:   "drain",
+		Short: "Pause and wait for the files in progress to finish",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			check(adminCall(http.MethodPost, "/v1/admin/drain?wait="+adminDrainWait.String(), nil))
+		},
+	}
+	drain.Flags().DurationVar(&adminDrainWait, "wait", 10*time.Minute, "how long to wait")
+	adminCmd.AddCommand(drain)
+
+	requeue := &cobra.Command{
+		Use:   "requeue FILE",
+		Short: "Move a failed file back into the inbox",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			check(adminCall(http.MethodPost, "/v1/admin/requeue", map[string]interface{}{"file": args[0], "priority": adminPriority, "duplicate": adminDuplicate}))
+		},
+	}
+	requeue.Flags().BoolVar(&adminPriority, "priority", false, "put it in the urgent lane")
+	requeue.Flags().BoolVar(&adminDuplicate, "duplicate", false, "load it even if it repeats an earlier batch")
+	adminCmd.AddCommand(requeue)
+
+	adminCmd.AddCommand(&cobra.Command{
+		Use:   "priority FILE",
+		Short: "Move a queued file to the urgent lane",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			check(adminCall(http.MethodPost, "/v1/admin/priority", map[string]string{"file": args[0]}))
+		},
+	})
+
+	rootCmd.AddCommand(adminCmd)
+}
+
+// adminCall makes one admin request and prints the JSON response.
+func adminCall(method, path string, body interface{}) error {
+	client, err := adminClient()
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(viper.GetString("admin.url"), "/")+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	token := viper.GetString("admin.token")
+	if t := os.Getenv("ENROLL_ADMIN_TOKEN"); t != "" {
+		token = t
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var out bytes.Buffer
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if json.Indent(&out, b, "", "  ") != nil {
+		out.Write(b)
+	}
+	fmt.Println(strings.TrimSpace(out.String()))
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return nil
+}
+
+func adminClient() (*http.Client, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if ca := viper.GetString("admin.ca"); ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("config: admin.ca: %v", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("config: admin.ca: no certificates in %s", ca)
+		}
+	}
+	if cert := viper.GetString("admin.cert"); cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, viper.GetString("admin.key"))
+		if err != nil {
+			return nil, fmt.Errorf("config: admin.cert/key: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+
+	// Drains can take a while; the server bounds them with ?wait.
+	return &http.Client{
+		Timeout:   adminDrainWait + time.Minute,
+		Transport: &http.Transport{TLSClientConfig: cfg},
+	}, nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/microsoft/go-mssqldb/aecmk/localcert" // https://github.com/microsoft/go-mssqldb
+	"github.com/spf13/viper"                          // https://github.com/spf13/viper
+)
+
+// SQL Server Always Encrypted (sql/033_always_encrypted.sql). With
+// "mssql.alwaysencrypted.enabled" every record's owner and EFIN owner SSN
+// and date of birth are also kept in ero_sensitive, whose columns SQL
+// Server only ever sees encrypted: the driver encrypts them on the way in
+// and decrypts them on the way out, with column encryption keys that are
+// themselves wrapped by a column master key the server can't use. The
+// DBAs provision the keys; we hold the master key:
+//
+//	pfx          path to the master key's certificate (.pfx). It must be
+//	             the KEY_PATH the column master key was created with,
+//	             under KEY_STORE_PROVIDER_NAME 'pfx'.
+//	pfxpassword  its password, as a secret reference (see secrets.go)
+//
+// On Windows a master key in the certificate store
+// (MSSQL_CERTIFICATE_STORE) works too, with no pfx settings.
+//
+// SSN is deterministic encryption, so it can be matched on; date of birth
+// is randomized. Parameters for encrypted columns have to be plain
+// placeholders in the statement - the driver asks the server how each is
+// encrypted (sp_describe_parameter_encryption) - never part of an
+// expression or compared with a literal.
+func init() {
+	viper.SetDefault("mssql.alwaysencrypted.enabled", false)
+	viper.SetDefault("mssql.alwaysencrypted.pfx", "")
+	viper.SetDefault("mssql.alwaysencrypted.pfxpassword", "")
+}
+
+var columnMasterKey struct {
+	sync.Once
+	err error
+}
+
+// alwaysEncrypted reports whether ero_sensitive is in use.
+func alwaysEncrypted() bool {
+	return viper.GetBool("mssql.alwaysencrypted.enabled")
+}
+
+// registerColumnMasterKey gives the driver the password to the column
+// master key certificate, once.
+func registerColumnMasterKey() error {
+	columnMasterKey.Do(func() {
+		path := viper.GetString("mssql.alwaysencrypted.pfx")
+		if path == "" {
+			return
+		}
+		password, err := secretValue(viper.GetString("mssql.alwaysencrypted.pfxpassword"))
+		if err != nil {
+			columnMasterKey.err = fmt.Errorf("config: mssql.alwaysencrypted.pfxpassword: %v", err)
+			return
+		}
+		localcert.PfxKeyProvider.SetCertificatePassword(path, password)
+	})
+	return columnMasterKey.err
+}
+
+// storeSensitive keeps the SSNs and dates of birth in record id in
+// ero_sensitive. It does nothing unless Always Encrypted is enabled.
+func storeSensitive(p preparer, id int64, e Enrollment) error {
+	if !alwaysEncrypted() {
+		return nil
+	}
+	people := []struct {
+		role     string
+		ssn, dob string
+	}{
+		{roleOwner, e.OwnerInformation.SSN, e.OwnerInformation.DateOfBirth},
+		{roleEFINOwner, e.EFINOwnerInfo.SSN, e.EFINOwnerInfo.DateOfBirth},
+	}
+	for _, who := range people {
+		ssn, dob := ssnDigits(who.ssn), strings.TrimSpace(who.dob)
+		if ssn == "" && dob == "" {
+			continue
+		}
+		if _, err := execStatement(p, "ero_sensitive.add", id, who.role, ssn, truncate(dob, 10)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"encoding/xml" // https://golang.org/pkg/encoding/xml/
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dstroot/go_enrollment/enrollment"
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// An amendment - a record for an EFIN and tax year we already have - may
+// carry only what changed, e.g. just its OfficeInfo. An element that is
+// left out keeps what the record it amends had; one that is there but
+// empty (<Email></Email>, or a whole <OfficeInfo/>) clears it, as empty
+// values always have (see empty.go). So while decoding we note which
+// fields each record actually had (presence), and when one is missing
+// some we patch it from the latest record for its EFIN that wasn't
+// rejected before it is checked and inserted.
+//
+// Two loads can amend the same EFIN at once, so the insert checks that
+// the record we read is still the latest and unchanged (optimistic
+// concurrency, sql/017_amendment_versions.sql). If it isn't, nothing is
+// inserted and the record is rejected with AMEND_CONFLICT rather than
+// quietly undoing the other load's change.
+//
+// Only the fields we store (storedColumns) can be carried over; the rest
+// were never kept. Missing fields are also left alone by the empty.fields
+// "error" rules, since an amendment isn't changing them. A record with no
+// earlier one to amend is loaded as it always was. Set load.sparse to
+// false to treat every record as complete.
+//
+// A record amends one for the same tax year: its ProcessingYear, or
+// load.taxyear (default this year) if it left that out.
+func init() {
+	viper.SetDefault("load.sparse", true)
+	viper.SetDefault("load.taxyear", time.Now().Year())
+}
+
+// recordYear is the tax year e is for.
+func recordYear(e Enrollment) int {
+	if year, err := strconv.Atoi(strings.TrimSpace(e.ProcessingYear)); err == nil {
+		return year
+	}
+	return viper.GetInt("load.taxyear")
+}
+
+// fieldSet is the fields (Go paths, as in fields.go) a record had. nil
+// means all of them.
+type fieldSet map[string]bool
+
+func (s fieldSet) has(path string) bool {
+	return s == nil || s[path]
+}
+
+// complete reports whether the record had every field.
+func (s fieldSet) complete() bool {
+	if s == nil {
+		return true
+	}
+	for _, path := range leafFields {
+		if !s[path] {
+			return false
+		}
+	}
+	return true
+}
+
+// leafFields are every non-section field of an Enrollment, and
+// xmlFields maps their element paths ("OfficeInfo/Email") - and the
+// sections' - to them.
+var leafFields, xmlFields = enrollmentFields()
+
+func enrollmentFields() ([]string, map[string]string) {
+	var leaves []string
+	paths := map[string]string{}
+	var walk func(t reflect.Type, xmlPrefix, goPrefix string)
+	walk = func(t reflect.Type, xmlPrefix, goPrefix string) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("xml"), ",")[0]
+			if name == "-" || f.PkgPath != "" || strings.HasSuffix(f.Tag.Get("xml"), ",attr") {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			x, g := xmlPrefix+name, goPrefix+f.Name
+			paths[x] = g
+			if f.Type.Kind() == reflect.Struct {
+				walk(f.Type, x+"/", g+".")
+				continue
+			}
+			leaves = append(leaves, g)
+		}
+	}
+	walk(reflect.TypeOf(Enrollment{}), "", "")
+	return leaves, paths
+}
+
+// presence returns the fields each <Enrollment> in an already decoded
+// file had, in file order.
+func presence(content []byte) ([]fieldSet, error) {
+	var (
+		sets  []fieldSet
+		stack []string // element names below <Enrollment>
+		kids  []int    // child elements seen, per level of stack
+		depth int      // below the root element
+	)
+	d := xml.NewDecoder(bytes.NewReader(content))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return sets, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch {
+			case depth == 2 && t.Name.Local == "Enrollment":
+				sets = append(sets, fieldSet{})
+				stack, kids = stack[:0], kids[:0]
+			case depth > 2 && len(sets) > 0:
+				if len(kids) > 0 {
+					kids[len(kids)-1]++
+				}
+				stack = append(stack, t.Name.Local)
+				kids = append(kids, 0)
+				if g, ok := xmlFields[strings.Join(stack, "/")]; ok {
+					sets[len(sets)-1][g] = true
+				}
+			}
+		case xml.EndElement:
+			if depth > 2 && len(stack) > 0 {
+				// An empty section clears everything in it.
+				if g, ok := xmlFields[strings.Join(stack, "/")]; ok && kids[len(kids)-1] == 0 {
+					for _, leaf := range leafFields {
+						if strings.HasPrefix(leaf, g+".") {
+							sets[len(sets)-1][leaf] = true
+						}
+					}
+				}
+				stack, kids = stack[:len(stack)-1], kids[:len(kids)-1]
+			}
+			if depth--; depth == 0 {
+				return sets, nil // as Decode, stop at the end of the root
+			}
+		}
+	}
+}
+
+// errAmendConflict is the code for an amendment that lost a race: the
+// record it amends changed while it was being loaded.
+const errAmendConflict = "AMEND_CONFLICT"
+
+// errConflict is what insertEnrollment returns when that happens.
+var errConflict = enrollment.ErrConflict
+
+// priorRecord is the latest record for an EFIN and tax year that wasn't
+// rejected - the one a new record for them amends. ID is 0 if there is
+// none.
+type priorRecord struct {
+	ID                   int64
+	Version              []byte    // ero.VERSION, see sql/017_amendment_versions.sql
+	Received             time.Time // its TransactionDate
+	Company, State, Bank sql.NullString
+	MasterEfin           sql.NullString
+}
+
+// value is what the record has for a stored field. ok is false for
+// fields ero.prior doesn't read.
+func (r priorRecord) value(field string) (v sql.NullString, ok bool) {
+	switch field {
+	case "OfficeInfo.OfficeName":
+		return r.Company, true
+	case "OfficeInfo.State":
+		return r.State, true
+	case "PriorYearInfo.Bank":
+		return r.Bank, true
+	case "MasterEfin":
+		return r.MasterEfin, true
+	}
+	return sql.NullString{}, false
+}
+
+// priorFields are the fields value knows.
+var priorFields = []string{"OfficeInfo.OfficeName", "OfficeInfo.State", "PriorYearInfo.Bank", "MasterEfin"}
+
+// readPrior returns the record a record for efin and year would amend. p
+// may be the load's transaction, so an earlier record in the same file
+// counts.
+func readPrior(p preparer, efin string, year int) (priorRecord, error) {
+	stmt, err := prepare(p, "ero.prior")
+	if err != nil {
+		return priorRecord{}, err
+	}
+	defer stmt.Close()
+
+	var r priorRecord
+	err = stmt.QueryRow(efin, year).Scan(&r.ID, &r.Version, &r.Received, &r.Company, &r.State, &r.Bank, &r.MasterEfin)
+	if err == sql.ErrNoRows {
+		return priorRecord{}, nil
+	}
+	return r, err
+}
+
+// amendment is the record a record amends, and what it kept from it.
+type amendment struct {
+	Base    priorRecord
+	Present fieldSet               // the fields a partial amendment had; nil otherwise
+	Kept    map[string]interface{} // stored values carried over, by field; nil is NULL
+}
+
+// amend reads the record e amends. It is the base the insert checks is
+// still current, and if e is a partial amendment the stored fields it
+// left out are filled in from it.
+func amend(p preparer, e *Enrollment, present fieldSet) (*amendment, error) {
+	base, err := readPrior(p, e.EFIN, recordYear(*e))
+	if err != nil {
+		return nil, err
+	}
+	a := &amendment{Base: base}
+	if base.ID == 0 || present.complete() || !present.has("EFIN") || !viper.GetBool("load.sparse") {
+		return a, nil
+	}
+
+	a.Present = present
+	for _, field := range priorFields {
+		if !present.has(field) {
+			a.keep(e, field)
+		}
+	}
+	return a, nil
+}
+
+// keep sets a stored field of e back to what the amended record has.
+func (a *amendment) keep(e *Enrollment, field string) {
+	v, _ := a.Base.value(field)
+	ref, _ := fieldRef(e, field)
+	ref.SetString(v.String)
+	if a.Kept == nil {
+		a.Kept = map[string]interface{}{}
+	}
+	a.Kept[field] = nil
+	if v.Valid {
+		a.Kept[field] = v.String
+	}
+}
+
+// base is the ID and version of the record a amends; 0 and nil if none.
+func (a *amendment) base() (int64, []byte) {
+	if a == nil {
+		return 0, nil
+	}
+	return a.Base.ID, a.Base.Version
+}
+
+// present is the fields the amendment had; nil (all of them) if a is.
+func (a *amendment) present() fieldSet {
+	if a == nil {
+		return nil
+	}
+	return a.Present
+}
+
+// column is the value to write for a stored field: what the amended
+// record had if the amendment left it out, as empty.column says otherwise.
+func (a *amendment) column(empty *emptyPolicy, e Enrollment, field string) interface{} {
+	if a != nil {
+		if v, ok := a.Kept[field]; ok {
+			return v
+		}
+	}
+	return empty.column(e, field)
+}
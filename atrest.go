@@ -0,0 +1,232 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Enrollment files carry SSNs, so what we keep on local disk is encrypted
+// with AES-256-GCM when storage.key is set: uploads in server.spooldir,
+// files kept in watch.done, watch.failed and watch.quarantine (and the
+// quarantine diagnostics), checkpoints, and the offline spool. The key is
+// 32 bytes, base64 or hex, normally given as a secret reference such as
+// "env:ENROLL_STORAGE_KEY" or "file:/run/secrets/enroll-storage-key" (see
+// secrets.go).
+//
+// An encrypted file starts with "ENRLENC1", then the 12-byte nonce, then
+// the ciphertext. Files without that prefix are read as they are, so
+// files written before the key was set (and inbox files straight from a
+// transmitter) still load. "enroll decrypt FILE" prints one.
+//
+// Nothing is written unencrypted without a key unless storage.plaintext
+// says that is intended: writing such a file fails. serve, load, replay
+// and triage check first, so they fail before they start rather than on
+// the first file.
+var sealedMagic = []byte("ENRLENC1")
+
+func init() {
+	viper.SetDefault("storage.plaintext", false)
+}
+
+var storageKey struct {
+	sync.Once
+	aead cipher.AEAD // nil when storage.key isn't set
+	err  error
+}
+
+// storageAEAD returns the cipher for storage.key, or nil if there's no
+// key.
+func storageAEAD() (cipher.AEAD, error) {
+	storageKey.Do(func() {
+		ref := viper.GetString("storage.key")
+		if ref == "" {
+			return
+		}
+		value, err := secretValue(ref)
+		if err != nil {
+			storageKey.err = fmt.Errorf("config: storage.key: %v", err)
+			return
+		}
+		key, err := decodeKey(value)
+		if err != nil {
+			storageKey.err = fmt.Errorf("config: storage.key: %v", err)
+			return
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			storageKey.err = err
+			return
+		}
+		storageKey.aead, storageKey.err = cipher.NewGCM(block)
+	})
+	return storageKey.aead, storageKey.err
+}
+
+var errNoStorageKey = errors.New("config: storage.key is not set, so uploads and the files we keep would be written unencrypted; set it, or set storage.plaintext to true")
+
+// sealingAEAD returns the cipher to write files with. It is nil only if
+// storage.plaintext is set.
+func sealingAEAD() (cipher.AEAD, error) {
+	aead, err := storageAEAD()
+	if err != nil || aead != nil {
+		return aead, err
+	}
+	if !viper.GetBool("storage.plaintext") {
+		return nil, errNoStorageKey
+	}
+	return nil, nil
+}
+
+// requireStorageKey checks storage.key, and fails if there is none and
+// storage.plaintext isn't set.
+func requireStorageKey() error {
+	aead, err := sealingAEAD()
+	if err != nil || aead != nil {
+		return err
+	}
+	log.Println("storage.plaintext is set: uploads and the files we keep are not encrypted")
+	return nil
+}
+
+// decodeKey accepts a 32-byte key as base64 or hex.
+func decodeKey(s string) ([]byte, error) {
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("must be 32 bytes, base64 or hex encoded")
+}
+
+// seal encrypts b. It is returned as it is only under storage.plaintext.
+func seal(b []byte) ([]byte, error) {
+	aead, err := sealingAEAD()
+	if err != nil || aead == nil {
+		return b, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := append(append([]byte{}, sealedMagic...), nonce...)
+	return aead.Seal(out, nonce, b, sealedMagic), nil
+}
+
+// unseal decrypts b if it is encrypted, and returns it as it is if not.
+func unseal(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, sealedMagic) {
+		return b, nil
+	}
+	aead, err := storageAEAD()
+	if err != nil {
+		return nil, err
+	}
+	if aead == nil {
+		return nil, errors.New("encrypted, but storage.key is not set")
+	}
+	rest := b[len(sealedMagic):]
+	if len(rest) < aead.NonceSize() {
+		return nil, errors.New("encrypted file is truncated")
+	}
+	plain, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], sealedMagic)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting: %v (wrong storage.key?)", err)
+	}
+	return plain, nil
+}
+
+// writeSealed writes b to path, encrypted (see seal).
+func writeSealed(path string, b []byte, perm os.FileMode) error {
+	sealed, err := seal(b)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, sealed, perm)
+}
+
+// readSealed reads a file written by writeSealed (or a plain one).
+func readSealed(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := unseal(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return plain, nil
+}
+
+// sealFile encrypts a file in place, unless it is encrypted already or
+// storage.plaintext is set. The file is replaced atomically.
+func sealFile(path string) error {
+	if aead, err := sealingAEAD(); err != nil || aead == nil {
+		return err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(b, sealedMagic) {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := writeSealed(path+".tmp", b, 0600); err != nil {
+		return err
+	}
+	// Keep the delivery time; the SLA reports use it.
+	if err := os.Chtimes(path+".tmp", info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+var decryptCmd = &cobra.Command{
+	Use:   "decrypt FILE...",
+	Short: "Print files encrypted with storage.key",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, path := range args {
+			b, err := readSealed(path)
+			check(err)
+			_, err = os.Stdout.Write(b)
+			check(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(decryptCmd)
+}
@@ -0,0 +1,249 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Who is calling the API? In order:
+//
+//  1. a client certificate mapped to a transmitter (see tls.go)
+//  2. "Authorization: Bearer <token>" where the token is one of our API
+//     keys (server.apikeys - we keep only the SHA-256 of each key - or,
+//     with credentials.enabled, a transmitter's api-key credential, see
+//     credentials.go)
+//  3. a bearer token our OAuth2 server vouches for, via token
+//     introspection (RFC 7662) at server.oauth.introspecturl
+//
+// Authenticated callers are then rate limited per transmitter
+// (server.ratelimit) and, for submissions, held to a daily file quota.
+func init() {
+	viper.SetDefault("server.oauth.introspecturl", "")
+	viper.SetDefault("server.oauth.transmitterclaim", "transmitter_id")
+	viper.SetDefault("server.ratelimit.perminute", 60)
+	viper.SetDefault("server.ratelimit.burst", 10)
+	viper.SetDefault("server.quota.filesperday", 0) // 0 = no quota
+}
+
+// apiKey is one entry in server.apikeys. Generate a key, give it to the
+// vendor, and store only `echo -n KEY | sha256sum`.
+type apiKey struct {
+	Name        string `mapstructure:"name"`
+	SHA256      string `mapstructure:"sha256"`
+	Transmitter string `mapstructure:"transmitter"`
+}
+
+var errUnauthenticated = errors.New("authentication required")
+
+// authenticate returns the transmitter the request is acting for.
+func authenticate(r *http.Request) (string, error) {
+	if t := certTransmitter(r); t != "" {
+		return t, nil
+	}
+
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return "", errUnauthenticated
+	}
+	token := strings.TrimSpace(h[len("Bearer "):])
+	if token == "" {
+		return "", errUnauthenticated
+	}
+
+	var keys []apiKey
+	if err := viper.UnmarshalKey("server.apikeys", &keys); err != nil {
+		return "", fmt.Errorf("config: server.apikeys: %v", err)
+	}
+	sum := sha256.Sum256([]byte(token))
+	for _, k := range keys {
+		want, err := hex.DecodeString(k.SHA256)
+		if err == nil && subtle.ConstantTimeCompare(sum[:], want) == 1 {
+			return k.Transmitter, nil
+		}
+	}
+	stored, err := credentialAPIKeys()
+	if err != nil {
+		return "", fmt.Errorf("credentials: %v", err)
+	}
+	if t, ok := stored[hex.EncodeToString(sum[:])]; ok {
+		return t, nil
+	}
+
+	if viper.GetString("server.oauth.introspecturl") != "" {
+		return introspect(token)
+	}
+	return "", errUnauthenticated
+}
+
+var introspectClient = &http.Client{Timeout: 10 * time.Second}
+
+// introspect asks the OAuth2 server whether a token is live and which
+// transmitter it was issued to.
+func introspect(token string) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, viper.GetString("server.oauth.introspecturl"),
+		strings.NewReader(url.Values{"token": {token}}.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	secret, err := secretValue(viper.GetString("server.oauth.clientsecret"))
+	if err != nil {
+		return "", fmt.Errorf("config: server.oauth.clientsecret: %v", err)
+	}
+	req.SetBasicAuth(viper.GetString("server.oauth.clientid"), secret)
+
+	resp, err := introspectClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token introspection: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token introspection: %s", resp.Status)
+	}
+
+	var claims map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return "", fmt.Errorf("token introspection: %v", err)
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return "", errUnauthenticated
+	}
+	t, _ := claims[viper.GetString("server.oauth.transmitterclaim")].(string)
+	if t == "" {
+		return "", errUnauthenticated
+	}
+	return t, nil
+}
+
+// rateLimiter is a token bucket per transmitter: "perminute" tokens are
+// added each minute, up to "burst"; each request takes one.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*bucket{}}
+}
+
+// allow takes a token for the transmitter. If there isn't one it returns
+// false and how long until there will be.
+func (l *rateLimiter) allow(transmitter string) (bool, time.Duration) {
+	return l.take(transmitter, viper.GetFloat64("server.ratelimit.perminute"), viper.GetFloat64("server.ratelimit.burst"))
+}
+
+// take is allow with explicit limits. perMinute <= 0 means no limit.
+func (l *rateLimiter) take(key string, perMinute, burst float64) (bool, time.Duration) {
+	if perMinute <= 0 {
+		return true, 0
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Minutes() * perMinute
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / perMinute * float64(time.Minute))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// authorized wraps a handler that needs to know the calling transmitter,
+// answering 401 for unknown callers and 429 for ones over their limit.
+func authorized(limits *rateLimiter, next func(w http.ResponseWriter, r *http.Request, transmitter string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		transmitter, err := authenticate(r)
+		if err == errUnauthenticated {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="enroll"`)
+			httpError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if ok, wait := limits.allow(transmitter); !ok {
+			tooManyRequests(w, wait, "rate limit exceeded")
+			return
+		}
+		next(w, r, transmitter)
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	httpError(w, http.StatusTooManyRequests, msg)
+}
+
+// overQuota reports whether the transmitter has already sent its
+// server.quota.filesperday files today, and how long until midnight.
+func overQuota(db *sql.DB, transmitter string) (bool, time.Duration, error) {
+	quota := viper.GetInt("server.quota.filesperday")
+	if quota <= 0 {
+		return false, 0, nil
+	}
+
+	stmt, err := prepare(db, "batch.count_since")
+	if err != nil {
+		return false, 0, err
+	}
+	defer stmt.Close()
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	var n int
+	if err := stmt.QueryRow(transmitter, today).Scan(&n); err != nil {
+		return false, 0, err
+	}
+	return n >= quota, today.AddDate(0, 0, 1).Sub(now), nil
+}
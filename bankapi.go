@@ -0,0 +1,292 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// When bank.api.url is set, each record we load (or approve in review) is
+// also sent to the bank's enrollment API, one POST per record with
+// bank.api.token as a bearer token and "ero-<id>" as the Idempotency-Key.
+// Records are queued in the bank_outbox table (sql/014_bank_outbox.sql) as
+// they load and sent by "enroll serve" every bank.api.interval, so a bank
+// outage never holds up loading. A record the bank accepts is marked
+// forwarded (see deadline.go).
+//
+// If the API keeps failing - bank.api.breaker.failures (5) calls in a row
+// time out, can't connect or get a 5xx, 408 or 429 - a circuit breaker
+// (breaker.go) opens: we stop calling for bank.api.breaker.cooldown (1m),
+// then try one record; while that fails the wait doubles up to
+// bank.api.breaker.maxcooldown (15m). Records keep queueing meanwhile and
+// go out once a call succeeds. Any other 4xx is a problem with the record,
+// not the API: it is retried on later rounds, and after
+// bank.api.maxattempts (10) it stays in the outbox for someone to look at.
+func init() {
+	viper.SetDefault("bank.api.timeout", "30s")
+	viper.SetDefault("bank.api.interval", "30s")
+	viper.SetDefault("bank.api.batchsize", 100)
+	viper.SetDefault("bank.api.maxattempts", 10)
+	viper.SetDefault("bank.api.breaker.failures", 5)
+	viper.SetDefault("bank.api.breaker.cooldown", "1m")
+	viper.SetDefault("bank.api.breaker.maxcooldown", "15m")
+}
+
+func bankAPIEnabled() bool {
+	return viper.GetString("bank.api.url") != ""
+}
+
+// queueForBank queues a record for the bank API, if there is one.
+func queueForBank(p preparer, id int64) error {
+	if !bankAPIEnabled() {
+		return nil
+	}
+	args := []interface{}{id, time.Now()}
+	if !viper.GetBool("mssql.storedprocedures") {
+		args = append(args, id) // for NOT EXISTS
+	}
+	stmt, err := prepare(p, "bank_outbox.add")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(args...)
+	return err
+}
+
+// bankEnrollment is what we send the bank for each record.
+type bankEnrollment struct {
+	ID            int64     `json:"id"`
+	EFIN          string    `json:"efin"`
+	Company       string    `json:"company"`
+	TaxYear       int       `json:"taxYear"`
+	State         string    `json:"state,omitempty"`
+	PriorBank     string    `json:"priorBank,omitempty"`
+	Received      time.Time `json:"receivedDate"`
+	Amended       bool      `json:"amended"`
+	CorrelationId string    `json:"correlationId,omitempty"`
+	Confirmation  string    `json:"confirmation,omitempty"`
+	Status        string    `json:"status"`           // loaded, suspended, or inactive after a de-enrollment
+	Reason        string    `json:"reason,omitempty"` // why it was deactivated
+}
+
+// bankForwarder sends queued records to the bank API.
+type bankForwarder struct {
+	db          *sql.DB
+	url, token  string
+	client      *http.Client
+	breaker     *breaker
+	interval    time.Duration
+	batchSize   int
+	maxAttempts int
+}
+
+func newBankForwarder(db *sql.DB) (*bankForwarder, error) {
+	durations := map[string]time.Duration{}
+	for _, key := range []string{"bank.api.timeout", "bank.api.interval", "bank.api.breaker.cooldown", "bank.api.breaker.maxcooldown"} {
+		d, err := configDuration(key)
+		if err != nil {
+			return nil, err
+		}
+		durations[key] = d
+	}
+	token, err := secretValue(viper.GetString("bank.api.token"))
+	if err != nil {
+		return nil, fmt.Errorf("config: bank.api.token: %v", err)
+	}
+
+	return &bankForwarder{
+		db:          db,
+		url:         viper.GetString("bank.api.url"),
+		token:       token,
+		client:      &http.Client{Timeout: durations["bank.api.timeout"], Transport: chaosTransport(http.DefaultTransport)}, // see chaos.go
+		interval:    durations["bank.api.interval"],
+		batchSize:   viper.GetInt("bank.api.batchsize"),
+		maxAttempts: viper.GetInt("bank.api.maxattempts"),
+		breaker: newBreaker("bank-api", viper.GetInt("bank.api.breaker.failures"),
+			durations["bank.api.breaker.cooldown"], durations["bank.api.breaker.maxcooldown"]),
+	}, nil
+}
+
+// run sends queued records every interval until stop is closed.
+func (f *bankForwarder) run(stop <-chan struct{}) {
+	log.Printf("Forwarding records to %s\n", f.url)
+	for {
+		f.flush()
+		f.gauges()
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(f.interval):
+		}
+	}
+}
+
+// flush sends what is queued, a batch at a time, while the breaker lets
+// it.
+func (f *bankForwarder) flush() {
+	for f.breaker.allow() {
+		queued, err := f.next()
+		if err != nil {
+			log.Printf("reading the bank outbox: %v", err)
+			return
+		}
+		if len(queued) == 0 {
+			return
+		}
+
+		for i, e := range queued {
+			// The first call was allowed above; it may be the trial.
+			if i > 0 && !f.breaker.allow() {
+				return
+			}
+			err := f.send(e)
+			switch {
+			case err == nil:
+				f.breaker.success()
+				metricCount("bank.forward", 1, tag("status", "sent"))
+				if _, err := execStatement(f.db, "bank_outbox.sent", f.sentArgs(e.ID)...); err != nil {
+					log.Printf("recording record %d sent to the bank: %v", e.ID, err)
+				}
+			case isAPIOutage(err):
+				f.breaker.failure(err)
+				metricCount("bank.forward", 1, tag("status", "unavailable"))
+				return // the record stays queued as it was
+			default:
+				// The API is up; it didn't like this record.
+				f.breaker.success()
+				metricCount("bank.forward", 1, tag("status", "refused"))
+				log.Printf("bank API refused record %d: %v", e.ID, err)
+				if _, err := execStatement(f.db, "bank_outbox.failed", truncate(err.Error(), 1000), time.Now(), e.ID); err != nil {
+					log.Printf("recording record %d refused by the bank: %v", e.ID, err)
+				}
+			}
+		}
+		if len(queued) < f.batchSize {
+			return
+		}
+	}
+}
+
+func (f *bankForwarder) sentArgs(id int64) []interface{} {
+	args := []interface{}{time.Now().UTC(), id}
+	if !viper.GetBool("mssql.storedprocedures") {
+		args = append(args, id) // for the DELETE
+	}
+	return args
+}
+
+func (f *bankForwarder) next() ([]bankEnrollment, error) {
+	stmt, err := prepare(f.db, "bank_outbox.next")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(f.batchSize, f.maxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var queued []bankEnrollment
+	for rows.Next() {
+		var e bankEnrollment
+		if err := rows.Scan(&e.ID, &e.EFIN, &e.Company, &e.TaxYear, &e.State, &e.PriorBank, &e.Received, &e.Amended, &e.CorrelationId, &e.Confirmation, &e.Status, &e.Reason); err != nil {
+			return nil, err
+		}
+		queued = append(queued, e)
+	}
+	return queued, rows.Err()
+}
+
+// callError is a response other than 2xx from an API we call out to (the
+// bank's here, fulfillment's in events.go).
+type callError struct {
+	API    string
+	Status int
+	Text   string
+}
+
+func (e *callError) Error() string { return e.API + ": " + e.Text }
+
+// isAPIOutage reports whether err means the API itself is in trouble, as
+// opposed to refusing one record.
+func isAPIOutage(err error) bool {
+	apiErr, ok := err.(*callError)
+	if !ok {
+		return true // couldn't reach it at all
+	}
+	return apiErr.Status >= 500 || apiErr.Status == http.StatusRequestTimeout || apiErr.Status == http.StatusTooManyRequests
+}
+
+func (f *bankForwarder) send(e bankEnrollment) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, f.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "ero-"+strconv.FormatInt(e.ID, 10))
+	if e.CorrelationId != "" {
+		req.Header.Set(correlationHeader, e.CorrelationId)
+	}
+	if f.token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.token)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return &callError{API: "bank API", Status: resp.StatusCode, Text: resp.Status}
+	}
+	return nil
+}
+
+// gauges reports how much is waiting for the bank.
+func (f *bankForwarder) gauges() {
+	stmt, err := prepare(f.db, "bank_outbox.depth")
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	var queued, stuck int
+	if err := stmt.QueryRow(f.maxAttempts).Scan(&queued, &stuck); err != nil {
+		if debug {
+			log.Printf("bank outbox depth: %v", err)
+		}
+		return
+	}
+	metricGauge("bank.queue", queued)
+	metricGauge("bank.refused", stuck)
+}
@@ -0,0 +1,189 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every file we load is a batch. The batch row records where the file came
+// from, how it went, and which reference data it was validated against;
+// every ero row it loads carries the batch ID.
+
+// Batch statuses.
+const (
+	batchRunning = "running"
+	batchLoaded  = "loaded"
+	batchFailed  = "failed"
+)
+
+// batchJob is one file being loaded as a batch.
+type batchJob struct {
+	File      inputFile
+	ID        int64        // batch ID, set once the batch row exists
+	ReplayOf  int64        // batch being replayed, or 0
+	Pinned    *refVersions // validate against these instead of current data
+	Ref       *refData
+	Zips      *zipData // see zipdata.go; nil if there is no ZIP data
+	Collate   *collations
+	policies             // the base rules
+	Rulesets  []ruleset  // rules for some dates or years instead (see rules.go)
+	Claim     *fileClaim // held by the caller; loadFile claims the file itself if nil
+	Pace      func()     // if set, called before each record (see quota.go)
+	Shadow    bool       // the copy of a batch written to the shadow (see shadow.go)
+	Canary    *canaryRules
+	Enrichers []Enricher // see enrich.go
+	Trial     bool       // only checks records against canary rules; runs no hooks
+
+	AllowDuplicate bool // load it even if it repeats an earlier file (see duplicates.go)
+	Resumed        bool // a batch started before, picked up again (see ledger.go)
+
+	Correlation string // file correlation ID (see correlation.go); made up if empty
+}
+
+// batchInfo is a batch row as read back from the database.
+type batchInfo struct {
+	ID          int64       `json:"id"`
+	FileName    string      `json:"file"`
+	SHA256      string      `json:"sha256"`
+	Status      string      `json:"status"`
+	Transmitter string      `json:"transmitter"`
+	Records     int         `json:"records"`
+	Loaded      int         `json:"loaded"`
+	Rejected    int         `json:"rejected"`
+	Started     time.Time   `json:"started"`
+	Finished    *time.Time  `json:"finished,omitempty"`
+	Versions    refVersions `json:"refdata"`
+	Correlation string      `json:"correlationId,omitempty"`
+}
+
+// startBatch creates the batch row and returns its ID.
+func startBatch(db *sql.DB, job *batchJob) (int64, error) {
+	stmt, err := prepare(db, "batch.start")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var replayOf interface{}
+	if job.ReplayOf > 0 {
+		replayOf = job.ReplayOf
+	}
+
+	var id int64
+	err = stmt.QueryRow(job.File.Path, job.File.SHA256, len(job.File.Records), time.Now(),
+		job.Ref.Versions.Banks, job.Ref.Versions.EFINs, job.Ref.Versions.Transmitters, job.Ref.Versions.States, replayOf,
+		job.File.Transmitter(), job.File.Arrived, job.Correlation).Scan(&id)
+	return id, err
+}
+
+// finishBatch records the outcome of a batch.
+func finishBatch(db *sql.DB, id int64, status string, summary loadSummary) error {
+	stmt, err := prepare(db, "batch.finish")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(status, len(summary.Loaded)+summary.Earlier, len(summary.Rejected), time.Now(), id)
+	return err
+}
+
+// getBatch reads a batch row.
+func getBatch(db *sql.DB, id int64) (batchInfo, error) {
+	stmt, err := prepare(db, "batch.get")
+	if err != nil {
+		return batchInfo{}, err
+	}
+	defer stmt.Close()
+
+	return scanBatch(stmt.QueryRow(id))
+}
+
+// recentBatches returns the last n batches, newest first.
+func recentBatches(db *sql.DB, n int) ([]batchInfo, error) {
+	stmt, err := prepare(db, "batch.recent")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	batches := []batchInfo{}
+	for rows.Next() {
+		b, err := scanBatch(rows)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, b)
+	}
+	return batches, rows.Err()
+}
+
+// scanBatch reads the columns of batch.get / batch.recent.
+func scanBatch(row interface{ Scan(...interface{}) error }) (batchInfo, error) {
+	var (
+		b                                  batchInfo
+		banks, efins, transmitters, states sql.NullInt64
+		loaded, rejected                   sql.NullInt64
+		transmitter, correlation           sql.NullString
+		finished                           sql.NullTime
+	)
+	err := row.Scan(&b.ID, &b.FileName, &b.SHA256, &b.Status, &banks, &efins, &transmitters, &states,
+		&transmitter, &b.Records, &loaded, &rejected, &b.Started, &finished, &correlation)
+	b.Versions = refVersions{Banks: banks.Int64, EFINs: efins.Int64, Transmitters: transmitters.Int64, States: states.Int64}
+	b.Transmitter, b.Correlation = transmitter.String, correlation.String
+	b.Loaded, b.Rejected = int(loaded.Int64), int(rejected.Int64)
+	if finished.Valid {
+		b.Finished = &finished.Time
+	}
+	return b, err
+}
+
+// registerBatchRoutes adds GET /v1/batches/{id}, the status of a batch.
+// A transmitter sees only its own batches; anyone else's is not found.
+func registerBatchRoutes(mux *http.ServeMux, dbs *databases, limits *rateLimiter) {
+	mux.HandleFunc("/v1/batches/", authorized(limits, func(w http.ResponseWriter, r *http.Request, transmitter string) {
+		if r.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/v1/batches/"), 10, 64)
+		if err != nil {
+			httpError(w, http.StatusNotFound, "not found")
+			return
+		}
+
+		b, err := getBatch(dbs.reader(), id)
+		switch {
+		case err == sql.ErrNoRows, err == nil && b.Transmitter != transmitter:
+			httpError(w, http.StatusNotFound, "no such batch")
+		case err != nil:
+			httpError(w, http.StatusInternalServerError, err.Error())
+		default:
+			writeJSON(w, http.StatusOK, b)
+		}
+	}))
+}
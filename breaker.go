@@ -0,0 +1,134 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// A breaker stops us calling something that keeps failing. After
+// `failures` failures in a row it opens: calls are refused for
+// `cooldown`, then one trial call is let through (half-open). If that
+// succeeds the breaker closes again; if not it stays open for twice as
+// long, up to maxCooldown.
+type breaker struct {
+	name        string
+	failures    int
+	cooldown    time.Duration
+	maxCooldown time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failed   int           // consecutive failures
+	openedAt time.Time     // when it last opened
+	wait     time.Duration // how long it stays open this time
+}
+
+// Breaker states.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+func newBreaker(name string, failures int, cooldown, maxCooldown time.Duration) *breaker {
+	if failures < 1 {
+		failures = 1
+	}
+	if maxCooldown < cooldown {
+		maxCooldown = cooldown
+	}
+	b := &breaker{name: name, failures: failures, cooldown: cooldown, maxCooldown: maxCooldown, state: breakerClosed, wait: cooldown}
+	b.gauge()
+	return b
+}
+
+// allow reports whether a call may be made now.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.wait {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		return true
+	}
+	return false // half-open: the trial call is still out
+}
+
+// success records a call that worked.
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failed = 0
+	b.wait = b.cooldown
+	if b.state != breakerClosed {
+		log.Printf("%s: circuit breaker closed; calls resume\n", b.name)
+		b.setState(breakerClosed)
+	}
+}
+
+// failure records a call that failed.
+func (b *breaker) failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failed++
+	switch {
+	case b.state == breakerHalfOpen:
+		b.wait *= 2
+		if b.wait > b.maxCooldown {
+			b.wait = b.maxCooldown
+		}
+		log.Printf("%s: trial call failed: %v; circuit breaker open for %v", b.name, err, b.wait)
+		b.open()
+	case b.state == breakerClosed && b.failed >= b.failures:
+		log.Printf("%s: %d failures in a row, the last %v; circuit breaker open for %v", b.name, b.failed, err, b.wait)
+		metricCount("breaker.trip", 1, tag("breaker", b.name))
+		b.open()
+	}
+}
+
+func (b *breaker) open() {
+	b.openedAt = time.Now()
+	b.setState(breakerOpen)
+}
+
+// current returns the breaker's state.
+func (b *breaker) current() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *breaker) setState(state string) {
+	b.state = state
+	b.gauge()
+}
+
+// gauge reports the state as 0 (closed), 1 (half-open) or 2 (open).
+func (b *breaker) gauge() {
+	v := map[string]int{breakerClosed: 0, breakerHalfOpen: 1, breakerOpen: 2}[b.state]
+	metricGauge("breaker.state", v, tag("breaker", b.name))
+}
@@ -0,0 +1,386 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// "enroll bulk-update" changes the status of every record matching a
+// filter at once - when a bank partner leaves mid-season, say:
+//
+//	enroll bulk-update --filter 'bank=XYZ AND year=2016' --set status=suspended --reason "bank exited program"
+//
+// The filter is terms joined by AND, each key=value, with the value in
+// quotes if it has spaces; the keys are in bulkFilterKeys. Only records
+// that are loaded, pending or suspended are touched, so a rejected or
+// de-enrolled record stays as it is.
+//
+// It prints how many records would change, by their current status, and
+// asks for that number to be typed back before changing anything (--yes
+// skips the question, --dry-run stops after the counts). The update runs
+// in one transaction and is refused if the count has moved since. Each
+// run is kept in bulk_update (sql/029_bulk_updates.sql) with who, why and
+// the filter, and every row it changed points at it; the row history has
+// the status it had before. Every changed row is queued for the bank
+// API with its new status.
+
+// enrollmentSuspended is the ero status of a record put on hold by a bulk
+// update.
+const enrollmentSuspended = "suspended"
+
+// bulkStatuses are the statuses bulk-update can set.
+var bulkStatuses = []string{enrollmentSuspended, enrollmentInactive, enrollmentLoaded}
+
+// bulkFilterKeys are the keys a filter can use. bank is the bank the
+// office gave (PRIOR_BANK) and transmitter the one that sent its batch.
+var bulkFilterKeys = []string{"bank", "year", "efin", "masterefin", "state", "status", "batch", "transmitter"}
+
+// bulkWhere matches ero e against a bulkFilter (see bulkFilter.args).
+const bulkWhere = `(? = '' OR e.PRIOR_BANK = ?) AND (? = 0 OR e.TAX_YEAR = ?) AND (? = '' OR e.EFIN = ?)
+			AND (? = '' OR e.MASTER_EFIN = ?) AND (? = '' OR e.STATE = ?) AND (? = '' OR e.STATUS = ?) AND (? = 0 OR e.BATCH_ID = ?)
+			AND (? = '' OR EXISTS (SELECT 1 FROM batch b WHERE b.ID = e.BATCH_ID AND b.TRANSMITTER_ID = ?))`
+
+// bulkFilter is a parsed --filter. Empty fields match anything.
+type bulkFilter struct {
+	Bank, EFIN, MasterEFIN, State, Status, Transmitter string
+	Year                                               int
+	Batch                                              int64
+}
+
+// bulkCount is how many matching records have one status.
+type bulkCount struct {
+	Status    string
+	Records   int
+	Forwarded int // already sent to the bank
+}
+
+var (
+	bulkFilterText, bulkSet, bulkReason, bulkBy string
+	bulkDryRun, bulkYes                         bool
+)
+
+var bulkUpdateCmd = &cobra.Command{
+	Use:   "bulk-update",
+	Short: "Change the status of every record matching a filter",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		f, err := parseBulkFilter(bulkFilterText)
+		check(err)
+		status, err := parseBulkSet(bulkSet)
+		check(err)
+		if strings.TrimSpace(bulkReason) == "" {
+			check(fmt.Errorf("--reason is required"))
+		}
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		// The counts come from the primary: they are what the update
+		// will be checked against.
+		counts, err := previewBulkUpdate(dbs.primary, f, status)
+		check(err)
+		total := printBulkPreview(counts, status)
+		if total == 0 || bulkDryRun {
+			return
+		}
+		if !bulkYes {
+			fmt.Printf("Type %d to set %d records to %s: ", total, total, status)
+			in := bufio.NewScanner(os.Stdin)
+			if !in.Scan() || strings.TrimSpace(in.Text()) != strconv.Itoa(total) {
+				fmt.Println("Nothing changed.")
+				return
+			}
+		}
+
+		id, n, err := bulkUpdate(dbs.primary, f, bulkFilterText, status, total, bulkBy, bulkReason)
+		check(err)
+		fmt.Printf("Bulk update %d by %s: %d records set to %s\n", id, bulkBy, n, status)
+	},
+}
+
+func init() {
+	bulkUpdateCmd.Flags().StringVar(&bulkFilterText, "filter", "", "which records, e.g. 'bank=XYZ AND year=2016'")
+	bulkUpdateCmd.Flags().StringVar(&bulkSet, "set", "", "the change, status=suspended|inactive|loaded")
+	bulkUpdateCmd.Flags().StringVar(&bulkReason, "reason", "", "why they are changing")
+	bulkUpdateCmd.Flags().StringVar(&bulkBy, "by", currentUser(), "who is changing them")
+	bulkUpdateCmd.Flags().BoolVar(&bulkDryRun, "dry-run", false, "show what would change without changing anything")
+	bulkUpdateCmd.Flags().BoolVar(&bulkYes, "yes", false, "don't ask for the record count")
+	rootCmd.AddCommand(bulkUpdateCmd)
+}
+
+// parseBulkFilter parses a --filter. It must have at least one term: a
+// bulk update of everything is a mistake.
+func parseBulkFilter(s string) (bulkFilter, error) {
+	var f bulkFilter
+	terms, err := splitBulkTerms(s)
+	if err != nil {
+		return f, err
+	}
+	if len(terms) == 0 {
+		return f, fmt.Errorf("--filter is required")
+	}
+	seen := map[string]bool{}
+	for _, term := range terms {
+		i := strings.Index(term, "=")
+		if i < 0 {
+			return f, fmt.Errorf("filter term %q is not key=value", term)
+		}
+		key, value := strings.ToLower(strings.TrimSpace(term[:i])), unquote(strings.TrimSpace(term[i+1:]))
+		if !containsString(bulkFilterKeys, key) {
+			return f, fmt.Errorf("unknown filter key %q (use %s)", key, strings.Join(bulkFilterKeys, ", "))
+		}
+		if seen[key] {
+			return f, fmt.Errorf("filter key %q given twice", key)
+		}
+		seen[key] = true
+		if value == "" {
+			return f, fmt.Errorf("filter key %q has no value", key)
+		}
+
+		switch key {
+		case "bank":
+			f.Bank = value
+		case "efin":
+			f.EFIN = value
+		case "masterefin":
+			f.MasterEFIN = value
+		case "state":
+			f.State = strings.ToUpper(value)
+		case "status":
+			f.Status = strings.ToLower(value)
+		case "transmitter":
+			f.Transmitter = value
+		case "year":
+			if f.Year, err = strconv.Atoi(value); err != nil {
+				return f, fmt.Errorf("year must be a number (got %q)", value)
+			}
+		case "batch":
+			if f.Batch, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return f, fmt.Errorf("batch must be a number (got %q)", value)
+			}
+		}
+	}
+	return f, nil
+}
+
+// splitBulkTerms splits a filter on AND (any case), leaving quoted values
+// alone.
+func splitBulkTerms(s string) ([]string, error) {
+	var terms []string
+	var quote rune
+	start := 0
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case (i == 0 || s[i-1] == ' ') && len(s) >= i+4 && strings.EqualFold(s[i:i+3], "AND") && s[i+3] == ' ':
+			terms = append(terms, s[start:i])
+			start = i + 3
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unclosed %c in filter", quote)
+	}
+	terms = append(terms, s[start:])
+
+	var out []string
+	for _, t := range terms {
+		if t = strings.TrimSpace(t); t == "" {
+			if len(terms) > 1 {
+				return nil, fmt.Errorf("empty term in filter %q", s)
+			}
+			continue
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// parseBulkSet parses --set, which can only change the status for now.
+func parseBulkSet(s string) (string, error) {
+	i := strings.Index(s, "=")
+	if i < 0 || !strings.EqualFold(strings.TrimSpace(s[:i]), "status") {
+		return "", fmt.Errorf("--set must be status=%s", strings.Join(bulkStatuses, "|"))
+	}
+	status := strings.ToLower(unquote(strings.TrimSpace(s[i+1:])))
+	if containsString(bulkStatuses, status) {
+		return status, nil
+	}
+	return "", fmt.Errorf("status must be one of %s (got %q)", strings.Join(bulkStatuses, ", "), status)
+}
+
+// args are the filter's arguments for the bulk statements. The plain SQL
+// takes each twice: to see if it is set, then to match it.
+func (f bulkFilter) args() []interface{} {
+	values := []interface{}{f.Bank, f.Year, f.EFIN, f.MasterEFIN, f.State, f.Status, f.Batch, f.Transmitter}
+	if viper.GetBool("mssql.storedprocedures") {
+		return values
+	}
+	var args []interface{}
+	for _, v := range values {
+		args = append(args, v, v)
+	}
+	return args
+}
+
+// previewBulkUpdate counts the records setting status would change, by
+// their current status.
+func previewBulkUpdate(db *sql.DB, f bulkFilter, status string) ([]bulkCount, error) {
+	stmt, err := prepare(db, "ero.bulk_preview")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(append([]interface{}{status}, f.args()...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []bulkCount
+	for rows.Next() {
+		var c bulkCount
+		if err := rows.Scan(&c.Status, &c.Records, &c.Forwarded); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// printBulkPreview prints the counts and returns the total.
+func printBulkPreview(counts []bulkCount, status string) int {
+	total := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, c := range counts {
+		fmt.Fprintf(w, "%s -> %s\t%d\t(%d already sent to the bank)\n", c.Status, status, c.Records, c.Forwarded)
+		total += c.Records
+	}
+	check(w.Flush())
+	fmt.Printf("%d records to set to %s\n", total, status)
+	return total
+}
+
+// bulkUpdate sets the status of the records f matches and records the run
+// in bulk_update, all in one transaction. It fails, changing nothing, if
+// the number of records isn't expect any more.
+func bulkUpdate(db *sql.DB, f bulkFilter, filter, status string, expect int, by, reason string) (int64, int, error) {
+	level, err := isolationLevel(db)
+	if err != nil {
+		return 0, 0, err
+	}
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: level})
+	if err != nil {
+		return 0, 0, err
+	}
+	id, rows, err := bulkUpdateTx(tx, f, filter, status, by, reason)
+	if err == nil && len(rows) != expect {
+		err = fmt.Errorf("%d records match now, not %d; run it again to see what changed", len(rows), expect)
+	}
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return 0, 0, fmt.Errorf("bulk update: %v (and rollback failed: %v)", err, rbErr)
+		}
+		return 0, 0, fmt.Errorf("bulk update: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	metricCount("bulk_update.records", len(rows), tag("status", status))
+	return id, len(rows), nil
+}
+
+func bulkUpdateTx(tx *sql.Tx, f bulkFilter, filter, status, by, reason string) (int64, []int64, error) {
+	stmt, err := prepare(tx, "bulk_update.add")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer stmt.Close()
+	var id int64
+	err = stmt.QueryRow(truncate(filter, 400), status, truncate(reason, 400), truncate(by, 100), time.Now()).Scan(&id)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	update, err := prepare(tx, "ero.bulk_update")
+	if err != nil {
+		return id, nil, err
+	}
+	defer update.Close()
+	args := []interface{}{status, id}
+	if !viper.GetBool("mssql.storedprocedures") {
+		args = append(args, status) // for STATUS <> ?
+	}
+	rows, err := update.Query(append(args, f.args()...)...)
+	if err != nil {
+		return id, nil, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var row int64
+		if err := rows.Scan(&row); err != nil {
+			rows.Close()
+			return id, nil, err
+		}
+		ids = append(ids, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return id, nil, err
+	}
+
+	// The rows have to be read before anything else runs on tx.
+	for _, row := range ids {
+		if err := queueForBank(tx, row); err != nil {
+			return id, nil, err
+		}
+	}
+	_, err = execStatement(tx, "bulk_update.finish", len(ids), id)
+	return id, ids, err
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseBulkFilter(t *testing.T) {
+	tests := []struct {
+		filter  string
+		want    bulkFilter
+		wantErr string // in the error, if it fails
+	}{
+		{filter: "bank=XYZ AND year=2016", want: bulkFilter{Bank: "XYZ", Year: 2016}},
+		{filter: "bank=XYZ and year=2016", want: bulkFilter{Bank: "XYZ", Year: 2016}},
+		{filter: " Bank = XYZ ", want: bulkFilter{Bank: "XYZ"}},
+		{filter: `bank="Bank AND Trust" AND state=ca`, want: bulkFilter{Bank: "Bank AND Trust", State: "CA"}},
+		{filter: `bank='Smith=Jones'`, want: bulkFilter{Bank: "Smith=Jones"}},
+		{filter: "status=Pending AND batch=42", want: bulkFilter{Status: "pending", Batch: 42}},
+		{filter: "efin=123456 AND masterefin=100000 AND transmitter=77777",
+			want: bulkFilter{EFIN: "123456", MasterEFIN: "100000", Transmitter: "77777"}},
+		{filter: "brand=XYZ", wantErr: `unknown filter key "brand"`},
+		{filter: "", wantErr: "--filter is required"},
+		{filter: "   ", wantErr: "--filter is required"},
+		{filter: "bank", wantErr: `filter term "bank" is not key=value`},
+		{filter: "color=red", wantErr: `unknown filter key "color"`},
+		{filter: "bank=A AND BANK=B", wantErr: `filter key "bank" given twice`},
+		{filter: "bank=", wantErr: `filter key "bank" has no value`},
+		{filter: "bank=''", wantErr: `filter key "bank" has no value`},
+		{filter: "year=last", wantErr: `year must be a number (got "last")`},
+		{filter: "batch=1.5", wantErr: `batch must be a number (got "1.5")`},
+		{filter: `bank="XYZ`, wantErr: `unclosed " in filter`},
+		{filter: "bank=XYZ AND  AND year=2016", wantErr: "empty term in filter"},
+		{filter: "bank=XYZ AND ", wantErr: "empty term in filter"},
+	}
+	for _, tt := range tests {
+		f, err := parseBulkFilter(tt.filter)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%q: got %+v, %v; want an error with %q", tt.filter, f, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.filter, err)
+			continue
+		}
+		if f != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.filter, f, tt.want)
+		}
+	}
+}
+
+func TestSplitBulkTerms(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"a=1", []string{"a=1"}},
+		{"a=1 AND b=2", []string{"a=1", "b=2"}},
+		{"a=1 And b=2", []string{"a=1", "b=2"}},
+		{"brand=1 AND band=2", []string{"brand=1", "band=2"}},
+		{"a=ANDREW AND b=2", []string{"a=ANDREW", "b=2"}},
+		{"a='x AND y'", []string{"a='x AND y'"}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got, err := splitBulkTerms(tt.filter)
+		if err != nil {
+			t.Errorf("%q: %v", tt.filter, err)
+			continue
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestParseBulkSet(t *testing.T) {
+	tests := []struct {
+		set     string
+		want    string
+		wantErr bool
+	}{
+		{"status=suspended", "suspended", false},
+		{" Status = 'Inactive' ", "inactive", false},
+		{"status=loaded", "loaded", false},
+		{"status=rejected", "", true},
+		{"bank=XYZ", "", true},
+		{"suspended", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseBulkSet(tt.set)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%q: got %q, %v; want %q", tt.set, got, err, tt.want)
+		}
+	}
+}
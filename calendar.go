@@ -0,0 +1,250 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Transmitters that deliver on a schedule can be given a delivery
+// calendar, calendar.transmitters.<id>:
+//
+//	{"days": ["mon", "tue", "wed", "thu", "fri"], "times": ["09:00", "15:00"], "grace": "1h"}
+//
+// (local time; every day if days is empty; grace defaults to
+// calendar.grace, 1h). Every calendar.checkevery (5m) "enroll serve" pages
+// (see incidents.go) for each expected delivery that hasn't arrived within
+// grace of its time, and resolves the page when a file from that
+// transmitter turns up. A file that arrives outside every window - early,
+// or on a day nothing was expected - is logged and reported to
+// notify.email.to and notify.slack.webhook as unexpected, but still loaded.
+func init() {
+	viper.SetDefault("calendar.grace", "1h")
+	viper.SetDefault("calendar.checkevery", "5m")
+}
+
+// deliveryCalendar is a calendar.transmitters entry.
+type deliveryCalendar struct {
+	Days  []string
+	Times []string
+	Grace string
+}
+
+// transmitterCalendar is a parsed delivery calendar.
+type transmitterCalendar struct {
+	days  map[time.Weekday]bool // empty means every day
+	times [][2]int              // hour, minute
+	grace time.Duration
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// loadCalendars reads calendar.transmitters.
+func loadCalendars() (map[string]*transmitterCalendar, error) {
+	var configured map[string]deliveryCalendar
+	if err := viper.UnmarshalKey("calendar.transmitters", &configured); err != nil {
+		return nil, fmt.Errorf("config: calendar.transmitters: %v", err)
+	}
+
+	calendars := map[string]*transmitterCalendar{}
+	for id, dc := range configured {
+		c := &transmitterCalendar{days: map[time.Weekday]bool{}}
+		for _, d := range dc.Days {
+			d = strings.ToLower(d)
+			if len(d) > 3 {
+				d = d[:3] // "Monday" as well as "mon"
+			}
+			wd, ok := weekdays[d]
+			if !ok {
+				return nil, fmt.Errorf("config: calendar.transmitters.%s: unknown day %q", id, d)
+			}
+			c.days[wd] = true
+		}
+		for _, t := range dc.Times {
+			at, err := time.Parse("15:04", t)
+			if err != nil {
+				return nil, fmt.Errorf("config: calendar.transmitters.%s: bad time %q", id, t)
+			}
+			c.times = append(c.times, [2]int{at.Hour(), at.Minute()})
+		}
+		if len(c.times) == 0 {
+			return nil, fmt.Errorf("config: calendar.transmitters.%s: no times", id)
+		}
+		grace := dc.Grace
+		if grace == "" {
+			grace = viper.GetString("calendar.grace")
+		}
+		var err error
+		if c.grace, err = time.ParseDuration(grace); err != nil {
+			return nil, fmt.Errorf("config: calendar.transmitters.%s: grace: %v", id, err)
+		}
+		calendars[id] = c
+	}
+	return calendars, nil
+}
+
+// slots returns the expected deliveries from from to to, in order.
+func (c *transmitterCalendar) slots(from, to time.Time) []time.Time {
+	from, to = from.In(time.Local), to.In(time.Local)
+	var slots []time.Time
+	for d := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.Local); !d.After(to); d = d.AddDate(0, 0, 1) {
+		if len(c.days) > 0 && !c.days[d.Weekday()] {
+			continue
+		}
+		for _, hm := range c.times {
+			at := time.Date(d.Year(), d.Month(), d.Day(), hm[0], hm[1], 0, 0, time.Local)
+			if !at.Before(from) && !at.After(to) {
+				slots = append(slots, at)
+			}
+		}
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].Before(slots[j]) })
+	return slots
+}
+
+// expected reports whether a file arriving at t is within grace of an
+// expected delivery.
+func (c *transmitterCalendar) expected(t time.Time) bool {
+	return len(c.slots(t.Add(-c.grace), t.Add(c.grace))) > 0
+}
+
+// next returns the first expected delivery after t, if there is one in
+// the coming week.
+func (c *transmitterCalendar) next(t time.Time) (time.Time, bool) {
+	slots := c.slots(t, t.AddDate(0, 0, 8))
+	if len(slots) == 0 {
+		return time.Time{}, false
+	}
+	return slots[0], true
+}
+
+// checkArrival reports a file that doesn't match its transmitter's
+// calendar.
+func checkArrival(calendars map[string]*transmitterCalendar, f inputFile) {
+	c := calendars[f.Transmitter()]
+	if c == nil || f.Arrived.IsZero() || c.expected(f.Arrived) {
+		return
+	}
+
+	arrived := f.Arrived.In(time.Local)
+	text := fmt.Sprintf("Unexpected file %s from transmitter %s: arrived %s, not within %s of an expected delivery",
+		filepath.Base(f.Path), f.Transmitter(), arrived.Format("Mon 2006-01-02 15:04"), c.grace)
+	if next, ok := c.next(arrived); ok {
+		text += fmt.Sprintf(" (next expected %s)", next.Format("Mon 2006-01-02 15:04"))
+	}
+	log.Println(text)
+	metricCount("calendar.unexpected", 1, tag("transmitter", f.Transmitter()))
+	notifyOps("enroll: unexpected file from "+f.Transmitter(), text)
+}
+
+// calendarWatch remembers which missing deliveries we've paged for. It is
+// only used from the watcher's loop.
+type calendarWatch struct {
+	calendars map[string]*transmitterCalendar
+	paged     map[string]time.Time // dedup key -> expected time
+}
+
+// calendarLookback is how far back we look for missed deliveries.
+const calendarLookback = 24 * time.Hour
+
+// check pages for expected deliveries that haven't arrived, and resolves
+// the pages for those that since have.
+func (cw *calendarWatch) check(db *sql.DB, now time.Time) {
+	for id, c := range cw.calendars {
+		// Deliveries whose window closed in the lookback period.
+		slots := c.slots(now.Add(-calendarLookback-c.grace), now.Add(-c.grace))
+		if len(slots) == 0 {
+			continue
+		}
+		arrivals, err := arrivalsSince(db, id, slots[0].Add(-c.grace))
+		if err != nil {
+			log.Printf("checking deliveries from %s: %v", id, err)
+			continue
+		}
+
+		for _, at := range slots {
+			dedup := "enroll-missing-" + id + "-" + at.Format("200601021504")
+			var arrived bool
+			for _, a := range arrivals {
+				if !a.Before(at.Add(-c.grace)) {
+					arrived = true
+					break
+				}
+			}
+			_, paged := cw.paged[dedup]
+			switch {
+			case arrived && paged:
+				log.Printf("The %s delivery from %s has arrived\n", at.Format("Mon 15:04"), id)
+				resolveIncident(dedup)
+				delete(cw.paged, dedup)
+			case !arrived && !paged:
+				summary := fmt.Sprintf("enroll: missing file from %s, expected %s (grace %s)", id, at.Format("Mon 2006-01-02 15:04"), c.grace)
+				log.Println(summary)
+				metricCount("calendar.missing", 1, tag("transmitter", id))
+				triggerIncident(dedup, summary, map[string]interface{}{
+					"transmitter": id,
+					"expected":    at.Format(time.RFC3339),
+					"grace":       c.grace.String(),
+				})
+				cw.paged[dedup] = at
+			}
+		}
+	}
+
+	// Forget pages too old to be checked again; they stay open for a
+	// person to close.
+	for dedup, at := range cw.paged {
+		if now.Sub(at) > 2*calendarLookback {
+			delete(cw.paged, dedup)
+		}
+	}
+}
+
+// arrivalsSince returns when files from the transmitter arrived since t.
+func arrivalsSince(db *sql.DB, transmitter string, t time.Time) ([]time.Time, error) {
+	stmt, err := prepare(db, "batch.arrivals")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(transmitter, t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var arrivals []time.Time
+	for rows.Next() {
+		var a time.Time
+		if err := rows.Scan(&a); err != nil {
+			return nil, err
+		}
+		arrivals = append(arrivals, a.In(time.Local))
+	}
+	return arrivals, rows.Err()
+}
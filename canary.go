@@ -0,0 +1,290 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Canary rules let compliance see what a rule change would do before it
+// is switched on. "canary.rules" names a config file holding just the
+// sections that change - any of risk, defaults, empty, lengths,
+// conflicts, prioryear and pricing - and everything it leaves out is as
+// configured now. Every enrollment is then checked against those rules
+// too, right after the real check and against the same database state
+// (see checkRecord in load.go), and where the canary would have decided
+// differently - loaded, pending review or rejected, and with which error
+// codes or review flags - it is recorded (sql/026_canary.sql) under
+// "canary.name" (default: the file's name). Nothing the canary decides
+// touches the record.
+//
+// The file is read again for every batch, so it can be edited between
+// batches; one that doesn't load is logged and ignored. Hooks don't run
+// for the canary, so records a hook rejected aren't compared.
+// "enroll report canary" sums up the differences.
+func init() {
+	viper.SetDefault("canary.rules", "")
+	viper.SetDefault("canary.name", "")
+}
+
+// canaryRules is the canary's own set of policies.
+type canaryRules struct {
+	Name string
+	job  *batchJob // with Trial set
+}
+
+// canaryDelta is a record the canary would have decided differently.
+type canaryDelta struct {
+	Index        int
+	EFIN         string
+	Active       string // loaded, pending or rejected
+	ActiveDetail string // error codes or review flags
+	Canary       string
+	CanaryDetail string
+}
+
+// canarySummary is how the canary did on a batch.
+type canarySummary struct {
+	Checked int
+	Deltas  []canaryDelta
+}
+
+// add counts a record the canary checked, if it could (ok).
+func (s *canarySummary) add(d canaryDelta, ok bool) {
+	if !ok {
+		return
+	}
+	s.Checked++
+	if d.Active != d.Canary || d.ActiveDetail != d.CanaryDetail {
+		s.Deltas = append(s.Deltas, d)
+	}
+}
+
+// loadCanary reads the canary rules for job, if there are any.
+func loadCanary(db, reader *sql.DB, job *batchJob, versions refVersions) *canaryRules {
+	path := viper.GetString("canary.rules")
+	if path == "" {
+		return nil
+	}
+	name := viper.GetString("canary.name")
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	// The canary is one set of rules: rules.sets doesn't apply to it.
+	c := &canaryRules{Name: truncate(name, 100), job: &batchJob{File: job.File, Correlation: job.Correlation, Trial: true}}
+	cfg, err := overlayConfig(path) // see rules.go
+	if err == nil {
+		cfg.Set("rules.sets", []interface{}{})
+		err = loadPolicies(cfg, db, reader, c.job, versions)
+	}
+	if err != nil {
+		job.logf("canary rules %s not used: %v", path, err)
+		return nil
+	}
+	return c
+}
+
+// try checks record i against the canary rules and says how that
+// compares with active, the real check. ok is false if it couldn't say.
+func (c *canaryRules) try(p preparer, i int, active recordCheck) (d canaryDelta, ok bool) {
+	for _, e := range active.Problems {
+		if e.Code == errHookRejected {
+			return d, false
+		}
+	}
+
+	e := c.job.File.Records[i]
+	trial, err := c.job.checkRecord(p, i, &e)
+	if err != nil {
+		c.job.logRecordf(i, "canary %s: record %d: %v", c.Name, i, err)
+		return d, false
+	}
+	d = canaryDelta{Index: i, EFIN: e.EFIN}
+	d.Active, d.ActiveDetail = checkOutcome(active)
+	d.Canary, d.CanaryDetail = checkOutcome(trial)
+	return d, true
+}
+
+// checkOutcome is what a check would make of a record, and why.
+func checkOutcome(c recordCheck) (string, string) {
+	switch {
+	case len(c.Problems) > 0:
+		seen := map[string]bool{}
+		var codes []string
+		for _, e := range c.Problems {
+			if !seen[e.Code] {
+				seen[e.Code] = true
+				codes = append(codes, e.Code)
+			}
+		}
+		sort.Strings(codes)
+		return enrollmentRejected, strings.Join(codes, ",")
+	case len(c.Review) > 0:
+		return enrollmentPending, strings.Join(c.Review, "; ")
+	}
+	return enrollmentLoaded, ""
+}
+
+// recordCanary writes how the canary did on the batch.
+func recordCanary(db *sql.DB, job *batchJob, summary loadSummary) error {
+	if job.Canary == nil || summary.Canary.Checked == 0 {
+		return nil
+	}
+	transmitter := nullString(job.File.Transmitter())
+
+	var deltas []canaryDelta
+	seen := map[int]bool{} // a record retried after a failover is tried twice
+	for _, d := range summary.Canary.Deltas {
+		if !seen[d.Index] {
+			seen[d.Index] = true
+			deltas = append(deltas, d)
+		}
+	}
+
+	now := time.Now()
+	checked := summary.Canary.Checked
+	if n := len(job.File.Records); checked > n {
+		checked = n
+	}
+	if _, err := execStatement(db, "canary.run_add", job.ID, job.Canary.Name, transmitter, checked, len(deltas), now); err != nil {
+		return err
+	}
+
+	stmt, err := prepare(db, "canary.result_add")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, d := range deltas {
+		if _, err := stmt.Exec(job.ID, job.Canary.Name, transmitter, d.Index, nullString(d.EFIN),
+			d.Active, nullString(truncate(d.ActiveDetail, 400)), d.Canary, nullString(truncate(d.CanaryDetail, 400)), now); err != nil {
+			return err
+		}
+	}
+
+	metricCount("canary.changed", len(deltas), tag("canary", job.Canary.Name))
+	job.logf("Canary %s: %d of %d record(s) would have come out differently\n", job.Canary.Name, len(deltas), checked)
+	return nil
+}
+
+// ---------------------------------------------------------------------
+// enroll report canary
+
+var (
+	canaryTransmitter string
+	canarySince       string
+	canaryRecords     bool
+)
+
+var canaryReportCmd = &cobra.Command{
+	Use:   "canary",
+	Short: "What canary rules would have decided differently",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		since, err := time.Parse("2006-01-02", canarySince)
+		if err != nil {
+			check(fmt.Errorf("--since: %v", err))
+		}
+
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+		db := dbs.reader()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "CANARY\tBATCHES\tCHECKED\tCHANGED")
+		queryRows(db, "canary.runs", func(rows *sql.Rows) {
+			var (
+				name                      string
+				batches, checked, changed int
+			)
+			check(rows.Scan(&name, &batches, &checked, &changed))
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", name, batches, checked, changed)
+		}, since, canaryTransmitter, canaryTransmitter)
+		check(w.Flush())
+
+		fmt.Println()
+		fmt.Fprintln(w, "CANARY\tACTIVE\tCANARY\tRECORDS")
+		queryRows(db, "canary.changes", func(rows *sql.Rows) {
+			var (
+				name, active, trial string
+				n                   int
+			)
+			check(rows.Scan(&name, &active, &trial, &n))
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", name, active, trial, n)
+		}, since, canaryTransmitter, canaryTransmitter)
+		check(w.Flush())
+
+		if !canaryRecords {
+			return
+		}
+		fmt.Println()
+		fmt.Fprintln(w, "CANARY\tWHEN\tTRANSMITTER\tBATCH\tRECORD\tEFIN\tACTIVE\tCANARY")
+		queryRows(db, "canary.list", func(rows *sql.Rows) {
+			var (
+				when                                                     time.Time
+				name, transmitter, efin, active, aDetail, trial, cDetail string
+				batch                                                    int64
+				index                                                    int
+			)
+			check(rows.Scan(&when, &name, &transmitter, &batch, &index, &efin, &active, &aDetail, &trial, &cDetail))
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\n", name, when.Format("2006-01-02 15:04"), transmitter, batch, index, efin,
+				outcomeText(active, aDetail), outcomeText(trial, cDetail))
+		}, since, canaryTransmitter, canaryTransmitter)
+		check(w.Flush())
+	},
+}
+
+// queryRows runs a catalog query and calls fn for each row.
+func queryRows(db *sql.DB, name string, fn func(*sql.Rows), args ...interface{}) {
+	stmt, err := prepare(db, name)
+	check(err)
+	defer stmt.Close()
+
+	rows, err := stmt.Query(args...)
+	check(err)
+	defer rows.Close()
+	for rows.Next() {
+		fn(rows)
+	}
+	check(rows.Err())
+}
+
+func outcomeText(outcome, detail string) string {
+	if detail == "" {
+		return outcome
+	}
+	return outcome + " (" + detail + ")"
+}
+
+func init() {
+	yearStart := time.Date(time.Now().Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	canaryReportCmd.Flags().StringVar(&canaryTransmitter, "transmitter", "", "only this transmitter ID")
+	canaryReportCmd.Flags().StringVar(&canarySince, "since", yearStart.Format("2006-01-02"), "first day to include (YYYY-MM-DD)")
+	canaryReportCmd.Flags().BoolVar(&canaryRecords, "records", false, "list every record that would have differed")
+	reportCmd.AddCommand(canaryReportCmd)
+}
@@ -0,0 +1,148 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+//go:build chaos
+
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// A build with -tags chaos fails things on purpose, at random, so a
+// staging loader left running shows whether retries, checkpoints,
+// rollbacks and the ledger (ledger.go) do what they should:
+//
+//	chaos.db.failrate       share of statements that fail (0.01)
+//	chaos.db.badconn        share of those that fail as a lost connection,
+//	                        so the load reconnects and resumes; the rest
+//	                        fail as the statement's own error (0.5)
+//	chaos.input.truncaterate  share of files read that are cut short at a
+//	                        random byte (0.05)
+//	chaos.bank.delayrate    share of bank API calls held up (0.2)
+//	chaos.bank.maxdelay     for up to this long; longer than
+//	                        bank.api.timeout makes the call time out (45s)
+//	chaos.seed              for the same faults run after run (0: random)
+//
+// Every fault is logged and counted in the chaos.injected metric, by
+// fault. The build without the tag has none of this (chaos_off.go).
+func init() {
+	viper.SetDefault("chaos.db.failrate", 0.01)
+	viper.SetDefault("chaos.db.badconn", 0.5)
+	viper.SetDefault("chaos.input.truncaterate", 0.05)
+	viper.SetDefault("chaos.bank.delayrate", 0.2)
+	viper.SetDefault("chaos.bank.maxdelay", "45s")
+	viper.SetDefault("chaos.seed", 0)
+}
+
+// errChaos is a statement failed on purpose.
+var errChaos = errors.New("chaos: statement failed on purpose")
+
+var chaos struct {
+	once sync.Once
+	sync.Mutex
+	rand *rand.Rand
+}
+
+// chance reports true with probability p.
+func chance(p float64) bool {
+	chaos.once.Do(func() {
+		seed := viper.GetInt64("chaos.seed")
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		log.Printf("chaos build: injecting faults (seed %d)", seed)
+		chaos.rand = rand.New(rand.NewSource(seed))
+	})
+	if p <= 0 {
+		return false
+	}
+	chaos.Lock()
+	defer chaos.Unlock()
+	return chaos.rand.Float64() < p
+}
+
+// randomUpTo is a random duration in [0, max), or 0.
+func randomUpTo(max int64) int64 {
+	if max <= 0 {
+		return 0
+	}
+	chaos.Lock()
+	defer chaos.Unlock()
+	return chaos.rand.Int63n(max)
+}
+
+func injected(fault, format string, args ...interface{}) {
+	log.Printf("chaos: "+format, args...)
+	metricCount("chaos.injected", 1, tag("fault", fault))
+}
+
+// chaosStatement is the error statement name fails with, if it is to.
+func chaosStatement(name string) error {
+	if !chance(viper.GetFloat64("chaos.db.failrate")) {
+		return nil
+	}
+	if chance(viper.GetFloat64("chaos.db.badconn")) {
+		injected("db.badconn", "%s: lost connection", name)
+		return driver.ErrBadConn
+	}
+	injected("db.error", "%s: failed", name)
+	return errChaos
+}
+
+// chaosInput is r, or r cut short at a random byte.
+func chaosInput(path string, r io.Reader, size int64) io.Reader {
+	if !chance(viper.GetFloat64("chaos.input.truncaterate")) {
+		return r
+	}
+	n := randomUpTo(size)
+	injected("input.truncate", "%s: cut short at byte %d of %d", path, n, size)
+	return io.LimitReader(r, n)
+}
+
+// chaosTransport is rt, holding up some requests first.
+func chaosTransport(rt http.RoundTripper) http.RoundTripper {
+	return chaosRoundTripper{rt}
+}
+
+type chaosRoundTripper struct {
+	rt http.RoundTripper
+}
+
+func (c chaosRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if chance(viper.GetFloat64("chaos.bank.delayrate")) {
+		max, err := configDuration("chaos.bank.maxdelay")
+		if err != nil {
+			return nil, err
+		}
+		d := time.Duration(randomUpTo(int64(max)))
+		injected("bank.delay", "%s: held up %s", req.URL.Host, d)
+		select {
+		case <-time.After(d):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	return c.rt.RoundTrip(req)
+}
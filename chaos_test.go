@@ -0,0 +1,85 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+//go:build chaos
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// chaosRecords is how many records each TestChaos file has, and
+// chaosAttempts how many times a file is loaded before giving up on it.
+const (
+	chaosRecords  = 10
+	chaosAttempts = 40
+)
+
+// TestChaos loads files with statements failing and files being cut short
+// at random (chaos.go), in each transaction mode, running the loader
+// again after each failure as the watcher would, until the file loads.
+// Then every record must be in the database once: none lost, none twice.
+// Records aren't quarantined and savepoints are off, so a fault fails
+// the load rather than rejecting a good record. Like TestCrashAndRestart
+// it needs ENROLL_TEST_CONFIG; run it with "go test -tags chaos".
+func TestChaos(t *testing.T) {
+	for m, mode := range []string{"none", "file", "batch"} {
+		mode, n := mode, 900+m
+		t.Run(mode, func(t *testing.T) {
+			dir := testLoader(t, map[string]interface{}{
+				"transaction": mode,
+				"batchsize":   3,
+				"savepoints":  false,
+				"quarantine":  map[string]interface{}{"enabled": false},
+			})
+			chaosConfig(t, dir)
+			path := filepath.Join(dir, fmt.Sprintf("chaos-%s.xml", mode))
+			efins := writeTestFile(t, path, n, chaosRecords)
+
+			failed := 0
+			for runEnroll(t, dir, path) != 0 {
+				if failed++; failed == chaosAttempts {
+					t.Fatalf("%s didn't load in %d attempts", path, chaosAttempts)
+				}
+			}
+			t.Logf("%s loaded after %d failed attempts", path, failed)
+			checkLoadedOnce(t, path, efins)
+		})
+	}
+}
+
+// chaosConfig adds the faults to the loader's config in dir. This process
+// reads the config too, to check the results; it gets none.
+func chaosConfig(t *testing.T, dir string) {
+	t.Helper()
+	faults := map[string]interface{}{
+		"db":    map[string]interface{}{"failrate": 0.01, "badconn": 0.5},
+		"input": map[string]interface{}{"truncaterate": 0.2},
+		"bank":  map[string]interface{}{"delayrate": 0},
+	}
+	path := filepath.Join(dir, "config", "config.json")
+	config := readTestConfig(t, path)
+	config["chaos"] = faults
+	writeTestConfig(t, path, config)
+
+	viper.Set("chaos.db.failrate", 0)
+	viper.Set("chaos.input.truncaterate", 0)
+	viper.Set("chaos.bank.delayrate", 0)
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json" // https://golang.org/pkg/encoding/json/
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// A checkpoint records how far we got through a file, so a load that was
+// interrupted (by a failover, or by the process being killed) picks up
+// where it left off instead of inserting the same records twice.
+//
+// Checkpoints are keyed by the SHA-256 of the file contents, not its name:
+// a vendor re-sending a corrected file under the same name starts over.
+// They are written every "load.checkpointevery" committed records and
+// removed once the file is done, encrypted if storage.key is set.
+func init() {
+	viper.SetDefault("load.checkpointdir", "./checkpoints")
+	viper.SetDefault("load.checkpointevery", 100)
+}
+
+type checkpoint struct {
+	File        string      `json:"file"`
+	SHA256      string      `json:"sha256"`
+	Batch       int64       `json:"batch"` // batch we are resuming
+	Versions    refVersions `json:"refdata"`
+	Next        int         `json:"next"` // index of the first record not yet committed
+	Correlation string      `json:"correlation"`
+	Updated     time.Time   `json:"updated"`
+}
+
+func checkpointPath(sum string) string {
+	return filepath.Join(viper.GetString("load.checkpointdir"), sum+".json")
+}
+
+// openCheckpoint returns the saved checkpoint for a file, or a fresh one
+// starting at record 0.
+func openCheckpoint(f inputFile) checkpoint {
+	cp := checkpoint{File: f.Path, SHA256: f.SHA256}
+
+	b, err := readSealed(checkpointPath(f.SHA256))
+	if err != nil {
+		return cp
+	}
+	var saved checkpoint
+	if json.Unmarshal(b, &saved) != nil || saved.SHA256 != f.SHA256 {
+		return cp
+	}
+	return saved
+}
+
+// save writes the checkpoint atomically (write then rename) so a crash
+// can't leave a half-written file behind.
+func (cp *checkpoint) save() error {
+	cp.Updated = time.Now()
+
+	if err := os.MkdirAll(viper.GetString("load.checkpointdir"), 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	path := checkpointPath(cp.SHA256)
+	if err := writeSealed(path+".tmp", b, 0600); err != nil { // see atrest.go
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (cp *checkpoint) remove() error {
+	err := os.Remove(checkpointPath(cp.SHA256))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,271 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json" // https://golang.org/pkg/encoding/json/
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// "enroll check-record record.xml" runs one record through the checks a
+// load would (checkRecord in load.go), against the database as it is now,
+// and prints what each rule made of it, so a vendor or support can see
+// why a record is rejected without loading a file. The record is the
+// first in the file, or --record N; with --inline it is given as JSON
+// instead, with the XML element names:
+//
+//	enroll check-record --inline '{"EFIN": "123456", "OfficeInfo": {"Email": "a@example.com"}}'
+//
+// Nothing is written and hooks don't run. It exits 1 if the record would
+// be rejected.
+
+var (
+	checkRecordInline string
+	checkRecordIndex  int
+)
+
+// Results of a rule, as check-record prints them.
+const (
+	rulePass    = "pass"
+	ruleFail    = "fail"
+	ruleWarn    = "warn"    // loaded anyway, but the ACK says so
+	ruleReview  = "review"  // goes in pending review
+	ruleApplied = "applied" // changed the record
+	ruleSkipped = "skipped"
+)
+
+// ruleResult is what one rule made of a record.
+type ruleResult struct {
+	Rule   string
+	Result string
+	Detail string
+}
+
+var checkRecordCmd = &cobra.Command{
+	Use:   "check-record [RECORD.xml]",
+	Short: "Check one record against the rules and say what each made of it",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if (len(args) == 1) == (checkRecordInline != "") {
+			check(fmt.Errorf("give a file or --inline, not both"))
+		}
+		f, err := readCheckRecord(args)
+		check(err)
+
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		job := &batchJob{File: f, Trial: true}
+		versions, err := currentRefVersions(dbs.reader())
+		check(err)
+		check(loadPolicies(viper.GetViper(), dbs.primary, dbs.reader(), job, versions))
+
+		e := f.Records[0]
+		if recordAction(e) != actionEnroll {
+			fmt.Printf("Record is a de-enrollment (%s): the rules don't apply to it.\n", e.Action)
+			return
+		}
+		results, verdict, err := checkOneRecord(dbs.reader(), job, e)
+		check(err)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "RULE\tRESULT\tDETAIL")
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", r.Rule, r.Result, r.Detail)
+		}
+		w.Flush()
+		fmt.Printf("\nEFIN %s would be %s.\n", e.EFIN, verdict)
+		if verdict == enrollmentRejected {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	checkRecordCmd.Flags().StringVar(&checkRecordInline, "inline", "", "the record as JSON")
+	checkRecordCmd.Flags().IntVar(&checkRecordIndex, "record", 0, "which record in the file, from 0")
+	rootCmd.AddCommand(checkRecordCmd)
+}
+
+// readCheckRecord reads the record to check, as a file of one.
+func readCheckRecord(args []string) (inputFile, error) {
+	if checkRecordInline != "" {
+		var e Enrollment
+		if err := json.Unmarshal([]byte(checkRecordInline), &e); err != nil {
+			return inputFile{}, fmt.Errorf("--inline: %v", err)
+		}
+		return inputFile{Path: "inline", Records: []Enrollment{e}}, nil
+	}
+
+	f, err := readInputFile(args[0])
+	if err != nil {
+		return f, err
+	}
+	i := checkRecordIndex
+	if i < 0 || i >= len(f.Records) {
+		return f, fmt.Errorf("%s has %d record(s); there is no record %d", args[0], len(f.Records), i)
+	}
+	f.Records = f.Records[i : i+1]
+	if f.Present != nil {
+		f.Present = f.Present[i : i+1]
+	}
+	return f, nil
+}
+
+// checkOneRecord checks e as record 0 of job and returns what each rule
+// made of it and what would become of it: loaded, pending or rejected.
+func checkOneRecord(p preparer, job *batchJob, e Enrollment) ([]ruleResult, string, error) {
+	checked := e
+	c, err := job.checkRecord(p, 0, &checked)
+	if err != nil {
+		return nil, "", err
+	}
+	rules := c.Rules
+
+	results := []ruleResult{{Rule: "ruleset", Result: rulePass, Detail: rules.Version}}
+	if c.Amended != nil && c.Amended.Base.ID != 0 {
+		results = append(results, ruleResult{Rule: "amends", Result: rulePass,
+			Detail: fmt.Sprintf("ID %d, keeping %d field(s) it leaves out", c.Amended.Base.ID, len(c.Amended.Kept))})
+	}
+
+	if c.Received.IsZero() {
+		results = append(results, ruleResult{Rule: "TransactionDate", Result: ruleFail, Detail: fmt.Sprintf("%q is not a date and time", e.TransactionDate)})
+	} else {
+		results = append(results, ruleResult{Rule: "TransactionDate", Result: rulePass, Detail: c.Received.Format("2006-01-02 15:04:05")})
+	}
+
+	for _, d := range rules.Defaults {
+		results = append(results, changedBy("default "+d.Field, d.Field, e, checked))
+	}
+
+	for _, g := range rules.Conflict {
+		r := ruleResult{Rule: "conflict " + g.Name, Result: rulePass}
+		if c.Amended == nil || c.Amended.Base.ID == 0 {
+			r.Result, r.Detail = ruleSkipped, "not an amendment"
+		}
+		for _, flag := range c.Review {
+			if strings.HasPrefix(flag, "conflict "+g.Name+" (") {
+				r.Result, r.Detail = ruleReview, flag
+			}
+		}
+		results = append(results, r)
+	}
+
+	// Problems and warnings, by the rule that found them.
+	byRule := map[string][]ruleResult{}
+	add := func(result string, errs []recordError) {
+		for _, err := range errs {
+			rule := "refdata"
+			switch err.Code {
+			case errFieldEmpty:
+				rule = "empty"
+			case errFieldTooLong, errFieldTruncated:
+				rule = "lengths"
+			case errFieldInvalid:
+				rule = "validation"
+			case errZipUnknown, errZipStateMismatch:
+				rule = "zip"
+			case errPriorYearMismatch:
+				rule = "prioryear"
+				if result == ruleWarn && rules.Prior.flags() {
+					result = ruleReview
+				}
+			}
+			byRule[rule] = append(byRule[rule], ruleResult{Rule: rule + " " + err.Field, Result: result, Detail: err.Code + ": " + err.Message})
+		}
+	}
+	add(ruleFail, c.Problems)
+	add(ruleWarn, c.Warnings)
+
+	if rules.Prior == nil {
+		results = append(results, ruleResult{Rule: "prioryear", Result: ruleSkipped, Detail: "turned off"})
+	} else {
+		results = append(results, orPass("prioryear", byRule["prioryear"])...)
+	}
+	for _, r := range rules.Empty.rules {
+		if r.As == emptyDefault {
+			results = append(results, changedBy("empty "+r.Field, r.Field, e, checked))
+		}
+	}
+	results = append(results, orPass("empty", byRule["empty"])...)
+	results = append(results, orPass("lengths", byRule["lengths"])...)
+	if rules.Fields == validationOff {
+		results = append(results, ruleResult{Rule: "validation", Result: ruleSkipped, Detail: "turned off"})
+	} else {
+		results = append(results, orPass("validation", byRule["validation"])...)
+	}
+	if job.Zips == nil {
+		results = append(results, ruleResult{Rule: "zip", Result: ruleSkipped, Detail: "no ZIP data"})
+	} else {
+		results = append(results, orPass("zip", byRule["zip"])...)
+		if len(byRule["zip"]) == 0 {
+			results[len(results)-1].Detail = "ZIP data " + job.Zips.Version
+		}
+	}
+	results = append(results, ruleResult{Rule: "hooks", Result: ruleSkipped, Detail: "hooks don't run for check-record"})
+
+	// The reference data and risk rules only run for a record that has
+	// passed everything else; they are shown for every record.
+	ref := job.Ref.check(checked)
+	if len(ref) == 0 {
+		results = append(results, ruleResult{Rule: "refdata", Result: rulePass,
+			Detail: job.Ref.Versions.String()})
+	}
+	for _, err := range ref {
+		results = append(results, ruleResult{Rule: "refdata " + err.Field, Result: ruleFail, Detail: err.Code + ": " + err.Message})
+	}
+	for _, r := range rules.Risk {
+		result := ruleResult{Rule: "risk " + r.Name, Result: rulePass, Detail: r.Field}
+		if r.matches(checked) {
+			result.Result = ruleReview
+		}
+		results = append(results, result)
+	}
+
+	verdict := enrollmentLoaded
+	switch {
+	case len(c.Problems) > 0 || len(ref) > 0:
+		verdict = enrollmentRejected
+	case len(c.Review) > 0:
+		verdict = enrollmentPending
+	}
+	return results, verdict, nil
+}
+
+// changedBy is the result of a rule that may fill in field.
+func changedBy(rule, field string, before, after Enrollment) ruleResult {
+	was, _ := fieldValue(before, field)
+	now, _ := fieldValue(after, field)
+	if was == now {
+		return ruleResult{Rule: rule, Result: rulePass, Detail: "not needed"}
+	}
+	return ruleResult{Rule: rule, Result: ruleApplied, Detail: fmt.Sprintf("%s set to %q", field, now)}
+}
+
+// orPass is results, or a pass for rule if there are none.
+func orPass(rule string, results []ruleResult) []ruleResult {
+	if len(results) == 0 {
+		return []ruleResult{{Rule: rule, Result: rulePass}}
+	}
+	return results
+}
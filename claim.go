@@ -0,0 +1,296 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// We run two loader instances for HA. Before an instance loads a file it
+// claims it in the file_claim table (sql/007_file_claims.sql), keyed by
+// the file's SHA-256 like checkpoints are, so two instances never load
+// the same file at once. The claim is kept alive by a heartbeat; one
+// whose heartbeat is older than load.claimttl is assumed dead and can be
+// taken over. Keep the TTL comfortably longer than retry.database.maxelapsed,
+// or a failover on one instance hands its file to the other. An instance
+// whose heartbeat finds the claim taken stops loading: the transaction it
+// has open rolls back, and the load fails with errClaimed.
+//
+// A claim left by a loader that was killed needn't wait out the TTL when
+// we can tell the loader is gone: it was an earlier run of this instance
+// (the same load.instance), or a process on this host that has exited.
+func init() {
+	viper.SetDefault("load.claims", true)
+	viper.SetDefault("load.claimttl", "5m")
+	viper.SetDefault("load.instance", defaultInstance())
+}
+
+// defaultInstance identifies this process in claims: host:pid.
+func defaultInstance() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// errClaimed means another instance is loading the file.
+var errClaimed = errors.New("file is being loaded by another instance")
+
+// fileClaim is a claim we hold.
+type fileClaim struct {
+	db    *sql.DB
+	sha   string
+	path  string
+	owner string
+	stop  chan struct{}
+	wg    sync.WaitGroup
+
+	// ctx is cancelled when the claim is taken, and taken is then 1.
+	ctx    context.Context
+	cancel context.CancelFunc
+	taken  int32
+}
+
+// claimFile claims a file for this instance, or returns an error wrapping
+// errClaimed if someone else has it. With load.claims off it returns a
+// claim that does nothing.
+func claimFile(db *sql.DB, f inputFile) (*fileClaim, error) {
+	if !viper.GetBool("load.claims") {
+		return &fileClaim{}, nil
+	}
+	ttl, err := time.ParseDuration(viper.GetString("load.claimttl"))
+	if err != nil {
+		return nil, fmt.Errorf("config: load.claimttl: %v", err)
+	}
+
+	c := &fileClaim{db: db, sha: f.SHA256, path: f.Path, owner: viper.GetString("load.instance"), stop: make(chan struct{})}
+	if c.owner == "" {
+		c.owner = defaultInstance()
+	}
+	if !holdClaim(f.SHA256) {
+		return nil, fmt.Errorf("%s: %w (%s, this process)", f.Path, errClaimed, c.owner)
+	}
+	if err := c.claim(f, ttl); err != nil {
+		forgetClaim(f.SHA256)
+		return nil, err
+	}
+
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.wg.Add(1)
+	go c.heartbeat(ttl / 3)
+	return c, nil
+}
+
+// claim makes the file_claim row for f ours: a new one, or one whose
+// holder has gone quiet for ttl, or has gone.
+func (c *fileClaim) claim(f inputFile, ttl time.Duration) error {
+	_, err := execStatement(c.db, "claim.insert", f.SHA256, f.Path, c.owner)
+	if err == nil {
+		return nil
+	}
+	if dbError(err).Code != errDBDuplicate {
+		return fmt.Errorf("claiming %s: %v", f.Path, err)
+	}
+
+	// Already claimed. Take it over if the holder has gone quiet.
+	n, err := execStatement(c.db, "claim.takeover", c.owner, f.SHA256, int(ttl.Seconds()))
+	if err == nil && n == 0 {
+		n, err = reclaimFile(c.db, f, c.owner)
+	}
+	if err != nil {
+		return fmt.Errorf("claiming %s: %v", f.Path, err)
+	}
+	if n == 0 {
+		return claimHolder(c.db, f)
+	}
+	log.Printf("Took over the stale claim on %s\n", f.Path)
+	return nil
+}
+
+// heldClaims are the files this process has claimed, or is claiming, by
+// SHA-256. While we hold one, a claim in our own name is ours; otherwise
+// it was left by an earlier run.
+var heldClaims = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: map[string]bool{}}
+
+// holdClaim marks sha as claimed by this process, unless it is already.
+func holdClaim(sha string) bool {
+	heldClaims.Lock()
+	defer heldClaims.Unlock()
+	if heldClaims.m[sha] {
+		return false
+	}
+	heldClaims.m[sha] = true
+	return true
+}
+
+func forgetClaim(sha string) {
+	heldClaims.Lock()
+	defer heldClaims.Unlock()
+	delete(heldClaims.m, sha)
+}
+
+// reclaimFile takes f's claim over for owner if its holder is gone (see
+// holderGone), and returns 1 if it did.
+func reclaimFile(db *sql.DB, f inputFile, owner string) (int64, error) {
+	stmt, err := prepare(db, "claim.get")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var holder string
+	var at, beat time.Time
+	err = stmt.QueryRow(f.SHA256).Scan(&holder, &at, &beat)
+	if err == sql.ErrNoRows {
+		return 0, nil // released since; the next try gets it
+	}
+	if err != nil || !holderGone(holder, owner) {
+		return 0, err
+	}
+
+	// Only if it is still theirs: another instance may be doing the same.
+	return execStatement(db, "claim.reclaim", owner, f.SHA256, holder)
+}
+
+// holderGone reports whether the loader that claimed a file as holder
+// has stopped. A claim in our own name that this run doesn't hold (see
+// heldClaims) is left from an earlier run; one in a host:pid on this
+// host is gone if the process is.
+func holderGone(holder, owner string) bool {
+	if holder == owner {
+		return true
+	}
+
+	i := strings.LastIndexByte(holder, ':')
+	if i < 0 {
+		return false
+	}
+	host, err := os.Hostname()
+	if err != nil || holder[:i] != host {
+		return false
+	}
+	pid, err := strconv.Atoi(holder[i+1:])
+	if err != nil || pid <= 0 || pid == os.Getpid() {
+		return false
+	}
+	return !processAlive(pid) // see signals_unix.go
+}
+
+// claimHolder describes who holds a file's claim.
+func claimHolder(db *sql.DB, f inputFile) error {
+	stmt, err := prepare(db, "claim.get")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	var by string
+	var at, beat time.Time
+	if err := stmt.QueryRow(f.SHA256).Scan(&by, &at, &beat); err != nil {
+		return fmt.Errorf("%s: %w", f.Path, errClaimed)
+	}
+	return fmt.Errorf("%s: %w (%s, since %s UTC, last heartbeat %s UTC)", f.Path, errClaimed,
+		by, at.Format(time.RFC3339), beat.Format(time.RFC3339))
+}
+
+func (c *fileClaim) heartbeat(every time.Duration) {
+	defer c.wg.Done()
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-t.C:
+			n, err := execStatement(c.db, "claim.heartbeat", c.sha, c.owner)
+			switch {
+			case err != nil:
+				log.Printf("claim heartbeat: %v", err)
+			case n == 0:
+				log.Printf("lost the claim on %s to another instance; stopping its load", c.path)
+				atomic.StoreInt32(&c.taken, 1)
+				c.cancel()
+				return
+			}
+		}
+	}
+}
+
+// context is what the load's transactions run in: it is cancelled if the
+// claim is taken, so an open transaction rolls back rather than commits.
+func (c *fileClaim) context() context.Context {
+	if c == nil || c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// lost returns an error wrapping errClaimed if another instance has taken
+// the claim, and nil while we still hold it.
+func (c *fileClaim) lost() error {
+	if c == nil || atomic.LoadInt32(&c.taken) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s: %w (the claim was taken over mid-load)", c.path, errClaimed)
+}
+
+// release gives the claim up.
+func (c *fileClaim) release() {
+	if c == nil || c.db == nil {
+		return
+	}
+	close(c.stop)
+	c.wg.Wait()
+	c.cancel()
+	forgetClaim(c.sha)
+	if c.lost() != nil {
+		return // not ours to release any more
+	}
+	if _, err := execStatement(c.db, "claim.release", c.sha, c.owner); err != nil {
+		log.Printf("releasing claim on %s: %v", c.sha, err)
+	}
+}
+
+// execStatement runs a catalog statement and returns the rows affected.
+func execStatement(p preparer, name string, args ...interface{}) (int64, error) {
+	stmt, err := prepare(p, name)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,175 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+
+	"github.com/spf13/viper"  // https://github.com/spf13/viper
+	"golang.org/x/text/cases" // https://pkg.go.dev/golang.org/x/text
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"golang.org/x/text/width"
+)
+
+// When we compare a record's values with ours - does the office name
+// differ from what we have (conflict.go), is the bank on the list
+// (refdata.go), is it our bank (prioryear.go) - we compare them the way
+// SQL Server compares the column they are stored in, so we never call
+// two values different that the database calls equal, or the other way
+// round. The collation of each stored field's column is read from the
+// database when a batch starts; collation.default (the SQL Server
+// default, SQL_Latin1_General_CP1_CI_AS) covers fields we don't store and
+// columns we can't see, and collation.override, if set, is used for
+// everything.
+//
+// From a collation's name we take case (CI/CS), accent (AI/AS) and width
+// (WS, or insensitive) sensitivity; BIN and BIN2 collations compare code
+// points. Trailing spaces never count, as in SQL Server.
+func init() {
+	viper.SetDefault("collation.default", "SQL_Latin1_General_CP1_CI_AS")
+	viper.SetDefault("collation.override", "")
+}
+
+// collation is how one column compares text.
+type collation struct {
+	Name              string
+	binary            bool
+	caseInsensitive   bool
+	accentInsensitive bool
+	widthInsensitive  bool
+}
+
+func parseCollation(name string) (collation, error) {
+	c := collation{Name: name, widthInsensitive: true}
+	parts := strings.Split(strings.ToUpper(name), "_")
+	var sawCase bool
+	for _, p := range parts {
+		switch p {
+		case "BIN", "BIN2":
+			c.binary = true
+		case "CI":
+			c.caseInsensitive, sawCase = true, true
+		case "CS":
+			sawCase = true
+		case "AI":
+			c.accentInsensitive = true
+		case "WS":
+			c.widthInsensitive = false
+		}
+	}
+	if !c.binary && !sawCase {
+		return c, fmt.Errorf("collation %q: can't tell whether it is case sensitive", name)
+	}
+	if c.binary {
+		c.caseInsensitive, c.accentInsensitive, c.widthInsensitive = false, false, false
+	}
+	return c, nil
+}
+
+var foldCase = cases.Fold()
+
+// key returns s in a form where two strings the collation calls equal
+// are identical.
+func (c collation) key(s string) string {
+	s = strings.TrimRight(s, " ")
+	if c.binary {
+		return s
+	}
+	if c.widthInsensitive {
+		s = width.Fold.String(s)
+	}
+	if c.accentInsensitive {
+		t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+		if stripped, _, err := transform.String(t, s); err == nil {
+			s = stripped
+		}
+	}
+	if c.caseInsensitive {
+		s = foldCase.String(s)
+	}
+	return s
+}
+
+// collations are the collations of the fields we compare.
+type collations struct {
+	byField  map[string]collation
+	fallback collation
+}
+
+// loadCollations reads the stored fields' column collations. db may be
+// nil, for the configured ones only.
+func loadCollations(db *sql.DB) (*collations, error) {
+	name := viper.GetString("collation.default")
+	if o := viper.GetString("collation.override"); o != "" {
+		name = o
+	}
+	fallback, err := parseCollation(name)
+	if err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+	c := &collations{byField: map[string]collation{}, fallback: fallback}
+	if db == nil || viper.GetString("collation.override") != "" {
+		return c, nil
+	}
+
+	columns, err := readEroColumns(db)
+	if err != nil {
+		log.Printf("reading ero column collations (using %s): %v", fallback.Name, err)
+		return c, nil
+	}
+	for field, sc := range storedColumnTypes {
+		col, ok := columns[sc.Name]
+		if !ok || col.Collation == "" {
+			continue
+		}
+		parsed, err := parseCollation(col.Collation)
+		if err != nil {
+			log.Printf("ero.%s: %v (using %s)", sc.Name, err, fallback.Name)
+			continue
+		}
+		c.byField[field] = parsed
+	}
+	return c, nil
+}
+
+// of returns the collation for a field. A nil *collations compares
+// exactly, apart from trailing spaces.
+func (c *collations) of(field string) collation {
+	if c == nil {
+		return collation{Name: "exact", binary: true}
+	}
+	if col, ok := c.byField[field]; ok {
+		return col
+	}
+	return c.fallback
+}
+
+// key is the comparison form of a value of field.
+func (c *collations) key(field, s string) string {
+	return c.of(field).key(s)
+}
+
+// equal reports whether the database would call a and b equal as values
+// of field.
+func (c *collations) equal(field, a, b string) bool {
+	return c.key(field, a) == c.key(field, b)
+}
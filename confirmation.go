@@ -0,0 +1,133 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Every accepted enrollment gets a confirmation number, stored with it
+// (sql/016_confirmation.sql) and echoed back in the ACK and the API
+// response. Transmitters can quote it to look the record up ("enroll
+// status --confirmation", GET /v1/enrollments?confirmation=). Records
+// pending review get theirs when they're approved.
+//
+// confirmation.format lays the number out. It must contain {seq}, the
+// next number from the database sequence (sql/015_sequences.sql); the
+// other tokens are
+//
+//	{seq:N}     {seq} zero-padded to N digits
+//	{yyyy} {yy} the year it was issued
+//	{yyyymmdd}  the date it was issued
+//	{check}     a Luhn check digit over the digits before it
+//
+// The default, "E{yyyy}{seq:09}{check}", gives E2016000001234 plus a
+// check digit.
+func init() {
+	viper.SetDefault("confirmation.format", "E{yyyy}{seq:09}{check}")
+}
+
+var confirmationToken = regexp.MustCompile(`\{(yyyy|yy|yyyymmdd|seq(?::(\d+))?)\}`)
+
+// maxConfirmation is the width of ero.CONFIRMATION.
+const maxConfirmation = 40
+
+// newConfirmation allocates a confirmation number. p may be the load's
+// transaction.
+func newConfirmation(p preparer) (string, error) {
+	format := viper.GetString("confirmation.format")
+	if !strings.Contains(format, "{seq") {
+		return "", fmt.Errorf("config: confirmation.format must contain {seq}")
+	}
+	seq, err := nextSequence(p, "confirmation")
+	if err != nil {
+		return "", err
+	}
+	c := formatConfirmation(format, seq, time.Now())
+	if len(c) > maxConfirmation {
+		return "", fmt.Errorf("config: confirmation.format makes %q, longer than %d characters", c, maxConfirmation)
+	}
+	return c, nil
+}
+
+// formatConfirmation lays a confirmation number out.
+func formatConfirmation(format string, seq int64, now time.Time) string {
+	s := confirmationToken.ReplaceAllStringFunc(format, func(tok string) string {
+		m := confirmationToken.FindStringSubmatch(tok)
+		switch {
+		case m[1] == "yyyy":
+			return now.Format("2006")
+		case m[1] == "yy":
+			return now.Format("06")
+		case m[1] == "yyyymmdd":
+			return now.Format("20060102")
+		case m[2] != "":
+			width, _ := strconv.Atoi(m[2])
+			return fmt.Sprintf("%0*d", width, seq)
+		}
+		return strconv.FormatInt(seq, 10)
+	})
+
+	for {
+		i := strings.Index(s, "{check}")
+		if i < 0 {
+			return s
+		}
+		s = s[:i] + string(luhnDigit(s[:i])) + s[i+len("{check}"):]
+	}
+}
+
+// luhnDigit is the Luhn check digit for the digits in s (anything else is
+// skipped), so a mistyped digit or swapped pair is caught.
+func luhnDigit(s string) byte {
+	sum, double := 0, true
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < '0' || s[i] > '9' {
+			continue
+		}
+		d := int(s[i] - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// confirmRecord gives an approved record its confirmation number, if it
+// doesn't have one yet.
+func confirmRecord(p preparer, id int64) (string, error) {
+	c, err := newConfirmation(p)
+	if err != nil {
+		return "", err
+	}
+	stmt, err := prepare(p, "ero.confirm")
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(c, id)
+	return c, err
+}
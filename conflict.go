@@ -0,0 +1,138 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// A resubmitted record can disagree with what we have for its EFIN - a
+// different office, a different bank. By default the record wins, as it
+// always has. "conflicts.groups" sets a policy per group of fields:
+//
+//	"conflicts": {
+//	  "groups": [
+//	    {"name": "office", "fields": ["OfficeInfo.OfficeName", "OfficeInfo.State"], "policy": "newest"},
+//	    {"name": "bank", "fields": ["PriorYearInfo.Bank"], "policy": "review"}
+//	  ]
+//	}
+//
+//	record  the record wins (the default)
+//	newest  whichever has the later TransactionDate wins; the record wins a tie
+//	db      what we have wins
+//	review  the record wins, but is loaded pending review (see review.go)
+//
+// A group conflicts if any of its fields differ (blank and NULL are the
+// same), compared as the database compares them (see collation.go). Only the fields we store and read back can be compared (see
+// amend.go); the owner sections aren't stored, so they can't. Where we
+// win, the new row keeps our values for the whole group.
+
+// Conflict policies.
+const (
+	conflictRecord = "record"
+	conflictNewest = "newest"
+	conflictDB     = "db"
+	conflictReview = "review"
+)
+
+type conflictGroup struct {
+	Name   string   `mapstructure:"name"`
+	Fields []string `mapstructure:"fields"`
+	Policy string   `mapstructure:"policy"`
+}
+
+// loadConflictGroups reads and checks conflicts.groups.
+func loadConflictGroups(cfg *viper.Viper) ([]conflictGroup, error) {
+	var groups []conflictGroup
+	if err := cfg.UnmarshalKey("conflicts.groups", &groups); err != nil {
+		return nil, fmt.Errorf("config: conflicts.groups: %v", err)
+	}
+
+	seen := map[string]string{}
+	for _, g := range groups {
+		switch g.Policy {
+		case conflictRecord, conflictNewest, conflictDB, conflictReview:
+		default:
+			return nil, fmt.Errorf("config: conflicts: %s: policy must be record, newest, db or review (got %q)", g.Name, g.Policy)
+		}
+		if len(g.Fields) == 0 {
+			return nil, fmt.Errorf("config: conflicts: %s has no fields", g.Name)
+		}
+		for _, f := range g.Fields {
+			if _, ok := (priorRecord{}).value(f); !ok {
+				return nil, fmt.Errorf("config: conflicts: %s: %q can't be compared (fields: %s)", g.Name, f, strings.Join(priorFields, ", "))
+			}
+			if other, ok := seen[f]; ok {
+				return nil, fmt.Errorf("config: conflicts: %s is in both %s and %s", f, other, g.Name)
+			}
+			seen[f] = g.Name
+		}
+	}
+	return groups, nil
+}
+
+// changed returns the group's fields where e differs from the record it
+// amends.
+func (g conflictGroup) changed(c *collations, base priorRecord, e Enrollment) []string {
+	var fields []string
+	for _, f := range g.Fields {
+		ours, _ := base.value(f)
+		theirs, _ := fieldValue(e, f)
+		if !c.equal(f, strings.TrimSpace(ours.String), strings.TrimSpace(theirs)) {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// resolveConflicts applies groups, the policies, to record i, which has been read
+// as of received (its TransactionDate). Groups where we win are set back
+// to what we have; the flags for groups under review are returned.
+func resolveConflicts(job *batchJob, groups []conflictGroup, i int, a *amendment, e *Enrollment, received time.Time) []string {
+	if a == nil || a.Base.ID == 0 {
+		return nil
+	}
+
+	var flags []string
+	for _, g := range groups {
+		fields := g.changed(job.Collate, a.Base, *e)
+		if len(fields) == 0 {
+			continue
+		}
+
+		ours := g.Policy == conflictDB || (g.Policy == conflictNewest && received.Before(a.Base.Received))
+		winner := "record"
+		if ours {
+			winner = "database"
+			for _, f := range g.Fields {
+				a.keep(e, f)
+			}
+		}
+		if g.Policy == conflictReview {
+			flags = append(flags, fmt.Sprintf("conflict %s (%s)", g.Name, strings.Join(fields, ", ")))
+		}
+		if job.Trial {
+			continue
+		}
+		job.logRecordf(i, "Record %d conflicts with ID %d on %s (%s): %s policy, %s wins\n", i, a.Base.ID, g.Name, strings.Join(fields, ", "), g.Policy, winner)
+		metricCount("conflicts.count", 1, tag("group", g.Name), tag("policy", g.Policy), tag("winner", winner))
+	}
+	return flags
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+// Every file gets a correlation ID when we start loading it, and every
+// record in it the file's ID plus its index ("3f9a0c1d2e4b5a67-12"). The
+// IDs are in the log lines for the file, on the batch and ero rows
+// (sql/011_correlation.sql), in the ACK and webhook payload, and in API
+// responses, so one enrollment can be traced from the upload to the
+// database. A resumed batch keeps its file's ID (it is in the
+// checkpoint).
+//
+// API callers can send X-Correlation-ID with a request; we use it for
+// the file they submit and echo it back. Otherwise we make one up.
+
+const correlationHeader = "X-Correlation-ID"
+
+// validCorrelation is what we accept from callers.
+var validCorrelation = regexp.MustCompile(`^[A-Za-z0-9._-]{8,36}$`)
+
+// newCorrelationID returns a random ID.
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand doesn't fail on supported platforms
+	}
+	return hex.EncodeToString(b)
+}
+
+// recordCorrelation is the correlation ID of the record at index i.
+func (job *batchJob) recordCorrelation(i int) string {
+	return fmt.Sprintf("%s-%d", job.Correlation, i)
+}
+
+// logf logs a line about the job, tagged with its correlation ID.
+func (job *batchJob) logf(format string, args ...interface{}) {
+	log.Printf("[%s] "+format, append([]interface{}{job.Correlation}, args...)...)
+}
+
+// logRecordf logs a line about one of the job's records.
+func (job *batchJob) logRecordf(i int, format string, args ...interface{}) {
+	log.Printf("[%s] "+format, append([]interface{}{job.recordCorrelation(i)}, args...)...)
+}
+
+// requestCorrelation returns the caller's X-Correlation-ID, or a new ID.
+func requestCorrelation(r *http.Request) string {
+	if id := r.Header.Get(correlationHeader); validCorrelation.MatchString(id) {
+		return id
+	}
+	return newCorrelationID()
+}
+
+// withCorrelation makes sure every request has a correlation ID and every
+// response carries it.
+func withCorrelation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestCorrelation(r)
+		r.Header.Set(correlationHeader, id)
+		w.Header().Set(correlationHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,257 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dstroot/go_enrollment/enrollmenttest"
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// The tests that load files need a SQL Server database to load them
+// into, migrated (sql/) and otherwise empty: ENROLL_TEST_CONFIG is a
+// config.json for it. They are skipped without one. They run the loader
+// as "enroll" would, by running this test binary again (see TestMain).
+
+// TestMain runs main instead of the tests when the test binary is run as
+// the loader.
+func TestMain(m *testing.M) {
+	if os.Getenv("ENROLL_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// crashPoints are where TestCrashAndRestart kills a load (crashpoints.go).
+var crashPoints = []string{"claimed", "started", "written:3", "committed:3", "checkpointed:2", "finished", "loaded"}
+
+// crashRecords is how many records each test file has.
+const crashRecords = 5
+
+// TestCrashAndRestart kills a load at each point it could die, in each
+// transaction mode, then loads the file again, and checks that it was
+// loaded once and each record written once (ledger.go).
+func TestCrashAndRestart(t *testing.T) {
+	for m, mode := range []string{"none", "file", "batch"} {
+		for p, point := range crashPoints {
+			mode, point, n := mode, point, m*len(crashPoints)+p
+			t.Run(mode+"/"+point, func(t *testing.T) {
+				if mode == "file" && strings.HasPrefix(point, "checkpointed") {
+					t.Skip("a file in one transaction has no checkpoints")
+				}
+				dir := testLoader(t, map[string]interface{}{"transaction": mode, "batchsize": 2})
+				path := filepath.Join(dir, fmt.Sprintf("crash-%s-%d.xml", mode, p))
+				efins := writeTestFile(t, path, n, crashRecords)
+
+				if code := runEnroll(t, dir, "--crash-at", point, path); code != crashExit {
+					t.Fatalf("--crash-at %s: exited %d, want %d", point, code, crashExit)
+				}
+				if code := runEnroll(t, dir, path); code != 0 {
+					t.Fatalf("loading again: exited %d", code)
+				}
+				// And once more: it is loaded already, so nothing happens.
+				if code := runEnroll(t, dir, path); code != 0 {
+					t.Fatalf("loading a third time: exited %d", code)
+				}
+				checkLoadedOnce(t, path, efins)
+				checkReleased(t, path)
+			})
+		}
+	}
+}
+
+// testLoader sets up a directory to run the loader in, with the test
+// database's config and these load settings, and reads that config into
+// this process too. It skips the test if there is no test database.
+func testLoader(t *testing.T, load map[string]interface{}) string {
+	t.Helper()
+	base := os.Getenv("ENROLL_TEST_CONFIG")
+	if base == "" {
+		t.Skip("ENROLL_TEST_CONFIG is not set: no test database")
+	}
+	config := readTestConfig(t, base)
+
+	dir := t.TempDir()
+	l, _ := config["load"].(map[string]interface{})
+	if l == nil {
+		l = map[string]interface{}{}
+	}
+	l["checkpointdir"] = filepath.Join(dir, "checkpoints")
+	l["checkpointevery"] = 1
+	for k, v := range load {
+		l[k] = v
+	}
+	config["load"] = l
+	// The loader won't write checkpoints in the clear (atrest.go).
+	if _, ok := config["storage"]; !ok {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		config["storage"] = map[string]interface{}{"key": base64.StdEncoding.EncodeToString(key)}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "config"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config", "config.json")
+	writeTestConfig(t, path, config)
+
+	viper.SetConfigFile(path)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func readTestConfig(t *testing.T, path string) map[string]interface{} {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(b, &config); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return config
+}
+
+func writeTestConfig(t *testing.T, path string, config map[string]interface{}) {
+	t.Helper()
+	b, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestFile writes a file of count valid records to path, with EFINs
+// no other test file has (n numbers the file), and returns them.
+func writeTestFile(t *testing.T, path string, n, count int) []string {
+	t.Helper()
+	var records []enrollmenttest.Record
+	var efins []string
+	for i := 0; i < count; i++ {
+		efin := fmt.Sprintf("9%03d%02d", n, i)
+		efins = append(efins, efin)
+		records = append(records, enrollmenttest.ValidRecord().WithEFIN(efin))
+	}
+	if err := os.WriteFile(path, enrollmenttest.NewFile(records...).Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return efins
+}
+
+// runEnroll runs the loader in dir with args, and returns its exit status.
+func runEnroll(t *testing.T, dir string, args ...string) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "ENROLL_TEST_MAIN=1")
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		t.Logf("enroll %v: exit %d\n%s", args, exit.ExitCode(), out)
+		return exit.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0
+}
+
+// checkLoadedOnce checks that the file at path has one batch, which
+// finished, with a ledger row and an ero row for each record, and that
+// no record was written by any other batch.
+func checkLoadedOnce(t *testing.T, path string, efins []string) {
+	t.Helper()
+	dbs, err := openDatabases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbs.Close()
+	db := dbs.primary
+
+	f, err := readInputFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, ok, err := fileBatch(db, f)
+	if err != nil || !ok {
+		t.Fatalf("no batch for %s (%v)", path, err)
+	}
+	if b.Status != batchLoaded {
+		t.Errorf("batch %d is %s, want %s", b.ID, b.Status, batchLoaded)
+	}
+
+	count := func(query string, args ...interface{}) int {
+		t.Helper()
+		var n int
+		if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		return n
+	}
+	if n := count("SELECT COUNT(*) FROM batch WHERE SHA256 = ? AND REPLAY_OF IS NULL", f.SHA256); n != 1 {
+		t.Errorf("%d batches loaded the file, want 1", n)
+	}
+	if n := count("SELECT COUNT(*) FROM load_ledger WHERE BATCH_ID = ?", b.ID); n != len(efins) {
+		t.Errorf("batch %d has %d ledger rows, want %d", b.ID, n, len(efins))
+	}
+	for _, efin := range efins {
+		if n := count("SELECT COUNT(*) FROM ero WHERE EFIN = ?", efin); n != 1 {
+			t.Errorf("EFIN %s has %d ero rows, want 1", efin, n)
+		}
+		if n := count("SELECT COUNT(*) FROM ero WHERE EFIN = ? AND BATCH_ID = ?", efin, b.ID); n != 1 {
+			t.Errorf("EFIN %s isn't in batch %d", efin, b.ID)
+		}
+	}
+}
+
+// checkReleased checks that the file at path isn't claimed.
+func checkReleased(t *testing.T, path string) {
+	t.Helper()
+	dbs, err := openDatabases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbs.Close()
+
+	f, err := readInputFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := dbs.primary.QueryRow("SELECT COUNT(*) FROM file_claim WHERE SHA256 = ?", f.SHA256).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%s is still claimed", path)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// To test that a load survives being killed (ledger.go), --crash-at
+// (load.crashat) makes the process exit at once - no deferred cleanup,
+// nothing flushed, as if it had been killed - the Nth time the load gets
+// to a point: "committed:37" is just after the 37th record commits. The
+// points, in the order a load reaches them:
+//
+//	claimed       the file is claimed, before its batch starts
+//	started       the batch row exists
+//	written       a record's writes are done, before they commit
+//	committed     a record has committed (or, in a transaction, is
+//	              written), before the checkpoint moves
+//	checkpointed  the checkpoint has been saved
+//	finished      the batch is marked done, before the ACK and hooks
+//	loaded        loadFile is returning, before the file is moved
+//
+// N defaults to 1. Never set this in production.
+func init() {
+	rootCmd.PersistentFlags().String("crash-at", "", "exit abruptly at this point of a load (testing only)")
+	check(rootCmd.PersistentFlags().MarkHidden("crash-at"))
+	check(viper.BindPFlag("load.crashat", rootCmd.PersistentFlags().Lookup("crash-at")))
+}
+
+// crashExit is the status a crash point exits with.
+const crashExit = 86
+
+var crashHits struct {
+	sync.Mutex
+	n map[string]int
+}
+
+// crashPoint exits the process if load.crashat names this point, and
+// this is the time.
+func crashPoint(point string) {
+	at := viper.GetString("load.crashat")
+	if at == "" {
+		return
+	}
+	name, nth := at, 1
+	if i := strings.IndexByte(at, ':'); i >= 0 {
+		name = at[:i]
+		if n, err := strconv.Atoi(at[i+1:]); err == nil {
+			nth = n
+		}
+	}
+	if name != point {
+		return
+	}
+
+	crashHits.Lock()
+	defer crashHits.Unlock()
+	if crashHits.n == nil {
+		crashHits.n = map[string]int{}
+	}
+	if crashHits.n[point]++; crashHits.n[point] == nth {
+		log.Printf("crash-at %s: exiting", at)
+		os.Exit(crashExit)
+	}
+}
@@ -0,0 +1,483 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"  // https://github.com/spf13/cobra
+	"github.com/spf13/viper"  // https://github.com/spf13/viper
+	"golang.org/x/crypto/ssh" // https://godoc.org/golang.org/x/crypto/ssh
+)
+
+// Each vendor's credentials are kept in the database, by transmitter ID,
+// rather than in files and the config (sql/037_transmitter_credentials.sql):
+//
+//	sftp         where their return files go: user@host[:port][/dir]
+//	sftp-key     our private key for that server, PEM
+//	known-hosts  the server's host keys, as known_hosts lines
+//	api-key      an API key we gave them - only its SHA-256 is kept
+//	ack-key      the key their ACK files are signed with (signing.go)
+//	pgp-key      their PGP public key, armored, for whatever needs it
+//
+// Each is encrypted with storage.key (see atrest.go) before it is stored,
+// so they can't be kept without one. The config refers to them as secrets
+// (secrets.go), "cred:<transmitter>/<kind>":
+//
+//	"delivery": {"transmitters": {"98765": {"type": "sftp",
+//	    "endpoint": "cred:98765/sftp", "key": "cred:98765/sftp-key", "hostkeys": "cred:98765/known-hosts"}}},
+//	"signing": {"transmitters": {"98765": {"ackkey": "cred:98765/ack-key"}}}
+//
+// With credentials.enabled, the API also takes every live api-key (see
+// auth.go). What is read is cached for credentials.cachettl (5m).
+//
+//	enroll transmitter creds set --id 98765 --kind sftp-key --file id_ed25519
+//	enroll transmitter creds rotate --id 98765 --kind api-key [--overlap 24h]
+//	enroll transmitter creds list [--id 98765]
+//
+// set replaces the transmitter's credential of that kind at once. rotate
+// adds a new one and leaves the old ones working for --overlap, so the
+// vendor can switch over; an api-key or ack-key is generated and printed
+// once, others are read like set's. A value that isn't from --file is
+// read from stdin, so it never goes in a command line. Credentials are
+// never shown again, only a fingerprint: the start of the SHA-256 of
+// what is stored.
+func init() {
+	viper.SetDefault("credentials.enabled", false)
+	viper.SetDefault("credentials.cachettl", "5m")
+}
+
+// Kinds of credential.
+const (
+	credSFTP       = "sftp"
+	credSFTPKey    = "sftp-key"
+	credKnownHosts = "known-hosts"
+	credAPIKey     = "api-key"
+	credAckKey     = "ack-key"
+	credPGPKey     = "pgp-key"
+)
+
+// credentialKinds are the kinds, with what makes a value of each usable.
+var credentialKinds = []struct {
+	Kind  string
+	Check func(v []byte) error
+}{
+	{credSFTP, func(v []byte) error {
+		_, err := transmitterSFTP(string(v)) // see transmitter.go
+		return err
+	}},
+	{credSFTPKey, func(v []byte) error {
+		_, err := ssh.ParsePrivateKey(v)
+		return err
+	}},
+	{credKnownHosts, func(v []byte) error {
+		_, _, _, _, _, err := ssh.ParseKnownHosts(v)
+		return err
+	}},
+	{credAPIKey, func(v []byte) error {
+		if len(v) < 32 {
+			return errors.New("an API key must be at least 32 characters")
+		}
+		return nil
+	}},
+	{credAckKey, func(v []byte) error {
+		if len(v) < 16 {
+			return errors.New("an ACK key must be at least 16 characters")
+		}
+		return nil
+	}},
+	{credPGPKey, func(v []byte) error {
+		if !bytes.Contains(v, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----")) {
+			return errors.New("not an armored PGP public key")
+		}
+		return nil
+	}},
+}
+
+// checkCredential checks that kind is a kind and v a value of it.
+func checkCredential(kind string, v []byte) error {
+	names := make([]string, 0, len(credentialKinds))
+	for _, k := range credentialKinds {
+		if k.Kind == kind {
+			if v == nil {
+				return nil
+			}
+			if err := k.Check(v); err != nil {
+				return fmt.Errorf("%s: %v", kind, err)
+			}
+			return nil
+		}
+		names = append(names, k.Kind)
+	}
+	return fmt.Errorf("unknown kind %q (use %s)", kind, strings.Join(names, ", "))
+}
+
+// generated reports whether rotate makes the kind's values itself.
+func generated(kind string) bool {
+	return kind == credAPIKey || kind == credAckKey
+}
+
+// credentialValue is what to store for v: an API key's SHA-256, anything
+// else as it is.
+func credentialValue(kind string, v []byte) []byte {
+	if kind == credAPIKey {
+		sum := sha256.Sum256(v)
+		return []byte(hex.EncodeToString(sum[:]))
+	}
+	return v
+}
+
+// storeCredential adds a credential for the transmitter and has the
+// others of its kind expire at expires. It returns the new one's ID and
+// fingerprint.
+func storeCredential(db *sql.DB, transmitter, kind string, v []byte, expires time.Time, by string) (int64, string, error) {
+	if aead, err := storageAEAD(); err != nil {
+		return 0, "", err
+	} else if aead == nil {
+		return 0, "", errors.New("storage.key must be set to keep credentials")
+	}
+	stored := credentialValue(kind, v)
+	sealed, err := seal(stored)
+	if err != nil {
+		return 0, "", err
+	}
+	sum := sha256.Sum256(stored)
+	fingerprint := hex.EncodeToString(sum[:])[:12]
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+	stmt, err := prepare(tx, "credential.add")
+	if err != nil {
+		return 0, "", err
+	}
+	defer stmt.Close()
+	now := time.Now()
+	var id int64
+	if err := stmt.QueryRow(transmitter, kind, sealed, fingerprint, now, truncate(by, 100)).Scan(&id); err != nil {
+		return 0, "", err
+	}
+	if _, err := execStatement(tx, "credential.expire", expires, transmitter, kind, id, now); err != nil {
+		return 0, "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, "", err
+	}
+	forgetCredentials()
+	return id, fingerprint, nil
+}
+
+// The credentials read, and the pool they are read through.
+var credentials struct {
+	sync.Mutex
+	db      *sql.DB
+	values  map[string]cachedCredential // by "<transmitter>/<kind>"
+	apiKeys map[string]string           // transmitter, by key SHA-256
+	keysAt  time.Time
+}
+
+type cachedCredential struct {
+	value string
+	at    time.Time
+}
+
+// credentialDB opens the pool credentials are read through, once. Call
+// with credentials locked.
+func credentialDB() (*sql.DB, error) {
+	if credentials.db == nil {
+		db, err := openDB(dbPrimary)
+		if err != nil {
+			return nil, err
+		}
+		credentials.db = db
+	}
+	return credentials.db, nil
+}
+
+// forgetCredentials empties the cache.
+func forgetCredentials() {
+	credentials.Lock()
+	defer credentials.Unlock()
+	credentials.values, credentials.apiKeys = nil, nil
+}
+
+// credentialSecret resolves a "cred:<transmitter>/<kind>" reference to
+// the transmitter's current credential of that kind.
+func credentialSecret(ref string) (string, error) {
+	transmitter, kind, ok := strings.Cut(strings.TrimPrefix(ref, "cred:"), "/")
+	if !ok || transmitter == "" {
+		return "", fmt.Errorf("secret %s: must be cred:<transmitter>/<kind>", ref)
+	}
+	if err := checkCredential(kind, nil); err != nil {
+		return "", fmt.Errorf("secret %s: %v", ref, err)
+	}
+	ttl, err := configDuration("credentials.cachettl")
+	if err != nil {
+		return "", err
+	}
+
+	credentials.Lock()
+	defer credentials.Unlock()
+	key := transmitter + "/" + kind
+	if c, ok := credentials.values[key]; ok && time.Since(c.at) < ttl {
+		return c.value, nil
+	}
+	db, err := credentialDB()
+	if err != nil {
+		return "", fmt.Errorf("secret %s: %v", ref, err)
+	}
+	stmt, err := prepare(db, "credential.current")
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+	var sealed []byte
+	err = stmt.QueryRow(transmitter, kind, time.Now()).Scan(&sealed)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("secret %s: transmitter %s has no %s", ref, transmitter, kind)
+	}
+	if err != nil {
+		return "", fmt.Errorf("secret %s: %v", ref, err)
+	}
+	plain, err := unseal(sealed)
+	if err != nil {
+		return "", fmt.Errorf("secret %s: %v", ref, err)
+	}
+	if credentials.values == nil {
+		credentials.values = map[string]cachedCredential{}
+	}
+	credentials.values[key] = cachedCredential{value: string(plain), at: time.Now()}
+	return string(plain), nil
+}
+
+// credentialAPIKeys are the live API keys in the database, as transmitter
+// by SHA-256. There are none unless credentials.enabled.
+func credentialAPIKeys() (map[string]string, error) {
+	if !viper.GetBool("credentials.enabled") {
+		return nil, nil
+	}
+	ttl, err := configDuration("credentials.cachettl")
+	if err != nil {
+		return nil, err
+	}
+
+	credentials.Lock()
+	defer credentials.Unlock()
+	if credentials.apiKeys != nil && time.Since(credentials.keysAt) < ttl {
+		return credentials.apiKeys, nil
+	}
+	db, err := credentialDB()
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := prepare(db, "credential.api_keys")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := map[string]string{}
+	for rows.Next() {
+		var transmitter string
+		var sealed []byte
+		if err := rows.Scan(&transmitter, &sealed); err != nil {
+			return nil, err
+		}
+		sum, err := unseal(sealed)
+		if err != nil {
+			return nil, fmt.Errorf("api-key for %s: %v", transmitter, err)
+		}
+		keys[string(sum)] = transmitter
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	credentials.apiKeys, credentials.keysAt = keys, time.Now()
+	return keys, nil
+}
+
+// readCredential is the value for set or rotate: --file, or stdin.
+func readCredential(kind, file string) ([]byte, error) {
+	var b []byte
+	var err error
+	if file != "" {
+		b, err = os.ReadFile(file)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s (end with Ctrl-D):\n", kind)
+		b, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case credSFTPKey, credKnownHosts, credPGPKey:
+		return b, nil
+	}
+	// One-line values.
+	return bytes.TrimSpace(b), nil
+}
+
+// ---------------------------------------------------------------------
+// enroll transmitter creds set / rotate / list
+
+var (
+	credID      string
+	credKind    string
+	credFile    string
+	credOverlap time.Duration
+	credBy      string
+)
+
+var credsCmd = &cobra.Command{
+	Use:   "creds",
+	Short: "Keep transmitters' credentials",
+}
+
+var credsSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "Store a transmitter's credential, replacing the one it had",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		check(storeCredentialFlags(false))
+	},
+}
+
+var credsRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Add a new credential for a transmitter, keeping the old one for --overlap",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		check(storeCredentialFlags(true))
+	},
+}
+
+// storeCredentialFlags is set and rotate.
+func storeCredentialFlags(rotate bool) error {
+	if credID == "" || credKind == "" {
+		return errors.New("--id and --kind are required")
+	}
+	if err := checkCredential(credKind, nil); err != nil {
+		return err
+	}
+	var v []byte
+	var err error
+	if rotate && generated(credKind) && credFile == "" {
+		var s string
+		if s, err = newTransmitterSecret(); err != nil {
+			return err
+		}
+		v = []byte(s)
+	} else if v, err = readCredential(credKind, credFile); err != nil {
+		return err
+	}
+	if err := checkCredential(credKind, v); err != nil {
+		return err
+	}
+
+	dbs, err := openDatabases()
+	if err != nil {
+		return err
+	}
+	defer dbs.Close()
+	expires := time.Now()
+	if rotate {
+		expires = expires.Add(credOverlap)
+	}
+	id, fingerprint, err := storeCredential(dbs.primary, credID, credKind, v, expires, credBy)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Stored %s %d for transmitter %s (fingerprint %s)\n", credKind, id, credID, fingerprint)
+	if rotate {
+		fmt.Printf("The previous %s works until %s\n", credKind, expires.Format(time.RFC3339))
+		if generated(credKind) && credFile == "" {
+			fmt.Printf("Give this to the vendor; it isn't shown again:\n  %s\n", v)
+		}
+	}
+	return nil
+}
+
+var credsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List transmitters' credentials, without their values",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		stmt, err := prepare(dbs.reader(), "credential.list")
+		check(err)
+		defer stmt.Close()
+		rows, err := stmt.Query(credID, credID)
+		check(err)
+		defer rows.Close()
+
+		now := time.Now()
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tTRANSMITTER\tKIND\tFINGERPRINT\tCREATED\tBY\tEXPIRES")
+		for rows.Next() {
+			var (
+				id                        int64
+				transmitter, kind, fp, by string
+				created                   time.Time
+				expires                   sql.NullTime
+			)
+			check(rows.Scan(&id, &transmitter, &kind, &fp, &created, &by, &expires))
+			until := "-"
+			switch {
+			case expires.Valid && !expires.Time.After(now):
+				until = "expired " + expires.Time.Format("2006-01-02 15:04")
+			case expires.Valid:
+				until = expires.Time.Format("2006-01-02 15:04")
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", id, transmitter, kind, fp, created.Format("2006-01-02 15:04"), by, until)
+		}
+		check(rows.Err())
+		check(w.Flush())
+	},
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{credsSetCmd, credsRotateCmd, credsListCmd} {
+		cmd.Flags().StringVar(&credID, "id", "", "transmitter ID")
+	}
+	for _, cmd := range []*cobra.Command{credsSetCmd, credsRotateCmd} {
+		cmd.Flags().StringVar(&credKind, "kind", "", "sftp, sftp-key, known-hosts, api-key, ack-key or pgp-key")
+		cmd.Flags().StringVar(&credFile, "file", "", "read the value from this file rather than stdin")
+		cmd.Flags().StringVar(&credBy, "by", currentUser(), "who is storing it")
+	}
+	credsRotateCmd.Flags().DurationVar(&credOverlap, "overlap", 24*time.Hour, "how long the previous credential keeps working")
+	credsCmd.AddCommand(credsSetCmd, credsRotateCmd, credsListCmd)
+	transmitterCmd.AddCommand(credsCmd) // see transmitter.go
+}
@@ -0,0 +1,327 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Connection encryption defaults. SQL Server connections carry SSNs and
+// dates of birth, so unless the config says otherwise we encrypt the
+// connection and insist on a server certificate we can validate.
+func init() {
+	viper.SetDefault("mssql.encrypt", "true")
+	viper.SetDefault("mssql.trustservercertificate", false)
+	viper.SetDefault("mssql.certificate", "")
+	viper.SetDefault("mssql.hostnameincertificate", "")
+	viper.SetDefault("load.isolation", "read committed")
+	viper.SetDefault("mssql.replica.enabled", false)
+	viper.SetDefault("mssql.shadow.enabled", false)
+}
+
+// Connection roles: the primary takes writes, the replica reads and the
+// shadow gets a copy of every batch (see shadow.go).
+const (
+	dbPrimary = "primary"
+	dbReplica = "replica"
+	dbShadow  = "shadow"
+)
+
+/*
+
+   The idiomatic way to use a SQL, or SQL-like, database in Go is through the
+   database/sql package. It provides a lightweight interface to a row-oriented database.
+
+   The first thing to do is import the database/sql package, and a driver package.
+   You generally shouldn't use the driver package directly, although some drivers
+   encourage you to do so. (In our opinion, it's usually a bad idea.) Instead,
+   your code should only refer to database/sql. This helps avoid making your
+   code dependent on the driver, so that you can change the underlying driver
+   (and thus the database you're accessing) without changing your code. It also
+   forces you to use the Go idioms instead of ad-hoc idioms that a particular
+   driver author may have provided.
+
+   The sql.DB performs some important tasks for you behind the scenes:
+    1. It opens and closes connections to the actual underlying database, via the driver.
+    2. It manages a pool of connections as needed.
+
+   These "connections" may be file handles, sockets, network connections,
+   or other ways to access the database. The sql.DB abstraction is
+   designed to keep you from worrying about how to manage concurrent
+   access to the underlying datastore. A connection is marked in-use
+   when you use it to perform a task, and then returned to the available
+   pool when it's not in use anymore. One consequence of this is that if
+   you fail to release connections back to the pool, you can cause db.SQL
+   to open a lot of connections, potentially running out of resources
+   (too many connections, too many open file handles, lack of available n
+   etwork ports, etc). We'll discuss more about this later.
+
+   To create a sql.DB, you use sql.Open(). This returns a *sql.DB:
+
+   Perhaps counter-intuitively, sql.Open() does
+   not establish any connections to the database, nor does it validate
+   driver connection parameters. Instead, it simply prepares the database
+   abstraction for later use.
+
+   // MySQL Example
+   db, err := sql.Open("mysql", "user:password@tcp(127.0.0.1:3306)/hello")
+   if err != nil {
+       log.Fatal(err)
+   }
+
+   Although it's idiomatic to Close() the database when you're finished
+   with it, the sql.DB object is designed to be long-lived. Don't Open()
+   and Close() databases frequently. Instead, create one sql.DB object
+   for each distinct datastore you need to access, and keep it until the
+   program is done accessing that datastore. Pass it around as needed, or
+   make it available somehow globally, but keep it open. And don't Open()
+   and Close() from a short-lived function. Instead, pass the sql.DB into
+   that short-lived function as an argument.
+
+*/
+
+// databases holds our connection pools. Writes always go to the primary.
+// When "mssql.replica.enabled" is set, validation lookups and the
+// status/list commands read from a read-only replica instead, which keeps
+// that load off the primary during season peak. Replicas can lag the
+// primary by a few seconds, so never read back something you have just
+// written through reader().
+type databases struct {
+	primary *sql.DB
+	replica *sql.DB // nil unless a replica is configured
+	shadow  *sql.DB // nil unless a shadow is configured
+}
+
+// reader returns the pool to use for read-only queries.
+func (d *databases) reader() *sql.DB {
+	if d.replica != nil {
+		return d.replica
+	}
+	return d.primary
+}
+
+func (d *databases) Close() {
+	d.primary.Close()
+	if d.replica != nil {
+		d.replica.Close()
+	}
+	if d.shadow != nil {
+		d.shadow.Close()
+	}
+}
+
+// openDatabases connects to the primary and, if configured, the replica
+// and the shadow.
+func openDatabases() (*databases, error) {
+	primary, err := openDB(dbPrimary)
+	if err != nil {
+		return nil, err
+	}
+	dbs := &databases{primary: primary}
+
+	if viper.GetBool("mssql.replica.enabled") {
+		dbs.replica, err = openDB(dbReplica)
+		if err != nil {
+			dbs.Close()
+			return nil, err
+		}
+	}
+	if viper.GetBool("mssql.shadow.enabled") {
+		dbs.shadow, err = openDB(dbShadow)
+		if err != nil {
+			dbs.Close()
+			return nil, fmt.Errorf("shadow: %w", err)
+		}
+	}
+	return dbs, nil
+}
+
+// openDB opens a pool for role and checks we can actually log in.
+func openDB(role string) (*sql.DB, error) {
+	readOnly := role == dbReplica
+	connString, host, err := connectionString(role)
+	if err != nil {
+		return nil, err
+	}
+	if err := registerColumnMasterKey(); err != nil { // see alwaysencrypted.go
+		return nil, err
+	}
+
+	db, err := sql.Open("mssql", connString)
+	if err != nil {
+		return nil, fmt.Errorf("open connection failed: %v", err)
+	}
+
+	// The first actual connection to the underlying datastore will be
+	// established lazily, when it's needed for the first time. If you want
+	// to check right away that the database is available and accessible
+	// (for example, check that you can establish a network connection and log
+	// in), use db.Ping() to do that, and remember to check for errors:
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, connectionError(host, err)
+	}
+
+	if debug {
+		fmt.Printf("Database Connected!\n")
+		fmt.Printf("Server: %s (%s, encrypt=%s, read-only=%t)\n\n", host, role, viper.GetString("mssql.encrypt"), readOnly)
+	}
+	return db, nil
+}
+
+// connectionString builds the go-mssqldb connection string from the
+// "mssql" section of the config file, including the TLS settings:
+//
+//	encrypt                 "true" (default), "false" (encrypt the login
+//	                        packet only) or "disable" (no encryption)
+//	trustservercertificate  skip certificate validation (dev only!)
+//	certificate             path to a PEM CA bundle used to validate the
+//	                        server certificate (e.g. our internal CA)
+//	hostnameincertificate   name to expect in the server certificate when
+//	                        it differs from "host" (e.g. AG listeners)
+//
+// With "mssql.alwaysencrypted.enabled" it turns on column encryption
+// (see alwaysencrypted.go) for every role.
+//
+// For the replica we connect with ApplicationIntent=ReadOnly, which the AG
+// listener routes to a readable secondary. "mssql.replica.host" and
+// "mssql.replica.port" override the primary's when the replica has its
+// own address; the shadow can override those and its user, password and
+// database too. It returns the host it connects to along with the string.
+func connectionString(role string) (string, string, error) {
+	encrypt := strings.ToLower(viper.GetString("mssql.encrypt"))
+	switch encrypt {
+	case "true", "false", "disable":
+	default:
+		return "", "", fmt.Errorf("config: mssql.encrypt must be one of true, false or disable (got %q)", encrypt)
+	}
+
+	setting := func(key string) string {
+		if role != dbPrimary {
+			if v := viper.GetString("mssql." + role + "." + key); v != "" {
+				return v
+			}
+		}
+		return viper.GetString("mssql." + key)
+	}
+	host := setting("host")
+	if role == dbShadow && viper.GetString("mssql.shadow.host") == "" && viper.GetString("mssql.shadow.database") == "" {
+		return "", "", fmt.Errorf("config: mssql.shadow needs its own host or database")
+	}
+
+	params := []string{
+		"server=" + host,
+		"port=" + setting("port"),
+		"user id=" + setting("user"),
+		"password=" + setting("password"),
+		"database=" + setting("database"),
+		"encrypt=" + encrypt,
+		fmt.Sprintf("TrustServerCertificate=%t", viper.GetBool("mssql.trustservercertificate")),
+	}
+	if role == dbReplica {
+		params = append(params, "ApplicationIntent=ReadOnly")
+	}
+	if alwaysEncrypted() {
+		params = append(params, "columnencryption=true")
+	}
+
+	// The driver silently ignores a CA bundle it can't read, which makes
+	// for a very confusing "certificate signed by unknown authority" later
+	// on. Check it up front instead.
+	if ca := viper.GetString("mssql.certificate"); ca != "" {
+		if _, err := os.Stat(ca); err != nil {
+			return "", "", fmt.Errorf("config: mssql.certificate: %v", err)
+		}
+		params = append(params, "certificate="+ca)
+	}
+	if name := viper.GetString("mssql.hostnameincertificate"); name != "" {
+		params = append(params, "hostNameInCertificate="+name)
+	}
+
+	return strings.Join(params, ";"), host, nil
+}
+
+// connectionError turns a failed Ping into something an operator can act
+// on. The driver reports TLS failures as plain strings, so we have to look
+// for the x509 package's messages rather than use a typed error.
+func connectionError(host string, err error) error {
+	msg := err.Error()
+	if strings.Contains(msg, "x509:") || strings.Contains(msg, "TLS Handshake failed") {
+		return fmt.Errorf("unable to validate the SQL Server certificate for %s: %v\n"+
+			"check mssql.certificate (CA bundle) and mssql.hostnameincertificate in the config, "+
+			"or set mssql.trustservercertificate to true for development servers only",
+			host, err)
+	}
+	return fmt.Errorf("unable to connect to SQL Server %s: %v", host, err)
+}
+
+// isolationLevel maps "load.isolation" onto a database/sql isolation level
+// and checks that the database actually allows it. The two row-versioning
+// options are what keep the load from blocking the reporting queries that
+// run against the same tables:
+//
+//	read committed snapshot  READ COMMITTED, but the database must have
+//	                         READ_COMMITTED_SNAPSHOT ON
+//	snapshot                 SNAPSHOT; needs ALLOW_SNAPSHOT_ISOLATION ON
+//
+// "read uncommitted", "read committed" (the default), "repeatable read"
+// and "serializable" are passed through as-is.
+func isolationLevel(db *sql.DB) (sql.IsolationLevel, error) {
+	setting := strings.ToLower(viper.GetString("load.isolation"))
+
+	levels := map[string]sql.IsolationLevel{
+		"read uncommitted":        sql.LevelReadUncommitted,
+		"read committed":          sql.LevelReadCommitted,
+		"read committed snapshot": sql.LevelReadCommitted,
+		"repeatable read":         sql.LevelRepeatableRead,
+		"snapshot":                sql.LevelSnapshot,
+		"serializable":            sql.LevelSerializable,
+	}
+	level, ok := levels[setting]
+	if !ok {
+		return 0, fmt.Errorf("config: unknown load.isolation %q", setting)
+	}
+
+	if setting != "read committed snapshot" && setting != "snapshot" {
+		return level, nil
+	}
+
+	stmt, err := prepare(db, "db.isolation_options")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var rcsi bool
+	var snapshotState int
+	if err := stmt.QueryRow().Scan(&rcsi, &snapshotState); err != nil {
+		return 0, fmt.Errorf("checking database isolation options: %v", err)
+	}
+
+	// snapshot_isolation_state 1 is ON; 2 and 3 are transitions.
+	switch {
+	case setting == "read committed snapshot" && !rcsi:
+		return 0, fmt.Errorf("load.isolation is %q but READ_COMMITTED_SNAPSHOT is OFF for database %s", setting, viper.GetString("mssql.database"))
+	case setting == "snapshot" && snapshotState != 1:
+		return 0, fmt.Errorf("load.isolation is %q but ALLOW_SNAPSHOT_ISOLATION is not ON for database %s", setting, viper.GetString("mssql.database"))
+	}
+	return level, nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// A de-enrollment is a record with action="deactivate", in any
+// enrollment file:
+//
+//	<Enrollment action="deactivate" reason="Office closed">
+//	  <EFIN>123456</EFIN>
+//	</Enrollment>
+//
+// It marks the EFIN's records for the tax year inactive, with the reason
+// and batch (sql/018_deactivation.sql), and every office whose MasterEfin
+// it is with it. It isn't checked like an enrollment - only the EFIN
+// matters. The ACK lists it as "deactivated" with the offices that went
+// with it, the webhook counts it, OnRecordDeactivated hooks see it and
+// every row it deactivated is queued for the bank API (bankapi.go) with
+// its new status. An EFIN with nothing active to deactivate is rejected
+// with NOT_ENROLLED.
+
+// Record actions.
+const (
+	actionEnroll     = "enroll"
+	actionDeactivate = "deactivate"
+)
+
+// enrollmentInactive is the ero status of a deactivated record.
+const enrollmentInactive = "inactive"
+
+// Error codes for de-enrollments.
+const (
+	errActionUnknown = "ACTION_UNKNOWN"
+	errNotEnrolled   = "NOT_ENROLLED"
+)
+
+// deactivatedRecord is a de-enrollment we applied.
+type deactivatedRecord struct {
+	Index   int // position in the file, from 0
+	EFIN    string
+	Year    int // the tax year deactivated (see recordYear)
+	Reason  string
+	IDs     []int64  // the ero rows it made inactive
+	Offices []string // child office EFINs deactivated with it
+}
+
+// recordAction is what a record asks for; "" means enroll.
+func recordAction(e Enrollment) string {
+	if a := strings.ToLower(strings.TrimSpace(e.Action)); a != "" {
+		return a
+	}
+	return actionEnroll
+}
+
+// loadDeactivation applies the de-enrollment record i. Like an insert,
+// without savepoints a database error is returned; with them the record is
+// rolled back and rejected.
+func loadDeactivation(p preparer, job *batchJob, i int, e Enrollment, sp *savepoints) (deactivatedRecord, []recordError, error) {
+	d := deactivatedRecord{Index: i, EFIN: strings.TrimSpace(e.EFIN), Year: recordYear(e), Reason: strings.TrimSpace(e.Reason)}
+	if a := recordAction(e); a != actionDeactivate {
+		return d, []recordError{{Code: errActionUnknown, Message: fmt.Sprintf("action must be %s or %s (got %q)", actionEnroll, actionDeactivate, e.Action),
+			Args: map[string]string{"action": e.Action}}}, nil
+	}
+	if d.EFIN == "" {
+		return d, []recordError{{Field: "EFIN", Code: errFieldEmpty, Message: "a de-enrollment needs an EFIN"}}, nil
+	}
+
+	name := fmt.Sprintf("rec%d", i)
+	if sp != nil {
+		if err := sp.save(name); err != nil {
+			return d, nil, err
+		}
+	}
+	err := deactivate(p, job.ID, &d)
+	if err != nil {
+		if sp == nil {
+			return d, nil, err
+		}
+		if rbErr := sp.rollback(name); rbErr != nil {
+			return d, nil, fmt.Errorf("record %d: %w (and rollback to savepoint failed: %v)", i, err, rbErr)
+		}
+		return d, []recordError{dbError(err)}, nil
+	}
+	if len(d.IDs) == 0 {
+		return d, []recordError{{Field: "EFIN", Code: errNotEnrolled, Message: "EFIN " + d.EFIN + " has nothing active to deactivate",
+			Args: map[string]string{"efin": d.EFIN}}}, nil
+	}
+	return d, nil, nil
+}
+
+// deactivate marks d's EFIN and its offices inactive and queues the rows
+// for the bank.
+func deactivate(p preparer, batch int64, d *deactivatedRecord) error {
+	stmt, err := prepare(p, "ero.deactivate")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	args := []interface{}{time.Now(), nullString(truncate(d.Reason, 400)), batch, d.EFIN}
+	if !viper.GetBool("mssql.storedprocedures") {
+		args = append(args, d.EFIN) // for MASTER_EFIN
+	}
+	args = append(args, d.Year)
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return err
+	}
+	offices := map[string]bool{}
+	for rows.Next() {
+		var id int64
+		var efin string
+		if err := rows.Scan(&id, &efin); err != nil {
+			rows.Close()
+			return err
+		}
+		d.IDs = append(d.IDs, id)
+		if efin != d.EFIN && !offices[efin] {
+			offices[efin] = true
+			d.Offices = append(d.Offices, efin)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// The rows have to be read before anything else runs on p.
+	for _, id := range d.IDs {
+		if err := queueForBank(p, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Each enrollment has to reach the bank within sla.record.window (24h) of
+// its TransactionDate. It reaches the bank in the end-of-day report, so
+// "report eod --deliver" marks the day's records forwarded
+// (sql/013_record_deadlines.sql).
+//
+// "enroll report overdue" lists the records past their deadline and those
+// due within sla.record.warn (4h). "enroll serve" checks every
+// sla.record.checkevery (15m) and pages (see incidents.go) while any
+// record is at risk.
+func init() {
+	viper.SetDefault("sla.record.window", "24h")
+	viper.SetDefault("sla.record.warn", "4h")
+	viper.SetDefault("sla.record.checkevery", "15m")
+}
+
+// recordDeadline is an unforwarded record that is overdue or nearly so.
+type recordDeadline struct {
+	ID          int64
+	EFIN        string
+	Transmitter string
+	Status      string
+	Received    time.Time
+	Deadline    time.Time
+}
+
+func configDuration(key string) (time.Duration, error) {
+	d, err := time.ParseDuration(viper.GetString(key))
+	if err != nil {
+		return 0, fmt.Errorf("config: %s: %v", key, err)
+	}
+	return d, nil
+}
+
+// atRiskRecords returns the records not yet forwarded whose deadline is
+// before now+within, earliest first.
+func atRiskRecords(db *sql.DB, now time.Time, within time.Duration) ([]recordDeadline, error) {
+	window, err := configDuration("sla.record.window")
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := prepare(db, "ero.deadlines")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	minutes := int(window.Minutes())
+	rows, err := stmt.Query(minutes, minutes, now.Add(within).UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found []recordDeadline
+	for rows.Next() {
+		var d recordDeadline
+		if err := rows.Scan(&d.ID, &d.EFIN, &d.Transmitter, &d.Status, &d.Received, &d.Deadline); err != nil {
+			return nil, err
+		}
+		found = append(found, d)
+	}
+	return found, rows.Err()
+}
+
+// markForwarded records that a day's end-of-day report has gone to the
+// bank, and with it the day's records.
+func markForwarded(db *sql.DB, day time.Time) (int64, error) {
+	return execStatement(db, "ero.forwarded", time.Now().UTC(), day, day.AddDate(0, 0, 1))
+}
+
+var overdueWithin string
+
+var overdueCmd = &cobra.Command{
+	Use:   "overdue",
+	Short: "Records not yet forwarded to the bank that are past or near their deadline",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if overdueWithin == "" {
+			overdueWithin = viper.GetString("sla.record.warn")
+		}
+		within, err := time.ParseDuration(overdueWithin)
+		if err != nil {
+			check(fmt.Errorf("--within: %v", err))
+		}
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		now := time.Now()
+		found, err := atRiskRecords(dbs.reader(), now, within)
+		check(err)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tEFIN\tTRANSMITTER\tSTATUS\tRECEIVED\tDEADLINE\t")
+		for _, d := range found {
+			state := "OVERDUE " + now.Sub(d.Deadline).Round(time.Minute).String()
+			if d.Deadline.After(now) {
+				state = "due in " + d.Deadline.Sub(now).Round(time.Minute).String()
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", d.ID, d.EFIN, d.Transmitter, d.Status,
+				d.Received.Format(time.RFC3339), d.Deadline.Format(time.RFC3339), state)
+		}
+		check(w.Flush())
+	},
+}
+
+func init() {
+	overdueCmd.Flags().StringVar(&overdueWithin, "within", "", "also list records due within this long (default sla.record.warn)")
+	reportCmd.AddCommand(overdueCmd)
+}
+
+const deadlineIncidentKey = "enroll-record-deadlines"
+
+// checkDeadlines pages while records are overdue or due within
+// sla.record.warn, and resolves the incident once they're all forwarded.
+func checkDeadlines(db *sql.DB) {
+	warn, err := configDuration("sla.record.warn")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	now := time.Now()
+	found, err := atRiskRecords(db, now, warn)
+	if err != nil {
+		log.Printf("checking record deadlines: %v", err)
+		return
+	}
+
+	overdue := 0
+	for _, d := range found {
+		if d.Deadline.Before(now) {
+			overdue++
+		}
+	}
+	metricGauge("records.overdue", overdue)
+	metricGauge("records.atrisk", len(found)-overdue)
+
+	if len(found) == 0 {
+		resolveIncident(deadlineIncidentKey)
+		return
+	}
+	triggerIncident(deadlineIncidentKey,
+		fmt.Sprintf("enroll: %d records overdue for the bank, %d more due within %s", overdue, len(found)-overdue, warn),
+		map[string]interface{}{"overdue": overdue, "at_risk": len(found) - overdue, "earliest_deadline": found[0].Deadline.Format(time.RFC3339)})
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// "defaults.fields" fills in empty fields before a record is checked and
+// inserted, so every record goes through the rules and into the database
+// the same way. Each entry names a field (as in risk.go) and either a
+// value or another field to copy it from:
+//
+//	{"field": "MasterEfin", "from": "EFIN"}
+//	{"field": "EFINOwnerInfo", "from": "OwnerInformation"}
+//	{"field": "ProcessingYear", "value": "2016"}
+//
+// A field counts as empty if it is blank - for a section such as
+// EFINOwnerInfo, if everything in it is blank. Entries are applied in
+// order, so one can copy a field an earlier one filled in.
+
+type fieldDefault struct {
+	Field string `mapstructure:"field"`
+	Value string `mapstructure:"value"`
+	From  string `mapstructure:"from"`
+}
+
+// loadDefaults reads and checks the configured defaults.
+func loadDefaults(cfg *viper.Viper) ([]fieldDefault, error) {
+	var defaults []fieldDefault
+	if err := cfg.UnmarshalKey("defaults.fields", &defaults); err != nil {
+		return nil, fmt.Errorf("config: defaults.fields: %v", err)
+	}
+
+	var e Enrollment
+	for _, d := range defaults {
+		dst, ok := fieldRef(&e, d.Field)
+		if !ok {
+			return nil, fmt.Errorf("config: defaults: unknown field %q", d.Field)
+		}
+		if (d.From == "") == (d.Value == "") {
+			return nil, fmt.Errorf("config: defaults: %s needs one of value or from", d.Field)
+		}
+		if d.From != "" {
+			src, ok := fieldRef(&e, d.From)
+			if !ok {
+				return nil, fmt.Errorf("config: defaults: %s: unknown field %q", d.Field, d.From)
+			}
+			if err := assignField(dst, src); err != nil {
+				return nil, fmt.Errorf("config: defaults: %s from %s: %v", d.Field, d.From, err)
+			}
+			continue
+		}
+		if dst.Kind() != reflect.String {
+			// A false can't be told from a missing element, so only
+			// text fields take a value.
+			return nil, fmt.Errorf("config: defaults: %s can only be copied with from", d.Field)
+		}
+	}
+	return defaults, nil
+}
+
+// applyDefaults fills in e's empty fields. The defaults have been checked
+// by loadDefaults.
+func applyDefaults(defaults []fieldDefault, e *Enrollment) {
+	for _, d := range defaults {
+		dst, _ := fieldRef(e, d.Field)
+		if !blank(dst) {
+			continue
+		}
+		if d.From != "" {
+			src, _ := fieldRef(e, d.From)
+			assignField(dst, src)
+			continue
+		}
+		dst.SetString(d.Value)
+	}
+}
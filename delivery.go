@@ -0,0 +1,295 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws" // https://github.com/aws/aws-sdk-go-v2
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// After a batch we push its return files - the ACK and its signature - to
+// the transmitter that sent it, if delivery.transmitters.<id> says where:
+//
+//	{"type": "sftp", "host": ..., "user": ..., "keyfile": ..., "knownhosts": ..., "dir": ...}
+//	{"type": "s3", "bucket": ..., "prefix": ..., "region": ...}
+//
+// (SFTP settings as in sftp.go; S3 uses the usual AWS credential chain.)
+// Each file is tracked in the delivery table (sql/010_deliveries.sql) and
+// tried as the "network" retry policy allows (see retry.go). Failures stay
+// "failed" until they are retried, by "enroll deliveries --retry" or by
+// "enroll serve" every delivery.retryevery.
+func init() {
+	viper.SetDefault("delivery.retryevery", "10m")
+}
+
+// Delivery statuses.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// deliveryTarget is where one transmitter's return files go.
+type deliveryTarget struct {
+	key  string // config section
+	kind string // sftp or s3
+}
+
+// transmitterTarget returns the transmitter's delivery target, if it has
+// one.
+func transmitterTarget(transmitter string) (deliveryTarget, bool) {
+	key := "delivery.transmitters." + transmitter
+	if transmitter == "" || !viper.IsSet(key+".type") {
+		return deliveryTarget{}, false
+	}
+	return deliveryTarget{key: key, kind: viper.GetString(key + ".type")}, true
+}
+
+func (t deliveryTarget) String() string {
+	switch t.kind {
+	case "sftp":
+		if ref := viper.GetString(t.key + ".endpoint"); ref != "" {
+			return "sftp " + ref // not the credential itself
+		}
+		return fmt.Sprintf("sftp://%s@%s/%s", viper.GetString(t.key+".user"), viper.GetString(t.key+".host"),
+			strings.TrimPrefix(viper.GetString(t.key+".dir"), "/"))
+	case "s3":
+		return "s3://" + path.Join(viper.GetString(t.key+".bucket"), viper.GetString(t.key+".prefix"))
+	}
+	return t.kind
+}
+
+// put uploads one file.
+func (t deliveryTarget) put(local string) error {
+	switch t.kind {
+	case "sftp":
+		return sftpDeliver(t.key, local)
+	case "s3":
+		return s3Deliver(t.key, local)
+	}
+	return fmt.Errorf("config: %s.type must be sftp or s3 (got %q)", t.key, t.kind)
+}
+
+// s3Deliver uploads a file to the bucket and prefix configured under key.
+func s3Deliver(key, local string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(viper.GetString(key+".region")))
+	if err != nil {
+		return fmt.Errorf("aws config: %v", err)
+	}
+
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = s3.NewFromConfig(cfg).PutObject(ctx, &s3.PutObjectInput{
+		Bucket:               aws.String(viper.GetString(key + ".bucket")),
+		Key:                  aws.String(path.Join(viper.GetString(key+".prefix"), filepath.Base(local))),
+		Body:                 f,
+		ServerSideEncryption: types.ServerSideEncryptionAes256,
+	})
+	return err
+}
+
+// deliverReturnFiles sends a batch's return files to its transmitter.
+// Problems are logged and recorded, never returned: the batch itself
+// is done either way.
+func deliverReturnFiles(db *sql.DB, job *batchJob, files []string) {
+	transmitter := job.File.Transmitter()
+	target, ok := transmitterTarget(transmitter)
+	if !ok {
+		return
+	}
+
+	for _, local := range files {
+		id, err := addDelivery(db, job.ID, transmitter, local, target)
+		if err != nil {
+			job.logf("recording delivery of %s: %v", local, err)
+			continue
+		}
+		attemptDelivery(db, id, target, local)
+	}
+}
+
+func addDelivery(db *sql.DB, batch int64, transmitter, local string, target deliveryTarget) (int64, error) {
+	stmt, err := prepare(db, "delivery.add")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var id int64
+	err = stmt.QueryRow(batch, transmitter, local, target.String(), deliveryPending, time.Now()).Scan(&id)
+	return id, err
+}
+
+// attemptDelivery tries a delivery as often as the network retry policy
+// allows and records how it went.
+func attemptDelivery(db *sql.DB, id int64, target deliveryTarget, local string) bool {
+	policy := retryPolicyFor("network")
+	started := time.Now()
+
+	var err error
+	attempts := 0
+	for {
+		attempts++
+		if err = target.put(local); err == nil {
+			break
+		}
+		log.Printf("delivering %s to %s (attempt %d, retry policy %s): %v", local, target, attempts, policy, err)
+		wait, ok := policy.next(attempts, started)
+		if !ok {
+			break
+		}
+		time.Sleep(wait)
+	}
+
+	status, lastErr, delivered := deliveryDelivered, interface{}(nil), interface{}(nil)
+	defer func() { metricCount("delivery.count", 1, tag("target", target.kind), tag("status", status)) }()
+	if err != nil {
+		status, lastErr = deliveryFailed, truncate(err.Error(), 1000)
+	} else {
+		delivered = time.Now()
+		log.Printf("Delivered %s to %s\n", filepath.Base(local), target)
+	}
+	if _, uerr := execStatement(db, "delivery.update", status, attempts, lastErr, delivered, id); uerr != nil {
+		log.Printf("recording delivery %d: %v", id, uerr)
+	}
+	return err == nil
+}
+
+// truncate shortens s to at most n runes.
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
+
+// openDelivery is a delivery that hasn't succeeded yet.
+type openDelivery struct {
+	ID          int64
+	Batch       int64
+	Transmitter string
+	File        string
+	Target      string
+	Status      string
+	Attempts    int
+	LastError   string
+	Created     time.Time
+}
+
+func openDeliveries(db *sql.DB) ([]openDelivery, error) {
+	stmt, err := prepare(db, "delivery.open")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var open []openDelivery
+	for rows.Next() {
+		var d openDelivery
+		if err := rows.Scan(&d.ID, &d.Batch, &d.Transmitter, &d.File, &d.Target, &d.Status, &d.Attempts, &d.LastError, &d.Created); err != nil {
+			return nil, err
+		}
+		open = append(open, d)
+	}
+	return open, rows.Err()
+}
+
+// retryDeliveries retries every delivery that hasn't succeeded, to the
+// transmitter's target as configured now. It returns how many are still
+// outstanding.
+func retryDeliveries(db *sql.DB) (int, error) {
+	open, err := openDeliveries(db)
+	if err != nil {
+		return 0, err
+	}
+
+	left := 0
+	for _, d := range open {
+		target, ok := transmitterTarget(d.Transmitter)
+		if !ok {
+			log.Printf("delivery %d: transmitter %s no longer has a delivery target", d.ID, d.Transmitter)
+			left++
+			continue
+		}
+		if !attemptDelivery(db, d.ID, target, d.File) {
+			left++
+		}
+	}
+	return left, nil
+}
+
+var deliveriesRetry bool
+
+var deliveriesCmd = &cobra.Command{
+	Use:   "deliveries",
+	Short: "List (and retry) return file deliveries that haven't succeeded",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		if deliveriesRetry {
+			left, err := retryDeliveries(dbs.primary)
+			check(err)
+			fmt.Printf("%d still outstanding\n", left)
+			return
+		}
+
+		open, err := openDeliveries(dbs.primary)
+		check(err)
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tBATCH\tTRANSMITTER\tFILE\tTARGET\tSTATUS\tATTEMPTS\tLAST ERROR")
+		for _, d := range open {
+			fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\t%d\t%s\n", d.ID, d.Batch, d.Transmitter,
+				filepath.Base(d.File), d.Target, d.Status, d.Attempts, d.LastError)
+		}
+		check(w.Flush())
+	},
+}
+
+func init() {
+	deliveriesCmd.Flags().BoolVar(&deliveriesRetry, "retry", false, "retry them now")
+	rootCmd.AddCommand(deliveriesCmd)
+}
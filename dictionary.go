@@ -0,0 +1,223 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// "enroll schema dict" prints the data dictionary we publish to partners:
+// every element and attribute we read, built from the struct tags in
+// records.go and the checks this configuration applies (empty.fields,
+// defaults.fields, lengths, the reference lists, prior-year checks), so
+// the spec can't say something the loader doesn't do. Stored fields'
+// lengths are the built-in ones (storedColumnTypes), which the migrations
+// keep in step with the columns. Risk rules and conflict policies are
+// ours and are left out.
+
+// dictEntry is one element or attribute.
+type dictEntry struct {
+	Element   string   `json:"element"` // e.g. Enrollment/OfficeInfo/Email, or Enrollment/@action
+	Field     string   `json:"field"`   // the path config uses, e.g. OfficeInfo.Email
+	Type      string   `json:"type"`    // string, boolean or group
+	Required  bool     `json:"required"`
+	Default   string   `json:"default,omitempty"`
+	Empty     string   `json:"empty,omitempty"` // what an empty value is stored as: null or empty
+	Column    string   `json:"column,omitempty"`
+	MaxLength int      `json:"maxLength,omitempty"`
+	Rules     []string `json:"rules,omitempty"`
+}
+
+// dictionary builds the data dictionary for the current configuration.
+func dictionary() ([]dictEntry, error) {
+	empty, err := loadEmptyPolicy(viper.GetViper())
+	if err != nil {
+		return nil, err
+	}
+	lengths, err := loadLengthPolicy(viper.GetViper(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defaults, err := loadDefaults(viper.GetViper())
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []dictEntry
+	index := map[string]int{}
+	var walk func(t reflect.Type, element, field string)
+	walk = func(t reflect.Type, element, field string) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := strings.Split(f.Tag.Get("xml"), ",")
+			if tag[0] == "" || tag[0] == "-" {
+				continue
+			}
+			d := dictEntry{Element: element + "/" + tag[0], Field: strings.TrimPrefix(field+"."+f.Name, ".")}
+			if len(tag) > 1 && tag[1] == "attr" {
+				d.Element = element + "/@" + tag[0]
+			}
+			switch f.Type.Kind() {
+			case reflect.Struct:
+				d.Type = "group"
+			case reflect.Bool:
+				d.Type = "boolean"
+			default:
+				d.Type = "string"
+			}
+			index[d.Field] = len(entries)
+			entries = append(entries, d)
+			if f.Type.Kind() == reflect.Struct {
+				walk(f.Type, d.Element, d.Field)
+			}
+		}
+	}
+	walk(reflect.TypeOf(Enrollment{}), "Enrollment", "")
+
+	at := func(field string) *dictEntry { return &entries[index[field]] }
+	for field, as := range empty.stored {
+		d := at(field)
+		d.Empty = as
+		if c, ok := storedColumnTypes[field]; ok {
+			d.Column = c.Name
+		}
+	}
+	for _, field := range lengths.fields {
+		d := at(field)
+		d.MaxLength = lengths.max[field]
+		if lengths.truncate {
+			d.Rules = append(d.Rules, fmt.Sprintf("cut to %d characters if longer (%s)", d.MaxLength, errFieldTruncated))
+		} else {
+			d.Rules = append(d.Rules, fmt.Sprintf("at most %d characters (%s)", d.MaxLength, errFieldTooLong))
+		}
+	}
+	for _, r := range empty.rules {
+		d := at(r.Field)
+		switch r.As {
+		case emptyError:
+			d.Required = true
+			d.Rules = append(d.Rules, "must not be empty ("+errFieldEmpty+")")
+		case emptyDefault:
+			d.Default = r.Value
+		}
+	}
+	policy, err := loadValidationPolicy(viper.GetViper())
+	if err != nil {
+		return nil, err
+	}
+	if policy != validationOff {
+		for _, v := range []struct {
+			prefix string
+			t      reflect.Type
+		}{
+			{"", reflect.TypeOf(ValidEnrollment{})},
+			{"OfficeInfo.", reflect.TypeOf(ValidOfficeInfo{})},
+			{"OwnerInformation.", reflect.TypeOf(ValidOwnerInformation{})},
+			{"EFINOwnerInfo.", reflect.TypeOf(ValidEFINOwnerInfo{})},
+			{"PriorYearInfo.", reflect.TypeOf(ValidPriorYearInfo{})},
+		} {
+			for i := 0; i < v.t.NumField(); i++ {
+				f := v.t.Field(i)
+				if _, ok := index[v.prefix+f.Name]; !ok || f.Tag.Get("valid") == "" {
+					continue
+				}
+				d := at(v.prefix + f.Name)
+				d.Rules = append(d.Rules, "valid:\""+f.Tag.Get("valid")+"\" ("+errFieldInvalid+", "+policy+")")
+			}
+		}
+	}
+	for _, def := range defaults {
+		d := at(def.Field)
+		if def.From != "" {
+			d.Default = "copied from " + def.From
+		} else if d.Default == "" {
+			d.Default = def.Value
+		}
+	}
+
+	at("Action").Rules = append(at("Action").Rules, fmt.Sprintf("%s (the default) or %s (%s)", actionEnroll, actionDeactivate, errActionUnknown))
+	at("EFIN").Rules = append(at("EFIN").Rules, "on the approved EFIN list, when we have one ("+errEFINNotApproved+")")
+	at("PriorYearInfo.Bank").Rules = append(at("PriorYearInfo.Bank").Rules, "on our bank list, when we have one ("+errBankUnknown+")")
+	if viper.GetBool("prioryear.enabled") {
+		for _, field := range []string{"PriorYearInfo.Bank", "PriorYearInfo.ClientOfYoursLastYear"} {
+			at(field).Rules = append(at(field).Rules, "checked against our prior-year records ("+errPriorYearMismatch+")")
+		}
+	}
+	return entries, nil
+}
+
+func writeDictionaryCSV(w io.Writer, entries []dictEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"ELEMENT", "FIELD", "TYPE", "REQUIRED", "DEFAULT", "EMPTY", "COLUMN", "MAX_LENGTH", "RULES"})
+	for _, d := range entries {
+		length := ""
+		if d.MaxLength > 0 {
+			length = strconv.Itoa(d.MaxLength)
+		}
+		cw.Write([]string{d.Element, d.Field, d.Type, strconv.FormatBool(d.Required), d.Default, d.Empty, d.Column, length, strings.Join(d.Rules, "; ")})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+var (
+	dictFormat string
+	dictOut    string
+)
+
+var schemaDictCmd = &cobra.Command{
+	Use:   "dict",
+	Short: "Print the data dictionary: every field we accept and how it is checked",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		entries, err := dictionary()
+		check(err)
+
+		w := io.Writer(os.Stdout)
+		if dictOut != "" {
+			f, err := os.Create(dictOut)
+			check(err)
+			defer f.Close()
+			w = f
+		}
+		switch dictFormat {
+		case "json":
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			check(enc.Encode(entries))
+		case "csv":
+			check(writeDictionaryCSV(w, entries))
+		default:
+			check(fmt.Errorf("--format must be json or csv (got %q)", dictFormat))
+		}
+	},
+}
+
+func init() {
+	schemaDictCmd.Flags().StringVar(&dictFormat, "format", "json", "json or csv")
+	schemaDictCmd.Flags().StringVar(&dictOut, "out", "", "file to write (default stdout)")
+	schemaCmd.AddCommand(schemaDictCmd)
+}
@@ -0,0 +1,206 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Vendors sometimes regenerate a file they already sent - same records,
+// new timestamps - and its checksum is then new too, so nothing else
+// stops us loading it twice. Before a file is loaded we compare its
+// records with those of the transmitter's files loaded in the last
+// dedup.window (30 days): each record is hashed without its
+// TransactionDate, and a file that shares at least dedup.threshold
+// (0.99) of its records with an earlier one is a near duplicate. Each
+// batch's hashes are kept in batch_fingerprint
+// (sql/038_batch_fingerprints.sql) for the files after it. Files of
+// fewer than dedup.minrecords (10) records aren't checked: sending the
+// same correction or edit twice is nothing unusual.
+//
+// With dedup.action "hold" (the default) a near duplicate isn't loaded:
+// it fails before a batch is started, operators are told which batch it
+// repeats, and it waits in watch.failed. To load it anyway requeue it
+// with "duplicate": true (enroll admin requeue --duplicate), or load it
+// with --allow-duplicate. With "warn" operators are told and the file is
+// loaded. Replays and resumed batches aren't checked.
+func init() {
+	viper.SetDefault("dedup.enabled", true)
+	viper.SetDefault("dedup.threshold", 0.99)
+	viper.SetDefault("dedup.window", "720h")
+	viper.SetDefault("dedup.action", "hold")
+	viper.SetDefault("dedup.candidates", 20)
+	viper.SetDefault("dedup.minrecords", 10)
+	rootCmd.Flags().BoolVar(&allowDuplicate, "allow-duplicate", false, "load the file even if it repeats an earlier batch")
+}
+
+var allowDuplicate bool
+
+// nearDuplicateError is a file held because it repeats an earlier batch.
+type nearDuplicateError struct {
+	Batch      int64
+	File       string
+	Similarity float64 // the share of the records they have in common
+	Exact      bool    // the very same file
+}
+
+func (e *nearDuplicateError) Error() string {
+	if e.Exact {
+		return fmt.Sprintf("held as a duplicate: the same file as batch %d (%s)", e.Batch, e.File)
+	}
+	return fmt.Sprintf("held as a duplicate: %.1f%% the same records as batch %d (%s)", e.Similarity*100, e.Batch, e.File)
+}
+
+// recordHashes is an 8-byte hash of each of f's records, leaving out the
+// TransactionDate, sorted.
+func recordHashes(f inputFile) []uint64 {
+	hashes := make([]uint64, len(f.Records))
+	for i, e := range f.Records {
+		e.TransactionDate = ""
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%#v", e)))
+		hashes[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	return hashes
+}
+
+// packHashes and unpackHashes convert hashes to and from RECORD_HASHES.
+func packHashes(hashes []uint64) []byte {
+	b := make([]byte, 8*len(hashes))
+	for i, h := range hashes {
+		binary.BigEndian.PutUint64(b[8*i:], h)
+	}
+	return b
+}
+
+func unpackHashes(b []byte) []uint64 {
+	hashes := make([]uint64, len(b)/8)
+	for i := range hashes {
+		hashes[i] = binary.BigEndian.Uint64(b[8*i:])
+	}
+	return hashes
+}
+
+// similarity is the share of records two files have in common: how many
+// of a's hashes b has too, over the bigger file's count. Both are sorted.
+func similarity(a, b []uint64) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	same := 0
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			same++
+			i++
+			j++
+		case a[i] < b[j]:
+			i++
+		default:
+			j++
+		}
+	}
+	return float64(same) / math.Max(float64(len(a)), float64(len(b)))
+}
+
+// checkDuplicate compares job's file with the transmitter's recent
+// batches. It returns the hashes, for storeFingerprint, and with
+// dedup.action "hold" a *nearDuplicateError if the file repeats one.
+func checkDuplicate(db *sql.DB, job *batchJob) ([]uint64, error) {
+	if !viper.GetBool("dedup.enabled") || len(job.File.Records) < viper.GetInt("dedup.minrecords") || len(job.File.Records) == 0 {
+		return nil, nil
+	}
+	hashes := recordHashes(job.File)
+	if job.ReplayOf > 0 {
+		return hashes, nil
+	}
+
+	threshold := viper.GetFloat64("dedup.threshold")
+	if threshold <= 0 || threshold > 1 {
+		return nil, fmt.Errorf("config: dedup.threshold must be more than 0 and at most 1 (got %v)", threshold)
+	}
+	action := viper.GetString("dedup.action")
+	if action != "hold" && action != "warn" {
+		return nil, fmt.Errorf("config: dedup.action must be hold or warn (got %q)", action)
+	}
+	window, err := configDuration("dedup.window")
+	if err != nil {
+		return nil, err
+	}
+
+	n := float64(len(hashes))
+	stmt, err := prepare(db, "batch.similar")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(viper.GetInt("dedup.candidates"), job.File.Transmitter(), time.Now().Add(-window),
+		int(math.Ceil(n*threshold)), int(math.Floor(n/threshold)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var best *nearDuplicateError
+	for rows.Next() {
+		var d nearDuplicateError
+		var sha string
+		var packed []byte
+		if err := rows.Scan(&d.Batch, &d.File, &sha, &packed); err != nil {
+			return nil, err
+		}
+		d.Exact = sha == job.File.SHA256
+		if d.Similarity = similarity(hashes, unpackHashes(packed)); d.Exact {
+			d.Similarity = 1
+		}
+		if d.Similarity >= threshold && (best == nil || d.Similarity > best.Similarity) {
+			best = &d
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if best == nil {
+		return hashes, nil
+	}
+
+	metricCount("load.duplicates", 1, tag("action", action))
+	if action == "warn" || job.AllowDuplicate {
+		text := fmt.Sprintf("%s has %.1f%% the same records as batch %d (%s), and is being loaded anyway.", job.File.Path, best.Similarity*100, best.Batch, best.File)
+		job.logf("%s\n", text)
+		notifyOps("enroll: possible duplicate "+job.File.Path, text)
+		return hashes, nil
+	}
+	notifyOps("enroll: held duplicate "+job.File.Path, fmt.Sprintf("%s was not loaded: %v. If it should be loaded anyway, requeue it with \"duplicate\": true (enroll admin requeue --duplicate).", job.File.Path, best))
+	return nil, best
+}
+
+// storeFingerprint keeps batch id's record hashes for the files after it.
+func storeFingerprint(db *sql.DB, id int64, hashes []uint64) error {
+	if hashes == nil {
+		return nil
+	}
+	_, err := execStatement(db, "batch.fingerprint", id, packHashes(hashes))
+	return err
+}
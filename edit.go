@@ -0,0 +1,302 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Support edits a record through the API:
+//
+//	PATCH /v1/enrollments/{id}   {"fields": {"OfficeInfo.State": "TX"}, "note": "..."}
+//
+// The edit goes in the way a transmitter's correction would: as a
+// partial amendment of the record (amend.go) - its EFIN and tax year, what
+// we have stored for it and the edited fields - written to a file in
+// edits.dir, loaded as a batch of one and removed. So it is checked by
+// the same rules, may go to review, is stamped with a batch, kept in the
+// row history and acknowledged like any other load. Only the latest record
+// for an EFIN can be edited; the edit fails with 409 if another load
+// amended it first. Each edit is also kept in enrollment_edit
+// (sql/028_enrollment_edits.sql) with who made it, why, and every
+// field's old and new value.
+//
+// The response is 200 with the new record if it was loaded (or went to
+// review), 422 with the errors if the rules rejected it. It needs admin
+// credentials (see admin.go); the OpenAPI document says so.
+func init() {
+	viper.SetDefault("edits.dir", "./edits")
+}
+
+// Fields an edit can't change: they say which record it amends, or when
+// it was sent.
+var fixedFields = map[string]bool{"EFIN": true, "ProcessingYear": true, "TransactionDate": true}
+
+var (
+	errEditNotFound = errors.New("no such record")
+	errEditStale    = errors.New("the record has been amended or rejected since; edit the latest record for its EFIN")
+)
+
+// editChange is one edited field.
+type editChange struct {
+	From *string `json:"from"` // nil if we don't store the field
+	To   string  `json:"to"`
+}
+
+// editError is an error the rules found with an edit.
+type editError struct {
+	Code    string `json:"code"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// editResult is the response to an edit.
+type editResult struct {
+	ID           int64                 `json:"id"`              // the record edited
+	NewID        int64                 `json:"newId,omitempty"` // the amendment
+	Batch        int64                 `json:"batch"`
+	Status       string                `json:"status"` // loaded, pending or rejected
+	Confirmation string                `json:"confirmation,omitempty"`
+	Changes      map[string]editChange `json:"changes"`
+	Errors       []editError           `json:"errors,omitempty"`
+	Warnings     []editError           `json:"warnings,omitempty"`
+}
+
+// editEnrollment applies fields to record id for editor and loads the
+// result as an amendment.
+func editEnrollment(dbs *databases, id int64, fields map[string]string, editor, note, correlation string) (editResult, error) {
+	result := editResult{ID: id, Changes: map[string]editChange{}}
+
+	stmt, err := prepare(dbs.primary, "ero.edit_base")
+	if err != nil {
+		return result, err
+	}
+	defer stmt.Close()
+	var efin, status string
+	var year int
+	err = stmt.QueryRow(id).Scan(&efin, &year, &status)
+	if err == sql.ErrNoRows {
+		return result, errEditNotFound
+	}
+	if err != nil {
+		return result, err
+	}
+	base, err := readPrior(dbs.primary, efin, year)
+	if err != nil {
+		return result, err
+	}
+	if base.ID != id || status != enrollmentLoaded && status != enrollmentPending {
+		return result, errEditStale
+	}
+
+	// The record as we have it, then the edits.
+	e := Enrollment{EFIN: efin, ProcessingYear: strconv.Itoa(year), TransactionDate: time.Now().UTC().Format("2006-01-02T15:04:05")}
+	present := fieldSet{"EFIN": true, "ProcessingYear": true, "TransactionDate": true}
+	for _, f := range priorFields {
+		v, _ := base.value(f)
+		setField(&e, f, v.String)
+		present[f] = true
+	}
+	for name, value := range fields {
+		before := e
+		field, err := setField(&e, name, value)
+		if err != nil {
+			return result, badEdit{err}
+		}
+		if fixedFields[field] {
+			return result, badEdit{fmt.Errorf("%s can't be edited", field)}
+		}
+		present[field] = true
+
+		var from *string
+		if v, ok := base.value(field); ok {
+			from = &v.String
+		} else if v, _ := fieldValue(before, field); v != "" {
+			from = &v
+		}
+		to, _ := fieldValue(e, field)
+		result.Changes[field] = editChange{From: from, To: to}
+	}
+
+	path, err := writeEdit(id, e, present)
+	if err != nil {
+		return result, err
+	}
+	// The batch and enrollment_edit keep the edit; the file was only
+	// the way in.
+	defer os.Remove(path)
+	f, err := readInputFile(path)
+	if err != nil {
+		return result, err
+	}
+	job := &batchJob{File: f, Correlation: correlation}
+	summary, err := loadFile(dbs, job)
+	result.Batch = job.ID
+	if err != nil {
+		result.Status = editFailed
+		if aerr := auditEdit(dbs, result, editor, note, []string{err.Error()}); aerr != nil {
+			log.Printf("edit of record %d: %v", id, aerr)
+		}
+		return result, err
+	}
+
+	result.Status = enrollmentRejected
+	var detail []string
+	for _, l := range summary.Loaded {
+		result.NewID, result.Confirmation, result.Status = l.ID, l.Confirmation, enrollmentLoaded
+		if l.Flagged != "" {
+			result.Status = enrollmentPending
+		}
+		result.Warnings = editErrors(l.Warnings)
+	}
+	for _, r := range summary.Rejected {
+		result.Errors = editErrors(r.Errors)
+		for _, e := range r.Errors {
+			detail = append(detail, e.Code)
+		}
+	}
+	if err := auditEdit(dbs, result, editor, note, detail); err != nil {
+		return result, err
+	}
+	if len(summary.Loaded) == 0 && hasCode(summary.Rejected, errAmendConflict) {
+		return result, errEditStale
+	}
+	return result, nil
+}
+
+// editFailed is the outcome of an edit whose batch didn't load.
+const editFailed = "failed"
+
+// auditEdit keeps the edit in enrollment_edit, with detail - error codes,
+// or the error a failed load had - as its detail.
+func auditEdit(dbs *databases, result editResult, editor, note string, detail []string) error {
+	changes, err := json.Marshal(result.Changes)
+	if err != nil {
+		return err
+	}
+	var newID, batch interface{}
+	if result.NewID != 0 {
+		newID = result.NewID
+	}
+	if result.Batch != 0 {
+		batch = result.Batch
+	}
+	_, err = execStatement(dbs.primary, "edit.add", result.ID, newID, batch, truncate(editor, 100), time.Now(), nullString(truncate(note, 400)),
+		string(changes), result.Status, nullString(truncate(strings.Join(detail, ", "), 400)))
+	return err
+}
+
+// writeEdit writes the amendment for an edit of record id as a file of
+// its own in edits.dir, with only the elements in present.
+func writeEdit(id int64, e Enrollment, present fieldSet) (string, error) {
+	dir := viper.GetString("edits.dir")
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+	content, err := encodeRecords([]Enrollment{e}, []fieldSet{present}) // see triage.go
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("ero-%d.edit-%s.xml", id, time.Now().Format("20060102150405.000000")))
+	return path, writeSealed(path, content, 0640)
+}
+
+func editErrors(errs []recordError) []editError {
+	var out []editError
+	for _, e := range errs {
+		out = append(out, editError{Code: e.Code, Field: e.Field, Message: e.Message})
+	}
+	return out
+}
+
+func hasCode(rejected []rejectedRecord, code string) bool {
+	for _, r := range rejected {
+		for _, e := range r.Errors {
+			if e.Code == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// badEdit is an edit that asks for something it can't have.
+type badEdit struct{ error }
+
+// registerEditRoutes adds PATCH /v1/enrollments/{id}.
+func registerEditRoutes(mux *http.ServeMux, dbs *databases) {
+	mux.HandleFunc("/v1/enrollments/", adminOnly(http.MethodPatch, func(w http.ResponseWriter, r *http.Request, admin string) {
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/v1/enrollments/"), 10, 64)
+		if err != nil {
+			httpError(w, http.StatusNotFound, "not found")
+			return
+		}
+
+		var body struct {
+			Fields map[string]interface{} `json:"fields"`
+			Note   string                 `json:"note"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			httpError(w, http.StatusBadRequest, "bad request body: "+err.Error())
+			return
+		}
+		if len(body.Fields) == 0 {
+			httpError(w, http.StatusBadRequest, "no fields to edit")
+			return
+		}
+		fields := map[string]string{}
+		for k, v := range body.Fields {
+			switch v := v.(type) {
+			case string:
+				fields[k] = v
+			case bool:
+				fields[k] = strconv.FormatBool(v)
+			default:
+				httpError(w, http.StatusBadRequest, fmt.Sprintf("%s must be a string or true or false", k))
+				return
+			}
+		}
+
+		result, err := editEnrollment(dbs, id, fields, admin, body.Note, r.Header.Get(correlationHeader))
+		var bad badEdit
+		switch {
+		case err == errEditNotFound:
+			httpError(w, http.StatusNotFound, err.Error())
+		case err == errEditStale:
+			httpError(w, http.StatusConflict, err.Error())
+		case errors.As(err, &bad):
+			httpError(w, http.StatusBadRequest, err.Error())
+		case err != nil:
+			httpError(w, http.StatusInternalServerError, err.Error())
+		case result.Status == enrollmentRejected:
+			writeJSON(w, http.StatusUnprocessableEntity, result)
+		default:
+			writeJSON(w, http.StatusOK, result)
+		}
+	}))
+}
@@ -0,0 +1,201 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// An empty XML element reads as "". Reporting downstream treats '' and
+// NULL differently, so "empty.fields" says per field what an empty value
+// means:
+//
+//	{"field": "OfficeInfo.State", "as": "null"}          store NULL
+//	{"field": "OfficeInfo.OfficeName", "as": "empty"}    store ''
+//	{"field": "OfficeInfo.OfficeName", "as": "error"}    reject the record (FIELD_EMPTY)
+//	{"field": "PriorYearInfo.Bank", "as": "default", "value": "NONE"}
+//
+// "null" and "empty" only make sense for fields we store (storedColumns);
+// "error" and "default" work for any text field and are applied after
+// defaults.fields, before the record is checked. Stored fields that
+// aren't configured keep their old behaviour (storedColumns).
+
+// errFieldEmpty is the code for a record rejected for an empty field.
+const errFieldEmpty = "FIELD_EMPTY"
+
+// What to do with an empty value.
+const (
+	emptyNull    = "null"
+	emptyString  = "empty"
+	emptyError   = "error"
+	emptyDefault = "default"
+)
+
+// storedColumns are the text fields we write to ero, with what an empty
+// value became before empty.fields existed.
+var storedColumns = map[string]string{
+	"EFIN":                  emptyString,
+	"MasterEfin":            emptyNull,
+	"OfficeInfo.OfficeName": emptyString,
+	"OfficeInfo.State":      emptyNull,
+	"PriorYearInfo.Bank":    emptyNull,
+}
+
+// storedColumn is the ero column a stored field is written to.
+type storedColumn struct {
+	Name   string
+	Type   string // SQL type, e.g. NVARCHAR(100)
+	Length int    // in characters
+}
+
+var storedColumnTypes = map[string]storedColumn{
+	"EFIN":                  {"EFIN", "VARCHAR(6)", 6},
+	"MasterEfin":            {"MASTER_EFIN", "VARCHAR(6)", 6},
+	"OfficeInfo.OfficeName": {"COMPANY", "NVARCHAR(100)", 100},
+	"OfficeInfo.State":      {"STATE", "CHAR(2)", 2},
+	"PriorYearInfo.Bank":    {"PRIOR_BANK", "NVARCHAR(60)", 60},
+}
+
+// eroColumn is a text column of ero as the database describes it.
+type eroColumn struct {
+	Length    int // -1 for (N)VARCHAR(MAX)
+	Collation string
+}
+
+// readEroColumns reads ero's text columns, by name. A login that can't
+// see some of them gets only the rest.
+func readEroColumns(db *sql.DB) (map[string]eroColumn, error) {
+	stmt, err := prepare(db, "schema.ero_columns")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := map[string]eroColumn{}
+	for rows.Next() {
+		var name string
+		var c eroColumn
+		if err := rows.Scan(&name, &c.Length, &c.Collation); err != nil {
+			return nil, err
+		}
+		columns[name] = c
+	}
+	return columns, rows.Err()
+}
+
+type emptyRule struct {
+	Field string `mapstructure:"field"`
+	As    string `mapstructure:"as"`
+	Value string `mapstructure:"value"`
+}
+
+// emptyPolicy is the checked empty.fields.
+type emptyPolicy struct {
+	rules  []emptyRule       // error and default, in order
+	stored map[string]string // stored field -> null or empty
+}
+
+func loadEmptyPolicy(cfg *viper.Viper) (*emptyPolicy, error) {
+	var rules []emptyRule
+	if err := cfg.UnmarshalKey("empty.fields", &rules); err != nil {
+		return nil, fmt.Errorf("config: empty.fields: %v", err)
+	}
+
+	p := &emptyPolicy{stored: map[string]string{}}
+	for k, v := range storedColumns {
+		p.stored[k] = v
+	}
+	var e Enrollment
+	for _, r := range rules {
+		if v, ok := fieldValue(e, r.Field); !ok || v != "" {
+			return nil, fmt.Errorf("config: empty: %q is not a text field", r.Field)
+		}
+		switch r.As {
+		case emptyNull, emptyString:
+			if _, ok := storedColumns[r.Field]; !ok {
+				return nil, fmt.Errorf("config: empty: %s isn't stored, so it can't be %s (stored fields: %s)", r.Field, r.As, strings.Join(storedFields(), ", "))
+			}
+			p.stored[r.Field] = r.As
+		case emptyError, emptyDefault:
+			if r.As == emptyDefault && r.Value == "" {
+				return nil, fmt.Errorf("config: empty: %s: a default needs a value", r.Field)
+			}
+			p.rules = append(p.rules, r)
+		default:
+			return nil, fmt.Errorf("config: empty: %s: as must be null, empty, error or default (got %q)", r.Field, r.As)
+		}
+	}
+	return p, nil
+}
+
+func storedFields() []string {
+	var names []string
+	for k := range storedColumns {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// apply fills in defaults for empty fields and returns an error for each
+// empty field that mustn't be. Fields a partial amendment left out
+// (present, see amend.go) are skipped.
+func (p *emptyPolicy) apply(e *Enrollment, present fieldSet) []recordError {
+	if p == nil {
+		return nil
+	}
+	var problems []recordError
+	for _, r := range p.rules {
+		if !present.has(r.Field) {
+			continue
+		}
+		v, _ := fieldRef(e, r.Field)
+		if !blank(v) {
+			continue
+		}
+		if r.As == emptyDefault {
+			v.SetString(r.Value)
+			continue
+		}
+		problems = append(problems, recordError{Field: r.Field, Code: errFieldEmpty, Message: r.Field + " is empty"})
+	}
+	return problems
+}
+
+// column is the value to write for a stored field: NULL for an empty
+// value if the field is "null", the value otherwise.
+func (p *emptyPolicy) column(e Enrollment, field string) interface{} {
+	v, _ := fieldValue(e, field)
+	as := storedColumns[field]
+	if p != nil {
+		as = p.stored[field]
+	}
+	if as == emptyNull {
+		return nullString(v)
+	}
+	return v
+}
@@ -0,0 +1,348 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// The enrich stage (pipeline.go) adds columns to each record that passes
+// its checks, from lookups elsewhere. They are stored by name in
+// ero_enrichment (sql/034_enrichment.sql); the view v_ero_enriched has
+// the built-in ones as columns beside the ero row, which the analytics
+// team used to join in afterwards. Two are built in, each switched on by
+// its URL, where {key} is replaced by what is looked up:
+//
+//	zip   enrich.zip.url, with the office's five-digit ZIP. Answers
+//	      {"county": "Dallas", "fips": "48113"}, giving OFFICE_COUNTY and
+//	      OFFICE_COUNTY_FIPS. Without a URL they come from the ZIP data
+//	      file, if there is one (zipdata.go).
+//	bank  enrich.bank.url, with the prior-year bank. Answers
+//	      {"routingNumber": "111000025", "name": "..."}, giving
+//	      BANK_ROUTING_NUMBER and BANK_NAME.
+//
+// enrich.<name>.token, if set, is sent as a bearer token (an env: or
+// file: reference, see secrets.go). A 404 means there is nothing to add.
+// Each call gives up after enrich.<name>.timeout (2s), and answers, found
+// or not, are kept for enrich.cachettl (24h), up to enrich.cachesize
+// (10000) per enricher. A lookup that fails leaves its columns out; the
+// record loads regardless. After enrich.breaker.failures (5) failures in
+// a row an enricher stops calling for a while (breaker.go), as the bank
+// API does.
+//
+// Code compiled into the loader can add enrichers with RegisterEnricher.
+func init() {
+	for _, b := range builtinEnrichers {
+		viper.SetDefault("enrich."+b.Name+".timeout", "2s")
+	}
+	viper.SetDefault("enrich.cachettl", "24h")
+	viper.SetDefault("enrich.cachesize", 10000)
+	viper.SetDefault("enrich.breaker.failures", 5)
+	viper.SetDefault("enrich.breaker.cooldown", "1m")
+	viper.SetDefault("enrich.breaker.maxcooldown", "15m")
+}
+
+// An Enricher works out extra columns for a record, by name. It should
+// give up after a timeout of its own; an error leaves its columns out.
+type Enricher interface {
+	Name() string
+	Enrich(e Enrollment) (map[string]string, error)
+}
+
+var enrichers struct {
+	sync.Mutex
+	registered []Enricher
+	builtin    []Enricher
+	built      bool
+	err        error
+}
+
+// RegisterEnricher adds an enricher, run after the built-in ones.
+func RegisterEnricher(en Enricher) {
+	enrichers.Lock()
+	enrichers.registered = append(enrichers.registered, en)
+	enrichers.Unlock()
+}
+
+// configuredEnrichers is the built-in enrichers that have a URL (or, for
+// zip, the ZIP data), then the registered ones. The built-ins, and their caches, last as long as
+// the process.
+func configuredEnrichers() ([]Enricher, error) {
+	enrichers.Lock()
+	defer enrichers.Unlock()
+	if !enrichers.built {
+		enrichers.built = true
+		for _, b := range builtinEnrichers {
+			if viper.GetString("enrich."+b.Name+".url") == "" {
+				if b.Name == "zip" && viper.GetString("refdata.zip.file") != "" {
+					enrichers.builtin = append(enrichers.builtin, zipEnricher{}) // see zipdata.go
+				}
+				continue
+			}
+			l, err := newLookupEnricher(b)
+			if err != nil {
+				enrichers.err = err
+				break
+			}
+			enrichers.builtin = append(enrichers.builtin, l)
+		}
+	}
+	if enrichers.err != nil {
+		return nil, enrichers.err
+	}
+	return append(append([]Enricher{}, enrichers.builtin...), enrichers.registered...), nil
+}
+
+// errEnricherPaused is a lookup the breaker didn't let through.
+var errEnricherPaused = errors.New("paused after repeated failures")
+
+// enrich runs job's enrichers on record i. Where two give the same
+// column, the later one wins.
+func enrich(job *batchJob, i int, e Enrollment) map[string]string {
+	var columns map[string]string
+	for _, en := range job.Enrichers {
+		var found map[string]string
+		var err error
+		safely(job, "enricher "+en.Name(), func() { found, err = en.Enrich(e) })
+		if err != nil {
+			if err != errEnricherPaused {
+				job.logRecordf(i, "enricher %s: record %d: %v", en.Name(), i, err)
+			}
+			metricCount("enrich.failed", 1, tag("enricher", en.Name()))
+			continue
+		}
+		for k, v := range found {
+			if columns == nil {
+				columns = map[string]string{}
+			}
+			columns[k] = v
+		}
+	}
+	return columns
+}
+
+// storeEnrichment writes a loaded record's enrichment columns.
+func storeEnrichment(p preparer, id int64, columns map[string]string) error {
+	names := make([]string, 0, len(columns))
+	for k := range columns {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if _, err := execStatement(p, "ero_enrichment.add", id, truncate(k, 64), truncate(columns[k], 400)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// builtinEnricher is one of the built-in lookups.
+type builtinEnricher struct {
+	Name    string
+	Key     func(e Enrollment) string // what to look up; nothing if ""
+	Columns map[string]string         // field in the answer -> column
+}
+
+var builtinEnrichers = []builtinEnricher{
+	{"zip", func(e Enrollment) string { return zip5(e.OfficeInfo.Zip) },
+		map[string]string{"county": "OFFICE_COUNTY", "fips": "OFFICE_COUNTY_FIPS"}},
+	{"bank", func(e Enrollment) string { return strings.TrimSpace(e.PriorYearInfo.Bank) },
+		map[string]string{"routingNumber": "BANK_ROUTING_NUMBER", "name": "BANK_NAME"}},
+}
+
+// zip5 is the five-digit ZIP from a ZIP or ZIP+4, or "".
+func zip5(zip string) string {
+	zip = strings.TrimSpace(zip)
+	if len(zip) < 5 {
+		return ""
+	}
+	for _, r := range zip[:5] {
+		if !unicode.IsDigit(r) {
+			return ""
+		}
+	}
+	return zip[:5]
+}
+
+// lookupEnricher is a built-in enricher: a GET of its URL.
+type lookupEnricher struct {
+	spec    builtinEnricher
+	url     string
+	token   string
+	client  *http.Client
+	breaker *breaker
+	ttl     time.Duration
+	size    int
+
+	mu    sync.Mutex
+	cache map[string]cachedLookup
+}
+
+// cachedLookup is an answer we keep; Columns is nil if nothing was found.
+type cachedLookup struct {
+	Columns map[string]string
+	Expires time.Time
+}
+
+func newLookupEnricher(b builtinEnricher) (*lookupEnricher, error) {
+	prefix := "enrich." + b.Name + "."
+	durations := map[string]time.Duration{}
+	for _, key := range []string{prefix + "timeout", "enrich.cachettl", "enrich.breaker.cooldown", "enrich.breaker.maxcooldown"} {
+		d, err := configDuration(key)
+		if err != nil {
+			return nil, err
+		}
+		durations[key] = d
+	}
+	if !strings.Contains(viper.GetString(prefix+"url"), "{key}") {
+		return nil, fmt.Errorf("config: %surl must contain {key}", prefix)
+	}
+
+	var token string
+	if ref := viper.GetString(prefix + "token"); ref != "" {
+		var err error
+		if token, err = secretValue(ref); err != nil {
+			return nil, fmt.Errorf("config: %stoken: %v", prefix, err)
+		}
+	}
+
+	return &lookupEnricher{
+		spec:   b,
+		url:    viper.GetString(prefix + "url"),
+		token:  token,
+		client: &http.Client{Timeout: durations[prefix+"timeout"]},
+		breaker: newBreaker("enrich-"+b.Name, viper.GetInt("enrich.breaker.failures"),
+			durations["enrich.breaker.cooldown"], durations["enrich.breaker.maxcooldown"]),
+		ttl:   durations["enrich.cachettl"],
+		size:  viper.GetInt("enrich.cachesize"),
+		cache: map[string]cachedLookup{},
+	}, nil
+}
+
+func (l *lookupEnricher) Name() string { return l.spec.Name }
+
+// Enrich looks the record up, from the cache if it can.
+func (l *lookupEnricher) Enrich(e Enrollment) (map[string]string, error) {
+	key := l.spec.Key(e)
+	if key == "" {
+		return nil, nil
+	}
+	if columns, ok := l.cached(key); ok {
+		metricCount("enrich.lookup", 1, tag("enricher", l.spec.Name), "result:cached")
+		return columns, nil
+	}
+	if !l.breaker.allow() {
+		return nil, errEnricherPaused
+	}
+
+	columns, err := l.fetch(key)
+	if err != nil && isAPIOutage(err) {
+		l.breaker.failure(err)
+		return nil, err
+	}
+	l.breaker.success()
+	if err != nil {
+		return nil, err // it answered, but not usefully; ask again next time
+	}
+	metricCount("enrich.lookup", 1, tag("enricher", l.spec.Name), "result:fetched")
+	l.keep(key, columns)
+	return columns, nil
+}
+
+// fetch calls the lookup for key. Columns is nil if it isn't known.
+func (l *lookupEnricher) fetch(key string) (map[string]string, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.Replace(l.url, "{key}", url.PathEscape(key), -1), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if l.token != "" {
+		req.Header.Set("Authorization", "Bearer "+l.token)
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode >= 300 {
+		return nil, &callError{API: "enrich " + l.spec.Name, Status: resp.StatusCode, Text: resp.Status}
+	}
+
+	var answer map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, &callError{API: "enrich " + l.spec.Name, Status: resp.StatusCode, Text: err.Error()}
+	}
+	var columns map[string]string
+	for field, column := range l.spec.Columns {
+		v, ok := answer[field]
+		if !ok || v == nil {
+			continue
+		}
+		if columns == nil {
+			columns = map[string]string{}
+		}
+		columns[column] = strings.TrimSpace(fmt.Sprint(v))
+	}
+	return columns, nil
+}
+
+func (l *lookupEnricher) cached(key string) (map[string]string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.cache[key]
+	if !ok || time.Now().After(c.Expires) {
+		return nil, false
+	}
+	return c.Columns, true
+}
+
+// keep caches an answer. When the cache is full the expired answers go,
+// and if none have, an arbitrary one.
+func (l *lookupEnricher) keep(key string, columns map[string]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.cache) >= l.size {
+		now := time.Now()
+		for k, c := range l.cache {
+			if now.After(c.Expires) {
+				delete(l.cache, k)
+			}
+		}
+		for k := range l.cache {
+			if len(l.cache) < l.size {
+				break
+			}
+			delete(l.cache, k)
+		}
+	}
+	if l.size > 0 {
+		l.cache[key] = cachedLookup{Columns: columns, Expires: time.Now().Add(l.ttl)}
+	}
+}
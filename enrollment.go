@@ -17,34 +17,31 @@
 //    header to the file contents
 // 2) It validates the contents of each record
 // 3) It inserts the records into SQL Server
-//    - We need to break up the "flat" record structure into a
-//      relational format.
+//    - The "flat" record is broken up into a relational format: the
+//      ero row, and a row per part of it (see parts.go).
 
 package main
 
 import (
 	// "bufio"
-	"database/sql" // https://golang.org/pkg/database/sql/
 	// https://golang.org/pkg/encoding/csv/
-	"encoding/xml" // https://golang.org/pkg/encoding/xml/
-	"flag"         // https://golang.org/pkg/flag/
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
-	"time"
+	"path/filepath"
+	"strings"
 
 	// Notice that we're loading the MSSQL driver anonymously, aliasing its
 	// package qualifier to _ so none of its exported names are visible
 	// to our code. Under the hood, the driver registers itself as being
 	// available to the database/sql package.
-	_ "github.com/denisenkom/go-mssqldb" // https://github.com/denisenkom/go-mssqldb
+	_ "github.com/microsoft/go-mssqldb" // https://github.com/microsoft/go-mssqldb
 
 	// _ "github.com/go-sql-driver/mysql"
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
 	"github.com/spf13/viper" // https://github.com/spf13/viper
-	// "github.com/spf13/cobra"              // https://github.com/spf13/cobra
 	// "github.com/spf13/pflag"              //https://github.com/spf13/pflag
-	"github.com/asaskevich/govalidator" // https://github.com/asaskevich/govalidator
 )
 
 // Reading files requires checking most calls for errors.
@@ -64,118 +61,64 @@ func setupEnvironment() {
 	viper.SetConfigType("json")
 	err := viper.ReadInConfig()
 	check(err)
+	check(mergeTransmitterConfigs()) // see transmitter.go
+	check(setupLogging())            // see logging.go
 	// if err != nil {
 	// 	panic(fmt.Errorf("Fatal error with config file: %s \n", err))
 	// }
 }
 
-func main() {
-
-	setupEnvironment()
-
-	// Now, let's grab any command line flags
-	// Use -debug to turn on debugging
-	debug := flag.Bool("debug", false, "enable debugging")
-	// Once all flags are declared, call flag.Parse() to execute the command-line parsing.
-	flag.Parse()
-
-	// Finally, let's get any command line arguments
-	// Note: os.Args[0] (first value in this slice) is the path
-	// to the program so we skip it.
-	args := os.Args[1:] // this creates a slice
+// debug is set by the --debug flag on any command.
+var debug bool
 
-	argString := ""
-	spacer := ""
-
-	// Step through the slice
-	for _, arg := range args {
-		argString += spacer + arg
-		spacer = ", "
-	}
-
-	if *debug {
-		fmt.Println("Command Line Arguments: ", argString)
-	}
+// rootCmd is "enroll" with no sub-command: load the enrollment file.
+var rootCmd = &cobra.Command{
+	Use:   "enroll FILE...",
+	Short: "Process enrollment files",
+	Long: `enroll validates enrollment files and loads them into SQL Server.
 
-	/*
-
-	   The idiomatic way to use a SQL, or SQL-like, database in Go is through the
-	   database/sql package. It provides a lightweight interface to a row-oriented database.
-
-	   The first thing to do is import the database/sql package, and a driver package.
-	   You generally shouldn't use the driver package directly, although some drivers
-	   encourage you to do so. (In our opinion, it's usually a bad idea.) Instead,
-	   your code should only refer to database/sql. This helps avoid making your
-	   code dependent on the driver, so that you can change the underlying driver
-	   (and thus the database you're accessing) without changing your code. It also
-	   forces you to use the Go idioms instead of ad-hoc idioms that a particular
-	   driver author may have provided.
-
-	   Step 1: Establish database connection.
-
-	   The sql.DB performs some important tasks for you behind the scenes:
-	    1. It opens and closes connections to the actual underlying database, via the driver.
-	    2. It manages a pool of connections as needed.
-
-	   These "connections" may be file handles, sockets, network connections,
-	   or other ways to access the database. The sql.DB abstraction is
-	   designed to keep you from worrying about how to manage concurrent
-	   access to the underlying datastore. A connection is marked in-use
-	   when you use it to perform a task, and then returned to the available
-	   pool when it's not in use anymore. One consequence of this is that if
-	   you fail to release connections back to the pool, you can cause db.SQL
-	   to open a lot of connections, potentially running out of resources
-	   (too many connections, too many open file handles, lack of available n
-	   etwork ports, etc). We'll discuss more about this later.
-
-	   To create a sql.DB, you use sql.Open(). This returns a *sql.DB:
-
-	   Perhaps counter-intuitively, sql.Open() does
-	   not establish any connections to the database, nor does it validate
-	   driver connection parameters. Instead, it simply prepares the database
-	   abstraction for later use.
+With no sub-command it loads the files named, one after the other. A name
+can be a glob, such as 'inbox/ERO2016*.xml'.`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  runLoad,
+}
 
-	   // MySQL Example
-	   db, err := sql.Open("mysql", "user:password@tcp(127.0.0.1:3306)/hello")
-	   if err != nil {
-	       log.Fatal(err)
-	   }
-	*/
+func main() {
+	// Now, let's grab any command line flags
+	// Use --debug to turn on debugging
+	rootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "enable debugging")
 
-	// SQL Server Example
-	connString := "server=" + viper.GetString("mssql.host") + ";port=" + viper.GetString("mssql.port") + ";user id=" + viper.GetString("mssql.user") + ";password=" + viper.GetString("mssql.password") + ";database=" + viper.GetString("mssql.database")
+	// The config file is read once the flags are parsed, before any
+	// command runs.
+	cobra.OnInitialize(setupEnvironment, startProfiling)
 
-	db, err := sql.Open("mssql", connString)
+	err := rootCmd.Execute()
+	stopProfiling() // see profile.go
 	if err != nil {
-		log.Fatal("Open connection failed:", err.Error())
+		os.Exit(1)
 	}
+}
 
-	// It is idiomatic to defer db.Close() if the sql.DB should not have a
-	// lifetime beyond the scope of the function.
+// runLoad reads each enrollment file named on the command line and loads
+// it, printing a summary for each. A file that fails doesn't stop the
+// ones after it, but the command exits non-zero.
+func runLoad(cmd *cobra.Command, args []string) {
+	check(requireStorageKey()) // checkpoints and quarantined files (see atrest.go)
 
-	// Although it's idiomatic to Close() the database when you're finished
-	// with it, the sql.DB object is designed to be long-lived. Don't Open()
-	// and Close() databases frequently. Instead, create one sql.DB object
-	// for each distinct datastore you need to access, and keep it until the
-	// program is done accessing that datastore. Pass it around as needed, or
-	// make it available somehow globally, but keep it open. And don't Open()
-	// and Close() from a short-lived function. Instead, pass the sql.DB into
-	// that short-lived function as an argument.
-	defer db.Close()
+	// Finally, let's see any command line arguments
+	// Note: cobra has already stripped the program name and flags.
+	paths, err := inputPaths(args)
+	check(err)
 
-	// The first actual connection to the underlying datastore will be
-	// established lazily, when it's needed for the first time. If you want
-	// to check right away that the database is available and accessible
-	// (for example, check that you can establish a network connection and log
-	// in), use db.Ping() to do that, and remember to check for errors:
-	err = db.Ping()
-	if err != nil {
-		if *debug {
-			fmt.Printf("Database Connected!\n")
-			fmt.Printf("Connection: %s\n\n", connString)
-		}
+	if debug {
+		fmt.Println("Files: ", strings.Join(paths, ", "))
 	}
 
+	// Step 1: Establish database connection (see db.go).
+	dbs, err := openDatabases()
+	check(err)
+	defer dbs.Close()
+
 	// // Perhaps the most basic file reading task is slurping a file’s entire contents into memory.
 	// dat, err := ioutil.ReadFile("./tmp/file.txt")
 	// check(err)
@@ -187,216 +130,38 @@ func main() {
 
 	********************************************************************* */
 
-	// Golang has a very powerful encoding/xml package that is part of the
-	// standard library. All you need to do is the create the data structures
-	// that map to an XML document. Then read the XML document with the
-	// xml.Unmarshal() function. Because Unmarshal uses the reflect package,
-	// it can only assign to exported (upper case) fields.
-
-	// OfficeInfo -
-	type OfficeInfo struct {
-		OfficeName          string `xml:"OfficeName"`
-		PrimaryContactFirst string `xml:"PrimaryContactFirst"`
-		PrimaryContactLast  string `xml:"PrimaryContactLast"`
-		PhoneNumber         string `xml:"PhoneNumber"`
-		FaxNumber           string `xml:"FaxNumber"`
-		Email               string `xml:"Email"`
-		Address1            string `xml:"Address1"`
-		Address2            string `xml:"Address2"`
-		City                string `xml:"City"`
-		State               string `xml:"State"`
-		Zip                 string `xml:"Zip"`
-	}
-
-	// OwnerInformation -
-	type OwnerInformation struct {
-		FirstName   string `xml:"FirstName"`
-		LastName    string `xml:"LastName"`
-		PhoneNumber string `xml:"PhoneNumber"`
-		Email       string `xml:"Email"`
-		Address1    string `xml:"Address1"`
-		Address2    string `xml:"Address2"`
-		City        string `xml:"City"`
-		State       string `xml:"State"`
-		Zip         string `xml:"Zip"`
-		SSN         string `xml:"SSN"`
-		DateOfBirth string `xml:"DateOfBirth"`
-	}
-
-	// EFINOwnerInfo -
-	type EFINOwnerInfo struct {
-		FirstName   string `xml:"FirstName"`
-		LastName    string `xml:"LastName"`
-		PhoneNumber string `xml:"PhoneNumber"`
-		Email       string `xml:"Email"`
-		Address1    string `xml:"Address1"`
-		Address2    string `xml:"Address2"`
-		City        string `xml:"City"`
-		State       string `xml:"State"`
-		Zip         string `xml:"Zip"`
-		SSN         string `xml:"SSN"`
-		DateOfBirth string `xml:"DateOfBirth"`
-	}
-
-	// PriorYearInfo -
-	type PriorYearInfo struct {
-		Bank                  string `xml:"Bank"`
-		ClientOfYoursLastYear bool   `xml:"ClientOfYoursLastYear"`
-	}
-
-	// Enrollment - Enrollment record
-	type Enrollment struct {
-		MasterEfin       string           `xml:"MasterEfin"`
-		EFIN             string           `xml:"EFIN"`
-		TransmitterID    string           `xml:"TransmitterId"`
-		ProcessingYear   string           `xml:"ProcessingYear"`
-		OfficeInfo       OfficeInfo       `xml:"OfficeInfo"`
-		OwnerInformation OwnerInformation `xml:"OwnerInformation"`
-		EFINOwnerInfo    EFINOwnerInfo    `xml:"EFINOwnerInfo"`
-		PriorYearInfo    PriorYearInfo    `xml:"PriorYearInfo"`
-		TransactionDate  string           `xml:"TransactionDate"`
-	}
-
-	// EnrollmentCollection - Full enrollment collection
-	type EnrollmentCollection struct {
-		XMLName        xml.Name     `xml:"EnrollmentCollection"`
-		EnrollmentList []Enrollment `xml:"Enrollment"`
-	}
-
-	// Golang has a very powerful encoding/xml package that is part of the
-	// standard library. All you need to do is the create the data structures
-	// that map to an XML document. Then read the XML document with the
-	// xml.Unmarshal() function. Because Unmarshal uses the reflect package,
-	// it can only assign to exported (upper case) fields.
-
-	// OfficeInfo -
-	type ValidOfficeInfo struct {
-		OfficeName          string `valid:"alphanum,required"`
-		PrimaryContactFirst string `valid:"alphanum,required"`
-		PrimaryContactLast  string `valid:"alphanum,required"`
-		PhoneNumber         string `valid:"-"`
-		FaxNumber           string `valid:"-"`
-		Email               string `valid:"email,required"`
-		Address1            string `valid:"alphanum,required"`
-		Address2            string `valid:"-"`
-		City                string `valid:"alphanum,required"`
-		State               string `valid:"length(2|2)"`
-		Zip                 string `valid:"alphanum,required"`
-	}
-
-	// OwnerInformation -
-	type ValidOwnerInformation struct {
-		FirstName   string `valid:"alphanum,required"`
-		LastName    string `valid:"alphanum,required"`
-		PhoneNumber string `valid:"alphanum,required"`
-		Email       string `valid:"Email"`
-		Address1    string `valid:"alphanum,required"`
-		Address2    string `valid:"-"`
-		City        string `valid:"alphanum,required"`
-		State       string `valid:"length(2|2)"`
-		Zip         string `valid:"alphanum,required"`
-		SSN         string `valid:"ssn"`
-		DateOfBirth string `valid:"-"`
-	}
-
-	// EFINOwnerInfo -
-	type ValidEFINOwnerInfo struct {
-		FirstName   string `valid:"-"`
-		LastName    string `valid:"-"`
-		PhoneNumber string `valid:"-"`
-		Email       string `valid:"-"`
-		Address1    string `valid:"-"`
-		Address2    string `valid:"-"`
-		City        string `valid:"-"`
-		State       string `valid:"-"`
-		Zip         string `valid:"-"`
-		SSN         string `valid:"-"`
-		DateOfBirth string `valid:"-"`
-	}
-
-	// PriorYearInfo -
-	type ValidPriorYearInfo struct {
-		Bank                  string `valid:"-"`
-		ClientOfYoursLastYear bool   `valid:"-"`
-	}
-
-	// Enrollment - Enrollment record
-	type ValidEnrollment struct {
-		MasterEfin       string `valid:"numeric,required"`
-		EFIN             string `valid:"numeric,required"`
-		TransmitterID    string `valid:"numeric,required"`
-		ProcessingYear   string `valid:"numeric,required"`
-		OfficeInfo       OfficeInfo
-		OwnerInformation OwnerInformation
-		EFINOwnerInfo    EFINOwnerInfo
-		PriorYearInfo    PriorYearInfo
-		TransactionDate  string `valid:"-"`
-	}
-
-	// Read the XML File
-	xmlFile, err := os.Open("./examples/EROEnrollmentRecords.xml")
-	check(err)
-	defer xmlFile.Close()
-
-	b, _ := ioutil.ReadAll(xmlFile)
-	v := EnrollmentCollection{}
-
-	// Unmarshal parses the XML-encoded data and stores the result in the
-	// value pointed to by v, which must be an arbitrary struct, slice, or
-	// string. Well-formed data that does not fit into v is discarded.
-
-	err = xml.Unmarshal(b, &v)
-	if err != nil {
-		fmt.Printf("error: %v", err)
-		return
-	}
-
-	// Lets view some of the data
-	for _, Enrollment := range v.EnrollmentList {
-		// fmt.Printf("\t%s\n\n", Enrollment)
-		fmt.Printf("Tax Year: %q\n", Enrollment.ProcessingYear)
-		fmt.Printf("EFIN: %q\n", Enrollment.EFIN)
-		fmt.Printf("Company Name: %q\n", Enrollment.OfficeInfo.OfficeName)
-		fmt.Printf("Date: %q\n", Enrollment.TransactionDate)
+	failed := 0
+	for _, path := range paths {
+		if len(paths) > 1 {
+			fmt.Printf("\n== %s\n", path)
+		}
 
-		// Convert date string to time value
-		t, err := time.Parse(time.RFC3339, Enrollment.TransactionDate+"Z")
+		// Read the file (see records.go)
+		f, err := readInputFile(path)
 		if err != nil {
-			println("error: " + err.Error())
+			fmt.Printf("error: %v\n", err)
+			failed++
+			continue
 		}
-		fmt.Println(t)
-
-		// let's validate some of the data
-		println(govalidator.IsUpperCase(`Enrollment.OfficeInfo.OfficeName`))
-		//
-		//
-		//
-		// ValidEnrollment = Enrollment
-		// result, err := govalidator.ValidateStruct(ValidEnrollment)
-		// if err != nil {
-		// 	println("error: " + err.Error())
-		// }
-		// println(result)
-		// fmt.Printf("Tax Year: %q\n", ValidEnrollment.ProcessingYear)
-		// fmt.Printf("EFIN: %q\n", ValidEnrollment.EFIN)
-		// fmt.Printf("Company Name: %q\n", ValidEnrollment.OfficeInfo.OfficeName)
-		// fmt.Printf("Date: %q\n", ValidEnrollment.TransactionDate)
-
-		// Let's insert into SQL Server
-		stmt, err := db.Prepare("INSERT INTO ero(EFIN,COMPANY,TAX_YEAR,RECEIVED_DATE) VALUES(?,?,?,?)")
-		check(err)
-
-		res, err := stmt.Exec(Enrollment.EFIN, Enrollment.OfficeInfo.OfficeName, 2016, t)
-		check(err)
 
-		// lastId, err := res.LastInsertId()
-		// check(err)
-
-		rowCnt, err := res.RowsAffected()
-		check(err)
-
-		// log.Printf("ID = %d, affected = %d\n", lastId, rowCnt)
-		log.Printf("Insert Successful, Rows affected = %d\n\n", rowCnt)
+		// Insert the records (see load.go)
+		summary, err := loadFile(dbs, &batchJob{File: f, AllowDuplicate: allowDuplicate})
+		var already *alreadyLoadedError
+		if errors.As(err, &already) { // see ledger.go
+			fmt.Printf("%s: %v; nothing to do\n", path, err)
+			continue
+		}
+		summary.print()
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
+			failed++
+		}
+	}
+	if len(paths) > 1 {
+		fmt.Printf("\n%d file(s): %d loaded, %d failed\n", len(paths), len(paths)-failed, failed)
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d file(s) failed", failed, len(paths))
 	}
 
 	/* ********************************************************************
@@ -515,3 +280,31 @@ func main() {
 	// fmt.Printf("5 bytes: %s\n", string(b4))
 
 }
+
+// inputPaths expands the command line's file names, any of which can be
+// a glob, into the files to load, in the order given. A glob that matches
+// nothing is an error; a plain name is left for reading the file to fail
+// on if it isn't there.
+func inputPaths(args []string) ([]string, error) {
+	var paths []string
+	seen := map[string]bool{}
+	for _, arg := range args {
+		matches := []string{arg}
+		if strings.ContainsAny(arg, "*?[") {
+			var err error
+			if matches, err = filepath.Glob(arg); err != nil {
+				return nil, fmt.Errorf("%s: %v", arg, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %s", arg)
+			}
+		}
+		for _, path := range matches {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths, nil
+}
@@ -0,0 +1,187 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package enrollment
+
+import (
+	"encoding/csv" // https://golang.org/pkg/encoding/csv/
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// An enrollment CSV file has a row per Enrollment and a column per field,
+// named by its Go path: "EFIN", "OfficeInfo.Email", "PriorYearInfo.Bank"
+// and so on. With a header row the columns can come in any order and any
+// of them can be left out; without one they are CSVColumns, in that
+// order, and a short row leaves the fields at the end empty. Names are
+// matched without regard to case. ClientOfYoursLastYear takes true/false,
+// 1/0 or Y/N, and blank is false.
+
+// CSVColumns is the column layout of a CSV file without a header row:
+// every field of an Enrollment, in the order they are declared.
+var CSVColumns = csvColumns()
+
+// pathIndex and pathNames are each field of an Enrollment, and its Go
+// path as it is in CSVColumns, by its lower-cased Go path.
+var (
+	pathIndex = map[string][]int{}
+	pathNames = map[string]string{}
+)
+
+func csvColumns() []string {
+	var names []string
+	var walk func(t reflect.Type, prefix string, index []int)
+	walk = func(t reflect.Type, prefix string, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			at := append(append([]int{}, index...), i)
+			if f.Type.Kind() == reflect.Struct {
+				walk(f.Type, prefix+f.Name+".", at)
+				continue
+			}
+			names = append(names, prefix+f.Name)
+			pathIndex[strings.ToLower(prefix+f.Name)] = at
+			pathNames[strings.ToLower(prefix+f.Name)] = prefix + f.Name
+		}
+	}
+	walk(reflect.TypeOf(Enrollment{}), "", nil)
+	return names
+}
+
+// ParseCSV reads enrollment records from r, a CSV file laid out as above.
+// columns is the header row's column names, as in CSVColumns, or nil if
+// the file has no header row. Errors are *ParseError, as for Parse, and
+// Err is a *csv.ParseError with the line.
+func ParseCSV(r io.Reader, opts ...Option) (records []Enrollment, columns []string, err error) {
+	o := parseOptions(opts)
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	// fail is err in field i of the row just read.
+	fail := func(i int, err error) error {
+		line, col := cr.FieldPos(i)
+		return &ParseError{Offset: cr.InputOffset(), Err: &csv.ParseError{StartLine: line, Line: line, Column: col, Err: err}}
+	}
+
+	var index [][]int
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return records, columns, nil
+		}
+		if err != nil {
+			return nil, nil, &ParseError{Offset: cr.InputOffset(), Err: err}
+		}
+
+		if index == nil {
+			if columns, index, err = csvHeader(row); err != nil {
+				return nil, nil, fail(0, err)
+			}
+			if columns != nil {
+				continue
+			}
+		}
+		if o.full(len(records)) {
+			return nil, nil, &ParseError{Offset: cr.InputOffset(), Err: ErrTooManyRecords}
+		}
+		if len(row) > len(index) {
+			return nil, nil, fail(len(index), fmt.Errorf("%d fields, but there are only %d columns", len(row), len(index)))
+		}
+
+		var e Enrollment
+		v := reflect.ValueOf(&e).Elem()
+		for i, cell := range row {
+			f := v.FieldByIndex(index[i])
+			if f.Kind() != reflect.Bool {
+				f.SetString(cell)
+				continue
+			}
+			b, err := csvBool(cell)
+			if err != nil {
+				return nil, nil, fail(i, fmt.Errorf("%s: %v", csvName(columns, i), err))
+			}
+			f.SetBool(b)
+		}
+		internEnrollment(&e)
+		records = append(records, e)
+	}
+}
+
+// csvHeader works out the columns from the file's first row. A row in
+// which any cell names a column is the header, and then every cell must.
+// Otherwise there is no header, columns is nil, and the row is a record
+// in the CSVColumns layout.
+func csvHeader(row []string) (columns []string, index [][]int, err error) {
+	named := false
+	for _, cell := range row {
+		if _, ok := pathIndex[csvKey(cell)]; ok {
+			named = true
+			break
+		}
+	}
+	if !named {
+		for _, name := range CSVColumns {
+			index = append(index, pathIndex[strings.ToLower(name)])
+		}
+		return nil, index, nil
+	}
+
+	seen := map[string]bool{}
+	for _, cell := range row {
+		name := csvKey(cell)
+		at, ok := pathIndex[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown column %q", cell)
+		}
+		if seen[name] {
+			return nil, nil, fmt.Errorf("column %q appears twice", cell)
+		}
+		seen[name] = true
+		columns = append(columns, pathNames[name])
+		index = append(index, at)
+	}
+	return columns, index, nil
+}
+
+// csvKey is a header cell as pathIndex has it. Spreadsheets often start
+// the file with a byte order mark.
+func csvKey(cell string) string {
+	return strings.ToLower(strings.TrimSpace(strings.TrimPrefix(cell, "\ufeff")))
+}
+
+// csvName is column i's name, for errors.
+func csvName(columns []string, i int) string {
+	if columns != nil {
+		return columns[i]
+	}
+	return CSVColumns[i]
+}
+
+func csvBool(s string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "n", "no":
+		return false, nil
+	case "y", "yes":
+		return true, nil
+	}
+	return strconv.ParseBool(strings.TrimSpace(s))
+}
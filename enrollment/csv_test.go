@@ -0,0 +1,149 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package enrollment
+
+import (
+	"encoding/csv"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		opts    []Option
+		columns []string
+		want    []Enrollment
+		wantErr string // in the error, if it fails
+	}{
+		{
+			name:    "header",
+			csv:     "EFIN,OfficeInfo.City,PriorYearInfo.ClientOfYoursLastYear\n123456,San Diego,Y\n654321,Fresno,\n",
+			columns: []string{"EFIN", "OfficeInfo.City", "PriorYearInfo.ClientOfYoursLastYear"},
+			want: []Enrollment{
+				{EFIN: "123456", OfficeInfo: OfficeInfo{City: "San Diego"}, PriorYearInfo: PriorYearInfo{ClientOfYoursLastYear: true}},
+				{EFIN: "654321", OfficeInfo: OfficeInfo{City: "Fresno"}},
+			},
+		},
+		{
+			name:    "header in any case, with a byte order mark",
+			csv:     "\ufeffefin, officeinfo.state \n123456,CA\n",
+			columns: []string{"EFIN", "OfficeInfo.State"},
+			want:    []Enrollment{{EFIN: "123456", OfficeInfo: OfficeInfo{State: "CA"}}},
+		},
+		{
+			name: "no header",
+			csv:  ",,100000,123456,77777,2016\n",
+			want: []Enrollment{{MasterEfin: "100000", EFIN: "123456", TransmitterID: "77777", ProcessingYear: "2016"}},
+		},
+		{
+			name:    "header only",
+			csv:     "EFIN\n",
+			columns: []string{"EFIN"},
+		},
+		{
+			name: "empty file",
+			csv:  "",
+		},
+		{
+			name:    "bools",
+			csv:     "EFIN,PriorYearInfo.ClientOfYoursLastYear\n1,yes\n2,no\n3,true\n4,0\n5,N\n",
+			columns: []string{"EFIN", "PriorYearInfo.ClientOfYoursLastYear"},
+			want: []Enrollment{
+				{EFIN: "1", PriorYearInfo: PriorYearInfo{ClientOfYoursLastYear: true}},
+				{EFIN: "2"},
+				{EFIN: "3", PriorYearInfo: PriorYearInfo{ClientOfYoursLastYear: true}},
+				{EFIN: "4"},
+				{EFIN: "5"},
+			},
+		},
+		{
+			name:    "bad bool",
+			csv:     "EFIN,PriorYearInfo.ClientOfYoursLastYear\n1,maybe\n",
+			wantErr: "PriorYearInfo.ClientOfYoursLastYear",
+		},
+		{
+			name:    "unknown column",
+			csv:     "EFIN,Nickname\n1,Bob\n",
+			wantErr: `unknown column "Nickname"`,
+		},
+		{
+			name:    "column twice",
+			csv:     "EFIN,efin\n1,1\n",
+			wantErr: `column "efin" appears twice`,
+		},
+		{
+			name:    "too many fields",
+			csv:     "EFIN\n1,2\n",
+			wantErr: "2 fields, but there are only 1 columns",
+		},
+		{
+			name:    "over the record limit",
+			csv:     "EFIN\n1\n2\n",
+			opts:    []Option{MaxRecords(1)},
+			wantErr: ErrTooManyRecords.Error(),
+		},
+	}
+	for _, tt := range tests {
+		records, columns, err := ParseCSV(strings.NewReader(tt.csv), tt.opts...)
+		if tt.wantErr != "" {
+			var pe *ParseError
+			if !errors.As(err, &pe) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, want a *ParseError with %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(columns, tt.columns) {
+			t.Errorf("%s: got columns %q, want %q", tt.name, columns, tt.columns)
+		}
+		if !reflect.DeepEqual(records, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, records, tt.want)
+		}
+	}
+}
+
+func TestParseCSVErrorLine(t *testing.T) {
+	_, _, err := ParseCSV(strings.NewReader("EFIN,PriorYearInfo.ClientOfYoursLastYear\n1,Y\n2,maybe\n"))
+	var ce *csv.ParseError
+	if !errors.As(err, &ce) || ce.Line != 3 || ce.Column != 3 {
+		t.Errorf("got %#v, want a *csv.ParseError at line 3, column 3", err)
+	}
+}
+
+func TestCSVColumns(t *testing.T) {
+	seen := map[string]bool{}
+	for _, name := range CSVColumns {
+		if seen[name] {
+			t.Errorf("column %q is there twice", name)
+		}
+		seen[name] = true
+	}
+	for _, name := range []string{"EFIN", "OfficeInfo.Email", "OwnerInformation.SSN", "PriorYearInfo.Bank", "TransactionDate"} {
+		if !seen[name] {
+			t.Errorf("no %q column", name)
+		}
+	}
+	if CSVColumns[0] != "Action" || CSVColumns[len(CSVColumns)-1] != "TransactionDate" {
+		t.Errorf("columns run %s to %s, want them in declaration order", CSVColumns[0], CSVColumns[len(CSVColumns)-1])
+	}
+}
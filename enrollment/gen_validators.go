@@ -0,0 +1,194 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+//go:build ignore
+
+// gen_validators writes validators_gen.go: for each Valid* struct in
+// records.go, a validator that checks the same `valid` tags as
+// govalidator, in the same order and with the same idea of empty, but
+// without reflection. It knows required, alphanum, date, email, numeric,
+// ssn, text (date and text are validate.go's) and length(min|max); a
+// struct with any other tag is left to govalidator. Run it with "go generate" (see validate.go).
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// checks maps a tag to the condition under which the value v fails it.
+var checks = map[string]string{
+	"alphanum": "!govalidator.IsAlphanumeric(v)",
+	"date":     "!IsTransactionDate(v)",
+	"email":    "!govalidator.IsEmail(v)",
+	"numeric":  "!govalidator.IsNumeric(v)",
+	"ssn":      "!govalidator.IsSSN(v)",
+	"text":     "!IsText(v)",
+}
+
+// aliases are other spellings of a tag, as in validate.go's tagAliases.
+var aliases = map[string]string{
+	"Email": "email",
+}
+
+var lengthTag = regexp.MustCompile(`^length\((\d+)\|(\d+)\)$`)
+
+type field struct {
+	Name string
+	Tag  string // the whole valid tag
+}
+
+type validStruct struct {
+	Name   string
+	Fields []field
+}
+
+func main() {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "records.go", nil, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var structs []validStruct
+	ast.Inspect(f, func(n ast.Node) bool {
+		spec, ok := n.(*ast.TypeSpec)
+		if !ok || !strings.HasPrefix(spec.Name.Name, "Valid") {
+			return true
+		}
+		st, ok := spec.Type.(*ast.StructType)
+		if !ok {
+			return false
+		}
+		s := validStruct{Name: spec.Name.Name}
+		for _, fl := range st.Fields.List {
+			tag := ""
+			if fl.Tag != nil {
+				raw, err := strconv.Unquote(fl.Tag.Value)
+				if err != nil {
+					log.Fatal(err)
+				}
+				tag = reflect.StructTag(raw).Get("valid")
+			}
+			for _, name := range fl.Names {
+				s.Fields = append(s.Fields, field{Name: name.Name, Tag: tag})
+			}
+		}
+		structs = append(structs, s)
+		return false
+	})
+
+	var b bytes.Buffer
+	b.WriteString(`// Code generated by gen_validators.go from records.go; DO NOT EDIT.
+
+package enrollment
+
+import (
+	"reflect"
+
+	"github.com/asaskevich/govalidator" // https://github.com/asaskevich/govalidator
+)
+
+func init() {
+`)
+	var funcs bytes.Buffer
+	for _, s := range structs {
+		code, ok := validator(s)
+		if !ok {
+			fmt.Fprintf(&b, "\t// %s has tags only govalidator knows.\n", s.Name)
+			continue
+		}
+		funcs.WriteString(code)
+		fmt.Fprintf(&b, "\tregisterGenerated(reflect.TypeOf(%s{}), validate%sFast, map[string]string{\n", s.Name, strings.TrimPrefix(s.Name, "Valid"))
+		for _, fl := range s.Fields {
+			fmt.Fprintf(&b, "\t\t%q: %q,\n", fl.Name, fl.Tag)
+		}
+		b.WriteString("\t})\n")
+	}
+	b.WriteString("}\n")
+	b.Write(funcs.Bytes())
+
+	out, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Fatalf("%v\n%s", err, b.Bytes())
+	}
+	if err := os.WriteFile("validators_gen.go", out, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// validator writes the validator for s, or reports false if s has a tag
+// it doesn't know.
+func validator(s validStruct) (string, bool) {
+	part := "e." + strings.TrimPrefix(s.Name, "Valid") + "."
+	prefix := strings.TrimPrefix(part, "e.")
+	if s.Name == "ValidEnrollment" {
+		part, prefix = "e.", ""
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "\nfunc validate%sFast(e *Enrollment, problems []FieldError) []FieldError {\n", strings.TrimPrefix(s.Name, "Valid"))
+	for _, fl := range s.Fields {
+		if fl.Tag == "" || fl.Tag == "-" {
+			continue
+		}
+		required := false
+		var conds []string // condition, tag
+		for _, opt := range strings.Split(fl.Tag, ",") {
+			if alias, ok := aliases[opt]; ok {
+				opt = alias
+			}
+			switch {
+			case opt == "required":
+				required = true
+			case checks[opt] != "":
+				conds = append(conds, checks[opt], opt)
+			case lengthTag.MatchString(opt):
+				m := lengthTag.FindStringSubmatch(opt)
+				conds = append(conds, fmt.Sprintf("len(v) < %s || len(v) > %s", m[1], m[2]), "length")
+			default:
+				return "", false
+			}
+		}
+
+		if !required && len(conds) == 0 {
+			continue
+		}
+
+		// govalidator only checks an empty value for required; the
+		// first tag that fails is the one reported.
+		path := prefix + fl.Name
+		fmt.Fprintf(&b, "switch v := %s%s; {\ncase v == \"\":\n", part, fl.Name)
+		if required {
+			fmt.Fprintf(&b, "problems = append(problems, fieldInvalid(%q, \"required\"))\n", path)
+		}
+		for i := 0; i < len(conds); i += 2 {
+			fmt.Fprintf(&b, "case %s:\nproblems = append(problems, fieldInvalid(%q, %q))\n", conds[i], path, conds[i+1])
+		}
+		b.WriteString("}\n")
+	}
+	b.WriteString("\treturn problems\n}\n")
+	return b.String(), true
+}
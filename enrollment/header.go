@@ -0,0 +1,105 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package enrollment
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A file can say what it should hold, so that one cut short or put
+// together wrongly is caught before it is loaded: a <FileHeader> before
+// its records, a <FileTrailer> after them, or both, in the
+// EnrollmentCollection -
+//
+//	<FileHeader>
+//	  <RecordCount>2</RecordCount>
+//	  <Checksum>9f86d0...</Checksum>
+//	  <ProcessingYear>2016</ProcessingYear>
+//	</FileHeader>
+//
+// - or "FileHeader" and "FileTrailer" keys beside the "EnrollmentCollection"
+// array of a JSON file. Any of the three can be left out. A CSV file has
+// nowhere to put one.
+
+// A FileHeader is a file's header or trailer.
+type FileHeader struct {
+	Trailer        bool   `xml:"-"`
+	RecordCount    string `xml:"RecordCount"`
+	Checksum       string `xml:"Checksum"` // see Checksum
+	ProcessingYear string `xml:"ProcessingYear"`
+}
+
+// Headers has the parse add the file's header and trailer, if it has
+// them, to *h.
+func Headers(h *[]FileHeader) Option {
+	return func(o *options) { o.headers = h }
+}
+
+// Checksum is the SHA-256, in hex, of the records' EFINs in the order
+// they come in the file, each followed by a newline.
+func Checksum(records []Enrollment) string {
+	h := sha256.New()
+	for _, e := range records {
+		h.Write([]byte(strings.TrimSpace(e.EFIN) + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// A HeaderError is a header or trailer that doesn't match the records.
+type HeaderError struct {
+	Trailer  bool
+	Field    string // RecordCount, Checksum or ProcessingYear
+	Declared string
+	Actual   string
+}
+
+func (e *HeaderError) Error() string {
+	which := "FileHeader"
+	if e.Trailer {
+		which = "FileTrailer"
+	}
+	return fmt.Sprintf("%s %s is %s, but the records have %s", which, e.Field, e.Declared, e.Actual)
+}
+
+// Check compares h with the records it came with, and returns a
+// *HeaderError for the first thing that doesn't match.
+func (h FileHeader) Check(records []Enrollment) error {
+	mismatch := func(field, declared, actual string) error {
+		return &HeaderError{Trailer: h.Trailer, Field: field, Declared: declared, Actual: actual}
+	}
+	if s := strings.TrimSpace(h.RecordCount); s != "" {
+		if n, err := strconv.Atoi(s); err != nil || n != len(records) {
+			return mismatch("RecordCount", s, strconv.Itoa(len(records)))
+		}
+	}
+	if s := strings.TrimSpace(h.Checksum); s != "" {
+		if sum := Checksum(records); !strings.EqualFold(s, sum) {
+			return mismatch("Checksum", s, sum)
+		}
+	}
+	if s := strings.TrimSpace(h.ProcessingYear); s != "" {
+		for i, e := range records {
+			if year := strings.TrimSpace(e.ProcessingYear); year != s {
+				return mismatch("ProcessingYear", s, fmt.Sprintf("%q (record %d)", year, i+1))
+			}
+		}
+	}
+	return nil
+}
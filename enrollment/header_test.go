@@ -0,0 +1,114 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package enrollment
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseHeaders(t *testing.T) {
+	const xml = `<EnrollmentCollection>
+  <FileHeader><RecordCount>1</RecordCount><ProcessingYear>2016</ProcessingYear></FileHeader>
+  <Enrollment><EFIN>1</EFIN></Enrollment>
+  <FileTrailer><Checksum>abc</Checksum></FileTrailer>
+</EnrollmentCollection>`
+
+	// Without Headers they are skipped like anything else.
+	records, err := Parse(strings.NewReader(xml))
+	if err != nil || len(records) != 1 {
+		t.Fatalf("got %d records, %v; want 1", len(records), err)
+	}
+
+	var headers []FileHeader
+	if _, err := Parse(strings.NewReader(xml), Headers(&headers)); err != nil {
+		t.Fatal(err)
+	}
+	want := []FileHeader{
+		{RecordCount: "1", ProcessingYear: "2016"},
+		{Trailer: true, Checksum: "abc"},
+	}
+	if !reflect.DeepEqual(headers, want) {
+		t.Errorf("got headers %+v, want %+v", headers, want)
+	}
+}
+
+func TestFileHeaderCheck(t *testing.T) {
+	records := []Enrollment{
+		{EFIN: "123456", ProcessingYear: "2016"},
+		{EFIN: " 654321 ", ProcessingYear: "2016"},
+	}
+	sum := Checksum(records)
+
+	tests := []struct {
+		name   string
+		header FileHeader
+		field  string // that doesn't match, or "" if it all does
+	}{
+		{"empty", FileHeader{}, ""},
+		{"all of it", FileHeader{RecordCount: "2", Checksum: sum, ProcessingYear: "2016"}, ""},
+		{"padded", FileHeader{RecordCount: " 2 ", Checksum: " " + sum + " ", ProcessingYear: " 2016 "}, ""},
+		{"checksum in upper case", FileHeader{Checksum: strings.ToUpper(sum)}, ""},
+		{"too few", FileHeader{RecordCount: "3"}, "RecordCount"},
+		{"not a number", FileHeader{RecordCount: "two"}, "RecordCount"},
+		{"wrong checksum", FileHeader{Checksum: Checksum(records[:1])}, "Checksum"},
+		{"wrong year", FileHeader{ProcessingYear: "2017"}, "ProcessingYear"},
+		{"count before checksum", FileHeader{RecordCount: "1", Checksum: "x"}, "RecordCount"},
+	}
+	for _, tt := range tests {
+		for _, trailer := range []bool{false, true} {
+			h := tt.header
+			h.Trailer = trailer
+			err := h.Check(records)
+			if tt.field == "" {
+				if err != nil {
+					t.Errorf("%s: %v", tt.name, err)
+				}
+				continue
+			}
+			var he *HeaderError
+			if !errors.As(err, &he) || he.Field != tt.field || he.Trailer != trailer {
+				t.Errorf("%s (trailer %v): got %v, want a %s mismatch", tt.name, trailer, err, tt.field)
+			}
+		}
+	}
+}
+
+func TestFileHeaderCheckMixedYears(t *testing.T) {
+	records := []Enrollment{{ProcessingYear: "2016"}, {ProcessingYear: "2015"}}
+	err := FileHeader{ProcessingYear: "2016"}.Check(records)
+	want := `FileHeader ProcessingYear is 2016, but the records have "2015" (record 2)`
+	if err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	// The SHA-256 of "1\n2\n".
+	const want = "a6e2b7a040683432de03a18fd8a1939a2fdf82585b364bfc874bdd4095c4cae1"
+	a := Checksum([]Enrollment{{EFIN: "1"}, {EFIN: "2"}})
+	if b := Checksum([]Enrollment{{EFIN: " 1"}, {EFIN: "2 "}}); a != b {
+		t.Errorf("padding changes the checksum: %s, %s", a, b)
+	}
+	if b := Checksum([]Enrollment{{EFIN: "2"}, {EFIN: "1"}}); a == b {
+		t.Error("order doesn't change the checksum")
+	}
+	if a != want {
+		t.Errorf("got %s, want %s", a, want)
+	}
+}
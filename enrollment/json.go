@@ -0,0 +1,159 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package enrollment
+
+import (
+	"encoding/json" // https://golang.org/pkg/encoding/json/
+	"fmt"
+	"io"
+	"strings"
+)
+
+// An enrollment JSON file is an array of Enrollment objects, or an object
+// with the array as its "EnrollmentCollection" (or "Enrollment"). The keys
+// are the Go field names - "EFIN", "OfficeInfo", "PriorYearInfo" - matched
+// without regard to case, so the XML's "TransmitterId" works too, and
+// sections are nested objects:
+//
+//	[{"EFIN": "123456", "OfficeInfo": {"OfficeName": "..."}, ...}]
+//
+// The object can have a "FileHeader" and "FileTrailer" too (see
+// FileHeader). As with XML, keys that aren't fields are ignored. A section that is
+// there but empty ({} or null) has all of its fields, empty.
+
+// ParseJSON reads enrollment records from r, a JSON file laid out as
+// above, a record at a time. fields is the fields each record had, as Go
+// paths like CSVColumns. Errors are *ParseError, as for Parse; Err is a
+// *json.SyntaxError, io.EOF or io.ErrUnexpectedEOF for a file that isn't
+// well-formed JSON.
+func ParseJSON(r io.Reader, opts ...Option) (records []Enrollment, fields [][]string, err error) {
+	d := json.NewDecoder(r)
+	records, fields, err = decodeJSON(d, parseOptions(opts))
+	if err != nil {
+		return nil, nil, &ParseError{Offset: d.InputOffset(), Err: err}
+	}
+	return records, fields, nil
+}
+
+func decodeJSON(d *json.Decoder, o options) (records []Enrollment, fields [][]string, err error) {
+	tok, err := d.Token()
+	if err != nil {
+		return nil, nil, err
+	}
+	if tok != json.Delim('{') {
+		return decodeJSONArray(d, tok, o)
+	}
+
+	// The array, and perhaps a header and trailer, are among its keys.
+	found := false
+	for {
+		key, err := d.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		if key == json.Delim('}') {
+			break
+		}
+		switch name, _ := key.(string); {
+		case (name == "EnrollmentCollection" || name == "Enrollment") && !found:
+			if tok, err = d.Token(); err != nil {
+				return nil, nil, err
+			}
+			if records, fields, err = decodeJSONArray(d, tok, o); err != nil {
+				return nil, nil, err
+			}
+			found = true
+		case (name == "FileHeader" || name == "FileTrailer") && o.headers != nil:
+			var h jsonHeader
+			if err := d.Decode(&h); err != nil {
+				return nil, nil, err
+			}
+			*o.headers = append(*o.headers, FileHeader{Trailer: name == "FileTrailer",
+				RecordCount: h.RecordCount.String(), Checksum: h.Checksum, ProcessingYear: h.ProcessingYear.String()})
+		default:
+			var skip json.RawMessage
+			if err := d.Decode(&skip); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if !found {
+		return nil, nil, fmt.Errorf("expected an EnrollmentCollection array")
+	}
+	return records, fields, nil
+}
+
+// jsonHeader is a FileHeader as JSON has it: the numbers can be numbers.
+type jsonHeader struct {
+	RecordCount    json.Number
+	Checksum       string
+	ProcessingYear json.Number
+}
+
+// decodeJSONArray decodes the array of records that starts with tok.
+func decodeJSONArray(d *json.Decoder, tok json.Token, o options) (records []Enrollment, fields [][]string, err error) {
+	if tok != json.Delim('[') {
+		return nil, nil, fmt.Errorf("expected an array of Enrollment objects but have %v", tok)
+	}
+
+	for d.More() {
+		if o.full(len(records)) {
+			return nil, nil, ErrTooManyRecords
+		}
+		var raw json.RawMessage
+		if err := d.Decode(&raw); err != nil {
+			return nil, nil, err
+		}
+		var e Enrollment
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return nil, nil, err
+		}
+		internEnrollment(&e)
+		records = append(records, e)
+		fields = append(fields, jsonFields(raw, ""))
+	}
+	if _, err := d.Token(); err != nil { // the closing ]
+		return nil, nil, err
+	}
+	return records, fields, nil
+}
+
+// jsonFields is the fields under prefix that the object raw has.
+func jsonFields(raw json.RawMessage, prefix string) []string {
+	var keys map[string]json.RawMessage
+	if json.Unmarshal(raw, &keys) != nil {
+		return nil
+	}
+	var fields []string
+	if len(keys) == 0 && prefix != "" {
+		// An empty section: all of it.
+		for _, name := range CSVColumns {
+			if strings.HasPrefix(strings.ToLower(name), prefix) {
+				fields = append(fields, name)
+			}
+		}
+		return fields
+	}
+	for k, v := range keys {
+		path := strings.ToLower(prefix + k)
+		if name, ok := pathNames[path]; ok {
+			fields = append(fields, name)
+			continue
+		}
+		fields = append(fields, jsonFields(v, path+".")...)
+	}
+	return fields
+}
@@ -0,0 +1,139 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package enrollment
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		opts    []Option
+		want    []Enrollment
+		fields  [][]string // sorted
+		wantErr string     // in the error, if it fails
+	}{
+		{
+			name:   "array",
+			json:   `[{"EFIN": "1", "OfficeInfo": {"City": "San Diego"}}, {"efin": "2"}]`,
+			want:   []Enrollment{{EFIN: "1", OfficeInfo: OfficeInfo{City: "San Diego"}}, {EFIN: "2"}},
+			fields: [][]string{{"EFIN", "OfficeInfo.City"}, {"EFIN"}},
+		},
+		{
+			name:   "object",
+			json:   `{"Other": [1, 2], "EnrollmentCollection": [{"TransmitterId": "77777"}]}`,
+			want:   []Enrollment{{TransmitterID: "77777"}},
+			fields: [][]string{{"TransmitterID"}},
+		},
+		{
+			name:   "Enrollment key",
+			json:   `{"Enrollment": [{"EFIN": "1"}]}`,
+			want:   []Enrollment{{EFIN: "1"}},
+			fields: [][]string{{"EFIN"}},
+		},
+		{
+			name:   "unknown keys are ignored",
+			json:   `[{"EFIN": "1", "Nickname": "Bob"}]`,
+			want:   []Enrollment{{EFIN: "1"}},
+			fields: [][]string{{"EFIN"}},
+		},
+		{
+			name:   "empty section",
+			json:   `[{"PriorYearInfo": {}}]`,
+			want:   []Enrollment{{}},
+			fields: [][]string{{"PriorYearInfo.Bank", "PriorYearInfo.ClientOfYoursLastYear"}},
+		},
+		{
+			name: "empty array",
+			json: `[]`,
+		},
+		{
+			name:    "no array",
+			json:    `{"Other": []}`,
+			wantErr: "expected an EnrollmentCollection array",
+		},
+		{
+			name:    "not an array",
+			json:    `"EFIN"`,
+			wantErr: "expected an array of Enrollment objects",
+		},
+		{
+			name:    "wrong type",
+			json:    `[{"EFIN": 123456}]`,
+			wantErr: "cannot unmarshal number",
+		},
+		{
+			name:    "cut short",
+			json:    `[{"EFIN": "1"}, {"EFIN"`,
+			wantErr: "unexpected EOF",
+		},
+		{
+			name:    "over the record limit",
+			json:    `[{"EFIN": "1"}, {"EFIN": "2"}]`,
+			opts:    []Option{MaxRecords(1)},
+			wantErr: ErrTooManyRecords.Error(),
+		},
+	}
+	for _, tt := range tests {
+		records, fields, err := ParseJSON(strings.NewReader(tt.json), tt.opts...)
+		if tt.wantErr != "" {
+			var pe *ParseError
+			if !errors.As(err, &pe) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, want a *ParseError with %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(records, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, records, tt.want)
+		}
+		for _, f := range fields {
+			sort.Strings(f)
+		}
+		if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("%s: got fields %q, want %q", tt.name, fields, tt.fields)
+		}
+	}
+}
+
+func TestParseJSONHeaders(t *testing.T) {
+	const json = `{
+  "FileHeader": {"RecordCount": 1, "ProcessingYear": "2016"},
+  "EnrollmentCollection": [{"EFIN": "1"}],
+  "FileTrailer": {"Checksum": "abc"}
+}`
+	var headers []FileHeader
+	records, _, err := ParseJSON(strings.NewReader(json), Headers(&headers))
+	if err != nil || len(records) != 1 {
+		t.Fatalf("got %d records, %v; want 1", len(records), err)
+	}
+	want := []FileHeader{
+		{RecordCount: "1", ProcessingYear: "2016"},
+		{Trailer: true, Checksum: "abc"},
+	}
+	if !reflect.DeepEqual(headers, want) {
+		t.Errorf("got headers %+v, want %+v", headers, want)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package enrollment
+
+import (
+	"encoding/xml" // https://golang.org/pkg/encoding/xml/
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A ParseError is an enrollment file Parse couldn't read. Err is what the
+// XML decoder said: an *xml.SyntaxError, io.EOF or io.ErrUnexpectedEOF
+// for a file that isn't well-formed XML.
+type ParseError struct {
+	Offset int64 // bytes into the file the decoder had got to
+	Err    error
+}
+
+func (e *ParseError) Error() string { return e.Err.Error() }
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// ErrTooManyRecords is the Err of the *ParseError a parser returns for a
+// file with more records than MaxRecords allows.
+var ErrTooManyRecords = errors.New("too many records")
+
+// An Option changes how Parse, ParseCSV or ParseJSON reads a file.
+// ParseCSV ignores Headers.
+type Option func(*options)
+
+type options struct {
+	maxRecords int
+	headers    *[]FileHeader
+}
+
+// MaxRecords stops the parse with ErrTooManyRecords as soon as the file
+// turns out to have more than n records, rather than read the rest of
+// it. 0 means no limit.
+func MaxRecords(n int) Option {
+	return func(o *options) { o.maxRecords = n }
+}
+
+func parseOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// full reports whether a file that has n records already can't have
+// another.
+func (o options) full(n int) bool {
+	return o.maxRecords > 0 && n >= o.maxRecords
+}
+
+// Parse reads an EnrollmentCollection from r, an Enrollment at a time,
+// rather than decoding the whole collection at once. Well-formed data
+// that doesn't fit an Enrollment is discarded. Like xml.Decoder.Decode
+// it stops at the end of the root element.
+func Parse(r io.Reader, opts ...Option) ([]Enrollment, error) {
+	d := xml.NewDecoder(r)
+	records, err := decode(d, parseOptions(opts))
+	if err != nil {
+		return nil, &ParseError{Offset: d.InputOffset(), Err: err}
+	}
+	return records, nil
+}
+
+func decode(d *xml.Decoder, o options) ([]Enrollment, error) {
+	var records []Enrollment
+	depth := 0 // below the root element
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch {
+			case depth == 0 && t.Name.Local != "EnrollmentCollection":
+				return nil, fmt.Errorf("expected element type <EnrollmentCollection> but have <%s>", t.Name.Local)
+			case depth == 0:
+				depth++
+			case depth == 1 && t.Name.Local == "Enrollment":
+				if o.full(len(records)) {
+					return nil, ErrTooManyRecords
+				}
+				var e Enrollment
+				if err := d.DecodeElement(&e, &t); err != nil {
+					return nil, err
+				}
+				internEnrollment(&e)
+				records = append(records, e)
+			case depth == 1 && o.headers != nil && (t.Name.Local == "FileHeader" || t.Name.Local == "FileTrailer"):
+				h := FileHeader{Trailer: t.Name.Local == "FileTrailer"}
+				if err := d.DecodeElement(&h, &t); err != nil {
+					return nil, err
+				}
+				*o.headers = append(*o.headers, h)
+			default:
+				if err := d.Skip(); err != nil {
+					return nil, err
+				}
+			}
+		case xml.EndElement:
+			if depth--; depth == 0 {
+				return records, nil
+			}
+		}
+	}
+}
+
+// A million-record file repeats the same few hundred states, cities,
+// banks and years over and over, and the XML decoder makes a new string
+// for every one of them. As each record is decoded its low-cardinality
+// fields are swapped for one shared copy, so the copies can be collected
+// straight away instead of living as long as the file. The table is
+// capped so a field that turns out not to repeat can't grow it without
+// limit; past the cap new values are simply kept as they are.
+
+const maxInterned = 50000
+
+var interned struct {
+	sync.Mutex
+	m map[string]string
+}
+
+// intern returns the shared copy of s.
+func intern(s string) string {
+	if s == "" {
+		return s
+	}
+	interned.Lock()
+	defer interned.Unlock()
+	if v, ok := interned.m[s]; ok {
+		return v
+	}
+	if interned.m == nil {
+		interned.m = map[string]string{}
+	}
+	if len(interned.m) < maxInterned {
+		interned.m[s] = s
+	}
+	return s
+}
+
+// internEnrollment interns e's low-cardinality fields.
+func internEnrollment(e *Enrollment) {
+	for _, s := range []*string{
+		&e.Action, &e.Reason, &e.TransmitterID, &e.ProcessingYear, &e.MasterEfin,
+		&e.OfficeInfo.City, &e.OfficeInfo.State, &e.OfficeInfo.Zip,
+		&e.OwnerInformation.City, &e.OwnerInformation.State, &e.OwnerInformation.Zip,
+		&e.EFINOwnerInfo.City, &e.EFINOwnerInfo.State, &e.EFINOwnerInfo.Zip,
+		&e.PriorYearInfo.Bank,
+	} {
+		*s = intern(*s)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package enrollment
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		xml     string
+		opts    []Option
+		efins   []string // the records' EFINs, if it parses
+		wantErr string   // in the error, if it doesn't
+	}{
+		{
+			name:  "records",
+			xml:   `<EnrollmentCollection><Enrollment><EFIN>1</EFIN></Enrollment><Enrollment><EFIN>2</EFIN></Enrollment></EnrollmentCollection>`,
+			efins: []string{"1", "2"},
+		},
+		{
+			name:  "empty collection",
+			xml:   `<EnrollmentCollection></EnrollmentCollection>`,
+			efins: nil,
+		},
+		{
+			name:  "other elements are skipped",
+			xml:   `<EnrollmentCollection><Comment><EFIN>9</EFIN></Comment><Enrollment><EFIN>1</EFIN><Extra>x</Extra></Enrollment></EnrollmentCollection>`,
+			efins: []string{"1"},
+		},
+		{
+			name:  "stops at the end of the root",
+			xml:   `<EnrollmentCollection><Enrollment><EFIN>1</EFIN></Enrollment></EnrollmentCollection><junk`,
+			efins: []string{"1"},
+		},
+		{
+			name:  "at the record limit",
+			xml:   `<EnrollmentCollection><Enrollment><EFIN>1</EFIN></Enrollment><Enrollment><EFIN>2</EFIN></Enrollment></EnrollmentCollection>`,
+			opts:  []Option{MaxRecords(2)},
+			efins: []string{"1", "2"},
+		},
+		{
+			name:    "over the record limit",
+			xml:     `<EnrollmentCollection><Enrollment><EFIN>1</EFIN></Enrollment><Enrollment><EFIN>2</EFIN></Enrollment></EnrollmentCollection>`,
+			opts:    []Option{MaxRecords(1)},
+			wantErr: ErrTooManyRecords.Error(),
+		},
+		{
+			name:    "cut short",
+			xml:     `<EnrollmentCollection><Enrollment><EFIN>1</EFIN>`,
+			wantErr: "XML syntax error on line 1: unexpected EOF",
+		},
+		{
+			name:    "empty file",
+			xml:     ``,
+			wantErr: "EOF",
+		},
+	}
+	for _, tt := range tests {
+		records, err := Parse(strings.NewReader(tt.xml), tt.opts...)
+		if tt.wantErr != "" {
+			var pe *ParseError
+			if !errors.As(err, &pe) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, want a *ParseError with %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := efins(records); !reflect.DeepEqual(got, tt.efins) {
+			t.Errorf("%s: got EFINs %q, want %q", tt.name, got, tt.efins)
+		}
+	}
+}
+
+func TestParseWrongRoot(t *testing.T) {
+	_, err := Parse(strings.NewReader(`<Enrollments><Enrollment/></Enrollments>`))
+	var pe *ParseError
+	if !errors.As(err, &pe) || !strings.Contains(err.Error(), "<EnrollmentCollection>") {
+		t.Errorf("got %v, want a *ParseError asking for <EnrollmentCollection>", err)
+	}
+}
+
+func TestParseFields(t *testing.T) {
+	const xml = `<EnrollmentCollection>
+  <Enrollment action="deactivate" reason="closed">
+    <MasterEfin>100000</MasterEfin>
+    <EFIN>123456</EFIN>
+    <TransmitterId>TX01</TransmitterId>
+    <ProcessingYear>2016</ProcessingYear>
+    <OfficeInfo><OfficeName>Jones Tax</OfficeName><City>San Diego</City><State>CA</State></OfficeInfo>
+    <OwnerInformation><FirstName>Pat</FirstName><SSN>000000000</SSN></OwnerInformation>
+    <PriorYearInfo><Bank>SBTPG</Bank><ClientOfYoursLastYear>true</ClientOfYoursLastYear></PriorYearInfo>
+    <TransactionDate>2016-01-15T09:30:00</TransactionDate>
+  </Enrollment>
+</EnrollmentCollection>`
+	records, err := Parse(strings.NewReader(xml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Enrollment{
+		Action: "deactivate", Reason: "closed", MasterEfin: "100000", EFIN: "123456", TransmitterID: "TX01",
+		ProcessingYear:   "2016",
+		OfficeInfo:       OfficeInfo{OfficeName: "Jones Tax", City: "San Diego", State: "CA"},
+		OwnerInformation: OwnerInformation{FirstName: "Pat", SSN: "000000000"},
+		PriorYearInfo:    PriorYearInfo{Bank: "SBTPG", ClientOfYoursLastYear: true},
+		TransactionDate:  "2016-01-15T09:30:00",
+	}
+	if len(records) != 1 || !reflect.DeepEqual(records[0], want) {
+		t.Errorf("got %+v, want %+v", records, want)
+	}
+}
+
+// efins is the records' EFINs, or nil if there are none.
+func efins(records []Enrollment) []string {
+	var s []string
+	for _, e := range records {
+		s = append(s, e.EFIN)
+	}
+	return s
+}
@@ -0,0 +1,175 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+// Package enrollment reads, checks and stores ERO enrollment records: the
+// record types of the IRS enrollment file, Parse to decode a file (and
+// ParseCSV and ParseJSON for one sent as CSV or JSON), Validate to check
+// a record against the `valid` tags on the Valid* structs, and Store to
+// write a record's ero row. The enroll command (the loader) uses it, and
+// so can anything else that needs to read these files.
+package enrollment
+
+import (
+	"encoding/xml" // https://golang.org/pkg/encoding/xml/
+)
+
+// Golang has a very powerful encoding/xml package that is part of the
+// standard library. All you need to do is the create the data structures
+// that map to an XML document. Then read the XML document with the
+// xml.Unmarshal() function. Because Unmarshal uses the reflect package,
+// it can only assign to exported (upper case) fields.
+
+// OfficeInfo -
+type OfficeInfo struct {
+	OfficeName          string `xml:"OfficeName"`
+	PrimaryContactFirst string `xml:"PrimaryContactFirst"`
+	PrimaryContactLast  string `xml:"PrimaryContactLast"`
+	PhoneNumber         string `xml:"PhoneNumber"`
+	FaxNumber           string `xml:"FaxNumber"`
+	Email               string `xml:"Email"`
+	Address1            string `xml:"Address1"`
+	Address2            string `xml:"Address2"`
+	City                string `xml:"City"`
+	State               string `xml:"State"`
+	Zip                 string `xml:"Zip"`
+}
+
+// OwnerInformation -
+type OwnerInformation struct {
+	FirstName   string `xml:"FirstName"`
+	LastName    string `xml:"LastName"`
+	PhoneNumber string `xml:"PhoneNumber"`
+	Email       string `xml:"Email"`
+	Address1    string `xml:"Address1"`
+	Address2    string `xml:"Address2"`
+	City        string `xml:"City"`
+	State       string `xml:"State"`
+	Zip         string `xml:"Zip"`
+	SSN         string `xml:"SSN"`
+	DateOfBirth string `xml:"DateOfBirth"`
+}
+
+// EFINOwnerInfo -
+type EFINOwnerInfo struct {
+	FirstName   string `xml:"FirstName"`
+	LastName    string `xml:"LastName"`
+	PhoneNumber string `xml:"PhoneNumber"`
+	Email       string `xml:"Email"`
+	Address1    string `xml:"Address1"`
+	Address2    string `xml:"Address2"`
+	City        string `xml:"City"`
+	State       string `xml:"State"`
+	Zip         string `xml:"Zip"`
+	SSN         string `xml:"SSN"`
+	DateOfBirth string `xml:"DateOfBirth"`
+}
+
+// PriorYearInfo -
+type PriorYearInfo struct {
+	Bank                  string `xml:"Bank"`
+	ClientOfYoursLastYear bool   `xml:"ClientOfYoursLastYear"`
+}
+
+// Enrollment - Enrollment record. Action is "deactivate" for a
+// de-enrollment, which the loader handles apart (its deactivate.go).
+type Enrollment struct {
+	Action           string           `xml:"action,attr"`
+	Reason           string           `xml:"reason,attr"`
+	MasterEfin       string           `xml:"MasterEfin"`
+	EFIN             string           `xml:"EFIN"`
+	TransmitterID    string           `xml:"TransmitterId"`
+	ProcessingYear   string           `xml:"ProcessingYear"`
+	OfficeInfo       OfficeInfo       `xml:"OfficeInfo"`
+	OwnerInformation OwnerInformation `xml:"OwnerInformation"`
+	EFINOwnerInfo    EFINOwnerInfo    `xml:"EFINOwnerInfo"`
+	PriorYearInfo    PriorYearInfo    `xml:"PriorYearInfo"`
+	TransactionDate  string           `xml:"TransactionDate"`
+}
+
+// EnrollmentCollection - Full enrollment collection
+type EnrollmentCollection struct {
+	XMLName        xml.Name     `xml:"EnrollmentCollection"`
+	EnrollmentList []Enrollment `xml:"Enrollment"`
+}
+
+// Golang has a very powerful encoding/xml package that is part of the
+// standard library. All you need to do is the create the data structures
+// that map to an XML document. Then read the XML document with the
+// xml.Unmarshal() function. Because Unmarshal uses the reflect package,
+// it can only assign to exported (upper case) fields.
+
+// OfficeInfo -
+type ValidOfficeInfo struct {
+	OfficeName          string `valid:"text,required"`
+	PrimaryContactFirst string `valid:"text,required"`
+	PrimaryContactLast  string `valid:"text,required"`
+	PhoneNumber         string `valid:"-"`
+	FaxNumber           string `valid:"-"`
+	Email               string `valid:"email,required"`
+	Address1            string `valid:"text,required"`
+	Address2            string `valid:"-"`
+	City                string `valid:"text,required"`
+	State               string `valid:"length(2|2)"`
+	Zip                 string `valid:"alphanum,required"`
+}
+
+// OwnerInformation -
+type ValidOwnerInformation struct {
+	FirstName   string `valid:"text,required"`
+	LastName    string `valid:"text,required"`
+	PhoneNumber string `valid:"alphanum,required"`
+	Email       string `valid:"Email"`
+	Address1    string `valid:"text,required"`
+	Address2    string `valid:"-"`
+	City        string `valid:"text,required"`
+	State       string `valid:"length(2|2)"`
+	Zip         string `valid:"alphanum,required"`
+	SSN         string `valid:"ssn"`
+	DateOfBirth string `valid:"-"`
+}
+
+// EFINOwnerInfo -
+type ValidEFINOwnerInfo struct {
+	FirstName   string `valid:"-"`
+	LastName    string `valid:"-"`
+	PhoneNumber string `valid:"-"`
+	Email       string `valid:"-"`
+	Address1    string `valid:"-"`
+	Address2    string `valid:"-"`
+	City        string `valid:"-"`
+	State       string `valid:"-"`
+	Zip         string `valid:"-"`
+	SSN         string `valid:"-"`
+	DateOfBirth string `valid:"-"`
+}
+
+// PriorYearInfo -
+type ValidPriorYearInfo struct {
+	Bank                  string `valid:"-"`
+	ClientOfYoursLastYear bool   `valid:"-"`
+}
+
+// Enrollment - Enrollment record
+type ValidEnrollment struct {
+	MasterEfin       string `valid:"numeric,required"`
+	EFIN             string `valid:"numeric,required"`
+	TransmitterID    string `valid:"numeric,required"`
+	ProcessingYear   string `valid:"numeric,required"`
+	OfficeInfo       OfficeInfo
+	OwnerInformation OwnerInformation
+	EFINOwnerInfo    EFINOwnerInfo
+	PriorYearInfo    PriorYearInfo
+	TransactionDate  string `valid:"date,required"`
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package enrollment
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"errors"
+	"strings"
+	"time"
+)
+
+// The ero insert, as plain SQL and as the stored procedure that does the
+// same (sql/001_stored_procedures.sql and later migrations). AMENDED is
+// worked out from the EFIN and tax year, and the insert only happens if
+// the record it amends is still current (sql/017_amendment_versions.sql),
+// so the plain SQL takes the EFIN and year three times and the base ID
+// twice.
+const (
+	InsertQuery = `INSERT INTO ero(EFIN,COMPANY,TAX_YEAR,RECEIVED_DATE,BATCH_ID,STATUS,FLAG_REASON,STATE,PRIOR_BANK,CORRELATION_ID,CONFIRMATION,MASTER_EFIN,AMENDED)
+			OUTPUT INSERTED.ID
+			SELECT ?,?,?,?,?,?,?,?,?,?,?,?, CASE WHEN EXISTS (SELECT 1 FROM ero WHERE EFIN = ? AND TAX_YEAR = ?) THEN 1 ELSE 0 END
+			WHERE COALESCE((SELECT TOP 1 ID FROM ero WITH (UPDLOCK, HOLDLOCK)
+					WHERE EFIN = ? AND TAX_YEAR = ? AND STATUS <> 'rejected' ORDER BY ID DESC), 0) = ?
+				AND NOT EXISTS (SELECT 1 FROM ero WHERE ID = ? AND VERSION <> ?)`
+	InsertProc = "dbo.usp_ero_insert"
+)
+
+// InsertParams are InsertProc's parameters, in order.
+var InsertParams = []string{"EFIN", "COMPANY", "TAX_YEAR", "RECEIVED_DATE", "BATCH_ID", "STATUS", "FLAG_REASON", "STATE", "PRIOR_BANK",
+	"CORRELATION_ID", "CONFIRMATION", "MASTER_EFIN", "BASE_ID", "BASE_VERSION"}
+
+// ErrConflict is what Store returns when the record being amended has
+// changed since it was read.
+var ErrConflict = errors.New("the record it amends was changed by another load; send it again")
+
+// Preparer is satisfied by both *sql.DB and *sql.Tx.
+type Preparer interface {
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+// Row is the rest of a record's ero row: how it was judged and where it
+// came from.
+type Row struct {
+	TaxYear      int
+	Received     time.Time // the record's TransactionDate
+	Batch        int64
+	Status       string
+	FlagReason   string // why it is pending review; none if it isn't
+	Correlation  string
+	Confirmation string // none (NULL) unless it was accepted
+
+	// Columns, by field path, replace the record's own value for the
+	// EFIN, OfficeInfo.OfficeName, OfficeInfo.State, PriorYearInfo.Bank
+	// and MasterEfin columns: nil for NULL, say, or a value kept from
+	// the record it amends.
+	Columns map[string]interface{}
+
+	BaseID      int64  // the record it amends; 0 if none
+	BaseVersion []byte // that record's VERSION
+}
+
+// column is what to write for field.
+func (r Row) column(field, v string) interface{} {
+	if c, ok := r.Columns[field]; ok {
+		return c
+	}
+	return v
+}
+
+// Store writes e's ero row and returns the ID SQL Server generated for
+// it; with procs it calls InsertProc rather than sending InsertQuery. The
+// mssql driver doesn't implement LastInsertId (SQL Server has no
+// equivalent on the wire), so the insert carries an OUTPUT INSERTED.ID
+// clause and the new key comes back as a one-row result set. The same ID
+// is the foreign key for any child rows written for the record.
+func Store(p Preparer, e Enrollment, row Row, procs bool) (int64, error) {
+	text := InsertQuery
+	if procs {
+		args := make([]string, len(InsertParams))
+		for i, p := range InsertParams {
+			args[i] = "@" + p + " = ?"
+		}
+		text = "EXEC " + InsertProc + " " + strings.Join(args, ", ")
+	}
+	stmt, err := p.Prepare(text)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	args := []interface{}{
+		row.column("EFIN", e.EFIN), row.column("OfficeInfo.OfficeName", e.OfficeInfo.OfficeName), row.TaxYear, row.Received,
+		row.Batch, row.Status, nullable(row.FlagReason), row.column("OfficeInfo.State", e.OfficeInfo.State),
+		row.column("PriorYearInfo.Bank", e.PriorYearInfo.Bank), row.Correlation, nullable(strings.TrimSpace(row.Confirmation)),
+		row.column("MasterEfin", e.MasterEfin),
+	}
+	if procs {
+		args = append(args, row.BaseID, row.BaseVersion)
+	} else {
+		args = append(args, e.EFIN, row.TaxYear, // for AMENDED
+			e.EFIN, row.TaxYear, row.BaseID, row.BaseID, row.BaseVersion) // for the base check
+	}
+
+	var id int64
+	err = stmt.QueryRow(args...).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrConflict
+	}
+	return id, err
+}
+
+// nullable maps "" to NULL.
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,199 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package enrollment
+
+//go:generate go run gen_validators.go
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/asaskevich/govalidator" // https://github.com/asaskevich/govalidator
+)
+
+// Field validation from the `valid` tags on the Valid* structs in
+// records.go. govalidator works them out by reflection on every record,
+// which at peak volume costs more than anything else done to a record,
+// so "go generate" writes plain code for the same tags to
+// validators_gen.go (see gen_validators.go). Validate uses the generated
+// code for each struct that has it and govalidator for the rest - a
+// struct whose tags the generator doesn't know, or one changed since it
+// last ran (the generated code names the tags it was written for). Run
+// "go generate" after changing a tag.
+
+// OwnerInformation's Email has always been tagged "Email", which
+// govalidator doesn't know (its tag is "email"), so we teach it that
+// spelling too rather than change the tag. Either is reported as "email".
+func init() {
+	for alias := range tagAliases {
+		govalidator.TagMap[alias] = govalidator.TagMap[tagAliases[alias]]
+	}
+	govalidator.TagMap["text"] = govalidator.Validator(IsText)
+	govalidator.TagMap["date"] = govalidator.Validator(IsTransactionDate)
+}
+
+// tagAliases are other spellings of govalidator tags, and the tag each
+// means. gen_validators.go has the same list.
+var tagAliases = map[string]string{
+	"Email": "email",
+}
+
+// textPunctuation is the punctuation names and addresses have: "O'Brien",
+// "Smith & Jones, Inc.", "Suite #4/5".
+const textPunctuation = ".,'-&#/()"
+
+// IsText reports whether s is the kind of text a name, street or city
+// is - letters, digits, spaces and ordinary punctuation - which is what
+// the "text" valid tag checks. alphanum is no good for these: "San Diego"
+// has a space.
+func IsText(s string) bool {
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != ' ' && !strings.ContainsRune(textPunctuation, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseTransactionDate parses a TransactionDate, such as
+// "2016-01-15T10:30:00": RFC 3339 without the zone, which is UTC.
+func ParseTransactionDate(s string) (time.Time, error) {
+	return time.Parse(time.RFC3339, s+"Z")
+}
+
+// IsTransactionDate reports whether s parses as a TransactionDate, which
+// is what the "date" valid tag checks.
+func IsTransactionDate(s string) bool {
+	_, err := ParseTransactionDate(s)
+	return err == nil
+}
+
+// A FieldError is a field that fails its valid tag.
+type FieldError struct {
+	Field   string // path in the record, such as "OfficeInfo.Zip"
+	Rule    string // the tag option it fails, such as "required"
+	Message string
+}
+
+func (e FieldError) Error() string { return e.Message }
+
+// fieldValidator checks one Valid* struct's part of e, appending to
+// problems.
+type fieldValidator func(e *Enrollment, problems []FieldError) []FieldError
+
+// generatedValidators holds validators_gen.go's validators, by struct.
+var generatedValidators = map[string]fieldValidator{}
+
+// registerGenerated is how validators_gen.go offers the validator for
+// struct t, written for tags (by field). It is used only if the tags are
+// still what t has.
+func registerGenerated(t reflect.Type, v fieldValidator, tags map[string]string) {
+	if t.NumField() != len(tags) {
+		return
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if tag, ok := tags[f.Name]; !ok || tag != f.Tag.Get("valid") {
+			return
+		}
+	}
+	generatedValidators[t.Name()] = v
+}
+
+// validatedStructs are the Valid* structs, the field path prefix of the
+// part of the record each checks, and that part as the struct.
+var validatedStructs = []struct {
+	Name   string
+	Prefix string
+	Value  func(e *Enrollment) interface{}
+}{
+	{"ValidEnrollment", "", func(e *Enrollment) interface{} {
+		return ValidEnrollment{MasterEfin: e.MasterEfin, EFIN: e.EFIN, TransmitterID: e.TransmitterID,
+			ProcessingYear: e.ProcessingYear, TransactionDate: e.TransactionDate}
+	}},
+	{"ValidOfficeInfo", "OfficeInfo.", func(e *Enrollment) interface{} { return ValidOfficeInfo(e.OfficeInfo) }},
+	{"ValidOwnerInformation", "OwnerInformation.", func(e *Enrollment) interface{} { return ValidOwnerInformation(e.OwnerInformation) }},
+	{"ValidEFINOwnerInfo", "EFINOwnerInfo.", func(e *Enrollment) interface{} { return ValidEFINOwnerInfo(e.EFINOwnerInfo) }},
+	{"ValidPriorYearInfo", "PriorYearInfo.", func(e *Enrollment) interface{} { return ValidPriorYearInfo(e.PriorYearInfo) }},
+}
+
+// ValidationResult is what Validate found.
+type ValidationResult struct {
+	Errors []FieldError // in struct order: the record, then each part of it
+}
+
+// Valid reports whether the record passed every tag.
+func (r ValidationResult) Valid() bool { return len(r.Errors) == 0 }
+
+// Validate checks e against the valid tags: the record's own fields as a
+// ValidEnrollment, then OfficeInfo, OwnerInformation, EFINOwnerInfo and
+// PriorYearInfo as their Valid* structs. With the generated validators it
+// allocates nothing unless the record has problems. The error is for a
+// tag govalidator can't work out, not a field that fails one.
+func Validate(e Enrollment) (ValidationResult, error) {
+	var r ValidationResult
+	for _, s := range validatedStructs {
+		if v, ok := generatedValidators[s.Name]; ok {
+			r.Errors = v(&e, r.Errors)
+			continue
+		}
+		problems, err := reflectValidate(s.Prefix, s.Value(&e))
+		if err != nil {
+			return r, fmt.Errorf("%s: %v", s.Name, err)
+		}
+		r.Errors = append(r.Errors, problems...)
+	}
+	return r, nil
+}
+
+// reflectValidate is the govalidator fallback.
+func reflectValidate(prefix string, v interface{}) ([]FieldError, error) {
+	_, err := govalidator.ValidateStruct(v)
+	if err == nil {
+		return nil, nil
+	}
+	var errs govalidator.Errors
+	if !errors.As(err, &errs) {
+		return nil, err
+	}
+	var problems []FieldError
+	for _, err := range errs.Errors() {
+		var fe govalidator.Error
+		if !errors.As(err, &fe) {
+			return nil, err
+		}
+		rule := fe.Validator
+		if tag, ok := tagAliases[rule]; ok {
+			rule = tag
+		}
+		problems = append(problems, fieldInvalid(prefix+fe.Name, rule))
+	}
+	return problems, nil
+}
+
+// fieldInvalid is the error for field failing rule. The value isn't in
+// the message: it may be an SSN.
+func fieldInvalid(field, rule string) FieldError {
+	msg := field + " is not a valid " + rule
+	if rule == "required" {
+		msg = field + " is required"
+	}
+	return FieldError{Field: field, Rule: rule, Message: msg}
+}
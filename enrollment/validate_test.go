@@ -0,0 +1,158 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package enrollment
+
+import (
+	"reflect"
+	"testing"
+)
+
+// validEnrollment is a record that passes every tag.
+func validEnrollment() Enrollment {
+	return Enrollment{
+		MasterEfin: "100000", EFIN: "123456", TransmitterID: "77777", ProcessingYear: "2016",
+		TransactionDate: "2016-01-15T10:30:00",
+		OfficeInfo: OfficeInfo{
+			OfficeName: "Smith & Jones, Inc.", PrimaryContactFirst: "Pat", PrimaryContactLast: "O'Brien",
+			Email: "office@example.com", Address1: "1 Main St, Suite #4/5", City: "San Diego", State: "CA", Zip: "92101",
+		},
+		OwnerInformation: OwnerInformation{
+			FirstName: "Pat", LastName: "Jones-Smith", PhoneNumber: "8585550100", Email: "pat@example.com",
+			Address1: "1 Main St", City: "St. Louis", State: "MO", Zip: "63101", SSN: "078-05-1120",
+		},
+	}
+}
+
+var validateTests = []struct {
+	name  string
+	edit  func(e *Enrollment)
+	field string // the one that fails, or "" if none does
+	rule  string
+}{
+	{"valid", func(e *Enrollment) {}, "", ""},
+	{"no EFIN", func(e *Enrollment) { e.EFIN = "" }, "EFIN", "required"},
+	{"EFIN not a number", func(e *Enrollment) { e.EFIN = "12345X" }, "EFIN", "numeric"},
+	{"transmitter not a number", func(e *Enrollment) { e.TransmitterID = "TX01" }, "TransmitterID", "numeric"},
+	{"no year", func(e *Enrollment) { e.ProcessingYear = "" }, "ProcessingYear", "required"},
+	{"no date", func(e *Enrollment) { e.TransactionDate = "" }, "TransactionDate", "required"},
+	{"date not a date", func(e *Enrollment) { e.TransactionDate = "01/15/2016" }, "TransactionDate", "date"},
+	{"date with a zone", func(e *Enrollment) { e.TransactionDate = "2016-01-15T10:30:00Z" }, "TransactionDate", "date"},
+	{"date with fractional seconds", func(e *Enrollment) { e.TransactionDate = "2016-01-15T10:30:00.5" }, "", ""},
+	{"no office name", func(e *Enrollment) { e.OfficeInfo.OfficeName = "" }, "OfficeInfo.OfficeName", "required"},
+	{"office name with a tag", func(e *Enrollment) { e.OfficeInfo.OfficeName = "<b>Jones</b>" }, "OfficeInfo.OfficeName", "text"},
+	{"city with a semicolon", func(e *Enrollment) { e.OfficeInfo.City = "San Diego;" }, "OfficeInfo.City", "text"},
+	{"bad office email", func(e *Enrollment) { e.OfficeInfo.Email = "office" }, "OfficeInfo.Email", "email"},
+	{"no office email", func(e *Enrollment) { e.OfficeInfo.Email = "" }, "OfficeInfo.Email", "required"},
+	{"three letter state", func(e *Enrollment) { e.OfficeInfo.State = "CAL" }, "OfficeInfo.State", "length"},
+	{"zip with a dash", func(e *Enrollment) { e.OfficeInfo.Zip = "92101-1234" }, "OfficeInfo.Zip", "alphanum"},
+	{"no owner phone", func(e *Enrollment) { e.OwnerInformation.PhoneNumber = "" }, "OwnerInformation.PhoneNumber", "required"},
+	{"bad owner email", func(e *Enrollment) { e.OwnerInformation.Email = "pat@" }, "OwnerInformation.Email", "email"},
+	{"no owner email", func(e *Enrollment) { e.OwnerInformation.Email = "" }, "", ""},
+	{"bad SSN", func(e *Enrollment) { e.OwnerInformation.SSN = "12345" }, "OwnerInformation.SSN", "ssn"},
+	{"EFIN owner isn't checked", func(e *Enrollment) { e.EFINOwnerInfo.Email = "x" }, "", ""},
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range validateTests {
+		e := validEnrollment()
+		tt.edit(&e)
+		r, err := Validate(e)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if tt.field == "" {
+			if !r.Valid() {
+				t.Errorf("%s: got %v, want it valid", tt.name, r.Errors)
+			}
+			continue
+		}
+		if len(r.Errors) != 1 || r.Errors[0].Field != tt.field || r.Errors[0].Rule != tt.rule {
+			t.Errorf("%s: got %v, want %s failing %s", tt.name, r.Errors, tt.field, tt.rule)
+		}
+	}
+}
+
+func TestValidateMessage(t *testing.T) {
+	e := validEnrollment()
+	e.EFIN, e.OwnerInformation.SSN = "", "12345"
+	r, _ := Validate(e)
+	want := []FieldError{
+		{Field: "EFIN", Rule: "required", Message: "EFIN is required"},
+		{Field: "OwnerInformation.SSN", Rule: "ssn", Message: "OwnerInformation.SSN is not a valid ssn"},
+	}
+	if !reflect.DeepEqual(r.Errors, want) {
+		t.Errorf("got %+v, want %+v", r.Errors, want)
+	}
+}
+
+// The generated validators are only used while the tags are the ones they
+// were written for; "go generate" keeps them so.
+func TestGeneratedValidatorsInUse(t *testing.T) {
+	for _, s := range validatedStructs {
+		if _, ok := generatedValidators[s.Name]; !ok {
+			t.Errorf("%s has no generated validator: run go generate", s.Name)
+		}
+	}
+}
+
+// The generated validators find what govalidator finds.
+func TestGeneratedMatchesReflect(t *testing.T) {
+	for _, tt := range validateTests {
+		e := validEnrollment()
+		tt.edit(&e)
+		for _, s := range validatedStructs {
+			v, ok := generatedValidators[s.Name]
+			if !ok {
+				continue
+			}
+			got := v(&e, nil)
+			want, err := reflectValidate(s.Prefix, s.Value(&e))
+			if err != nil {
+				t.Errorf("%s: %s: %v", tt.name, s.Name, err)
+				continue
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: %s: generated %+v, govalidator %+v", tt.name, s.Name, got, want)
+			}
+		}
+	}
+}
+
+func TestIsText(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"", true},
+		{"San Diego", true},
+		{"O'Brien", true},
+		{"Smith & Jones, Inc.", true},
+		{"Suite #4/5 (rear)", true},
+		{"Zoë Müller", true},
+		{"Coeur-d'Alene", true},
+		{"Jones;", false},
+		{"<script>", false},
+		{"a\tb", false},
+		{"line\nbreak", false},
+		{"50%", false},
+	}
+	for _, tt := range tests {
+		if got := IsText(tt.s); got != tt.want {
+			t.Errorf("IsText(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
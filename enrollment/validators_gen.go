@@ -0,0 +1,214 @@
+// Code generated by gen_validators.go from records.go; DO NOT EDIT.
+
+package enrollment
+
+import (
+	"reflect"
+
+	"github.com/asaskevich/govalidator" // https://github.com/asaskevich/govalidator
+)
+
+func init() {
+	registerGenerated(reflect.TypeOf(ValidOfficeInfo{}), validateOfficeInfoFast, map[string]string{
+		"OfficeName":          "text,required",
+		"PrimaryContactFirst": "text,required",
+		"PrimaryContactLast":  "text,required",
+		"PhoneNumber":         "-",
+		"FaxNumber":           "-",
+		"Email":               "email,required",
+		"Address1":            "text,required",
+		"Address2":            "-",
+		"City":                "text,required",
+		"State":               "length(2|2)",
+		"Zip":                 "alphanum,required",
+	})
+	registerGenerated(reflect.TypeOf(ValidOwnerInformation{}), validateOwnerInformationFast, map[string]string{
+		"FirstName":   "text,required",
+		"LastName":    "text,required",
+		"PhoneNumber": "alphanum,required",
+		"Email":       "Email",
+		"Address1":    "text,required",
+		"Address2":    "-",
+		"City":        "text,required",
+		"State":       "length(2|2)",
+		"Zip":         "alphanum,required",
+		"SSN":         "ssn",
+		"DateOfBirth": "-",
+	})
+	registerGenerated(reflect.TypeOf(ValidEFINOwnerInfo{}), validateEFINOwnerInfoFast, map[string]string{
+		"FirstName":   "-",
+		"LastName":    "-",
+		"PhoneNumber": "-",
+		"Email":       "-",
+		"Address1":    "-",
+		"Address2":    "-",
+		"City":        "-",
+		"State":       "-",
+		"Zip":         "-",
+		"SSN":         "-",
+		"DateOfBirth": "-",
+	})
+	registerGenerated(reflect.TypeOf(ValidPriorYearInfo{}), validatePriorYearInfoFast, map[string]string{
+		"Bank":                  "-",
+		"ClientOfYoursLastYear": "-",
+	})
+	registerGenerated(reflect.TypeOf(ValidEnrollment{}), validateEnrollmentFast, map[string]string{
+		"MasterEfin":       "numeric,required",
+		"EFIN":             "numeric,required",
+		"TransmitterID":    "numeric,required",
+		"ProcessingYear":   "numeric,required",
+		"OfficeInfo":       "",
+		"OwnerInformation": "",
+		"EFINOwnerInfo":    "",
+		"PriorYearInfo":    "",
+		"TransactionDate":  "date,required",
+	})
+}
+
+func validateOfficeInfoFast(e *Enrollment, problems []FieldError) []FieldError {
+	switch v := e.OfficeInfo.OfficeName; {
+	case v == "":
+		problems = append(problems, fieldInvalid("OfficeInfo.OfficeName", "required"))
+	case !IsText(v):
+		problems = append(problems, fieldInvalid("OfficeInfo.OfficeName", "text"))
+	}
+	switch v := e.OfficeInfo.PrimaryContactFirst; {
+	case v == "":
+		problems = append(problems, fieldInvalid("OfficeInfo.PrimaryContactFirst", "required"))
+	case !IsText(v):
+		problems = append(problems, fieldInvalid("OfficeInfo.PrimaryContactFirst", "text"))
+	}
+	switch v := e.OfficeInfo.PrimaryContactLast; {
+	case v == "":
+		problems = append(problems, fieldInvalid("OfficeInfo.PrimaryContactLast", "required"))
+	case !IsText(v):
+		problems = append(problems, fieldInvalid("OfficeInfo.PrimaryContactLast", "text"))
+	}
+	switch v := e.OfficeInfo.Email; {
+	case v == "":
+		problems = append(problems, fieldInvalid("OfficeInfo.Email", "required"))
+	case !govalidator.IsEmail(v):
+		problems = append(problems, fieldInvalid("OfficeInfo.Email", "email"))
+	}
+	switch v := e.OfficeInfo.Address1; {
+	case v == "":
+		problems = append(problems, fieldInvalid("OfficeInfo.Address1", "required"))
+	case !IsText(v):
+		problems = append(problems, fieldInvalid("OfficeInfo.Address1", "text"))
+	}
+	switch v := e.OfficeInfo.City; {
+	case v == "":
+		problems = append(problems, fieldInvalid("OfficeInfo.City", "required"))
+	case !IsText(v):
+		problems = append(problems, fieldInvalid("OfficeInfo.City", "text"))
+	}
+	switch v := e.OfficeInfo.State; {
+	case v == "":
+	case len(v) < 2 || len(v) > 2:
+		problems = append(problems, fieldInvalid("OfficeInfo.State", "length"))
+	}
+	switch v := e.OfficeInfo.Zip; {
+	case v == "":
+		problems = append(problems, fieldInvalid("OfficeInfo.Zip", "required"))
+	case !govalidator.IsAlphanumeric(v):
+		problems = append(problems, fieldInvalid("OfficeInfo.Zip", "alphanum"))
+	}
+	return problems
+}
+
+func validateOwnerInformationFast(e *Enrollment, problems []FieldError) []FieldError {
+	switch v := e.OwnerInformation.FirstName; {
+	case v == "":
+		problems = append(problems, fieldInvalid("OwnerInformation.FirstName", "required"))
+	case !IsText(v):
+		problems = append(problems, fieldInvalid("OwnerInformation.FirstName", "text"))
+	}
+	switch v := e.OwnerInformation.LastName; {
+	case v == "":
+		problems = append(problems, fieldInvalid("OwnerInformation.LastName", "required"))
+	case !IsText(v):
+		problems = append(problems, fieldInvalid("OwnerInformation.LastName", "text"))
+	}
+	switch v := e.OwnerInformation.PhoneNumber; {
+	case v == "":
+		problems = append(problems, fieldInvalid("OwnerInformation.PhoneNumber", "required"))
+	case !govalidator.IsAlphanumeric(v):
+		problems = append(problems, fieldInvalid("OwnerInformation.PhoneNumber", "alphanum"))
+	}
+	switch v := e.OwnerInformation.Email; {
+	case v == "":
+	case !govalidator.IsEmail(v):
+		problems = append(problems, fieldInvalid("OwnerInformation.Email", "email"))
+	}
+	switch v := e.OwnerInformation.Address1; {
+	case v == "":
+		problems = append(problems, fieldInvalid("OwnerInformation.Address1", "required"))
+	case !IsText(v):
+		problems = append(problems, fieldInvalid("OwnerInformation.Address1", "text"))
+	}
+	switch v := e.OwnerInformation.City; {
+	case v == "":
+		problems = append(problems, fieldInvalid("OwnerInformation.City", "required"))
+	case !IsText(v):
+		problems = append(problems, fieldInvalid("OwnerInformation.City", "text"))
+	}
+	switch v := e.OwnerInformation.State; {
+	case v == "":
+	case len(v) < 2 || len(v) > 2:
+		problems = append(problems, fieldInvalid("OwnerInformation.State", "length"))
+	}
+	switch v := e.OwnerInformation.Zip; {
+	case v == "":
+		problems = append(problems, fieldInvalid("OwnerInformation.Zip", "required"))
+	case !govalidator.IsAlphanumeric(v):
+		problems = append(problems, fieldInvalid("OwnerInformation.Zip", "alphanum"))
+	}
+	switch v := e.OwnerInformation.SSN; {
+	case v == "":
+	case !govalidator.IsSSN(v):
+		problems = append(problems, fieldInvalid("OwnerInformation.SSN", "ssn"))
+	}
+	return problems
+}
+
+func validateEFINOwnerInfoFast(e *Enrollment, problems []FieldError) []FieldError {
+	return problems
+}
+
+func validatePriorYearInfoFast(e *Enrollment, problems []FieldError) []FieldError {
+	return problems
+}
+
+func validateEnrollmentFast(e *Enrollment, problems []FieldError) []FieldError {
+	switch v := e.MasterEfin; {
+	case v == "":
+		problems = append(problems, fieldInvalid("MasterEfin", "required"))
+	case !govalidator.IsNumeric(v):
+		problems = append(problems, fieldInvalid("MasterEfin", "numeric"))
+	}
+	switch v := e.EFIN; {
+	case v == "":
+		problems = append(problems, fieldInvalid("EFIN", "required"))
+	case !govalidator.IsNumeric(v):
+		problems = append(problems, fieldInvalid("EFIN", "numeric"))
+	}
+	switch v := e.TransmitterID; {
+	case v == "":
+		problems = append(problems, fieldInvalid("TransmitterID", "required"))
+	case !govalidator.IsNumeric(v):
+		problems = append(problems, fieldInvalid("TransmitterID", "numeric"))
+	}
+	switch v := e.ProcessingYear; {
+	case v == "":
+		problems = append(problems, fieldInvalid("ProcessingYear", "required"))
+	case !govalidator.IsNumeric(v):
+		problems = append(problems, fieldInvalid("ProcessingYear", "numeric"))
+	}
+	switch v := e.TransactionDate; {
+	case v == "":
+		problems = append(problems, fieldInvalid("TransactionDate", "required"))
+	case !IsTransactionDate(v):
+		problems = append(problems, fieldInvalid("TransactionDate", "date"))
+	}
+	return problems
+}
@@ -0,0 +1,191 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+// Package enrollmenttest helps teams that integrate with the enrollment
+// loader test their side without SQL Server: builders and canned
+// fixtures for enrollment files, and an in-memory Store that keeps the
+// rows the loader would write.
+//
+// This package mirrors the file format (package enrollment) and the
+// loader's tables rather than importing them, so tests that use it need
+// nothing of the loader's. Keep it in step with enrollment/records.go and
+// the sql/ migrations.
+package enrollmenttest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Office is the OfficeInfo element.
+type Office struct {
+	OfficeName          string `xml:"OfficeName"`
+	PrimaryContactFirst string `xml:"PrimaryContactFirst"`
+	PrimaryContactLast  string `xml:"PrimaryContactLast"`
+	PhoneNumber         string `xml:"PhoneNumber"`
+	FaxNumber           string `xml:"FaxNumber"`
+	Email               string `xml:"Email"`
+	Address1            string `xml:"Address1"`
+	Address2            string `xml:"Address2"`
+	City                string `xml:"City"`
+	State               string `xml:"State"`
+	Zip                 string `xml:"Zip"`
+}
+
+// Person is the OwnerInformation and EFINOwnerInfo elements.
+type Person struct {
+	FirstName   string `xml:"FirstName"`
+	LastName    string `xml:"LastName"`
+	PhoneNumber string `xml:"PhoneNumber"`
+	Email       string `xml:"Email"`
+	Address1    string `xml:"Address1"`
+	Address2    string `xml:"Address2"`
+	City        string `xml:"City"`
+	State       string `xml:"State"`
+	Zip         string `xml:"Zip"`
+	SSN         string `xml:"SSN"`
+	DateOfBirth string `xml:"DateOfBirth"`
+}
+
+// PriorYear is the PriorYearInfo element.
+type PriorYear struct {
+	Bank                  string `xml:"Bank"`
+	ClientOfYoursLastYear bool   `xml:"ClientOfYoursLastYear"`
+}
+
+// Record is one Enrollment element.
+type Record struct {
+	MasterEfin       string    `xml:"MasterEfin"`
+	EFIN             string    `xml:"EFIN"`
+	TransmitterID    string    `xml:"TransmitterId"`
+	ProcessingYear   string    `xml:"ProcessingYear"`
+	OfficeInfo       Office    `xml:"OfficeInfo"`
+	OwnerInformation Person    `xml:"OwnerInformation"`
+	EFINOwnerInfo    Person    `xml:"EFINOwnerInfo"`
+	PriorYearInfo    PriorYear `xml:"PriorYearInfo"`
+	TransactionDate  string    `xml:"TransactionDate"`
+}
+
+// File is an EnrollmentCollection.
+type File struct {
+	XMLName xml.Name `xml:"EnrollmentCollection"`
+	Records []Record `xml:"Enrollment"`
+}
+
+// The fixtures use these; the Store approves them by default.
+const (
+	ValidEFIN   = "123456"
+	ValidBank   = "SBTPG"
+	Transmitter = "10001"
+)
+
+// ValidRecord returns a record that passes every check, with the
+// fixture EFIN, bank and transmitter.
+func ValidRecord() Record {
+	owner := Person{
+		FirstName: "Pat", LastName: "Jones", PhoneNumber: "8585550100", Email: "pat@example.com",
+		Address1: "1 Main St", City: "San Diego", State: "CA", Zip: "92101",
+		SSN: "078-05-1120", DateOfBirth: "1970-01-01",
+	}
+	return Record{
+		MasterEfin:     ValidEFIN,
+		EFIN:           ValidEFIN,
+		TransmitterID:  Transmitter,
+		ProcessingYear: "2016",
+		OfficeInfo: Office{
+			OfficeName: "Jones Tax", PrimaryContactFirst: "Pat", PrimaryContactLast: "Jones",
+			PhoneNumber: "8585550100", Email: "office@example.com",
+			Address1: "1 Main St", City: "San Diego", State: "CA", Zip: "92101",
+		},
+		OwnerInformation: owner,
+		EFINOwnerInfo:    owner,
+		PriorYearInfo:    PriorYear{Bank: ValidBank},
+		TransactionDate:  "2016-01-15T09:30:00",
+	}
+}
+
+// Invalid records, each failing one check, keyed by the error code the
+// loader rejects it with.
+func InvalidRecords() map[string]Record {
+	efin := ValidRecord().WithEFIN("999999")
+	bank := ValidRecord().WithBank("NOSUCHBANK")
+	return map[string]Record{
+		"EFIN_NOT_APPROVED": efin,
+		"BANK_UNKNOWN":      bank,
+	}
+}
+
+// WithEFIN returns a copy of r with another EFIN (and master EFIN).
+func (r Record) WithEFIN(efin string) Record {
+	r.EFIN, r.MasterEfin = efin, efin
+	return r
+}
+
+// WithBank returns a copy of r with another prior-year bank.
+func (r Record) WithBank(bank string) Record {
+	r.PriorYearInfo.Bank = bank
+	return r
+}
+
+// WithTransmitter returns a copy of r from another transmitter.
+func (r Record) WithTransmitter(id string) Record {
+	r.TransmitterID = id
+	return r
+}
+
+// WithDate returns a copy of r with another transaction date.
+func (r Record) WithDate(t time.Time) Record {
+	r.TransactionDate = t.Format("2006-01-02T15:04:05")
+	return r
+}
+
+// NewFile builds a file of records.
+func NewFile(records ...Record) File {
+	return File{Records: records}
+}
+
+// Bytes renders the file as the loader expects it.
+func (f File) Bytes() []byte {
+	b, err := xml.MarshalIndent(f, "", "  ")
+	if err != nil {
+		panic(err) // only plain strings and bools in here
+	}
+	return append([]byte(xml.Header), b...)
+}
+
+// Malformed is a file the loader can't decode.
+func Malformed() []byte {
+	return []byte(xml.Header + "<EnrollmentCollection><Enrollment><EFIN>123456</EFIN>")
+}
+
+// WriteFile writes the file to a temporary directory (removed when the
+// test ends) and returns its path.
+func (f File) WriteFile(t testing.TB, name string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, f.Bytes(), 0640); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// String describes the file for test failure messages.
+func (f File) String() string {
+	return fmt.Sprintf("enrollment file with %d records", len(f.Records))
+}
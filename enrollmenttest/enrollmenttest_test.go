@@ -0,0 +1,168 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package enrollmenttest_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dstroot/go_enrollment/enrollment"
+	"github.com/dstroot/go_enrollment/enrollmenttest"
+)
+
+// The package mirrors enrollment rather than importing it; these keep the
+// mirror in step.
+
+func TestBytesParse(t *testing.T) {
+	f := enrollmenttest.NewFile(enrollmenttest.ValidRecord(), enrollmenttest.ValidRecord().WithEFIN("654321"))
+	records, err := enrollment.Parse(bytes.NewReader(f.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].EFIN != enrollmenttest.ValidEFIN || records[1].EFIN != "654321" {
+		t.Fatalf("got %+v, want the file's two records", records)
+	}
+
+	want := enrollmenttest.ValidRecord()
+	got := records[0]
+	if got.TransmitterID != want.TransmitterID || got.ProcessingYear != want.ProcessingYear ||
+		got.OfficeInfo.City != want.OfficeInfo.City || got.OwnerInformation.SSN != want.OwnerInformation.SSN ||
+		got.PriorYearInfo.Bank != want.PriorYearInfo.Bank || got.TransactionDate != want.TransactionDate {
+		t.Errorf("got %+v, want it to match %+v", got, want)
+	}
+}
+
+func TestValidRecordValidates(t *testing.T) {
+	records, err := enrollment.Parse(bytes.NewReader(enrollmenttest.NewFile(enrollmenttest.ValidRecord()).Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := enrollment.Validate(records[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Valid() {
+		t.Errorf("ValidRecord fails validation: %v", r.Errors)
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	_, err := enrollment.Parse(bytes.NewReader(enrollmenttest.Malformed()))
+	var pe *enrollment.ParseError
+	if !errors.As(err, &pe) {
+		t.Errorf("got %v, want a *enrollment.ParseError", err)
+	}
+}
+
+func TestWith(t *testing.T) {
+	date := time.Date(2016, 2, 1, 8, 0, 0, 0, time.UTC)
+	r := enrollmenttest.ValidRecord().WithEFIN("654321").WithBank("RAL").WithTransmitter("88888").WithDate(date)
+	if r.EFIN != "654321" || r.MasterEfin != "654321" {
+		t.Errorf("WithEFIN: got EFIN %s, master EFIN %s", r.EFIN, r.MasterEfin)
+	}
+	if r.PriorYearInfo.Bank != "RAL" {
+		t.Errorf("WithBank: got %s", r.PriorYearInfo.Bank)
+	}
+	if r.TransmitterID != "88888" {
+		t.Errorf("WithTransmitter: got %s", r.TransmitterID)
+	}
+	if r.TransactionDate != "2016-02-01T08:00:00" {
+		t.Errorf("WithDate: got %s", r.TransactionDate)
+	}
+	if v := enrollmenttest.ValidRecord(); v.EFIN != enrollmenttest.ValidEFIN || v.PriorYearInfo.Bank != enrollmenttest.ValidBank {
+		t.Error("the With methods changed the fixture")
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	f := enrollmenttest.NewFile(enrollmenttest.ValidRecord())
+	path := f.WriteFile(t, "enroll.xml")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, f.Bytes()) {
+		t.Errorf("%s has\n%s\nwant\n%s", path, b, f.Bytes())
+	}
+	if s := f.String(); s != "enrollment file with 1 records" {
+		t.Errorf("String: got %q", s)
+	}
+}
+
+func TestStoreCheck(t *testing.T) {
+	s := enrollmenttest.NewStore()
+	if code := s.Check(enrollmenttest.ValidRecord()); code != "" {
+		t.Errorf("ValidRecord: got %s", code)
+	}
+	for code, r := range enrollmenttest.InvalidRecords() {
+		if got := s.Check(r); got != code {
+			t.Errorf("got %q, want %s", got, code)
+		}
+	}
+
+	s.ApproveEFIN(" 999999 ")
+	s.AddBank("nosuchbank")
+	for code, r := range enrollmenttest.InvalidRecords() {
+		if got := s.Check(r); got != "" {
+			t.Errorf("%s record, approved: got %s", code, got)
+		}
+	}
+	if got := s.Check(enrollmenttest.ValidRecord().WithBank("")); got != "" {
+		t.Errorf("no bank: got %s", got)
+	}
+}
+
+func TestStoreLoad(t *testing.T) {
+	s := enrollmenttest.NewStore()
+	valid := enrollmenttest.ValidRecord()
+	batch, loaded, rejected := s.Load(enrollmenttest.NewFile(valid, valid.WithEFIN("999999")))
+	if batch != 1 || len(loaded) != 1 {
+		t.Fatalf("got batch %d, %d loaded; want batch 1, 1 loaded", batch, len(loaded))
+	}
+	want := []enrollmenttest.Reject{{Index: 1, EFIN: "999999", Code: "EFIN_NOT_APPROVED"}}
+	if !reflect.DeepEqual(rejected, want) {
+		t.Errorf("got rejects %+v, want %+v", rejected, want)
+	}
+	row := loaded[0]
+	if row.EFIN != valid.EFIN || row.TaxYear != 2016 || row.Company != "Jones Tax" || row.Status != "loaded" ||
+		row.State != "CA" || row.PriorBank != enrollmenttest.ValidBank || row.Amended || row.Batch != 1 {
+		t.Errorf("got row %+v", row)
+	}
+
+	// The same EFIN and year again is an amendment; another year isn't.
+	later := valid.WithDate(time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC))
+	next := valid
+	next.ProcessingYear = "2017"
+	batch, loaded, _ = s.Load(enrollmenttest.NewFile(later, next))
+	if batch != 2 || len(loaded) != 2 || !loaded[0].Amended || loaded[1].Amended || loaded[1].TaxYear != 2017 {
+		t.Errorf("second batch: got %d, %+v", batch, loaded)
+	}
+
+	if rows := s.Rows(); len(rows) != 3 || rows[0].ID != 1 || rows[2].ID != 3 {
+		t.Errorf("got rows %+v, want 3 in insert order", rows)
+	}
+	found := s.Enrollments(valid.EFIN)
+	if len(found) != 3 || found[0].Received.Before(found[1].Received) {
+		t.Errorf("got %+v, want 3 rows, newest first", found)
+	}
+	if found := s.Enrollments("999999"); len(found) != 0 {
+		t.Errorf("rejected EFIN has rows: %+v", found)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package enrollmenttest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Row is an ero row as the loader writes it.
+type Row struct {
+	ID          int64
+	EFIN        string
+	Company     string
+	TaxYear     int
+	Received    time.Time
+	Batch       int64
+	Status      string // loaded, pending or rejected
+	State       string
+	PriorBank   string
+	Amended     bool // there was already a row for the EFIN and tax year
+	Correlation string
+}
+
+// Reject is a record the loader would reject, and why.
+type Reject struct {
+	Index int
+	EFIN  string
+	Code  string
+}
+
+// Store is an in-memory stand-in for the enrollment database: the
+// approved EFIN and bank lists, and the ero rows. It applies the same
+// reference data checks as the loader. It is safe for concurrent use.
+type Store struct {
+	mu    sync.Mutex
+	efins map[string]bool
+	banks map[string]bool
+	rows  []Row
+	batch int64
+}
+
+// NewStore returns a store that approves ValidEFIN and ValidBank.
+func NewStore() *Store {
+	return &Store{
+		efins: map[string]bool{ValidEFIN: true},
+		banks: map[string]bool{ValidBank: true},
+	}
+}
+
+// ApproveEFIN adds EFINs to the approved list.
+func (s *Store) ApproveEFIN(efins ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range efins {
+		s.efins[strings.TrimSpace(e)] = true
+	}
+}
+
+// AddBank adds banks to the bank list.
+func (s *Store) AddBank(banks ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range banks {
+		s.banks[strings.ToUpper(strings.TrimSpace(b))] = true
+	}
+}
+
+// Check returns the error code the loader would reject r with, or "".
+func (s *Store) Check(r Record) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.check(r)
+}
+
+func (s *Store) check(r Record) string {
+	if !s.efins[strings.TrimSpace(r.EFIN)] {
+		return "EFIN_NOT_APPROVED"
+	}
+	if bank := strings.ToUpper(strings.TrimSpace(r.PriorYearInfo.Bank)); bank != "" && !s.banks[bank] {
+		return "BANK_UNKNOWN"
+	}
+	return ""
+}
+
+// Load runs a file through the store as a batch, returning the batch ID,
+// the rows inserted and the records rejected.
+func (s *Store) Load(f File) (batch int64, loaded []Row, rejected []Reject) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.batch++
+	for i, r := range f.Records {
+		if code := s.check(r); code != "" {
+			rejected = append(rejected, Reject{Index: i, EFIN: r.EFIN, Code: code})
+			continue
+		}
+		received, _ := time.Parse("2006-01-02T15:04:05", r.TransactionDate)
+		year, _ := strconv.Atoi(strings.TrimSpace(r.ProcessingYear))
+		row := Row{
+			ID:          int64(len(s.rows) + 1),
+			EFIN:        r.EFIN,
+			Company:     r.OfficeInfo.OfficeName,
+			TaxYear:     year,
+			Received:    received,
+			Batch:       s.batch,
+			Status:      "loaded",
+			State:       r.OfficeInfo.State,
+			PriorBank:   r.PriorYearInfo.Bank,
+			Amended:     s.has(r.EFIN, year),
+			Correlation: fmt.Sprintf("test-%d-%d", s.batch, i),
+		}
+		s.rows = append(s.rows, row)
+		loaded = append(loaded, row)
+	}
+	return s.batch, loaded, rejected
+}
+
+func (s *Store) has(efin string, year int) bool {
+	for _, r := range s.rows {
+		if r.EFIN == efin && r.TaxYear == year {
+			return true
+		}
+	}
+	return false
+}
+
+// Enrollments returns the rows for an EFIN, newest first, like
+// GET /v1/enrollments.
+func (s *Store) Enrollments(efin string) []Row {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var found []Row
+	for _, r := range s.rows {
+		if r.EFIN == efin {
+			found = append(found, r)
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Received.After(found[j].Received) })
+	return found
+}
+
+// Rows returns every row, in insert order.
+func (s *Store) Rows() []Row {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Row(nil), s.rows...)
+}
@@ -0,0 +1,178 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bufio"
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// "enroll report eod --date 2016-01-04" writes the end-of-day control
+// report the bank contract requires: counts of the day's enrollments by
+// status, by office state, by bank and new vs amended, in the bank's
+// fixed-width format. With --deliver it is also uploaded to the bank's
+// SFTP server (eod.sftp, see sftp.go).
+//
+// The day is the batches started that day, local time; replays are left
+// out. The enrollment file has no bank product field, so the BANK section
+// counts the prior-year bank.
+//
+// Layout - every record is 50 characters plus CRLF:
+//
+//	H  1    "H"
+//	   2-8  "ENRLEOD"
+//	   9-16 report date, YYYYMMDD
+//	  17-30 created, YYYYMMDDHHMMSS
+//	  31-40 sender ID (eod.senderid), left-justified, space-filled
+//	  41-50 spaces
+//	D  1    "D"
+//	   2-11 section: STATUS, STATE, BANK or TYPE, left-justified
+//	  12-41 key, left-justified, space-filled (truncated at 30)
+//	  42-50 count, right-justified, zero-filled
+//	T  1    "T"
+//	   2-10 number of D records, zero-filled
+//	  11-19 enrollments loaded (the TYPE total), zero-filled
+//	  20-50 spaces
+func init() {
+	viper.SetDefault("eod.senderid", "")
+	viper.SetDefault("eod.dir", "./eod")
+}
+
+// eodSections is the order the sections appear in.
+var eodSections = []string{"STATUS", "STATE", "BANK", "TYPE"}
+
+type eodCount struct {
+	Section, Key string
+	Count        int
+}
+
+var (
+	eodDate    string
+	eodDeliver bool
+)
+
+var eodCmd = &cobra.Command{
+	Use:   "eod",
+	Short: "Write (and deliver) the end-of-day control report for the bank",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		day := time.Now()
+		if eodDate != "" {
+			var err error
+			if day, err = time.ParseInLocation("2006-01-02", eodDate, time.Local); err != nil {
+				check(fmt.Errorf("--date must be YYYY-MM-DD: %v", err))
+			}
+		}
+		day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.Local)
+
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		counts, err := eodCounts(dbs.reader(), day)
+		check(err)
+
+		dir := viper.GetString("eod.dir")
+		check(os.MkdirAll(dir, 0750))
+		path := filepath.Join(dir, "ENRLEOD"+day.Format("20060102")+".txt")
+		f, err := os.Create(path)
+		check(err)
+		check(writeEOD(f, day, stamp(), counts))
+		check(f.Close())
+		fmt.Println(path)
+
+		if eodDeliver {
+			check(retrying("network", "delivering "+path, func() error { return sftpDeliver("eod.sftp", path) }))
+			n, err := markForwarded(dbs.primary, day)
+			check(err)
+			fmt.Printf("%d records forwarded\n", n)
+		}
+	},
+}
+
+func init() {
+	eodCmd.Flags().StringVar(&eodDate, "date", "", "day to report, YYYY-MM-DD (default today)")
+	eodCmd.Flags().BoolVar(&eodDeliver, "deliver", false, "upload the report to the bank's SFTP server")
+	reportCmd.AddCommand(eodCmd)
+}
+
+// eodCounts totals the day's enrollments by section and key.
+func eodCounts(db *sql.DB, day time.Time) ([]eodCount, error) {
+	stmt, err := prepare(db, "eod.counts")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	from, to := day, day.AddDate(0, 0, 1)
+	rows, err := stmt.Query(from, to, from, to, from, to, from, to, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []eodCount
+	for rows.Next() {
+		var c eodCount
+		if err := rows.Scan(&c.Section, &c.Key, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	order := map[string]int{}
+	for i, s := range eodSections {
+		order[s] = i
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Section != counts[j].Section {
+			return order[counts[i].Section] < order[counts[j].Section]
+		}
+		return counts[i].Key < counts[j].Key
+	})
+	return counts, nil
+}
+
+// writeEOD writes the report in the bank's layout.
+func writeEOD(out io.Writer, day, created time.Time, counts []eodCount) error {
+	w := bufio.NewWriter(out)
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(w, "%-50.50s\r\n", fmt.Sprintf(format, args...))
+	}
+
+	line("HENRLEOD%s%s%-10.10s", day.Format("20060102"), created.Format("20060102150405"), viper.GetString("eod.senderid"))
+	total := 0
+	for _, c := range counts {
+		line("D%-10.10s%-30.30s%09d", c.Section, c.Key, c.Count)
+		if c.Section == "TYPE" {
+			total += c.Count
+		}
+	}
+	line("T%09d%09d", len(counts), total)
+	return w.Flush()
+}
@@ -0,0 +1,171 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Every error code a record can come back with, for partner developers:
+// "enroll errors list" prints it and GET /v1/errors serves it. When you
+// add a code, add it here too.
+//
+// Severity is what the code does to the record: "error" rejects it,
+// "warning" accepts it with the message in the ACK, and "review" sends it
+// to review (pending in the ACK). PRIOR_YEAR_MISMATCH depends on
+// prioryear.mismatch, so the list reports what this configuration does.
+
+// Severities.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+	severityReview  = "review"
+)
+
+// errorCode is one entry in the registry.
+type errorCode struct {
+	Code        string            `json:"code"`
+	Severity    string            `json:"severity"`
+	Field       bool              `json:"fieldSpecific"` // whether it comes with a field path
+	Description string            `json:"description"`
+	Messages    map[string]string `json:"messages,omitempty"` // message templates by language, other than English (see messages.go)
+}
+
+var errorCodes = []errorCode{
+	{Code: errFieldEmpty, Severity: severityError, Field: true,
+		Description: "A required field is empty or missing."},
+	{Code: errFieldTooLong, Severity: severityError, Field: true,
+		Description: "A value is longer than the field allows (see enroll schema dict for the lengths)."},
+	{Code: errFieldTruncated, Severity: severityWarning, Field: true,
+		Description: "A value was longer than the field allows and was cut to fit."},
+	{Code: errFieldInvalid, Severity: severityError, Field: true,
+		Description: "A value isn't in the form the field needs (digits, letters and digits, an email address, an SSN...)."},
+	{Code: errEFINNotApproved, Severity: severityError, Field: true,
+		Description: "The EFIN is not on the approved EFIN list."},
+	{Code: errBankUnknown, Severity: severityError, Field: true,
+		Description: "PriorYearInfo/Bank is not a bank on our bank list."},
+	{Code: errTransmitterUnknown, Severity: severityError, Field: true,
+		Description: "The TransmitterId is not on our list of transmitters."},
+	{Code: errStateUnknown, Severity: severityError, Field: true,
+		Description: "A State is not a state code on our list."},
+	{Code: errZipUnknown, Severity: severityWarning, Field: true,
+		Description: "A ZIP code isn't in our ZIP code data."},
+	{Code: errZipStateMismatch, Severity: severityWarning, Field: true,
+		Description: "The state isn't the one our ZIP code data has for the ZIP."},
+	{Code: errPriorYearMismatch, Severity: severityReview, Field: true,
+		Description: "A PriorYearInfo claim doesn't match our records of last year."},
+	{Code: errHookRejected, Severity: severityError,
+		Description: "A custom check configured for this loader refused the record; the message says why."},
+	{Code: errAmendConflict, Severity: severityError,
+		Description: "The enrollment this record amends changed while it was being loaded. Send the record again."},
+	{Code: errActionUnknown, Severity: severityError,
+		Description: "The Enrollment's action attribute is neither enroll nor deactivate."},
+	{Code: errNotEnrolled, Severity: severityError, Field: true,
+		Description: "A de-enrollment names an EFIN with nothing active to deactivate."},
+	{Code: errDBTruncation, Severity: severityError,
+		Description: "A value is longer than we can store."},
+	{Code: errDBDuplicate, Severity: severityError,
+		Description: "The record duplicates one we already have."},
+	{Code: errDBConstraint, Severity: severityError,
+		Description: "The database refused the record: a required value is missing or a value is not allowed."},
+	{Code: errDB, Severity: severityError,
+		Description: "The record could not be saved for another reason. These are ours to fix; the record can be sent again."},
+}
+
+// errorRegistry returns the registry for the current configuration,
+// sorted by code.
+func errorRegistry() []errorCode {
+	codes := make([]errorCode, len(errorCodes))
+	for i, c := range errorCodes {
+		if c.Code == errPriorYearMismatch {
+			switch viper.GetString("prioryear.mismatch") {
+			case "reject":
+				c.Severity = severityError
+			case "warn":
+				c.Severity = severityWarning
+			}
+		}
+		c.Messages = map[string]string{}
+		for lang, text := range messageCatalog[c.Code] {
+			c.Messages[lang] = text
+		}
+		for lang := range viper.GetStringMapString("messages.catalog." + c.Code) {
+			c.Messages[lang] = viper.GetString("messages.catalog." + c.Code + "." + lang)
+		}
+		codes[i] = c
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i].Code < codes[j].Code })
+	return codes
+}
+
+// registerErrorRoutes adds GET /v1/errors.
+func registerErrorRoutes(mux *http.ServeMux, limits *rateLimiter) {
+	mux.HandleFunc("/v1/errors", authorized(limits, func(w http.ResponseWriter, r *http.Request, _ string) {
+		if r.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		writeJSON(w, http.StatusOK, errorRegistry())
+	}))
+}
+
+// ---------------------------------------------------------------------
+// enroll errors list
+
+var errorsOutput string
+
+var errorsCmd = &cobra.Command{
+	Use:   "errors",
+	Short: "The error codes records can be rejected with",
+}
+
+var errorsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List every error code with its severity and description",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		codes := errorRegistry()
+		switch errorsOutput {
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			check(enc.Encode(codes))
+		case "table":
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "CODE\tSEVERITY\tDESCRIPTION")
+			for _, c := range codes {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", c.Code, c.Severity, c.Description)
+			}
+			check(w.Flush())
+		default:
+			check(fmt.Errorf("--output must be table or json (got %q)", errorsOutput))
+		}
+	},
+}
+
+func init() {
+	errorsListCmd.Flags().StringVar(&errorsOutput, "output", "table", "table or json")
+	errorsCmd.AddCommand(errorsListCmd)
+	rootCmd.AddCommand(errorsCmd)
+}
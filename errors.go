@@ -0,0 +1,81 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Error codes attached to rejected records. These end up in the
+// error_stats table and in reports to vendors, so once a code is in use
+// don't change its meaning - add a new one, and list it in errorCodes
+// (errorcodes.go).
+const (
+	errEFINNotApproved    = "EFIN_NOT_APPROVED"
+	errBankUnknown        = "BANK_UNKNOWN"
+	errTransmitterUnknown = "TRANSMITTER_UNKNOWN"
+	errStateUnknown       = "STATE_UNKNOWN"
+	errDBTruncation       = "DB_TRUNCATION"
+	errDBDuplicate        = "DB_DUPLICATE"
+	errDBConstraint       = "DB_CONSTRAINT"
+	errDB                 = "DB_ERROR"
+)
+
+// recordError is one thing wrong with a record.
+type recordError struct {
+	Field   string // path in the Enrollment, e.g. "PriorYearInfo.Bank"; "" if not field-specific
+	Code    string
+	Message string
+	Args    map[string]string // values for the message in other languages (see messages.go)
+}
+
+func (e recordError) String() string {
+	if e.Field == "" {
+		return fmt.Sprintf("%s: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s %s: %s", e.Field, e.Code, e.Message)
+}
+
+// joinErrors renders a list of record errors on one line.
+func joinErrors(errs []recordError) string {
+	s := make([]string, len(errs))
+	for i, e := range errs {
+		s[i] = e.String()
+	}
+	return strings.Join(s, "; ")
+}
+
+// dbError classifies an error from an insert so the statistics can tell
+// "office name too long" apart from "somebody dropped a table".
+func dbError(err error) recordError {
+	code := errDB
+
+	var sqlErr interface{ SQLErrorNumber() int32 }
+	if errors.As(err, &sqlErr) {
+		switch sqlErr.SQLErrorNumber() {
+		case 8152, 2628: // string or binary data would be truncated
+			code = errDBTruncation
+		case 2601, 2627: // duplicate key
+			code = errDBDuplicate
+		case 515, 547: // NULL into NOT NULL, foreign key or check constraint
+			code = errDBConstraint
+		}
+	}
+
+	return recordError{Code: code, Message: err.Error()}
+}
@@ -0,0 +1,56 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+//go:build windows
+
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/sys/windows/svc/eventlog" // https://pkg.go.dev/golang.org/x/sys/windows/svc/eventlog
+)
+
+// eventLogWriter writes each log line as an event. The source has to be
+// registered once, as administrator, e.g. with
+// "New-EventLog -LogName Application -Source enroll".
+type eventLogWriter struct {
+	log *eventlog.Log
+}
+
+func newEventLogWriter(source string) (*eventLogWriter, error) {
+	l, err := eventlog.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLogWriter{log: l}, nil
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	var err error
+	switch logSeverity(line) {
+	case sevErr:
+		err = w.log.Error(1, line)
+	case sevWarning:
+		err = w.log.Warning(1, line)
+	default:
+		err = w.log.Info(1, line)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
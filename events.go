@@ -0,0 +1,336 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// When events.fulfillment.url is set, the first time we accept an EFIN
+// we queue an enrollment.welcome event for the fulfillment system, which
+// sends the office its welcome kit and marketing materials. The event
+// carries the office's name, contact and mailing address from the
+// enrollment. "First time" means the EFIN has no accepted record under
+// another ID and has never had a welcome event, so amendments, rollovers
+// and re-enrollments after a de-enrollment don't send another kit.
+//
+// Events are queued in the event_outbox table (sql/023_event_outbox.sql)
+// in the same transaction as the record, so one is never sent for a
+// record that didn't load. A record that goes to review queues its event
+// held; approving it releases the event with the confirmation number,
+// rejecting it drops it. "enroll serve" sends what is queued every
+// events.fulfillment.interval, one POST per event signed like a webhook
+// (X-Enroll-Timestamp and X-Enroll-Signature, with
+// events.fulfillment.secret) and with "event-<id>" as the
+// Idempotency-Key. Outages and refusals are handled as for the bank API
+// (see bankapi.go), with the same settings under events.fulfillment.
+func init() {
+	viper.SetDefault("events.fulfillment.timeout", "30s")
+	viper.SetDefault("events.fulfillment.interval", "30s")
+	viper.SetDefault("events.fulfillment.batchsize", 100)
+	viper.SetDefault("events.fulfillment.maxattempts", 10)
+	viper.SetDefault("events.fulfillment.breaker.failures", 5)
+	viper.SetDefault("events.fulfillment.breaker.cooldown", "1m")
+	viper.SetDefault("events.fulfillment.breaker.maxcooldown", "15m")
+}
+
+// Event types.
+const eventWelcome = "enrollment.welcome"
+
+func eventsEnabled() bool {
+	return viper.GetString("events.fulfillment.url") != ""
+}
+
+// mailingAddress is where the welcome kit goes.
+type mailingAddress struct {
+	Address1 string `json:"address1"`
+	Address2 string `json:"address2,omitempty"`
+	City     string `json:"city"`
+	State    string `json:"state"`
+	Zip      string `json:"zip"`
+}
+
+// welcomeEvent is the data of an enrollment.welcome event.
+type welcomeEvent struct {
+	EnrollmentID   int64          `json:"enrollmentId"`
+	EFIN           string         `json:"efin"`
+	TransmitterID  string         `json:"transmitterId,omitempty"`
+	TaxYear        int            `json:"taxYear"`
+	OfficeName     string         `json:"officeName"`
+	ContactFirst   string         `json:"contactFirstName"`
+	ContactLast    string         `json:"contactLastName"`
+	Email          string         `json:"email,omitempty"`
+	Phone          string         `json:"phone,omitempty"`
+	MailingAddress mailingAddress `json:"mailingAddress"`
+	Confirmation   string         `json:"confirmation,omitempty"` // filled in on approval for reviewed records
+	CorrelationId  string         `json:"correlationId,omitempty"`
+}
+
+func newWelcomeEvent(id int64, e Enrollment, confirmation, correlation string) welcomeEvent {
+	o := e.OfficeInfo
+	return welcomeEvent{
+		EnrollmentID:  id,
+		EFIN:          e.EFIN,
+		TransmitterID: e.TransmitterID,
+		TaxYear:       recordYear(e),
+		OfficeName:    o.OfficeName,
+		ContactFirst:  o.PrimaryContactFirst,
+		ContactLast:   o.PrimaryContactLast,
+		Email:         o.Email,
+		Phone:         o.PhoneNumber,
+		MailingAddress: mailingAddress{
+			Address1: o.Address1,
+			Address2: o.Address2,
+			City:     o.City,
+			State:    o.State,
+			Zip:      o.Zip,
+		},
+		Confirmation:  confirmation,
+		CorrelationId: correlation,
+	}
+}
+
+// queueWelcome queues the welcome event for a record we just wrote, if
+// its EFIN hasn't been accepted before. held is for records going to
+// review.
+func queueWelcome(p preparer, id int64, e Enrollment, held bool, confirmation, correlation string) error {
+	if !eventsEnabled() {
+		return nil
+	}
+	payload, err := json.Marshal(newWelcomeEvent(id, e, confirmation, correlation))
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{id, e.EFIN, string(payload), held, time.Now()}
+	if !viper.GetBool("mssql.storedprocedures") {
+		args = append([]interface{}{e.EFIN, held}, args...) // for the DELETE
+		args = append(args, e.EFIN, e.EFIN, id)             // for NOT EXISTS
+	}
+	stmt, err := prepare(p, "event_outbox.welcome")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(args...)
+	return err
+}
+
+// releaseWelcome releases (approve) or drops the welcome event held for
+// a record decided in review.
+func releaseWelcome(db *sql.DB, id int64, approve bool, confirmation string) error {
+	if !eventsEnabled() {
+		return nil
+	}
+	if approve {
+		_, err := execStatement(db, "event_outbox.release", confirmation, id)
+		return err
+	}
+	_, err := execStatement(db, "event_outbox.drop", id)
+	return err
+}
+
+// outboxEvent is what we send: the envelope and its type's data.
+type outboxEvent struct {
+	ID      int64           `json:"id"`
+	Type    string          `json:"type"`
+	Created time.Time       `json:"createdAt"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// eventDispatcher sends queued events to the fulfillment system.
+type eventDispatcher struct {
+	db          *sql.DB
+	url, secret string
+	client      *http.Client
+	breaker     *breaker
+	interval    time.Duration
+	batchSize   int
+	maxAttempts int
+}
+
+func newEventDispatcher(db *sql.DB) (*eventDispatcher, error) {
+	durations := map[string]time.Duration{}
+	for _, key := range []string{"events.fulfillment.timeout", "events.fulfillment.interval",
+		"events.fulfillment.breaker.cooldown", "events.fulfillment.breaker.maxcooldown"} {
+		d, err := configDuration(key)
+		if err != nil {
+			return nil, err
+		}
+		durations[key] = d
+	}
+	secret, err := secretValue(viper.GetString("events.fulfillment.secret"))
+	if err != nil {
+		return nil, fmt.Errorf("config: events.fulfillment.secret: %v", err)
+	}
+
+	return &eventDispatcher{
+		db:          db,
+		url:         viper.GetString("events.fulfillment.url"),
+		secret:      secret,
+		client:      &http.Client{Timeout: durations["events.fulfillment.timeout"]},
+		interval:    durations["events.fulfillment.interval"],
+		batchSize:   viper.GetInt("events.fulfillment.batchsize"),
+		maxAttempts: viper.GetInt("events.fulfillment.maxattempts"),
+		breaker: newBreaker("fulfillment", viper.GetInt("events.fulfillment.breaker.failures"),
+			durations["events.fulfillment.breaker.cooldown"], durations["events.fulfillment.breaker.maxcooldown"]),
+	}, nil
+}
+
+// run sends queued events every interval until stop is closed.
+func (d *eventDispatcher) run(stop <-chan struct{}) {
+	log.Printf("Sending events to %s\n", d.url)
+	for {
+		d.flush()
+		d.gauges()
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(d.interval):
+		}
+	}
+}
+
+// flush sends what is queued, a batch at a time, while the breaker lets
+// it.
+func (d *eventDispatcher) flush() {
+	for d.breaker.allow() {
+		queued, err := d.next()
+		if err != nil {
+			log.Printf("reading the event outbox: %v", err)
+			return
+		}
+		if len(queued) == 0 {
+			return
+		}
+
+		for i, ev := range queued {
+			if i > 0 && !d.breaker.allow() {
+				return
+			}
+			err := d.send(ev)
+			switch {
+			case err == nil:
+				d.breaker.success()
+				metricCount("events.sent", 1, tag("type", ev.Type), tag("status", "sent"))
+				if _, err := execStatement(d.db, "event_outbox.sent", time.Now().UTC(), ev.ID); err != nil {
+					log.Printf("recording event %d sent: %v", ev.ID, err)
+				}
+			case isAPIOutage(err):
+				d.breaker.failure(err)
+				metricCount("events.sent", 1, tag("type", ev.Type), tag("status", "unavailable"))
+				return
+			default:
+				d.breaker.success()
+				metricCount("events.sent", 1, tag("type", ev.Type), tag("status", "refused"))
+				log.Printf("fulfillment refused event %d (%s): %v", ev.ID, ev.Type, err)
+				if _, err := execStatement(d.db, "event_outbox.failed", truncate(err.Error(), 1000), time.Now(), ev.ID); err != nil {
+					log.Printf("recording event %d refused: %v", ev.ID, err)
+				}
+			}
+		}
+		if len(queued) < d.batchSize {
+			return
+		}
+	}
+}
+
+func (d *eventDispatcher) next() ([]outboxEvent, error) {
+	stmt, err := prepare(d.db, "event_outbox.next")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(d.batchSize, d.maxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var queued []outboxEvent
+	for rows.Next() {
+		var ev outboxEvent
+		var payload string
+		if err := rows.Scan(&ev.ID, &ev.Type, &payload, &ev.Created); err != nil {
+			return nil, err
+		}
+		ev.Data = json.RawMessage(payload)
+		queued = append(queued, ev)
+	}
+	return queued, rows.Err()
+}
+
+func (d *eventDispatcher) send(ev outboxEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "event-"+strconv.FormatInt(ev.ID, 10))
+	req.Header.Set("X-Enroll-Timestamp", timestamp)
+	req.Header.Set("X-Enroll-Signature", signWebhook(d.secret, timestamp, body))
+	var data struct {
+		CorrelationId string `json:"correlationId"`
+	}
+	if json.Unmarshal(ev.Data, &data) == nil && data.CorrelationId != "" {
+		req.Header.Set(correlationHeader, data.CorrelationId)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return &callError{API: "fulfillment", Status: resp.StatusCode, Text: resp.Status}
+	}
+	return nil
+}
+
+// gauges reports how many events are waiting.
+func (d *eventDispatcher) gauges() {
+	stmt, err := prepare(d.db, "event_outbox.depth")
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	var queued, stuck int
+	if err := stmt.QueryRow(d.maxAttempts).Scan(&queued, &stuck); err != nil {
+		if debug {
+			log.Printf("event outbox depth: %v", err)
+		}
+		return
+	}
+	metricGauge("events.queue", queued)
+	metricGauge("events.refused", stuck)
+}
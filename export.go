@@ -0,0 +1,133 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"encoding/csv"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+)
+
+// "enroll export" writes a tax year's enrollments as CSV - for the bank,
+// or for an auditor with --as-of. Deleted records are left out unless
+// --include-deleted, which adds a DELETED_AT column. --masked runs every
+// row through the anonymizer (mask.go) first, for seeding staging.
+
+var (
+	exportYear   int
+	exportOut    string
+	exportMasked bool
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export a tax year's enrollments as CSV",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		out := io.Writer(os.Stdout)
+		if exportOut != "" {
+			f, err := os.Create(exportOut)
+			check(err)
+			defer f.Close()
+			out = f
+		}
+
+		if t, ok := parseAsOf(asOf); ok {
+			check(exportEnrollments(out, dbs.reader(), "ero.export_asof", t, exportYear, includeDeleted))
+			return
+		}
+		check(exportEnrollments(out, dbs.reader(), "ero.export", exportYear, includeDeleted))
+	},
+}
+
+func init() {
+	exportCmd.Flags().IntVar(&exportYear, "year", 2016, "tax year")
+	exportCmd.Flags().StringVar(&exportOut, "out", "", "file to write (default stdout)")
+	exportCmd.Flags().StringVar(&asOf, "as-of", "", "export what was loaded as of this date (2016-02-15) or time (RFC 3339)")
+	exportCmd.Flags().BoolVar(&includeDeleted, "include-deleted", false, "export deleted records too")
+	exportCmd.Flags().BoolVar(&exportMasked, "masked", false, "apply the anonymizer rules (mask.rules) to every row")
+	rootCmd.AddCommand(exportCmd)
+}
+
+// exportEnrollments runs one of the ero.export queries and writes CSV.
+func exportEnrollments(out io.Writer, db *sql.DB, name string, args ...interface{}) error {
+	var m *masker
+	if exportMasked {
+		var err error
+		if m, err = newMasker(); err != nil {
+			return err
+		}
+	}
+	stmt, err := prepare(db, name)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := csv.NewWriter(out)
+	header := []string{"ID", "EFIN", "COMPANY", "TAX_YEAR", "RECEIVED_DATE", "BATCH_ID", "STATUS"}
+	if includeDeleted {
+		header = append(header, "DELETED_AT")
+	}
+	w.Write(header)
+	for rows.Next() {
+		var e enrollmentRecord
+		var batch sql.NullInt64
+		var deleted sql.NullTime
+		if err := rows.Scan(&e.ID, &e.EFIN, &e.Company, &e.TaxYear, &e.Received, &batch, &e.Status, &deleted); err != nil {
+			return err
+		}
+		batchID := ""
+		if batch.Valid {
+			batchID = strconv.FormatInt(batch.Int64, 10)
+		}
+		record := []string{
+			strconv.FormatInt(e.ID, 10), e.EFIN, e.Company, strconv.Itoa(e.TaxYear),
+			e.Received.Format(time.RFC3339), batchID, e.Status,
+		}
+		if includeDeleted {
+			deletedAt := ""
+			if deleted.Valid {
+				deletedAt = deleted.Time.Format(time.RFC3339)
+			}
+			record = append(record, deletedAt)
+		}
+		if m != nil {
+			m.apply(header, record)
+		}
+		w.Write(record)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
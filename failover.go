@@ -0,0 +1,113 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Our SQL Server runs in an AlwaysOn availability group. When it fails
+// over, every open connection to the old primary dies and, for a few
+// seconds, the listener either refuses connections or points at a replica
+// that can't take writes yet. Rather than fall over, the loader waits for
+// the listener to come back and carries on from its last checkpoint
+// (see checkpoint.go).
+func init() {
+	viper.SetDefault("mssql.failover.enabled", true)
+}
+
+// SQL Server error numbers we see during an AG failover.
+var failoverErrors = map[int32]bool{
+	233:   true, // no process is on the other end of the pipe
+	596:   true, // session is in the kill state
+	976:   true, // database in an AG is not accessible for queries
+	978:   true, // database only accessible with read-only intent
+	983:   true, // replica is not in the PRIMARY or SECONDARY role
+	3906:  true, // database is read-only (we're talking to the old primary)
+	4060:  true, // cannot open database requested by the login
+	10053: true, // transport-level error, connection aborted
+	10054: true, // transport-level error, connection reset
+}
+
+// isFailoverError reports whether err looks like the primary went away,
+// as opposed to something wrong with our data or SQL.
+func isFailoverError(err error) bool {
+	if err == nil || !viper.GetBool("mssql.failover.enabled") {
+		return false
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	// The driver's Error type has a SQLErrorNumber method. We check for
+	// the method rather than import the driver by name.
+	var sqlErr interface{ SQLErrorNumber() int32 }
+	if errors.As(err, &sqlErr) {
+		return failoverErrors[sqlErr.SQLErrorNumber()]
+	}
+
+	// Some connection failures only ever reach us as strings.
+	msg := err.Error()
+	return strings.Contains(msg, "connection reset") || strings.Contains(msg, "broken pipe")
+}
+
+// reconnect drops the pool's connections to the old primary and waits for
+// the listener to accept us again, backing off as the "database" retry
+// policy says (see retry.go).
+func reconnect(db *sql.DB) error {
+	policy := retryPolicyFor("database")
+	started := time.Now()
+
+	// Setting the idle limit to zero closes every idle connection; put
+	// database/sql's default back once we are through.
+	db.SetMaxIdleConns(0)
+	defer db.SetMaxIdleConns(2)
+
+	for n := 1; ; n++ {
+		err := db.Ping()
+		if err == nil {
+			log.Printf("Reconnected to %s\n", viper.GetString("mssql.host"))
+			dbUp()
+			metricCount("db.reconnect", 1)
+			return nil
+		}
+		dbDown(err)
+		wait, ok := policy.next(n, started)
+		if !ok {
+			return fmt.Errorf("gave up reconnecting to %s after %v: %w", viper.GetString("mssql.host"),
+				time.Since(started).Round(time.Second), err)
+		}
+
+		log.Printf("Waiting for %s: %v (retrying in %v)\n", viper.GetString("mssql.host"), err, wait)
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Config refers to enrollment fields by their Go path, e.g.
+// "OfficeInfo.Email" or "PriorYearInfo.Bank". fieldValue resolves such a
+// path against a record using reflection. Each path is looked up in the
+// Enrollment type once (fieldIndex); after that a record only costs a
+// FieldByIndex.
+
+// fieldIndexes caches fieldIndex, by path. nil means no such field.
+var fieldIndexes sync.Map
+
+// fieldIndex returns the reflect index of the field at path in an
+// Enrollment. ok is false if there is no such field.
+func fieldIndex(path string) (index []int, ok bool) {
+	if i, ok := fieldIndexes.Load(path); ok {
+		index = i.([]int)
+		return index, index != nil
+	}
+	t := reflect.TypeOf(Enrollment{})
+	for _, name := range strings.Split(path, ".") {
+		f, found := reflect.StructField{}, false
+		if t.Kind() == reflect.Struct {
+			f, found = t.FieldByName(name)
+		}
+		if !found {
+			index = nil
+			break
+		}
+		index = append(index, f.Index...)
+		t = f.Type
+	}
+	fieldIndexes.Store(path, index)
+	return index, index != nil
+}
+
+// fieldValue returns the value at path as a string. ok is false if there
+// is no such field.
+func fieldValue(e Enrollment, path string) (value string, ok bool) {
+	index, ok := fieldIndex(path)
+	if !ok {
+		return "", false
+	}
+	v := reflect.ValueOf(e).FieldByIndex(index)
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), true
+	case reflect.Bool:
+		return fmt.Sprintf("%t", v.Bool()), true
+	case reflect.Struct:
+		return "", false
+	default:
+		return fmt.Sprint(v.Interface()), true
+	}
+}
+
+// fieldRef returns the settable field at path in *e.
+func fieldRef(e *Enrollment, path string) (reflect.Value, bool) {
+	index, ok := fieldIndex(path)
+	if !ok {
+		return reflect.Value{}, false
+	}
+	return reflect.ValueOf(e).Elem().FieldByIndex(index), true
+}
+
+// blank reports whether a field holds nothing: an empty (or all space)
+// string, false, or a struct whose fields are all blank.
+func blank(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String:
+		return strings.TrimSpace(v.String()) == ""
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !blank(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return v.IsZero()
+}
+
+// assignField copies src into dst. Structs of different types (e.g.
+// OwnerInformation into EFINOwnerInfo) are copied field by field, by name.
+func assignField(dst, src reflect.Value) error {
+	if src.Type().AssignableTo(dst.Type()) {
+		dst.Set(src)
+		return nil
+	}
+	if dst.Kind() != reflect.Struct || src.Kind() != reflect.Struct {
+		return fmt.Errorf("can't copy %s into %s", src.Type(), dst.Type())
+	}
+	for i := 0; i < dst.NumField(); i++ {
+		name := dst.Type().Field(i).Name
+		if s := src.FieldByName(name); s.IsValid() {
+			if err := assignField(dst.Field(i), s); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// setField sets the field at path (matched without regard to case) to
+// value, "true" or "false" for a flag, and returns its proper path.
+func setField(e *Enrollment, path, value string) (string, error) {
+	field := ""
+	for _, f := range leafFields {
+		if strings.EqualFold(f, path) {
+			field = f
+		}
+	}
+	v, ok := fieldRef(e, field)
+	if field == "" || !ok {
+		return "", fmt.Errorf("unknown field %q", path)
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		switch strings.ToLower(value) {
+		case "true", "1":
+			v.SetBool(true)
+		case "false", "0":
+			v.SetBool(false)
+		default:
+			return "", fmt.Errorf("%s is true or false (got %q)", field, value)
+		}
+	default:
+		return "", fmt.Errorf("%s can't be set", field)
+	}
+	return field, nil
+}
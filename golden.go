@@ -0,0 +1,88 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// With --golden (or "golden": true in the config) the same input file
+// always produces byte-identical ACKs, summaries and reports, so they can
+// be kept as golden files and diffed to see what a rule change did:
+//
+//   - results are sorted by record index, and errors by field and code
+//   - the correlation ID is taken from the file's checksum
+//   - timestamps, batch numbers and enrollment IDs are left out (the ACK
+//     is named <file>.ack.xml)
+func init() {
+	rootCmd.PersistentFlags().Bool("golden", false, "deterministic output for golden-file tests")
+	check(viper.BindPFlag("golden", rootCmd.PersistentFlags().Lookup("golden")))
+}
+
+func golden() bool {
+	return viper.GetBool("golden")
+}
+
+// goldenTime stands in for "now" in golden output.
+var goldenTime = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// stamp is the time to put in output: now, or goldenTime.
+func stamp() time.Time {
+	if golden() {
+		return goldenTime
+	}
+	return time.Now()
+}
+
+// fileCorrelation picks the correlation ID for a file.
+func fileCorrelation(f inputFile) string {
+	if golden() && len(f.SHA256) >= 16 {
+		return f.SHA256[:16]
+	}
+	return newCorrelationID()
+}
+
+// sorted returns the summary in file order, each record's errors sorted.
+func (s loadSummary) sorted() loadSummary {
+	loaded := append([]loadedRecord(nil), s.Loaded...)
+	sort.SliceStable(loaded, func(i, j int) bool { return loaded[i].Index < loaded[j].Index })
+
+	rejected := make([]rejectedRecord, len(s.Rejected))
+	for i, r := range s.Rejected {
+		r.Errors = append([]recordError(nil), r.Errors...)
+		sortErrors(r.Errors)
+		rejected[i] = r
+	}
+	sort.SliceStable(rejected, func(i, j int) bool { return rejected[i].Index < rejected[j].Index })
+
+	deactivated := append([]deactivatedRecord(nil), s.Deactivated...)
+	sort.SliceStable(deactivated, func(i, j int) bool { return deactivated[i].Index < deactivated[j].Index })
+
+	s.Loaded, s.Rejected, s.Deactivated = loaded, rejected, deactivated
+	return s
+}
+
+func sortErrors(errs []recordError) {
+	sort.SliceStable(errs, func(i, j int) bool {
+		if errs[i].Field != errs[j].Field {
+			return errs[i].Field < errs[j].Field
+		}
+		return errs[i].Code < errs[j].Code
+	})
+}
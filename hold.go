@@ -0,0 +1,147 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+)
+
+// Legal holds (sql/032_legal_holds.sql). Legal puts an EFIN, or an owner
+// by their subject hash (see subject.go), under hold while a matter is
+// open:
+//
+//	enroll hold place --efin 123456 --reason "Smith v. TPG"
+//	enroll hold place --owner <ssn hash> --reason "..."
+//	enroll hold release --id 7
+//
+// Nothing that destroys data touches what is held: subject erase refuses,
+// and revert --delete rejects held records but doesn't mark them deleted.
+// "enroll report holds" lists every hold in place, why, and how many
+// records it covers.
+
+// Legal hold kinds.
+const (
+	holdEFIN  = "efin"
+	holdOwner = "owner"
+)
+
+var (
+	holdEFINFlag, holdOwnerFlag string
+	holdReason, holdBy          string
+	holdID                      int64
+)
+
+var holdCmd = &cobra.Command{
+	Use:   "hold",
+	Short: "Place or release legal holds",
+}
+
+var holdPlaceCmd = &cobra.Command{
+	Use:   "place",
+	Short: "Put an EFIN or an owner under legal hold",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if (holdEFINFlag == "") == (holdOwnerFlag == "") {
+			check(fmt.Errorf("give one of --efin or --owner"))
+		}
+		if strings.TrimSpace(holdReason) == "" {
+			check(fmt.Errorf("--reason is required"))
+		}
+		kind, value := holdEFIN, strings.TrimSpace(holdEFINFlag)
+		if holdOwnerFlag != "" {
+			hash, err := parseSubjectHash("owner", holdOwnerFlag)
+			check(err)
+			kind, value = holdOwner, hash
+		}
+
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		stmt, err := prepare(dbs.primary, "legal_hold.add")
+		check(err)
+		defer stmt.Close()
+		var id int64
+		check(stmt.QueryRow(kind, value, truncate(holdReason, 400), truncate(holdBy, 100), time.Now()).Scan(&id))
+		fmt.Printf("Hold %d placed on %s %s by %s\n", id, kind, value, holdBy)
+	},
+}
+
+var holdReleaseCmd = &cobra.Command{
+	Use:   "release",
+	Short: "Release a legal hold",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if holdID == 0 {
+			check(fmt.Errorf("--id is required"))
+		}
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		n, err := execStatement(dbs.primary, "legal_hold.release", time.Now(), truncate(holdBy, 100), holdID)
+		check(err)
+		if n == 0 {
+			check(fmt.Errorf("no hold %d in place", holdID))
+		}
+		fmt.Printf("Hold %d released by %s\n", holdID, holdBy)
+	},
+}
+
+var holdsReportCmd = &cobra.Command{
+	Use:   "holds",
+	Short: "Every legal hold in place and why",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tKIND\tHELD\tRECORDS\tPLACED\tBY\tREASON")
+		queryRows(dbs.reader(), "legal_hold.list", func(rows *sql.Rows) {
+			var (
+				id                          int64
+				kind, value, reason, placer string
+				placed                      time.Time
+				records                     int
+			)
+			check(rows.Scan(&id, &kind, &value, &reason, &placer, &placed, &records))
+			fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\t%s\n", id, kind, value, records, placed.Format("2006-01-02"), placer, reason)
+		})
+		check(w.Flush())
+	},
+}
+
+func init() {
+	holdPlaceCmd.Flags().StringVar(&holdEFINFlag, "efin", "", "EFIN to hold")
+	holdPlaceCmd.Flags().StringVar(&holdOwnerFlag, "owner", "", "owner to hold, by subject hash (see enroll subject hash)")
+	holdPlaceCmd.Flags().StringVar(&holdReason, "reason", "", "the matter the hold is for")
+	holdReleaseCmd.Flags().Int64Var(&holdID, "id", 0, "hold ID")
+	for _, cmd := range []*cobra.Command{holdPlaceCmd, holdReleaseCmd} {
+		cmd.Flags().StringVar(&holdBy, "by", currentUser(), "who is placing or releasing it")
+	}
+	holdCmd.AddCommand(holdPlaceCmd, holdReleaseCmd)
+	rootCmd.AddCommand(holdCmd)
+	reportCmd.AddCommand(holdsReportCmd)
+}
@@ -0,0 +1,150 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Hooks let code built into the loader attach behaviour to the pipeline -
+// extra logging, routing records elsewhere, feeding another system -
+// without changing load.go. Add a file with an init that registers them:
+//
+//	func init() {
+//		RegisterHooks(Hooks{
+//			OnRecordLoaded: func(job *batchJob, r loadedRecord) { ... },
+//		})
+//	}
+//
+// Any field may be nil. Hooks run in the loading goroutine, in the order
+// they were registered, so keep them quick; a hook that panics is logged
+// and otherwise ignored. The copy of a batch loaded into the shadow
+// database (shadow.go) only runs OnRecordParsed, which can change what is
+// loaded; the rest would hear about every record twice. Canary rules
+// (canary.go) run none.
+type Hooks struct {
+	// OnRecordParsed sees each record before it is checked. It may change
+	// the record; returning an error rejects it (HOOK_REJECTED).
+	OnRecordParsed func(job *batchJob, index int, e *Enrollment) error
+
+	// OnValidationFailed sees each rejected record.
+	OnValidationFailed func(job *batchJob, r rejectedRecord)
+
+	// OnRecordLoaded sees each record after it is inserted.
+	OnRecordLoaded func(job *batchJob, r loadedRecord)
+
+	// OnRecordDeactivated sees each de-enrollment after it is applied.
+	OnRecordDeactivated func(job *batchJob, r deactivatedRecord)
+
+	// OnFileComplete runs once the batch is finished and its ACK written.
+	OnFileComplete func(job *batchJob, status string, summary loadSummary)
+}
+
+// errHookRejected is the code for records a hook rejected.
+const errHookRejected = "HOOK_REJECTED"
+
+var hooks struct {
+	sync.RWMutex
+	list []Hooks
+}
+
+// RegisterHooks adds a set of hooks.
+func RegisterHooks(h Hooks) {
+	hooks.Lock()
+	hooks.list = append(hooks.list, h)
+	hooks.Unlock()
+}
+
+func registeredHooks() []Hooks {
+	hooks.RLock()
+	defer hooks.RUnlock()
+	return hooks.list
+}
+
+// safely runs a hook, turning a panic into a log line.
+func safely(job *batchJob, name string, fn func()) {
+	defer func() {
+		if p := recover(); p != nil {
+			job.logf("%s hook panicked: %v", name, p)
+		}
+	}()
+	fn()
+}
+
+func recordParsed(job *batchJob, i int, e *Enrollment) []recordError {
+	if job.Trial {
+		return nil
+	}
+	var problems []recordError
+	for _, h := range registeredHooks() {
+		if h.OnRecordParsed == nil {
+			continue
+		}
+		var err error
+		safely(job, "OnRecordParsed", func() { err = h.OnRecordParsed(job, i, e) })
+		if err != nil {
+			problems = append(problems, recordError{Code: errHookRejected, Message: err.Error()})
+		}
+	}
+	return problems
+}
+
+func validationFailed(job *batchJob, r rejectedRecord) {
+	if job.Shadow {
+		return
+	}
+	for _, h := range registeredHooks() {
+		if h.OnValidationFailed != nil {
+			safely(job, "OnValidationFailed", func() { h.OnValidationFailed(job, r) })
+		}
+	}
+}
+
+func recordLoaded(job *batchJob, r loadedRecord) {
+	if job.Shadow {
+		return
+	}
+	for _, h := range registeredHooks() {
+		if h.OnRecordLoaded != nil {
+			safely(job, "OnRecordLoaded", func() { h.OnRecordLoaded(job, r) })
+		}
+	}
+}
+
+func recordDeactivated(job *batchJob, r deactivatedRecord) {
+	if job.Shadow {
+		return
+	}
+	for _, h := range registeredHooks() {
+		if h.OnRecordDeactivated != nil {
+			safely(job, "OnRecordDeactivated", func() { h.OnRecordDeactivated(job, r) })
+		}
+	}
+}
+
+func fileComplete(job *batchJob, status string, summary loadSummary) {
+	for _, h := range registeredHooks() {
+		if h.OnFileComplete != nil {
+			safely(job, "OnFileComplete", func() { h.OnFileComplete(job, status, summary) })
+		}
+	}
+}
+
+// String lets a job be logged by hooks.
+func (job *batchJob) String() string {
+	return fmt.Sprintf("batch %d (%s, %s)", job.ID, job.File.Path, job.Correlation)
+}
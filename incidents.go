@@ -0,0 +1,259 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// When processing fails hard we open an incident in PagerDuty
+// (incidents.pagerduty.routingkey, Events API v2) and/or Opsgenie
+// (incidents.opsgenie.apikey). We page for:
+//
+//   - the database being unreachable for incidents.dbdown (default 5m)
+//   - a file failing, or loading for more than incidents.stuckafter
+//     (default 30m)
+//   - a file whose reject rate is over incidents.rejectrate (default 0.5,
+//     for files of at least incidents.rejectmin records, default 20)
+//
+// Every incident has a dedup key - per file (its SHA-256) or for the
+// database - so a problem pages once however often we notice it, and is
+// resolved automatically when it clears (the database comes back, the
+// stuck file finishes).
+func init() {
+	viper.SetDefault("incidents.dbdown", "5m")
+	viper.SetDefault("incidents.stuckafter", "30m")
+	viper.SetDefault("incidents.rejectrate", 0.5)
+	viper.SetDefault("incidents.rejectmin", 20)
+	viper.SetDefault("incidents.pagerduty.url", "https://events.pagerduty.com/v2/enqueue")
+	viper.SetDefault("incidents.opsgenie.url", "https://api.opsgenie.com/v2/alerts")
+}
+
+// incidentsEnabled reports whether anything is configured to page.
+func incidentsEnabled() bool {
+	return viper.GetString("incidents.pagerduty.routingkey") != "" || viper.GetString("incidents.opsgenie.apikey") != ""
+}
+
+// incidentKey is the key in setting name, which may be a secret
+// reference (secrets.go). One that can't be resolved is logged, and that
+// service isn't paged.
+func incidentKey(name string) string {
+	key, err := secretValue(viper.GetString(name))
+	if err != nil {
+		log.Printf("config: %s: %v", name, err)
+		return ""
+	}
+	return key
+}
+
+var incidentClient = &http.Client{Timeout: 10 * time.Second}
+
+// triggerIncident opens (or, for a dedup key already open, updates) an
+// incident. Failures to page are logged.
+func triggerIncident(dedup, summary string, details map[string]interface{}) {
+	if !incidentsEnabled() {
+		return
+	}
+	log.Printf("Incident %s: %s\n", dedup, summary)
+	source, _ := os.Hostname()
+
+	if key := incidentKey("incidents.pagerduty.routingkey"); key != "" {
+		err := postIncident(viper.GetString("incidents.pagerduty.url"), "", map[string]interface{}{
+			"routing_key":  key,
+			"event_action": "trigger",
+			"dedup_key":    dedup,
+			"payload": map[string]interface{}{
+				"summary":        summary,
+				"source":         source,
+				"severity":       "critical",
+				"component":      "enroll",
+				"custom_details": details,
+			},
+		})
+		if err != nil {
+			log.Printf("pagerduty: %v", err)
+		}
+	}
+	if key := incidentKey("incidents.opsgenie.apikey"); key != "" {
+		err := postIncident(viper.GetString("incidents.opsgenie.url"), key, map[string]interface{}{
+			"message":  truncate(summary, 130),
+			"alias":    dedup,
+			"source":   source,
+			"priority": "P1",
+			"details":  stringDetails(details),
+		})
+		if err != nil {
+			log.Printf("opsgenie: %v", err)
+		}
+	}
+}
+
+// resolveIncident closes the incident for a dedup key, if there is one.
+func resolveIncident(dedup string) {
+	if !incidentsEnabled() {
+		return
+	}
+
+	if key := incidentKey("incidents.pagerduty.routingkey"); key != "" {
+		err := postIncident(viper.GetString("incidents.pagerduty.url"), "", map[string]interface{}{
+			"routing_key":  key,
+			"event_action": "resolve",
+			"dedup_key":    dedup,
+		})
+		if err != nil {
+			log.Printf("pagerduty: %v", err)
+		}
+	}
+	if key := incidentKey("incidents.opsgenie.apikey"); key != "" {
+		u := viper.GetString("incidents.opsgenie.url") + "/" + url.PathEscape(dedup) + "/close?identifierType=alias"
+		if err := postIncident(u, key, map[string]interface{}{"source": "enroll"}); err != nil {
+			log.Printf("opsgenie: %v", err)
+		}
+	}
+}
+
+func postIncident(u, genieKey string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return retrying("api", "posting to "+u, func() error { return postIncidentOnce(u, genieKey, b) })
+}
+
+func postIncidentOnce(u, genieKey string, b []byte) error {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if genieKey != "" {
+		req.Header.Set("Authorization", "GenieKey "+genieKey)
+	}
+
+	resp, err := incidentClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// Opsgenie details are string to string.
+func stringDetails(details map[string]interface{}) map[string]string {
+	s := make(map[string]string, len(details))
+	for k, v := range details {
+		s[k] = fmt.Sprint(v)
+	}
+	return s
+}
+
+func fileIncidentKey(sha string) string { return "enroll-file-" + sha }
+
+// fileIncidents pages for a finished file that failed or rejected too
+// much, and resolves any earlier incident (e.g. "stuck") for it otherwise.
+func fileIncidents(job *batchJob, status string, summary loadSummary) {
+	dedup := fileIncidentKey(job.File.SHA256)
+	details := map[string]interface{}{
+		"batch":       job.ID,
+		"correlation": job.Correlation,
+		"file":        job.File.Path,
+		"transmitter": job.File.Transmitter(),
+		"records":     len(job.File.Records),
+		"loaded":      len(summary.Loaded),
+		"rejected":    len(summary.Rejected),
+	}
+
+	n := len(job.File.Records)
+	rate := 0.0
+	if n > 0 {
+		rate = float64(len(summary.Rejected)) / float64(n)
+	}
+
+	switch {
+	case status == batchFailed:
+		triggerIncident(dedup, fmt.Sprintf("enroll: batch %d (%s) failed", job.ID, job.File.Path), details)
+	case n >= viper.GetInt("incidents.rejectmin") && rate > viper.GetFloat64("incidents.rejectrate"):
+		triggerIncident(dedup, fmt.Sprintf("enroll: batch %d (%s) rejected %.0f%% of %d records", job.ID, job.File.Path, rate*100, n), details)
+	default:
+		resolveIncident(dedup)
+	}
+}
+
+// dbHealth tracks how long the database has been unreachable.
+var dbHealth struct {
+	sync.Mutex
+	since time.Time // first failure of the current outage
+	paged bool
+}
+
+const dbIncidentKey = "enroll-database"
+
+// dbDown notes a failed attempt to reach the database, and pages once it
+// has been down for incidents.dbdown.
+func dbDown(err error) {
+	threshold, perr := time.ParseDuration(viper.GetString("incidents.dbdown"))
+	if perr != nil {
+		threshold = 5 * time.Minute
+	}
+
+	dbHealth.Lock()
+	if dbHealth.since.IsZero() {
+		dbHealth.since = time.Now()
+	}
+	down := time.Since(dbHealth.since)
+	page := !dbHealth.paged && down >= threshold
+	if page {
+		dbHealth.paged = true
+	}
+	dbHealth.Unlock()
+
+	if page {
+		triggerIncident(dbIncidentKey, fmt.Sprintf("enroll: %s unreachable for %s", viper.GetString("mssql.host"), down.Round(time.Second)),
+			map[string]interface{}{"host": viper.GetString("mssql.host"), "error": err.Error()})
+	}
+}
+
+// dbUp notes that the database answered, resolving any outage incident.
+func dbUp() {
+	dbHealth.Lock()
+	paged := dbHealth.paged
+	dbHealth.since, dbHealth.paged = time.Time{}, false
+	dbHealth.Unlock()
+
+	if paged {
+		resolveIncident(dbIncidentKey)
+	}
+}
+
+// dbIsDown reports whether we are in an outage.
+func dbIsDown() bool {
+	dbHealth.Lock()
+	defer dbHealth.Unlock()
+	return !dbHealth.since.IsZero()
+}
@@ -0,0 +1,113 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"time"
+)
+
+// A file is loaded exactly once, however it arrives and wherever the
+// loader dies along the way. Three things see to it:
+//
+//   - The batch table is the registry of files, by checksum. Before a
+//     file is loaded we look it up: if a batch has loaded it already we
+//     load nothing and say which batch did; if one started on it and never
+//     finished (the process died, or it failed) we pick that batch up
+//     again, even on another instance and without its checkpoint.
+//   - The load_ledger table (sql/039_load_ledger.sql) has a row for each
+//     record a batch has written, added in the record's own transaction.
+//     A batch picked up again skips the records in it, so a record that
+//     committed after the last checkpoint isn't written twice.
+//   - What a record queues for later - the bank API (bankapi.go), events
+//     (events.go), verification email (verify.go) - goes in an outbox in
+//     that same transaction, and is sent with an Idempotency-Key.
+//
+// Replays (replay.go) load a file again on purpose, and so does
+// --allow-duplicate. The checkpoint (checkpoint.go) is still kept: it
+// saves looking records up in the ledger. recent.go and duplicates.go
+// stop repeats earlier, but nothing depends on them.
+
+// Ledger outcomes.
+const (
+	ledgerLoaded      = "loaded"
+	ledgerPending     = "pending"
+	ledgerDeactivated = "deactivated"
+)
+
+// alreadyLoadedError is a file a batch has loaded already.
+type alreadyLoadedError struct {
+	Batch batchInfo
+}
+
+func (e *alreadyLoadedError) Error() string {
+	return fmt.Sprintf("already loaded as batch %d (%s)", e.Batch.ID, e.Batch.FileName)
+}
+
+// fileBatch is the latest batch, not a replay, that loaded or began
+// loading f, if there is one.
+func fileBatch(db *sql.DB, f inputFile) (batchInfo, bool, error) {
+	stmt, err := prepare(db, "batch.by_sha")
+	if err != nil {
+		return batchInfo{}, false, err
+	}
+	defer stmt.Close()
+
+	b, err := scanBatch(stmt.QueryRow(f.SHA256))
+	if err == sql.ErrNoRows {
+		return batchInfo{}, false, nil
+	}
+	return b, err == nil, err
+}
+
+// recordWritten adds record i of job's batch to the ledger, through w,
+// the record's transaction. id is its ero row, or 0.
+func recordWritten(w preparer, job *batchJob, i int, id int64, outcome string) error {
+	var ero interface{}
+	if id > 0 {
+		ero = id
+	}
+	_, err := execStatement(w, "ledger.add", job.ID, i, ero, outcome, time.Now())
+	return err
+}
+
+// writtenRecords is the records from start up to end that job's batch
+// has written already, and how.
+func writtenRecords(p preparer, job *batchJob, start, end int) (map[int]string, error) {
+	stmt, err := prepare(p, "ledger.written")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(job.ID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	written := map[int]string{}
+	for rows.Next() {
+		var i int
+		var outcome string
+		if err := rows.Scan(&i, &outcome); err != nil {
+			return nil, err
+		}
+		written[i] = outcome
+	}
+	return written, rows.Err()
+}
@@ -0,0 +1,172 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// A value longer than its ero column used to get as far as the insert and
+// fail there with DB_TRUNCATION. Now each stored field is checked against
+// its column before anything is written: the lengths come from the
+// database's column metadata when the batch starts (lengths.fromdb), or
+// storedColumnTypes if it can't be read. lengths.fields sets limits for
+// other text fields, or tighter ones for stored fields:
+//
+//	"lengths": {
+//	  "policy": "reject",
+//	  "fields": [
+//	    {"field": "OfficeInfo.Email", "max": 254},
+//	    {"field": "OfficeInfo.OfficeName", "max": 80}
+//	  ]
+//	}
+//
+// lengths.policy "reject" (the default) rejects a record with a value
+// that is too long (FIELD_TOO_LONG); "truncate" cuts the value to fit and
+// accepts the record with a FIELD_TRUNCATED warning in the ACK. Lengths
+// are in characters.
+func init() {
+	viper.SetDefault("lengths.policy", lengthReject)
+	viper.SetDefault("lengths.fromdb", true)
+}
+
+// What to do with a value that is too long.
+const (
+	lengthReject   = "reject"
+	lengthTruncate = "truncate"
+)
+
+// Codes for values that are too long.
+const (
+	errFieldTooLong   = "FIELD_TOO_LONG"
+	errFieldTruncated = "FIELD_TRUNCATED"
+)
+
+type lengthLimit struct {
+	Field string `mapstructure:"field"`
+	Max   int    `mapstructure:"max"`
+}
+
+// lengthPolicy is the checked lengths config.
+type lengthPolicy struct {
+	truncate bool
+	max      map[string]int // field -> characters
+	fields   []string       // sorted, for the order of problems
+}
+
+// loadLengthPolicy reads the lengths config. With db, the stored fields'
+// lengths come from the ero columns.
+func loadLengthPolicy(cfg *viper.Viper, db *sql.DB) (*lengthPolicy, error) {
+	p := &lengthPolicy{max: map[string]int{}}
+	switch policy := cfg.GetString("lengths.policy"); policy {
+	case lengthReject:
+	case lengthTruncate:
+		p.truncate = true
+	default:
+		return nil, fmt.Errorf("config: lengths.policy must be %s or %s (got %q)", lengthReject, lengthTruncate, policy)
+	}
+
+	for field, c := range storedColumnTypes {
+		p.max[field] = c.Length
+	}
+	if db != nil && cfg.GetBool("lengths.fromdb") {
+		if err := p.readColumns(db); err != nil {
+			log.Printf("reading ero column lengths (using the built-in ones): %v", err)
+		}
+	}
+
+	var limits []lengthLimit
+	if err := cfg.UnmarshalKey("lengths.fields", &limits); err != nil {
+		return nil, fmt.Errorf("config: lengths.fields: %v", err)
+	}
+	var e Enrollment
+	for _, l := range limits {
+		if v, ok := fieldValue(e, l.Field); !ok || v != "" {
+			return nil, fmt.Errorf("config: lengths: %q is not a text field", l.Field)
+		}
+		if l.Max < 1 {
+			return nil, fmt.Errorf("config: lengths: %s: max must be at least 1 (got %d)", l.Field, l.Max)
+		}
+		if column, stored := p.max[l.Field]; stored && l.Max > column {
+			return nil, fmt.Errorf("config: lengths: %s is stored in %s, which holds %d characters (got %d)", l.Field, storedColumnTypes[l.Field].Name, column, l.Max)
+		}
+		p.max[l.Field] = l.Max
+	}
+
+	for field := range p.max {
+		p.fields = append(p.fields, field)
+	}
+	sort.Strings(p.fields)
+	return p, nil
+}
+
+// readColumns takes the stored fields' lengths from the database.
+func (p *lengthPolicy) readColumns(db *sql.DB) error {
+	columns, err := readEroColumns(db)
+	if err != nil {
+		return err
+	}
+	for field, c := range storedColumnTypes {
+		switch col, ok := columns[c.Name]; {
+		case !ok:
+			// Not visible to this login; keep the built-in length.
+		case col.Length < 0:
+			delete(p.max, field) // (N)VARCHAR(MAX)
+		default:
+			p.max[field] = col.Length
+		}
+	}
+	return nil
+}
+
+// apply checks the record's values against their limits, cutting them
+// down under the truncate policy. Fields a partial amendment left out
+// (present, see amend.go) are skipped.
+func (p *lengthPolicy) apply(e *Enrollment, present fieldSet) (problems, warnings []recordError) {
+	if p == nil {
+		return nil, nil
+	}
+	for _, field := range p.fields {
+		if !present.has(field) {
+			continue
+		}
+		v, ok := fieldRef(e, field)
+		if !ok {
+			continue
+		}
+		max, n := p.max[field], utf8.RuneCountInString(v.String())
+		if n <= max {
+			continue
+		}
+		args := map[string]string{"length": strconv.Itoa(n), "max": strconv.Itoa(max)}
+		if !p.truncate {
+			problems = append(problems, recordError{Field: field, Code: errFieldTooLong, Args: args,
+				Message: fmt.Sprintf("%s is %d characters long; at most %d are allowed", field, n, max)})
+			continue
+		}
+		v.SetString(string([]rune(v.String())[:max]))
+		warnings = append(warnings, recordError{Field: field, Code: errFieldTruncated, Args: args,
+			Message: fmt.Sprintf("%s was %d characters long and was cut to %d", field, n, max)})
+	}
+	return problems, warnings
+}
@@ -0,0 +1,932 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dstroot/go_enrollment/enrollment"
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Transaction modes ("load.transaction" in the config):
+//
+//	none  every record commits on its own, in a transaction with its
+//	      parts (see parts.go). A record that fails is quarantined and
+//	      the rest of the file carries on (see quarantine.go); with
+//	      "load.quarantine.enabled" off the first error stops the run,
+//	      as it always used to
+//	file  the whole file is loaded in one transaction. With
+//	      "load.savepoints" on, each record gets a savepoint so a bad
+//	      record is rolled back and rejected while the rest of the file
+//	      still commits; with it off, any error rolls back the file.
+//	      The transaction runs at "load.isolation" (see db.go).
+//	batch "load.batchsize" records (500 by default, or --batch-size)
+//	      go in each transaction, which is much quicker than a commit
+//	      per record on a big file. Savepoints work as they do for a
+//	      file. A batch that fails is rolled back in full and loaded
+//	      again a record at a time, as in none, so the records that can
+//	      go in do and the bad one is quarantined. The checkpoint moves
+//	      on as each batch commits.
+func init() {
+	viper.SetDefault("load.transaction", "none")
+	viper.SetDefault("load.savepoints", true)
+	viper.SetDefault("load.batchsize", 500)
+	rootCmd.PersistentFlags().Int("batch-size", 500, "records per transaction when load.transaction is batch")
+	check(viper.BindPFlag("load.batchsize", rootCmd.PersistentFlags().Lookup("batch-size")))
+}
+
+// Enrollment statuses in the ero table. Records flagged by the risk rules
+// are loaded as pending and wait for a reviewer (see review.go).
+const (
+	enrollmentLoaded   = "loaded"
+	enrollmentPending  = "pending"
+	enrollmentRejected = "rejected"
+)
+
+// loadedRecord is what we report back for every enrollment we insert.
+type loadedRecord struct {
+	Index   int // position in the file, from 0
+	EFIN    string
+	ID      int64
+	Flagged string // why it is pending review, if it is
+
+	Confirmation string        // see confirmation.go; none while pending review
+	Warnings     []recordError // loaded anyway, but the ACK says so
+	Ruleset      string        // version of the rules that judged it (see rules.go)
+}
+
+// rejectedRecord is an enrollment we rolled back, and why.
+type rejectedRecord struct {
+	Index       int // position in the file, from 0
+	EFIN        string
+	Transmitter string
+	Errors      []recordError
+	Ruleset     string // version of the rules that judged it; none if it wasn't checked
+	Quarantined string // the file it was quarantined to, if it was (see quarantine.go)
+}
+
+func newReject(i int, e Enrollment, errs ...recordError) rejectedRecord {
+	return rejectedRecord{Index: i, EFIN: e.EFIN, Transmitter: e.TransmitterID, Errors: errs}
+}
+
+// Reason is the errors as one line of text.
+func (r rejectedRecord) Reason() string {
+	return joinErrors(r.Errors)
+}
+
+// loadSummary is the outcome of loading one file.
+type loadSummary struct {
+	ResumedAt int // first record processed, if we resumed from a checkpoint
+	Loaded    []loadedRecord
+	Rejected  []rejectedRecord
+
+	Repeated      []int                  // records loaded lately already, skipped (see recent.go)
+	Earlier       int                    // enrollments written before the load was interrupted (see ledger.go)
+	Deactivated   []deactivatedRecord    // see deactivate.go
+	Discrepancies []priorYearDiscrepancy // see prioryear.go
+	Canary        canarySummary          // see canary.go
+}
+
+func (s *loadSummary) merge(o loadSummary) {
+	s.Loaded = append(s.Loaded, o.Loaded...)
+	s.Rejected = append(s.Rejected, o.Rejected...)
+	s.Repeated = append(s.Repeated, o.Repeated...)
+	s.Earlier += o.Earlier
+	s.Deactivated = append(s.Deactivated, o.Deactivated...)
+	s.Discrepancies = append(s.Discrepancies, o.Discrepancies...)
+	s.Canary.Checked += o.Canary.Checked
+	s.Canary.Deltas = append(s.Canary.Deltas, o.Canary.Deltas...)
+}
+
+func (s loadSummary) print() {
+	if golden() {
+		s = s.sorted()
+	}
+	if s.ResumedAt > 0 {
+		fmt.Printf("Resumed from checkpoint at record %d\n", s.ResumedAt)
+	}
+	fmt.Printf("Loaded %d enrollment(s), rejected %d\n", len(s.Loaded), len(s.Rejected))
+	if q := s.quarantined(); q > 0 {
+		fmt.Printf("Quarantined %d record(s) to %s\n", q, viper.GetString("load.quarantine.dir"))
+	}
+	if s.Earlier > 0 {
+		fmt.Printf("Loaded %d enrollment(s) before the load was interrupted\n", s.Earlier)
+	}
+	if len(s.Repeated) > 0 {
+		fmt.Printf("Skipped %d record(s) loaded lately already\n", len(s.Repeated))
+	}
+	for _, d := range s.Deactivated {
+		fmt.Printf("  EFIN %s -> deactivated (%d record(s), %d office(s))\n", d.EFIN, len(d.IDs), len(d.Offices))
+	}
+	for _, r := range s.Loaded {
+		id := fmt.Sprintf("ID %d", r.ID)
+		if golden() {
+			id = "loaded" // IDs depend on what else is in the database
+		}
+		if r.Flagged != "" {
+			fmt.Printf("  EFIN %s -> %s (pending review: %s)\n", r.EFIN, id, r.Flagged)
+			continue
+		}
+		fmt.Printf("  EFIN %s -> %s\n", r.EFIN, id)
+	}
+	for _, r := range s.Rejected {
+		fmt.Printf("  REJECTED record %d (EFIN %s): %s\n", r.Index, r.EFIN, r.Reason())
+	}
+}
+
+// quarantined is how many of the rejected records were quarantined.
+func (s loadSummary) quarantined() int {
+	n := 0
+	for _, r := range s.Rejected {
+		if r.Quarantined != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// inputFile is an enrollment file we have read and parsed.
+type inputFile struct {
+	Path    string
+	SHA256  string    // hex digest of the raw file contents
+	Arrived time.Time // when the file was delivered
+	Records []Enrollment
+	Present []fieldSet // the fields each record had (see amend.go)
+}
+
+// present is the fields record i had; nil (all of them) if we don't know.
+func (f inputFile) present(i int) fieldSet {
+	if i < len(f.Present) {
+		return f.Present[i]
+	}
+	return nil
+}
+
+// Transmitter is the software vendor that sent the file. Vendors send
+// their own files, so the first record's TransmitterId speaks for all.
+func (f inputFile) Transmitter() string {
+	for _, e := range f.Records {
+		if e.TransmitterID != "" {
+			return e.TransmitterID
+		}
+	}
+	return ""
+}
+
+// loadFile loads a file as a batch, according to the configured
+// transaction mode. If the database fails over part way through we
+// reconnect and resume from the checkpoint (see failover.go).
+func loadFile(dbs *databases, job *batchJob) (loadSummary, error) {
+	started := time.Now()
+	defer timeStage(job.File.Path, stageLoad, started) // see profile.go
+	db := dbs.primary
+	mode := viper.GetString("load.transaction")
+	if mode != "none" && mode != "file" && mode != "batch" {
+		return loadSummary{}, fmt.Errorf("config: load.transaction must be none, file or batch (got %q)", mode)
+	}
+
+	// Make sure no other instance is loading this file.
+	if job.Claim == nil {
+		c, err := claimFile(db, job.File)
+		if err != nil {
+			return loadSummary{}, err
+		}
+		defer c.release()
+		job.Claim = c
+	}
+	crashPoint("claimed") // see crashpoints.go
+
+	// A checkpoint means we are picking up a batch we already started, so
+	// carry on with the same batch and the same reference data. Without
+	// one the registry of files may know the file (see ledger.go).
+	cp := openCheckpoint(job.File)
+	if cp.Batch == 0 && job.ReplayOf == 0 {
+		b, found, err := fileBatch(db, job.File)
+		if err != nil {
+			return loadSummary{}, err
+		}
+		switch {
+		case found && b.Status == batchLoaded && !job.AllowDuplicate:
+			return loadSummary{}, &alreadyLoadedError{Batch: b}
+		case found && (b.Status == batchRunning || b.Status == batchFailed):
+			job.logf("Picking up batch %d (%s), which was left %s\n", b.ID, job.File.Path, b.Status)
+			cp.Batch, cp.Versions, cp.Correlation = b.ID, b.Versions, b.Correlation
+		}
+	}
+	if cp.Correlation != "" {
+		job.Correlation = cp.Correlation
+	} else if job.Correlation == "" {
+		job.Correlation = fileCorrelation(job.File)
+	}
+	cp.Correlation = job.Correlation
+	if cp.Batch > 0 {
+		if !cp.Updated.IsZero() {
+			job.logf("Resuming batch %d (%s) at record %d (checkpoint from %s)\n", cp.Batch, job.File.Path, cp.Next, cp.Updated.Format(time.RFC3339))
+		}
+		job.ID = cp.Batch
+		job.Pinned = &cp.Versions
+		job.Resumed = true
+	}
+
+	var err error
+	versions := refVersions{}
+	if job.Pinned != nil {
+		versions = *job.Pinned
+	} else if versions, err = currentRefVersions(dbs.reader()); err != nil {
+		return loadSummary{}, err
+	}
+	if err := loadPolicies(viper.GetViper(), db, dbs.reader(), job, versions); err != nil {
+		return loadSummary{}, err
+	}
+	job.Canary = loadCanary(db, dbs.reader(), job, versions) // see canary.go
+
+	if job.ID == 0 {
+		hashes, err := checkDuplicate(db, job) // see duplicates.go
+		if err != nil {
+			return loadSummary{}, err
+		}
+		if job.ID, err = startBatch(db, job); err != nil {
+			return loadSummary{}, fmt.Errorf("starting batch: %v", err)
+		}
+		if err := storeFingerprint(db, job.ID, hashes); err != nil {
+			job.logf("recording batch %d fingerprint: %v", job.ID, err)
+		}
+		crashPoint("started")
+	}
+	cp.Batch = job.ID
+	cp.Versions = versions
+	job.logf("Batch %d: %s (%s)\n", job.ID, job.File.Path, versions)
+
+	summary, err := loadBatch(db, job, &cp, mode)
+	if errors.Is(err, errClaimed) {
+		// The batch is the other instance's now; leave it to finish.
+		job.logf("Batch %d: %v\n", job.ID, err)
+		return summary, err
+	}
+	recent.remember(job, summary) // see recent.go
+	if len(summary.Repeated) > 0 {
+		metricCount("load.repeats", len(summary.Repeated))
+	}
+	if q := summary.quarantined(); q > 0 {
+		job.logf("Batch %d: quarantined %d record(s) to %s\n", job.ID, q, viper.GetString("load.quarantine.dir"))
+	}
+
+	status := batchLoaded
+	if err != nil {
+		status = batchFailed
+	}
+	if finErr := finishBatch(db, job.ID, status, summary); finErr != nil {
+		job.logf("recording batch %d outcome: %v", job.ID, finErr)
+	}
+	crashPoint("finished")
+	if statErr := recordErrorStats(db, summary); statErr != nil {
+		job.logf("recording error statistics for batch %d: %v", job.ID, statErr)
+	}
+	if dErr := recordDiscrepancies(db, job, summary); dErr != nil {
+		job.logf("recording prior-year discrepancies for batch %d: %v", job.ID, dErr)
+	}
+	if cErr := recordCanary(db, job, summary); cErr != nil {
+		job.logf("recording canary results for batch %d: %v", job.ID, cErr)
+	}
+	if mErr := recordLoadMetrics(db, job, status, summary, started, time.Now()); mErr != nil {
+		job.logf("recording load metrics for batch %d: %v", job.ID, mErr)
+	}
+	if ack, ackErr := writeAck(job, status, summary); ackErr != nil {
+		job.logf("writing acknowledgement for batch %d: %v", job.ID, ackErr)
+	} else if ack != "" {
+		job.logf("Acknowledgement: %s\n", ack)
+		deliverReturnFiles(db, job, returnFiles(ack))
+	}
+	notifyWebhooks(job, status, summary)
+	sendNotifications(job, status, summary)
+	fileIncidents(job, status, summary)
+	fileComplete(job, status, summary)
+	fileMetrics(job, status, summary, time.Since(started))
+	if err == nil {
+		shadowBatch(dbs, job, summary) // see shadow.go
+	}
+	crashPoint("loaded")
+	return summary, err
+}
+
+// loadPolicies reads the reference data and rules a batch is checked
+// against: the rules from cfg, every version of them, table settings from db and reference lists
+// from reader.
+func loadPolicies(cfg *viper.Viper, db, reader *sql.DB, job *batchJob, versions refVersions) error {
+	var err error
+	if job.Collate, err = loadCollations(db); err != nil {
+		return err
+	}
+	if job.Ref, err = loadRefData(reader, versions, job.Collate); err != nil {
+		return err
+	}
+	if job.Zips, err = currentZipData(); err != nil {
+		return err
+	}
+	if job.policies, err = loadRules(cfg, db, job.Collate); err != nil {
+		return err
+	}
+	if job.Enrichers, err = configuredEnrichers(); err != nil {
+		return err
+	}
+	job.Rulesets, err = loadRulesets(cfg, db, job.Collate) // see rules.go
+	return err
+}
+
+// loadBatch runs the records through the database, reconnecting after a
+// failover until the batch is done or it fails for some other reason.
+func loadBatch(db *sql.DB, job *batchJob, cp *checkpoint, mode string) (loadSummary, error) {
+	summary := loadSummary{ResumedAt: cp.Next}
+	for {
+		var part loadSummary
+		var err error
+		next := cp.Next
+
+		switch mode {
+		case "none":
+			// Records commit one at a time, so whatever we managed
+			// is in the database and the checkpoint moves forward.
+			part, next, err = loadRecords(db, job, cp.Next, len(job.File.Records), nil, cp)
+			summary.merge(part)
+		case "batch":
+			// As far as the last batch that committed.
+			part, next, err = loadBatches(db, job, cp)
+			summary.merge(part)
+		default:
+			// A failed file transaction is rolled back in full, so
+			// the checkpoint stays where it was.
+			part, err = loadFileTx(db, job, cp.Next)
+			if err == nil {
+				summary.merge(part)
+			}
+		}
+
+		if err == nil {
+			if rmErr := cp.remove(); rmErr != nil {
+				job.logf("removing checkpoint: %v", rmErr)
+			}
+			return summary, nil
+		}
+
+		cp.Next = next
+		if mode != "file" {
+			if saveErr := cp.save(); saveErr != nil {
+				job.logf("saving checkpoint: %v", saveErr)
+			}
+		}
+
+		if !isFailoverError(err) {
+			return summary, err
+		}
+
+		job.logf("Lost the database (%v); reconnecting to resume %s at record %d\n", err, job.File.Path, cp.Next)
+		if err := reconnect(db); err != nil {
+			return summary, err
+		}
+	}
+}
+
+// loadBatches loads the file "load.batchsize" records to a transaction,
+// from the checkpoint on, saving the checkpoint as each batch commits. A
+// batch that fails is rolled back and its records loaded again one at a
+// time, each committing on its own. next is the first record not loaded.
+func loadBatches(db *sql.DB, job *batchJob, cp *checkpoint) (summary loadSummary, next int, err error) {
+	size := viper.GetInt("load.batchsize")
+	if size < 1 {
+		size = 1
+	}
+	n := len(job.File.Records)
+	for next = cp.Next; next < n; {
+		end := next + size
+		if end > n {
+			end = n
+		}
+
+		part, err := loadTx(db, job, next, end)
+		if err != nil {
+			if isFailoverError(err) || errors.Is(err, errClaimed) {
+				return summary, next, err
+			}
+			job.logf("Records %d to %d rolled back (%v); loading them one at a time\n", next, end-1, err)
+			var done int
+			part, done, err = loadRecords(db, job, next, end, nil, nil)
+			summary.merge(part)
+			if err != nil {
+				return summary, done, err
+			}
+		} else {
+			summary.merge(part)
+		}
+
+		next = end
+		cp.Next = next
+		if err := cp.save(); err != nil {
+			job.logf("saving checkpoint: %v", err)
+		}
+		crashPoint("checkpointed")
+	}
+	return summary, next, nil
+}
+
+// loadFileTx loads a file inside a single transaction.
+func loadFileTx(db *sql.DB, job *batchJob, start int) (loadSummary, error) {
+	summary, err := loadTx(db, job, start, len(job.File.Records))
+	if err != nil {
+		return loadSummary{}, fmt.Errorf("file rolled back: %w", err)
+	}
+	return summary, nil
+}
+
+// loadTx loads records start up to end inside a single transaction.
+func loadTx(db *sql.DB, job *batchJob, start, end int) (loadSummary, error) {
+	level, err := isolationLevel(db)
+	if err != nil {
+		return loadSummary{}, err
+	}
+
+	tx, err := db.BeginTx(job.Claim.context(), &sql.TxOptions{Isolation: level})
+	if err != nil {
+		return loadSummary{}, err
+	}
+
+	var sp *savepoints
+	if viper.GetBool("load.savepoints") {
+		sp = &savepoints{tx: tx}
+	}
+
+	summary, _, err := loadRecords(tx, job, start, end, sp, nil)
+	if err == nil {
+		err = job.Claim.lost()
+	}
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil && rbErr != sql.ErrTxDone {
+			job.logf("rollback failed: %v", rbErr)
+		}
+		return loadSummary{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		if lost := job.Claim.lost(); lost != nil {
+			return loadSummary{}, lost
+		}
+		return loadSummary{}, err
+	}
+	return summary, nil
+}
+
+// savepoints wraps the SAVE TRANSACTION / ROLLBACK TRANSACTION pair we use
+// to undo a single record without losing the rest of the file.
+type savepoints struct {
+	tx *sql.Tx
+}
+
+func (s *savepoints) save(name string) error {
+	_, err := s.tx.Exec("SAVE TRANSACTION " + name)
+	return err
+}
+
+// rollback undoes everything since the named savepoint. If SQL Server has
+// already doomed the transaction (XACT_STATE() = -1) this fails, and the
+// caller has no choice but to roll back the whole file or batch.
+func (s *savepoints) rollback(name string) error {
+	_, err := s.tx.Exec("ROLLBACK TRANSACTION " + name)
+	return err
+}
+
+// loadRecords runs the records, from index start up to end, through the
+// record stages (see pipeline.go) and writes them one at a time, in file
+// order.
+// With savepoints a failed record is rolled back to its savepoint,
+// rejected, and we carry on; without a transaction it is quarantined
+// (see quarantine.go). Otherwise the first error is returned.
+//
+// next is the index of the first record not dealt with. When each insert
+// commits on its own (no transaction), pass a checkpoint and it is saved
+// every "load.checkpointevery" records.
+func loadRecords(p preparer, job *batchJob, start, end int, sp *savepoints, cp *checkpoint) (summary loadSummary, next int, err error) {
+	every := viper.GetInt("load.checkpointevery")
+	next = start
+
+	// A batch picked up again skips what it wrote before (see ledger.go).
+	var written map[int]string
+	if job.Resumed {
+		if written, err = writtenRecords(p, job, start, end); err != nil {
+			return summary, next, err
+		}
+	}
+
+	stages := []stage{
+		{Name: stageNormalize, Run: func(it *recordItem) {
+			if outcome, ok := written[it.Index]; ok {
+				it.Skip, it.Written = true, outcome
+				return
+			}
+			// De-enrollments aren't checked like enrollments (see
+			// deactivate.go); write deals with them.
+			if recordAction(it.Record) != actionEnroll {
+				it.Skip = true
+				return
+			}
+			if recent.seen(recentKeyOf(job.File, it.Index)) { // see recent.go
+				it.Skip, it.Repeat = true, true
+				return
+			}
+			it.Err = job.normalizeRecord(p, it.Index, &it.Record, &it.Check)
+		}},
+		{Name: stageValidate, Run: func(it *recordItem) {
+			it.Err = job.validateRecord(p, it.Index, &it.Record, &it.Check)
+		}},
+		{Name: stageEnrich, Run: func(it *recordItem) {
+			job.enrichRecord(it.Index, &it.Record, &it.Check)
+			if job.Canary != nil {
+				it.Canary, it.CanaryOK = job.Canary.try(p, it.Index, it.Check) // see canary.go
+			}
+		}},
+	}
+
+	// quarantine rejects record i, which failed with err, and
+	// quarantines it (see quarantine.go).
+	quarantine := func(i int, e Enrollment, rules *policies, err error) {
+		job.logRecordf(i, "Record %d rejected: %v\n\n", i, err)
+		r := newReject(i, e, dbError(err))
+		if rules != nil {
+			r.Ruleset = rules.Version
+		}
+		quarantineRecord(job, &r, err)
+		summary.Rejected = append(summary.Rejected, r)
+		validationFailed(job, r)
+		next = i + 1
+	}
+
+	// Lets view some of the data
+	write := func(it *recordItem) error {
+		i, Enrollment, c := it.Index, it.Record, it.Check
+		if err := job.Claim.lost(); err != nil {
+			return err
+		}
+		if it.Err != nil {
+			if !quarantines(p, it.Err) {
+				return it.Err
+			}
+			quarantine(i, Enrollment, c.Rules, it.Err)
+			return nil
+		}
+
+		if it.Written != "" {
+			job.logRecordf(i, "Record %d already written (%s) before the load was interrupted\n\n", i, it.Written)
+			if it.Written != ledgerDeactivated {
+				summary.Earlier++
+			}
+			next = i + 1
+			return nil
+		}
+		if it.Repeat {
+			job.logRecordf(i, "Record %d skipped: EFIN %s loaded the same record lately\n\n", i, Enrollment.EFIN)
+			summary.Repeated = append(summary.Repeated, i)
+			next = i + 1
+			return nil
+		}
+		if it.Skip {
+			w, end, err := beginRecord(job.Claim.context(), p)
+			if err != nil {
+				return err
+			}
+			d, problems, err := loadDeactivation(w, job, i, Enrollment, sp)
+			if err == nil && len(problems) == 0 {
+				err = recordWritten(w, job, i, 0, ledgerDeactivated) // see ledger.go
+			}
+			if err == nil {
+				err = job.Claim.lost()
+			}
+			if err == nil {
+				crashPoint("written")
+			}
+			if err = end(err); err != nil {
+				if !quarantines(p, err) {
+					return err
+				}
+				quarantine(i, Enrollment, nil, err)
+				return nil
+			}
+			if len(problems) > 0 {
+				job.logRecordf(i, "Record %d rejected: %s\n\n", i, joinErrors(problems))
+				r := newReject(i, Enrollment, problems...)
+				summary.Rejected = append(summary.Rejected, r)
+				validationFailed(job, r)
+			} else {
+				job.logRecordf(i, "Record %d deactivated EFIN %s (%d record(s), offices %v)\n\n", i, d.EFIN, len(d.IDs), d.Offices)
+				summary.Deactivated = append(summary.Deactivated, d)
+				recordDeactivated(job, d)
+			}
+			next = i + 1
+			return nil
+		}
+
+		// The stages have checked it. Nothing has been written yet, so a
+		// failure there is a plain reject in any mode.
+		summary.Discrepancies = append(summary.Discrepancies, c.Discrepancies...)
+		if job.Canary != nil {
+			summary.Canary.add(it.Canary, it.CanaryOK)
+		}
+
+		problems, warnings := c.Problems, c.Warnings
+		if len(problems) > 0 {
+			job.logRecordf(i, "Record %d rejected: %s\n\n", i, joinErrors(problems))
+			r := newReject(i, Enrollment, problems...)
+			r.Ruleset = c.Rules.Version
+			summary.Rejected = append(summary.Rejected, r)
+			validationFailed(job, r)
+			next = i + 1
+			return nil
+		}
+
+		// SQL Server savepoint names are limited to 32 characters.
+		name := fmt.Sprintf("rec%d", i)
+		if sp != nil {
+			if err := sp.save(name); err != nil {
+				return err
+			}
+		}
+
+		// Flagged records go in as pending review.
+		status, flagged := enrollmentLoaded, ""
+		if len(c.Review) > 0 {
+			status, flagged = enrollmentPending, strings.Join(c.Review, "; ")
+		}
+
+		// Without a transaction, the record's writes go in one of their
+		// own (see quarantine.go).
+		w, end, err := beginRecord(job.Claim.context(), p)
+		if err != nil {
+			return err
+		}
+
+		// Accepted records get a confirmation number.
+		var confirmation string
+		if status == enrollmentLoaded {
+			confirmation, err = newConfirmation(w)
+		}
+
+		// Let's insert into SQL Server
+		var id int64
+		if err == nil {
+			id, err = insertEnrollment(w, c.Rules.Empty, c.Amended, Enrollment, c.Received, job.ID, status, flagged, job.recordCorrelation(i), confirmation)
+		}
+		if err == nil {
+			_, err = execStatement(w, "ero.ruleset", c.Rules.Version, id)
+		}
+		if err == nil {
+			err = c.Prior.store(w, id)
+		}
+		if err == nil && status == enrollmentLoaded {
+			err = queueForBank(w, id) // see bankapi.go
+			if err == nil {
+				err = job.price(w, c.Rules.Pricing, i, id, c.Prior, Enrollment) // see pricing.go
+			}
+		}
+		if err == nil {
+			err = queueWelcome(w, id, Enrollment, status == enrollmentPending, confirmation, job.recordCorrelation(i)) // see events.go
+		}
+		if err == nil {
+			err = queueVerification(w, id, Enrollment, status == enrollmentPending) // see verify.go
+		}
+		if err == nil {
+			err = storeSubjects(w, id, Enrollment) // see subject.go
+		}
+		if err == nil {
+			err = storeSensitive(w, id, Enrollment) // see alwaysencrypted.go
+		}
+		if err == nil {
+			err = storeEnrichment(w, id, c.Enriched) // see enrich.go
+		}
+		if err == nil {
+			err = storeParts(w, id, Enrollment) // see parts.go
+		}
+		if err == nil {
+			outcome := ledgerLoaded
+			if status == enrollmentPending {
+				outcome = ledgerPending
+			}
+			err = recordWritten(w, job, i, id, outcome) // see ledger.go
+		}
+		if err == nil {
+			err = job.Claim.lost() // see claim.go
+		}
+		if err == nil {
+			crashPoint("written") // see crashpoints.go
+		}
+		err = end(err)
+		if lost := job.Claim.lost(); lost != nil {
+			return lost
+		}
+		if errors.Is(err, errConflict) {
+			// Nothing was written, so this is a plain reject in any mode.
+			job.logRecordf(i, "Record %d rejected: %v\n\n", i, err)
+			r := newReject(i, Enrollment, recordError{Code: errAmendConflict, Message: err.Error()})
+			r.Ruleset = c.Rules.Version
+			summary.Rejected = append(summary.Rejected, r)
+			validationFailed(job, r)
+			next = i + 1
+			return nil
+		}
+		if err != nil {
+			if sp == nil {
+				if !quarantines(p, err) {
+					return err
+				}
+				quarantine(i, Enrollment, c.Rules, err)
+				return nil
+			}
+			if rbErr := sp.rollback(name); rbErr != nil {
+				return fmt.Errorf("record %d: %w (and rollback to savepoint failed: %v)", i, err, rbErr)
+			}
+			job.logRecordf(i, "Record %d rolled back: %v\n\n", i, err)
+			r := newReject(i, Enrollment, dbError(err))
+			r.Ruleset = c.Rules.Version
+			quarantineRecord(job, &r, err)
+			summary.Rejected = append(summary.Rejected, r)
+			validationFailed(job, r)
+			next = i + 1
+			return nil
+		}
+
+		crashPoint("committed")
+		job.logRecordf(i, "Insert Successful, ID = %d\n\n", id)
+		loaded := loadedRecord{Index: i, EFIN: Enrollment.EFIN, ID: id, Flagged: flagged, Confirmation: confirmation, Warnings: warnings, Ruleset: c.Rules.Version}
+		summary.Loaded = append(summary.Loaded, loaded)
+		recordLoaded(job, loaded)
+		next = i + 1
+
+		if cp != nil && every > 0 && (next-start)%every == 0 {
+			cp.Next = next
+			if err := cp.save(); err != nil {
+				job.logf("saving checkpoint: %v", err)
+			}
+			crashPoint("checkpointed")
+		}
+		return nil
+	}
+
+	err = runPipeline(job, p, start, end, stages, write)
+	return summary, next, err
+}
+
+// recordCheck is what checking one enrollment found.
+type recordCheck struct {
+	Rules         *policies // the version of the rules that judged it
+	Amended       *amendment
+	Received      time.Time // its TransactionDate
+	Prior         *priorYearInfo
+	Discrepancies []priorYearDiscrepancy
+	Problems      []recordError     // any of these rejects it
+	Warnings      []recordError     // loaded anyway, but the ACK says so
+	Review        []string          // why it would go to review
+	Enriched      map[string]string // extra columns, by name (see enrich.go)
+}
+
+// checkRecord checks enrollment i, which it may change on the way, by
+// running it through the normalize, validate and enrich stages in turn.
+// It only reads from the database.
+func (job *batchJob) checkRecord(p preparer, i int, e *Enrollment) (recordCheck, error) {
+	var c recordCheck
+	if err := job.normalizeRecord(p, i, e, &c); err != nil {
+		return c, err
+	}
+	if err := job.validateRecord(p, i, e, &c); err != nil {
+		return c, err
+	}
+	job.enrichRecord(i, e, &c)
+	return c, nil
+}
+
+// normalizeRecord finds what enrollment i amends (a partial amendment
+// keeps what it leaves out, see amend.go), picks the version of the
+// rules that judges it (rules.go), fills in defaults and lets the
+// conflict policies decide where it disagrees with what we have
+// (conflict.go).
+func (job *batchJob) normalizeRecord(p preparer, i int, e *Enrollment, c *recordCheck) error {
+	var err error
+	if c.Amended, err = amend(p, e, job.File.present(i)); err != nil {
+		return err
+	}
+	if len(c.Amended.Kept) > 0 && !job.Trial {
+		job.logRecordf(i, "Record %d amends ID %d, keeping %d field(s) it leaves out\n", i, c.Amended.Base.ID, len(c.Amended.Kept))
+	}
+	rules := job.rulesFor(*e)
+	c.Rules = rules
+	applyDefaults(rules.Defaults, e)
+
+	// A date that doesn't parse leaves Received zero, and validateRecord
+	// rejects the record.
+	c.Received, _ = enrollment.ParseTransactionDate(e.TransactionDate)
+
+	c.Review = resolveConflicts(job, rules.Conflict, i, c.Amended, e, c.Received)
+	return nil
+}
+
+// validateRecord checks enrollment i's prior-year claims (prioryear.go),
+// the empty and length rules, the valid tags (validate.go), the ZIP data,
+// any hooks and the batch's reference data.
+func (job *batchJob) validateRecord(p preparer, i int, e *Enrollment, c *recordCheck) error {
+	rules := c.Rules
+	var err error
+	if c.Prior, err = rules.Prior.lookup(p, e.EFIN, recordYear(*e)); err != nil {
+		return err
+	}
+	c.Discrepancies = rules.Prior.verify(c.Prior, i, *e, job.File.present(i))
+
+	problems := rules.Empty.apply(e, c.Amended.present())
+	tooLong, truncated := rules.Lengths.apply(e, c.Amended.present()) // see lengths.go
+	problems, c.Warnings = append(problems, tooLong...), truncated
+	if rules.Fields != validationOff {
+		invalid, err := validateFields(*e)
+		if err != nil {
+			return err
+		}
+		if rules.Fields == validationReject {
+			problems = append(problems, invalid...)
+		} else {
+			c.Warnings = append(c.Warnings, invalid...)
+		}
+	}
+	// Without its date a record has no SLA deadline, can't be ordered
+	// against what we have and may be judged by the wrong rules, so a bad
+	// one rejects it whatever validation.policy says.
+	if c.Received.IsZero() && !hasProblem(problems, "TransactionDate") {
+		problems = append(problems, transactionDateProblem(e.TransactionDate))
+	}
+	for _, d := range c.Discrepancies {
+		switch {
+		case rules.Prior.rejects():
+			problems = append(problems, d.recordError())
+		case rules.Prior.flags():
+			c.Review = append(c.Review, fmt.Sprintf("%s (%s)", errPriorYearMismatch, d.Field))
+			fallthrough
+		default:
+			c.Warnings = append(c.Warnings, d.recordError())
+		}
+	}
+	c.Warnings = append(c.Warnings, job.Zips.check(*e)...) // see zipdata.go
+	problems = append(problems, recordParsed(job, i, e)...)
+	if len(problems) == 0 {
+		problems = job.Ref.check(*e)
+	}
+	c.Problems = problems
+	return nil
+}
+
+// enrichRecord works out what follows from enrollment i if it passed its
+// checks. Anything the risk rules flag, that conflicts with what we have
+// under a "review" policy or whose prior-year claims don't check out
+// goes in as pending review. Unless this is a trial, the enrichers add
+// their columns.
+func (job *batchJob) enrichRecord(i int, e *Enrollment, c *recordCheck) {
+	if len(c.Problems) > 0 {
+		c.Review = nil
+		return
+	}
+	c.Review = append(c.Review, riskFlags(c.Rules.Risk, *e)...)
+	if !job.Trial {
+		c.Enriched = enrich(job, i, *e)
+	}
+}
+
+// insertEnrollment writes one enrollment to the ero table and returns the
+// ID SQL Server generated for it (see enrollment.Store). The columns the
+// empty policy stores as NULL, or the amendment keeps from the record it
+// amends, are written that way.
+func insertEnrollment(p preparer, empty *emptyPolicy, amended *amendment, e Enrollment, received time.Time, batch int64, status, flagged, correlation, confirmation string) (int64, error) {
+	row := enrollment.Row{TaxYear: recordYear(e), Received: received, Batch: batch, Status: status, FlagReason: flagged,
+		Correlation: correlation, Confirmation: confirmation, Columns: map[string]interface{}{"EFIN": empty.column(e, "EFIN")}}
+	for _, field := range []string{"OfficeInfo.OfficeName", "OfficeInfo.State", "PriorYearInfo.Bank", "MasterEfin"} {
+		row.Columns[field] = amended.column(empty, e, field)
+	}
+	row.BaseID, row.BaseVersion = amended.base()
+	return enrollment.Store(p, e, row, viper.GetBool("mssql.storedprocedures"))
+}
+
+// nullString maps "" to NULL.
+func nullString(s string) interface{} {
+	if s = strings.TrimSpace(s); s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,308 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// "enroll loadtest" sizes hardware before the January peak. It makes up
+// enrollment files of --batch synthetic records and loads them, --workers
+// at a time, through the whole pipeline (loadFile: checks, inserts,
+// ACKs, webhooks, metrics) at --rps records a second for --duration:
+//
+//	enroll loadtest --rps 500 --duration 10m
+//
+// Point it at staging, never production: the records are real rows
+// there, under transmitter --transmitter. With --no-store records are
+// only checked (checkRecord, which reads but never writes), to measure
+// everything but the inserts. EFINs come from --efins, a file of one per
+// line (e.g. staging's approved list), or are made up - and then
+// rejected, unless the EFIN list is empty. Owner SSNs are in the 9xx
+// range, which the SSA never issues.
+//
+// It reports each record's latency - from starting the record to
+// starting the next, so the wait for --rps isn't counted - and each
+// file's, as percentiles.
+
+var (
+	loadtestRPS         int
+	loadtestDuration    time.Duration
+	loadtestBatch       int
+	loadtestWorkers     int
+	loadtestNoStore     bool
+	loadtestTransmitter string
+	loadtestEFINs       string
+)
+
+var loadtestCmd = &cobra.Command{
+	Use:   "loadtest",
+	Short: "Drive synthetic records through the pipeline and report latency",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if loadtestRPS <= 0 || loadtestBatch <= 0 || loadtestWorkers <= 0 {
+			check(fmt.Errorf("--rps, --batch and --workers must be more than 0"))
+		}
+		var efins []string
+		if loadtestEFINs != "" {
+			var err error
+			efins, err = readLines(loadtestEFINs)
+			check(err)
+		}
+
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		r := runLoadTest(dbs, efins)
+		r.print()
+	},
+}
+
+func init() {
+	loadtestCmd.Flags().IntVar(&loadtestRPS, "rps", 100, "records a second")
+	loadtestCmd.Flags().DurationVar(&loadtestDuration, "duration", time.Minute, "how long to run")
+	loadtestCmd.Flags().IntVar(&loadtestBatch, "batch", 250, "records a file")
+	loadtestCmd.Flags().IntVar(&loadtestWorkers, "workers", 4, "files loading at once")
+	loadtestCmd.Flags().BoolVar(&loadtestNoStore, "no-store", false, "check records but write nothing")
+	loadtestCmd.Flags().StringVar(&loadtestTransmitter, "transmitter", "99999", "transmitter the files come from")
+	loadtestCmd.Flags().StringVar(&loadtestEFINs, "efins", "", "file of EFINs to use, one a line")
+	rootCmd.AddCommand(loadtestCmd)
+}
+
+// latencies collects durations for percentiles. It is safe for
+// concurrent use.
+type latencies struct {
+	mu sync.Mutex
+	d  []time.Duration
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mu.Lock()
+	l.d = append(l.d, d)
+	l.mu.Unlock()
+}
+
+// percentiles returns the given percentiles (0-100), in order.
+func (l *latencies) percentiles(ps ...float64) []time.Duration {
+	l.mu.Lock()
+	sorted := append([]time.Duration(nil), l.d...)
+	l.mu.Unlock()
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	out := make([]time.Duration, len(ps))
+	if len(sorted) == 0 {
+		return out
+	}
+	for i, p := range ps {
+		n := int(p / 100 * float64(len(sorted)-1))
+		out[i] = sorted[n]
+	}
+	return out
+}
+
+// loadTestResult is what a load test did.
+type loadTestResult struct {
+	Took     time.Duration
+	Files    int
+	Loaded   int
+	Rejected int
+	Failed   int // files that failed outright
+	Records  latencies
+	PerFile  latencies
+
+	mu sync.Mutex
+}
+
+func (r *loadTestResult) file(s loadSummary, err error, took time.Duration) {
+	r.PerFile.add(took)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Files++
+	r.Loaded += len(s.Loaded)
+	r.Rejected += len(s.Rejected)
+	if err != nil {
+		r.Failed++
+	}
+}
+
+func (r *loadTestResult) print() {
+	records := r.Loaded + r.Rejected
+	fmt.Printf("%d files, %d records (%d loaded, %d rejected) in %s: %.1f records/s\n",
+		r.Files, records, r.Loaded, r.Rejected, r.Took.Round(time.Second), float64(records)/r.Took.Seconds())
+	if r.Failed > 0 {
+		fmt.Printf("%d files failed\n", r.Failed)
+	}
+	ps := []float64{50, 90, 95, 99, 100}
+	for _, l := range []struct {
+		name string
+		l    *latencies
+	}{{"record", &r.Records}, {"file", &r.PerFile}} {
+		d := l.l.percentiles(ps...)
+		fmt.Printf("%-6s  p50 %s  p90 %s  p95 %s  p99 %s  max %s\n", l.name, d[0], d[1], d[2], d[3], d[4])
+	}
+}
+
+// runLoadTest runs the workers until loadtestDuration is up.
+func runLoadTest(dbs *databases, efins []string) *loadTestResult {
+	r := &loadTestResult{}
+	limits := newRateLimiter()
+	perMinute := float64(loadtestRPS * 60)
+	pace := func() {
+		for {
+			ok, wait := limits.take("loadtest", perMinute, float64(loadtestRPS))
+			if ok {
+				return
+			}
+			time.Sleep(wait)
+		}
+	}
+
+	started := time.Now()
+	deadline := started.Add(loadtestDuration)
+	var wg sync.WaitGroup
+	for w := 0; w < loadtestWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := 0; time.Now().Before(deadline); n++ {
+				job := &batchJob{File: syntheticFile(fmt.Sprintf("loadtest-%d-%d.xml", w, n), efins)}
+				var last time.Time
+				job.Pace = func() {
+					if !last.IsZero() {
+						r.Records.add(time.Since(last))
+					}
+					pace()
+					last = time.Now()
+				}
+				fileStarted := time.Now()
+				s, err := loadTestFile(dbs, job)
+				if err != nil {
+					job.logf("load test file %s: %v", job.File.Path, err)
+				}
+				r.file(s, err, time.Since(fileStarted))
+			}
+		}(w)
+	}
+	wg.Wait()
+	r.Took = time.Since(started)
+	return r
+}
+
+// loadTestFile loads job, or with --no-store only checks its records.
+func loadTestFile(dbs *databases, job *batchJob) (loadSummary, error) {
+	if !loadtestNoStore {
+		return loadFile(dbs, job)
+	}
+
+	var s loadSummary
+	versions, err := currentRefVersions(dbs.reader())
+	if err != nil {
+		return s, err
+	}
+	job.Trial = true
+	job.Correlation = fileCorrelation(job.File)
+	if err := loadPolicies(viper.GetViper(), dbs.primary, dbs.reader(), job, versions); err != nil {
+		return s, err
+	}
+	for i := range job.File.Records {
+		job.Pace()
+		e := job.File.Records[i]
+		c, err := job.checkRecord(dbs.reader(), i, &e)
+		if err != nil {
+			return s, err
+		}
+		if len(c.Problems) > 0 {
+			s.Rejected = append(s.Rejected, newReject(i, e, c.Problems...))
+			continue
+		}
+		s.Loaded = append(s.Loaded, loadedRecord{Index: i, EFIN: e.EFIN})
+	}
+	return s, nil
+}
+
+// syntheticFile makes up a file of loadtestBatch records.
+func syntheticFile(name string, efins []string) inputFile {
+	f := inputFile{Path: name, SHA256: randomHex(32), Arrived: time.Now()}
+	for i := 0; i < loadtestBatch; i++ {
+		efin := fmt.Sprintf("%06d", randomInt(1000000))
+		if len(efins) > 0 {
+			efin = efins[randomInt(len(efins))]
+		}
+		owner := OwnerInformation{
+			FirstName: "Load", LastName: "Test" + randomHex(3), PhoneNumber: "8585550100",
+			Email: "loadtest@example.com", Address1: "1 Main St", City: "San Diego", State: "CA", Zip: "92101",
+			SSN: fmt.Sprintf("9%08d", randomInt(100000000)), DateOfBirth: "1970-01-01",
+		}
+		f.Records = append(f.Records, Enrollment{
+			MasterEfin:     efin,
+			EFIN:           efin,
+			TransmitterID:  loadtestTransmitter,
+			ProcessingYear: "2016",
+			OfficeInfo: OfficeInfo{
+				OfficeName: "Load Test " + efin, PrimaryContactFirst: "Load", PrimaryContactLast: "Test",
+				PhoneNumber: "8585550100", Email: "loadtest@example.com", Address1: "1 Main St",
+				City: "San Diego", State: "CA", Zip: "92101",
+			},
+			OwnerInformation: owner,
+			EFINOwnerInfo:    EFINOwnerInfo(owner),
+			TransactionDate:  time.Now().UTC().Format("2006-01-02T15:04:05"),
+		})
+	}
+	return f
+}
+
+func randomInt(n int) int {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	check(err)
+	return int(i.Int64())
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	check(err)
+	return hex.EncodeToString(b)
+}
+
+// readLines reads the non-blank lines of a file.
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, s.Err()
+}
@@ -0,0 +1,199 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// log.target "file" writes the log to log.file.path and rotates it when it
+// reaches log.file.maxsize megabytes or, with log.file.rotate set to
+// "daily" or "hourly", when the day or hour turns over. Rotated logs are
+// renamed enroll-<time>.log and gzipped (log.file.compress); we keep the
+// newest log.file.keep of them, none older than log.file.maxagedays.
+func init() {
+	viper.SetDefault("log.file.path", "./logs/enroll.log")
+	viper.SetDefault("log.file.maxsize", 100)
+	viper.SetDefault("log.file.rotate", "daily")
+	viper.SetDefault("log.file.compress", true)
+	viper.SetDefault("log.file.keep", 30)
+	viper.SetDefault("log.file.maxagedays", 90)
+}
+
+// rotatingFile is an io.Writer over the current log file.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	period   string // "", "daily" or "hourly"
+	compress bool
+	keep     int
+	maxAge   time.Duration
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func newRotatingFile() (*rotatingFile, error) {
+	period := viper.GetString("log.file.rotate")
+	if period != "" && period != "daily" && period != "hourly" {
+		return nil, fmt.Errorf("config: log.file.rotate must be daily, hourly or empty (got %q)", period)
+	}
+	r := &rotatingFile{
+		path:     viper.GetString("log.file.path"),
+		maxSize:  viper.GetInt64("log.file.maxsize") << 20,
+		period:   period,
+		compress: viper.GetBool("log.file.compress"),
+		keep:     viper.GetInt("log.file.keep"),
+		maxAge:   time.Duration(viper.GetInt("log.file.maxagedays")) * 24 * time.Hour,
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0750); err != nil {
+		return nil, err
+	}
+	return r, r.open()
+}
+
+// open opens (or carries on with) the current log file.
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file, r.size, r.opened = f, info.Size(), info.ModTime()
+	if r.size == 0 {
+		r.opened = time.Now()
+	}
+	return nil
+}
+
+// due reports whether the file must be rotated before writing n bytes.
+func (r *rotatingFile) due(n int, now time.Time) bool {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(n) > r.maxSize {
+		return true
+	}
+	switch r.period {
+	case "daily":
+		return now.Format("2006-01-02") != r.opened.Format("2006-01-02")
+	case "hourly":
+		return now.Format("2006-01-02T15") != r.opened.Format("2006-01-02T15")
+	}
+	return false
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.due(len(p), time.Now()) {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "rotating %s: %v\n", r.path, err)
+		}
+	}
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return os.Stderr.Write(p)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and starts a new one. Compressing
+// and pruning happen in the background so logging isn't held up.
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+	r.file = nil
+
+	ext := filepath.Ext(r.path)
+	stem := strings.TrimSuffix(r.path, ext)
+	rotated := fmt.Sprintf("%s-%s%s", stem, time.Now().Format("20060102T150405.000"), ext)
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+	go r.tidy(rotated)
+	return r.open()
+}
+
+// tidy compresses a rotated log and removes old ones.
+func (r *rotatingFile) tidy(rotated string) {
+	if r.compress {
+		if err := gzipFile(rotated); err != nil {
+			fmt.Fprintf(os.Stderr, "compressing %s: %v\n", rotated, err)
+		}
+	}
+
+	ext := filepath.Ext(r.path)
+	stem := strings.TrimSuffix(r.path, ext)
+	old, _ := filepath.Glob(stem + "-*" + ext + "*")
+	sort.Sort(sort.Reverse(sort.StringSlice(old))) // newest first; names sort by time
+	for i, name := range old {
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		if (r.keep > 0 && i >= r.keep) || (r.maxAge > 0 && time.Since(info.ModTime()) > r.maxAge) {
+			os.Remove(name)
+		}
+	}
+}
+
+// gzipFile replaces name with name.gz.
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	gz.Name = filepath.Base(name)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(name)
+}
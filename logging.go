@@ -0,0 +1,167 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// log.target says where the log goes:
+//
+//	stderr    the default
+//	file      log.file.path, rotated (see logfile.go)
+//	syslog    RFC 5424 to log.syslog.addr over log.syslog.network (udp or
+//	          tcp, octet-counted per RFC 6587), facility log.syslog.facility
+//	eventlog  the Windows Event Log, as source log.eventlog.source
+//
+// log.syslog.appname defaults to the program name.
+func init() {
+	viper.SetDefault("log.target", "stderr")
+	viper.SetDefault("log.syslog.network", "udp")
+	viper.SetDefault("log.syslog.addr", "127.0.0.1:514")
+	viper.SetDefault("log.syslog.facility", 16) // local0
+	viper.SetDefault("log.syslog.appname", filepath.Base(os.Args[0]))
+	viper.SetDefault("log.eventlog.source", "enroll")
+}
+
+// setupLogging points the standard logger at log.target.
+func setupLogging() error {
+	switch target := viper.GetString("log.target"); target {
+	case "", "stderr":
+		return nil
+	case "file":
+		w, err := newRotatingFile()
+		if err != nil {
+			return fmt.Errorf("log file: %v", err)
+		}
+		log.SetOutput(w)
+	case "syslog":
+		w, err := newSyslogWriter()
+		if err != nil {
+			return err
+		}
+		log.SetFlags(0) // the syslog header has the time
+		log.SetOutput(w)
+	case "eventlog":
+		w, err := newEventLogWriter(viper.GetString("log.eventlog.source"))
+		if err != nil {
+			return fmt.Errorf("event log: %v", err)
+		}
+		log.SetFlags(0)
+		log.SetOutput(w)
+	default:
+		return fmt.Errorf("config: log.target must be stderr, file, syslog or eventlog (got %q)", target)
+	}
+	return nil
+}
+
+// syslogWriter sends each log line as one RFC 5424 message. If syslog is
+// unreachable the line goes to stderr instead, so nothing is lost
+// silently.
+type syslogWriter struct {
+	network, addr string
+	facility      int
+	host, app     string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newSyslogWriter() (*syslogWriter, error) {
+	network := viper.GetString("log.syslog.network")
+	if network != "udp" && network != "tcp" {
+		return nil, fmt.Errorf("config: log.syslog.network must be udp or tcp (got %q)", network)
+	}
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "-"
+	}
+	w := &syslogWriter{
+		network:  network,
+		addr:     viper.GetString("log.syslog.addr"),
+		facility: viper.GetInt("log.syslog.facility"),
+		host:     host,
+		app:      viper.GetString("log.syslog.appname"),
+	}
+	return w, w.connect()
+}
+
+func (w *syslogWriter) connect() error {
+	c, err := net.DialTimeout(w.network, w.addr, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("syslog: %v", err)
+	}
+	w.conn = c
+	return nil
+}
+
+// Severities we map log lines to.
+const (
+	sevErr     = 3
+	sevWarning = 4
+	sevInfo    = 6
+)
+
+// logSeverity guesses a line's severity. Our messages that start with a
+// capital ("Loaded ...", "Batch 12: ...") are progress; lower-case ones
+// ("moving x: ...") are problems, as are fatal errors.
+func logSeverity(line string) int {
+	switch {
+	case line == "":
+		return sevInfo
+	case strings.Contains(line, "panic") || strings.Contains(line, "fatal"):
+		return sevErr
+	case line[0] >= 'a' && line[0] <= 'z':
+		return sevWarning
+	}
+	return sevInfo
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", w.facility*8+logSeverity(line),
+		time.Now().UTC().Format("2006-01-02T15:04:05.000000Z"), w.host, w.app, os.Getpid(), line)
+	if w.network == "tcp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for try := 0; try < 2; try++ {
+		if w.conn == nil {
+			if err := w.connect(); err != nil {
+				break
+			}
+		}
+		w.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.WriteString(w.conn, msg); err == nil {
+			return len(p), nil
+		}
+		w.conn.Close()
+		w.conn = nil // reconnect and try once more
+	}
+	return os.Stderr.Write(p)
+}
@@ -0,0 +1,108 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// The anonymizer behind "enroll export --masked", for seeding staging
+// from production. "mask.rules" says what happens to each export column:
+//
+//	keep     left as it is (any column without a rule)
+//	digits   the same number of digits, worked out from the value
+//	name     "Office " and eight hex digits, worked out from the value
+//	blank    emptied
+//
+// By default EFIN is digits and COMPANY is name. Masked values come from
+// an HMAC of the value under "mask.key" (a secret reference), so an EFIN
+// masks the same way in every row - and in every export made with the
+// same key, which keeps a staging database consistent as it is topped
+// up. Without a key each export uses a random one.
+func init() {
+	viper.SetDefault("mask.key", "")
+	viper.SetDefault("mask.rules", map[string]string{"efin": "digits", "company": "name"})
+}
+
+// masker applies mask.rules to export rows.
+type masker struct {
+	key   []byte
+	rules map[string]string // by lower-case column name
+}
+
+// newMasker reads mask.key and mask.rules.
+func newMasker() (*masker, error) {
+	m := &masker{rules: viper.GetStringMapString("mask.rules")}
+	for column, rule := range m.rules {
+		switch rule {
+		case "keep", "digits", "name", "blank":
+		default:
+			return nil, fmt.Errorf("config: mask.rules.%s: unknown rule %q", column, rule)
+		}
+	}
+	if ref := viper.GetString("mask.key"); ref != "" {
+		key, err := secretValue(ref)
+		if err != nil {
+			return nil, fmt.Errorf("config: mask.key: %v", err)
+		}
+		m.key = []byte(key)
+		return m, nil
+	}
+	m.key = make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, m.key); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// apply masks record, whose columns are header, in place.
+func (m *masker) apply(header, record []string) {
+	for i, column := range header {
+		v := record[i]
+		if v == "" {
+			continue
+		}
+		switch m.rules[strings.ToLower(column)] {
+		case "digits":
+			sum := m.sum("digits", v)
+			digits := make([]byte, len(v))
+			for j := range digits {
+				digits[j] = '0' + sum[j%len(sum)]%10
+			}
+			record[i] = string(digits)
+		case "name":
+			record[i] = "Office " + hex.EncodeToString(m.sum("name", v)[:4])
+		case "blank":
+			record[i] = ""
+		}
+	}
+}
+
+// sum is the HMAC of a value under rule, so a value masks the same way
+// whichever column it is in.
+func (m *masker) sum(rule, v string) []byte {
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte(rule + "\x00" + v))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"strings"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Reject reports (the ACK files) go to vendors who don't all read
+// English. Each transmitter gets its messages in the language set by
+// messages.transmitters.<id> ("en" or "es"), or messages.language if it
+// has none. Only the message text changes: error codes and field paths
+// stay as they are for the vendors' software, and our own logs, database
+// and reports stay in English.
+//
+// The English text is the message as the check wrote it. Other languages
+// come from the catalog below, keyed by error code, with {name}
+// placeholders filled from the error: {field} is its field path, {detail}
+// the English message (for free text such as a database error) and the
+// rest come from recordError.Args. messages.catalog.<CODE>.<lang> in the
+// config overrides or adds an entry. A code with no entry for the
+// language falls back to English.
+func init() {
+	viper.SetDefault("messages.language", "en")
+}
+
+var messageCatalog = map[string]map[string]string{
+	errEFINNotApproved: {
+		"es": "El EFIN {efin} no está en la lista de EFIN aprobados (versión {version})",
+	},
+	errBankUnknown: {
+		"es": "El banco del año anterior {bank} no está en la lista de bancos (versión {version})",
+	},
+	errFieldEmpty: {
+		"es": "{field} está vacío",
+	},
+	errFieldTooLong: {
+		"es": "{field} tiene {length} caracteres; se permiten como máximo {max}",
+	},
+	errFieldTruncated: {
+		"es": "{field} tenía {length} caracteres y se recortó a {max}",
+	},
+	errActionUnknown: {
+		"es": "La acción debe ser enroll o deactivate (se recibió {action})",
+	},
+	errNotEnrolled: {
+		"es": "El EFIN {efin} no tiene nada activo que desactivar",
+	},
+	errAmendConflict: {
+		"es": "El registro cambió mientras se procesaba esta enmienda; vuelva a enviarla",
+	},
+	errHookRejected: {
+		"es": "El registro fue rechazado: {detail}",
+	},
+	errPriorYearMismatch: {
+		"es": "{field}: lo declarado ({claimed}) no coincide con nuestros registros del año anterior",
+	},
+	errDBTruncation: {
+		"es": "Un valor es demasiado largo para guardarse: {detail}",
+	},
+	errDBDuplicate: {
+		"es": "El registro ya existe: {detail}",
+	},
+	errDBConstraint: {
+		"es": "Falta un valor obligatorio o no es válido: {detail}",
+	},
+	errDB: {
+		"es": "No se pudo guardar el registro: {detail}",
+	},
+}
+
+// transmitterLanguage is the language a transmitter's reports are in.
+func transmitterLanguage(transmitter string) string {
+	if transmitter != "" {
+		if l := viper.GetString("messages.transmitters." + transmitter); l != "" {
+			return strings.ToLower(l)
+		}
+	}
+	return strings.ToLower(viper.GetString("messages.language"))
+}
+
+// localize renders e's message in lang.
+func localize(e recordError, lang string) string {
+	if lang == "" || lang == "en" {
+		return e.Message
+	}
+
+	text := viper.GetString("messages.catalog." + e.Code + "." + lang)
+	if text == "" {
+		text = messageCatalog[e.Code][lang]
+	}
+	if text == "" {
+		return e.Message
+	}
+
+	pairs := []string{"{field}", e.Field, "{detail}", e.Message}
+	for k, v := range e.Args {
+		pairs = append(pairs, "{"+k+"}", v)
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
@@ -0,0 +1,151 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// With statsd.addr set (e.g. "127.0.0.1:8125", the Datadog agent) we push
+// counters, timers and gauges to statsd, tagged the Datadog way:
+//
+//	enroll.file.records:250|c|#transmitter:tx01,result:loaded,env:prod
+//
+// statsd.prefix goes in front of every name and statsd.tags (a list of
+// "key:value") on every metric. statsd.network is udp (default) or tcp.
+// Sends never block loading: a metric that can't be sent is dropped.
+func init() {
+	viper.SetDefault("statsd.network", "udp")
+	viper.SetDefault("statsd.prefix", "enroll.")
+}
+
+var metrics struct {
+	sync.Mutex
+	conn   net.Conn
+	failed time.Time // last dial failure, so we don't redial per metric
+}
+
+// sendMetric writes one statsd line: name, value and type (c, ms or g).
+func sendMetric(name, value, kind string, tags ...string) {
+	addr := viper.GetString("statsd.addr")
+	if addr == "" {
+		return
+	}
+
+	line := viper.GetString("statsd.prefix") + name + ":" + value + "|" + kind
+	if all := append(viper.GetStringSlice("statsd.tags"), tags...); len(all) > 0 {
+		line += "|#" + strings.Join(all, ",")
+	}
+	line += "\n"
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	if metrics.conn == nil {
+		if time.Since(metrics.failed) < time.Minute {
+			return
+		}
+		c, err := net.DialTimeout(viper.GetString("statsd.network"), addr, 2*time.Second)
+		if err != nil {
+			log.Printf("statsd: %v", err)
+			metrics.failed = time.Now()
+			return
+		}
+		metrics.conn = c
+	}
+	metrics.conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := metrics.conn.Write([]byte(line)); err != nil {
+		if debug {
+			log.Printf("statsd: %v", err)
+		}
+		metrics.conn.Close()
+		metrics.conn = nil // redial next time (e.g. the agent restarted)
+	}
+}
+
+// metricCount adds n to a counter.
+func metricCount(name string, n int, tags ...string) {
+	sendMetric(name, fmt.Sprint(n), "c", tags...)
+}
+
+// metricTiming records a duration in milliseconds.
+func metricTiming(name string, d time.Duration, tags ...string) {
+	sendMetric(name, fmt.Sprint(d.Milliseconds()), "ms", tags...)
+}
+
+// metricGauge sets a gauge.
+func metricGauge(name string, v int, tags ...string) {
+	sendMetric(name, fmt.Sprint(v), "g", tags...)
+}
+
+// tag formats a Datadog tag.
+func tag(key, value string) string {
+	if value == "" {
+		value = "none"
+	}
+	return key + ":" + value
+}
+
+// fileMetrics reports a finished file.
+func fileMetrics(job *batchJob, status string, summary loadSummary, took time.Duration) {
+	transmitter := tag("transmitter", job.File.Transmitter())
+	metricCount("file.count", 1, transmitter, tag("status", status))
+	metricTiming("file.duration", took, transmitter, tag("status", status))
+	metricCount("file.records", len(summary.Loaded), transmitter, "result:loaded")
+	metricCount("file.records", len(summary.Rejected), transmitter, "result:rejected")
+	for k, n := range countErrors(summary) {
+		metricCount("record.errors", n, transmitter, tag("code", k.Code), tag("field", k.Field))
+	}
+}
+
+// recordLoadMetrics writes the batch's row in load_metrics
+// (sql/012_load_metrics.sql), which the ops dashboard reads: queue time,
+// duration and throughput.
+func recordLoadMetrics(db *sql.DB, job *batchJob, status string, summary loadSummary, started, finished time.Time) error {
+	took := finished.Sub(started)
+	records := len(summary.Loaded) + len(summary.Rejected)
+	rate := 0.0
+	if took > 0 {
+		rate = float64(records) / took.Seconds()
+	}
+
+	var arrived, queued interface{}
+	if !job.File.Arrived.IsZero() {
+		arrived = job.File.Arrived
+		if q := started.Sub(job.File.Arrived); q >= 0 {
+			queued = int64(q.Seconds())
+		}
+	}
+	instance := viper.GetString("load.instance")
+	if instance == "" {
+		instance = defaultInstance()
+	}
+
+	args := []interface{}{job.ID, nullString(job.File.Transmitter()), instance, status, arrived, started, finished,
+		queued, took.Milliseconds(), records, len(summary.Loaded), len(summary.Rejected), fmt.Sprintf("%.2f", rate)}
+	if !viper.GetBool("mssql.storedprocedures") {
+		args = append([]interface{}{job.ID}, args...) // for the DELETE
+	}
+	_, err := execStatement(db, "load_metrics.add", args...)
+	return err
+}
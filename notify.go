@@ -0,0 +1,215 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// After each file we can tell ops by email (notify.email) and/or in Slack
+// (notify.slack.webhook). The messages are Go templates (text/template)
+// kept in config, so the wording and what's included can change without a
+// release:
+//
+//	notify.templates.subject   email subject line
+//	notify.templates.email     email body
+//	notify.templates.slack     Slack message (mrkdwn)
+//
+// Templates see a notification: everything in the webhook payload
+// (.Batch, .File, .Transmitter, .Status, .Counts.Loaded, .Links.batch,
+// .Finished, ...) plus .Rejected, the rejected records (.Index, .EFIN,
+// .Reason). Extra functions: base (file name without directory), upper,
+// lower. A template that doesn't parse or run is logged and the built-in
+// default is used instead.
+//
+// notify.on picks which files to tell anyone about: "always" (default),
+// "problems" (failed, or anything rejected) or "failures".
+func init() {
+	viper.SetDefault("notify.on", "always")
+	viper.SetDefault("notify.email.port", 587)
+	viper.SetDefault("notify.templates.subject", defaultSubjectTemplate)
+	viper.SetDefault("notify.templates.email", defaultEmailTemplate)
+	viper.SetDefault("notify.templates.slack", defaultSlackTemplate)
+}
+
+const (
+	defaultSubjectTemplate = `[enroll] {{base .File}}: {{.Status}} ({{.Counts.Loaded}} loaded, {{.Counts.Rejected}} rejected)`
+
+	defaultEmailTemplate = `Batch {{.Batch}} - {{.File}}
+Transmitter: {{.Transmitter}}
+Status:      {{.Status}}
+Finished:    {{.Finished.Format "2006-01-02 15:04:05"}}
+
+Records:  {{.Counts.Records}}
+Loaded:   {{.Counts.Loaded}} ({{.Counts.Pending}} pending review)
+Rejected: {{.Counts.Rejected}}
+{{range .Rejected}}
+  record {{.Index}} (EFIN {{.EFIN}}): {{.Reason}}{{end}}
+{{with .Links.batch}}
+{{.}}{{end}}
+`
+
+	defaultSlackTemplate = `*{{base .File}}* ({{.Transmitter}}): *{{.Status}}* - {{.Counts.Loaded}} loaded, {{.Counts.Pending}} pending, {{.Counts.Rejected}} rejected{{with .Links.batch}} <{{.}}|batch {{$.Batch}}>{{end}}`
+)
+
+// notification is what the templates see.
+type notification struct {
+	webhookPayload
+	Rejected []rejectedRecord
+}
+
+var templateFuncs = template.FuncMap{
+	"base":  filepath.Base,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// render runs the template configured at key, falling back to def.
+func render(key, def string, n notification) string {
+	text := viper.GetString(key)
+	if strings.TrimSpace(text) == "" {
+		text = def
+	}
+	out, err := execTemplate(key, text, n)
+	if err != nil && text != def {
+		log.Printf("config: %s: %v; using the default", key, err)
+		out, err = execTemplate(key, def, n)
+	}
+	if err != nil {
+		log.Printf("%s: %v", key, err)
+	}
+	return out
+}
+
+func execTemplate(name, text string, n notification) (string, error) {
+	t, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, n); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// sendNotifications tells ops how a file went. Failures are logged only.
+func sendNotifications(job *batchJob, status string, summary loadSummary) {
+	switch viper.GetString("notify.on") {
+	case "failures":
+		if status != batchFailed {
+			return
+		}
+	case "problems":
+		if status != batchFailed && len(summary.Rejected) == 0 {
+			return
+		}
+	}
+
+	n := notification{webhookPayload: newWebhookPayload(job, status, summary), Rejected: summary.Rejected}
+
+	if to := viper.GetStringSlice("notify.email.to"); len(to) > 0 {
+		subject := render("notify.templates.subject", defaultSubjectTemplate, n)
+		body := render("notify.templates.email", defaultEmailTemplate, n)
+		if err := sendEmail(to, subject, body); err != nil {
+			job.logf("emailing batch %d summary: %v", job.ID, err)
+		}
+	}
+	if hook := viper.GetString("notify.slack.webhook"); hook != "" {
+		text := render("notify.templates.slack", defaultSlackTemplate, n)
+		if err := retrying("api", "posting to Slack", func() error { return postSlack(hook, text) }); err != nil {
+			job.logf("posting batch %d summary to Slack: %v", job.ID, err)
+		}
+	}
+}
+
+// notifyOps sends a message that isn't about one file to the same email
+// and Slack recipients. Failures are logged only.
+func notifyOps(subject, text string) {
+	if to := viper.GetStringSlice("notify.email.to"); len(to) > 0 {
+		if err := sendEmail(to, subject, text); err != nil {
+			log.Printf("emailing %q: %v", subject, err)
+		}
+	}
+	if hook := viper.GetString("notify.slack.webhook"); hook != "" {
+		if err := retrying("api", "posting to Slack", func() error { return postSlack(hook, text) }); err != nil {
+			log.Printf("posting %q to Slack: %v", subject, err)
+		}
+	}
+}
+
+// sendEmail sends a plain text message through notify.email.host.
+// smtp.SendMail uses STARTTLS when the server offers it.
+func sendEmail(to []string, subject, body string) error {
+	host := viper.GetString("notify.email.host")
+	if host == "" {
+		return fmt.Errorf("config: notify.email.host is not set")
+	}
+	from := viper.GetString("notify.email.from")
+
+	var auth smtp.Auth
+	if user := viper.GetString("notify.email.user"); user != "" {
+		password, err := secretValue(viper.GetString("notify.email.password"))
+		if err != nil {
+			return fmt.Errorf("config: notify.email.password: %v", err)
+		}
+		auth = smtp.PlainAuth("", user, password, host)
+	}
+
+	// Newlines in a configured subject would start new headers.
+	subject = strings.Join(strings.Fields(subject), " ")
+	msg := "From: " + from + "\r\n" +
+		"To: " + strings.Join(to, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		strings.ReplaceAll(body, "\n", "\r\n")
+
+	addr := net.JoinHostPort(host, strconv.Itoa(viper.GetInt("notify.email.port")))
+	return smtp.SendMail(addr, auth, from, to, []byte(msg))
+}
+
+// postSlack posts a message to a Slack incoming webhook.
+func postSlack(hook, text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(hook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+	bolt "go.etcd.io/bbolt"  // https://github.com/etcd-io/bbolt
+)
+
+// Sites on flaky links can run the watcher in store-and-forward mode
+// (offline.enabled). When a file can't be loaded because the database is
+// unreachable, its records are written to a local bbolt file
+// (offline.path, default ./spool/offline.db) instead of the file going to
+// watch.failed, and the file itself is filed under watch.done. Once the
+// database answers again the watcher loads the spooled files, oldest
+// first, as ordinary batches - so reference checks, ACKs and
+// notifications all happen then - and drops each from the spool when it
+// has loaded. The spooled records are encrypted with storage.key (see
+// atrest.go).
+func init() {
+	viper.SetDefault("offline.enabled", false)
+	viper.SetDefault("offline.path", "./spool/offline.db")
+}
+
+var offlineBucket = []byte("files")
+
+// spooledFile is one file waiting in the offline spool.
+type spooledFile struct {
+	File        inputFile
+	Correlation string
+	Spooled     time.Time
+	Reason      string // why it couldn't be loaded
+}
+
+// offlineSpool is the store-and-forward queue.
+type offlineSpool struct {
+	db *bolt.DB
+
+	mu       sync.Mutex
+	flushing bool
+}
+
+func openOfflineSpool() (*offlineSpool, error) {
+	path := viper.GetString("offline.path")
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening offline spool %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(offlineBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &offlineSpool{db: db}, nil
+}
+
+func (s *offlineSpool) Close() error { return s.db.Close() }
+
+// isOffline reports whether err means the database is unreachable, so the
+// file is worth spooling rather than failing.
+func isOffline(err error) bool {
+	return err != nil && (isFailoverError(err) || dbIsDown())
+}
+
+// spoolKey orders the spool by when files were spooled.
+func spoolKey(sf spooledFile) []byte {
+	return []byte(fmt.Sprintf("%020d-%s", sf.Spooled.UnixNano(), sf.File.SHA256))
+}
+
+// add spools a file. A file already in the spool isn't added twice.
+func (s *offlineSpool) add(f inputFile, correlation string, reason error) error {
+	sf := spooledFile{File: f, Correlation: correlation, Spooled: time.Now(), Reason: reason.Error()}
+	value, err := json.Marshal(sf)
+	if err != nil {
+		return err
+	}
+	if value, err = seal(value); err != nil { // the records carry SSNs
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(offlineBucket)
+		dup := false
+		b.ForEach(func(k, v []byte) error {
+			var other spooledFile
+			if plain, err := unseal(v); err == nil && json.Unmarshal(plain, &other) == nil && other.File.SHA256 == f.SHA256 {
+				dup = true
+			}
+			return nil
+		})
+		if dup {
+			return nil
+		}
+		return b.Put(spoolKey(sf), value)
+	})
+}
+
+// len returns how many files are waiting.
+func (s *offlineSpool) len() int {
+	n := 0
+	s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(offlineBucket).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+// oldest returns the file that has waited longest, if any.
+func (s *offlineSpool) oldest() ([]byte, *spooledFile, error) {
+	var key []byte
+	var sf *spooledFile
+	err := s.db.View(func(tx *bolt.Tx) error {
+		k, v := tx.Bucket(offlineBucket).Cursor().First()
+		if k == nil {
+			return nil
+		}
+		plain, err := unseal(v)
+		if err != nil {
+			return fmt.Errorf("offline spool entry %s: %v", k, err)
+		}
+		sf = &spooledFile{}
+		if err := json.Unmarshal(plain, sf); err != nil {
+			return fmt.Errorf("offline spool entry %s: %v", k, err)
+		}
+		key = append([]byte(nil), k...)
+		return nil
+	})
+	return key, sf, err
+}
+
+func (s *offlineSpool) remove(key []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(offlineBucket).Delete(key)
+	})
+}
+
+// flushSpool loads spooled files until the spool is empty or the
+// database goes away again. Only one flush runs at a time; a call while
+// one is running returns straight away. A spooled file that fails on its
+// merits is moved from watch.done to watch.failed, as if it had failed to
+// begin with.
+func (w *watcher) flushSpool() {
+	s := w.spool
+	s.mu.Lock()
+	if s.flushing {
+		s.mu.Unlock()
+		return
+	}
+	s.flushing = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.flushing = false
+		s.mu.Unlock()
+	}()
+
+	for {
+		if w.isPaused() {
+			return
+		}
+		key, sf, err := s.oldest()
+		if err != nil {
+			log.Printf("reading the offline spool: %v", err)
+			return
+		}
+		if sf == nil {
+			return
+		}
+
+		name := filepath.Base(sf.File.Path)
+		job := &batchJob{File: sf.File, Correlation: sf.Correlation}
+		job.logf("Loading %s from the offline spool (spooled %s)\n", name, sf.Spooled.Format(time.RFC3339))
+		// Count it as loading, so a drain waits for it.
+		w.mu.Lock()
+		w.loading["spool:"+name] = loadingFile{sha: sf.File.SHA256, started: time.Now()}
+		w.mu.Unlock()
+		summary, err := loadFile(w.dbs, job)
+		w.mu.Lock()
+		delete(w.loading, "spool:"+name)
+		w.mu.Unlock()
+		var already *alreadyLoadedError
+		if errors.As(err, &already) { // see ledger.go
+			job.logf("%s %v; nothing to do\n", name, err)
+			err = nil
+		}
+		summary.print()
+		if isOffline(err) {
+			job.logf("database unreachable again; leaving %s spooled: %v", name, err)
+			return
+		}
+		if err != nil {
+			job.logf("%s failed: %v", name, err)
+			if err := os.Rename(filepath.Join(w.done, name), filepath.Join(w.failed, name)); err != nil {
+				log.Printf("moving %s to %s: %v", name, w.failed, err)
+			}
+		}
+		if err := s.remove(key); err != nil {
+			log.Printf("removing %s from the offline spool: %v", name, err)
+			return
+		}
+		metricGauge("offline.spooled", s.len())
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// The OpenAPI 3 document for the API is generated from the code: the
+// schemas come from the Go types the handlers encode (by reflection, so a
+// new field shows up without anyone editing the spec), and the paths are
+// listed below. When you add a partner-facing route, add it here too; the
+// /v1/admin routes are for our operators and are left out on purpose. The
+// edit endpoint is in, since partners ask us for edits and see the
+// result, but it takes admin credentials.
+//
+// It is served at GET /v1/openapi.json and printed by "enroll openapi".
+
+var apiSchemas = map[string]interface{}{
+	"Batch":        batchInfo{},
+	"Enrollment":   enrollmentRecord{},
+	"EditResult":   editResult{},
+	"SubmitResult": submitResult{},
+	"Error":        apiError{},
+	"ErrorCode":    errorCode{},
+}
+
+// openAPISpec builds the document.
+func openAPISpec() map[string]interface{} {
+	schemas := map[string]interface{}{}
+	for name, v := range apiSchemas {
+		schemas[name] = schemaFor(reflect.TypeOf(v))
+	}
+
+	spec := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Enrollment API",
+			"version":     "1",
+			"description": "Submit ERO enrollment files and check on them. Authenticate with a client certificate from our internal CA or a bearer token (API key or OAuth2 access token).",
+		},
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"bearer": []string{}}},
+		"paths":    apiPaths(),
+	}
+	if u := viper.GetString("server.publicurl"); u != "" {
+		spec["servers"] = []interface{}{map[string]string{"url": strings.TrimRight(u, "/")}}
+	}
+	return spec
+}
+
+func apiPaths() map[string]interface{} {
+	paths := map[string]interface{}{
+		"/v1/files": map[string]interface{}{
+			"post": operation("submitFile", "Submit an enrollment file", "SubmitResult",
+				[]interface{}{queryParam("name", "file name, ending .xml, .csv or .json")},
+				map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/xml":  map[string]interface{}{"schema": map[string]string{"type": "string", "format": "binary"}},
+						"text/csv":         map[string]interface{}{"schema": map[string]string{"type": "string", "format": "binary"}},
+						"application/json": map[string]interface{}{"schema": map[string]string{"type": "string", "format": "binary"}},
+					},
+				}, 400, 401, 403, 413, 422, 429),
+		},
+		"/v1/batches/{id}": map[string]interface{}{
+			"get": operation("getBatch", "Status of a batch", "Batch",
+				[]interface{}{pathParam("id", "integer")}, nil, 401, 404, 429),
+		},
+		"/v1/enrollments": map[string]interface{}{
+			"get": operation("findEnrollments", "What we have loaded for an EFIN, or the record with a confirmation number", "[]Enrollment",
+				[]interface{}{optional(queryParam("efin", "the EFIN")), optional(queryParam("confirmation", "a confirmation number"))}, nil, 400, 401, 404, 429),
+		},
+		"/v1/enrollments/{id}": map[string]interface{}{
+			"patch": operation("editEnrollment", "Edit a record and load it as an amendment (admin credentials only)", "EditResult",
+				[]interface{}{pathParam("id", "integer")},
+				map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": map[string]interface{}{
+							"type":     "object",
+							"required": []string{"fields"},
+							"properties": map[string]interface{}{
+								"fields": map[string]interface{}{
+									"type":                 "object",
+									"additionalProperties": map[string]interface{}{"oneOf": []interface{}{map[string]string{"type": "string"}, map[string]string{"type": "boolean"}}},
+								},
+								"note": map[string]string{"type": "string"},
+							},
+						}},
+					},
+				}, 400, 401, 404, 409, 422),
+		},
+		"/v1/errors": map[string]interface{}{
+			"get": operation("listErrorCodes", "Every error code a record can come back with", "[]ErrorCode", nil, nil, 401, 429),
+		},
+	}
+	// Only served when verification emails are sent (verify.go).
+	if verificationEnabled() {
+		paths["/v1/verify"] = map[string]interface{}{
+			"get": pageOperation("verifyPage", "The page a verification email links to",
+				[]interface{}{queryParam("token", "the token from the email")}, nil, 400, 429),
+			"post": pageOperation("verifyEmail", "Confirm the email address of an enrollment",
+				nil, map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/x-www-form-urlencoded": map[string]interface{}{"schema": map[string]interface{}{
+							"type":       "object",
+							"required":   []string{"token"},
+							"properties": map[string]interface{}{"token": map[string]string{"type": "string"}},
+						}},
+					},
+				}, 404, 429),
+		}
+	}
+	return paths
+}
+
+// operation describes one endpoint. result names a schema ("[]X" for an
+// array of X, "" for an untyped object); errs are the error statuses it
+// can return.
+func operation(id, summary, result string, params []interface{}, body map[string]interface{}, errs ...int) map[string]interface{} {
+	var schema interface{} = map[string]string{"type": "object"}
+	switch {
+	case strings.HasPrefix(result, "[]"):
+		schema = map[string]interface{}{"type": "array", "items": schemaRef(result[2:])}
+	case result != "":
+		schema = schemaRef(result)
+	}
+
+	responses := map[string]interface{}{
+		"200": map[string]interface{}{
+			"description": "OK",
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}},
+		},
+	}
+	for _, status := range errs {
+		responses[strconv.Itoa(status)] = map[string]interface{}{
+			"description": http.StatusText(status),
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": schemaRef("Error")}},
+		}
+	}
+
+	op := map[string]interface{}{"operationId": id, "summary": summary, "responses": responses}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	if body != nil {
+		op["requestBody"] = body
+	}
+	return op
+}
+
+// pageOperation describes an endpoint people open in a browser, which
+// answers with an HTML page and needs no credentials.
+func pageOperation(id, summary string, params []interface{}, body map[string]interface{}, errs ...int) map[string]interface{} {
+	page := map[string]interface{}{"text/html": map[string]interface{}{"schema": map[string]string{"type": "string"}}}
+	responses := map[string]interface{}{"200": map[string]interface{}{"description": "OK", "content": page}}
+	for _, status := range errs {
+		responses[strconv.Itoa(status)] = map[string]interface{}{"description": http.StatusText(status), "content": page}
+	}
+
+	op := map[string]interface{}{"operationId": id, "summary": summary, "responses": responses, "security": []interface{}{}}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	if body != nil {
+		op["requestBody"] = body
+	}
+	return op
+}
+
+func schemaRef(name string) map[string]string {
+	return map[string]string{"$ref": "#/components/schemas/" + name}
+}
+
+func queryParam(name, desc string) map[string]interface{} {
+	return map[string]interface{}{"name": name, "in": "query", "required": true, "description": desc, "schema": map[string]string{"type": "string"}}
+}
+
+// optional marks a parameter as not required.
+func optional(param map[string]interface{}) map[string]interface{} {
+	param["required"] = false
+	return param
+}
+
+func pathParam(name, typ string) map[string]interface{} {
+	return map[string]interface{}{"name": name, "in": "path", "required": true, "schema": map[string]string{"type": typ}}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor derives a JSON schema from a Go type, following its json tags.
+func schemaFor(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue // unexported
+			}
+			name, opts := f.Name, ""
+			if tag, ok := f.Tag.Lookup("json"); ok {
+				if tag == "-" {
+					continue
+				}
+				name, opts = tag, ""
+				if i := strings.Index(tag, ","); i >= 0 {
+					name, opts = tag[:i], tag[i:]
+				}
+				if name == "" {
+					name = f.Name
+				}
+			}
+			props[name] = schemaFor(f.Type)
+			if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Ptr {
+				required = append(required, name)
+			}
+		}
+		s := map[string]interface{}{"type": "object", "properties": props}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		return s
+	}
+	return map[string]interface{}{}
+}
+
+// registerOpenAPIRoutes adds GET /v1/openapi.json.
+func registerOpenAPIRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/v1/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		writeJSON(w, http.StatusOK, openAPISpec())
+	})
+}
+
+var openapiCmd = &cobra.Command{
+	Use:   "openapi",
+	Short: "Print the OpenAPI document for the HTTP API",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		check(enc.Encode(openAPISpec()))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(openapiCmd)
+}
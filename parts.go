@@ -0,0 +1,82 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import "strings"
+
+// The ero row has only the columns the loader judges a record by. The
+// rest of the record is broken up into a table per part, each row keyed
+// by the ero row's ID (sql/036_ero_parts.sql): ero_office for OfficeInfo,
+// ero_owner for OwnerInformation, ero_efin_owner for EFINOwnerInfo and
+// ero_prior_year for PriorYearInfo. They are written in the record's
+// transaction (see beginRecord in quarantine.go), so a record is loaded
+// with all of its parts or not at all.
+//
+// SSNs and dates of birth stay out of them (see alwaysencrypted.go and
+// subject.go). With privacy.ssnkey set, so do the owners' names, phone
+// numbers, email and street addresses: ero_subject has those, encrypted
+// so that erasing the person shreds them, and a plain copy here would
+// outlive the erasure.
+
+// storeParts writes record id's office, owner, EFIN owner and prior-year
+// rows. An owner block with nothing in it but an SSN and date of birth
+// gets no row.
+func storeParts(p preparer, id int64, e Enrollment) error {
+	o := e.OfficeInfo
+	if _, err := execStatement(p, "ero_office.add", id,
+		part(o.OfficeName, 100), part(o.PrimaryContactFirst, 50), part(o.PrimaryContactLast, 50),
+		part(o.PhoneNumber, 20), part(o.FaxNumber, 20), part(o.Email, 254),
+		part(o.Address1, 100), part(o.Address2, 100), part(o.City, 50), part(o.State, 2), part(o.Zip, 10)); err != nil {
+		return err
+	}
+
+	key, err := ssnHashKey()
+	if err != nil {
+		return err
+	}
+	people := []struct {
+		name string
+		who  OwnerInformation
+	}{
+		{"ero_owner.add", e.OwnerInformation},
+		{"ero_efin_owner.add", OwnerInformation(e.EFINOwnerInfo)},
+	}
+	for _, person := range people {
+		w := person.who
+		if key != nil {
+			// Kept in ero_subject (subject.go).
+			w.FirstName, w.LastName, w.PhoneNumber, w.Email, w.Address1, w.Address2 = "", "", "", "", "", ""
+		}
+		w.SSN, w.DateOfBirth = "", ""
+		if w == (OwnerInformation{}) {
+			continue
+		}
+		if _, err := execStatement(p, person.name, id,
+			part(w.FirstName, 50), part(w.LastName, 50), part(w.PhoneNumber, 20), part(w.Email, 254),
+			part(w.Address1, 100), part(w.Address2, 100), part(w.City, 50), part(w.State, 2), part(w.Zip, 10)); err != nil {
+			return err
+		}
+	}
+
+	_, err = execStatement(p, "ero_prior_year.add", id, part(e.PriorYearInfo.Bank, 60), e.PriorYearInfo.ClientOfYoursLastYear)
+	return err
+}
+
+// part is a field as its column in a part table takes it: trimmed, cut to
+// the column's n characters, and NULL if empty.
+func part(s string, n int) interface{} {
+	return nullString(truncate(strings.TrimSpace(s), n))
+}
@@ -0,0 +1,79 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The rules are read again for every batch, and for every rule set, so
+// the regular expressions and value lists in them go through this
+// registry: each pattern is compiled once and each list made into a set
+// once for the life of the process, and shared by every batch and rule
+// set that uses it. What it hands out is never changed, so it is safe to
+// share. The config doesn't change under a running process, which keeps
+// the registry small.
+var patterns struct {
+	sync.Mutex
+	compiled map[string]*regexp.Regexp
+	sets     map[string]map[string]bool
+}
+
+// compilePattern returns expr compiled.
+func compilePattern(expr string) (*regexp.Regexp, error) {
+	patterns.Lock()
+	defer patterns.Unlock()
+	if re, ok := patterns.compiled[expr]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if patterns.compiled == nil {
+		patterns.compiled = map[string]*regexp.Regexp{}
+	}
+	patterns.compiled[expr] = re
+	return re, nil
+}
+
+// lookupSet returns values, trimmed, as a set.
+func lookupSet(values []string) map[string]bool {
+	trimmed := make([]string, len(values))
+	for i, v := range values {
+		trimmed[i] = strings.TrimSpace(v)
+	}
+	sort.Strings(trimmed)
+	key := strings.Join(trimmed, "\x00")
+
+	patterns.Lock()
+	defer patterns.Unlock()
+	if set, ok := patterns.sets[key]; ok {
+		return set
+	}
+	set := make(map[string]bool, len(trimmed))
+	for _, v := range trimmed {
+		set[v] = true
+	}
+	if patterns.sets == nil {
+		patterns.sets = map[string]map[string]bool{}
+	}
+	patterns.sets[key] = set
+	return set
+}
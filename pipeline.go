@@ -0,0 +1,425 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// A file goes through the load in stages:
+//
+//	read       read the file in (readInputFile)
+//	decode     parse it into records
+//	normalize  find what a record amends, pick its rules, fill in
+//	           defaults and settle conflicts (normalizeRecord)
+//	validate   check it (validateRecord)
+//	enrich     work out what follows from it: risk flags, lookups
+//	           (enrich.go), the canary comparison (enrichRecord)
+//	write      insert or reject it (loadRecords)
+//
+// read and decode happen once per file, before the batch starts. The
+// record stages run side by side, connected by channels holding up to
+// pipeline.queue records, so the next records are being checked while
+// one is written. pipeline.workers.<stage> sets how many records
+// normalize, validate and enrich each work on at once (1 by default);
+// write takes one record at a time, in file order. A record isn't
+// normalized until any earlier record with the same EFIN has been
+// written, so it sees what that record wrote, as it would one at a time.
+// In a file or batch transaction there is only the one connection, so
+// the stages take turns on it.
+//
+// Every stage counts the records it handles and the time it is busy with
+// them, and how many records are queued in front of it; the stage with a
+// queue that keeps growing is the bottleneck. These go to statsd
+// (pipeline.records, pipeline.busy and, every pipeline.sample,
+// pipeline.queue, each tagged with the stage), to GET /v1/admin/pipeline
+// and, with --profile, to stages.txt.
+func init() {
+	viper.SetDefault("pipeline.queue", 64)
+	viper.SetDefault("pipeline.sample", "10s")
+	for _, s := range scaledStages {
+		viper.SetDefault("pipeline.workers."+s, 1)
+	}
+}
+
+// Pipeline stages, in order.
+const (
+	stageRead      = "read"
+	stageDecode    = "decode"
+	stageNormalize = "normalize"
+	stageValidate  = "validate"
+	stageEnrich    = "enrich"
+	stageWrite     = "write"
+)
+
+var pipelineStages = []string{stageRead, stageDecode, stageNormalize, stageValidate, stageEnrich, stageWrite}
+
+// scaledStages are the stages pipeline.workers can give more workers.
+var scaledStages = []string{stageNormalize, stageValidate, stageEnrich}
+
+// stageWorkers is how many records stage works on at once.
+func stageWorkers(stage string) int {
+	for _, s := range scaledStages {
+		if s == stage && viper.GetInt("pipeline.workers."+s) > 1 {
+			return viper.GetInt("pipeline.workers." + s)
+		}
+	}
+	return 1
+}
+
+// recordItem is a record on its way through the stages.
+type recordItem struct {
+	Index  int // position in the file, from 0
+	Record Enrollment
+	Check  recordCheck
+
+	Canary   canaryDelta // see canary.go
+	CanaryOK bool
+
+	Skip    bool   // only write has anything to do with it (a de-enrollment or a repeat)
+	Repeat  bool   // loaded lately already (see recent.go)
+	Written string // the ledger's outcome, if the batch wrote it already (see ledger.go)
+	Err     error  // stops the load when it gets to write
+}
+
+// stage is one of the record stages before write.
+type stage struct {
+	Name string
+	Run  func(it *recordItem)
+}
+
+// stageTotals is what a stage has done.
+type stageTotals struct {
+	Records int64
+	Busy    time.Duration
+}
+
+// pipelineStats is what every stage has done since the process started,
+// and the pipelines running now.
+var pipelineStats struct {
+	sync.Mutex
+	stages  map[string]*stageTotals
+	running map[*pipeline]bool
+}
+
+// countStage adds n records that kept stage busy for busy.
+func countStage(stage string, n int, busy time.Duration) {
+	pipelineStats.Lock()
+	defer pipelineStats.Unlock()
+	if pipelineStats.stages == nil {
+		pipelineStats.stages = map[string]*stageTotals{}
+	}
+	t, ok := pipelineStats.stages[stage]
+	if !ok {
+		t = &stageTotals{}
+		pipelineStats.stages[stage] = t
+	}
+	t.Records += int64(n)
+	t.Busy += busy
+}
+
+// fileDecoded counts a file's read and decode stages, which readInputFile
+// runs.
+func fileDecoded(records int, read, decode time.Duration) {
+	countStage(stageRead, records, read)
+	countStage(stageDecode, records, decode)
+	for _, s := range []struct {
+		Name string
+		Busy time.Duration
+	}{{stageRead, read}, {stageDecode, decode}} {
+		metricCount("pipeline.records", records, tag("stage", s.Name))
+		metricTiming("pipeline.busy", s.Busy, tag("stage", s.Name))
+	}
+}
+
+// pipeline is one file's records going through the record stages.
+type pipeline struct {
+	job    *batchJob
+	stages []stage
+	queues []chan *recordItem // queues[s] feeds stages[s]; the last one feeds write
+	stop   chan struct{}      // closed when write stops early
+	turn   *sync.Mutex        // taken by each stage in a transaction
+
+	earlier map[int]int           // record -> the earlier record with its EFIN
+	written map[int]chan struct{} // closed once the record is written, for those that wait on it
+
+	mu   sync.Mutex
+	held int // records write has that must wait for an earlier one
+	took map[string]*stageTotals
+}
+
+// runPipeline takes job's records from start up to end through stages
+// and then write, which has them in file order. The first error write returns
+// stops the pipeline, dropping the records behind it, and is returned.
+// p is what the stages use; in a transaction they take turns with it.
+func runPipeline(job *batchJob, p preparer, start, end int, stages []stage, write func(it *recordItem) error) error {
+	pl := &pipeline{job: job, stages: stages, stop: make(chan struct{}), took: map[string]*stageTotals{}}
+	if _, ok := p.(*sql.Tx); ok {
+		pl.turn = &sync.Mutex{}
+	}
+	pl.order(start, end)
+	for s := 0; s <= len(stages); s++ {
+		pl.queues = append(pl.queues, make(chan *recordItem, viper.GetInt("pipeline.queue")))
+	}
+
+	pipelineStats.Lock()
+	if pipelineStats.running == nil {
+		pipelineStats.running = map[*pipeline]bool{}
+	}
+	pipelineStats.running[pl] = true
+	pipelineStats.Unlock()
+	defer func() {
+		pipelineStats.Lock()
+		delete(pipelineStats.running, pl)
+		pipelineStats.Unlock()
+		pl.report()
+	}()
+
+	go pl.feed(start, end)
+	for s := range stages {
+		pl.startStage(s)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go pl.sample(done)
+
+	return pl.write(start, write)
+}
+
+// order works out which records must wait for an earlier one.
+func (pl *pipeline) order(start, end int) {
+	pl.earlier, pl.written = map[int]int{}, map[int]chan struct{}{}
+	last := map[string]int{}
+	for i := start; i < end; i++ {
+		efin := strings.TrimSpace(pl.job.File.Records[i].EFIN)
+		if j, ok := last[efin]; ok {
+			pl.earlier[i] = j
+			if pl.written[j] == nil {
+				pl.written[j] = make(chan struct{})
+			}
+		}
+		last[efin] = i
+	}
+}
+
+// feed puts the records into the first stage, paced by job.Pace.
+func (pl *pipeline) feed(start, end int) {
+	defer close(pl.queues[0])
+	for i := start; i < end; i++ {
+		select {
+		case <-pl.stop:
+			return
+		default:
+		}
+		if pl.job.Pace != nil {
+			pl.job.Pace()
+		}
+		select {
+		case pl.queues[0] <- &recordItem{Index: i, Record: pl.job.File.Records[i]}:
+		case <-pl.stop:
+			return
+		}
+	}
+}
+
+// startStage starts stage s's workers. The first stage holds each record
+// until the earlier record with its EFIN is written.
+func (pl *pipeline) startStage(s int) {
+	st, in, out := pl.stages[s], pl.queues[s], pl.queues[s+1]
+	var wg sync.WaitGroup
+	for w := 0; w < stageWorkers(st.Name); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for it := range in {
+				if s == 0 && !pl.waitEarlier(it.Index) {
+					continue
+				}
+				select {
+				case <-pl.stop:
+					continue // drain
+				default:
+				}
+				if it.Err == nil && !it.Skip {
+					pl.run(st.Name, func() { st.Run(it) })
+				}
+				select {
+				case out <- it:
+				case <-pl.stop:
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+}
+
+// waitEarlier waits until the earlier record with record i's EFIN, if
+// there is one, has been written. It reports false if the pipeline
+// stopped first.
+func (pl *pipeline) waitEarlier(i int) bool {
+	j, ok := pl.earlier[i]
+	if !ok {
+		return true
+	}
+	select {
+	case <-pl.written[j]:
+		return true
+	case <-pl.stop:
+		return false
+	}
+}
+
+// run runs one stage on one record, and counts it.
+func (pl *pipeline) run(stage string, f func()) {
+	if pl.turn != nil {
+		pl.turn.Lock()
+		defer pl.turn.Unlock()
+	}
+	started := time.Now()
+	f()
+	took := time.Since(started)
+	timeStage(pl.job.File.Path, stage, started) // see profile.go
+	countStage(stage, 1, took)
+
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	t, ok := pl.took[stage]
+	if !ok {
+		t = &stageTotals{}
+		pl.took[stage] = t
+	}
+	t.Records++
+	t.Busy += took
+}
+
+// write hands the records to write in file order, holding any that come
+// out of the stages ahead of their turn.
+func (pl *pipeline) write(start int, write func(it *recordItem) error) error {
+	held := map[int]*recordItem{}
+	next := start
+	var err error
+	for it := range pl.queues[len(pl.stages)] {
+		if err != nil {
+			continue // drain
+		}
+		held[it.Index] = it
+		for err == nil {
+			w, ok := held[next]
+			if !ok {
+				break
+			}
+			delete(held, next)
+			next++
+			pl.run(stageWrite, func() { err = write(w) })
+			if c, ok := pl.written[w.Index]; ok {
+				close(c)
+			}
+		}
+		if err != nil {
+			close(pl.stop)
+		}
+		pl.mu.Lock()
+		pl.held = len(held)
+		pl.mu.Unlock()
+	}
+	return err
+}
+
+// queued is how many records are waiting for each record stage.
+func (pl *pipeline) queued() map[string]int {
+	q := map[string]int{}
+	for s, st := range pl.stages {
+		q[st.Name] = len(pl.queues[s])
+	}
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	q[stageWrite] = len(pl.queues[len(pl.stages)]) + pl.held
+	return q
+}
+
+// sample sends the queue depths to statsd until done.
+func (pl *pipeline) sample(done <-chan struct{}) {
+	every := viper.GetDuration("pipeline.sample")
+	if every <= 0 || viper.GetString("statsd.addr") == "" {
+		return
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	transmitter := tag("transmitter", pl.job.File.Transmitter())
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			for stage, n := range pl.queued() {
+				metricGauge("pipeline.queue", n, transmitter, tag("stage", stage))
+			}
+		}
+	}
+}
+
+// report sends what the record stages did with the file to statsd.
+func (pl *pipeline) report() {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	transmitter := tag("transmitter", pl.job.File.Transmitter())
+	for stage, t := range pl.took {
+		metricCount("pipeline.records", int(t.Records), transmitter, tag("stage", stage))
+		metricTiming("pipeline.busy", t.Busy, transmitter, tag("stage", stage))
+	}
+}
+
+// stageStatus is one stage in GET /v1/admin/pipeline.
+type stageStatus struct {
+	Stage       string  `json:"stage"`
+	Workers     int     `json:"workers"`
+	Records     int64   `json:"records"` // since the process started
+	BusySeconds float64 `json:"busySeconds"`
+	PerSecond   float64 `json:"perSecond"` // records per busy second, per worker
+	Queued      int     `json:"queued"`    // waiting for it now, across the files loading
+}
+
+// pipelineStatus is every stage's status, in order.
+func pipelineStatus() []stageStatus {
+	pipelineStats.Lock()
+	defer pipelineStats.Unlock()
+	queued := map[string]int{}
+	for pl := range pipelineStats.running {
+		for stage, n := range pl.queued() {
+			queued[stage] += n
+		}
+	}
+	var status []stageStatus
+	for _, name := range pipelineStages {
+		s := stageStatus{Stage: name, Workers: stageWorkers(name), Queued: queued[name]}
+		if t, ok := pipelineStats.stages[name]; ok {
+			s.Records, s.BusySeconds = t.Records, t.Busy.Seconds()
+			if s.BusySeconds > 0 {
+				s.PerSecond = float64(s.Records) / s.BusySeconds
+			}
+		}
+		status = append(status, s)
+	}
+	return status
+}
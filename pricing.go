@@ -0,0 +1,143 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Every accepted enrollment is given a fee schedule, written to
+// ero_pricing (sql/022_pricing.sql) when it is loaded - or approved, if it
+// was held for review. "pricing.rules" picks it from the prior-year volume
+// tier (see prioryear.go) and the bank product (PriorYearInfo.Bank); the
+// first rule that matches wins, and a rule without tiers or banks matches
+// anything:
+//
+//	"pricing": {
+//	  "rules": [
+//	    {"schedule": "PREMIER", "tiers": ["high"], "banks": ["TPG"]},
+//	    {"schedule": "VOLUME", "tiers": ["high", "medium"]},
+//	    {"schedule": "STANDARD"}
+//	  ]
+//	}
+//
+// With no rules nothing is assigned. A record no rule matches gets no
+// schedule and a log line.
+
+type pricingRule struct {
+	Schedule string   `mapstructure:"schedule"`
+	Tiers    []string `mapstructure:"tiers"`
+	Banks    []string `mapstructure:"banks"`
+}
+
+// loadPricingRules reads and checks pricing.rules.
+func loadPricingRules(cfg *viper.Viper) ([]pricingRule, error) {
+	var rules []pricingRule
+	if err := cfg.UnmarshalKey("pricing.rules", &rules); err != nil {
+		return nil, fmt.Errorf("config: pricing.rules: %v", err)
+	}
+	for i, r := range rules {
+		if r.Schedule == "" || len(r.Schedule) > 40 {
+			return nil, fmt.Errorf("config: pricing rule %d needs a schedule of up to 40 characters", i+1)
+		}
+	}
+	return rules, nil
+}
+
+func (r pricingRule) matches(tier, bank string) bool {
+	return matchesAny(r.Tiers, tier) && matchesAny(r.Banks, bank)
+}
+
+// matchesAny reports whether v is one of values, ignoring case, or values
+// is empty.
+func matchesAny(values []string, v string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, x := range values {
+		if strings.EqualFold(strings.TrimSpace(x), strings.TrimSpace(v)) {
+			return true
+		}
+	}
+	return false
+}
+
+// assignPricing gives record id the schedule of the first rule matching
+// its tier and bank. It returns the schedule, "" if none matched.
+func assignPricing(p preparer, rules []pricingRule, id int64, tier, bank string) (string, error) {
+	for n, r := range rules {
+		if !r.matches(tier, bank) {
+			continue
+		}
+		stmt, err := prepare(p, "pricing.set")
+		if err != nil {
+			return "", err
+		}
+		defer stmt.Close()
+
+		now := time.Now()
+		args := []interface{}{id, r.Schedule, nullString(tier), nullString(bank), n + 1, now}
+		if !viper.GetBool("mssql.storedprocedures") {
+			args = append(args, r.Schedule, nullString(tier), nullString(bank), n+1, now) // for the INSERT
+		}
+		_, err = stmt.Exec(args...)
+		return r.Schedule, err
+	}
+	return "", nil
+}
+
+// priceApproved assigns the schedule of a record approved in review, from
+// what was stored with it, by the pricing rules of the version that
+// judged it (see rules.go).
+func priceApproved(db *sql.DB, id int64) error {
+	stmt, err := prepare(db, "pricing.inputs")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	var tier, bank, version string
+	if err := stmt.QueryRow(id).Scan(&tier, &bank, &version); err != nil {
+		return err
+	}
+	rules, err := rulesetPricing(version)
+	if err != nil || len(rules) == 0 {
+		return err
+	}
+	_, err = assignPricing(db, rules, id, tier, bank)
+	return err
+}
+
+// price assigns the schedule of record i, loaded as id, by rules.
+func (job *batchJob) price(p preparer, rules []pricingRule, i int, id int64, py *priorYearInfo, e Enrollment) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	tier := ""
+	if py != nil {
+		tier = py.Tier
+	}
+	schedule, err := assignPricing(p, rules, id, tier, e.PriorYearInfo.Bank)
+	if err == nil && schedule == "" {
+		job.logRecordf(i, "Record %d (ID %d): no pricing rule matches tier %q, bank %q\n", i, id, tier, e.PriorYearInfo.Bank)
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// The watcher's queue has two lanes. Urgent files - re-enrollments that
+// someone is waiting on - are loaded before bulk ones such as backfills,
+// oldest first within each lane. A file is urgent if:
+//
+//   - its name matches watch.priority.pattern (by default it contains
+//     "urgent" or "rush" as a word, e.g. ERO20160104_URGENT.xml), or
+//   - an operator bumped it (POST /v1/admin/priority, or requeue with
+//     "priority": true), or
+//   - any record's MasterEfin is in watch.priority.masterefins.
+func init() {
+	viper.SetDefault("watch.priority.pattern", `(?i)(^|[._-])(urgent|rush)([._-]|$)`)
+	viper.SetDefault("watch.priority.masterefins", []string{})
+}
+
+// priorities decides which lane a queued file is in.
+type priorities struct {
+	pattern *regexp.Regexp
+	masters map[string]bool
+
+	mu      sync.Mutex
+	bumped  map[string]bool        // by an operator, by file name
+	scanned map[string]scannedFile // by file name
+}
+
+// scannedFile is what we learned from reading a queued file, cached so we
+// only read each file once while it waits.
+type scannedFile struct {
+	mod         time.Time
+	size        int64
+	urgent      bool // a record's MasterEfin is on the list
+	transmitter string
+}
+
+func newPriorities() (*priorities, error) {
+	p := &priorities{masters: map[string]bool{}, bumped: map[string]bool{}, scanned: map[string]scannedFile{}}
+
+	if s := viper.GetString("watch.priority.pattern"); s != "" {
+		re, err := compilePattern(s) // see patterns.go
+		if err != nil {
+			return nil, fmt.Errorf("config: watch.priority.pattern: %v", err)
+		}
+		p.pattern = re
+	}
+	for _, m := range viper.GetStringSlice("watch.priority.masterefins") {
+		p.masters[strings.TrimSpace(m)] = true
+	}
+	return p, nil
+}
+
+// urgent reports whether the file in dir is in the urgent lane.
+func (p *priorities) urgent(dir, name string) bool {
+	if p.pattern != nil && p.pattern.MatchString(strings.TrimSuffix(name, filepath.Ext(name))) {
+		return true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bumped[name] {
+		return true
+	}
+	if len(p.masters) == 0 {
+		return false
+	}
+	return p.scanLocked(dir, name).urgent
+}
+
+// scan reads (or recalls) a queued file.
+func (p *priorities) scan(dir, name string) scannedFile {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.scanLocked(dir, name)
+}
+
+func (p *priorities) scanLocked(dir, name string) scannedFile {
+	path := filepath.Join(dir, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return scannedFile{}
+	}
+	if s, ok := p.scanned[name]; ok && s.mod.Equal(info.ModTime()) && s.size == info.Size() {
+		return s
+	}
+
+	// Unreadable files aren't urgent; loading them will report why.
+	s := scannedFile{mod: info.ModTime(), size: info.Size()}
+	if f, err := readInputFile(path); err == nil {
+		s.transmitter = f.Transmitter()
+		for _, e := range f.Records {
+			if p.masters[strings.TrimSpace(e.MasterEfin)] {
+				s.urgent = true
+				break
+			}
+		}
+	}
+	p.scanned[name] = s
+	return s
+}
+
+// bump puts a file in the urgent lane.
+func (p *priorities) bump(name string) {
+	p.mu.Lock()
+	p.bumped[name] = true
+	p.mu.Unlock()
+}
+
+// forget drops what we know about a file once it has left the inbox.
+func (p *priorities) forget(name string) {
+	p.mu.Lock()
+	delete(p.bumped, name)
+	delete(p.scanned, name)
+	p.mu.Unlock()
+}
+
+var errNotQueued = errors.New("no such file in the inbox")
+
+// prioritize moves a queued file to the urgent lane.
+func (w *watcher) prioritize(name string) error {
+	name = filepath.Base(name)
+	if _, err := os.Stat(filepath.Join(w.inbox, name)); err != nil {
+		return errNotQueued
+	}
+	w.lanes.bump(name)
+	w.poke()
+	return nil
+}
@@ -0,0 +1,301 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// While loading, each record's EFIN is looked up in our own prior-year
+// data (sql/020_prior_year.sql): whether we had an accepted record for it
+// last year, the bank that makes it by our records, and its return volume
+// and volume tier. What we find is stored with the record, and the
+// record's PriorYearInfo claims are checked against it:
+//
+//	"prioryear": {
+//	  "enabled": true,
+//	  "ourbank": "TPG",
+//	  "mismatch": "flag",
+//	  "tiers": [{"name": "high", "min": 1000}, {"name": "medium", "min": 250}, {"name": "low", "min": 0}]
+//	}
+//
+// ClientOfYoursLastYear must agree with whether it is a returning
+// customer (when the element was sent), and if ourbank is set a Bank of
+// ourbank must mean it is one. A mismatch is flagged for review ("flag"),
+// rejected with PRIOR_YEAR_MISMATCH ("reject") or only warned about in the
+// ACK ("warn"). Either way it is written to prior_year_discrepancy
+// (sql/021_prior_year_discrepancies.sql) for "enroll report
+// discrepancies". The tier is the first, by highest min, the volume
+// reaches.
+func init() {
+	viper.SetDefault("prioryear.enabled", true)
+	viper.SetDefault("prioryear.ourbank", "")
+	viper.SetDefault("prioryear.mismatch", "flag")
+}
+
+// errPriorYearMismatch is the code for a claim our prior-year data
+// contradicts.
+const errPriorYearMismatch = "PRIOR_YEAR_MISMATCH"
+
+type volumeTier struct {
+	Name string `mapstructure:"name"`
+	Min  int64  `mapstructure:"min"`
+}
+
+// priorYearPolicy is the checked prioryear config; nil if it is off.
+type priorYearPolicy struct {
+	ourBank  string
+	collate  *collations
+	mismatch string
+	tiers    []volumeTier // highest min first
+}
+
+func loadPriorYearPolicy(cfg *viper.Viper, c *collations) (*priorYearPolicy, error) {
+	if !cfg.GetBool("prioryear.enabled") {
+		return nil, nil
+	}
+	p := &priorYearPolicy{
+		ourBank:  strings.ToUpper(strings.TrimSpace(cfg.GetString("prioryear.ourbank"))),
+		collate:  c,
+		mismatch: cfg.GetString("prioryear.mismatch"),
+	}
+	switch p.mismatch {
+	case "flag", "reject", "warn":
+	default:
+		return nil, fmt.Errorf("config: prioryear.mismatch must be flag, reject or warn (got %q)", p.mismatch)
+	}
+	if err := cfg.UnmarshalKey("prioryear.tiers", &p.tiers); err != nil {
+		return nil, fmt.Errorf("config: prioryear.tiers: %v", err)
+	}
+	for _, t := range p.tiers {
+		if t.Name == "" || len(t.Name) > 20 {
+			return nil, fmt.Errorf("config: prioryear.tiers: every tier needs a name of up to 20 characters (got %q)", t.Name)
+		}
+	}
+	sort.SliceStable(p.tiers, func(i, j int) bool { return p.tiers[i].Min > p.tiers[j].Min })
+	return p, nil
+}
+
+// priorYearInfo is what we know of an EFIN from last year.
+type priorYearInfo struct {
+	Returning bool
+	Bank      string // ourbank if it is returning; "" if we don't know
+	Volume    sql.NullInt64
+	Tier      string
+}
+
+// lookup finds what we know of efin from the year before year, the tax
+// year of the record we load.
+func (p *priorYearPolicy) lookup(db preparer, efin string, year int) (*priorYearInfo, error) {
+	if p == nil {
+		return nil, nil
+	}
+	stmt, err := prepare(db, "ero.prior_year")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	efin, prior := strings.TrimSpace(efin), year-1
+	var py priorYearInfo
+	if err := stmt.QueryRow(efin, prior, efin, prior).Scan(&py.Returning, &py.Volume); err != nil {
+		return nil, err
+	}
+	if py.Returning {
+		py.Bank = p.ourBank
+	}
+	if py.Volume.Valid {
+		for _, t := range p.tiers {
+			if py.Volume.Int64 >= t.Min {
+				py.Tier = t.Name
+				break
+			}
+		}
+	}
+	return &py, nil
+}
+
+// priorYearDiscrepancy is a claim our prior-year data contradicts.
+type priorYearDiscrepancy struct {
+	Index   int // position in the file, from 0
+	EFIN    string
+	Field   string
+	Claimed string
+	Actual  string // by our records
+	Message string
+}
+
+func (d priorYearDiscrepancy) recordError() recordError {
+	return recordError{Field: d.Field, Code: errPriorYearMismatch, Message: d.Message,
+		Args: map[string]string{"claimed": d.Claimed, "actual": d.Actual}}
+}
+
+// verify checks record i's PriorYearInfo claims against py. Whether
+// ClientOfYoursLastYear was sent is in present.
+func (p *priorYearPolicy) verify(py *priorYearInfo, i int, e Enrollment, present fieldSet) []priorYearDiscrepancy {
+	if p == nil || py == nil {
+		return nil
+	}
+	var found []priorYearDiscrepancy
+	if claimed := e.PriorYearInfo.ClientOfYoursLastYear; present.has("PriorYearInfo.ClientOfYoursLastYear") && claimed != py.Returning {
+		found = append(found, priorYearDiscrepancy{Index: i, EFIN: e.EFIN, Field: "PriorYearInfo.ClientOfYoursLastYear",
+			Claimed: fmt.Sprint(claimed), Actual: fmt.Sprint(py.Returning),
+			Message: fmt.Sprintf("claims ClientOfYoursLastYear %t, but by our records it is %t", claimed, py.Returning)})
+	}
+	bank := strings.ToUpper(strings.TrimSpace(e.PriorYearInfo.Bank))
+	if p.ourBank != "" && p.collate.equal("PriorYearInfo.Bank", bank, p.ourBank) && !py.Returning {
+		found = append(found, priorYearDiscrepancy{Index: i, EFIN: e.EFIN, Field: "PriorYearInfo.Bank", Claimed: bank,
+			Message: fmt.Sprintf("claims prior year bank %s, but we have no record of it last year", bank)})
+	}
+	return found
+}
+
+// rejects and flags report what a mismatch does to the record.
+func (p *priorYearPolicy) rejects() bool {
+	return p != nil && p.mismatch == "reject"
+}
+
+func (p *priorYearPolicy) flags() bool {
+	return p != nil && p.mismatch == "flag"
+}
+
+// Discrepancy outcomes, for prior_year_discrepancy.
+const (
+	discrepancyRejected = "rejected"
+	discrepancyFlagged  = "flagged"
+	discrepancyWarned   = "warned"
+)
+
+// recordDiscrepancies writes the batch's discrepancies, each with what
+// became of its record.
+func recordDiscrepancies(db *sql.DB, job *batchJob, summary loadSummary) error {
+	if len(summary.Discrepancies) == 0 {
+		return nil
+	}
+	loaded := map[int]loadedRecord{}
+	for _, r := range summary.Loaded {
+		loaded[r.Index] = r
+	}
+
+	stmt, err := prepare(db, "discrepancy.add")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	now := time.Now()
+	seen := map[string]bool{} // a record retried after a failover is verified twice
+	for _, d := range summary.Discrepancies {
+		key := fmt.Sprintf("%d/%s", d.Index, d.Field)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		outcome, id := discrepancyRejected, interface{}(nil)
+		if r, ok := loaded[d.Index]; ok {
+			outcome, id = discrepancyWarned, r.ID
+			if r.Flagged != "" && job.rulesByVersion(r.Ruleset).Prior.flags() {
+				outcome = discrepancyFlagged
+			}
+		}
+		if _, err := stmt.Exec(job.ID, nullString(job.File.Transmitter()), d.Index, nullString(d.EFIN), id, d.Field,
+			nullString(d.Claimed), nullString(d.Actual), outcome, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// store writes py to the record's prior-year columns.
+func (py *priorYearInfo) store(db preparer, id int64) error {
+	if py == nil {
+		return nil
+	}
+	var volume, tier interface{}
+	if py.Volume.Valid {
+		volume = py.Volume.Int64
+	}
+	if py.Tier != "" {
+		tier = py.Tier
+	}
+	stmt, err := prepare(db, "ero.enrich")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(py.Returning, nullString(py.Bank), volume, tier, id)
+	return err
+}
+
+var (
+	discrepanciesTransmitter string
+	discrepanciesSince       string
+)
+
+var discrepanciesCmd = &cobra.Command{
+	Use:   "discrepancies",
+	Short: "Prior-year claims our records contradict, per transmitter",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		since, err := time.Parse("2006-01-02", discrepanciesSince)
+		if err != nil {
+			check(fmt.Errorf("--since: %v", err))
+		}
+
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		stmt, err := prepare(dbs.reader(), "discrepancy.list")
+		check(err)
+		defer stmt.Close()
+
+		rows, err := stmt.Query(since, discrepanciesTransmitter, discrepanciesTransmitter)
+		check(err)
+		defer rows.Close()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "TRANSMITTER\tWHEN\tBATCH\tEFIN\tFIELD\tCLAIMED\tOURS\tOUTCOME")
+		for rows.Next() {
+			var (
+				when                                               time.Time
+				transmitter, efin, field, claimed, actual, outcome string
+				batch                                              int64
+			)
+			check(rows.Scan(&when, &transmitter, &batch, &efin, &field, &claimed, &actual, &outcome))
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n", transmitter, when.Format("2006-01-02 15:04"), batch, efin, field, claimed, actual, outcome)
+		}
+		check(rows.Err())
+		check(w.Flush())
+	},
+}
+
+func init() {
+	yearStart := time.Date(time.Now().Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	discrepanciesCmd.Flags().StringVar(&discrepanciesTransmitter, "transmitter", "", "only this transmitter ID")
+	discrepanciesCmd.Flags().StringVar(&discrepanciesSince, "since", yearStart.Format("2006-01-02"), "first day to include (YYYY-MM-DD)")
+	reportCmd.AddCommand(discrepanciesCmd)
+}
@@ -0,0 +1,167 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// With --profile (or "profile": true in the config) a run leaves, in
+// artifacts.dir/profile-<time>/:
+//
+//	cpu.pprof    CPU profile of the whole run
+//	heap.pprof   heap profile at the end of it
+//	stages.txt   per file: records, and the time spent parsing the
+//	             file, in each record stage (see pipeline.go), and
+//	             loading the file end to end
+//
+// Look at the profiles with "go tool pprof". A run that dies on an error
+// leaves no profiles.
+func init() {
+	rootCmd.PersistentFlags().Bool("profile", false, "write CPU/heap profiles and stage timings to artifacts.dir")
+	check(viper.BindPFlag("profile", rootCmd.PersistentFlags().Lookup("profile")))
+	viper.SetDefault("artifacts.dir", "./artifacts")
+}
+
+// Stages timed with --profile, besides the record stages.
+const (
+	stageParse = "parse" // the whole of readInputFile
+	stageLoad  = "load"  // the whole of loadFile
+)
+
+// fileStages is the time spent on one file, by stage.
+type fileStages struct {
+	File    string
+	Records int
+	Took    map[string]time.Duration
+}
+
+var profiling struct {
+	sync.Mutex
+	on     bool
+	dir    string
+	cpu    *os.File
+	files  map[string]*fileStages
+	order  []string
+	closed bool
+}
+
+// startProfiling starts the CPU profile if --profile is set. It runs once
+// the config is read.
+func startProfiling() {
+	if !viper.GetBool("profile") {
+		return
+	}
+	dir := filepath.Join(viper.GetString("artifacts.dir"), "profile-"+time.Now().Format("20060102-150405"))
+	check(os.MkdirAll(dir, 0750))
+	cpu, err := os.Create(filepath.Join(dir, "cpu.pprof"))
+	check(err)
+	check(pprof.StartCPUProfile(cpu))
+
+	profiling.Lock()
+	defer profiling.Unlock()
+	profiling.on, profiling.dir, profiling.cpu = true, dir, cpu
+	profiling.files = map[string]*fileStages{}
+}
+
+// stopProfiling writes what --profile collected. main calls it once the
+// command is done.
+func stopProfiling() {
+	profiling.Lock()
+	defer profiling.Unlock()
+	if !profiling.on || profiling.closed {
+		return
+	}
+	profiling.closed = true
+
+	pprof.StopCPUProfile()
+	if err := profiling.cpu.Close(); err != nil {
+		log.Printf("profile: %v", err)
+	}
+	if err := writeHeapProfile(filepath.Join(profiling.dir, "heap.pprof")); err != nil {
+		log.Printf("profile: %v", err)
+	}
+	if err := writeStages(filepath.Join(profiling.dir, "stages.txt")); err != nil {
+		log.Printf("profile: %v", err)
+	}
+	fmt.Printf("Profile: %s\n", profiling.dir)
+}
+
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	runtime.GC() // up to date statistics
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeStages writes the stage timings, a file a line. The caller holds
+// profiling's lock.
+func writeStages(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(f, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tRECORDS\tPARSE\tNORMALIZE\tVALIDATE\tENRICH\tWRITE\tLOAD")
+	for _, name := range profiling.order {
+		s := profiling.files[name]
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n", s.File, s.Records, s.Took[stageParse],
+			s.Took[stageNormalize], s.Took[stageValidate], s.Took[stageEnrich], s.Took[stageWrite], s.Took[stageLoad])
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// timeStage adds the time since started to file's stage. It does nothing
+// without --profile, and is meant to be deferred or called as a stage
+// ends. Each validate counts as a record. The record stages' workers
+// overlap, so their times can add up to more than the load's.
+func timeStage(file, stage string, started time.Time) {
+	profiling.Lock()
+	defer profiling.Unlock()
+	if !profiling.on || profiling.closed {
+		return
+	}
+	s, ok := profiling.files[file]
+	if !ok {
+		s = &fileStages{File: file, Took: map[string]time.Duration{}}
+		profiling.files[file] = s
+		profiling.order = append(profiling.order, file)
+	}
+	s.Took[stage] += time.Since(started)
+	if stage == stageValidate {
+		s.Records++
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// A file the watcher can't decode at all - it won't gunzip, or isn't
+// well-formed XML - isn't worth retrying, so rather than going to
+// watch.failed with the files an operator might requeue it is moved to
+// watch.quarantine, next to a <name>.diagnostic.txt describing what went
+// wrong: the error, where in the file (line and byte offset, when known)
+// and a hex dump of the first bytes and of the bytes around the offset.
+// Ops are told through notify.email.to and notify.slack.webhook. With
+// storage.key set both files are encrypted; read them with "enroll
+// decrypt".
+func init() {
+	viper.SetDefault("watch.quarantine", "./inbox/quarantine")
+}
+
+// How much of a quarantined file the diagnostic shows.
+const (
+	diagnosticHead    = 256
+	diagnosticContext = 64
+)
+
+// quarantineFile moves an undecodable file out of the inbox and writes its
+// diagnostic. It returns an error only if the file couldn't be moved.
+func (w *watcher) quarantineFile(name string, de *decodeError) error {
+	path := filepath.Join(w.inbox, name)
+	dest := filepath.Join(w.quarantine, name)
+	if err := os.Rename(path, dest); err != nil {
+		return err
+	}
+	if err := sealFile(dest); err != nil {
+		log.Printf("encrypting %s: %v", dest, err)
+	}
+
+	// The hex dumps can show SSNs, so the diagnostic is encrypted too.
+	diag := dest + ".diagnostic.txt"
+	if err := writeSealed(diag, []byte(diagnostic(name, de)), 0640); err != nil {
+		log.Printf("writing %s: %v", diag, err)
+	}
+	log.Printf("Quarantined %s: %v\n", name, de)
+	metricCount("watch.quarantined", 1, tag("stage", de.Stage))
+	notifyOps("enroll: quarantined "+name,
+		fmt.Sprintf("%s could not be decoded (%s: %v) and was moved to %s. See %s.", name, de.Stage, de.Err, w.quarantine, diag))
+	return nil
+}
+
+// diagnostic describes why a file couldn't be decoded.
+func diagnostic(name string, de *decodeError) string {
+	var b strings.Builder
+	sum := sha256.Sum256(de.Head)
+	fmt.Fprintf(&b, "File:        %s\n", name)
+	fmt.Fprintf(&b, "Size:        %d bytes\n", len(de.Head))
+	fmt.Fprintf(&b, "SHA-256:     %s\n", hex.EncodeToString(sum[:]))
+	fmt.Fprintf(&b, "Quarantined: %s\n", stamp().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Stage:       %s\n", de.Stage)
+	fmt.Fprintf(&b, "Error:       %v\n", de.Err)
+	if de.Line > 0 {
+		fmt.Fprintf(&b, "Line:        %d\n", de.Line)
+	}
+	if de.Offset >= 0 {
+		where := ""
+		if bytes.HasPrefix(de.Head, gzipMagic) {
+			where = " (of the decompressed content)"
+		}
+		fmt.Fprintf(&b, "Offset:      %d%s\n", de.Offset, where)
+	}
+
+	head := de.Head
+	if len(head) > diagnosticHead {
+		head = head[:diagnosticHead]
+	}
+	fmt.Fprintf(&b, "\nFirst %d bytes:\n%s", len(head), hex.Dump(head))
+
+	if de.Offset >= 0 && len(de.Content) > 0 {
+		from, to := de.Offset-diagnosticContext, de.Offset+diagnosticContext
+		if from < 0 {
+			from = 0
+		}
+		if to > int64(len(de.Content)) {
+			to = int64(len(de.Content))
+		}
+		fmt.Fprintf(&b, "\nBytes %d to %d:\n%s", from, to, hexDumpAt(de.Content[from:to], from))
+	}
+	return b.String()
+}
+
+// hexDumpAt is hex.Dump with offsets starting at base.
+func hexDumpAt(data []byte, base int64) string {
+	var b strings.Builder
+	for i := 0; i < len(data); i += 16 {
+		end := i + 16
+		if end > len(data) {
+			end = len(data)
+		}
+		line := hex.Dump(data[i:end])
+		// hex.Dump numbers lines from 0; put the real offset in.
+		fmt.Fprintf(&b, "%08x%s", base+int64(i), line[8:])
+	}
+	return b.String()
+}
+
+// A record the load can't finish - a database error writing it, or
+// reading what it needs to be checked - used to stop the whole file. With
+// load.quarantine.enabled (the default) it is rejected with the error
+// instead and the load carries on with the next record. The record is
+// written to load.quarantine.dir as an enrollment file of its own,
+// <file>.batch<ID>.record<N>.xml, ready to load again once the problem
+// is fixed, next to a <...>.reason.txt saying what went wrong. With
+// storage.key set both are encrypted. Losing the database isn't the
+// record's fault, so it still stops the load, which resumes from the
+// checkpoint (failover.go).
+//
+// This is for when inserts commit one at a time (load.transaction
+// "none", or a failed "batch" being loaded again), and each record's
+// writes then go in a transaction of their own, so a record that fails
+// half way leaves nothing behind. In a file transaction with savepoints
+// a record that fails to write is rolled back and rejected as before,
+// and quarantined too; without savepoints any error still rolls back the
+// file.
+func init() {
+	viper.SetDefault("load.quarantine.enabled", true)
+	viper.SetDefault("load.quarantine.dir", "./quarantine")
+}
+
+// quarantines reports whether a record written through p that failed
+// with err is quarantined rather than stop the load. In a file
+// transaction it isn't: with savepoints the record is rolled back and
+// rejected anyway, and without them the file is rolled back.
+func quarantines(p preparer, err error) bool {
+	if !viper.GetBool("load.quarantine.enabled") || isFailoverError(err) || errors.Is(err, errClaimed) {
+		return false
+	}
+	_, ok := p.(*sql.DB)
+	return ok
+}
+
+// beginRecord is where a record's writes go: a transaction of its own if
+// p is the database itself, so the ero row and its parts (parts.go)
+// commit together, or else p, the file's transaction. end
+// commits that transaction, or rolls it back if err isn't nil, and
+// returns err or the commit's error. A transaction of its own runs in
+// ctx.
+func beginRecord(ctx context.Context, p preparer) (w preparer, end func(err error) error, err error) {
+	db, ok := p.(*sql.DB)
+	if !ok {
+		return p, func(err error) error { return err }, nil
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tx, func(err error) error {
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}, nil
+}
+
+// quarantineRecord writes record i, rejected as r because of err, to the
+// quarantine directory and notes where in r. A record that can't be
+// written there is still rejected; the log says so.
+func quarantineRecord(job *batchJob, r *rejectedRecord, err error) {
+	if !viper.GetBool("load.quarantine.enabled") {
+		return
+	}
+	metricCount("load.quarantined", 1)
+	dir := viper.GetString("load.quarantine.dir")
+	if mkErr := os.MkdirAll(dir, 0750); mkErr != nil {
+		job.logRecordf(r.Index, "quarantining record %d: %v", r.Index, mkErr)
+		return
+	}
+	base := strings.TrimSuffix(filepath.Base(job.File.Path), filepath.Ext(job.File.Path))
+	path := filepath.Join(dir, fmt.Sprintf("%s.batch%d.record%d.xml", base, job.ID, r.Index))
+
+	// The record as it arrived, not as the load changed it.
+	var e Enrollment
+	if r.Index < len(job.File.Records) {
+		e = job.File.Records[r.Index]
+	}
+	content, encErr := encodeRecords([]Enrollment{e}, []fieldSet{job.File.present(r.Index)}) // see triage.go
+	if encErr == nil {
+		encErr = writeSealed(path, content, 0640) // see atrest.go
+	}
+	if encErr != nil {
+		job.logRecordf(r.Index, "quarantining record %d: %v", r.Index, encErr)
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "File:        %s\n", job.File.Path)
+	fmt.Fprintf(&b, "Batch:       %d\n", job.ID)
+	fmt.Fprintf(&b, "Record:      %d\n", r.Index)
+	fmt.Fprintf(&b, "EFIN:        %s\n", r.EFIN)
+	fmt.Fprintf(&b, "Correlation: %s\n", job.recordCorrelation(r.Index))
+	fmt.Fprintf(&b, "Quarantined: %s\n", stamp().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Reason:      %s\n", r.Reason())
+	fmt.Fprintf(&b, "Error:       %v\n", err)
+	reason := strings.TrimSuffix(path, ".xml") + ".reason.txt"
+	if wErr := writeSealed(reason, []byte(b.String()), 0640); wErr != nil {
+		job.logRecordf(r.Index, "writing %s: %v", reason, wErr)
+	}
+	r.Quarantined = path
+	job.logRecordf(r.Index, "Record %d quarantined to %s\n", r.Index, path)
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// In daemon mode the watcher loads up to watch.workers files at once. So
+// that one vendor's massive backfill can't take every worker, or flood
+// the database, each transmitter is held to
+//
+//	watch.limits.maxfiles           files loading at once (default 1)
+//	watch.limits.recordsperminute   records loaded a minute (0 = no limit)
+//
+// overridable per vendor as watch.transmitters.<id>.maxfiles and
+// watch.transmitters.<id>.recordsperminute. Files over a transmitter's
+// limit wait in the queue while other vendors' files go ahead. Command
+// line loads aren't limited.
+func init() {
+	viper.SetDefault("watch.workers", 2)
+	viper.SetDefault("watch.limits.maxfiles", 1)
+	viper.SetDefault("watch.limits.recordsperminute", 0)
+}
+
+// transmitterLimit reads a per-transmitter limit, falling back to the
+// default in watch.limits.
+func transmitterLimit(transmitter, name string) int {
+	key := "watch.transmitters." + transmitter + "." + name
+	if transmitter != "" && viper.IsSet(key) {
+		return viper.GetInt(key)
+	}
+	return viper.GetInt("watch.limits." + name)
+}
+
+// transmitterQuotas tracks what each transmitter is using.
+type transmitterQuotas struct {
+	mu      sync.Mutex
+	loading map[string]int // files loading, by transmitter
+	records *rateLimiter
+}
+
+func newTransmitterQuotas() *transmitterQuotas {
+	return &transmitterQuotas{loading: map[string]int{}, records: newRateLimiter()}
+}
+
+// startFile takes one of the transmitter's file slots, or reports false if
+// they are all in use. Give it back with doneFile.
+func (q *transmitterQuotas) startFile(transmitter string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	max := transmitterLimit(transmitter, "maxfiles")
+	if max > 0 && q.loading[transmitter] >= max {
+		return false
+	}
+	q.loading[transmitter]++
+	return true
+}
+
+func (q *transmitterQuotas) doneFile(transmitter string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.loading[transmitter]--; q.loading[transmitter] <= 0 {
+		delete(q.loading, transmitter)
+	}
+}
+
+// pacer returns a batchJob.Pace that holds the transmitter to its records
+// per minute, shared across all its files. The bucket allows a few
+// seconds' worth of records in a burst.
+func (q *transmitterQuotas) pacer(transmitter string) func() {
+	perMinute := float64(transmitterLimit(transmitter, "recordsperminute"))
+	if perMinute <= 0 {
+		return nil
+	}
+	burst := perMinute / 12
+	return func() {
+		for {
+			ok, wait := q.records.take(transmitter, perMinute, burst)
+			if ok {
+				return
+			}
+			time.Sleep(wait)
+		}
+	}
+}
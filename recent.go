@@ -0,0 +1,142 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// The ways into serve deliver at least once, not exactly once: a vendor
+// submits again when a response times out, the same file is dropped in
+// the inbox twice, the offline spool loads a file that had got in after
+// all. So serve remembers the records it has loaded lately - by EFIN,
+// processing year and a hash of the record and the fields it had - and
+// a record it loaded in the last dedup.recent.window (1h) is passed over
+// before it gets near the database. It remembers at most
+// dedup.recent.size (100,000) of them, forgetting the longest ago first;
+// 0 turns this off. Records are remembered once they have committed, so
+// a file rolled back is loaded again in full. The one-off load doesn't
+// do this: there is nothing to remember from.
+func init() {
+	viper.SetDefault("dedup.recent.size", 100000)
+	viper.SetDefault("dedup.recent.window", "1h")
+}
+
+// recent is the records loaded lately; nil, remembering nothing, except
+// in serve.
+var recent *recentRecords
+
+// recentKey identifies a record for recentRecords.
+type recentKey struct {
+	EFIN string
+	Year string
+	Hash [sha256.Size]byte
+}
+
+type recentEntry struct {
+	key    recentKey
+	loaded time.Time
+}
+
+// recentRecords is an LRU of the records loaded in the last window.
+type recentRecords struct {
+	mu      sync.Mutex
+	size    int
+	window  time.Duration
+	order   *list.List // of *recentEntry, the latest at the front
+	entries map[recentKey]*list.Element
+}
+
+// newRecentRecords sets up the records to remember, from the config. It
+// returns nil if dedup.recent.size is 0.
+func newRecentRecords() (*recentRecords, error) {
+	size := viper.GetInt("dedup.recent.size")
+	if size <= 0 {
+		return nil, nil
+	}
+	window, err := configDuration("dedup.recent.window")
+	if err != nil {
+		return nil, err
+	}
+	return &recentRecords{size: size, window: window, order: list.New(), entries: map[recentKey]*list.Element{}}, nil
+}
+
+// recentKeyOf is the key for record i of f.
+func recentKeyOf(f inputFile, i int) recentKey {
+	e := f.Records[i]
+	var fields []string
+	for name := range f.present(i) {
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	return recentKey{
+		EFIN: strings.TrimSpace(e.EFIN),
+		Year: strings.TrimSpace(e.ProcessingYear),
+		Hash: sha256.Sum256([]byte(fmt.Sprintf("%#v %q", e, fields))),
+	}
+}
+
+// seen reports whether the record with key k was loaded in the last
+// window.
+func (r *recentRecords) seen(k recentKey) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	el, ok := r.entries[k]
+	if !ok {
+		return false
+	}
+	if time.Since(el.Value.(*recentEntry).loaded) > r.window {
+		r.order.Remove(el)
+		delete(r.entries, k)
+		return false
+	}
+	return true
+}
+
+// remember adds the records summary says job loaded.
+func (r *recentRecords) remember(job *batchJob, summary loadSummary) {
+	if r == nil {
+		return
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, l := range summary.Loaded {
+		k := recentKeyOf(job.File, l.Index)
+		if el, ok := r.entries[k]; ok {
+			el.Value.(*recentEntry).loaded = now
+			r.order.MoveToFront(el)
+			continue
+		}
+		r.entries[k] = r.order.PushFront(&recentEntry{key: k, loaded: now})
+		for r.order.Len() > r.size {
+			oldest := r.order.Back()
+			r.order.Remove(oldest)
+			delete(r.entries, oldest.Value.(*recentEntry).key)
+		}
+	}
+}
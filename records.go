@@ -0,0 +1,367 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/csv" // https://golang.org/pkg/encoding/csv/
+	"encoding/hex"
+	"encoding/xml" // https://golang.org/pkg/encoding/xml/
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dstroot/go_enrollment/enrollment"
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// The record types are the enrollment package's; these are their names
+// here.
+type (
+	OfficeInfo            = enrollment.OfficeInfo
+	OwnerInformation      = enrollment.OwnerInformation
+	EFINOwnerInfo         = enrollment.EFINOwnerInfo
+	PriorYearInfo         = enrollment.PriorYearInfo
+	Enrollment            = enrollment.Enrollment
+	EnrollmentCollection  = enrollment.EnrollmentCollection
+	ValidOfficeInfo       = enrollment.ValidOfficeInfo
+	ValidOwnerInformation = enrollment.ValidOwnerInformation
+	ValidEFINOwnerInfo    = enrollment.ValidEFINOwnerInfo
+	ValidPriorYearInfo    = enrollment.ValidPriorYearInfo
+	ValidEnrollment       = enrollment.ValidEnrollment
+)
+
+// Enrollment files are the IRS XML, CSV laid out as the enrollment
+// package's csv.go describes, or JSON as its json.go does. All three are
+// decoded into the same records, so the rest of the load doesn't know the
+// difference. "input.format" (or --format) is xml, csv or json for every
+// file; auto, the default, goes by each file's extension (.xml, .csv or
+// .json, maybe .gz) and failing that by its first character. Columns a
+// CSV header leaves out, and keys a JSON record leaves out, are missing
+// from the record, as left-out elements are from an XML one (see
+// amend.go).
+func init() {
+	viper.SetDefault("input.format", "auto")
+	rootCmd.PersistentFlags().String("format", "auto", "enrollment file format: auto, xml, csv or json")
+	check(viper.BindPFlag("input.format", rootCmd.PersistentFlags().Lookup("format")))
+}
+
+// A file is read into memory whole, and decoded into records that stay
+// there while it loads, so a delivery that is far too big could take the
+// loader down part way through. input.maxbytes (256 MB) caps the file as
+// delivered and, if it is gzipped, what it unzips to; input.maxrecords
+// (1,000,000) caps the records in it. A file over either limit is turned
+// away as soon as we know - a file's size before any of it is read, the
+// records as soon as the parser gets past the limit - with a
+// *tooLargeError saying which limit and by how much. 0 means no limit.
+// The SHA-256 that identifies the file is worked out as it is read.
+func init() {
+	viper.SetDefault("input.maxbytes", 256<<20)
+	viper.SetDefault("input.maxrecords", 1000000)
+}
+
+// A file's header and trailer, if it has them, say how many records it
+// has, a checksum of them and their processing year (see the enrollment
+// package's header.go). They are checked once the file is parsed, so a
+// file that doesn't match them fails before anything is loaded. With
+// input.requireheader every XML and JSON file must have one.
+func init() {
+	viper.SetDefault("input.requireheader", false)
+}
+
+// errNoHeader is a file without a header or trailer when
+// input.requireheader is set.
+var errNoHeader = errors.New("the file has no FileHeader or FileTrailer, and input.requireheader is set")
+
+// checkHeaders checks the records against the file's headers.
+func checkHeaders(format string, headers []enrollment.FileHeader, records []Enrollment) error {
+	if len(headers) == 0 && format != "csv" && viper.GetBool("input.requireheader") {
+		return errNoHeader
+	}
+	for _, h := range headers {
+		if err := h.Check(records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tooLargeError is a file over one of the intake limits.
+type tooLargeError struct {
+	Path  string
+	What  string // "bytes", "bytes unzipped" or "records"
+	Limit int64
+	Size  int64 // how big it is, or -1 if we stopped counting at the limit
+}
+
+func (e *tooLargeError) Error() string {
+	if e.Size < 0 {
+		return fmt.Sprintf("%s: too large: more than the limit of %d %s", e.Path, e.Limit, e.What)
+	}
+	return fmt.Sprintf("%s: too large: %d %s, the limit is %d", e.Path, e.Size, e.What, e.Limit)
+}
+
+// readInputFile reads and parses an enrollment file.
+func readInputFile(path string) (inputFile, error) {
+	format := viper.GetString("input.format")
+	if format != "auto" && format != "xml" && format != "csv" && format != "json" {
+		return inputFile{}, fmt.Errorf("config: input.format must be auto, xml, csv or json (got %q)", format)
+	}
+	maxBytes, maxRecords := viper.GetInt64("input.maxbytes"), viper.GetInt("input.maxrecords")
+
+	started := time.Now()
+	defer timeStage(path, stageParse, started) // see profile.go
+	xmlFile, err := os.Open(path)
+	if err != nil {
+		return inputFile{}, err
+	}
+	defer xmlFile.Close()
+
+	// When the file landed in the inbox, for the SLA reports.
+	info, err := xmlFile.Stat()
+	if err != nil {
+		return inputFile{}, err
+	}
+	if maxBytes > 0 && info.Size() > maxBytes {
+		metricCount("input.toolarge", 1, tag("limit", "bytes"))
+		return inputFile{}, &tooLargeError{Path: path, What: "bytes", Limit: maxBytes, Size: info.Size()}
+	}
+
+	// The buffer goes back to the pool when we're done, unless a
+	// decodeError holds on to it.
+	buf := getBuffer() // see buffers.go
+	keep := false
+	defer func() {
+		if !keep {
+			putBuffer(buf)
+		}
+	}()
+	buf.Grow(int(info.Size()) + bytes.MinRead)
+	in := chaosInput(path, xmlFile, info.Size()) // see chaos.go
+	if maxBytes > 0 {
+		in = io.LimitReader(in, maxBytes+1) // it may still be growing
+	}
+	h := sha256.New()
+	if _, err := buf.ReadFrom(io.TeeReader(in, h)); err != nil {
+		return inputFile{}, err
+	}
+	if maxBytes > 0 && int64(buf.Len()) > maxBytes {
+		metricCount("input.toolarge", 1, tag("limit", "bytes"))
+		return inputFile{}, &tooLargeError{Path: path, What: "bytes", Limit: maxBytes, Size: -1}
+	}
+	b := buf.Bytes()
+	// Files we keep are encrypted at rest (see atrest.go); the checksum
+	// is of the file as it was delivered.
+	sum := h.Sum(nil)
+	if bytes.HasPrefix(b, sealedMagic) {
+		if b, err = unseal(b); err != nil {
+			return inputFile{}, fmt.Errorf("%s: %v", path, err)
+		}
+		plain := sha256.Sum256(b)
+		sum = plain[:]
+	}
+
+	// Some transmitters gzip their files; the checksum is still of the
+	// file as delivered.
+	content := b
+	if bytes.HasPrefix(b, gzipMagic) {
+		if content, err = gunzip(b, maxBytes); err != nil {
+			var tooLarge *tooLargeError
+			if errors.As(err, &tooLarge) {
+				tooLarge.Path = path
+				metricCount("input.toolarge", 1, tag("limit", "unzipped"))
+				return inputFile{}, tooLarge
+			}
+			keep = true
+			return inputFile{}, &decodeError{Path: path, Stage: "gzip", Offset: -1, Head: b, Err: err}
+		}
+	}
+	read := time.Since(started)
+
+	if format == "auto" {
+		format = sniffFormat(path, content)
+	}
+
+	var records []Enrollment
+	var present []fieldSet
+	var headers []enrollment.FileHeader
+	line := 0 // where it couldn't be decoded, if it can't and we know
+	limit := enrollment.MaxRecords(maxRecords)
+	switch format {
+	case "csv":
+		var columns []string
+		records, columns, err = enrollment.ParseCSV(bytes.NewReader(content), limit)
+		line = csvLineOf(err)
+		present = csvPresence(columns, len(records))
+
+	case "json":
+		var fields [][]string
+		records, fields, err = enrollment.ParseJSON(bytes.NewReader(content), limit, enrollment.Headers(&headers))
+		var parse *enrollment.ParseError
+		if errors.As(err, &parse) {
+			line = lineAt(content, parse.Offset)
+		}
+		present = make([]fieldSet, len(fields))
+		for i, names := range fields {
+			present[i] = fieldSet{}
+			for _, name := range names {
+				present[i][name] = true
+			}
+		}
+
+	default:
+		records, err = enrollment.Parse(bytes.NewReader(content), limit, enrollment.Headers(&headers))
+		var syntax *xml.SyntaxError
+		if errors.As(err, &syntax) {
+			line = lineOf(syntax)
+		} else if err == nil {
+			// Which fields each record had, for partial amendments (amend.go).
+			if present, err = presence(content); err != nil {
+				return inputFile{}, fmt.Errorf("%s: %v", path, err)
+			}
+		}
+	}
+	if errors.Is(err, enrollment.ErrTooManyRecords) {
+		metricCount("input.toolarge", 1, tag("limit", "records"))
+		return inputFile{}, &tooLargeError{Path: path, What: "records", Limit: int64(maxRecords), Size: -1}
+	}
+	if err != nil {
+		// CSV and JSON files that don't decode are broken; an XML file
+		// is if it isn't well-formed.
+		var parse *enrollment.ParseError
+		if errors.As(err, &parse) && (format != "xml" || line > 0 || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)) {
+			keep = true
+			return inputFile{}, &decodeError{Path: path, Stage: format, Offset: parse.Offset, Line: line, Head: b, Content: content, Err: parse.Err}
+		}
+		return inputFile{}, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := checkHeaders(format, headers, records); err != nil {
+		metricCount("input.headermismatch", 1)
+		return inputFile{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(present) != len(records) {
+		present = nil
+	}
+	fileDecoded(len(records), read, time.Since(started)-read) // see pipeline.go
+
+	// The checksum identifies the file for checkpoints and batches.
+	return inputFile{Path: path, SHA256: hex.EncodeToString(sum), Arrived: info.ModTime(), Records: records, Present: present}, nil
+}
+
+// sniffFormat is the format of the file at path, with the given content:
+// from its extension (ignoring .gz), or if that says nothing, from its
+// first character.
+func sniffFormat(path string, content []byte) string {
+	name := strings.TrimSuffix(strings.ToLower(path), ".gz")
+	switch filepath.Ext(name) {
+	case ".xml":
+		return "xml"
+	case ".csv":
+		return "csv"
+	case ".json":
+		return "json"
+	}
+	switch c := bytes.TrimLeft(bytes.TrimPrefix(content, []byte("\ufeff")), " \t\r\n"); {
+	case bytes.HasPrefix(c, []byte("[")), bytes.HasPrefix(c, []byte("{")):
+		return "json"
+	case bytes.HasPrefix(c, []byte("<")), len(c) == 0:
+		return "xml"
+	}
+	return "csv"
+}
+
+// lineAt is the line offset is on in content, from 1.
+func lineAt(content []byte, offset int64) int {
+	if offset < 0 || offset > int64(len(content)) {
+		return 0
+	}
+	return bytes.Count(content[:offset], []byte("\n")) + 1
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// gunzip unzips b, or returns a *tooLargeError if it unzips to more than
+// max bytes (if max isn't 0).
+func gunzip(b []byte, max int64) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if max <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err == nil && int64(len(content)) > max {
+		return nil, &tooLargeError{What: "bytes unzipped", Limit: max, Size: -1}
+	}
+	return content, err
+}
+
+// decodeError is a file we can't decode at all - it doesn't decompress,
+// or isn't well-formed XML, CSV or JSON - as opposed to one whose records
+// are merely invalid. The watcher quarantines these (see quarantine.go).
+type decodeError struct {
+	Path    string
+	Stage   string // gzip, xml, csv or json
+	Offset  int64  // into the decompressed content; -1 if unknown
+	Line    int    // 0 if unknown
+	Head    []byte // the file as delivered
+	Content []byte // the decompressed content, for xml, csv and json errors
+	Err     error
+}
+
+func (e *decodeError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", e.Path, e.Stage, e.Err)
+}
+
+func lineOf(err *xml.SyntaxError) int {
+	if err == nil {
+		return 0
+	}
+	return err.Line
+}
+
+func csvLineOf(err error) int {
+	var parse *csv.ParseError
+	if errors.As(err, &parse) {
+		return parse.Line
+	}
+	return 0
+}
+
+// csvPresence is the fields each of n records from a CSV file had: the
+// header's columns, or all of them if there was no header.
+func csvPresence(columns []string, n int) []fieldSet {
+	if columns == nil {
+		return nil
+	}
+	present := make([]fieldSet, n)
+	for i := range present {
+		present[i] = fieldSet{}
+		for _, c := range columns {
+			present[i][c] = true
+		}
+	}
+	return present
+}
@@ -0,0 +1,213 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reference data - the bank list, the approved EFIN list, the
+// transmitters we accept files from and the state codes - is kept in
+// versioned snapshots (see sql/003_batches_refdata.sql and
+// sql/035_refdata_management.sql), loaded by "enroll refdata load"
+// (refdataload.go). Every batch records which version of each list it was
+// validated against, so when we replay an old batch we can validate it
+// against exactly the same data instead of whatever is current, and get
+// the same answer. A version takes effect from its EFFECTIVE_FROM; a batch
+// uses the latest version of each list in effect when it starts.
+//
+// A list with no snapshots at all (version 0) isn't checked.
+
+// refVersions identifies the reference data used for a batch.
+type refVersions struct {
+	Banks        int64 `json:"banks"`
+	EFINs        int64 `json:"efins"`
+	Transmitters int64 `json:"transmitters,omitempty"`
+	States       int64 `json:"states,omitempty"`
+}
+
+// String is the versions for the log.
+func (v refVersions) String() string {
+	return fmt.Sprintf("bank list v%d, EFIN list v%d, transmitter list v%d, state list v%d", v.Banks, v.EFINs, v.Transmitters, v.States)
+}
+
+// refData is one version of the reference lists, loaded into memory.
+type refData struct {
+	Versions     refVersions
+	banks        map[string]bool // codes and names, as collation keys
+	efins        map[string]bool
+	transmitters map[string]bool
+	states       map[string]bool
+	collate      *collations // see collation.go
+}
+
+// currentRefVersions returns the latest snapshot of each list that is in
+// effect.
+func currentRefVersions(db *sql.DB) (refVersions, error) {
+	var v refVersions
+	now := time.Now()
+	for list, version := range map[string]*int64{
+		"banks": &v.Banks, "efins": &v.EFINs, "transmitters": &v.Transmitters, "states": &v.States,
+	} {
+		var err error
+		if *version, err = latestRefVersion(db, list, now); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+func latestRefVersion(db *sql.DB, list string, at time.Time) (int64, error) {
+	stmt, err := prepare(db, "refdata.latest")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var version int64
+	if err := stmt.QueryRow(list, at).Scan(&version); err != nil {
+		return 0, fmt.Errorf("reading %s reference version: %v", list, err)
+	}
+	return version, nil
+}
+
+// loadRefData reads the given versions of the reference lists. Records
+// are matched against them as the ero columns compare (c).
+func loadRefData(db *sql.DB, v refVersions, c *collations) (*refData, error) {
+	r := &refData{Versions: v, banks: map[string]bool{}, efins: map[string]bool{},
+		transmitters: map[string]bool{}, states: map[string]bool{}, collate: c}
+
+	if v.Banks > 0 {
+		err := queryStrings(db, "refdata.banks", v.Banks, func(code, name string) {
+			r.banks[c.key("PriorYearInfo.Bank", strings.TrimSpace(code))] = true
+			r.banks[c.key("PriorYearInfo.Bank", strings.TrimSpace(name))] = true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading bank list version %d: %v", v.Banks, err)
+		}
+	}
+
+	if v.EFINs > 0 {
+		err := queryStrings(db, "refdata.efins", v.EFINs, func(efin, _ string) {
+			r.efins[c.key("EFIN", strings.TrimSpace(efin))] = true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading EFIN list version %d: %v", v.EFINs, err)
+		}
+	}
+
+	if v.Transmitters > 0 {
+		err := queryStrings(db, "refdata.transmitters", v.Transmitters, func(id, _ string) {
+			r.transmitters[c.key("TransmitterID", strings.TrimSpace(id))] = true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading transmitter list version %d: %v", v.Transmitters, err)
+		}
+	}
+
+	if v.States > 0 {
+		err := queryStrings(db, "refdata.states", v.States, func(code, _ string) {
+			r.states[strings.ToUpper(strings.TrimSpace(code))] = true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading state list version %d: %v", v.States, err)
+		}
+	}
+
+	return r, nil
+}
+
+// queryStrings runs a two-column reference query for a version.
+func queryStrings(db *sql.DB, name string, version int64, fn func(a, b string)) error {
+	stmt, err := prepare(db, name)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(version)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a, b string
+		if err := rows.Scan(&a, &b); err != nil {
+			return err
+		}
+		fn(a, b)
+	}
+	return rows.Err()
+}
+
+// check validates an enrollment against the reference lists and returns
+// any problems found.
+func (r *refData) check(e Enrollment) []recordError {
+	var problems []recordError
+
+	if r.Versions.EFINs > 0 && !r.efins[r.collate.key("EFIN", strings.TrimSpace(e.EFIN))] {
+		problems = append(problems, recordError{
+			Field:   "EFIN",
+			Code:    errEFINNotApproved,
+			Message: fmt.Sprintf("EFIN %s is not on the approved EFIN list (version %d)", e.EFIN, r.Versions.EFINs),
+			Args:    map[string]string{"efin": e.EFIN, "version": strconv.FormatInt(r.Versions.EFINs, 10)},
+		})
+	}
+
+	bank := r.collate.key("PriorYearInfo.Bank", strings.TrimSpace(e.PriorYearInfo.Bank))
+	if r.Versions.Banks > 0 && bank != "" && !r.banks[bank] {
+		problems = append(problems, recordError{
+			Field:   "PriorYearInfo.Bank",
+			Code:    errBankUnknown,
+			Message: fmt.Sprintf("prior year bank %q is not on the bank list (version %d)", e.PriorYearInfo.Bank, r.Versions.Banks),
+			Args:    map[string]string{"bank": e.PriorYearInfo.Bank, "version": strconv.FormatInt(r.Versions.Banks, 10)},
+		})
+	}
+
+	if r.Versions.Transmitters > 0 && !r.transmitters[r.collate.key("TransmitterID", strings.TrimSpace(e.TransmitterID))] {
+		problems = append(problems, recordError{
+			Field:   "TransmitterID",
+			Code:    errTransmitterUnknown,
+			Message: fmt.Sprintf("transmitter %q is not on the transmitter list (version %d)", e.TransmitterID, r.Versions.Transmitters),
+			Args:    map[string]string{"transmitter": e.TransmitterID, "version": strconv.FormatInt(r.Versions.Transmitters, 10)},
+		})
+	}
+
+	if r.Versions.States > 0 {
+		for _, s := range []struct{ field, state string }{
+			{"OfficeInfo.State", e.OfficeInfo.State},
+			{"OwnerInformation.State", e.OwnerInformation.State},
+			{"EFINOwnerInfo.State", e.EFINOwnerInfo.State},
+		} {
+			field, state := s.field, strings.ToUpper(strings.TrimSpace(s.state))
+			if state != "" && !r.states[state] {
+				problems = append(problems, recordError{
+					Field:   field,
+					Code:    errStateUnknown,
+					Message: fmt.Sprintf("%s %q is not a state code on the state list (version %d)", field, state, r.Versions.States),
+					Args:    map[string]string{"state": state, "version": strconv.FormatInt(r.Versions.States, 10)},
+				})
+			}
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,549 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// The reference lists (refdata.go) used to be kept up by hand in SSMS.
+// "enroll refdata load LIST [SOURCE]" loads a new version of one from a
+// CSV file or an API:
+//
+//	enroll refdata load banks banks.csv --effective 2016-01-15
+//	enroll refdata load transmitters https://partners.example.com/transmitters
+//
+// SOURCE is a file or an http(s) URL, refdata.<list>.source if left out.
+// A .json file, or a URL that answers application/json, is an array of
+// objects; anything else is a CSV with a header row. Either way the
+// fields are named as below, others are ignored:
+//
+//	banks         code, name
+//	efins         efin
+//	transmitters  id, name
+//	states        code, name
+//
+// refdata.token, if set, is sent to a URL as a bearer token (an env: or
+// file: reference, see secrets.go); a fetch gives up after
+// refdata.timeout (30s).
+//
+// The new rows are compared with the latest version and the differences
+// printed; with --dry-run that is all, and a source with no differences
+// isn't loaded unless --force. The version takes effect at --effective
+// (a date, or an RFC 3339 time; now if not given), so a list can be
+// loaded ahead of the day it applies from. Versions are never changed
+// once loaded. "enroll refdata list" shows them, and "enroll refdata
+// diff LIST" compares two.
+func init() {
+	for _, l := range refLists {
+		viper.SetDefault("refdata."+l.Name+".source", "")
+	}
+	viper.SetDefault("refdata.token", "")
+	viper.SetDefault("refdata.timeout", "30s")
+}
+
+// refList is a reference list "enroll refdata" looks after. Its rows are
+// read with the statement "refdata.<Name>" and added with
+// "refdata.<Name>.add".
+type refList struct {
+	Name  string                  // refdata_version.LIST
+	Key   string                  // the field with the code
+	Label string                  // the field with its name; "" if it has none
+	Check func(key string) string // what's wrong with a code, if anything
+}
+
+var refLists = []refList{
+	{"banks", "code", "name", maxLength(20)},
+	{"efins", "efin", "", func(key string) string {
+		if len(key) != 6 || strings.IndexFunc(key, func(r rune) bool { return !unicode.IsDigit(r) }) >= 0 {
+			return "is not six digits"
+		}
+		return ""
+	}},
+	{"transmitters", "id", "name", maxLength(20)},
+	{"states", "code", "name", func(key string) string {
+		if len(key) != 2 {
+			return "is not a two-letter code"
+		}
+		return ""
+	}},
+}
+
+// maxLength checks that a code fits its column.
+func maxLength(n int) func(key string) string {
+	return func(key string) string {
+		if len(key) > n {
+			return fmt.Sprintf("is longer than %d characters", n)
+		}
+		return ""
+	}
+}
+
+// refListNamed is the list called name.
+func refListNamed(name string) (refList, error) {
+	names := make([]string, 0, len(refLists))
+	for _, l := range refLists {
+		if l.Name == name {
+			return l, nil
+		}
+		names = append(names, l.Name)
+	}
+	return refList{}, fmt.Errorf("unknown reference list %q (use %s)", name, strings.Join(names, ", "))
+}
+
+// readRefSource reads l's rows, code -> name, from a file or URL.
+func readRefSource(l refList, src string) (map[string]string, error) {
+	var b []byte
+	asJSON := strings.EqualFold(filepath.Ext(strings.SplitN(src, "?", 2)[0]), ".json")
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		var err error
+		var contentType string
+		if b, contentType, err = fetchRefSource(src); err != nil {
+			return nil, err
+		}
+		asJSON = asJSON || strings.Contains(contentType, "json")
+	} else {
+		var err error
+		if b, err = os.ReadFile(src); err != nil {
+			return nil, err
+		}
+	}
+
+	var records []map[string]string
+	var err error
+	if asJSON {
+		records, err = jsonRefRecords(b)
+	} else {
+		records, err = csvRefRecords(b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", src, err)
+	}
+
+	rows := map[string]string{}
+	for n, r := range records {
+		key := strings.TrimSpace(r[l.Key])
+		if l.Name == "states" {
+			key = strings.ToUpper(key)
+		}
+		if key == "" {
+			return nil, fmt.Errorf("%s: row %d has no %s", src, n+1, l.Key)
+		}
+		if problem := l.Check(key); problem != "" {
+			return nil, fmt.Errorf("%s: row %d: %s %q %s", src, n+1, l.Key, key, problem)
+		}
+		if _, dup := rows[key]; dup {
+			return nil, fmt.Errorf("%s: %s %q is listed twice", src, l.Key, key)
+		}
+		rows[key] = ""
+		if l.Label != "" {
+			rows[key] = truncate(strings.TrimSpace(r[l.Label]), 100)
+		}
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%s: there are no rows in it", src)
+	}
+	return rows, nil
+}
+
+// fetchRefSource GETs a reference list from an API.
+func fetchRefSource(url string) ([]byte, string, error) {
+	timeout, err := configDuration("refdata.timeout")
+	if err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", "application/json, text/csv")
+	if ref := viper.GetString("refdata.token"); ref != "" {
+		token, err := secretValue(ref)
+		if err != nil {
+			return nil, "", fmt.Errorf("config: refdata.token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	b, err := io.ReadAll(resp.Body)
+	return b, resp.Header.Get("Content-Type"), err
+}
+
+// csvRefRecords reads a CSV with a header row, field names lowered.
+func csvRefRecords(b []byte) ([]map[string]string, error) {
+	r := csv.NewReader(bytes.NewReader(b))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading the header: %v", err)
+	}
+	var records []map[string]string
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rec := map[string]string{}
+		for i, name := range header {
+			if i < len(row) {
+				rec[strings.ToLower(strings.TrimSpace(name))] = row[i]
+			}
+		}
+		records = append(records, rec)
+	}
+}
+
+// jsonRefRecords reads an array of objects, field names lowered.
+func jsonRefRecords(b []byte) ([]map[string]string, error) {
+	var objects []map[string]interface{}
+	if err := json.Unmarshal(b, &objects); err != nil {
+		return nil, err
+	}
+	records := make([]map[string]string, len(objects))
+	for i, o := range objects {
+		records[i] = map[string]string{}
+		for k, v := range o {
+			if v != nil {
+				records[i][strings.ToLower(k)] = fmt.Sprint(v)
+			}
+		}
+	}
+	return records, nil
+}
+
+// readRefVersion reads a stored version of l; none for version 0.
+func readRefVersion(db *sql.DB, l refList, version int64) (map[string]string, error) {
+	rows := map[string]string{}
+	if version == 0 {
+		return rows, nil
+	}
+	err := queryStrings(db, "refdata."+l.Name, version, func(key, name string) {
+		rows[strings.TrimSpace(key)] = strings.TrimSpace(name)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading %s version %d: %v", l.Name, version, err)
+	}
+	return rows, nil
+}
+
+// maxRefVersion is l's latest version, in effect or not.
+func maxRefVersion(p preparer, l refList) (int64, error) {
+	stmt, err := prepare(p, "refdata.max")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	var version int64
+	err = stmt.QueryRow(l.Name).Scan(&version)
+	return version, err
+}
+
+// refChange is a row that differs between two versions of a list.
+type refChange struct {
+	Key      string
+	Old, New string
+}
+
+// refDiff is how one version of a list differs from another.
+type refDiff struct {
+	Added, Removed, Changed []refChange // by code
+}
+
+func (d refDiff) empty() bool {
+	return len(d.Added)+len(d.Removed)+len(d.Changed) == 0
+}
+
+// diffRefRows compares two versions of a list.
+func diffRefRows(old, cur map[string]string) refDiff {
+	var d refDiff
+	for k, v := range cur {
+		was, ok := old[k]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, refChange{Key: k, New: v})
+		case was != v:
+			d.Changed = append(d.Changed, refChange{Key: k, Old: was, New: v})
+		}
+	}
+	for k, v := range old {
+		if _, ok := cur[k]; !ok {
+			d.Removed = append(d.Removed, refChange{Key: k, Old: v})
+		}
+	}
+	for _, c := range [][]refChange{d.Added, d.Removed, d.Changed} {
+		sort.Slice(c, func(i, j int) bool { return c[i].Key < c[j].Key })
+	}
+	return d
+}
+
+// print writes the differences, one row a line.
+func (d refDiff) print(w io.Writer) {
+	for _, c := range d.Added {
+		fmt.Fprintf(w, "+ %s\t%s\n", c.Key, c.New)
+	}
+	for _, c := range d.Removed {
+		fmt.Fprintf(w, "- %s\t%s\n", c.Key, c.Old)
+	}
+	for _, c := range d.Changed {
+		fmt.Fprintf(w, "~ %s\t%q -> %q\n", c.Key, c.Old, c.New)
+	}
+	fmt.Fprintf(w, "%d added, %d removed, %d changed\n", len(d.Added), len(d.Removed), len(d.Changed))
+}
+
+// storeRefVersion loads rows as the next version of l, in one
+// transaction, and returns the version.
+func storeRefVersion(db *sql.DB, l refList, rows map[string]string, effective time.Time, source, by string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	latest, err := maxRefVersion(tx, l)
+	if err != nil {
+		return 0, err
+	}
+	version := latest + 1
+	if _, err := execStatement(tx, "refdata.version.add", l.Name, version, effective, truncate(source, 400), truncate(by, 128), len(rows)); err != nil {
+		return 0, err
+	}
+
+	stmt, err := prepare(tx, "refdata."+l.Name+".add")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	keys := make([]string, 0, len(rows))
+	for k := range rows {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args := []interface{}{version, k}
+		if l.Label != "" {
+			args = append(args, rows[k])
+		}
+		if _, err := stmt.Exec(args...); err != nil {
+			return 0, fmt.Errorf("%s %s: %v", l.Key, k, err)
+		}
+	}
+	return version, tx.Commit()
+}
+
+// parseEffective reads --effective: a date, an RFC 3339 time or nothing
+// (now).
+func parseEffective(s string) (time.Time, error) {
+	if s == "" {
+		return time.Now(), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("--effective must be a date (2016-01-15) or an RFC 3339 time (got %q)", s)
+	}
+	return t, nil
+}
+
+// ---------------------------------------------------------------------
+// enroll refdata load / diff / list
+
+var (
+	refdataEffective string
+	refdataDryRun    bool
+	refdataForce     bool
+	refdataFrom      int64
+	refdataTo        int64
+)
+
+var refdataCmd = &cobra.Command{
+	Use:   "refdata",
+	Short: "Load and inspect reference data",
+}
+
+var refdataLoadCmd = &cobra.Command{
+	Use:   "load LIST [SOURCE]",
+	Short: "Load a new version of a reference list from a CSV file or an API",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		l, err := refListNamed(args[0])
+		check(err)
+		src := viper.GetString("refdata." + l.Name + ".source")
+		if len(args) > 1 {
+			src = args[1]
+		}
+		if src == "" {
+			check(fmt.Errorf("no SOURCE given and refdata.%s.source is not set", l.Name))
+		}
+		effective, err := parseEffective(refdataEffective)
+		check(err)
+		rows, err := readRefSource(l, src)
+		check(err)
+
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		latest, err := maxRefVersion(dbs.primary, l)
+		check(err)
+		old, err := readRefVersion(dbs.primary, l, latest)
+		check(err)
+		d := diffRefRows(old, rows)
+		fmt.Printf("%s: %s against version %d\n", l.Name, src, latest)
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		d.print(w)
+		check(w.Flush())
+		if refdataDryRun {
+			return
+		}
+		if d.empty() && latest > 0 && !refdataForce {
+			fmt.Println("No differences; nothing loaded (use --force to load it anyway).")
+			return
+		}
+
+		version, err := storeRefVersion(dbs.primary, l, rows, effective, src, currentUser())
+		check(err)
+		fmt.Printf("Loaded %s version %d: %d rows, in effect from %s\n", l.Name, version, len(rows), effective.Format(time.RFC3339))
+	},
+}
+
+var refdataDiffCmd = &cobra.Command{
+	Use:   "diff LIST",
+	Short: "Compare two versions of a reference list",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		l, err := refListNamed(args[0])
+		check(err)
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		// By default, what is in effect against the latest.
+		to := refdataTo
+		if to == 0 {
+			to, err = maxRefVersion(dbs.reader(), l)
+			check(err)
+		}
+		from := refdataFrom
+		if from == 0 {
+			from, err = latestRefVersion(dbs.reader(), l.Name, time.Now())
+			check(err)
+			if from == to && from > 1 {
+				from--
+			}
+		}
+		old, err := readRefVersion(dbs.reader(), l, from)
+		check(err)
+		rows, err := readRefVersion(dbs.reader(), l, to)
+		check(err)
+		fmt.Printf("%s: version %d against version %d\n", l.Name, to, from)
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		diffRefRows(old, rows).print(w)
+		check(w.Flush())
+	},
+}
+
+var refdataListCmd = &cobra.Command{
+	Use:   "list [LIST]",
+	Short: "List the versions of the reference lists; * marks the ones in effect",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		list := ""
+		if len(args) > 0 {
+			l, err := refListNamed(args[0])
+			check(err)
+			list = l.Name
+		}
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+		current, err := currentRefVersions(dbs.reader())
+		check(err)
+		inEffect := map[string]int64{"banks": current.Banks, "efins": current.EFINs, "transmitters": current.Transmitters, "states": current.States}
+
+		stmt, err := prepare(dbs.reader(), "refdata.versions")
+		check(err)
+		defer stmt.Close()
+		rows, err := stmt.Query(list, list)
+		check(err)
+		defer rows.Close()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "LIST\tVERSION\tEFFECTIVE\tLOADED\tROWS\tBY\tSOURCE")
+		for rows.Next() {
+			var (
+				name, source, by sql.NullString
+				version          int64
+				effective        sql.NullTime
+				loaded           time.Time
+				count            sql.NullInt64
+			)
+			check(rows.Scan(&name, &version, &effective, &loaded, &count, &source, &by))
+			mark := ""
+			if inEffect[name.String] == version {
+				mark = "*"
+			}
+			from := "-"
+			if effective.Valid {
+				from = effective.Time.Format("2006-01-02 15:04")
+			}
+			rowCount := "-"
+			if count.Valid {
+				rowCount = fmt.Sprint(count.Int64)
+			}
+			fmt.Fprintf(w, "%s\t%d%s\t%s\t%s\t%s\t%s\t%s\n", name.String, version, mark, from, loaded.Format("2006-01-02 15:04"), rowCount, by.String, source.String)
+		}
+		check(rows.Err())
+		check(w.Flush())
+	},
+}
+
+func init() {
+	refdataLoadCmd.Flags().StringVar(&refdataEffective, "effective", "", "when the version takes effect: a date or an RFC 3339 time (default now)")
+	refdataLoadCmd.Flags().BoolVar(&refdataDryRun, "dry-run", false, "show the differences without loading anything")
+	refdataLoadCmd.Flags().BoolVar(&refdataForce, "force", false, "load a new version even if nothing has changed")
+	refdataDiffCmd.Flags().Int64Var(&refdataFrom, "from", 0, "version to compare from (default the one in effect)")
+	refdataDiffCmd.Flags().Int64Var(&refdataTo, "to", 0, "version to compare to (default the latest)")
+	refdataCmd.AddCommand(refdataLoadCmd, refdataDiffCmd, refdataListCmd)
+	rootCmd.AddCommand(refdataCmd)
+}
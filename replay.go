@@ -0,0 +1,76 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+)
+
+// "enroll replay --batch N" loads an old batch's file again as a new batch.
+// With --refdata snapshot the records are validated against the reference
+// data the original batch used, so the replay reproduces the original
+// accept/reject decisions even if the bank or EFIN lists have moved on.
+
+var (
+	replayBatch   int64
+	replayRefdata string
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay",
+	Short: "Load an earlier batch's file again",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if replayBatch == 0 {
+			check(fmt.Errorf("--batch is required"))
+		}
+		if replayRefdata != "current" && replayRefdata != "snapshot" {
+			check(fmt.Errorf("--refdata must be current or snapshot"))
+		}
+		check(requireStorageKey()) // see atrest.go
+
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		orig, err := getBatch(dbs.primary, replayBatch)
+		check(err)
+
+		f, err := readInputFile(orig.FileName)
+		check(err)
+		if f.SHA256 != orig.SHA256 {
+			check(fmt.Errorf("%s has changed since batch %d was loaded (sha256 %s, was %s)", orig.FileName, orig.ID, f.SHA256, orig.SHA256))
+		}
+
+		job := &batchJob{File: f, ReplayOf: orig.ID}
+		if replayRefdata == "snapshot" {
+			job.Pinned = &orig.Versions
+		}
+
+		summary, err := loadFile(dbs, job)
+		check(err)
+		summary.print()
+	},
+}
+
+func init() {
+	replayCmd.Flags().Int64Var(&replayBatch, "batch", 0, "batch to replay")
+	replayCmd.Flags().StringVar(&replayRefdata, "refdata", "current", "validate against current reference data or the original batch's snapshot")
+
+	rootCmd.AddCommand(replayCmd)
+}
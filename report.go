@@ -0,0 +1,107 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+)
+
+// "enroll report ..." groups the read-only reports. Like status and list
+// they run against the replica when there is one.
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Reports built from the batch and statistics tables",
+}
+
+var (
+	trendsTransmitter string
+	trendsSince       string
+	trendsTop         int
+	trendsMonthly     bool
+)
+
+var errorTrendsCmd = &cobra.Command{
+	Use:   "error-trends",
+	Short: "Which fields and error codes fail most often, per transmitter",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		since, err := time.Parse("2006-01-02", trendsSince)
+		if err != nil {
+			check(fmt.Errorf("--since: %v", err))
+		}
+
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		db := dbs.reader()
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+		if trendsMonthly {
+			stmt, err := prepare(db, "error_stats.trends")
+			check(err)
+			defer stmt.Close()
+
+			rows, err := stmt.Query(since, trendsTransmitter, trendsTransmitter)
+			check(err)
+			defer rows.Close()
+
+			fmt.Fprintln(w, "TRANSMITTER\tMONTH\tFIELD\tCODE\tERRORS")
+			for rows.Next() {
+				var transmitter, field, code string
+				var month time.Time
+				var n int
+				check(rows.Scan(&transmitter, &field, &code, &month, &n))
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", transmitter, month.Format("2006-01"), field, code, n)
+			}
+			check(rows.Err())
+		} else {
+			stmt, err := prepare(db, "error_stats.top")
+			check(err)
+			defer stmt.Close()
+
+			rows, err := stmt.Query(trendsTop, since, trendsTransmitter, trendsTransmitter)
+			check(err)
+			defer rows.Close()
+
+			fmt.Fprintln(w, "TRANSMITTER\tFIELD\tCODE\tERRORS")
+			for rows.Next() {
+				var transmitter, field, code string
+				var n int
+				check(rows.Scan(&transmitter, &field, &code, &n))
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", transmitter, field, code, n)
+			}
+			check(rows.Err())
+		}
+		check(w.Flush())
+	},
+}
+
+func init() {
+	yearStart := time.Date(time.Now().Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	errorTrendsCmd.Flags().StringVar(&trendsTransmitter, "transmitter", "", "only this transmitter ID")
+	errorTrendsCmd.Flags().StringVar(&trendsSince, "since", yearStart.Format("2006-01-02"), "first day to include (YYYY-MM-DD)")
+	errorTrendsCmd.Flags().IntVar(&trendsTop, "top", 25, "how many field/code combinations to show")
+	errorTrendsCmd.Flags().BoolVar(&trendsMonthly, "monthly", false, "break the counts down by month")
+
+	reportCmd.AddCommand(errorTrendsCmd)
+	rootCmd.AddCommand(reportCmd)
+}
@@ -0,0 +1,168 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// How hard we retry depends on what failed. Each class has its own
+// policy, retry.<class>:
+//
+//	network   file transfers: return files and the EOD report over SFTP or S3
+//	database  reconnecting to SQL Server after a failover or outage
+//	api       outbound HTTP calls: webhooks, PagerDuty/Opsgenie, Slack
+//
+// with
+//
+//	tries       attempts in all (0: no limit, only maxelapsed)
+//	backoff     the first wait; each later wait doubles...
+//	maxbackoff  ...up to this
+//	maxelapsed  give up once this long has passed since the first attempt
+//	            (0: no limit, only tries)
+//
+// The older settings delivery.tries, webhooktries and
+// mssql.failover.timeout are still honoured when the new ones aren't
+// set.
+var retryDefaults = map[string]retryPolicy{
+	"network":  {Tries: 3, Backoff: time.Second, MaxBackoff: 30 * time.Second},
+	"database": {Tries: 0, Backoff: time.Second, MaxBackoff: 16 * time.Second, MaxElapsed: 2 * time.Minute},
+	"api":      {Tries: 3, Backoff: time.Second, MaxBackoff: 30 * time.Second, MaxElapsed: time.Minute},
+}
+
+// legacyRetryKeys maps a policy setting to the key it used to be.
+var legacyRetryKeys = map[string]string{
+	"retry.network.tries":       "delivery.tries",
+	"retry.api.tries":           "webhooktries",
+	"retry.database.maxelapsed": "mssql.failover.timeout",
+}
+
+// retryPolicy is how often, and for how long, to retry one class of
+// failure.
+type retryPolicy struct {
+	Class      string
+	Tries      int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	MaxElapsed time.Duration
+}
+
+// retryPolicyFor returns the configured policy for a failure class.
+func retryPolicyFor(class string) retryPolicy {
+	p := retryDefaults[class]
+	p.Class = class
+
+	key := func(name string) (string, bool) {
+		k := "retry." + class + "." + name
+		if viper.IsSet(k) {
+			return k, true
+		}
+		if old, ok := legacyRetryKeys[k]; ok && viper.IsSet(old) {
+			return old, true
+		}
+		return "", false
+	}
+	duration := func(name string, d *time.Duration) {
+		if k, ok := key(name); ok {
+			v, err := time.ParseDuration(viper.GetString(k))
+			if err != nil {
+				log.Printf("config: %s: %v; using %v", k, err, *d)
+				return
+			}
+			*d = v
+		}
+	}
+
+	if k, ok := key("tries"); ok {
+		p.Tries = viper.GetInt(k)
+	}
+	duration("backoff", &p.Backoff)
+	duration("maxbackoff", &p.MaxBackoff)
+	duration("maxelapsed", &p.MaxElapsed)
+
+	if p.Tries <= 0 && p.MaxElapsed <= 0 {
+		p.Tries = 1 // no limit at all would retry forever
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = time.Second
+	}
+	return p
+}
+
+// next returns how long to wait after the nth failed attempt, the first
+// of which was at started, or false if it's time to give up.
+func (p retryPolicy) next(n int, started time.Time) (time.Duration, bool) {
+	if p.Tries > 0 && n >= p.Tries {
+		return 0, false
+	}
+
+	wait := p.Backoff
+	for i := 1; i < n && (p.MaxBackoff <= 0 || wait < p.MaxBackoff); i++ {
+		wait *= 2
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+
+	if p.MaxElapsed > 0 {
+		left := p.MaxElapsed - time.Since(started)
+		if left <= 0 {
+			return 0, false
+		}
+		if wait > left {
+			wait = left
+		}
+	}
+	return wait, true
+}
+
+// String describes the limits, for log messages.
+func (p retryPolicy) String() string {
+	switch {
+	case p.Tries > 0 && p.MaxElapsed > 0:
+		return fmt.Sprintf("%d tries or %v", p.Tries, p.MaxElapsed)
+	case p.Tries > 0:
+		return fmt.Sprintf("%d tries", p.Tries)
+	}
+	return p.MaxElapsed.String()
+}
+
+// retrying calls fn until it succeeds or the class's policy gives up, and
+// returns its last error. Failed attempts are logged as what.
+func retrying(class, what string, fn func() error) error {
+	p := retryPolicyFor(class)
+	started := time.Now()
+	for n := 1; ; n++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		wait, ok := p.next(n, started)
+		if !ok {
+			if n > 1 {
+				return fmt.Errorf("%v (gave up after %d attempts)", err, n)
+			}
+			return err
+		}
+		log.Printf("%s (attempt %d, %s retry policy %s): %v; retrying in %v", what, n, class, p, err, wait)
+		metricCount("retry", 1, tag("class", class))
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+)
+
+// "enroll revert --batch 1234" undoes what a bad batch loaded, using the
+// batch ID stamped on every row (sql/025_batch_revert.sql), in one
+// transaction:
+//
+//   - its records are rejected, with who reverted it and why in the review
+//     columns - or, with --delete, rejected and marked deleted with who and
+//     why, so the list and export commands leave them out (see
+//     sql/030_soft_delete.sql);
+//   - whatever is still queued for them is dropped: bank API sends, unsent
+//     welcome events, unverified email tokens;
+//   - rows its de-enrollments made inactive go back to the status they had
+//     before, and are queued for the bank again;
+//   - the batch is marked "reverted", with when and by whom.
+//
+// A record the bank already has, or whose office has had its welcome, is
+// past taking back quietly: revert refuses unless --force, and then the
+// bank is sent the rejection. --delete always refuses those - the bank
+// would never hear. --dry-run only prints what it would do. The file can
+// be fixed and loaded again, or replayed, as a new batch.
+
+// batchReverted is the status of a batch that has been reverted.
+const batchReverted = "reverted"
+
+// revertPreview is what reverting a batch would touch.
+type revertPreview struct {
+	Records       int // not already rejected
+	Pending       int // of those, waiting for review
+	Forwarded     int // of those, already sent to the bank
+	Queued        int // waiting to go to the bank
+	Events        int // unsent welcome events
+	EventsSent    int // welcome events already sent
+	Verifications int // unverified email tokens
+	Deactivated   int // rows its de-enrollments made inactive
+	AmendedLater  int // records a later batch has amended since
+	Held          int // under legal hold (see hold.go)
+}
+
+// revertResult is what a revert did.
+type revertResult struct {
+	Rejected int
+	Deleted  int
+	Held     int // kept, not deleted, for a legal hold
+	Restored int // deactivated rows put back
+	Requeued int // rows queued for the bank again
+}
+
+var (
+	revertID             int64
+	revertDryRun         bool
+	revertDelete         bool
+	revertForce          bool
+	revertNote, revertBy string
+)
+
+var revertCmd = &cobra.Command{
+	Use:   "revert",
+	Short: "Undo everything a bad batch loaded",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if revertID == 0 {
+			check(fmt.Errorf("--batch is required"))
+		}
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		// Both read the primary: the revert acts on what is there now.
+		b, preview, err := previewRevert(dbs.primary, revertID)
+		check(err)
+		printRevertPreview(b, preview, revertDelete)
+		if revertDryRun {
+			return
+		}
+
+		r, err := revertBatch(dbs.primary, b.ID, revertDelete, revertForce, revertBy, revertNote)
+		check(err)
+		if revertDelete {
+			fmt.Printf("Batch %d reverted by %s: %d records deleted", b.ID, revertBy, r.Deleted)
+			if r.Held > 0 {
+				fmt.Printf(" (%d under legal hold only rejected)", r.Held)
+			}
+		} else {
+			fmt.Printf("Batch %d reverted by %s: %d records rejected", b.ID, revertBy, r.Rejected)
+		}
+		fmt.Printf(", %d deactivated records restored, %d queued for the bank\n", r.Restored, r.Requeued)
+	},
+}
+
+func init() {
+	revertCmd.Flags().Int64Var(&revertID, "batch", 0, "batch ID")
+	revertCmd.Flags().BoolVar(&revertDryRun, "dry-run", false, "show what would be reverted without changing anything")
+	revertCmd.Flags().BoolVar(&revertDelete, "delete", false, "mark the batch's records deleted as well as rejected")
+	revertCmd.Flags().BoolVar(&revertForce, "force", false, "revert even records the bank or the office has already heard about")
+	revertCmd.Flags().StringVar(&revertNote, "note", "", "why the batch is being reverted")
+	revertCmd.Flags().StringVar(&revertBy, "by", currentUser(), "who is reverting it")
+	rootCmd.AddCommand(revertCmd)
+}
+
+// previewRevert reads the batch and what reverting it would touch.
+func previewRevert(db *sql.DB, id int64) (batchInfo, revertPreview, error) {
+	var p revertPreview
+	b, err := getBatch(db, id)
+	switch {
+	case err == sql.ErrNoRows:
+		return b, p, fmt.Errorf("batch %d not found", id)
+	case err != nil:
+		return b, p, err
+	case b.Status == batchRunning:
+		return b, p, fmt.Errorf("batch %d is still running", id)
+	case b.Status == batchReverted:
+		return b, p, fmt.Errorf("batch %d has already been reverted", id)
+	}
+
+	stmt, err := prepare(db, "batch.revert_preview")
+	if err != nil {
+		return b, p, err
+	}
+	defer stmt.Close()
+
+	args := make([]interface{}, 10)
+	for i := range args {
+		args[i] = id
+	}
+	err = stmt.QueryRow(args...).Scan(&p.Records, &p.Pending, &p.Forwarded, &p.Queued,
+		&p.Events, &p.EventsSent, &p.Verifications, &p.Deactivated, &p.AmendedLater, &p.Held)
+	return b, p, err
+}
+
+func printRevertPreview(b batchInfo, p revertPreview, remove bool) {
+	action := "reject"
+	if remove {
+		action = "delete"
+	}
+	fmt.Printf("Batch %d: %s, transmitter %s, started %s, status %s\n",
+		b.ID, b.FileName, b.Transmitter, b.Started.Format(time.RFC3339), b.Status)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "records to %s\t%d\t(%d pending review)\n", action, p.Records, p.Pending)
+	fmt.Fprintf(w, "  already sent to the bank\t%d\n", p.Forwarded)
+	fmt.Fprintf(w, "  amended by a later batch\t%d\n", p.AmendedLater)
+	fmt.Fprintf(w, "  under legal hold\t%d\n", p.Held)
+	fmt.Fprintf(w, "bank API sends to drop\t%d\n", p.Queued)
+	fmt.Fprintf(w, "welcome events to drop\t%d\t(%d already sent)\n", p.Events, p.EventsSent)
+	fmt.Fprintf(w, "email tokens to drop\t%d\n", p.Verifications)
+	fmt.Fprintf(w, "deactivated records to restore\t%d\n", p.Deactivated)
+	check(w.Flush())
+}
+
+// revertBatch reverts batch id (see the top of this file) and says what
+// it did. It reads what the batch touched again first rather than trust a
+// preview the caller may have shown a while ago.
+func revertBatch(db *sql.DB, id int64, remove, force bool, by, note string) (revertResult, error) {
+	var r revertResult
+	_, p, err := previewRevert(db, id)
+	if err != nil {
+		return r, err
+	}
+	switch {
+	case p.Forwarded > 0 && remove:
+		return r, fmt.Errorf("batch %d: %d records have already gone to the bank; revert without --delete so it hears they were rejected", id, p.Forwarded)
+	case p.Forwarded > 0 && !force:
+		return r, fmt.Errorf("batch %d: %d records have already gone to the bank (use --force to reject them and tell the bank)", id, p.Forwarded)
+	case p.EventsSent > 0 && !force:
+		return r, fmt.Errorf("batch %d: %d offices have already been sent their welcome (use --force to revert anyway)", id, p.EventsSent)
+	}
+
+	level, err := isolationLevel(db)
+	if err != nil {
+		return r, err
+	}
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: level})
+	if err != nil {
+		return r, err
+	}
+	if r, err = revertBatchTx(tx, id, remove, by, note); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return r, fmt.Errorf("reverting batch %d: %v (and rollback failed: %v)", id, err, rbErr)
+		}
+		return r, fmt.Errorf("reverting batch %d: %w", id, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return r, err
+	}
+	mode, n := "reject", r.Rejected
+	if remove {
+		mode, n = "delete", r.Deleted
+		r.Held = p.Held
+	}
+	metricCount("revert.records", n, tag("mode", mode))
+	return r, nil
+}
+
+func revertBatchTx(tx *sql.Tx, id int64, remove bool, by, note string) (revertResult, error) {
+	var r revertResult
+	now := time.Now()
+	if note == "" {
+		note = fmt.Sprintf("batch %d reverted", id)
+	}
+
+	// Marking the batch first locks it against a second revert.
+	n, err := execStatement(tx, "batch.revert", now, truncate(by, 100), truncate(note, 400), id)
+	if err != nil {
+		return r, err
+	}
+	if n == 0 {
+		return r, fmt.Errorf("batch %d is running or has already been reverted", id)
+	}
+
+	restored, err := revertRows(tx, "ero.revert_deactivations", id)
+	if err != nil {
+		return r, err
+	}
+	r.Restored = len(restored)
+
+	for _, name := range []string{"bank_outbox.drop_batch", "event_outbox.drop_batch", "email_verification.drop_batch"} {
+		if _, err := execStatement(tx, name, id); err != nil {
+			return r, err
+		}
+	}
+
+	// Rows the batch itself loaded are about to go; the rest go back to
+	// the bank with their old status, and the ones it had with rejected.
+	var requeue []int64
+	for row, batch := range restored {
+		if batch != id {
+			requeue = append(requeue, row)
+		}
+	}
+	rejected, err := revertRows(tx, "ero.revert", truncate(by, 100), now, truncate(note, 400), id)
+	if err != nil {
+		return r, err
+	}
+	r.Rejected = len(rejected)
+	for row, forwarded := range rejected {
+		if forwarded == 1 {
+			requeue = append(requeue, row)
+		}
+	}
+	if remove {
+		// Records under legal hold (hold.go) stay rejected, not deleted.
+		n, err := execStatement(tx, "ero.delete_batch", now, truncate(by, 100), truncate(note, 400), id)
+		if err != nil {
+			return r, err
+		}
+		r.Deleted = int(n)
+	}
+
+	for _, row := range requeue {
+		if err := queueForBank(tx, row); err != nil {
+			return r, err
+		}
+	}
+	if bankAPIEnabled() {
+		r.Requeued = len(requeue)
+	}
+	return r, nil
+}
+
+// revertRows runs one of the revert statements that OUTPUT a row ID and a
+// number about it, and returns them keyed by row.
+func revertRows(tx *sql.Tx, name string, args ...interface{}) (map[int64]int64, error) {
+	stmt, err := prepare(tx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[int64]int64{}
+	for rows.Next() {
+		var id, v int64
+		if err := rows.Scan(&id, &v); err != nil {
+			return nil, err
+		}
+		out[id] = v
+	}
+	return out, rows.Err()
+}
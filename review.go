@@ -0,0 +1,264 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+)
+
+// Records flagged by the risk rules (risk.go) are loaded as "pending".
+// An operator then approves them (status "loaded") or rejects them
+// (status "rejected"), either with "enroll review" or through the API.
+// Who made the call, when, and their note are recorded on the row.
+
+// errNotPending means the record doesn't exist or was already reviewed.
+var errNotPending = errors.New("no pending record with that ID")
+
+// pendingRecord is a record waiting for review.
+type pendingRecord struct {
+	ID       int64     `json:"id"`
+	EFIN     string    `json:"efin"`
+	Company  string    `json:"company"`
+	TaxYear  int       `json:"taxYear"`
+	Received time.Time `json:"received"`
+	Batch    int64     `json:"batch"`
+	Flagged  string    `json:"flagged"`
+}
+
+// pendingReviews lists every record waiting for review, oldest first.
+func pendingReviews(db *sql.DB) ([]pendingRecord, error) {
+	stmt, err := prepare(db, "ero.pending")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []pendingRecord
+	for rows.Next() {
+		var r pendingRecord
+		var batch sql.NullInt64
+		var flagged sql.NullString
+		if err := rows.Scan(&r.ID, &r.EFIN, &r.Company, &r.TaxYear, &r.Received, &batch, &flagged); err != nil {
+			return nil, err
+		}
+		r.Batch, r.Flagged = batch.Int64, flagged.String
+		pending = append(pending, r)
+	}
+	return pending, rows.Err()
+}
+
+// decideReview approves or rejects a pending record.
+func decideReview(db *sql.DB, id int64, approve bool, reviewer, note string) error {
+	if strings.TrimSpace(reviewer) == "" {
+		return errors.New("a reviewer is required")
+	}
+
+	status := enrollmentRejected
+	if approve {
+		status = enrollmentLoaded
+	}
+
+	stmt, err := prepare(db, "ero.review")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(status, reviewer, time.Now(), note, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotPending
+	}
+	if !approve {
+		if err := releaseVerification(db, id, false); err != nil { // see verify.go
+			return err
+		}
+		return releaseWelcome(db, id, false, "") // see events.go
+	}
+	confirmation, err := confirmRecord(db, id) // see confirmation.go
+	if err != nil {
+		return err
+	}
+	if err := priceApproved(db, id); err != nil { // see pricing.go
+		return err
+	}
+	if err := releaseWelcome(db, id, true, confirmation); err != nil {
+		return err
+	}
+	if err := releaseVerification(db, id, true); err != nil {
+		return err
+	}
+	return queueForBank(db, id)
+}
+
+// ---------------------------------------------------------------------
+// enroll review list|approve|reject
+
+var (
+	reviewID       int64
+	reviewNote     string
+	reviewReviewer string
+)
+
+var reviewCmd = &cobra.Command{
+	Use:   "review",
+	Short: "Review records flagged by the risk rules",
+}
+
+var reviewListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List records waiting for review",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		// Reviews act on what's pending right now, so read the primary.
+		pending, err := pendingReviews(dbs.primary)
+		check(err)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tEFIN\tCOMPANY\tBATCH\tRECEIVED\tFLAGGED")
+		for _, r := range pending {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\n", r.ID, r.EFIN, r.Company, r.Batch, r.Received.Format(time.RFC3339), r.Flagged)
+		}
+		check(w.Flush())
+	},
+}
+
+func reviewDecisionCmd(use, short string, approve bool) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if reviewID == 0 {
+				check(fmt.Errorf("--id is required"))
+			}
+
+			dbs, err := openDatabases()
+			check(err)
+			defer dbs.Close()
+
+			check(decideReview(dbs.primary, reviewID, approve, reviewReviewer, reviewNote))
+			fmt.Printf("Record %d %sd by %s\n", reviewID, use, reviewReviewer)
+		},
+	}
+	cmd.Flags().Int64Var(&reviewID, "id", 0, "record ID")
+	cmd.Flags().StringVar(&reviewNote, "note", "", "note to keep with the decision")
+	cmd.Flags().StringVar(&reviewReviewer, "reviewer", currentUser(), "who is making the decision")
+	return cmd
+}
+
+// currentUser is the login name of whoever is running the command.
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+func init() {
+	reviewCmd.AddCommand(
+		reviewListCmd,
+		reviewDecisionCmd("approve", "Approve a pending record", true),
+		reviewDecisionCmd("reject", "Reject a pending record", false),
+	)
+	rootCmd.AddCommand(reviewCmd)
+}
+
+// ---------------------------------------------------------------------
+// API
+//
+//	GET  /v1/reviews                list pending records
+//	POST /v1/reviews/{id}/approve   {"note": "..."}
+//	POST /v1/reviews/{id}/reject    {"note": "..."}
+//
+// These are admin endpoints (admin.go): the reviewer is the admin who
+// made the call, not something the client says.
+
+func registerReviewRoutes(mux *http.ServeMux, dbs *databases) {
+	mux.HandleFunc("/v1/reviews", adminOnly(http.MethodGet, func(w http.ResponseWriter, r *http.Request, _ string) {
+		pending, err := pendingReviews(dbs.primary)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if pending == nil {
+			pending = []pendingRecord{}
+		}
+		writeJSON(w, http.StatusOK, pending)
+	}))
+
+	mux.HandleFunc("/v1/reviews/", adminOnly(http.MethodPost, func(w http.ResponseWriter, r *http.Request, admin string) {
+		// /v1/reviews/{id}/approve or /v1/reviews/{id}/reject
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/reviews/"), "/")
+		if len(parts) != 2 || (parts[1] != "approve" && parts[1] != "reject") {
+			httpError(w, http.StatusNotFound, "not found")
+			return
+		}
+		id, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "bad record ID")
+			return
+		}
+
+		// The note is optional, and so is the body.
+		var body struct {
+			Note string `json:"note"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			httpError(w, http.StatusBadRequest, "bad request body: "+err.Error())
+			return
+		}
+
+		err = decideReview(dbs.primary, id, parts[1] == "approve", admin, body.Note)
+		switch {
+		case err == errNotPending:
+			httpError(w, http.StatusNotFound, err.Error())
+		case err != nil:
+			httpError(w, http.StatusInternalServerError, err.Error())
+		default:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "decision": parts[1], "reviewer": admin})
+		}
+	}))
+}
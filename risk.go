@@ -0,0 +1,95 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Risk rules flag records that need a person to look at them before they
+// go any further - a throwaway email domain, an EFIN fraud have asked us to
+// watch, and so on. A flagged record is still loaded, but with status
+// "pending" until someone approves or rejects it (see review.go).
+//
+// Rules come from "risk.rules" in the config:
+//
+//	"risk": {
+//	  "rules": [
+//	    {"name": "disposable-email", "field": "OfficeInfo.Email", "pattern": "@(mailinator|guerrillamail)\\."},
+//	    {"name": "watch-list", "field": "EFIN", "values": ["123456", "654321"]}
+//	  ]
+//	}
+//
+// A rule matches when the field matches "pattern" (a regular expression)
+// or equals one of "values".
+
+type riskRule struct {
+	Name    string   `mapstructure:"name"`
+	Field   string   `mapstructure:"field"`
+	Pattern string   `mapstructure:"pattern"`
+	Values  []string `mapstructure:"values"`
+
+	re     *regexp.Regexp
+	values map[string]bool
+}
+
+// loadRiskRules reads and compiles the configured rules.
+func loadRiskRules(cfg *viper.Viper) ([]riskRule, error) {
+	var rules []riskRule
+	if err := cfg.UnmarshalKey("risk.rules", &rules); err != nil {
+		return nil, fmt.Errorf("config: risk.rules: %v", err)
+	}
+
+	for i := range rules {
+		r := &rules[i]
+		if _, ok := fieldValue(Enrollment{}, r.Field); !ok {
+			return nil, fmt.Errorf("config: risk rule %q: unknown field %q", r.Name, r.Field)
+		}
+		if r.Pattern != "" {
+			re, err := compilePattern(r.Pattern) // see patterns.go
+			if err != nil {
+				return nil, fmt.Errorf("config: risk rule %q: %v", r.Name, err)
+			}
+			r.re = re
+		}
+		r.values = lookupSet(r.Values)
+	}
+	return rules, nil
+}
+
+func (r riskRule) matches(e Enrollment) bool {
+	v, _ := fieldValue(e, r.Field)
+	v = strings.TrimSpace(v)
+	if r.re != nil && r.re.MatchString(v) {
+		return true
+	}
+	return r.values[v]
+}
+
+// riskFlags returns a description of every rule the record trips.
+func riskFlags(rules []riskRule, e Enrollment) []string {
+	var flags []string
+	for _, r := range rules {
+		if r.matches(e) {
+			flags = append(flags, fmt.Sprintf("%s (%s)", r.Name, r.Field))
+		}
+	}
+	return flags
+}
@@ -0,0 +1,241 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// "enroll rollover --from 2016 --to 2017" carries a season's enrollments
+// forward into the next: the latest record for each EFIN is copied into
+// the new tax year (sql/019_rollover.sql) if it passes the carry-forward
+// rules in "rollover":
+//
+//	statuses  the statuses that roll (default ["loaded"]: approved and
+//	          active, so not pending review or deactivated)
+//	refdata   the EFIN must still be on the approved EFIN list and its
+//	          bank on the bank list, as of now (default true)
+//	risk      it mustn't trip the current risk rules (default true)
+//
+// EFINs that already have a record for the new year are left alone, so it
+// can be run again. It prints what rolled and what didn't, and why;
+// --out writes the same as CSV and --dry-run only reports.
+func init() {
+	viper.SetDefault("rollover.statuses", []string{enrollmentLoaded})
+	viper.SetDefault("rollover.refdata", true)
+	viper.SetDefault("rollover.risk", true)
+}
+
+// rolloverCandidate is the record an EFIN would roll forward from.
+type rolloverCandidate struct {
+	ID       int64
+	Record   Enrollment // the stored fields
+	Status   string
+	Enrolled bool // already has a record in the new year
+}
+
+// rolloverResult is what happened to one EFIN.
+type rolloverResult struct {
+	EFIN   string
+	From   int64
+	To     int64 // the new record; 0 if it didn't roll
+	Rolled bool
+	Reason string // why not
+}
+
+var (
+	rolloverFrom, rolloverTo int
+	rolloverOut              string
+	rolloverDryRun           bool
+)
+
+var rolloverCmd = &cobra.Command{
+	Use:   "rollover",
+	Short: "Carry a season's enrollments forward into the next tax year",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if rolloverTo <= rolloverFrom {
+			check(fmt.Errorf("--to (%d) must be after --from (%d)", rolloverTo, rolloverFrom))
+		}
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		results, err := rollover(dbs, rolloverFrom, rolloverTo, rolloverDryRun)
+		check(err)
+		printRollover(results)
+		if rolloverOut != "" {
+			check(writeRolloverCSV(rolloverOut, results))
+		}
+	},
+}
+
+func init() {
+	rolloverCmd.Flags().IntVar(&rolloverFrom, "from", 2016, "tax year to carry forward")
+	rolloverCmd.Flags().IntVar(&rolloverTo, "to", 2017, "tax year to carry it into")
+	rolloverCmd.Flags().StringVar(&rolloverOut, "out", "", "also write the report to this CSV file")
+	rolloverCmd.Flags().BoolVar(&rolloverDryRun, "dry-run", false, "report what would roll without writing anything")
+	rootCmd.AddCommand(rolloverCmd)
+}
+
+// rollover carries from's enrollments into to and reports on every EFIN.
+func rollover(dbs *databases, from, to int, dryRun bool) ([]rolloverResult, error) {
+	candidates, err := rolloverCandidates(dbs.primary, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := map[string]bool{}
+	for _, s := range viper.GetStringSlice("rollover.statuses") {
+		statuses[strings.TrimSpace(s)] = true
+	}
+	var ref *refData
+	if viper.GetBool("rollover.refdata") {
+		versions, err := currentRefVersions(dbs.reader())
+		if err != nil {
+			return nil, err
+		}
+		collate, err := loadCollations(dbs.primary)
+		if err != nil {
+			return nil, err
+		}
+		if ref, err = loadRefData(dbs.reader(), versions, collate); err != nil {
+			return nil, err
+		}
+	}
+	var rules []riskRule
+	if viper.GetBool("rollover.risk") {
+		if rules, err = loadRiskRules(viper.GetViper()); err != nil {
+			return nil, err
+		}
+	}
+
+	var stmt *sql.Stmt
+	if !dryRun {
+		if stmt, err = prepare(dbs.primary, "ero.rollover"); err != nil {
+			return nil, err
+		}
+		defer stmt.Close()
+	}
+
+	results := make([]rolloverResult, 0, len(candidates))
+	now := time.Now()
+	for _, c := range candidates {
+		r := rolloverResult{EFIN: c.Record.EFIN, From: c.ID}
+		switch {
+		case c.Enrolled:
+			r.Reason = fmt.Sprintf("already has a %d record", to)
+		case !statuses[c.Status]:
+			r.Reason = "status " + c.Status
+		case ref != nil && len(ref.check(c.Record)) > 0:
+			r.Reason = joinErrors(ref.check(c.Record))
+		case len(riskFlags(rules, c.Record)) > 0:
+			r.Reason = "risk: " + strings.Join(riskFlags(rules, c.Record), "; ")
+		default:
+			r.Rolled = true
+		}
+		if r.Rolled && !dryRun {
+			args := []interface{}{to, now, c.ID}
+			if !viper.GetBool("mssql.storedprocedures") {
+				args = append(args, to) // for NOT EXISTS
+			}
+			err := stmt.QueryRow(args...).Scan(&r.To)
+			switch {
+			case err == sql.ErrNoRows:
+				// Enrolled for the new year since we looked.
+				r.Rolled, r.Reason = false, fmt.Sprintf("already has a %d record", to)
+			case err != nil:
+				return results, fmt.Errorf("rolling EFIN %s forward: %v", r.EFIN, err)
+			}
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+func rolloverCandidates(db *sql.DB, from, to int) ([]rolloverCandidate, error) {
+	stmt, err := prepare(db, "ero.rollover_source")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(to, from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []rolloverCandidate
+	for rows.Next() {
+		var c rolloverCandidate
+		e := &c.Record
+		if err := rows.Scan(&c.ID, &e.EFIN, &e.OfficeInfo.OfficeName, &e.OfficeInfo.State, &e.PriorYearInfo.Bank,
+			&e.MasterEfin, &c.Status, &c.Enrolled); err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, rows.Err()
+}
+
+func printRollover(results []rolloverResult) {
+	rolled := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "EFIN\tFROM\tTO\tRESULT\tREASON")
+	for _, r := range results {
+		to, result := "-", "skipped"
+		if r.Rolled {
+			rolled++
+			result = "rolled"
+			if r.To > 0 {
+				to = strconv.FormatInt(r.To, 10)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", r.EFIN, r.From, to, result, r.Reason)
+	}
+	check(w.Flush())
+	fmt.Printf("%d of %d EFIN(s) rolled forward\n", rolled, len(results))
+}
+
+func writeRolloverCSV(path string, results []rolloverResult) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"EFIN", "FROM_ID", "TO_ID", "ROLLED", "REASON"})
+	for _, r := range results {
+		w.Write([]string{r.EFIN, strconv.FormatInt(r.From, 10), strconv.FormatInt(r.To, 10), strconv.FormatBool(r.Rolled), r.Reason})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
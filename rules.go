@@ -0,0 +1,252 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dstroot/go_enrollment/enrollment"
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// The rules a record is judged by - risk, defaults, empty, lengths,
+// conflicts, prioryear and pricing - are versioned. What the config says
+// is version "rules.version" (default "base"); "rules.sets" adds versions
+// that apply from a date, for a tax year, or both:
+//
+//	{"version": "2016.2", "from": "2016-03-01", "to": "2016-12-31",
+//	 "years": [2016], "file": "rules/2016.2.json"}
+//
+// The file holds just the sections that differ, as for canary rules
+// (canary.go). from and to are inclusive and either may be left out, as
+// may years. Each record is judged by the first set whose dates cover its
+// TransactionDate and whose years include its ProcessingYear, and by the
+// base rules if none does (or its date doesn't parse). The version that
+// judged it is stored with the record (ero.RULESET, sql/027_rulesets.sql)
+// and given in its ACK, whatever the outcome.
+func init() {
+	viper.SetDefault("rules.version", "base")
+	viper.SetDefault("rules.sets", []interface{}{})
+}
+
+// policies is one version of the rules, ready to use.
+type policies struct {
+	Version  string
+	Risk     []riskRule
+	Defaults []fieldDefault
+	Empty    *emptyPolicy
+	Lengths  *lengthPolicy
+	Conflict []conflictGroup
+	Prior    *priorYearPolicy
+	Pricing  []pricingRule
+	Fields   string // validation.policy
+}
+
+// ruleset is a version of the rules and the records it applies to.
+type ruleset struct {
+	From, To time.Time // TransactionDates covered, inclusive; zero is open
+	Years    []int     // ProcessingYears covered; none is any
+	policies
+}
+
+// rulesetConfig is an entry in rules.sets.
+type rulesetConfig struct {
+	Version string
+	From    string
+	To      string
+	Years   []int
+	File    string
+}
+
+// loadRules reads one version of the rules from cfg. Column lengths come
+// from db as well, if lengths.fromdb says so.
+func loadRules(cfg *viper.Viper, db *sql.DB, c *collations) (policies, error) {
+	p := policies{Version: cfg.GetString("rules.version")}
+	var err error
+	if p.Risk, err = loadRiskRules(cfg); err != nil {
+		return p, err
+	}
+	if p.Defaults, err = loadDefaults(cfg); err != nil {
+		return p, err
+	}
+	if p.Empty, err = loadEmptyPolicy(cfg); err != nil {
+		return p, err
+	}
+	if p.Lengths, err = loadLengthPolicy(cfg, db); err != nil {
+		return p, err
+	}
+	if p.Conflict, err = loadConflictGroups(cfg); err != nil {
+		return p, err
+	}
+	if p.Prior, err = loadPriorYearPolicy(cfg, c); err != nil {
+		return p, err
+	}
+	if p.Fields, err = loadValidationPolicy(cfg); err != nil {
+		return p, err
+	}
+	p.Pricing, err = loadPricingRules(cfg)
+	return p, err
+}
+
+// loadRulesets reads the versions in cfg's rules.sets.
+func loadRulesets(cfg *viper.Viper, db *sql.DB, c *collations) ([]ruleset, error) {
+	var sets []rulesetConfig
+	if err := cfg.UnmarshalKey("rules.sets", &sets); err != nil {
+		return nil, fmt.Errorf("config: rules.sets: %v", err)
+	}
+
+	seen := map[string]bool{cfg.GetString("rules.version"): true}
+	rulesets := make([]ruleset, 0, len(sets))
+	for _, s := range sets {
+		s.Version = strings.TrimSpace(s.Version)
+		if s.Version == "" || len(s.Version) > 40 {
+			return nil, fmt.Errorf("config: rules.sets: every set needs a version of up to 40 characters (got %q)", s.Version)
+		}
+		if seen[s.Version] {
+			return nil, fmt.Errorf("config: rules.sets: version %s is used twice", s.Version)
+		}
+		seen[s.Version] = true
+
+		r := ruleset{Years: s.Years}
+		var err error
+		if r.From, err = rulesetDate(s.From); err != nil {
+			return nil, fmt.Errorf("config: rules.sets: %s: from: %v", s.Version, err)
+		}
+		if r.To, err = rulesetDate(s.To); err != nil {
+			return nil, fmt.Errorf("config: rules.sets: %s: to: %v", s.Version, err)
+		}
+		if !r.From.IsZero() && !r.To.IsZero() && r.To.Before(r.From) {
+			return nil, fmt.Errorf("config: rules.sets: %s: to is before from", s.Version)
+		}
+
+		setCfg, err := rulesetConfigFor(s)
+		if err != nil {
+			return nil, err
+		}
+		if r.policies, err = loadRules(setCfg, db, c); err != nil {
+			return nil, fmt.Errorf("rules %s (%s): %v", s.Version, s.File, err)
+		}
+		rulesets = append(rulesets, r)
+	}
+	return rulesets, nil
+}
+
+// rulesetConfigFor is the config for a set: the current config with the
+// set's file over it.
+func rulesetConfigFor(s rulesetConfig) (*viper.Viper, error) {
+	if s.File == "" {
+		return nil, fmt.Errorf("config: rules.sets: %s has no file", s.Version)
+	}
+	cfg, err := overlayConfig(s.File)
+	if err != nil {
+		return nil, fmt.Errorf("rules %s: %v", s.Version, err)
+	}
+	cfg.Set("rules.version", s.Version)
+	cfg.Set("rules.sets", []interface{}{})
+	return cfg, nil
+}
+
+// overlayConfig is the current config with the settings in path over it.
+func overlayConfig(path string) (*viper.Viper, error) {
+	cfg := viper.New()
+	for _, k := range viper.AllKeys() {
+		cfg.SetDefault(k, viper.Get(k))
+	}
+	cfg.SetConfigFile(path)
+	if err := cfg.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func rulesetDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// covers reports whether the set applies to a record from year with the
+// given TransactionDate.
+func (r *ruleset) covers(year int, date time.Time) bool {
+	if !r.From.IsZero() && date.Before(r.From) {
+		return false
+	}
+	if !r.To.IsZero() && !date.Before(r.To.AddDate(0, 0, 1)) {
+		return false
+	}
+	if len(r.Years) == 0 {
+		return true
+	}
+	for _, y := range r.Years {
+		if y == year {
+			return true
+		}
+	}
+	return false
+}
+
+// rulesFor picks the rules to judge e by.
+func (job *batchJob) rulesFor(e Enrollment) *policies {
+	if len(job.Rulesets) == 0 {
+		return &job.policies
+	}
+	date, err := enrollment.ParseTransactionDate(e.TransactionDate)
+	if err != nil {
+		return &job.policies
+	}
+	year, _ := strconv.Atoi(strings.TrimSpace(e.ProcessingYear))
+	for i := range job.Rulesets {
+		if job.Rulesets[i].covers(year, date) {
+			return &job.Rulesets[i].policies
+		}
+	}
+	return &job.policies
+}
+
+// rulesByVersion returns the batch's rules of that version, or the base
+// rules.
+func (job *batchJob) rulesByVersion(version string) *policies {
+	for i := range job.Rulesets {
+		if job.Rulesets[i].Version == version {
+			return &job.Rulesets[i].policies
+		}
+	}
+	return &job.policies
+}
+
+// rulesetPricing returns the pricing rules of a version as configured
+// now, for records priced after they were loaded (review.go).
+func rulesetPricing(version string) ([]pricingRule, error) {
+	var sets []rulesetConfig
+	if err := viper.UnmarshalKey("rules.sets", &sets); err != nil {
+		return nil, fmt.Errorf("config: rules.sets: %v", err)
+	}
+	for _, s := range sets {
+		if strings.TrimSpace(s.Version) == version {
+			cfg, err := rulesetConfigFor(s)
+			if err != nil {
+				return nil, err
+			}
+			return loadPricingRules(cfg)
+		}
+	}
+	return loadPricingRules(viper.GetViper())
+}
@@ -0,0 +1,318 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+)
+
+// "enroll schema check partner.xsd" compares a partner's schema with the
+// elements our structs (records.go) map, so we know before their first
+// file what we would drop, what they have renamed or moved, and what we
+// expect that they don't send.
+
+var schemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Work with partner XML schemas",
+}
+
+var schemaCheckCmd = &cobra.Command{
+	Use:   "check SCHEMA.xsd",
+	Short: "Compare a partner's XSD with the elements we support",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		f, err := os.Open(args[0])
+		check(err)
+		defer f.Close()
+
+		elems, err := parseXSD(f)
+		check(err)
+		root, err := collectionRoot(elems)
+		check(err)
+
+		diff := compareSchema(root)
+		diff.print()
+		if !diff.compatible() {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	schemaCmd.AddCommand(schemaCheckCmd)
+	rootCmd.AddCommand(schemaCmd)
+}
+
+// collectionRoot finds the EnrollmentCollection element, or an Enrollment
+// element to stand in for it.
+func collectionRoot(elems []*xsdElement) (*xsdElement, error) {
+	var names []string
+	for _, e := range elems {
+		if e.Name == "EnrollmentCollection" {
+			return e, nil
+		}
+		names = append(names, e.Name)
+	}
+	for _, e := range elems {
+		if e.Name == "Enrollment" {
+			return &xsdElement{Name: "EnrollmentCollection", Min: 1, Children: []*xsdElement{e}}, nil
+		}
+	}
+	return nil, fmt.Errorf("schema has no EnrollmentCollection or Enrollment element (it has %s)", strings.Join(names, ", "))
+}
+
+// We compare paths like "Enrollment/OfficeInfo/Email", relative to the
+// collection.
+
+// mappedElements lists the element paths our structs read, with each
+// field's kind.
+func mappedElements() map[string]reflect.Kind {
+	mapped := map[string]reflect.Kind{}
+	var walk func(t reflect.Type, prefix string)
+	walk = func(t reflect.Type, prefix string) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("xml"), ",")[0]
+			if name == "" || name == "-" || f.Type == reflect.TypeOf(EnrollmentCollection{}.XMLName) || strings.HasSuffix(f.Tag.Get("xml"), ",attr") {
+				continue
+			}
+			p := path.Join(prefix, name)
+			ft := f.Type
+			if ft.Kind() == reflect.Slice {
+				ft = ft.Elem()
+			}
+			mapped[p] = ft.Kind()
+			if ft.Kind() == reflect.Struct {
+				walk(ft, p)
+			}
+		}
+	}
+	walk(reflect.TypeOf(EnrollmentCollection{}), "")
+	return mapped
+}
+
+func schemaElements(root *xsdElement) map[string]*xsdElement {
+	found := map[string]*xsdElement{}
+	var walk func(e *xsdElement, prefix string)
+	walk = func(e *xsdElement, prefix string) {
+		for _, c := range e.Children {
+			p := path.Join(prefix, c.Name)
+			found[p] = c
+			walk(c, p)
+		}
+	}
+	walk(root, "")
+	return found
+}
+
+type schemaRename struct {
+	From, To string // ours, theirs
+}
+
+type schemaDiff struct {
+	Supported   int
+	Unsupported []string // in their schema, not mapped: we would drop it
+	Required    map[string]bool
+	Renamed     []schemaRename
+	Missing     []string // mapped, not in their schema
+	Types       []string // mapped both sides but the types don't agree
+}
+
+func compareSchema(root *xsdElement) schemaDiff {
+	ours, theirs := mappedElements(), schemaElements(root)
+	d := schemaDiff{Required: map[string]bool{}}
+
+	var extra, missing []string
+	for p, e := range theirs {
+		kind, ok := ours[p]
+		if !ok {
+			extra = append(extra, p)
+			continue
+		}
+		d.Supported++
+		if problem := typeMismatch(kind, e); problem != "" {
+			d.Types = append(d.Types, p+": "+problem)
+		}
+	}
+	for p := range ours {
+		if _, ok := theirs[p]; !ok {
+			missing = append(missing, p)
+		}
+	}
+	sort.Strings(extra)
+	sort.Strings(missing)
+
+	// A missing element of ours that looks like an extra one of theirs
+	// has been renamed or moved.
+	matched := map[string]bool{}
+	for _, m := range missing {
+		for _, x := range extra {
+			if !matched[x] && sameElement(m, x) {
+				d.Renamed = append(d.Renamed, schemaRename{From: m, To: x})
+				matched[x], matched[m] = true, true
+				break
+			}
+		}
+	}
+	// Children of an element that is missing altogether aren't listed.
+	extraSet, missingSet := pathSet(extra), pathSet(missing)
+	for _, x := range extra {
+		if !matched[x] && !underRenamed(x, d.Renamed) && !extraSet[path.Dir(x)] {
+			d.Unsupported = append(d.Unsupported, x)
+			d.Required[x] = theirs[x].Min > 0
+		}
+	}
+	for _, m := range missing {
+		if !matched[m] && !underRenamed(m, d.Renamed) && !missingSet[path.Dir(m)] {
+			d.Missing = append(d.Missing, m)
+		}
+	}
+	sort.Strings(d.Types)
+	return d
+}
+
+func pathSet(paths []string) map[string]bool {
+	set := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		set[p] = true
+	}
+	return set
+}
+
+// sameElement reports whether two paths probably name the same element:
+// same parent and a near-identical name, or the same name somewhere else.
+func sameElement(a, b string) bool {
+	na, nb := normalizeElement(path.Base(a)), normalizeElement(path.Base(b))
+	if path.Dir(a) == path.Dir(b) {
+		return na == nb || (len(na) >= 5 && editDistance(na, nb) <= 2)
+	}
+	return na == nb
+}
+
+// underRenamed reports whether p is inside an element that was renamed;
+// its children are accounted for by the rename.
+func underRenamed(p string, renames []schemaRename) bool {
+	for _, r := range renames {
+		if strings.HasPrefix(p, r.From+"/") || strings.HasPrefix(p, r.To+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeElement(name string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "", ".", "").Replace(name))
+}
+
+// editDistance is the Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// typeMismatch describes a disagreement between our field and theirs.
+func typeMismatch(kind reflect.Kind, e *xsdElement) string {
+	complex := len(e.Children) > 0
+	switch {
+	case kind == reflect.Struct && !complex:
+		return fmt.Sprintf("we expect child elements, the schema has %s", e.Type)
+	case kind != reflect.Struct && complex:
+		return "the schema has child elements, we read a value"
+	case kind == reflect.Bool && e.Type != "boolean":
+		return fmt.Sprintf("we read a boolean, the schema has %s", e.Type)
+	}
+	return ""
+}
+
+// compatible reports whether files to the schema would load as they do
+// today: nothing required is dropped and nothing has moved.
+func (d schemaDiff) compatible() bool {
+	for _, p := range d.Unsupported {
+		if d.Required[p] {
+			return false
+		}
+	}
+	return len(d.Renamed) == 0 && len(d.Types) == 0
+}
+
+func (d schemaDiff) print() {
+	fmt.Printf("%d elements supported\n", d.Supported)
+	if len(d.Unsupported) > 0 {
+		fmt.Println("\nNot supported (we would ignore these):")
+		for _, p := range d.Unsupported {
+			note := ""
+			if d.Required[p] {
+				note = " (required)"
+			}
+			fmt.Printf("  %s%s\n", p, note)
+		}
+	}
+	if len(d.Renamed) > 0 {
+		fmt.Println("\nRenamed or moved:")
+		for _, r := range d.Renamed {
+			fmt.Printf("  %s -> %s\n", r.From, r.To)
+		}
+	}
+	if len(d.Types) > 0 {
+		fmt.Println("\nDifferent types:")
+		for _, t := range d.Types {
+			fmt.Printf("  %s\n", t)
+		}
+	}
+	if len(d.Missing) > 0 {
+		fmt.Println("\nNot in the schema (these will be empty):")
+		for _, p := range d.Missing {
+			fmt.Printf("  %s\n", p)
+		}
+	}
+	if d.compatible() {
+		fmt.Println("\nCompatible")
+	} else {
+		fmt.Println("\nNot compatible")
+	}
+}
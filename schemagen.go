@@ -0,0 +1,215 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+)
+
+// "enroll schema generate next-year.xsd --out records_2017.go" writes Go
+// structs for a schema: one per complex element, with xml tags and
+// default govalidator tags worked out from the schema (required elements,
+// lengths, enumerations, patterns, numbers and a few well-known names).
+// Supporting a schema revision is then a regeneration, a review of the
+// tags, and "enroll schema check" against the old one.
+
+var (
+	genOut     string
+	genPackage string
+)
+
+var schemaGenerateCmd = &cobra.Command{
+	Use:   "generate SCHEMA.xsd",
+	Short: "Generate Go structs (with validation tags) from an XSD",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		f, err := os.Open(args[0])
+		check(err)
+		elems, err := parseXSD(f)
+		f.Close()
+		check(err)
+
+		src, err := generateStructs(elems, genPackage, filepath.Base(args[0]))
+		check(err)
+		if genOut == "" {
+			os.Stdout.Write(src)
+			return
+		}
+		check(os.WriteFile(genOut, src, 0644))
+	},
+}
+
+func init() {
+	schemaGenerateCmd.Flags().StringVar(&genOut, "out", "", "file to write (default stdout)")
+	schemaGenerateCmd.Flags().StringVar(&genPackage, "package", "enrollment", "package name")
+	schemaCmd.AddCommand(schemaGenerateCmd)
+}
+
+// structGen collects the struct types to write.
+type structGen struct {
+	types map[string]string // type name -> field list, to reuse identical types
+	order []string
+	decls map[string]string
+}
+
+func generateStructs(elems []*xsdElement, pkg, source string) ([]byte, error) {
+	g := &structGen{types: map[string]string{}, decls: map[string]string{}}
+	for _, e := range elems {
+		if len(e.Children) > 0 {
+			g.structFor(e, "")
+		}
+	}
+	if len(g.order) == 0 {
+		return nil, fmt.Errorf("%s has no complex elements", source)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by \"enroll schema generate %s\"; DO NOT EDIT.\n\npackage %s\n\nimport \"encoding/xml\"\n\n", source, pkg)
+	for _, name := range g.order {
+		b.WriteString(g.decls[name])
+	}
+	return format.Source(b.Bytes())
+}
+
+// structFor declares the struct for a complex element and returns its
+// name. Elements with the same name and fields share a type; different
+// ones with the same name get their parent's name in front.
+func (g *structGen) structFor(e *xsdElement, parent string) string {
+	var fields, decl bytes.Buffer
+	for _, c := range e.Children {
+		typ := goType(c)
+		if len(c.Children) > 0 {
+			typ = g.structFor(c, e.Name)
+		}
+		if c.Many {
+			typ = "[]" + typ
+		}
+		fmt.Fprintf(&fields, "\t%s %s `xml:\"%s\" valid:\"%s\"`", goName(c.Name), typ, c.Name, validTag(c))
+		if c.Doc != "" {
+			fmt.Fprintf(&fields, " // %s", c.Doc)
+		}
+		fields.WriteString("\n")
+	}
+
+	name := goName(e.Name)
+	if existing, ok := g.types[name]; ok && existing != fields.String() {
+		name = goName(parent) + name
+	}
+	if _, ok := g.types[name]; ok {
+		return name
+	}
+	g.types[name] = fields.String()
+
+	doc := "-" // as in records.go
+	if e.Doc != "" {
+		doc += " " + e.Doc
+	}
+	fmt.Fprintf(&decl, "// %s %s\ntype %s struct {\n", name, doc, name)
+	if parent == "" {
+		fmt.Fprintf(&decl, "\tXMLName xml.Name `xml:\"%s\"`\n", e.Name)
+	}
+	decl.WriteString(fields.String())
+	decl.WriteString("}\n\n")
+	g.decls[name] = decl.String()
+	g.order = append(g.order, name)
+	return name
+}
+
+func goType(e *xsdElement) string {
+	if e.Type == "boolean" {
+		return "bool"
+	}
+	return "string" // as in records.go: numbers and dates are checked, not parsed
+}
+
+// goName makes an element name a Go identifier: TransmitterId becomes
+// TransmitterID, office_name becomes OfficeName.
+func goName(name string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	s := b.String()
+	if strings.HasSuffix(s, "Id") {
+		s = strings.TrimSuffix(s, "Id") + "ID"
+	}
+	if s == "" || unicode.IsDigit(rune(s[0])) {
+		s = "X" + s
+	}
+	return s
+}
+
+// validTag works out a default govalidator tag for an element.
+func validTag(e *xsdElement) string {
+	if len(e.Children) > 0 || e.Type == "boolean" {
+		return "-"
+	}
+
+	var rules []string
+	lower := strings.ToLower(e.Name)
+	switch {
+	case len(e.Enum) > 0:
+		enum := append([]string(nil), e.Enum...)
+		sort.Strings(enum)
+		rules = append(rules, "in("+strings.Join(enum, "|")+")")
+	case strings.Contains(lower, "email"):
+		rules = append(rules, "email")
+	case lower == "ssn":
+		rules = append(rules, "ssn")
+	case isNumericType(e.Type):
+		rules = append(rules, "numeric")
+	case e.Pattern != "" && !strings.ContainsAny(e.Pattern, ",`\""):
+		// XSD patterns match the whole value.
+		rules = append(rules, "matches(^(?:"+e.Pattern+")$)")
+	}
+	if e.MaxLength > 0 {
+		rules = append(rules, fmt.Sprintf("length(%d|%d)", e.MinLength, e.MaxLength))
+	}
+	if e.Min > 0 {
+		rules = append(rules, "required")
+	}
+	if len(rules) == 0 {
+		return "-"
+	}
+	return strings.Join(rules, ",")
+}
+
+func isNumericType(t string) bool {
+	switch t {
+	case "int", "integer", "long", "short", "byte", "decimal",
+		"nonNegativeInteger", "positiveInteger", "unsignedInt", "unsignedLong", "unsignedShort", "gYear":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+// With two loader instances running, nothing that has to be unique may
+// be numbered by a counter in the process: the two would hand out the
+// same numbers. Numbers come from the database instead - batch IDs from
+// the batch table's IDENTITY, others from a SEQUENCE
+// (sql/015_sequences.sql), which is unique and increasing across every
+// instance and survives restarts and failovers (with gaps, never
+// repeats).
+
+// nextSequence allocates the next number from a database sequence. Each
+// sequence has a "sequence.<name>" statement. p may be a transaction;
+// the number is used up either way.
+func nextSequence(p preparer, name string) (int64, error) {
+	stmt, err := prepare(p, "sequence."+name)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var n int64
+	err = stmt.QueryRow().Scan(&n)
+	return n, err
+}
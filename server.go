@@ -0,0 +1,159 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// "enroll serve" runs the HTTP API. Each feature registers its own routes
+// on the mux (see registerReviewRoutes, for example).
+func init() {
+	viper.SetDefault("server.listen", ":8080")
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run the HTTP API",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		tlsConfig, err := serverTLSConfig()
+		check(err)
+		check(requireStorageKey())       // fail now, not on the first file (see atrest.go)
+		recent, err = newRecentRecords() // see recent.go
+		check(err)
+
+		var w *watcher
+		stop := make(chan struct{})
+		if viper.GetBool("watch.enabled") {
+			w, err = newWatcher(dbs)
+			check(err)
+			go w.run(stop)
+		}
+		if bankAPIEnabled() {
+			f, err := newBankForwarder(dbs.primary)
+			check(err)
+			go f.run(stop)
+		}
+		if eventsEnabled() {
+			d, err := newEventDispatcher(dbs.primary)
+			check(err)
+			go d.run(stop)
+		}
+		if verificationEnabled() {
+			v, err := newVerificationSender(dbs.primary)
+			check(err)
+			go v.run(stop)
+		}
+
+		srv := &http.Server{
+			Addr:      viper.GetString("server.listen"),
+			Handler:   withCorrelation(newServerMux(dbs, w)),
+			TLSConfig: tlsConfig,
+		}
+		go func() {
+			var err error
+			if tlsConfig == nil {
+				log.Printf("Listening on %s\n", srv.Addr)
+				err = srv.ListenAndServe()
+			} else {
+				// The certificate is already in TLSConfig.
+				log.Printf("Listening on %s (TLS)\n", srv.Addr)
+				err = srv.ListenAndServeTLS("", "")
+			}
+			if err != http.ErrServerClosed {
+				check(err)
+			}
+		}()
+
+		// Run until told to stop, then drain: let the files loading
+		// finish, stop taking requests, and exit.
+		waitForShutdown(w)
+		timeout, err := time.ParseDuration(viper.GetString("watch.draintimeout"))
+		check(err)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		if w != nil {
+			log.Printf("Draining (up to %s)\n", timeout)
+			if err := w.drain(ctx); err != nil {
+				log.Printf("drain: %v; files in progress will resume from their checkpoints", err)
+			}
+		}
+		close(stop)
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("shutting down: %v", err)
+		}
+		log.Println("Stopped")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+}
+
+// newServerMux wires up every API route. w is the inbox watcher, or nil.
+// The routes share one rate limiter, so server.ratelimit is each
+// transmitter's limit across the whole API, not per endpoint.
+func newServerMux(dbs *databases, w *watcher) *http.ServeMux {
+	mux := http.NewServeMux()
+	limits := newRateLimiter()
+	registerBatchRoutes(mux, dbs, limits)
+	registerReviewRoutes(mux, dbs)
+	registerSubmitRoutes(mux, dbs, limits)
+	registerEnrollmentRoutes(mux, dbs, limits)
+	registerEditRoutes(mux, dbs)
+	registerVerifyRoutes(mux, dbs, limits)
+	registerErrorRoutes(mux, limits)
+	registerAdminRoutes(mux, dbs, w)
+	registerOpenAPIRoutes(mux)
+	return mux
+}
+
+// writeJSON sends v as the response body.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("writing response: %v", err)
+	}
+}
+
+// apiError is the body of every error response.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// httpError sends a JSON error body.
+func httpError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, apiError{Error: msg})
+}
+
+// logAdmin records an operator action.
+func logAdmin(admin, action string) {
+	log.Printf("admin %s %s", admin, action)
+}
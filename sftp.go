@@ -0,0 +1,184 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/sftp"                // https://github.com/pkg/sftp
+	"github.com/spf13/viper"             // https://github.com/spf13/viper
+	"golang.org/x/crypto/ssh"            // https://godoc.org/golang.org/x/crypto/ssh
+	"golang.org/x/crypto/ssh/knownhosts" // https://godoc.org/golang.org/x/crypto/ssh/knownhosts
+)
+
+// Files we send to partners go over SFTP. A destination is a config
+// section with:
+//
+//	host, port (default 22), user
+//	keyfile     private key to log in with
+//	knownhosts  known_hosts file with the server's host key - required;
+//	            we never accept an unknown host key
+//	dir         remote directory to put files in
+//
+// or, for credentials kept in the database (credentials.go), secret
+// references (secrets.go) in place of the rest:
+//
+//	endpoint    user@host[:port][/dir], in place of host, port, user and dir
+//	key         the private key itself, in place of keyfile
+//	hostkeys    known_hosts lines, in place of knownhosts
+//
+// Uploads go to a temporary name and are renamed when complete, so the
+// other side never picks up half a file.
+
+// sftpDeliver uploads a local file to the SFTP destination configured
+// under key (e.g. "eod.sftp").
+func sftpDeliver(key, local string) error {
+	host, user, dir := viper.GetString(key+".host"), viper.GetString(key+".user"), viper.GetString(key+".dir")
+	port := viper.GetInt(key + ".port")
+	if ref := viper.GetString(key + ".endpoint"); ref != "" {
+		v, err := secretValue(ref)
+		if err != nil {
+			return fmt.Errorf("config: %s.endpoint: %v", key, err)
+		}
+		target, err := transmitterSFTP(v) // see transmitter.go
+		if err != nil {
+			return fmt.Errorf("config: %s.endpoint: %v", key, err)
+		}
+		host, user, dir = target["host"].(string), target["user"].(string), target["dir"].(string)
+		port, _ = target["port"].(int)
+	}
+	if host == "" {
+		return fmt.Errorf("config: %s.host is not set", key)
+	}
+	if port == 0 {
+		port = 22
+	}
+
+	signer, err := sftpSigner(key)
+	if err != nil {
+		return err
+	}
+	hostKeys, err := sftpHostKeys(key)
+	if err != nil {
+		return err
+	}
+
+	conn, err := ssh.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)), &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeys,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return fmt.Errorf("connecting to %s: %v", host, err)
+	}
+	defer conn.Close()
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		return fmt.Errorf("starting sftp on %s: %v", host, err)
+	}
+	defer client.Close()
+
+	in, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	remote := path.Join(dir, filepath.Base(local))
+	out, err := client.Create(remote + ".part")
+	if err != nil {
+		return fmt.Errorf("%s:%s: %v", host, remote, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("uploading to %s:%s: %v", host, remote, err)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// PosixRename replaces an existing file, where plain SFTP rename won't.
+	if err := client.PosixRename(remote+".part", remote); err != nil {
+		return fmt.Errorf("%s:%s: %v", host, remote, err)
+	}
+	return nil
+}
+
+// sftpSigner is the private key for the destination under key: key.key,
+// or the file key.keyfile.
+func sftpSigner(key string) (ssh.Signer, error) {
+	var pem []byte
+	if ref := viper.GetString(key + ".key"); ref != "" {
+		v, err := secretValue(ref)
+		if err != nil {
+			return nil, fmt.Errorf("config: %s.key: %v", key, err)
+		}
+		pem = []byte(v)
+	} else {
+		var err error
+		if pem, err = os.ReadFile(viper.GetString(key + ".keyfile")); err != nil {
+			return nil, fmt.Errorf("config: %s.keyfile: %v", key, err)
+		}
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("config: %s: private key: %v", key, err)
+	}
+	return signer, nil
+}
+
+// sftpHostKeys checks the server's host key against key.hostkeys, or the
+// file key.knownhosts.
+func sftpHostKeys(key string) (ssh.HostKeyCallback, error) {
+	ref := viper.GetString(key + ".hostkeys")
+	if ref == "" {
+		hostKeys, err := knownhosts.New(viper.GetString(key + ".knownhosts"))
+		if err != nil {
+			return nil, fmt.Errorf("config: %s.knownhosts: %v", key, err)
+		}
+		return hostKeys, nil
+	}
+	v, err := secretValue(ref)
+	if err != nil {
+		return nil, fmt.Errorf("config: %s.hostkeys: %v", key, err)
+	}
+	// knownhosts only reads files.
+	f, err := os.CreateTemp("", "known_hosts")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(v + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := knownhosts.New(f.Name())
+	if err != nil {
+		return nil, fmt.Errorf("config: %s.hostkeys: %v", key, err)
+	}
+	return hostKeys, nil
+}
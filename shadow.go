@@ -0,0 +1,269 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Shadow mode is for trying out a new database before we cut over to it.
+// With "mssql.shadow.enabled" every batch that loads is loaded again, as
+// its own batch, into the shadow database - "mssql.shadow.host", "port",
+// "user", "password" and "database" override the primary's settings - and
+// the two outcomes are compared record by record. The shadow only sees
+// the statement catalog (statements.go), so it must have the same schema
+// and procedures; a different engine would first need its own form of the
+// catalog and a driver.
+//
+// The shadow copy is checked against the shadow's own reference data and
+// column settings, in one transaction, and writes the same batch, error
+// statistics and discrepancy rows the primary does. Nothing else hears
+// about it: no ACK, webhooks, notifications or hooks (bar OnRecordParsed),
+// and its outboxes are only ever drained by a loader that uses it as the
+// primary. Primary and shadow keep their own IDs and confirmation
+// sequences, so neither is compared.
+//
+// What differs - the outcome of a record, its error codes, or a stored
+// column (see "ero.compare") - goes in a report, mssql.shadow.dir/
+// batch-<id>.json (encrypted with storage.key, if set), and is counted in
+// the shadow.divergences metric. A batch resumed from a checkpoint isn't
+// shadowed, since the summary only covers part of the file. Problems with
+// the shadow are logged and reported, never passed on to the batch.
+func init() {
+	viper.SetDefault("mssql.shadow.dir", "./shadow")
+}
+
+// shadowReport is how a batch and its shadow copy compare.
+type shadowReport struct {
+	Batch       int64              `json:"batch"`
+	ShadowBatch int64              `json:"shadowBatch,omitempty"`
+	File        string             `json:"file"`
+	Records     int                `json:"records"`
+	Compared    time.Time          `json:"compared"`
+	Error       string             `json:"error,omitempty"` // the shadow load failed
+	Divergences []shadowDivergence `json:"divergences"`
+}
+
+// shadowDivergence is one thing the primary and the shadow disagree on.
+type shadowDivergence struct {
+	Index   int    `json:"index"`
+	EFIN    string `json:"efin"`
+	Field   string `json:"field"` // "outcome", "errors", "deactivated" or an ero column
+	Primary string `json:"primary"`
+	Shadow  string `json:"shadow"`
+}
+
+// shadowBatch loads job's file into the shadow, if there is one, and
+// writes the report.
+func shadowBatch(dbs *databases, job *batchJob, summary loadSummary) {
+	if dbs.shadow == nil {
+		return
+	}
+	if summary.ResumedAt > 0 || job.Resumed {
+		job.logf("Batch %d not shadowed: resumed part way through\n", job.ID)
+		return
+	}
+
+	report := shadowReport{Batch: job.ID, File: job.File.Path, Records: len(job.File.Records), Divergences: []shadowDivergence{}}
+	sjob := &batchJob{File: job.File, Correlation: job.Correlation, Shadow: true}
+	shadowed, err := loadShadow(dbs.shadow, sjob)
+	report.ShadowBatch = sjob.ID
+	if err == nil {
+		report.Divergences, err = compareShadow(dbs.primary, dbs.shadow, summary, shadowed)
+	}
+	if err != nil {
+		report.Error = err.Error()
+		job.logf("Shadow of batch %d failed: %v", job.ID, err)
+	}
+	report.Compared = time.Now()
+
+	metricCount("shadow.divergences", len(report.Divergences), tag("transmitter", job.File.Transmitter()))
+	path, err := writeShadowReport(report)
+	if err != nil {
+		job.logf("writing shadow report for batch %d: %v", job.ID, err)
+		return
+	}
+	job.logf("Shadow batch %d: %d divergence(s) from batch %d (%s)\n", report.ShadowBatch, len(report.Divergences), job.ID, path)
+}
+
+// loadShadow loads sjob into the shadow database in one transaction.
+func loadShadow(db *sql.DB, sjob *batchJob) (loadSummary, error) {
+	versions, err := currentRefVersions(db)
+	if err != nil {
+		return loadSummary{}, err
+	}
+	if err := loadPolicies(viper.GetViper(), db, db, sjob, versions); err != nil {
+		return loadSummary{}, err
+	}
+	if sjob.ID, err = startBatch(db, sjob); err != nil {
+		return loadSummary{}, fmt.Errorf("starting batch: %v", err)
+	}
+
+	summary, err := loadFileTx(db, sjob, 0)
+	status := batchLoaded
+	if err != nil {
+		status = batchFailed
+	}
+	if finErr := finishBatch(db, sjob.ID, status, summary); finErr != nil {
+		sjob.logf("recording shadow batch %d outcome: %v", sjob.ID, finErr)
+	}
+	if err != nil {
+		return summary, err
+	}
+	if statErr := recordErrorStats(db, summary); statErr != nil {
+		sjob.logf("recording error statistics for shadow batch %d: %v", sjob.ID, statErr)
+	}
+	if dErr := recordDiscrepancies(db, sjob, summary); dErr != nil {
+		sjob.logf("recording prior-year discrepancies for shadow batch %d: %v", sjob.ID, dErr)
+	}
+	return summary, nil
+}
+
+// recordOutcome is what became of one record in a batch.
+type recordOutcome struct {
+	Outcome string // loaded, pending, rejected or deactivated
+	EFIN    string
+	ID      int64  // the ero row, if it was loaded
+	Detail  string // error codes, or how many rows were deactivated
+}
+
+func recordOutcomes(s loadSummary) map[int]recordOutcome {
+	out := map[int]recordOutcome{}
+	for _, r := range s.Loaded {
+		o := recordOutcome{Outcome: enrollmentLoaded, EFIN: r.EFIN, ID: r.ID}
+		if r.Flagged != "" {
+			o.Outcome = enrollmentPending
+		}
+		out[r.Index] = o
+	}
+	for _, r := range s.Rejected {
+		codes := make([]string, 0, len(r.Errors))
+		for _, e := range r.Errors {
+			codes = append(codes, e.Code)
+		}
+		sort.Strings(codes)
+		out[r.Index] = recordOutcome{Outcome: enrollmentRejected, EFIN: r.EFIN, Detail: strings.Join(codes, ",")}
+	}
+	for _, d := range s.Deactivated {
+		out[d.Index] = recordOutcome{Outcome: "deactivated", EFIN: d.EFIN, Detail: strconv.Itoa(len(d.IDs))}
+	}
+	return out
+}
+
+// compareShadow lists where the shadow's outcome differs from the
+// primary's, record by record.
+func compareShadow(primary, shadow *sql.DB, ps, ss loadSummary) ([]shadowDivergence, error) {
+	pOut, sOut := recordOutcomes(ps), recordOutcomes(ss)
+	indexes := make([]int, 0, len(pOut))
+	for i := range pOut {
+		indexes = append(indexes, i)
+	}
+	for i := range sOut {
+		if _, ok := pOut[i]; !ok {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+
+	pStmt, err := prepare(primary, "ero.compare")
+	if err != nil {
+		return nil, err
+	}
+	defer pStmt.Close()
+	sStmt, err := prepare(shadow, "ero.compare")
+	if err != nil {
+		return nil, err
+	}
+	defer sStmt.Close()
+
+	divergences := []shadowDivergence{}
+	for _, i := range indexes {
+		p, s := pOut[i], sOut[i]
+		efin := p.EFIN
+		if efin == "" {
+			efin = s.EFIN
+		}
+		diverge := func(field, pv, sv string) {
+			divergences = append(divergences, shadowDivergence{Index: i, EFIN: efin, Field: field, Primary: pv, Shadow: sv})
+		}
+
+		switch {
+		case p.Outcome != s.Outcome:
+			diverge("outcome", p.Outcome, s.Outcome)
+		case p.Outcome == enrollmentRejected && p.Detail != s.Detail:
+			diverge("errors", p.Detail, s.Detail)
+		case p.Outcome == "deactivated" && p.Detail != s.Detail:
+			diverge("deactivated", p.Detail, s.Detail)
+		case p.ID > 0 && s.ID > 0:
+			pRow, err := compareRow(pStmt, p.ID)
+			if err != nil {
+				return divergences, fmt.Errorf("reading primary row %d: %v", p.ID, err)
+			}
+			sRow, err := compareRow(sStmt, s.ID)
+			if err != nil {
+				return divergences, fmt.Errorf("reading shadow row %d: %v", s.ID, err)
+			}
+			for c, col := range compareColumns {
+				if pRow[c] != sRow[c] {
+					diverge(col, pRow[c], sRow[c])
+				}
+			}
+		}
+	}
+	return divergences, nil
+}
+
+// compareColumns are the columns of "ero.compare", in order.
+var compareColumns = []string{"EFIN", "COMPANY", "TAX_YEAR", "STATUS", "STATE", "PRIOR_BANK", "MASTER_EFIN",
+	"AMENDED", "FLAG_REASON", "PY_TIER", "SCHEDULE"}
+
+// compareRow reads one row through "ero.compare", as text.
+func compareRow(stmt *sql.Stmt, id int64) ([]string, error) {
+	var (
+		year    int
+		amended bool
+		row     = make([]string, len(compareColumns))
+	)
+	err := stmt.QueryRow(id).Scan(&row[0], &row[1], &year, &row[3], &row[4], &row[5], &row[6],
+		&amended, &row[8], &row[9], &row[10])
+	row[2], row[7] = strconv.Itoa(year), strconv.FormatBool(amended)
+	return row, err
+}
+
+// writeShadowReport writes the report under mssql.shadow.dir and returns
+// its path.
+func writeShadowReport(report shadowReport) (string, error) {
+	dir := viper.GetString("mssql.shadow.dir")
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("batch-%d.json", report.Batch))
+	return path, writeSealed(path, append(b, '\n'), 0640)
+}
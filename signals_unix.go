@@ -0,0 +1,64 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// waitForShutdown blocks until we are asked to stop (SIGINT, SIGTERM).
+// SIGUSR1 pauses the inbox watcher and SIGUSR2 resumes it.
+func waitForShutdown(w *watcher) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(sigs)
+
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGUSR1:
+			if w != nil {
+				w.pause()
+				log.Println("Paused (SIGUSR1)")
+			}
+		case syscall.SIGUSR2:
+			if w != nil {
+				w.resume()
+				log.Println("Resumed (SIGUSR2)")
+			}
+		default:
+			log.Printf("Stopping (%s)\n", sig)
+			return
+		}
+	}
+}
+
+// processAlive reports whether there is a process pid on this host (see
+// claim.go). Signal 0 checks without sending anything; EPERM means it is
+// there but not ours.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
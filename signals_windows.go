@@ -0,0 +1,47 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+//go:build windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+)
+
+// waitForShutdown blocks until we are asked to stop (Ctrl-C, or the
+// service being stopped). Windows has no SIGUSR1/2; use "enroll admin"
+// to pause and resume.
+func waitForShutdown(w *watcher) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	defer signal.Stop(sigs)
+
+	sig := <-sigs
+	log.Printf("Stopping (%s)\n", sig)
+}
+
+// processAlive reports whether there is a process pid on this host (see
+// claim.go). FindProcess opens it, and fails if there is none.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
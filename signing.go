@@ -0,0 +1,130 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Files we exchange with partners are signed with a detached HMAC-SHA256
+// signature: FILE.sig holds one line, "sha256=" + hex(HMAC(key, FILE)).
+// Both sides hold the shared key, so either can tell if a file was
+// altered in transit.
+//
+//	signing.ackkey                        signs the ACK files we send
+//	signing.transmitters.<id>.ackkey      per-vendor override
+//	signing.bankkey                       verifies the bank's response files
+//
+// Any of them may be a secret reference (secrets.go). With no key
+// configured, ACK files go out unsigned.
+
+// hmacSignature returns "sha256=" + hex(HMAC-SHA256(key, parts...)).
+func hmacSignature(key []byte, parts ...[]byte) string {
+	mac := hmac.New(sha256.New, key)
+	for _, p := range parts {
+		mac.Write(p)
+	}
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ackKey is the signing key for a transmitter's ACK files, if any. Either
+// setting may be a secret reference (secrets.go), such as the vendor's
+// ack-key credential (credentials.go).
+func ackKey(transmitter string) ([]byte, error) {
+	for _, name := range []string{"signing.transmitters." + transmitter + ".ackkey", "signing.ackkey"} {
+		if ref := viper.GetString(name); ref != "" {
+			k, err := secretValue(ref)
+			if err != nil {
+				return nil, fmt.Errorf("config: %s: %v", name, err)
+			}
+			return []byte(k), nil
+		}
+	}
+	return nil, nil
+}
+
+// signFile writes the detached signature for path to path + ".sig".
+func signFile(path string, key []byte) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path+".sig", []byte(hmacSignature(key, b)+"\n"), 0644)
+}
+
+// errBadSignature means the file doesn't match its signature.
+var errBadSignature = errors.New("signature does not match file contents")
+
+// verifyFile checks path against its detached signature in path + ".sig".
+func verifyFile(path string, key []byte) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sig, err := os.ReadFile(path + ".sig")
+	if err != nil {
+		return fmt.Errorf("reading signature: %v", err)
+	}
+
+	want := []byte(hmacSignature(key, b))
+	if !hmac.Equal(bytes.TrimSpace(sig), want) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// "enroll verify FILE..." checks inbound bank response files.
+var verifyCmd = &cobra.Command{
+	Use:   "verify FILE...",
+	Short: "Verify the signatures on bank response files",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ref := viper.GetString("signing.bankkey")
+		if ref == "" {
+			check(errors.New("config: signing.bankkey is not set"))
+		}
+		key, err := secretValue(ref)
+		if err != nil {
+			check(fmt.Errorf("config: signing.bankkey: %v", err))
+		}
+
+		bad := 0
+		for _, path := range args {
+			if err := verifyFile(path, []byte(key)); err != nil {
+				fmt.Printf("FAIL %s: %v\n", path, err)
+				bad++
+				continue
+			}
+			fmt.Printf("OK   %s\n", path)
+		}
+		if bad > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+}
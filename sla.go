@@ -0,0 +1,199 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// "enroll report sla --month 2016-01" summarizes, per transmitter, when
+// files arrived compared to the daily cutoff, how long we took to process
+// them, and how many records were rejected. It is built straight from the
+// batch table; replays are left out so a file only counts once.
+//
+// The cutoff is "sla.cutoff" (local time, default 17:00), overridden per
+// vendor with "sla.transmitters.<id>.cutoff".
+func init() {
+	viper.SetDefault("sla.cutoff", "17:00")
+}
+
+var slaMonth string
+
+var slaCmd = &cobra.Command{
+	Use:   "sla",
+	Short: "File arrival, processing latency and reject rates per transmitter",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		month, err := time.ParseInLocation("2006-01", slaMonth, time.Local)
+		if err != nil {
+			check(fmt.Errorf("--month must be YYYY-MM: %v", err))
+		}
+
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		stats, err := slaStats(dbs.reader(), month)
+		check(err)
+		check(printSLA(stats, month))
+	},
+}
+
+func init() {
+	slaCmd.Flags().StringVar(&slaMonth, "month", time.Now().Format("2006-01"), "month to report on (YYYY-MM)")
+	reportCmd.AddCommand(slaCmd)
+}
+
+// transmitterSLA is one transmitter's month.
+type transmitterSLA struct {
+	Transmitter  string
+	Cutoff       string
+	Files        int
+	Late         int // arrived after the cutoff
+	Failed       int
+	Records      int
+	Rejected     int
+	TotalLatency time.Duration // arrival to finished, summed over finished files
+	MaxLatency   time.Duration
+	Finished     int
+}
+
+func (t transmitterSLA) rejectRate() float64 {
+	if t.Records == 0 {
+		return 0
+	}
+	return 100 * float64(t.Rejected) / float64(t.Records)
+}
+
+func (t transmitterSLA) avgLatency() time.Duration {
+	if t.Finished == 0 {
+		return 0
+	}
+	return t.TotalLatency / time.Duration(t.Finished)
+}
+
+// cutoffFor returns a transmitter's daily cutoff as "HH:MM".
+func cutoffFor(transmitter string) string {
+	if c := viper.GetString("sla.transmitters." + transmitter + ".cutoff"); c != "" {
+		return c
+	}
+	return viper.GetString("sla.cutoff")
+}
+
+// afterCutoff reports whether t is later in its day than cutoff ("HH:MM").
+func afterCutoff(t time.Time, cutoff string) (bool, error) {
+	c, err := time.Parse("15:04", cutoff)
+	if err != nil {
+		return false, fmt.Errorf("bad cutoff %q: %v", cutoff, err)
+	}
+	t = t.In(time.Local)
+	limit := time.Date(t.Year(), t.Month(), t.Day(), c.Hour(), c.Minute(), 0, 0, time.Local)
+	return t.After(limit), nil
+}
+
+// slaStats reads the month's batches and totals them per transmitter.
+func slaStats(db *sql.DB, month time.Time) ([]*transmitterSLA, error) {
+	stmt, err := prepare(db, "batch.month")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(month, month.AddDate(0, 1, 0))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byTransmitter := map[string]*transmitterSLA{}
+	for rows.Next() {
+		var (
+			transmitter sql.NullString
+			arrived     time.Time
+			started     time.Time
+			finished    sql.NullTime
+			status      string
+			records     int
+			loaded      int
+			rejected    int
+		)
+		if err := rows.Scan(&transmitter, &arrived, &started, &finished, &status, &records, &loaded, &rejected); err != nil {
+			return nil, err
+		}
+
+		t := byTransmitter[transmitter.String]
+		if t == nil {
+			t = &transmitterSLA{Transmitter: transmitter.String, Cutoff: cutoffFor(transmitter.String)}
+			byTransmitter[transmitter.String] = t
+		}
+
+		t.Files++
+		t.Records += records
+		t.Rejected += rejected
+		if status == batchFailed {
+			t.Failed++
+		}
+
+		late, err := afterCutoff(arrived, t.Cutoff)
+		if err != nil {
+			return nil, err
+		}
+		if late {
+			t.Late++
+		}
+
+		if finished.Valid {
+			latency := finished.Time.Sub(arrived)
+			t.TotalLatency += latency
+			t.Finished++
+			if latency > t.MaxLatency {
+				t.MaxLatency = latency
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stats := make([]*transmitterSLA, 0, len(byTransmitter))
+	for _, t := range byTransmitter {
+		stats = append(stats, t)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Transmitter < stats[j].Transmitter })
+	return stats, nil
+}
+
+func printSLA(stats []*transmitterSLA, month time.Time) error {
+	fmt.Printf("SLA report for %s\n\n", month.Format("January 2006"))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TRANSMITTER\tCUTOFF\tFILES\tLATE\tFAILED\tAVG LATENCY\tMAX LATENCY\tRECORDS\tREJECTED\tREJECT %")
+	for _, t := range stats {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\t%s\t%d\t%d\t%.1f\n",
+			t.Transmitter, t.Cutoff, t.Files, t.Late, t.Failed,
+			t.avgLatency().Round(time.Second), t.MaxLatency.Round(time.Second),
+			t.Records, t.Rejected, t.rejectRate())
+	}
+	return w.Flush()
+}
@@ -0,0 +1,24 @@
+-- Stored procedures used when "mssql.storedprocedures" is true.
+--
+-- In that mode the loader never sends INSERT/UPDATE/DELETE statements;
+-- it only EXECs the procedures below. Grant the service account EXECUTE
+-- and nothing else:
+--
+--     GRANT EXECUTE ON SCHEMA::dbo TO [enrollment_loader];
+--
+-- Keep these in step with the catalog in statements.go.
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_insert
+    @EFIN          VARCHAR(6),
+    @COMPANY       NVARCHAR(100),
+    @TAX_YEAR      INT,
+    @RECEIVED_DATE DATETIME2
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    INSERT INTO ero(EFIN, COMPANY, TAX_YEAR, RECEIVED_DATE)
+    OUTPUT INSERTED.ID
+    VALUES (@EFIN, @COMPANY, @TAX_YEAR, @RECEIVED_DATE);
+END
+GO
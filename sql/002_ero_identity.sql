@@ -0,0 +1,9 @@
+-- The loader reads generated enrollment keys back with OUTPUT INSERTED.ID
+-- (the mssql driver has no LastInsertId), so ero needs an identity key.
+-- Child tables reference ero(ID).
+
+IF COL_LENGTH('dbo.ero', 'ID') IS NULL
+    ALTER TABLE dbo.ero
+        ADD ID INT IDENTITY(1, 1) NOT NULL
+            CONSTRAINT PK_ero PRIMARY KEY;
+GO
@@ -0,0 +1,101 @@
+-- Batches and versioned reference data.
+--
+-- Every file is loaded as a batch. The batch row records which version of
+-- the bank list and the approved EFIN list the file was validated against,
+-- so a replay can use exactly the same reference data.
+
+CREATE TABLE dbo.batch (
+    ID                INT IDENTITY(1, 1) NOT NULL CONSTRAINT PK_batch PRIMARY KEY,
+    FILE_NAME         NVARCHAR(260) NOT NULL,
+    SHA256            CHAR(64)      NOT NULL,
+    RECORD_COUNT      INT           NOT NULL,
+    STATUS            VARCHAR(20)   NOT NULL,
+    LOADED            INT           NULL,
+    REJECTED          INT           NULL,
+    STARTED_AT        DATETIME2     NOT NULL,
+    FINISHED_AT       DATETIME2     NULL,
+    BANK_LIST_VERSION INT           NULL,
+    EFIN_LIST_VERSION INT           NULL,
+    REPLAY_OF         INT           NULL CONSTRAINT FK_batch_replay REFERENCES dbo.batch(ID)
+);
+GO
+
+IF COL_LENGTH('dbo.ero', 'BATCH_ID') IS NULL
+    ALTER TABLE dbo.ero
+        ADD BATCH_ID INT NULL CONSTRAINT FK_ero_batch REFERENCES dbo.batch(ID);
+GO
+
+-- One row per snapshot of a reference list ("banks", "efins"). Snapshots
+-- are never updated in place: a refresh loads a new version.
+CREATE TABLE dbo.refdata_version (
+    LIST      VARCHAR(20) NOT NULL,
+    VERSION   INT         NOT NULL,
+    LOADED_AT DATETIME2   NOT NULL CONSTRAINT DF_refdata_version_loaded DEFAULT SYSUTCDATETIME(),
+    CONSTRAINT PK_refdata_version PRIMARY KEY (LIST, VERSION)
+);
+GO
+
+CREATE TABLE dbo.refdata_bank (
+    VERSION   INT           NOT NULL,
+    BANK_CODE VARCHAR(20)   NOT NULL,
+    BANK_NAME NVARCHAR(100) NOT NULL,
+    CONSTRAINT PK_refdata_bank PRIMARY KEY (VERSION, BANK_CODE)
+);
+GO
+
+CREATE TABLE dbo.refdata_efin (
+    VERSION INT        NOT NULL,
+    EFIN    VARCHAR(6) NOT NULL,
+    CONSTRAINT PK_refdata_efin PRIMARY KEY (VERSION, EFIN)
+);
+GO
+
+-- Stored procedures for mssql.storedprocedures mode.
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_insert
+    @EFIN          VARCHAR(6),
+    @COMPANY       NVARCHAR(100),
+    @TAX_YEAR      INT,
+    @RECEIVED_DATE DATETIME2,
+    @BATCH_ID      INT
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    INSERT INTO ero(EFIN, COMPANY, TAX_YEAR, RECEIVED_DATE, BATCH_ID)
+    OUTPUT INSERTED.ID
+    VALUES (@EFIN, @COMPANY, @TAX_YEAR, @RECEIVED_DATE, @BATCH_ID);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_batch_start
+    @FILE_NAME         NVARCHAR(260),
+    @SHA256            CHAR(64),
+    @RECORD_COUNT      INT,
+    @STARTED_AT        DATETIME2,
+    @BANK_LIST_VERSION INT,
+    @EFIN_LIST_VERSION INT,
+    @REPLAY_OF         INT
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    INSERT INTO batch(FILE_NAME, SHA256, RECORD_COUNT, STARTED_AT, STATUS, BANK_LIST_VERSION, EFIN_LIST_VERSION, REPLAY_OF)
+    OUTPUT INSERTED.ID
+    VALUES (@FILE_NAME, @SHA256, @RECORD_COUNT, @STARTED_AT, 'running', @BANK_LIST_VERSION, @EFIN_LIST_VERSION, @REPLAY_OF);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_batch_finish
+    @STATUS      VARCHAR(20),
+    @LOADED      INT,
+    @REJECTED    INT,
+    @FINISHED_AT DATETIME2,
+    @ID          INT
+AS
+BEGIN
+    UPDATE batch
+    SET STATUS = @STATUS, LOADED = @LOADED, REJECTED = @REJECTED, FINISHED_AT = @FINISHED_AT
+    WHERE ID = @ID;
+END
+GO
@@ -0,0 +1,32 @@
+-- Per-field error statistics, accumulated after every batch. One row per
+-- transmitter, field, error code and day. FIELD is '' for errors that
+-- aren't about a particular field (e.g. database errors).
+
+CREATE TABLE dbo.error_stats (
+    TRANSMITTER_ID VARCHAR(20) NOT NULL,
+    FIELD          VARCHAR(64) NOT NULL,
+    ERROR_CODE     VARCHAR(40) NOT NULL,
+    STAT_DATE      DATE        NOT NULL,
+    ERROR_COUNT    INT         NOT NULL,
+    CONSTRAINT PK_error_stats PRIMARY KEY (TRANSMITTER_ID, FIELD, ERROR_CODE, STAT_DATE)
+);
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_error_stats_add
+    @TRANSMITTER_ID VARCHAR(20),
+    @FIELD          VARCHAR(64),
+    @ERROR_CODE     VARCHAR(40),
+    @STAT_DATE      DATE,
+    @ERROR_COUNT    INT
+AS
+BEGIN
+    MERGE error_stats AS t
+    USING (SELECT @TRANSMITTER_ID, @FIELD, @ERROR_CODE, @STAT_DATE, @ERROR_COUNT)
+        AS s (TRANSMITTER_ID, FIELD, ERROR_CODE, STAT_DATE, ERROR_COUNT)
+    ON t.TRANSMITTER_ID = s.TRANSMITTER_ID AND t.FIELD = s.FIELD
+       AND t.ERROR_CODE = s.ERROR_CODE AND t.STAT_DATE = s.STAT_DATE
+    WHEN MATCHED THEN UPDATE SET ERROR_COUNT = t.ERROR_COUNT + s.ERROR_COUNT
+    WHEN NOT MATCHED THEN INSERT (TRANSMITTER_ID, FIELD, ERROR_CODE, STAT_DATE, ERROR_COUNT)
+        VALUES (s.TRANSMITTER_ID, s.FIELD, s.ERROR_CODE, s.STAT_DATE, s.ERROR_COUNT);
+END
+GO
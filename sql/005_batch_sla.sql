@@ -0,0 +1,32 @@
+-- Columns for the SLA report: who sent the file and when it arrived.
+
+IF COL_LENGTH('dbo.batch', 'TRANSMITTER_ID') IS NULL
+    ALTER TABLE dbo.batch ADD TRANSMITTER_ID VARCHAR(20) NULL;
+GO
+
+IF COL_LENGTH('dbo.batch', 'ARRIVED_AT') IS NULL
+    ALTER TABLE dbo.batch ADD ARRIVED_AT DATETIME2 NULL;
+GO
+
+CREATE INDEX IX_batch_arrived ON dbo.batch (ARRIVED_AT) INCLUDE (TRANSMITTER_ID);
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_batch_start
+    @FILE_NAME         NVARCHAR(260),
+    @SHA256            CHAR(64),
+    @RECORD_COUNT      INT,
+    @STARTED_AT        DATETIME2,
+    @BANK_LIST_VERSION INT,
+    @EFIN_LIST_VERSION INT,
+    @REPLAY_OF         INT,
+    @TRANSMITTER_ID    VARCHAR(20),
+    @ARRIVED_AT        DATETIME2
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    INSERT INTO batch(FILE_NAME, SHA256, RECORD_COUNT, STARTED_AT, STATUS, BANK_LIST_VERSION, EFIN_LIST_VERSION, REPLAY_OF, TRANSMITTER_ID, ARRIVED_AT)
+    OUTPUT INSERTED.ID
+    VALUES (@FILE_NAME, @SHA256, @RECORD_COUNT, @STARTED_AT, 'running', @BANK_LIST_VERSION, @EFIN_LIST_VERSION, @REPLAY_OF, @TRANSMITTER_ID, @ARRIVED_AT);
+END
+GO
@@ -0,0 +1,51 @@
+-- Review workflow: records flagged by the risk rules are loaded with
+-- STATUS = 'pending' and wait for an operator to approve ('loaded') or
+-- reject ('rejected') them. The reviewer and their note are kept.
+
+IF COL_LENGTH('dbo.ero', 'STATUS') IS NULL
+    ALTER TABLE dbo.ero
+        ADD STATUS VARCHAR(20) NOT NULL CONSTRAINT DF_ero_status DEFAULT 'loaded';
+GO
+
+IF COL_LENGTH('dbo.ero', 'FLAG_REASON') IS NULL
+    ALTER TABLE dbo.ero
+        ADD FLAG_REASON NVARCHAR(400) NULL,
+            REVIEWED_BY NVARCHAR(100) NULL,
+            REVIEWED_AT DATETIME2     NULL,
+            REVIEW_NOTE NVARCHAR(400) NULL;
+GO
+
+CREATE INDEX IX_ero_status ON dbo.ero (STATUS) WHERE STATUS = 'pending';
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_insert
+    @EFIN          VARCHAR(6),
+    @COMPANY       NVARCHAR(100),
+    @TAX_YEAR      INT,
+    @RECEIVED_DATE DATETIME2,
+    @BATCH_ID      INT,
+    @STATUS        VARCHAR(20),
+    @FLAG_REASON   NVARCHAR(400)
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    INSERT INTO ero(EFIN, COMPANY, TAX_YEAR, RECEIVED_DATE, BATCH_ID, STATUS, FLAG_REASON)
+    OUTPUT INSERTED.ID
+    VALUES (@EFIN, @COMPANY, @TAX_YEAR, @RECEIVED_DATE, @BATCH_ID, @STATUS, @FLAG_REASON);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_review
+    @STATUS      VARCHAR(20),
+    @REVIEWED_BY NVARCHAR(100),
+    @REVIEWED_AT DATETIME2,
+    @REVIEW_NOTE NVARCHAR(400),
+    @ID          INT
+AS
+BEGIN
+    UPDATE ero
+    SET STATUS = @STATUS, REVIEWED_BY = @REVIEWED_BY, REVIEWED_AT = @REVIEWED_AT, REVIEW_NOTE = @REVIEW_NOTE
+    WHERE ID = @ID AND STATUS = 'pending';
+END
+GO
@@ -0,0 +1,59 @@
+-- Claims stop two loader instances working on the same file at once. An
+-- instance inserts a row for the file's SHA-256 before it starts and
+-- deletes it when it's done; while loading it bumps HEARTBEAT_AT. A claim
+-- whose heartbeat is older than load.claimttl belongs to an instance that
+-- died, and can be taken over.
+--
+-- Times are the database's (SYSUTCDATETIME), so the instances' clocks
+-- don't have to agree.
+
+CREATE TABLE dbo.file_claim (
+    SHA256       CHAR(64)      NOT NULL CONSTRAINT PK_file_claim PRIMARY KEY,
+    FILE_NAME    NVARCHAR(260) NOT NULL,
+    CLAIMED_BY   VARCHAR(128)  NOT NULL,
+    CLAIMED_AT   DATETIME2     NOT NULL,
+    HEARTBEAT_AT DATETIME2     NOT NULL
+);
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_claim_insert
+    @SHA256     CHAR(64),
+    @FILE_NAME  NVARCHAR(260),
+    @CLAIMED_BY VARCHAR(128)
+AS
+BEGIN
+    INSERT INTO file_claim (SHA256, FILE_NAME, CLAIMED_BY, CLAIMED_AT, HEARTBEAT_AT)
+    VALUES (@SHA256, @FILE_NAME, @CLAIMED_BY, SYSUTCDATETIME(), SYSUTCDATETIME());
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_claim_takeover
+    @CLAIMED_BY VARCHAR(128),
+    @SHA256     CHAR(64),
+    @TTL        INT
+AS
+BEGIN
+    UPDATE file_claim
+    SET CLAIMED_BY = @CLAIMED_BY, CLAIMED_AT = SYSUTCDATETIME(), HEARTBEAT_AT = SYSUTCDATETIME()
+    WHERE SHA256 = @SHA256 AND HEARTBEAT_AT < DATEADD(SECOND, -@TTL, SYSUTCDATETIME());
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_claim_heartbeat
+    @SHA256     CHAR(64),
+    @CLAIMED_BY VARCHAR(128)
+AS
+BEGIN
+    UPDATE file_claim SET HEARTBEAT_AT = SYSUTCDATETIME()
+    WHERE SHA256 = @SHA256 AND CLAIMED_BY = @CLAIMED_BY;
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_claim_release
+    @SHA256     CHAR(64),
+    @CLAIMED_BY VARCHAR(128)
+AS
+BEGIN
+    DELETE FROM file_claim WHERE SHA256 = @SHA256 AND CLAIMED_BY = @CLAIMED_BY;
+END
+GO
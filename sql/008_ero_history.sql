@@ -0,0 +1,20 @@
+-- Keep the history of every ero row so we can say what we had loaded on
+-- a given date (bank audits; "enroll status --as-of"). SQL Server does the
+-- bookkeeping: ero becomes a system-versioned temporal table, and every
+-- update (a review decision, say) or delete copies the old version of the
+-- row into ero_history along with when it was current.
+--
+-- VALID_FROM/VALID_TO are UTC and HIDDEN, so SELECT * is unchanged. Rows
+-- that already exist get the time of this migration as VALID_FROM: the
+-- history starts now, not when they were loaded.
+
+ALTER TABLE dbo.ero ADD
+    VALID_FROM DATETIME2 GENERATED ALWAYS AS ROW START HIDDEN
+        CONSTRAINT DF_ero_VALID_FROM DEFAULT SYSUTCDATETIME(),
+    VALID_TO   DATETIME2 GENERATED ALWAYS AS ROW END HIDDEN
+        CONSTRAINT DF_ero_VALID_TO DEFAULT CONVERT(DATETIME2, '9999-12-31 23:59:59.9999999'),
+    PERIOD FOR SYSTEM_TIME (VALID_FROM, VALID_TO);
+GO
+
+ALTER TABLE dbo.ero SET (SYSTEM_VERSIONING = ON (HISTORY_TABLE = dbo.ero_history));
+GO
@@ -0,0 +1,31 @@
+-- Columns for the end-of-day control report to the bank: the office
+-- state, the prior-year bank, and whether the record amends an enrollment
+-- we already had for the EFIN and tax year (rather than being new).
+
+IF COL_LENGTH('dbo.ero', 'STATE') IS NULL
+    ALTER TABLE dbo.ero
+        ADD STATE      CHAR(2)      NULL,
+            PRIOR_BANK NVARCHAR(60) NULL,
+            AMENDED    BIT          NOT NULL CONSTRAINT DF_ero_amended DEFAULT 0;
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_insert
+    @EFIN          VARCHAR(6),
+    @COMPANY       NVARCHAR(100),
+    @TAX_YEAR      INT,
+    @RECEIVED_DATE DATETIME2,
+    @BATCH_ID      INT,
+    @STATUS        VARCHAR(20),
+    @FLAG_REASON   NVARCHAR(400),
+    @STATE         CHAR(2),
+    @PRIOR_BANK    NVARCHAR(60)
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    INSERT INTO ero(EFIN, COMPANY, TAX_YEAR, RECEIVED_DATE, BATCH_ID, STATUS, FLAG_REASON, STATE, PRIOR_BANK, AMENDED)
+    OUTPUT INSERTED.ID
+    SELECT @EFIN, @COMPANY, @TAX_YEAR, @RECEIVED_DATE, @BATCH_ID, @STATUS, @FLAG_REASON, @STATE, @PRIOR_BANK,
+        CASE WHEN EXISTS (SELECT 1 FROM ero WHERE EFIN = @EFIN AND TAX_YEAR = @TAX_YEAR) THEN 1 ELSE 0 END;
+END
+GO
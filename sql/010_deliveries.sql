@@ -0,0 +1,51 @@
+-- Return files (ACKs and their signatures) pushed to each transmitter's
+-- SFTP directory or S3 prefix. One row per file; failed deliveries stay
+-- at STATUS = 'failed' until "enroll deliveries --retry" gets them out.
+
+CREATE TABLE dbo.delivery (
+    ID             INT IDENTITY(1,1) NOT NULL CONSTRAINT PK_delivery PRIMARY KEY,
+    BATCH_ID       INT               NOT NULL,
+    TRANSMITTER_ID VARCHAR(20)       NOT NULL,
+    FILE_NAME      NVARCHAR(260)     NOT NULL,
+    TARGET         NVARCHAR(400)     NOT NULL,
+    STATUS         VARCHAR(20)       NOT NULL,
+    ATTEMPTS       INT               NOT NULL CONSTRAINT DF_delivery_attempts DEFAULT 0,
+    LAST_ERROR     NVARCHAR(1000)    NULL,
+    CREATED_AT     DATETIME2         NOT NULL,
+    DELIVERED_AT   DATETIME2         NULL
+);
+GO
+
+CREATE INDEX IX_delivery_status ON dbo.delivery (STATUS) WHERE STATUS <> 'delivered';
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_delivery_add
+    @BATCH_ID       INT,
+    @TRANSMITTER_ID VARCHAR(20),
+    @FILE_NAME      NVARCHAR(260),
+    @TARGET         NVARCHAR(400),
+    @STATUS         VARCHAR(20),
+    @CREATED_AT     DATETIME2
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    INSERT INTO delivery (BATCH_ID, TRANSMITTER_ID, FILE_NAME, TARGET, STATUS, CREATED_AT)
+    OUTPUT INSERTED.ID
+    VALUES (@BATCH_ID, @TRANSMITTER_ID, @FILE_NAME, @TARGET, @STATUS, @CREATED_AT);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_delivery_update
+    @STATUS       VARCHAR(20),
+    @ATTEMPTS     INT,
+    @LAST_ERROR   NVARCHAR(1000),
+    @DELIVERED_AT DATETIME2,
+    @ID           INT
+AS
+BEGIN
+    UPDATE delivery
+    SET STATUS = @STATUS, ATTEMPTS = ATTEMPTS + @ATTEMPTS, LAST_ERROR = @LAST_ERROR, DELIVERED_AT = @DELIVERED_AT
+    WHERE ID = @ID;
+END
+GO
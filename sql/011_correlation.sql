@@ -0,0 +1,61 @@
+-- Correlation IDs: one per file on the batch row, and one per record
+-- (the file's ID plus the record's index) on the ero row, so a support
+-- engineer can find an enrollment from the ID in the log, the ACK or an
+-- API response.
+
+IF COL_LENGTH('dbo.batch', 'CORRELATION_ID') IS NULL
+    ALTER TABLE dbo.batch ADD CORRELATION_ID VARCHAR(36) NULL;
+GO
+
+IF COL_LENGTH('dbo.ero', 'CORRELATION_ID') IS NULL
+    ALTER TABLE dbo.ero ADD CORRELATION_ID VARCHAR(48) NULL;
+GO
+
+CREATE INDEX IX_batch_correlation ON dbo.batch (CORRELATION_ID) WHERE CORRELATION_ID IS NOT NULL;
+GO
+
+CREATE INDEX IX_ero_correlation ON dbo.ero (CORRELATION_ID) WHERE CORRELATION_ID IS NOT NULL;
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_batch_start
+    @FILE_NAME         NVARCHAR(260),
+    @SHA256            CHAR(64),
+    @RECORD_COUNT      INT,
+    @STARTED_AT        DATETIME2,
+    @BANK_LIST_VERSION INT,
+    @EFIN_LIST_VERSION INT,
+    @REPLAY_OF         INT,
+    @TRANSMITTER_ID    VARCHAR(20),
+    @ARRIVED_AT        DATETIME2,
+    @CORRELATION_ID    VARCHAR(36)
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    INSERT INTO batch(FILE_NAME, SHA256, RECORD_COUNT, STARTED_AT, STATUS, BANK_LIST_VERSION, EFIN_LIST_VERSION, REPLAY_OF, TRANSMITTER_ID, ARRIVED_AT, CORRELATION_ID)
+    OUTPUT INSERTED.ID
+    VALUES (@FILE_NAME, @SHA256, @RECORD_COUNT, @STARTED_AT, 'running', @BANK_LIST_VERSION, @EFIN_LIST_VERSION, @REPLAY_OF, @TRANSMITTER_ID, @ARRIVED_AT, @CORRELATION_ID);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_insert
+    @EFIN           VARCHAR(6),
+    @COMPANY        NVARCHAR(100),
+    @TAX_YEAR       INT,
+    @RECEIVED_DATE  DATETIME2,
+    @BATCH_ID       INT,
+    @STATUS         VARCHAR(20),
+    @FLAG_REASON    NVARCHAR(400),
+    @STATE          CHAR(2),
+    @PRIOR_BANK     NVARCHAR(60),
+    @CORRELATION_ID VARCHAR(48)
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    INSERT INTO ero(EFIN, COMPANY, TAX_YEAR, RECEIVED_DATE, BATCH_ID, STATUS, FLAG_REASON, STATE, PRIOR_BANK, CORRELATION_ID, AMENDED)
+    OUTPUT INSERTED.ID
+    SELECT @EFIN, @COMPANY, @TAX_YEAR, @RECEIVED_DATE, @BATCH_ID, @STATUS, @FLAG_REASON, @STATE, @PRIOR_BANK, @CORRELATION_ID,
+        CASE WHEN EXISTS (SELECT 1 FROM ero WHERE EFIN = @EFIN AND TAX_YEAR = @TAX_YEAR) THEN 1 ELSE 0 END;
+END
+GO
@@ -0,0 +1,67 @@
+-- Loader health for the ops dashboard (SSRS / Power BI): one row per
+-- finished batch with how long it waited and took, and its throughput.
+-- v_load_metrics_hourly rolls them up per hour and transmitter.
+
+CREATE TABLE dbo.load_metrics (
+    BATCH_ID        INT           NOT NULL CONSTRAINT PK_load_metrics PRIMARY KEY,
+    TRANSMITTER_ID  VARCHAR(20)   NULL,
+    INSTANCE        VARCHAR(128)  NOT NULL,
+    STATUS          VARCHAR(20)   NOT NULL,
+    ARRIVED_AT      DATETIME2     NULL,
+    STARTED_AT      DATETIME2     NOT NULL,
+    FINISHED_AT     DATETIME2     NOT NULL,
+    QUEUE_SECONDS   INT           NULL,     -- arrival to start
+    DURATION_MS     INT           NOT NULL, -- start to finish
+    RECORDS         INT           NOT NULL,
+    LOADED          INT           NOT NULL,
+    REJECTED        INT           NOT NULL,
+    RECORDS_PER_SEC DECIMAL(10,2) NOT NULL
+);
+GO
+
+CREATE INDEX IX_load_metrics_finished ON dbo.load_metrics (FINISHED_AT);
+GO
+
+CREATE OR ALTER VIEW dbo.v_load_metrics_hourly AS
+SELECT
+    DATEADD(HOUR, DATEDIFF(HOUR, 0, FINISHED_AT), 0) AS HOUR_START,
+    TRANSMITTER_ID,
+    COUNT(*)                                          AS FILES,
+    SUM(CASE WHEN STATUS = 'failed' THEN 1 ELSE 0 END) AS FAILED,
+    SUM(RECORDS)                                      AS RECORDS,
+    SUM(REJECTED)                                     AS REJECTED,
+    AVG(CAST(DURATION_MS AS BIGINT))                  AS AVG_DURATION_MS,
+    MAX(DURATION_MS)                                  AS MAX_DURATION_MS,
+    AVG(CAST(QUEUE_SECONDS AS BIGINT))                AS AVG_QUEUE_SECONDS,
+    MAX(QUEUE_SECONDS)                                AS MAX_QUEUE_SECONDS,
+    AVG(RECORDS_PER_SEC)                              AS AVG_RECORDS_PER_SEC
+FROM dbo.load_metrics
+GROUP BY DATEADD(HOUR, DATEDIFF(HOUR, 0, FINISHED_AT), 0), TRANSMITTER_ID;
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_load_metrics_add
+    @BATCH_ID        INT,
+    @TRANSMITTER_ID  VARCHAR(20),
+    @INSTANCE        VARCHAR(128),
+    @STATUS          VARCHAR(20),
+    @ARRIVED_AT      DATETIME2,
+    @STARTED_AT      DATETIME2,
+    @FINISHED_AT     DATETIME2,
+    @QUEUE_SECONDS   INT,
+    @DURATION_MS     INT,
+    @RECORDS         INT,
+    @LOADED          INT,
+    @REJECTED        INT,
+    @RECORDS_PER_SEC DECIMAL(10,2)
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    -- A resumed batch finishes more than once; keep the last run.
+    DELETE FROM load_metrics WHERE BATCH_ID = @BATCH_ID;
+    INSERT INTO load_metrics(BATCH_ID, TRANSMITTER_ID, INSTANCE, STATUS, ARRIVED_AT, STARTED_AT, FINISHED_AT,
+        QUEUE_SECONDS, DURATION_MS, RECORDS, LOADED, REJECTED, RECORDS_PER_SEC)
+    VALUES (@BATCH_ID, @TRANSMITTER_ID, @INSTANCE, @STATUS, @ARRIVED_AT, @STARTED_AT, @FINISHED_AT,
+        @QUEUE_SECONDS, @DURATION_MS, @RECORDS, @LOADED, @REJECTED, @RECORDS_PER_SEC);
+END
+GO
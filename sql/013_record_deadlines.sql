@@ -0,0 +1,27 @@
+-- Every enrollment must be forwarded to the bank within sla.record.window
+-- (24 hours) of its TransactionDate (RECEIVED_DATE). A record counts as
+-- forwarded once the end-of-day report that includes it has been
+-- delivered to the bank; FORWARDED_AT records when.
+
+IF COL_LENGTH('dbo.ero', 'FORWARDED_AT') IS NULL
+    ALTER TABLE dbo.ero ADD FORWARDED_AT DATETIME2 NULL;
+GO
+
+IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = 'IX_ero_unforwarded' AND object_id = OBJECT_ID('dbo.ero'))
+    CREATE INDEX IX_ero_unforwarded ON dbo.ero (RECEIVED_DATE) INCLUDE (STATUS, BATCH_ID) WHERE FORWARDED_AT IS NULL;
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_forwarded
+    @FORWARDED_AT DATETIME2,
+    @FROM         DATETIME2,
+    @TO           DATETIME2
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    UPDATE e SET FORWARDED_AT = @FORWARDED_AT
+    FROM ero e JOIN batch b ON b.ID = e.BATCH_ID
+    WHERE b.STARTED_AT >= @FROM AND b.STARTED_AT < @TO AND b.REPLAY_OF IS NULL
+      AND e.FORWARDED_AT IS NULL AND e.STATUS <> 'rejected';
+END
+GO
@@ -0,0 +1,52 @@
+-- Records waiting to be sent to the bank's enrollment API (bankapi.go).
+-- A record is queued when it is loaded (or approved in review) and
+-- removed once the bank has accepted it, which also marks it forwarded.
+-- It stays queued while the API is down; nothing is lost if it is.
+
+CREATE TABLE dbo.bank_outbox (
+    ERO_ID        INT            NOT NULL CONSTRAINT PK_bank_outbox PRIMARY KEY,
+    QUEUED_AT     DATETIME2      NOT NULL,
+    ATTEMPTS      INT            NOT NULL CONSTRAINT DF_bank_outbox_attempts DEFAULT 0,
+    LAST_ERROR    NVARCHAR(1000) NULL,
+    LAST_TRIED_AT DATETIME2      NULL
+);
+GO
+
+CREATE INDEX IX_bank_outbox_queued ON dbo.bank_outbox (QUEUED_AT) INCLUDE (ATTEMPTS);
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_bank_outbox_add
+    @ERO_ID    INT,
+    @QUEUED_AT DATETIME2
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    IF NOT EXISTS (SELECT 1 FROM bank_outbox WHERE ERO_ID = @ERO_ID)
+        INSERT INTO bank_outbox (ERO_ID, QUEUED_AT) VALUES (@ERO_ID, @QUEUED_AT);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_bank_outbox_sent
+    @FORWARDED_AT DATETIME2,
+    @ERO_ID       INT
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    UPDATE ero SET FORWARDED_AT = COALESCE(FORWARDED_AT, @FORWARDED_AT) WHERE ID = @ERO_ID;
+    DELETE FROM bank_outbox WHERE ERO_ID = @ERO_ID;
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_bank_outbox_failed
+    @LAST_ERROR    NVARCHAR(1000),
+    @LAST_TRIED_AT DATETIME2,
+    @ERO_ID        INT
+AS
+BEGIN
+    UPDATE bank_outbox
+    SET ATTEMPTS = ATTEMPTS + 1, LAST_ERROR = @LAST_ERROR, LAST_TRIED_AT = @LAST_TRIED_AT
+    WHERE ERO_ID = @ERO_ID;
+END
+GO
@@ -0,0 +1,19 @@
+-- Numbers that must be unique across every loader instance come from the
+-- database, never from a counter in the process. Batch IDs already do
+-- (batch.ID is an IDENTITY); confirmation numbers (one per accepted
+-- enrollment) come from this sequence. CACHE keeps allocation cheap; the
+-- cost is a gap in the numbers after a restart or failover, never a
+-- repeat.
+
+IF OBJECT_ID('dbo.seq_confirmation', 'SO') IS NULL
+    CREATE SEQUENCE dbo.seq_confirmation AS BIGINT START WITH 1 INCREMENT BY 1 NO CYCLE CACHE 100;
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_sequence_confirmation
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    SELECT NEXT VALUE FOR dbo.seq_confirmation;
+END
+GO
@@ -0,0 +1,44 @@
+-- Every accepted enrollment gets a confirmation number (confirmation.go)
+-- that the transmitter can quote back to look it up. Numbers come from
+-- dbo.seq_confirmation (sql/015_sequences.sql); records waiting for review
+-- get theirs when they are approved.
+
+IF COL_LENGTH('dbo.ero', 'CONFIRMATION') IS NULL
+    ALTER TABLE dbo.ero ADD CONFIRMATION VARCHAR(40) NULL;
+GO
+
+IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = 'UX_ero_confirmation' AND object_id = OBJECT_ID('dbo.ero'))
+    CREATE UNIQUE INDEX UX_ero_confirmation ON dbo.ero (CONFIRMATION) WHERE CONFIRMATION IS NOT NULL;
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_insert
+    @EFIN           VARCHAR(6),
+    @COMPANY        NVARCHAR(100),
+    @TAX_YEAR       INT,
+    @RECEIVED_DATE  DATETIME2,
+    @BATCH_ID       INT,
+    @STATUS         VARCHAR(20),
+    @FLAG_REASON    NVARCHAR(400),
+    @STATE          CHAR(2),
+    @PRIOR_BANK     NVARCHAR(60),
+    @CORRELATION_ID VARCHAR(48),
+    @CONFIRMATION   VARCHAR(40)
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    INSERT INTO ero(EFIN, COMPANY, TAX_YEAR, RECEIVED_DATE, BATCH_ID, STATUS, FLAG_REASON, STATE, PRIOR_BANK, CORRELATION_ID, CONFIRMATION, AMENDED)
+    OUTPUT INSERTED.ID
+    SELECT @EFIN, @COMPANY, @TAX_YEAR, @RECEIVED_DATE, @BATCH_ID, @STATUS, @FLAG_REASON, @STATE, @PRIOR_BANK, @CORRELATION_ID, @CONFIRMATION,
+        CASE WHEN EXISTS (SELECT 1 FROM ero WHERE EFIN = @EFIN AND TAX_YEAR = @TAX_YEAR) THEN 1 ELSE 0 END;
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_confirm
+    @CONFIRMATION VARCHAR(40),
+    @ID           INT
+AS
+BEGIN
+    UPDATE ero SET CONFIRMATION = @CONFIRMATION WHERE ID = @ID AND CONFIRMATION IS NULL;
+END
+GO
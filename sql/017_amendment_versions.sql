@@ -0,0 +1,45 @@
+-- Optimistic concurrency for amendments (amend.go). Before checking a
+-- record the loader reads the latest record for its EFIN and tax year -
+-- the one it amends - and its VERSION; the insert only goes ahead if that
+-- is still the latest and hasn't changed since. Otherwise another load
+-- got there first and nothing is inserted, so the loser is rejected as a
+-- conflict instead of silently undoing the winner.
+--
+-- The history table gets VERSION too, as BINARY(8).
+
+IF COL_LENGTH('dbo.ero', 'VERSION') IS NULL
+    ALTER TABLE dbo.ero ADD VERSION ROWVERSION;
+GO
+
+IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = 'IX_ero_efin_year' AND object_id = OBJECT_ID('dbo.ero'))
+    CREATE INDEX IX_ero_efin_year ON dbo.ero (EFIN, TAX_YEAR, ID) INCLUDE (STATUS);
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_insert
+    @EFIN           VARCHAR(6),
+    @COMPANY        NVARCHAR(100),
+    @TAX_YEAR       INT,
+    @RECEIVED_DATE  DATETIME2,
+    @BATCH_ID       INT,
+    @STATUS         VARCHAR(20),
+    @FLAG_REASON    NVARCHAR(400),
+    @STATE          CHAR(2),
+    @PRIOR_BANK     NVARCHAR(60),
+    @CORRELATION_ID VARCHAR(48),
+    @CONFIRMATION   VARCHAR(40),
+    @BASE_ID        INT,        -- the record this one amends; 0 if none
+    @BASE_VERSION   BINARY(8)   -- its VERSION when the loader read it
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    -- No row comes back if the record we amend isn't current any more.
+    INSERT INTO ero(EFIN, COMPANY, TAX_YEAR, RECEIVED_DATE, BATCH_ID, STATUS, FLAG_REASON, STATE, PRIOR_BANK, CORRELATION_ID, CONFIRMATION, AMENDED)
+    OUTPUT INSERTED.ID
+    SELECT @EFIN, @COMPANY, @TAX_YEAR, @RECEIVED_DATE, @BATCH_ID, @STATUS, @FLAG_REASON, @STATE, @PRIOR_BANK, @CORRELATION_ID, @CONFIRMATION,
+        CASE WHEN EXISTS (SELECT 1 FROM ero WHERE EFIN = @EFIN AND TAX_YEAR = @TAX_YEAR) THEN 1 ELSE 0 END
+    WHERE COALESCE((SELECT TOP 1 ID FROM ero WITH (UPDLOCK, HOLDLOCK)
+            WHERE EFIN = @EFIN AND TAX_YEAR = @TAX_YEAR AND STATUS <> 'rejected' ORDER BY ID DESC), 0) = @BASE_ID
+        AND NOT EXISTS (SELECT 1 FROM ero WHERE ID = @BASE_ID AND VERSION <> @BASE_VERSION);
+END
+GO
@@ -0,0 +1,67 @@
+-- De-enrollment (deactivate.go). A record with action="deactivate" marks
+-- its EFIN inactive for the tax year, with the reason and the batch that
+-- did it, and the same for every office whose master EFIN it is - so ero
+-- now keeps each record's MASTER_EFIN too.
+
+IF COL_LENGTH('dbo.ero', 'MASTER_EFIN') IS NULL
+    ALTER TABLE dbo.ero ADD MASTER_EFIN VARCHAR(6) NULL;
+GO
+
+IF COL_LENGTH('dbo.ero', 'DEACTIVATED_AT') IS NULL
+    ALTER TABLE dbo.ero ADD
+        DEACTIVATED_AT      DATETIME2     NULL,
+        DEACTIVATION_REASON NVARCHAR(400) NULL,
+        DEACTIVATION_BATCH  INT           NULL;
+GO
+
+IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = 'IX_ero_master_efin' AND object_id = OBJECT_ID('dbo.ero'))
+    CREATE INDEX IX_ero_master_efin ON dbo.ero (MASTER_EFIN, TAX_YEAR) INCLUDE (STATUS) WHERE MASTER_EFIN IS NOT NULL;
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_insert
+    @EFIN           VARCHAR(6),
+    @COMPANY        NVARCHAR(100),
+    @TAX_YEAR       INT,
+    @RECEIVED_DATE  DATETIME2,
+    @BATCH_ID       INT,
+    @STATUS         VARCHAR(20),
+    @FLAG_REASON    NVARCHAR(400),
+    @STATE          CHAR(2),
+    @PRIOR_BANK     NVARCHAR(60),
+    @CORRELATION_ID VARCHAR(48),
+    @CONFIRMATION   VARCHAR(40),
+    @MASTER_EFIN    VARCHAR(6),
+    @BASE_ID        INT,        -- the record this one amends; 0 if none
+    @BASE_VERSION   BINARY(8)   -- its VERSION when the loader read it
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    -- No row comes back if the record we amend isn't current any more.
+    INSERT INTO ero(EFIN, COMPANY, TAX_YEAR, RECEIVED_DATE, BATCH_ID, STATUS, FLAG_REASON, STATE, PRIOR_BANK, CORRELATION_ID, CONFIRMATION, MASTER_EFIN, AMENDED)
+    OUTPUT INSERTED.ID
+    SELECT @EFIN, @COMPANY, @TAX_YEAR, @RECEIVED_DATE, @BATCH_ID, @STATUS, @FLAG_REASON, @STATE, @PRIOR_BANK, @CORRELATION_ID, @CONFIRMATION, @MASTER_EFIN,
+        CASE WHEN EXISTS (SELECT 1 FROM ero WHERE EFIN = @EFIN AND TAX_YEAR = @TAX_YEAR) THEN 1 ELSE 0 END
+    WHERE COALESCE((SELECT TOP 1 ID FROM ero WITH (UPDLOCK, HOLDLOCK)
+            WHERE EFIN = @EFIN AND TAX_YEAR = @TAX_YEAR AND STATUS <> 'rejected' ORDER BY ID DESC), 0) = @BASE_ID
+        AND NOT EXISTS (SELECT 1 FROM ero WHERE ID = @BASE_ID AND VERSION <> @BASE_VERSION);
+END
+GO
+
+-- Returns the ID and EFIN of every row it deactivated.
+CREATE OR ALTER PROCEDURE dbo.usp_ero_deactivate
+    @DEACTIVATED_AT      DATETIME2,
+    @DEACTIVATION_REASON NVARCHAR(400),
+    @DEACTIVATION_BATCH  INT,
+    @EFIN                VARCHAR(6),
+    @TAX_YEAR            INT
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    UPDATE ero SET STATUS = 'inactive', DEACTIVATED_AT = @DEACTIVATED_AT,
+        DEACTIVATION_REASON = @DEACTIVATION_REASON, DEACTIVATION_BATCH = @DEACTIVATION_BATCH
+    OUTPUT INSERTED.ID, INSERTED.EFIN
+    WHERE (EFIN = @EFIN OR MASTER_EFIN = @EFIN) AND TAX_YEAR = @TAX_YEAR AND STATUS IN ('loaded', 'pending');
+END
+GO
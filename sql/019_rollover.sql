@@ -0,0 +1,24 @@
+-- Season rollover (rollover.go). "enroll rollover" copies eligible
+-- enrollments from one tax year into the next; ROLLED_FROM is the record a
+-- row was carried forward from. The insert skips EFINs that already have
+-- a record for the new year, so a rollover can be run again safely.
+
+IF COL_LENGTH('dbo.ero', 'ROLLED_FROM') IS NULL
+    ALTER TABLE dbo.ero ADD ROLLED_FROM INT NULL;
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_rollover
+    @TAX_YEAR      INT,
+    @RECEIVED_DATE DATETIME2,
+    @ID            INT
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    INSERT INTO ero(EFIN, COMPANY, TAX_YEAR, RECEIVED_DATE, STATUS, STATE, PRIOR_BANK, MASTER_EFIN, ROLLED_FROM, AMENDED)
+    OUTPUT INSERTED.ID
+    SELECT e.EFIN, e.COMPANY, @TAX_YEAR, @RECEIVED_DATE, 'loaded', e.STATE, e.PRIOR_BANK, e.MASTER_EFIN, e.ID, 0
+    FROM ero e
+    WHERE e.ID = @ID AND NOT EXISTS (SELECT 1 FROM ero n WHERE n.EFIN = e.EFIN AND n.TAX_YEAR = @TAX_YEAR);
+END
+GO
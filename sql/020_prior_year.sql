@@ -0,0 +1,40 @@
+-- Prior-year cross-reference (prioryear.go). While loading we look the
+-- EFIN up in our own prior-year data and keep what we found with the
+-- record, so its PriorYearInfo claims can be checked against it:
+--
+--   PY_RETURNING  we had an accepted record for it last year
+--   PY_BANK       the bank it was with last year, by our records
+--   PY_VOLUME     its return volume last year, from efin_volume
+--   PY_TIER       the volume tier that falls in (prioryear.tiers)
+--
+-- efin_volume is filled from the bank's year-end production report.
+
+IF COL_LENGTH('dbo.ero', 'PY_RETURNING') IS NULL
+    ALTER TABLE dbo.ero ADD
+        PY_RETURNING BIT          NULL,
+        PY_BANK      NVARCHAR(60) NULL,
+        PY_VOLUME    INT          NULL,
+        PY_TIER      VARCHAR(20)  NULL;
+GO
+
+IF OBJECT_ID('dbo.efin_volume', 'U') IS NULL
+    CREATE TABLE dbo.efin_volume (
+        EFIN     VARCHAR(6) NOT NULL,
+        TAX_YEAR INT        NOT NULL,
+        RETURNS  INT        NOT NULL,
+        CONSTRAINT PK_efin_volume PRIMARY KEY (EFIN, TAX_YEAR)
+    );
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_enrich
+    @PY_RETURNING BIT,
+    @PY_BANK      NVARCHAR(60),
+    @PY_VOLUME    INT,
+    @PY_TIER      VARCHAR(20),
+    @ID           INT
+AS
+BEGIN
+    UPDATE ero SET PY_RETURNING = @PY_RETURNING, PY_BANK = @PY_BANK, PY_VOLUME = @PY_VOLUME, PY_TIER = @PY_TIER
+    WHERE ID = @ID;
+END
+GO
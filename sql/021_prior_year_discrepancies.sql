@@ -0,0 +1,40 @@
+-- Every PriorYearInfo claim our prior-year data contradicts
+-- (prioryear.go), whatever became of the record: rejected, held for
+-- review (flagged) or loaded with a warning (warned). "enroll report
+-- discrepancies" lists them per transmitter.
+
+CREATE TABLE dbo.prior_year_discrepancy (
+    ID             INT IDENTITY(1,1) NOT NULL CONSTRAINT PK_prior_year_discrepancy PRIMARY KEY,
+    BATCH_ID       INT           NOT NULL,
+    TRANSMITTER_ID VARCHAR(20)   NULL,
+    RECORD_INDEX   INT           NOT NULL,
+    EFIN           VARCHAR(6)    NULL,
+    ERO_ID         INT           NULL,
+    FIELD          VARCHAR(100)  NOT NULL,
+    CLAIMED        NVARCHAR(60)  NULL,
+    ACTUAL         NVARCHAR(60)  NULL,
+    OUTCOME        VARCHAR(20)   NOT NULL,
+    CREATED_AT     DATETIME2     NOT NULL
+);
+GO
+
+CREATE INDEX IX_prior_year_discrepancy_transmitter ON dbo.prior_year_discrepancy (TRANSMITTER_ID, CREATED_AT);
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_prior_year_discrepancy_add
+    @BATCH_ID       INT,
+    @TRANSMITTER_ID VARCHAR(20),
+    @RECORD_INDEX   INT,
+    @EFIN           VARCHAR(6),
+    @ERO_ID         INT,
+    @FIELD          VARCHAR(100),
+    @CLAIMED        NVARCHAR(60),
+    @ACTUAL         NVARCHAR(60),
+    @OUTCOME        VARCHAR(20),
+    @CREATED_AT     DATETIME2
+AS
+BEGIN
+    INSERT INTO prior_year_discrepancy (BATCH_ID, TRANSMITTER_ID, RECORD_INDEX, EFIN, ERO_ID, FIELD, CLAIMED, ACTUAL, OUTCOME, CREATED_AT)
+    VALUES (@BATCH_ID, @TRANSMITTER_ID, @RECORD_INDEX, @EFIN, @ERO_ID, @FIELD, @CLAIMED, @ACTUAL, @OUTCOME, @CREATED_AT);
+END
+GO
@@ -0,0 +1,31 @@
+-- Fee schedule for each accepted enrollment (pricing.go), assigned by the
+-- pricing rules from its prior-year volume tier (PY_TIER,
+-- sql/020_prior_year.sql) and bank. This replaces the SQL script that was
+-- run by hand after every load. RULE_NO is the rule that matched, from 1.
+
+CREATE TABLE dbo.ero_pricing (
+    ERO_ID      INT          NOT NULL CONSTRAINT PK_ero_pricing PRIMARY KEY,
+    SCHEDULE    VARCHAR(40)  NOT NULL,
+    TIER        VARCHAR(20)  NULL,
+    BANK        NVARCHAR(60) NULL,
+    RULE_NO     INT          NOT NULL,
+    ASSIGNED_AT DATETIME2    NOT NULL
+);
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_pricing_set
+    @ERO_ID      INT,
+    @SCHEDULE    VARCHAR(40),
+    @TIER        VARCHAR(20),
+    @BANK        NVARCHAR(60),
+    @RULE_NO     INT,
+    @ASSIGNED_AT DATETIME2
+AS
+BEGIN
+    MERGE ero_pricing AS t
+    USING (SELECT @ERO_ID AS ERO_ID) AS s ON t.ERO_ID = s.ERO_ID
+    WHEN MATCHED THEN UPDATE SET SCHEDULE = @SCHEDULE, TIER = @TIER, BANK = @BANK, RULE_NO = @RULE_NO, ASSIGNED_AT = @ASSIGNED_AT
+    WHEN NOT MATCHED THEN INSERT (ERO_ID, SCHEDULE, TIER, BANK, RULE_NO, ASSIGNED_AT)
+        VALUES (@ERO_ID, @SCHEDULE, @TIER, @BANK, @RULE_NO, @ASSIGNED_AT);
+END
+GO
@@ -0,0 +1,106 @@
+-- Events for downstream systems (events.go), queued in the same
+-- transaction as the record they are about and sent by "enroll serve".
+-- Sent events are kept (SENT_AT) so we know what went out.
+--
+-- enrollment.welcome tells fulfillment to send a welcome kit the first
+-- time we accept an EFIN, so there is at most one per EFIN. A record
+-- that goes to review queues its event HELD: approving it releases the
+-- event, rejecting it drops it.
+
+IF OBJECT_ID('dbo.event_outbox', 'U') IS NULL
+    CREATE TABLE dbo.event_outbox (
+        ID            INT            IDENTITY(1,1) NOT NULL CONSTRAINT PK_event_outbox PRIMARY KEY,
+        EVENT_TYPE    VARCHAR(50)    NOT NULL,
+        ERO_ID        INT            NOT NULL,
+        EFIN          VARCHAR(6)     NOT NULL,
+        PAYLOAD       NVARCHAR(MAX)  NOT NULL,
+        HELD          BIT            NOT NULL CONSTRAINT DF_event_outbox_held DEFAULT 0,
+        CREATED_AT    DATETIME2      NOT NULL,
+        ATTEMPTS      INT            NOT NULL CONSTRAINT DF_event_outbox_attempts DEFAULT 0,
+        LAST_ERROR    NVARCHAR(1000) NULL,
+        LAST_TRIED_AT DATETIME2      NULL,
+        SENT_AT       DATETIME2      NULL
+    );
+GO
+
+IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = 'UX_event_outbox_welcome' AND object_id = OBJECT_ID('dbo.event_outbox'))
+    CREATE UNIQUE INDEX UX_event_outbox_welcome ON dbo.event_outbox (EFIN) WHERE EVENT_TYPE = 'enrollment.welcome';
+GO
+
+IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = 'IX_event_outbox_unsent' AND object_id = OBJECT_ID('dbo.event_outbox'))
+    CREATE INDEX IX_event_outbox_unsent ON dbo.event_outbox (ID) INCLUDE (ATTEMPTS, HELD) WHERE SENT_AT IS NULL;
+GO
+
+IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = 'IX_event_outbox_ero' AND object_id = OBJECT_ID('dbo.event_outbox'))
+    CREATE INDEX IX_event_outbox_ero ON dbo.event_outbox (ERO_ID);
+GO
+
+-- Queues the welcome event unless the EFIN has had one, or has been
+-- accepted before (under another record). An accepted record replaces
+-- a welcome still held for review.
+CREATE OR ALTER PROCEDURE dbo.usp_event_outbox_welcome
+    @ERO_ID     INT,
+    @EFIN       VARCHAR(6),
+    @PAYLOAD    NVARCHAR(MAX),
+    @HELD       BIT,
+    @CREATED_AT DATETIME2
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    IF @HELD = 0
+        DELETE FROM event_outbox WHERE EVENT_TYPE = 'enrollment.welcome' AND EFIN = @EFIN AND HELD = 1;
+
+    INSERT INTO event_outbox (EVENT_TYPE, ERO_ID, EFIN, PAYLOAD, HELD, CREATED_AT)
+    SELECT 'enrollment.welcome', @ERO_ID, @EFIN, @PAYLOAD, @HELD, @CREATED_AT
+    WHERE NOT EXISTS (SELECT 1 FROM event_outbox WITH (UPDLOCK, HOLDLOCK) WHERE EVENT_TYPE = 'enrollment.welcome' AND EFIN = @EFIN)
+      AND NOT EXISTS (SELECT 1 FROM ero WHERE EFIN = @EFIN AND ID <> @ERO_ID AND STATUS IN ('loaded', 'inactive'));
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_event_outbox_release
+    @CONFIRMATION VARCHAR(40),
+    @ERO_ID       INT
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    UPDATE event_outbox SET HELD = 0, PAYLOAD = JSON_MODIFY(PAYLOAD, '$.confirmation', @CONFIRMATION)
+    WHERE ERO_ID = @ERO_ID AND HELD = 1;
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_event_outbox_drop
+    @ERO_ID INT
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    DELETE FROM event_outbox WHERE ERO_ID = @ERO_ID AND HELD = 1;
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_event_outbox_sent
+    @SENT_AT DATETIME2,
+    @ID      INT
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    UPDATE event_outbox SET SENT_AT = @SENT_AT WHERE ID = @ID;
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_event_outbox_failed
+    @LAST_ERROR    NVARCHAR(1000),
+    @LAST_TRIED_AT DATETIME2,
+    @ID            INT
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    UPDATE event_outbox
+    SET ATTEMPTS = ATTEMPTS + 1, LAST_ERROR = @LAST_ERROR, LAST_TRIED_AT = @LAST_TRIED_AT
+    WHERE ID = @ID;
+END
+GO
@@ -0,0 +1,116 @@
+-- Email address verification (verify.go). Each accepted enrollment gets
+-- a random token; our email service sends the office a link with it and
+-- following the link marks the enrollment's email verified.
+--
+-- Only the SHA-256 of the token is kept for lookups. The token itself is
+-- needed until the email goes out and is cleared once it has. A record
+-- that goes to review has its token HELD until it is approved (or
+-- dropped if it is rejected).
+
+IF COL_LENGTH('dbo.ero', 'EMAIL_VERIFIED_AT') IS NULL
+    ALTER TABLE dbo.ero ADD EMAIL_VERIFIED_AT DATETIME2 NULL;
+GO
+
+IF OBJECT_ID('dbo.email_verification', 'U') IS NULL
+    CREATE TABLE dbo.email_verification (
+        TOKEN_HASH    CHAR(64)       NOT NULL CONSTRAINT PK_email_verification PRIMARY KEY,
+        TOKEN         VARCHAR(64)    NULL,
+        ERO_ID        INT            NOT NULL,
+        EMAIL         NVARCHAR(254)  NOT NULL,
+        HELD          BIT            NOT NULL CONSTRAINT DF_email_verification_held DEFAULT 0,
+        CREATED_AT    DATETIME2      NOT NULL,
+        ATTEMPTS      INT            NOT NULL CONSTRAINT DF_email_verification_attempts DEFAULT 0,
+        LAST_ERROR    NVARCHAR(1000) NULL,
+        SENT_AT       DATETIME2      NULL,
+        VERIFIED_AT   DATETIME2      NULL
+    );
+GO
+
+IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = 'IX_email_verification_ero' AND object_id = OBJECT_ID('dbo.email_verification'))
+    CREATE INDEX IX_email_verification_ero ON dbo.email_verification (ERO_ID);
+GO
+
+IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = 'IX_email_verification_unsent' AND object_id = OBJECT_ID('dbo.email_verification'))
+    CREATE INDEX IX_email_verification_unsent ON dbo.email_verification (CREATED_AT) INCLUDE (ATTEMPTS, HELD) WHERE SENT_AT IS NULL;
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_email_verification_add
+    @TOKEN_HASH CHAR(64),
+    @TOKEN      VARCHAR(64),
+    @ERO_ID     INT,
+    @EMAIL      NVARCHAR(254),
+    @HELD       BIT,
+    @CREATED_AT DATETIME2
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    INSERT INTO email_verification (TOKEN_HASH, TOKEN, ERO_ID, EMAIL, HELD, CREATED_AT)
+    VALUES (@TOKEN_HASH, @TOKEN, @ERO_ID, @EMAIL, @HELD, @CREATED_AT);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_email_verification_release
+    @ERO_ID INT
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    UPDATE email_verification SET HELD = 0 WHERE ERO_ID = @ERO_ID AND HELD = 1;
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_email_verification_drop
+    @ERO_ID INT
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    DELETE FROM email_verification WHERE ERO_ID = @ERO_ID AND HELD = 1;
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_email_verification_sent
+    @SENT_AT    DATETIME2,
+    @TOKEN_HASH CHAR(64)
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    UPDATE email_verification SET SENT_AT = @SENT_AT, TOKEN = NULL WHERE TOKEN_HASH = @TOKEN_HASH;
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_email_verification_failed
+    @LAST_ERROR NVARCHAR(1000),
+    @TOKEN_HASH CHAR(64)
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    UPDATE email_verification SET ATTEMPTS = ATTEMPTS + 1, LAST_ERROR = @LAST_ERROR WHERE TOKEN_HASH = @TOKEN_HASH;
+END
+GO
+
+-- Verifies the token if it was sent no earlier than @SENT_AFTER and its
+-- record is still active, and returns the record's ID (no rows if not).
+CREATE OR ALTER PROCEDURE dbo.usp_email_verification_verify
+    @VERIFIED_AT DATETIME2,
+    @TOKEN_HASH  CHAR(64),
+    @SENT_AFTER  DATETIME2
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    DECLARE @ids TABLE (ERO_ID INT);
+
+    UPDATE email_verification SET VERIFIED_AT = COALESCE(VERIFIED_AT, @VERIFIED_AT)
+    OUTPUT inserted.ERO_ID INTO @ids
+    WHERE TOKEN_HASH = @TOKEN_HASH AND SENT_AT >= @SENT_AFTER;
+
+    UPDATE e SET EMAIL_VERIFIED_AT = COALESCE(e.EMAIL_VERIFIED_AT, @VERIFIED_AT)
+    OUTPUT inserted.ID
+    FROM ero e JOIN @ids i ON i.ERO_ID = e.ID
+    WHERE e.STATUS = 'loaded';
+END
+GO
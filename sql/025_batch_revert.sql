@@ -0,0 +1,107 @@
+-- Reverting a bad batch (revert.go). By default its records are rejected
+-- after the fact, with who did it and why in the review columns; with
+-- --delete they are removed (the history table still has them). Either
+-- way everything still queued on their behalf is dropped, EFINs the batch
+-- deactivated get back the status they had before, and the batch row
+-- says it was reverted, when and by whom.
+
+IF COL_LENGTH('dbo.batch', 'REVERTED_AT') IS NULL
+    ALTER TABLE dbo.batch ADD
+        REVERTED_AT DATETIME2     NULL,
+        REVERTED_BY NVARCHAR(100) NULL,
+        REVERT_NOTE NVARCHAR(400) NULL;
+GO
+
+IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = 'IX_ero_batch' AND object_id = OBJECT_ID('dbo.ero'))
+    CREATE INDEX IX_ero_batch ON dbo.ero (BATCH_ID) INCLUDE (STATUS, FORWARDED_AT);
+GO
+
+IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = 'IX_ero_deactivation_batch' AND object_id = OBJECT_ID('dbo.ero'))
+    CREATE INDEX IX_ero_deactivation_batch ON dbo.ero (DEACTIVATION_BATCH) WHERE DEACTIVATION_BATCH IS NOT NULL;
+GO
+
+-- Row counts matter to the caller here: no SET NOCOUNT ON.
+CREATE OR ALTER PROCEDURE dbo.usp_batch_revert
+    @REVERTED_AT DATETIME2,
+    @REVERTED_BY NVARCHAR(100),
+    @REVERT_NOTE NVARCHAR(400),
+    @ID          INT
+AS
+BEGIN
+    UPDATE batch SET STATUS = 'reverted', REVERTED_AT = @REVERTED_AT, REVERTED_BY = @REVERTED_BY, REVERT_NOTE = @REVERT_NOTE
+    WHERE ID = @ID AND STATUS NOT IN ('running', 'reverted');
+END
+GO
+
+-- Returns the ID of every row it put back, and the batch that loaded it.
+CREATE OR ALTER PROCEDURE dbo.usp_ero_revert_deactivations
+    @DEACTIVATION_BATCH INT
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    UPDATE e SET
+        STATUS = COALESCE((SELECT TOP 1 h.STATUS FROM ero FOR SYSTEM_TIME ALL h
+            WHERE h.ID = e.ID AND h.STATUS <> 'inactive' ORDER BY h.VALID_TO DESC), 'loaded'),
+        DEACTIVATED_AT = NULL, DEACTIVATION_REASON = NULL, DEACTIVATION_BATCH = NULL
+    OUTPUT INSERTED.ID, COALESCE(INSERTED.BATCH_ID, 0)
+    FROM ero e
+    WHERE e.DEACTIVATION_BATCH = @DEACTIVATION_BATCH AND e.STATUS = 'inactive';
+END
+GO
+
+-- Returns the ID of every row it rejected and whether the bank had it.
+CREATE OR ALTER PROCEDURE dbo.usp_ero_revert
+    @REVIEWED_BY NVARCHAR(100),
+    @REVIEWED_AT DATETIME2,
+    @REVIEW_NOTE NVARCHAR(400),
+    @BATCH_ID    INT
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    UPDATE ero SET STATUS = 'rejected', REVIEWED_BY = @REVIEWED_BY, REVIEWED_AT = @REVIEWED_AT, REVIEW_NOTE = @REVIEW_NOTE
+    OUTPUT INSERTED.ID, CASE WHEN INSERTED.FORWARDED_AT IS NULL THEN 0 ELSE 1 END
+    WHERE BATCH_ID = @BATCH_ID AND STATUS <> 'rejected';
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_delete_batch
+    @BATCH_ID INT
+AS
+BEGIN
+    DELETE FROM ero WHERE BATCH_ID = @BATCH_ID;
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_bank_outbox_drop_batch
+    @BATCH_ID INT
+AS
+BEGIN
+    DELETE FROM bank_outbox WHERE ERO_ID IN (SELECT ID FROM ero WHERE BATCH_ID = @BATCH_ID);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_event_outbox_drop_batch
+    @BATCH_ID INT
+AS
+BEGIN
+    DELETE FROM event_outbox WHERE SENT_AT IS NULL AND ERO_ID IN (SELECT ID FROM ero WHERE BATCH_ID = @BATCH_ID);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_email_verification_drop_batch
+    @BATCH_ID INT
+AS
+BEGIN
+    DELETE FROM email_verification WHERE VERIFIED_AT IS NULL AND ERO_ID IN (SELECT ID FROM ero WHERE BATCH_ID = @BATCH_ID);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_pricing_drop_batch
+    @BATCH_ID INT
+AS
+BEGIN
+    DELETE FROM ero_pricing WHERE ERO_ID IN (SELECT ID FROM ero WHERE BATCH_ID = @BATCH_ID);
+END
+GO
@@ -0,0 +1,71 @@
+-- Canary rules (canary.go): a new version of the rules, tried on every
+-- record alongside the active ones without deciding anything. Each batch
+-- records how many records the canary checked and how many it would have
+-- decided differently; each of those is kept with both outcomes. "enroll
+-- report canary" sums them up.
+
+CREATE TABLE dbo.canary_run (
+    ID             INT IDENTITY(1,1) NOT NULL CONSTRAINT PK_canary_run PRIMARY KEY,
+    BATCH_ID       INT           NOT NULL,
+    CANARY         NVARCHAR(100) NOT NULL,
+    TRANSMITTER_ID VARCHAR(20)   NULL,
+    CHECKED        INT           NOT NULL,
+    CHANGED        INT           NOT NULL,
+    CREATED_AT     DATETIME2     NOT NULL
+);
+GO
+
+CREATE INDEX IX_canary_run_created ON dbo.canary_run (CREATED_AT) INCLUDE (CANARY, TRANSMITTER_ID);
+GO
+
+-- OUTCOME is loaded, pending or rejected; DETAIL is the error codes of a
+-- rejected record or the review flags of a pending one.
+CREATE TABLE dbo.canary_result (
+    ID             INT IDENTITY(1,1) NOT NULL CONSTRAINT PK_canary_result PRIMARY KEY,
+    BATCH_ID       INT           NOT NULL,
+    CANARY         NVARCHAR(100) NOT NULL,
+    TRANSMITTER_ID VARCHAR(20)   NULL,
+    RECORD_INDEX   INT           NOT NULL,
+    EFIN           VARCHAR(6)    NULL,
+    ACTIVE_OUTCOME VARCHAR(20)   NOT NULL,
+    ACTIVE_DETAIL  NVARCHAR(400) NULL,
+    CANARY_OUTCOME VARCHAR(20)   NOT NULL,
+    CANARY_DETAIL  NVARCHAR(400) NULL,
+    CREATED_AT     DATETIME2     NOT NULL
+);
+GO
+
+CREATE INDEX IX_canary_result_created ON dbo.canary_result (CREATED_AT) INCLUDE (CANARY, TRANSMITTER_ID);
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_canary_run_add
+    @BATCH_ID       INT,
+    @CANARY         NVARCHAR(100),
+    @TRANSMITTER_ID VARCHAR(20),
+    @CHECKED        INT,
+    @CHANGED        INT,
+    @CREATED_AT     DATETIME2
+AS
+BEGIN
+    INSERT INTO canary_run (BATCH_ID, CANARY, TRANSMITTER_ID, CHECKED, CHANGED, CREATED_AT)
+    VALUES (@BATCH_ID, @CANARY, @TRANSMITTER_ID, @CHECKED, @CHANGED, @CREATED_AT);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_canary_result_add
+    @BATCH_ID       INT,
+    @CANARY         NVARCHAR(100),
+    @TRANSMITTER_ID VARCHAR(20),
+    @RECORD_INDEX   INT,
+    @EFIN           VARCHAR(6),
+    @ACTIVE_OUTCOME VARCHAR(20),
+    @ACTIVE_DETAIL  NVARCHAR(400),
+    @CANARY_OUTCOME VARCHAR(20),
+    @CANARY_DETAIL  NVARCHAR(400),
+    @CREATED_AT     DATETIME2
+AS
+BEGIN
+    INSERT INTO canary_result (BATCH_ID, CANARY, TRANSMITTER_ID, RECORD_INDEX, EFIN, ACTIVE_OUTCOME, ACTIVE_DETAIL, CANARY_OUTCOME, CANARY_DETAIL, CREATED_AT)
+    VALUES (@BATCH_ID, @CANARY, @TRANSMITTER_ID, @RECORD_INDEX, @EFIN, @ACTIVE_OUTCOME, @ACTIVE_DETAIL, @CANARY_OUTCOME, @CANARY_DETAIL, @CREATED_AT);
+END
+GO
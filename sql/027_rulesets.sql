@@ -0,0 +1,15 @@
+-- The version of the rules that judged each record (rules.go). Rejected
+-- records aren't stored; their ACK says which version rejected them.
+
+IF COL_LENGTH('dbo.ero', 'RULESET') IS NULL
+    ALTER TABLE dbo.ero ADD RULESET VARCHAR(40) NULL;
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_ruleset
+    @RULESET VARCHAR(40),
+    @ID      INT
+AS
+BEGIN
+    UPDATE ero SET RULESET = @RULESET WHERE ID = @ID;
+END
+GO
@@ -0,0 +1,38 @@
+-- Edits made through PATCH /v1/enrollments/{id} (edit.go). An edit is
+-- loaded as a one-record amendment batch, so the new row and the batch
+-- are audited as any other; this keeps who asked for it, why, what they
+-- changed from what, and how it came out.
+
+CREATE TABLE dbo.enrollment_edit (
+    ID        INT IDENTITY(1,1) NOT NULL CONSTRAINT PK_enrollment_edit PRIMARY KEY,
+    ERO_ID    INT            NOT NULL, -- the record edited
+    NEW_ID    INT            NULL,     -- the amendment, unless it was rejected
+    BATCH_ID  INT            NULL,
+    EDITED_BY NVARCHAR(100)  NOT NULL,
+    EDITED_AT DATETIME2      NOT NULL,
+    NOTE      NVARCHAR(400)  NULL,
+    CHANGES   NVARCHAR(MAX)  NOT NULL, -- JSON: {"field": {"from": ..., "to": ...}}
+    OUTCOME   VARCHAR(20)    NOT NULL, -- loaded, pending, rejected or failed
+    DETAIL    NVARCHAR(400)  NULL      -- error codes of a rejected edit, the error of a failed one
+);
+GO
+
+CREATE INDEX IX_enrollment_edit_ero ON dbo.enrollment_edit (ERO_ID);
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_enrollment_edit_add
+    @ERO_ID    INT,
+    @NEW_ID    INT,
+    @BATCH_ID  INT,
+    @EDITED_BY NVARCHAR(100),
+    @EDITED_AT DATETIME2,
+    @NOTE      NVARCHAR(400),
+    @CHANGES   NVARCHAR(MAX),
+    @OUTCOME   VARCHAR(20),
+    @DETAIL    NVARCHAR(400)
+AS
+BEGIN
+    INSERT INTO enrollment_edit (ERO_ID, NEW_ID, BATCH_ID, EDITED_BY, EDITED_AT, NOTE, CHANGES, OUTCOME, DETAIL)
+    VALUES (@ERO_ID, @NEW_ID, @BATCH_ID, @EDITED_BY, @EDITED_AT, @NOTE, @CHANGES, @OUTCOME, @DETAIL);
+END
+GO
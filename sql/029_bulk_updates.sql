@@ -0,0 +1,120 @@
+-- Bulk status updates (bulkupdate.go): every record matching a filter set
+-- to suspended, inactive or loaded at once, when a bank partner leaves
+-- mid-season. Each run is kept in bulk_update with who did it, why and
+-- the filter, and every row it changed points at its run; the row history
+-- (sql/008_ero_history.sql) has the status it had before.
+
+CREATE TABLE dbo.bulk_update (
+    ID         INT IDENTITY(1,1) NOT NULL CONSTRAINT PK_bulk_update PRIMARY KEY,
+    FILTER     NVARCHAR(400) NOT NULL,
+    NEW_STATUS VARCHAR(20)   NOT NULL,
+    REASON     NVARCHAR(400) NOT NULL,
+    UPDATED_BY NVARCHAR(100) NOT NULL,
+    UPDATED_AT DATETIME2     NOT NULL,
+    RECORDS    INT           NULL      -- how many rows it changed
+);
+GO
+
+IF COL_LENGTH('dbo.ero', 'BULK_UPDATE_ID') IS NULL
+    ALTER TABLE dbo.ero ADD BULK_UPDATE_ID INT NULL;
+GO
+
+IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = 'IX_ero_prior_bank' AND object_id = OBJECT_ID('dbo.ero'))
+    CREATE INDEX IX_ero_prior_bank ON dbo.ero (PRIOR_BANK, TAX_YEAR) INCLUDE (STATUS);
+GO
+
+-- A suspended office can still be de-enrolled.
+CREATE OR ALTER PROCEDURE dbo.usp_ero_deactivate
+    @DEACTIVATED_AT      DATETIME2,
+    @DEACTIVATION_REASON NVARCHAR(400),
+    @DEACTIVATION_BATCH  INT,
+    @EFIN                VARCHAR(6),
+    @TAX_YEAR            INT
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    UPDATE ero SET STATUS = 'inactive', DEACTIVATED_AT = @DEACTIVATED_AT,
+        DEACTIVATION_REASON = @DEACTIVATION_REASON, DEACTIVATION_BATCH = @DEACTIVATION_BATCH
+    OUTPUT INSERTED.ID, INSERTED.EFIN
+    WHERE (EFIN = @EFIN OR MASTER_EFIN = @EFIN) AND TAX_YEAR = @TAX_YEAR AND STATUS IN ('loaded', 'pending', 'suspended');
+END
+GO
+
+-- An empty (or 0) filter parameter matches anything.
+CREATE OR ALTER PROCEDURE dbo.usp_ero_bulk_preview
+    @NEW_STATUS     VARCHAR(20),
+    @BANK           NVARCHAR(60),
+    @TAX_YEAR       INT,
+    @EFIN           VARCHAR(6),
+    @MASTER_EFIN    VARCHAR(6),
+    @STATE          CHAR(2),
+    @STATUS         VARCHAR(20),
+    @BATCH_ID       INT,
+    @TRANSMITTER_ID VARCHAR(20)
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    SELECT e.STATUS, COUNT(*), SUM(CASE WHEN e.FORWARDED_AT IS NULL THEN 0 ELSE 1 END)
+    FROM ero e
+    WHERE e.STATUS IN ('loaded', 'pending', 'suspended') AND e.STATUS <> @NEW_STATUS
+        AND (@BANK = '' OR e.PRIOR_BANK = @BANK) AND (@TAX_YEAR = 0 OR e.TAX_YEAR = @TAX_YEAR) AND (@EFIN = '' OR e.EFIN = @EFIN)
+        AND (@MASTER_EFIN = '' OR e.MASTER_EFIN = @MASTER_EFIN) AND (@STATE = '' OR e.STATE = @STATE)
+        AND (@STATUS = '' OR e.STATUS = @STATUS) AND (@BATCH_ID = 0 OR e.BATCH_ID = @BATCH_ID)
+        AND (@TRANSMITTER_ID = '' OR EXISTS (SELECT 1 FROM batch b WHERE b.ID = e.BATCH_ID AND b.TRANSMITTER_ID = @TRANSMITTER_ID))
+    GROUP BY e.STATUS ORDER BY e.STATUS;
+END
+GO
+
+-- Returns the ID of every row it changed.
+CREATE OR ALTER PROCEDURE dbo.usp_ero_bulk_update
+    @NEW_STATUS     VARCHAR(20),
+    @BULK_UPDATE_ID INT,
+    @BANK           NVARCHAR(60),
+    @TAX_YEAR       INT,
+    @EFIN           VARCHAR(6),
+    @MASTER_EFIN    VARCHAR(6),
+    @STATE          CHAR(2),
+    @STATUS         VARCHAR(20),
+    @BATCH_ID       INT,
+    @TRANSMITTER_ID VARCHAR(20)
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    UPDATE e SET STATUS = @NEW_STATUS, BULK_UPDATE_ID = @BULK_UPDATE_ID
+    OUTPUT INSERTED.ID
+    FROM ero e
+    WHERE e.STATUS IN ('loaded', 'pending', 'suspended') AND e.STATUS <> @NEW_STATUS
+        AND (@BANK = '' OR e.PRIOR_BANK = @BANK) AND (@TAX_YEAR = 0 OR e.TAX_YEAR = @TAX_YEAR) AND (@EFIN = '' OR e.EFIN = @EFIN)
+        AND (@MASTER_EFIN = '' OR e.MASTER_EFIN = @MASTER_EFIN) AND (@STATE = '' OR e.STATE = @STATE)
+        AND (@STATUS = '' OR e.STATUS = @STATUS) AND (@BATCH_ID = 0 OR e.BATCH_ID = @BATCH_ID)
+        AND (@TRANSMITTER_ID = '' OR EXISTS (SELECT 1 FROM batch b WHERE b.ID = e.BATCH_ID AND b.TRANSMITTER_ID = @TRANSMITTER_ID));
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_bulk_update_add
+    @FILTER     NVARCHAR(400),
+    @NEW_STATUS VARCHAR(20),
+    @REASON     NVARCHAR(400),
+    @UPDATED_BY NVARCHAR(100),
+    @UPDATED_AT DATETIME2
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    INSERT INTO bulk_update (FILTER, NEW_STATUS, REASON, UPDATED_BY, UPDATED_AT)
+    OUTPUT INSERTED.ID
+    VALUES (@FILTER, @NEW_STATUS, @REASON, @UPDATED_BY, @UPDATED_AT);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_bulk_update_finish
+    @RECORDS INT,
+    @ID      INT
+AS
+BEGIN
+    UPDATE bulk_update SET RECORDS = @RECORDS WHERE ID = @ID;
+END
+GO
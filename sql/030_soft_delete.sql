@@ -0,0 +1,27 @@
+-- Soft deletes. Nothing removes an ero row any more: revert --delete
+-- (revert.go) rejects the batch's records and marks them deleted, with
+-- when, by whom and why, and the status, list and export commands leave
+-- deleted rows out unless --include-deleted. The pricing of a deleted
+-- record stays with it, as it does for a rejected one.
+
+IF COL_LENGTH('dbo.ero', 'DELETED_AT') IS NULL
+    ALTER TABLE dbo.ero ADD
+        DELETED_AT    DATETIME2     NULL,
+        DELETED_BY    NVARCHAR(100) NULL,
+        DELETE_REASON NVARCHAR(400) NULL;
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_delete_batch
+    @DELETED_AT    DATETIME2,
+    @DELETED_BY    NVARCHAR(100),
+    @DELETE_REASON NVARCHAR(400),
+    @BATCH_ID      INT
+AS
+BEGIN
+    UPDATE ero SET STATUS = 'rejected', DELETED_AT = @DELETED_AT, DELETED_BY = @DELETED_BY, DELETE_REASON = @DELETE_REASON
+    WHERE BATCH_ID = @BATCH_ID AND DELETED_AT IS NULL;
+END
+GO
+
+DROP PROCEDURE IF EXISTS dbo.usp_ero_pricing_drop_batch;
+GO
@@ -0,0 +1,150 @@
+-- Data-subject requests (subject.go). Each record is linked to the people
+-- in it - its owner and EFIN owner - by the HMAC of their SSN, and their
+-- details are kept here encrypted with a data key of their own. Erasing a
+-- person destroys their keys (crypto-shredding: every copy of the details,
+-- in the backups too, becomes unreadable) and blanks the plain-text copies
+-- elsewhere. legal_hold stops an erasure while a hold on the person or on
+-- one of their EFINs is in place; subject_erasure keeps each erasure's
+-- certificate.
+
+CREATE TABLE dbo.subject_key (
+    ID         INT IDENTITY(1,1) NOT NULL CONSTRAINT PK_subject_key PRIMARY KEY,
+    SSN_HASH   CHAR(64)        NOT NULL,
+    DATA_KEY   VARBINARY(256)  NULL,     -- sealed with storage.key if set; NULL once erased
+    CREATED_AT DATETIME2       NOT NULL,
+    ERASED_AT  DATETIME2       NULL,
+    ERASED_BY  NVARCHAR(100)   NULL
+);
+GO
+
+CREATE INDEX IX_subject_key_hash ON dbo.subject_key (SSN_HASH) INCLUDE (DATA_KEY);
+GO
+
+CREATE TABLE dbo.ero_subject (
+    ERO_ID   INT            NOT NULL,
+    ROLE     VARCHAR(20)    NOT NULL, -- owner or efinowner
+    SSN_HASH CHAR(64)       NOT NULL,
+    KEY_ID   INT            NOT NULL,
+    PERSONAL VARBINARY(MAX) NULL,     -- nonce + AES-GCM of the block as sent; NULL once erased
+    CONSTRAINT PK_ero_subject PRIMARY KEY (ERO_ID, ROLE)
+);
+GO
+
+CREATE INDEX IX_ero_subject_hash ON dbo.ero_subject (SSN_HASH);
+GO
+
+CREATE TABLE dbo.legal_hold (
+    ID          INT IDENTITY(1,1) NOT NULL CONSTRAINT PK_legal_hold PRIMARY KEY,
+    KIND        VARCHAR(10)    NOT NULL, -- efin, or owner (an SSN hash)
+    VALUE       VARCHAR(64)    NOT NULL,
+    REASON      NVARCHAR(400)  NOT NULL,
+    PLACED_BY   NVARCHAR(100)  NOT NULL,
+    PLACED_AT   DATETIME2      NOT NULL,
+    RELEASED_AT DATETIME2      NULL,
+    RELEASED_BY NVARCHAR(100)  NULL
+);
+GO
+
+CREATE INDEX IX_legal_hold_value ON dbo.legal_hold (KIND, VALUE) WHERE RELEASED_AT IS NULL;
+GO
+
+CREATE TABLE dbo.subject_erasure (
+    ID          INT IDENTITY(1,1) NOT NULL CONSTRAINT PK_subject_erasure PRIMARY KEY,
+    SSN_HASH    CHAR(64)       NOT NULL,
+    ERASED_AT   DATETIME2      NOT NULL,
+    ERASED_BY   NVARCHAR(100)  NOT NULL,
+    TICKET      NVARCHAR(100)  NOT NULL,
+    CERTIFICATE NVARCHAR(MAX)  NOT NULL  -- JSON, as written to privacy.certificates
+);
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_subject_key_add
+    @SSN_HASH   CHAR(64),
+    @DATA_KEY   VARBINARY(256),
+    @CREATED_AT DATETIME2
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    INSERT INTO subject_key (SSN_HASH, DATA_KEY, CREATED_AT)
+    OUTPUT INSERTED.ID
+    VALUES (@SSN_HASH, @DATA_KEY, @CREATED_AT);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_subject_key_erase
+    @ERASED_AT DATETIME2,
+    @ERASED_BY NVARCHAR(100),
+    @SSN_HASH  CHAR(64)
+AS
+BEGIN
+    UPDATE subject_key SET DATA_KEY = NULL, ERASED_AT = @ERASED_AT, ERASED_BY = @ERASED_BY
+    WHERE SSN_HASH = @SSN_HASH AND DATA_KEY IS NOT NULL;
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_subject_add
+    @ERO_ID   INT,
+    @ROLE     VARCHAR(20),
+    @SSN_HASH CHAR(64),
+    @KEY_ID   INT,
+    @PERSONAL VARBINARY(MAX)
+AS
+BEGIN
+    INSERT INTO ero_subject (ERO_ID, ROLE, SSN_HASH, KEY_ID, PERSONAL)
+    VALUES (@ERO_ID, @ROLE, @SSN_HASH, @KEY_ID, @PERSONAL);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_subject_erase
+    @SSN_HASH CHAR(64)
+AS
+BEGIN
+    UPDATE ero_subject SET PERSONAL = NULL WHERE SSN_HASH = @SSN_HASH AND PERSONAL IS NOT NULL;
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_email_verification_erase
+    @SSN_HASH CHAR(64)
+AS
+BEGIN
+    UPDATE email_verification SET EMAIL = '', TOKEN = NULL
+    WHERE EMAIL <> '' AND ERO_ID IN (SELECT ERO_ID FROM ero_subject WHERE SSN_HASH = @SSN_HASH);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_event_outbox_erase
+    @ERASED_AT DATETIME2,
+    @SSN_HASH  CHAR(64)
+AS
+BEGIN
+    UPDATE event_outbox SET PAYLOAD = '{}', SENT_AT = COALESCE(SENT_AT, @ERASED_AT),
+        LAST_ERROR = CASE WHEN SENT_AT IS NULL THEN 'erased before it was sent' ELSE LAST_ERROR END
+    WHERE PAYLOAD <> '{}' AND ERO_ID IN (SELECT ERO_ID FROM ero_subject WHERE SSN_HASH = @SSN_HASH);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_enrollment_edit_erase
+    @SSN_HASH CHAR(64)
+AS
+BEGIN
+    UPDATE d SET CHANGES = '{}', NOTE = NULL FROM enrollment_edit d
+    WHERE d.CHANGES <> '{}' AND EXISTS (SELECT 1 FROM ero_subject s WHERE s.SSN_HASH = @SSN_HASH AND s.ERO_ID IN (d.ERO_ID, d.NEW_ID));
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_subject_erasure_add
+    @SSN_HASH    CHAR(64),
+    @ERASED_AT   DATETIME2,
+    @ERASED_BY   NVARCHAR(100),
+    @TICKET      NVARCHAR(100),
+    @CERTIFICATE NVARCHAR(MAX)
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    INSERT INTO subject_erasure (SSN_HASH, ERASED_AT, ERASED_BY, TICKET, CERTIFICATE)
+    OUTPUT INSERTED.ID
+    VALUES (@SSN_HASH, @ERASED_AT, @ERASED_BY, @TICKET, @CERTIFICATE);
+END
+GO
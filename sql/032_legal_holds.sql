@@ -0,0 +1,45 @@
+-- Legal holds (hold.go). legal_hold itself came with the data-subject
+-- tables (031); "enroll hold" now places and releases holds, and
+-- revert --delete leaves the records they cover rejected but not deleted.
+
+CREATE OR ALTER PROCEDURE dbo.usp_legal_hold_add
+    @KIND      VARCHAR(10),
+    @VALUE     VARCHAR(64),
+    @REASON    NVARCHAR(400),
+    @PLACED_BY NVARCHAR(100),
+    @PLACED_AT DATETIME2
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    INSERT INTO legal_hold (KIND, VALUE, REASON, PLACED_BY, PLACED_AT)
+    OUTPUT INSERTED.ID
+    VALUES (@KIND, @VALUE, @REASON, @PLACED_BY, @PLACED_AT);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_legal_hold_release
+    @RELEASED_AT DATETIME2,
+    @RELEASED_BY NVARCHAR(100),
+    @ID          INT
+AS
+BEGIN
+    UPDATE legal_hold SET RELEASED_AT = @RELEASED_AT, RELEASED_BY = @RELEASED_BY
+    WHERE ID = @ID AND RELEASED_AT IS NULL;
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_delete_batch
+    @DELETED_AT    DATETIME2,
+    @DELETED_BY    NVARCHAR(100),
+    @DELETE_REASON NVARCHAR(400),
+    @BATCH_ID      INT
+AS
+BEGIN
+    UPDATE e SET STATUS = 'rejected', DELETED_AT = @DELETED_AT, DELETED_BY = @DELETED_BY, DELETE_REASON = @DELETE_REASON
+    FROM ero e
+    WHERE e.BATCH_ID = @BATCH_ID AND e.DELETED_AT IS NULL AND NOT EXISTS (SELECT 1 FROM legal_hold h WHERE h.RELEASED_AT IS NULL
+        AND (h.KIND = 'efin' AND h.VALUE = e.EFIN
+            OR h.KIND = 'owner' AND h.VALUE IN (SELECT s.SSN_HASH FROM ero_subject s WHERE s.ERO_ID = e.ID)));
+END
+GO
@@ -0,0 +1,51 @@
+-- Always Encrypted (alwaysencrypted.go). ero_sensitive keeps each
+-- record's owner and EFIN owner SSN and date of birth in columns the
+-- server only ever sees encrypted. Run this only with
+-- mssql.alwaysencrypted.enabled, and only once the DBAs have provisioned
+-- the keys (SSMS or the SqlServer PowerShell module):
+--
+--   CMK_enroll  the column master key, KEY_STORE_PROVIDER_NAME 'pfx' and
+--               KEY_PATH the path we have in mssql.alwaysencrypted.pfx
+--               (or MSSQL_CERTIFICATE_STORE on Windows). The certificate
+--               stays with us, never on the server.
+--   CEK_enroll  the column encryption key, wrapped by CMK_enroll.
+--
+-- Deterministic encryption needs a BIN2 collation. The feed carries no
+-- account numbers; any that it gains go here, randomized, the same way.
+
+CREATE TABLE dbo.ero_sensitive (
+    ERO_ID        INT          NOT NULL,
+    ROLE          VARCHAR(20)  NOT NULL, -- owner or efinowner
+    SSN           NVARCHAR(9)  COLLATE Latin1_General_BIN2
+        ENCRYPTED WITH (COLUMN_ENCRYPTION_KEY = CEK_enroll, ENCRYPTION_TYPE = DETERMINISTIC,
+            ALGORITHM = 'AEAD_AES_256_CBC_HMAC_SHA_256') NULL,
+    DATE_OF_BIRTH NVARCHAR(10) COLLATE Latin1_General_BIN2
+        ENCRYPTED WITH (COLUMN_ENCRYPTION_KEY = CEK_enroll, ENCRYPTION_TYPE = RANDOMIZED,
+            ALGORITHM = 'AEAD_AES_256_CBC_HMAC_SHA_256') NULL,
+    CONSTRAINT PK_ero_sensitive PRIMARY KEY (ERO_ID, ROLE)
+);
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_sensitive_add
+    @ERO_ID        INT,
+    @ROLE          VARCHAR(20),
+    @SSN           NVARCHAR(9),
+    @DATE_OF_BIRTH NVARCHAR(10)
+AS
+BEGIN
+    INSERT INTO ero_sensitive (ERO_ID, ROLE, SSN, DATE_OF_BIRTH)
+    VALUES (@ERO_ID, @ROLE, @SSN, @DATE_OF_BIRTH);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_sensitive_erase
+    @SSN_HASH CHAR(64)
+AS
+BEGIN
+    DELETE FROM ero_sensitive WHERE ERO_ID IN (SELECT ERO_ID FROM ero_subject WHERE SSN_HASH = @SSN_HASH);
+END
+GO
+
+-- Procedures that take encrypted parameters cache how to encrypt them.
+EXEC sp_refresh_parameter_encryption 'dbo.usp_ero_sensitive_add';
+GO
@@ -0,0 +1,44 @@
+-- Enrichment (enrich.go). The columns the enrich stage adds to a loaded
+-- record, by name: OFFICE_COUNTY and OFFICE_COUNTY_FIPS from the zip
+-- lookup, BANK_ROUTING_NUMBER and BANK_NAME from the bank lookup, and
+-- whatever enrichers compiled into the loader add. A lookup that failed
+-- leaves its rows out. v_ero_enriched has the built-in ones as columns
+-- beside the ero row, for the analytics team.
+
+CREATE TABLE dbo.ero_enrichment (
+    ERO_ID INT           NOT NULL,
+    NAME   VARCHAR(64)   NOT NULL,
+    VALUE  NVARCHAR(400) NULL,
+    CONSTRAINT PK_ero_enrichment PRIMARY KEY (ERO_ID, NAME)
+);
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_enrichment_add
+    @ERO_ID INT,
+    @NAME   VARCHAR(64),
+    @VALUE  NVARCHAR(400)
+AS
+BEGIN
+    INSERT INTO ero_enrichment (ERO_ID, NAME, VALUE) VALUES (@ERO_ID, @NAME, @VALUE);
+END
+GO
+
+CREATE OR ALTER VIEW dbo.v_ero_enriched AS
+SELECT
+    e.*,
+    x.OFFICE_COUNTY,
+    x.OFFICE_COUNTY_FIPS,
+    x.BANK_ROUTING_NUMBER,
+    x.BANK_NAME
+FROM dbo.ero e
+LEFT JOIN (
+    SELECT
+        ERO_ID,
+        MAX(CASE WHEN NAME = 'OFFICE_COUNTY'       THEN VALUE END) AS OFFICE_COUNTY,
+        MAX(CASE WHEN NAME = 'OFFICE_COUNTY_FIPS'  THEN VALUE END) AS OFFICE_COUNTY_FIPS,
+        MAX(CASE WHEN NAME = 'BANK_ROUTING_NUMBER' THEN VALUE END) AS BANK_ROUTING_NUMBER,
+        MAX(CASE WHEN NAME = 'BANK_NAME'           THEN VALUE END) AS BANK_NAME
+    FROM dbo.ero_enrichment
+    GROUP BY ERO_ID
+) x ON x.ERO_ID = e.ID;
+GO
@@ -0,0 +1,115 @@
+-- Reference data loaded by "enroll refdata load" (refdataload.go) rather
+-- than by hand in SSMS. Every version of a list now says when it takes
+-- effect, where it came from, who loaded it and how many rows it has; a
+-- batch uses the latest version of each list that is in effect when it
+-- starts. Two more lists join the bank and EFIN lists: the transmitters
+-- we accept files from and the state codes, and batches record which
+-- version of each they were checked against.
+
+IF COL_LENGTH('dbo.refdata_version', 'EFFECTIVE_FROM') IS NULL
+    ALTER TABLE dbo.refdata_version ADD
+        EFFECTIVE_FROM DATETIME2     NULL,
+        SOURCE         NVARCHAR(400) NULL,
+        LOADED_BY      NVARCHAR(128) NULL,
+        ROW_COUNT      INT           NULL;
+GO
+
+CREATE TABLE dbo.refdata_transmitter (
+    VERSION        INT           NOT NULL,
+    TRANSMITTER_ID VARCHAR(20)   NOT NULL,
+    NAME           NVARCHAR(100) NOT NULL,
+    CONSTRAINT PK_refdata_transmitter PRIMARY KEY (VERSION, TRANSMITTER_ID)
+);
+GO
+
+CREATE TABLE dbo.refdata_state (
+    VERSION    INT          NOT NULL,
+    STATE_CODE CHAR(2)      NOT NULL,
+    NAME       NVARCHAR(60) NOT NULL,
+    CONSTRAINT PK_refdata_state PRIMARY KEY (VERSION, STATE_CODE)
+);
+GO
+
+IF COL_LENGTH('dbo.batch', 'TRANSMITTER_LIST_VERSION') IS NULL
+    ALTER TABLE dbo.batch ADD
+        TRANSMITTER_LIST_VERSION INT NULL,
+        STATE_LIST_VERSION       INT NULL;
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_batch_start
+    @FILE_NAME                NVARCHAR(260),
+    @SHA256                   CHAR(64),
+    @RECORD_COUNT             INT,
+    @STARTED_AT               DATETIME2,
+    @BANK_LIST_VERSION        INT,
+    @EFIN_LIST_VERSION        INT,
+    @TRANSMITTER_LIST_VERSION INT,
+    @STATE_LIST_VERSION       INT,
+    @REPLAY_OF                INT,
+    @TRANSMITTER_ID           VARCHAR(20),
+    @ARRIVED_AT               DATETIME2,
+    @CORRELATION_ID           VARCHAR(36)
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    INSERT INTO batch(FILE_NAME, SHA256, RECORD_COUNT, STARTED_AT, STATUS, BANK_LIST_VERSION, EFIN_LIST_VERSION,
+                      TRANSMITTER_LIST_VERSION, STATE_LIST_VERSION, REPLAY_OF, TRANSMITTER_ID, ARRIVED_AT, CORRELATION_ID)
+    OUTPUT INSERTED.ID
+    VALUES (@FILE_NAME, @SHA256, @RECORD_COUNT, @STARTED_AT, 'running', @BANK_LIST_VERSION, @EFIN_LIST_VERSION,
+            @TRANSMITTER_LIST_VERSION, @STATE_LIST_VERSION, @REPLAY_OF, @TRANSMITTER_ID, @ARRIVED_AT, @CORRELATION_ID);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_refdata_version_add
+    @LIST           VARCHAR(20),
+    @VERSION        INT,
+    @EFFECTIVE_FROM DATETIME2,
+    @SOURCE         NVARCHAR(400),
+    @LOADED_BY      NVARCHAR(128),
+    @ROW_COUNT      INT
+AS
+BEGIN
+    INSERT INTO refdata_version (LIST, VERSION, EFFECTIVE_FROM, SOURCE, LOADED_BY, ROW_COUNT)
+    VALUES (@LIST, @VERSION, @EFFECTIVE_FROM, @SOURCE, @LOADED_BY, @ROW_COUNT);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_refdata_bank_add
+    @VERSION   INT,
+    @BANK_CODE VARCHAR(20),
+    @BANK_NAME NVARCHAR(100)
+AS
+BEGIN
+    INSERT INTO refdata_bank (VERSION, BANK_CODE, BANK_NAME) VALUES (@VERSION, @BANK_CODE, @BANK_NAME);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_refdata_efin_add
+    @VERSION INT,
+    @EFIN    VARCHAR(6)
+AS
+BEGIN
+    INSERT INTO refdata_efin (VERSION, EFIN) VALUES (@VERSION, @EFIN);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_refdata_transmitter_add
+    @VERSION        INT,
+    @TRANSMITTER_ID VARCHAR(20),
+    @NAME           NVARCHAR(100)
+AS
+BEGIN
+    INSERT INTO refdata_transmitter (VERSION, TRANSMITTER_ID, NAME) VALUES (@VERSION, @TRANSMITTER_ID, @NAME);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_refdata_state_add
+    @VERSION    INT,
+    @STATE_CODE CHAR(2),
+    @NAME       NVARCHAR(60)
+AS
+BEGIN
+    INSERT INTO refdata_state (VERSION, STATE_CODE, NAME) VALUES (@VERSION, @STATE_CODE, @NAME);
+END
+GO
@@ -0,0 +1,134 @@
+-- The parts of a record (parts.go), each in a table of its own with a
+-- foreign key to the ero row it belongs to: the office, the owner, the
+-- EFIN owner and the prior-year answers. They are written in the same
+-- transaction as the ero row, and would go with it if it were ever
+-- deleted. SSNs and dates of birth are never stored here: they are in
+-- ero_sensitive and ero_subject. With privacy.ssnkey set, the owners'
+-- names, phone numbers, email and street addresses aren't either - they
+-- are in ero_subject, encrypted with the person's own key so they can be
+-- erased - and only the city, state and ZIP are kept.
+
+CREATE TABLE dbo.ero_office (
+    ERO_ID        INT           NOT NULL,
+    OFFICE_NAME   NVARCHAR(100) NULL,
+    CONTACT_FIRST NVARCHAR(50)  NULL,
+    CONTACT_LAST  NVARCHAR(50)  NULL,
+    PHONE         VARCHAR(20)   NULL,
+    FAX           VARCHAR(20)   NULL,
+    EMAIL         NVARCHAR(254) NULL,
+    ADDRESS1      NVARCHAR(100) NULL,
+    ADDRESS2      NVARCHAR(100) NULL,
+    CITY          NVARCHAR(50)  NULL,
+    STATE         VARCHAR(2)    NULL,
+    ZIP           VARCHAR(10)   NULL,
+    CONSTRAINT PK_ero_office PRIMARY KEY (ERO_ID),
+    CONSTRAINT FK_ero_office_ero FOREIGN KEY (ERO_ID) REFERENCES dbo.ero(ID) ON DELETE CASCADE
+);
+GO
+
+CREATE TABLE dbo.ero_owner (
+    ERO_ID     INT           NOT NULL,
+    FIRST_NAME NVARCHAR(50)  NULL,
+    LAST_NAME  NVARCHAR(50)  NULL,
+    PHONE      VARCHAR(20)   NULL,
+    EMAIL      NVARCHAR(254) NULL,
+    ADDRESS1   NVARCHAR(100) NULL,
+    ADDRESS2   NVARCHAR(100) NULL,
+    CITY       NVARCHAR(50)  NULL,
+    STATE      VARCHAR(2)    NULL,
+    ZIP        VARCHAR(10)   NULL,
+    CONSTRAINT PK_ero_owner PRIMARY KEY (ERO_ID),
+    CONSTRAINT FK_ero_owner_ero FOREIGN KEY (ERO_ID) REFERENCES dbo.ero(ID) ON DELETE CASCADE
+);
+GO
+
+CREATE TABLE dbo.ero_efin_owner (
+    ERO_ID     INT           NOT NULL,
+    FIRST_NAME NVARCHAR(50)  NULL,
+    LAST_NAME  NVARCHAR(50)  NULL,
+    PHONE      VARCHAR(20)   NULL,
+    EMAIL      NVARCHAR(254) NULL,
+    ADDRESS1   NVARCHAR(100) NULL,
+    ADDRESS2   NVARCHAR(100) NULL,
+    CITY       NVARCHAR(50)  NULL,
+    STATE      VARCHAR(2)    NULL,
+    ZIP        VARCHAR(10)   NULL,
+    CONSTRAINT PK_ero_efin_owner PRIMARY KEY (ERO_ID),
+    CONSTRAINT FK_ero_efin_owner_ero FOREIGN KEY (ERO_ID) REFERENCES dbo.ero(ID) ON DELETE CASCADE
+);
+GO
+
+CREATE TABLE dbo.ero_prior_year (
+    ERO_ID                    INT          NOT NULL,
+    BANK                      NVARCHAR(60) NULL,
+    CLIENT_OF_YOURS_LAST_YEAR BIT          NOT NULL,
+    CONSTRAINT PK_ero_prior_year PRIMARY KEY (ERO_ID),
+    CONSTRAINT FK_ero_prior_year_ero FOREIGN KEY (ERO_ID) REFERENCES dbo.ero(ID) ON DELETE CASCADE
+);
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_office_add
+    @ERO_ID        INT,
+    @OFFICE_NAME   NVARCHAR(100),
+    @CONTACT_FIRST NVARCHAR(50),
+    @CONTACT_LAST  NVARCHAR(50),
+    @PHONE         VARCHAR(20),
+    @FAX           VARCHAR(20),
+    @EMAIL         NVARCHAR(254),
+    @ADDRESS1      NVARCHAR(100),
+    @ADDRESS2      NVARCHAR(100),
+    @CITY          NVARCHAR(50),
+    @STATE         VARCHAR(2),
+    @ZIP           VARCHAR(10)
+AS
+BEGIN
+    INSERT INTO ero_office (ERO_ID, OFFICE_NAME, CONTACT_FIRST, CONTACT_LAST, PHONE, FAX, EMAIL, ADDRESS1, ADDRESS2, CITY, STATE, ZIP)
+    VALUES (@ERO_ID, @OFFICE_NAME, @CONTACT_FIRST, @CONTACT_LAST, @PHONE, @FAX, @EMAIL, @ADDRESS1, @ADDRESS2, @CITY, @STATE, @ZIP);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_owner_add
+    @ERO_ID     INT,
+    @FIRST_NAME NVARCHAR(50),
+    @LAST_NAME  NVARCHAR(50),
+    @PHONE      VARCHAR(20),
+    @EMAIL      NVARCHAR(254),
+    @ADDRESS1   NVARCHAR(100),
+    @ADDRESS2   NVARCHAR(100),
+    @CITY       NVARCHAR(50),
+    @STATE      VARCHAR(2),
+    @ZIP        VARCHAR(10)
+AS
+BEGIN
+    INSERT INTO ero_owner (ERO_ID, FIRST_NAME, LAST_NAME, PHONE, EMAIL, ADDRESS1, ADDRESS2, CITY, STATE, ZIP)
+    VALUES (@ERO_ID, @FIRST_NAME, @LAST_NAME, @PHONE, @EMAIL, @ADDRESS1, @ADDRESS2, @CITY, @STATE, @ZIP);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_efin_owner_add
+    @ERO_ID     INT,
+    @FIRST_NAME NVARCHAR(50),
+    @LAST_NAME  NVARCHAR(50),
+    @PHONE      VARCHAR(20),
+    @EMAIL      NVARCHAR(254),
+    @ADDRESS1   NVARCHAR(100),
+    @ADDRESS2   NVARCHAR(100),
+    @CITY       NVARCHAR(50),
+    @STATE      VARCHAR(2),
+    @ZIP        VARCHAR(10)
+AS
+BEGIN
+    INSERT INTO ero_efin_owner (ERO_ID, FIRST_NAME, LAST_NAME, PHONE, EMAIL, ADDRESS1, ADDRESS2, CITY, STATE, ZIP)
+    VALUES (@ERO_ID, @FIRST_NAME, @LAST_NAME, @PHONE, @EMAIL, @ADDRESS1, @ADDRESS2, @CITY, @STATE, @ZIP);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_ero_prior_year_add
+    @ERO_ID                    INT,
+    @BANK                      NVARCHAR(60),
+    @CLIENT_OF_YOURS_LAST_YEAR BIT
+AS
+BEGIN
+    INSERT INTO ero_prior_year (ERO_ID, BANK, CLIENT_OF_YOURS_LAST_YEAR) VALUES (@ERO_ID, @BANK, @CLIENT_OF_YOURS_LAST_YEAR);
+END
+GO
@@ -0,0 +1,51 @@
+-- Transmitter credentials (credentials.go): the SFTP endpoints, keys and
+-- host keys, API key hashes, ACK signing keys and PGP keys we hold for
+-- each vendor, kept by transmitter ID and encrypted with storage.key
+-- before they reach the database. A credential is never changed; setting
+-- or rotating one adds a row and gives the older ones an EXPIRES_AT.
+
+CREATE TABLE dbo.transmitter_credential (
+    ID             INT IDENTITY(1,1) NOT NULL CONSTRAINT PK_transmitter_credential PRIMARY KEY,
+    TRANSMITTER_ID VARCHAR(20)    NOT NULL,
+    KIND           VARCHAR(20)    NOT NULL,
+    SECRET         VARBINARY(MAX) NOT NULL,
+    FINGERPRINT    CHAR(12)       NOT NULL,
+    CREATED_AT     DATETIME2      NOT NULL,
+    CREATED_BY     NVARCHAR(100)  NOT NULL,
+    EXPIRES_AT     DATETIME2      NULL
+);
+GO
+
+CREATE INDEX IX_transmitter_credential_kind ON dbo.transmitter_credential (TRANSMITTER_ID, KIND, ID);
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_transmitter_credential_add
+    @TRANSMITTER_ID VARCHAR(20),
+    @KIND           VARCHAR(20),
+    @SECRET         VARBINARY(MAX),
+    @FINGERPRINT    CHAR(12),
+    @CREATED_AT     DATETIME2,
+    @CREATED_BY     NVARCHAR(100)
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    INSERT INTO transmitter_credential (TRANSMITTER_ID, KIND, SECRET, FINGERPRINT, CREATED_AT, CREATED_BY)
+    OUTPUT INSERTED.ID
+    VALUES (@TRANSMITTER_ID, @KIND, @SECRET, @FINGERPRINT, @CREATED_AT, @CREATED_BY);
+END
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_transmitter_credential_expire
+    @EXPIRES_AT     DATETIME2,
+    @TRANSMITTER_ID VARCHAR(20),
+    @KIND           VARCHAR(20),
+    @ID             INT,
+    @NOW            DATETIME2
+AS
+BEGIN
+    UPDATE transmitter_credential SET EXPIRES_AT = @EXPIRES_AT
+    WHERE TRANSMITTER_ID = @TRANSMITTER_ID AND KIND = @KIND AND ID <> @ID
+        AND (EXPIRES_AT IS NULL OR EXPIRES_AT > @NOW);
+END
+GO
@@ -0,0 +1,28 @@
+-- What each batch's file held, for spotting a file that is the same as
+-- one we already loaded apart from its timestamps (duplicates.go): an
+-- 8-byte hash of every record with its TransactionDate left out, sorted,
+-- end to end in one value. The batch row has the rest - the transmitter,
+-- the record count and when it started - that picks which earlier files
+-- a new one is compared with.
+
+CREATE TABLE dbo.batch_fingerprint (
+    BATCH_ID      INT            NOT NULL,
+    RECORD_HASHES VARBINARY(MAX) NOT NULL,
+    CONSTRAINT PK_batch_fingerprint PRIMARY KEY (BATCH_ID),
+    CONSTRAINT FK_batch_fingerprint_batch FOREIGN KEY (BATCH_ID) REFERENCES dbo.batch(ID) ON DELETE CASCADE
+);
+GO
+
+CREATE INDEX IX_batch_transmitter_started ON dbo.batch (TRANSMITTER_ID, STARTED_AT) INCLUDE (RECORD_COUNT, STATUS);
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_batch_fingerprint_add
+    @BATCH_ID      INT,
+    @RECORD_HASHES VARBINARY(MAX)
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    INSERT INTO batch_fingerprint (BATCH_ID, RECORD_HASHES) VALUES (@BATCH_ID, @RECORD_HASHES);
+END
+GO
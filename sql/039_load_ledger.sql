@@ -0,0 +1,36 @@
+-- What each batch has written, a row per record, added in the same
+-- transaction as the record's own writes (ledger.go). A batch picked up
+-- again after the process died skips the records it finds here, so none
+-- is written twice, however far behind the checkpoint was. ERO_ID is the
+-- ero row an enrollment made; a de-enrollment has none.
+
+CREATE TABLE dbo.load_ledger (
+    BATCH_ID     INT          NOT NULL,
+    RECORD_INDEX INT          NOT NULL,
+    ERO_ID       INT          NULL,
+    OUTCOME      VARCHAR(16)  NOT NULL,
+    WRITTEN_AT   DATETIME2    NOT NULL,
+    CONSTRAINT PK_load_ledger PRIMARY KEY (BATCH_ID, RECORD_INDEX),
+    CONSTRAINT FK_load_ledger_batch FOREIGN KEY (BATCH_ID) REFERENCES dbo.batch(ID) ON DELETE CASCADE
+);
+GO
+
+-- A file is looked up by its checksum before it is loaded: the batch
+-- that already loaded it, or one to pick up again.
+CREATE INDEX IX_batch_sha256 ON dbo.batch (SHA256) INCLUDE (STATUS, REPLAY_OF);
+GO
+
+CREATE OR ALTER PROCEDURE dbo.usp_load_ledger_add
+    @BATCH_ID     INT,
+    @RECORD_INDEX INT,
+    @ERO_ID       INT,
+    @OUTCOME      VARCHAR(16),
+    @WRITTEN_AT   DATETIME2
+AS
+BEGIN
+    SET NOCOUNT ON;
+
+    INSERT INTO load_ledger (BATCH_ID, RECORD_INDEX, ERO_ID, OUTCOME, WRITTEN_AT)
+    VALUES (@BATCH_ID, @RECORD_INDEX, @ERO_ID, @OUTCOME, @WRITTEN_AT);
+END
+GO
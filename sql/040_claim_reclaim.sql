@@ -0,0 +1,17 @@
+-- A claim can be taken over before load.claimttl when the loader holding
+-- it is known to be gone (claim.go): an earlier run of the same instance,
+-- or a process on the same host that has exited. It is only taken if it
+-- is still the holder's, so two instances doing this at once can't both
+-- get it.
+
+CREATE OR ALTER PROCEDURE dbo.usp_claim_reclaim
+    @CLAIMED_BY VARCHAR(128),
+    @SHA256     CHAR(64),
+    @HOLDER     VARCHAR(128)
+AS
+BEGIN
+    UPDATE file_claim
+    SET CLAIMED_BY = @CLAIMED_BY, CLAIMED_AT = SYSUTCDATETIME(), HEARTBEAT_AT = SYSUTCDATETIME()
+    WHERE SHA256 = @SHA256 AND CLAIMED_BY = @HOLDER;
+END
+GO
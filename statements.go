@@ -0,0 +1,973 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"strings"
+
+	"github.com/dstroot/go_enrollment/enrollment"
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Every statement the loader sends to SQL Server is listed here, once, with
+// both its plain SQL form and the stored procedure that does the same job.
+//
+// When "mssql.storedprocedures" is true we only ever EXEC the procedures in
+// this catalog (see sql/001_stored_procedures.sql). That lets the DBAs give
+// the service account EXECUTE on the enrollment schema and nothing else.
+// A write that has no procedure is refused in that mode rather than quietly
+// falling back to raw DML.
+func init() {
+	viper.SetDefault("mssql.storedprocedures", false)
+}
+
+// statement is one entry in the catalog.
+type statement struct {
+	query  string   // plain SQL, "?" placeholders
+	proc   string   // stored procedure doing the same work
+	params []string // procedure parameter names, in placeholder order
+	write  bool     // INSERT/UPDATE/DELETE: must have a procedure
+}
+
+// statements is the whitelist. Keys are what the rest of the code uses.
+var statements = map[string]statement{
+	"ero.insert": {
+		// enrollment.Store sends this itself; it is here so the
+		// catalog still lists everything we send.
+		query:  enrollment.InsertQuery,
+		proc:   enrollment.InsertProc,
+		params: enrollment.InsertParams,
+		write:  true,
+	},
+	"ero.prior": {
+		// The record an amendment amends (see amend.go).
+		query: "SELECT TOP 1 ID, VERSION, RECEIVED_DATE, COMPANY, STATE, PRIOR_BANK, MASTER_EFIN FROM ero WHERE EFIN = ? AND TAX_YEAR = ? AND STATUS <> 'rejected' ORDER BY ID DESC",
+	},
+	"ero.deactivate": {
+		// The EFIN is passed twice: its own rows and its offices'.
+		query: `UPDATE ero SET STATUS = 'inactive', DEACTIVATED_AT = ?, DEACTIVATION_REASON = ?, DEACTIVATION_BATCH = ?
+			OUTPUT INSERTED.ID, INSERTED.EFIN
+			WHERE (EFIN = ? OR MASTER_EFIN = ?) AND TAX_YEAR = ? AND STATUS IN ('loaded', 'pending', 'suspended')`,
+		proc:   "dbo.usp_ero_deactivate",
+		params: []string{"DEACTIVATED_AT", "DEACTIVATION_REASON", "DEACTIVATION_BATCH", "EFIN", "TAX_YEAR"},
+		write:  true,
+	},
+	"ero.rollover_source": {
+		// The latest record for each EFIN in a tax year that wasn't
+		// rejected, and whether it has one in the new year already.
+		query: `SELECT e.ID, e.EFIN, COALESCE(e.COMPANY, ''), COALESCE(e.STATE, ''), COALESCE(e.PRIOR_BANK, ''),
+				COALESCE(e.MASTER_EFIN, ''), e.STATUS,
+				CASE WHEN EXISTS (SELECT 1 FROM ero n WHERE n.EFIN = e.EFIN AND n.TAX_YEAR = ?) THEN 1 ELSE 0 END
+			FROM ero e
+			WHERE e.TAX_YEAR = ? AND e.ID = (SELECT MAX(x.ID) FROM ero x WHERE x.EFIN = e.EFIN AND x.TAX_YEAR = e.TAX_YEAR AND x.STATUS <> 'rejected')
+			ORDER BY e.EFIN`,
+	},
+	"ero.rollover": {
+		// The new tax year is passed twice: the row and the NOT EXISTS.
+		query: `INSERT INTO ero(EFIN,COMPANY,TAX_YEAR,RECEIVED_DATE,STATUS,STATE,PRIOR_BANK,MASTER_EFIN,ROLLED_FROM,AMENDED)
+			OUTPUT INSERTED.ID
+			SELECT e.EFIN, e.COMPANY, ?, ?, 'loaded', e.STATE, e.PRIOR_BANK, e.MASTER_EFIN, e.ID, 0
+			FROM ero e
+			WHERE e.ID = ? AND NOT EXISTS (SELECT 1 FROM ero n WHERE n.EFIN = e.EFIN AND n.TAX_YEAR = ?)`,
+		proc:   "dbo.usp_ero_rollover",
+		params: []string{"TAX_YEAR", "RECEIVED_DATE", "ID"},
+		write:  true,
+	},
+	"ero.prior_year": {
+		// Whether we had an accepted record for the EFIN in a tax year,
+		// and its volume that year. EFIN and year are passed twice.
+		query: `SELECT CASE WHEN EXISTS (SELECT 1 FROM ero WHERE EFIN = ? AND TAX_YEAR = ? AND STATUS IN ('loaded', 'inactive')) THEN 1 ELSE 0 END,
+				(SELECT RETURNS FROM efin_volume WHERE EFIN = ? AND TAX_YEAR = ?)`,
+	},
+	"ero.enrich": {
+		query:  "UPDATE ero SET PY_RETURNING = ?, PY_BANK = ?, PY_VOLUME = ?, PY_TIER = ? WHERE ID = ?",
+		proc:   "dbo.usp_ero_enrich",
+		params: []string{"PY_RETURNING", "PY_BANK", "PY_VOLUME", "PY_TIER", "ID"},
+		write:  true,
+	},
+	"ero.ruleset": {
+		query:  "UPDATE ero SET RULESET = ? WHERE ID = ?",
+		proc:   "dbo.usp_ero_ruleset",
+		params: []string{"RULESET", "ID"},
+		write:  true,
+	},
+	"ero.confirm": {
+		query:  "UPDATE ero SET CONFIRMATION = ? WHERE ID = ? AND CONFIRMATION IS NULL",
+		proc:   "dbo.usp_ero_confirm",
+		params: []string{"CONFIRMATION", "ID"},
+		write:  true,
+	},
+	"ero.revert": {
+		query: `UPDATE ero SET STATUS = 'rejected', REVIEWED_BY = ?, REVIEWED_AT = ?, REVIEW_NOTE = ?
+			OUTPUT INSERTED.ID, CASE WHEN INSERTED.FORWARDED_AT IS NULL THEN 0 ELSE 1 END
+			WHERE BATCH_ID = ? AND STATUS <> 'rejected'`,
+		proc:   "dbo.usp_ero_revert",
+		params: []string{"REVIEWED_BY", "REVIEWED_AT", "REVIEW_NOTE", "BATCH_ID"},
+		write:  true,
+	},
+	"ero.revert_deactivations": {
+		// Each row goes back to the last status it had before it was
+		// deactivated, from the row history (sql/008_ero_history.sql).
+		query: `UPDATE e SET
+				STATUS = COALESCE((SELECT TOP 1 h.STATUS FROM ero FOR SYSTEM_TIME ALL h
+					WHERE h.ID = e.ID AND h.STATUS <> 'inactive' ORDER BY h.VALID_TO DESC), 'loaded'),
+				DEACTIVATED_AT = NULL, DEACTIVATION_REASON = NULL, DEACTIVATION_BATCH = NULL
+			OUTPUT INSERTED.ID, COALESCE(INSERTED.BATCH_ID, 0)
+			FROM ero e
+			WHERE e.DEACTIVATION_BATCH = ? AND e.STATUS = 'inactive'`,
+		proc:   "dbo.usp_ero_revert_deactivations",
+		params: []string{"DEACTIVATION_BATCH"},
+		write:  true,
+	},
+	"ero.bulk_preview": {
+		// What a bulk update to a status would change (see bulkupdate.go).
+		query: `SELECT e.STATUS, COUNT(*), SUM(CASE WHEN e.FORWARDED_AT IS NULL THEN 0 ELSE 1 END)
+			FROM ero e
+			WHERE e.STATUS IN ('loaded', 'pending', 'suspended') AND e.STATUS <> ? AND ` + bulkWhere + `
+			GROUP BY e.STATUS ORDER BY e.STATUS`,
+		proc: "dbo.usp_ero_bulk_preview",
+		params: []string{"NEW_STATUS", "BANK", "TAX_YEAR", "EFIN", "MASTER_EFIN", "STATE", "STATUS", "BATCH_ID",
+			"TRANSMITTER_ID"},
+	},
+	"ero.bulk_update": {
+		query: `UPDATE e SET STATUS = ?, BULK_UPDATE_ID = ?
+			OUTPUT INSERTED.ID
+			FROM ero e
+			WHERE e.STATUS IN ('loaded', 'pending', 'suspended') AND e.STATUS <> ? AND ` + bulkWhere,
+		proc: "dbo.usp_ero_bulk_update",
+		params: []string{"NEW_STATUS", "BULK_UPDATE_ID", "BANK", "TAX_YEAR", "EFIN", "MASTER_EFIN", "STATE", "STATUS", "BATCH_ID",
+			"TRANSMITTER_ID"},
+		write: true,
+	},
+	"bulk_update.add": {
+		query: `INSERT INTO bulk_update (FILTER, NEW_STATUS, REASON, UPDATED_BY, UPDATED_AT)
+			OUTPUT INSERTED.ID
+			VALUES (?,?,?,?,?)`,
+		proc:   "dbo.usp_bulk_update_add",
+		params: []string{"FILTER", "NEW_STATUS", "REASON", "UPDATED_BY", "UPDATED_AT"},
+		write:  true,
+	},
+	"bulk_update.finish": {
+		query:  "UPDATE bulk_update SET RECORDS = ? WHERE ID = ?",
+		proc:   "dbo.usp_bulk_update_finish",
+		params: []string{"RECORDS", "ID"},
+		write:  true,
+	},
+	"ero.delete_batch": {
+		// A soft delete (sql/030_soft_delete.sql): the rows stay, rejected,
+		// and the list and export commands leave them out. Rows under legal
+		// hold (sql/032_legal_holds.sql) aren't touched.
+		query: `UPDATE e SET STATUS = 'rejected', DELETED_AT = ?, DELETED_BY = ?, DELETE_REASON = ?
+			FROM ero e
+			WHERE e.BATCH_ID = ? AND e.DELETED_AT IS NULL AND NOT EXISTS (SELECT 1 FROM legal_hold h WHERE h.RELEASED_AT IS NULL
+				AND (h.KIND = 'efin' AND h.VALUE = e.EFIN
+					OR h.KIND = 'owner' AND h.VALUE IN (SELECT s.SSN_HASH FROM ero_subject s WHERE s.ERO_ID = e.ID)))`,
+		proc:   "dbo.usp_ero_delete_batch",
+		params: []string{"DELETED_AT", "DELETED_BY", "DELETE_REASON", "BATCH_ID"},
+		write:  true,
+	},
+	"ero.compare": {
+		// What shadow.go compares between the primary and the shadow.
+		query: `SELECT COALESCE(e.EFIN, ''), COALESCE(e.COMPANY, ''), e.TAX_YEAR, e.STATUS, COALESCE(e.STATE, ''),
+				COALESCE(e.PRIOR_BANK, ''), COALESCE(e.MASTER_EFIN, ''), e.AMENDED, COALESCE(e.FLAG_REASON, ''),
+				COALESCE(e.PY_TIER, ''), COALESCE(p.SCHEDULE, '')
+			FROM ero e LEFT JOIN ero_pricing p ON p.ERO_ID = e.ID
+			WHERE e.ID = ?`,
+	},
+	"ero.pending": {
+		query: "SELECT ID, EFIN, COMPANY, TAX_YEAR, RECEIVED_DATE, BATCH_ID, FLAG_REASON FROM ero WHERE STATUS = 'pending' ORDER BY ID",
+	},
+	"ero.review": {
+		query:  "UPDATE ero SET STATUS = ?, REVIEWED_BY = ?, REVIEWED_AT = ?, REVIEW_NOTE = ? WHERE ID = ? AND STATUS = 'pending'",
+		proc:   "dbo.usp_ero_review",
+		params: []string{"STATUS", "REVIEWED_BY", "REVIEWED_AT", "REVIEW_NOTE", "ID"},
+		write:  true,
+	},
+	"batch.start": {
+		query:  "INSERT INTO batch(FILE_NAME,SHA256,RECORD_COUNT,STARTED_AT,STATUS,BANK_LIST_VERSION,EFIN_LIST_VERSION,TRANSMITTER_LIST_VERSION,STATE_LIST_VERSION,REPLAY_OF,TRANSMITTER_ID,ARRIVED_AT,CORRELATION_ID) OUTPUT INSERTED.ID VALUES(?,?,?,?,'running',?,?,?,?,?,?,?,?)",
+		proc:   "dbo.usp_batch_start",
+		params: []string{"FILE_NAME", "SHA256", "RECORD_COUNT", "STARTED_AT", "BANK_LIST_VERSION", "EFIN_LIST_VERSION", "TRANSMITTER_LIST_VERSION", "STATE_LIST_VERSION", "REPLAY_OF", "TRANSMITTER_ID", "ARRIVED_AT", "CORRELATION_ID"},
+		write:  true,
+	},
+	"batch.finish": {
+		query:  "UPDATE batch SET STATUS = ?, LOADED = ?, REJECTED = ?, FINISHED_AT = ? WHERE ID = ?",
+		proc:   "dbo.usp_batch_finish",
+		params: []string{"STATUS", "LOADED", "REJECTED", "FINISHED_AT", "ID"},
+		write:  true,
+	},
+	"batch.month": {
+		query: `SELECT TRANSMITTER_ID, ARRIVED_AT, STARTED_AT, FINISHED_AT, STATUS, RECORD_COUNT, COALESCE(LOADED, 0), COALESCE(REJECTED, 0)
+			FROM batch
+			WHERE ARRIVED_AT >= ? AND ARRIVED_AT < ? AND REPLAY_OF IS NULL
+			ORDER BY TRANSMITTER_ID, ARRIVED_AT`,
+	},
+	"batch.arrivals": {
+		query: `SELECT ARRIVED_AT FROM batch
+			WHERE TRANSMITTER_ID = ? AND ARRIVED_AT >= ? AND REPLAY_OF IS NULL
+			ORDER BY ARRIVED_AT`,
+	},
+	"batch.count_since": {
+		query: `SELECT COUNT(*) FROM batch WHERE TRANSMITTER_ID = ? AND STARTED_AT >= ? AND REPLAY_OF IS NULL`,
+	},
+	"batch.get": {
+		query: `SELECT ID, FILE_NAME, SHA256, STATUS, BANK_LIST_VERSION, EFIN_LIST_VERSION, TRANSMITTER_LIST_VERSION, STATE_LIST_VERSION,
+			TRANSMITTER_ID, RECORD_COUNT, LOADED, REJECTED, STARTED_AT, FINISHED_AT, CORRELATION_ID
+			FROM batch WHERE ID = ?`,
+	},
+	"batch.recent": {
+		query: `SELECT TOP (?) ID, FILE_NAME, SHA256, STATUS, BANK_LIST_VERSION, EFIN_LIST_VERSION, TRANSMITTER_LIST_VERSION, STATE_LIST_VERSION,
+			TRANSMITTER_ID, RECORD_COUNT, LOADED, REJECTED, STARTED_AT, FINISHED_AT, CORRELATION_ID
+			FROM batch ORDER BY ID DESC`,
+	},
+	"batch.fingerprint": {
+		// Near-duplicate files (duplicates.go, sql/038_batch_fingerprints.sql).
+		query:  "INSERT INTO batch_fingerprint (BATCH_ID, RECORD_HASHES) VALUES (?,?)",
+		proc:   "dbo.usp_batch_fingerprint_add",
+		params: []string{"BATCH_ID", "RECORD_HASHES"},
+		write:  true,
+	},
+	"batch.similar": {
+		// Earlier batches from the transmitter that could be near
+		// duplicates: ones that loaded, or are loading, lately, with
+		// about as many records.
+		query: `SELECT TOP (?) b.ID, b.FILE_NAME, b.SHA256, f.RECORD_HASHES
+			FROM batch b JOIN batch_fingerprint f ON f.BATCH_ID = b.ID
+			WHERE b.TRANSMITTER_ID = ? AND b.STARTED_AT >= ? AND b.RECORD_COUNT BETWEEN ? AND ?
+				AND b.STATUS IN ('running', 'loaded')
+			ORDER BY b.ID DESC`,
+	},
+	"batch.by_sha": {
+		// The registry of files (ledger.go): the batch that loaded,
+		// or began loading, a file.
+		query: `SELECT TOP 1 ID, FILE_NAME, SHA256, STATUS, BANK_LIST_VERSION, EFIN_LIST_VERSION, TRANSMITTER_LIST_VERSION, STATE_LIST_VERSION,
+			TRANSMITTER_ID, RECORD_COUNT, LOADED, REJECTED, STARTED_AT, FINISHED_AT, CORRELATION_ID
+			FROM batch WHERE SHA256 = ? AND REPLAY_OF IS NULL ORDER BY ID DESC`,
+	},
+	"ledger.add": {
+		// What a batch has written (ledger.go, sql/039_load_ledger.sql).
+		query:  "INSERT INTO load_ledger (BATCH_ID, RECORD_INDEX, ERO_ID, OUTCOME, WRITTEN_AT) VALUES (?,?,?,?,?)",
+		proc:   "dbo.usp_load_ledger_add",
+		params: []string{"BATCH_ID", "RECORD_INDEX", "ERO_ID", "OUTCOME", "WRITTEN_AT"},
+		write:  true,
+	},
+	"ledger.written": {
+		query: "SELECT RECORD_INDEX, OUTCOME FROM load_ledger WHERE BATCH_ID = ? AND RECORD_INDEX >= ? AND RECORD_INDEX < ?",
+	},
+	"batch.revert": {
+		query:  "UPDATE batch SET STATUS = 'reverted', REVERTED_AT = ?, REVERTED_BY = ?, REVERT_NOTE = ? WHERE ID = ? AND STATUS NOT IN ('running', 'reverted')",
+		proc:   "dbo.usp_batch_revert",
+		params: []string{"REVERTED_AT", "REVERTED_BY", "REVERT_NOTE", "ID"},
+		write:  true,
+	},
+	"batch.revert_preview": {
+		// What reverting a batch would touch (see revert.go). The batch ID
+		// is passed once per count.
+		query: `SELECT
+				(SELECT COUNT(*) FROM ero WHERE BATCH_ID = ? AND STATUS <> 'rejected'),
+				(SELECT COUNT(*) FROM ero WHERE BATCH_ID = ? AND STATUS = 'pending'),
+				(SELECT COUNT(*) FROM ero WHERE BATCH_ID = ? AND STATUS <> 'rejected' AND FORWARDED_AT IS NOT NULL),
+				(SELECT COUNT(*) FROM bank_outbox o JOIN ero e ON e.ID = o.ERO_ID WHERE e.BATCH_ID = ?),
+				(SELECT COUNT(*) FROM event_outbox o JOIN ero e ON e.ID = o.ERO_ID WHERE e.BATCH_ID = ? AND o.SENT_AT IS NULL),
+				(SELECT COUNT(*) FROM event_outbox o JOIN ero e ON e.ID = o.ERO_ID WHERE e.BATCH_ID = ? AND o.SENT_AT IS NOT NULL),
+				(SELECT COUNT(*) FROM email_verification v JOIN ero e ON e.ID = v.ERO_ID WHERE e.BATCH_ID = ? AND v.VERIFIED_AT IS NULL),
+				(SELECT COUNT(*) FROM ero WHERE DEACTIVATION_BATCH = ? AND STATUS = 'inactive'),
+				(SELECT COUNT(*) FROM ero e WHERE e.BATCH_ID = ? AND e.STATUS <> 'rejected' AND EXISTS (SELECT 1 FROM ero n
+					WHERE n.EFIN = e.EFIN AND n.TAX_YEAR = e.TAX_YEAR AND n.ID > e.ID AND n.BATCH_ID <> e.BATCH_ID AND n.STATUS <> 'rejected')),
+				(SELECT COUNT(*) FROM ero e WHERE e.BATCH_ID = ? AND e.DELETED_AT IS NULL AND EXISTS (SELECT 1 FROM legal_hold h WHERE h.RELEASED_AT IS NULL
+						AND (h.KIND = 'efin' AND h.VALUE = e.EFIN
+							OR h.KIND = 'owner' AND h.VALUE IN (SELECT s.SSN_HASH FROM ero_subject s WHERE s.ERO_ID = e.ID))))`,
+	},
+	"claim.insert": {
+		query:  "INSERT INTO file_claim (SHA256, FILE_NAME, CLAIMED_BY, CLAIMED_AT, HEARTBEAT_AT) VALUES (?, ?, ?, SYSUTCDATETIME(), SYSUTCDATETIME())",
+		proc:   "dbo.usp_claim_insert",
+		params: []string{"SHA256", "FILE_NAME", "CLAIMED_BY"},
+		write:  true,
+	},
+	"claim.takeover": {
+		query: `UPDATE file_claim SET CLAIMED_BY = ?, CLAIMED_AT = SYSUTCDATETIME(), HEARTBEAT_AT = SYSUTCDATETIME()
+			WHERE SHA256 = ? AND HEARTBEAT_AT < DATEADD(SECOND, -?, SYSUTCDATETIME())`,
+		proc:   "dbo.usp_claim_takeover",
+		params: []string{"CLAIMED_BY", "SHA256", "TTL"},
+		write:  true,
+	},
+	"claim.reclaim": {
+		// A claim whose holder has exited, if it still has it (claim.go,
+		// sql/040_claim_reclaim.sql).
+		query: `UPDATE file_claim SET CLAIMED_BY = ?, CLAIMED_AT = SYSUTCDATETIME(), HEARTBEAT_AT = SYSUTCDATETIME()
+			WHERE SHA256 = ? AND CLAIMED_BY = ?`,
+		proc:   "dbo.usp_claim_reclaim",
+		params: []string{"CLAIMED_BY", "SHA256", "HOLDER"},
+		write:  true,
+	},
+	"claim.heartbeat": {
+		query:  "UPDATE file_claim SET HEARTBEAT_AT = SYSUTCDATETIME() WHERE SHA256 = ? AND CLAIMED_BY = ?",
+		proc:   "dbo.usp_claim_heartbeat",
+		params: []string{"SHA256", "CLAIMED_BY"},
+		write:  true,
+	},
+	"claim.release": {
+		query:  "DELETE FROM file_claim WHERE SHA256 = ? AND CLAIMED_BY = ?",
+		proc:   "dbo.usp_claim_release",
+		params: []string{"SHA256", "CLAIMED_BY"},
+		write:  true,
+	},
+	"claim.get": {
+		query: "SELECT CLAIMED_BY, CLAIMED_AT, HEARTBEAT_AT FROM file_claim WHERE SHA256 = ?",
+	},
+	"delivery.add": {
+		query:  "INSERT INTO delivery (BATCH_ID, TRANSMITTER_ID, FILE_NAME, TARGET, STATUS, CREATED_AT) OUTPUT INSERTED.ID VALUES (?, ?, ?, ?, ?, ?)",
+		proc:   "dbo.usp_delivery_add",
+		params: []string{"BATCH_ID", "TRANSMITTER_ID", "FILE_NAME", "TARGET", "STATUS", "CREATED_AT"},
+		write:  true,
+	},
+	"delivery.update": {
+		query:  "UPDATE delivery SET STATUS = ?, ATTEMPTS = ATTEMPTS + ?, LAST_ERROR = ?, DELIVERED_AT = ? WHERE ID = ?",
+		proc:   "dbo.usp_delivery_update",
+		params: []string{"STATUS", "ATTEMPTS", "LAST_ERROR", "DELIVERED_AT", "ID"},
+		write:  true,
+	},
+	"delivery.open": {
+		query: `SELECT ID, BATCH_ID, TRANSMITTER_ID, FILE_NAME, TARGET, STATUS, ATTEMPTS, COALESCE(LAST_ERROR, ''), CREATED_AT
+			FROM delivery WHERE STATUS <> 'delivered' ORDER BY ID`,
+	},
+	"discrepancy.add": {
+		query: `INSERT INTO prior_year_discrepancy (BATCH_ID, TRANSMITTER_ID, RECORD_INDEX, EFIN, ERO_ID, FIELD, CLAIMED, ACTUAL, OUTCOME, CREATED_AT)
+			VALUES (?,?,?,?,?,?,?,?,?,?)`,
+		proc:   "dbo.usp_prior_year_discrepancy_add",
+		params: []string{"BATCH_ID", "TRANSMITTER_ID", "RECORD_INDEX", "EFIN", "ERO_ID", "FIELD", "CLAIMED", "ACTUAL", "OUTCOME", "CREATED_AT"},
+		write:  true,
+	},
+	"discrepancy.list": {
+		query: `SELECT CREATED_AT, COALESCE(TRANSMITTER_ID, ''), BATCH_ID, COALESCE(EFIN, ''), FIELD, COALESCE(CLAIMED, ''), COALESCE(ACTUAL, ''), OUTCOME
+			FROM prior_year_discrepancy
+			WHERE CREATED_AT >= ? AND (? = '' OR TRANSMITTER_ID = ?)
+			ORDER BY TRANSMITTER_ID, CREATED_AT`,
+	},
+	"ero.edit_base": {
+		query: "SELECT EFIN, TAX_YEAR, STATUS FROM ero WHERE ID = ?",
+	},
+	"edit.add": {
+		query: `INSERT INTO enrollment_edit (ERO_ID, NEW_ID, BATCH_ID, EDITED_BY, EDITED_AT, NOTE, CHANGES, OUTCOME, DETAIL)
+			VALUES (?,?,?,?,?,?,?,?,?)`,
+		proc:   "dbo.usp_enrollment_edit_add",
+		params: []string{"ERO_ID", "NEW_ID", "BATCH_ID", "EDITED_BY", "EDITED_AT", "NOTE", "CHANGES", "OUTCOME", "DETAIL"},
+		write:  true,
+	},
+	"canary.run_add": {
+		query: `INSERT INTO canary_run (BATCH_ID, CANARY, TRANSMITTER_ID, CHECKED, CHANGED, CREATED_AT)
+			VALUES (?,?,?,?,?,?)`,
+		proc:   "dbo.usp_canary_run_add",
+		params: []string{"BATCH_ID", "CANARY", "TRANSMITTER_ID", "CHECKED", "CHANGED", "CREATED_AT"},
+		write:  true,
+	},
+	"canary.result_add": {
+		query: `INSERT INTO canary_result (BATCH_ID, CANARY, TRANSMITTER_ID, RECORD_INDEX, EFIN, ACTIVE_OUTCOME, ACTIVE_DETAIL, CANARY_OUTCOME, CANARY_DETAIL, CREATED_AT)
+			VALUES (?,?,?,?,?,?,?,?,?,?)`,
+		proc:   "dbo.usp_canary_result_add",
+		params: []string{"BATCH_ID", "CANARY", "TRANSMITTER_ID", "RECORD_INDEX", "EFIN", "ACTIVE_OUTCOME", "ACTIVE_DETAIL", "CANARY_OUTCOME", "CANARY_DETAIL", "CREATED_AT"},
+		write:  true,
+	},
+	"canary.runs": {
+		query: `SELECT CANARY, COUNT(*), SUM(CHECKED), SUM(CHANGED)
+			FROM canary_run
+			WHERE CREATED_AT >= ? AND (? = '' OR TRANSMITTER_ID = ?)
+			GROUP BY CANARY ORDER BY CANARY`,
+	},
+	"canary.changes": {
+		query: `SELECT CANARY, ACTIVE_OUTCOME, CANARY_OUTCOME, COUNT(*)
+			FROM canary_result
+			WHERE CREATED_AT >= ? AND (? = '' OR TRANSMITTER_ID = ?)
+			GROUP BY CANARY, ACTIVE_OUTCOME, CANARY_OUTCOME
+			ORDER BY CANARY, COUNT(*) DESC`,
+	},
+	"canary.list": {
+		query: `SELECT CREATED_AT, CANARY, COALESCE(TRANSMITTER_ID, ''), BATCH_ID, RECORD_INDEX, COALESCE(EFIN, ''),
+				ACTIVE_OUTCOME, COALESCE(ACTIVE_DETAIL, ''), CANARY_OUTCOME, COALESCE(CANARY_DETAIL, '')
+			FROM canary_result
+			WHERE CREATED_AT >= ? AND (? = '' OR TRANSMITTER_ID = ?)
+			ORDER BY CANARY, CREATED_AT, RECORD_INDEX`,
+	},
+	"pricing.set": {
+		// The values are passed twice: for the UPDATE and the INSERT.
+		query: `MERGE ero_pricing AS t
+			USING (SELECT ? AS ERO_ID) AS s ON t.ERO_ID = s.ERO_ID
+			WHEN MATCHED THEN UPDATE SET SCHEDULE = ?, TIER = ?, BANK = ?, RULE_NO = ?, ASSIGNED_AT = ?
+			WHEN NOT MATCHED THEN INSERT (ERO_ID, SCHEDULE, TIER, BANK, RULE_NO, ASSIGNED_AT)
+				VALUES (s.ERO_ID, ?, ?, ?, ?, ?);`,
+		proc:   "dbo.usp_ero_pricing_set",
+		params: []string{"ERO_ID", "SCHEDULE", "TIER", "BANK", "RULE_NO", "ASSIGNED_AT"},
+		write:  true,
+	},
+	"pricing.inputs": {
+		query: "SELECT COALESCE(PY_TIER, ''), COALESCE(PRIOR_BANK, ''), COALESCE(RULESET, '') FROM ero WHERE ID = ?",
+	},
+	"error_stats.add": {
+		query: `MERGE error_stats AS t
+			USING (SELECT ? AS TRANSMITTER_ID, ? AS FIELD, ? AS ERROR_CODE, ? AS STAT_DATE, ? AS ERROR_COUNT) AS s
+			ON t.TRANSMITTER_ID = s.TRANSMITTER_ID AND t.FIELD = s.FIELD AND t.ERROR_CODE = s.ERROR_CODE AND t.STAT_DATE = s.STAT_DATE
+			WHEN MATCHED THEN UPDATE SET ERROR_COUNT = t.ERROR_COUNT + s.ERROR_COUNT
+			WHEN NOT MATCHED THEN INSERT (TRANSMITTER_ID, FIELD, ERROR_CODE, STAT_DATE, ERROR_COUNT)
+				VALUES (s.TRANSMITTER_ID, s.FIELD, s.ERROR_CODE, s.STAT_DATE, s.ERROR_COUNT);`,
+		proc:   "dbo.usp_error_stats_add",
+		params: []string{"TRANSMITTER_ID", "FIELD", "ERROR_CODE", "STAT_DATE", "ERROR_COUNT"},
+		write:  true,
+	},
+	"load_metrics.add": {
+		query: `DELETE FROM load_metrics WHERE BATCH_ID = ?;
+			INSERT INTO load_metrics(BATCH_ID, TRANSMITTER_ID, INSTANCE, STATUS, ARRIVED_AT, STARTED_AT, FINISHED_AT,
+				QUEUE_SECONDS, DURATION_MS, RECORDS, LOADED, REJECTED, RECORDS_PER_SEC)
+			VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+		proc: "dbo.usp_load_metrics_add",
+		params: []string{"BATCH_ID", "TRANSMITTER_ID", "INSTANCE", "STATUS", "ARRIVED_AT", "STARTED_AT", "FINISHED_AT",
+			"QUEUE_SECONDS", "DURATION_MS", "RECORDS", "LOADED", "REJECTED", "RECORDS_PER_SEC"},
+		write: true,
+	},
+	"error_stats.trends": {
+		query: `SELECT TRANSMITTER_ID, FIELD, ERROR_CODE, DATEFROMPARTS(YEAR(STAT_DATE), MONTH(STAT_DATE), 1) AS MONTH, SUM(ERROR_COUNT) AS ERRORS
+			FROM error_stats
+			WHERE STAT_DATE >= ? AND (? = '' OR TRANSMITTER_ID = ?)
+			GROUP BY TRANSMITTER_ID, FIELD, ERROR_CODE, DATEFROMPARTS(YEAR(STAT_DATE), MONTH(STAT_DATE), 1)
+			ORDER BY TRANSMITTER_ID, MONTH, ERRORS DESC`,
+	},
+	"error_stats.top": {
+		query: `SELECT TOP (?) TRANSMITTER_ID, FIELD, ERROR_CODE, SUM(ERROR_COUNT) AS ERRORS
+			FROM error_stats
+			WHERE STAT_DATE >= ? AND (? = '' OR TRANSMITTER_ID = ?)
+			GROUP BY TRANSMITTER_ID, FIELD, ERROR_CODE
+			ORDER BY ERRORS DESC`,
+	},
+	"refdata.latest": {
+		query: "SELECT COALESCE(MAX(VERSION), 0) FROM refdata_version WHERE LIST = ? AND (EFFECTIVE_FROM IS NULL OR EFFECTIVE_FROM <= ?)",
+	},
+	"refdata.max": {
+		query: "SELECT COALESCE(MAX(VERSION), 0) FROM refdata_version WITH (UPDLOCK, HOLDLOCK) WHERE LIST = ?",
+	},
+	"refdata.versions": {
+		query: `SELECT LIST, VERSION, EFFECTIVE_FROM, LOADED_AT, ROW_COUNT, SOURCE, LOADED_BY
+			FROM refdata_version
+			WHERE (? = '' OR LIST = ?)
+			ORDER BY LIST, VERSION DESC`,
+	},
+	"refdata.banks": {
+		query: "SELECT BANK_CODE, BANK_NAME FROM refdata_bank WHERE VERSION = ?",
+	},
+	"refdata.efins": {
+		query: "SELECT EFIN, '' FROM refdata_efin WHERE VERSION = ?",
+	},
+	"refdata.transmitters": {
+		query: "SELECT TRANSMITTER_ID, NAME FROM refdata_transmitter WHERE VERSION = ?",
+	},
+	"refdata.states": {
+		query: "SELECT STATE_CODE, NAME FROM refdata_state WHERE VERSION = ?",
+	},
+	"refdata.version.add": {
+		query:  "INSERT INTO refdata_version (LIST, VERSION, EFFECTIVE_FROM, SOURCE, LOADED_BY, ROW_COUNT) VALUES (?,?,?,?,?,?)",
+		proc:   "dbo.usp_refdata_version_add",
+		params: []string{"LIST", "VERSION", "EFFECTIVE_FROM", "SOURCE", "LOADED_BY", "ROW_COUNT"},
+		write:  true,
+	},
+	"refdata.banks.add": {
+		query:  "INSERT INTO refdata_bank (VERSION, BANK_CODE, BANK_NAME) VALUES (?,?,?)",
+		proc:   "dbo.usp_refdata_bank_add",
+		params: []string{"VERSION", "BANK_CODE", "BANK_NAME"},
+		write:  true,
+	},
+	"refdata.efins.add": {
+		query:  "INSERT INTO refdata_efin (VERSION, EFIN) VALUES (?,?)",
+		proc:   "dbo.usp_refdata_efin_add",
+		params: []string{"VERSION", "EFIN"},
+		write:  true,
+	},
+	"refdata.transmitters.add": {
+		query:  "INSERT INTO refdata_transmitter (VERSION, TRANSMITTER_ID, NAME) VALUES (?,?,?)",
+		proc:   "dbo.usp_refdata_transmitter_add",
+		params: []string{"VERSION", "TRANSMITTER_ID", "NAME"},
+		write:  true,
+	},
+	"refdata.states.add": {
+		query:  "INSERT INTO refdata_state (VERSION, STATE_CODE, NAME) VALUES (?,?,?)",
+		proc:   "dbo.usp_refdata_state_add",
+		params: []string{"VERSION", "STATE_CODE", "NAME"},
+		write:  true,
+	},
+	"ero.status": {
+		query: "SELECT ID, EFIN, COMPANY, TAX_YEAR, RECEIVED_DATE, DELETED_AT FROM ero WHERE EFIN = ? AND (? = 1 OR DELETED_AT IS NULL) ORDER BY RECEIVED_DATE DESC",
+	},
+	"ero.status_confirmation": {
+		query: "SELECT ID, EFIN, COMPANY, TAX_YEAR, RECEIVED_DATE, DELETED_AT FROM ero WHERE CONFIRMATION = ? AND (? = 1 OR DELETED_AT IS NULL)",
+	},
+	"ero.status_asof": {
+		query: "SELECT ID, EFIN, COMPANY, TAX_YEAR, RECEIVED_DATE, DELETED_AT FROM ero FOR SYSTEM_TIME AS OF ? WHERE EFIN = ? AND (? = 1 OR DELETED_AT IS NULL) ORDER BY RECEIVED_DATE DESC",
+	},
+	"ero.forwarded": {
+		// The records in a day's end-of-day report, once it is delivered.
+		query: `UPDATE e SET FORWARDED_AT = ?
+			FROM ero e JOIN batch b ON b.ID = e.BATCH_ID
+			WHERE b.STARTED_AT >= ? AND b.STARTED_AT < ? AND b.REPLAY_OF IS NULL
+				AND e.FORWARDED_AT IS NULL AND e.STATUS <> 'rejected'`,
+		proc:   "dbo.usp_ero_forwarded",
+		params: []string{"FORWARDED_AT", "FROM", "TO"},
+		write:  true,
+	},
+	"ero.deadlines": {
+		// Records not yet forwarded whose deadline (RECEIVED_DATE plus
+		// the window in minutes) is before the horizon.
+		query: `SELECT e.ID, e.EFIN, COALESCE(b.TRANSMITTER_ID, ''), e.STATUS, e.RECEIVED_DATE,
+				DATEADD(MINUTE, ?, e.RECEIVED_DATE) AS DEADLINE
+			FROM ero e LEFT JOIN batch b ON b.ID = e.BATCH_ID
+			WHERE e.FORWARDED_AT IS NULL AND e.STATUS <> 'rejected'
+				AND e.RECEIVED_DATE < DATEADD(MINUTE, -?, ?)
+			ORDER BY e.RECEIVED_DATE`,
+	},
+	"bank_outbox.add": {
+		query: `INSERT INTO bank_outbox(ERO_ID, QUEUED_AT)
+			SELECT ?, ? WHERE NOT EXISTS (SELECT 1 FROM bank_outbox WHERE ERO_ID = ?)`,
+		proc:   "dbo.usp_bank_outbox_add",
+		params: []string{"ERO_ID", "QUEUED_AT"},
+		write:  true,
+	},
+	"bank_outbox.drop_batch": {
+		query:  "DELETE FROM bank_outbox WHERE ERO_ID IN (SELECT ID FROM ero WHERE BATCH_ID = ?)",
+		proc:   "dbo.usp_bank_outbox_drop_batch",
+		params: []string{"BATCH_ID"},
+		write:  true,
+	},
+	"bank_outbox.next": {
+		query: `SELECT TOP (?) e.ID, COALESCE(e.EFIN, ''), COALESCE(e.COMPANY, ''), e.TAX_YEAR, COALESCE(e.STATE, ''), COALESCE(e.PRIOR_BANK, ''),
+				e.RECEIVED_DATE, e.AMENDED, COALESCE(e.CORRELATION_ID, ''), COALESCE(e.CONFIRMATION, ''),
+				e.STATUS, COALESCE(e.DEACTIVATION_REASON, '')
+			FROM bank_outbox o JOIN ero e ON e.ID = o.ERO_ID
+			WHERE o.ATTEMPTS < ?
+			ORDER BY o.QUEUED_AT, o.ERO_ID`,
+	},
+	"bank_outbox.depth": {
+		query: "SELECT COUNT(*), COALESCE(SUM(CASE WHEN ATTEMPTS >= ? THEN 1 ELSE 0 END), 0) FROM bank_outbox",
+	},
+	"bank_outbox.sent": {
+		// ERO_ID is passed twice.
+		query: `UPDATE ero SET FORWARDED_AT = COALESCE(FORWARDED_AT, ?) WHERE ID = ?;
+			DELETE FROM bank_outbox WHERE ERO_ID = ?`,
+		proc:   "dbo.usp_bank_outbox_sent",
+		params: []string{"FORWARDED_AT", "ERO_ID"},
+		write:  true,
+	},
+	"bank_outbox.failed": {
+		query:  "UPDATE bank_outbox SET ATTEMPTS = ATTEMPTS + 1, LAST_ERROR = ?, LAST_TRIED_AT = ? WHERE ERO_ID = ?",
+		proc:   "dbo.usp_bank_outbox_failed",
+		params: []string{"LAST_ERROR", "LAST_TRIED_AT", "ERO_ID"},
+		write:  true,
+	},
+	"event_outbox.welcome": {
+		// EFIN is passed four times and HELD and ERO_ID twice.
+		query: `DELETE FROM event_outbox WHERE EVENT_TYPE = 'enrollment.welcome' AND EFIN = ? AND HELD = 1 AND ? = 0;
+			INSERT INTO event_outbox(EVENT_TYPE, ERO_ID, EFIN, PAYLOAD, HELD, CREATED_AT)
+			SELECT 'enrollment.welcome', ?, ?, ?, ?, ?
+			WHERE NOT EXISTS (SELECT 1 FROM event_outbox WITH (UPDLOCK, HOLDLOCK) WHERE EVENT_TYPE = 'enrollment.welcome' AND EFIN = ?)
+				AND NOT EXISTS (SELECT 1 FROM ero WHERE EFIN = ? AND ID <> ? AND STATUS IN ('loaded', 'inactive'))`,
+		proc:   "dbo.usp_event_outbox_welcome",
+		params: []string{"ERO_ID", "EFIN", "PAYLOAD", "HELD", "CREATED_AT"},
+		write:  true,
+	},
+	"event_outbox.release": {
+		query:  "UPDATE event_outbox SET HELD = 0, PAYLOAD = JSON_MODIFY(PAYLOAD, '$.confirmation', ?) WHERE ERO_ID = ? AND HELD = 1",
+		proc:   "dbo.usp_event_outbox_release",
+		params: []string{"CONFIRMATION", "ERO_ID"},
+		write:  true,
+	},
+	"event_outbox.drop": {
+		query:  "DELETE FROM event_outbox WHERE ERO_ID = ? AND HELD = 1",
+		proc:   "dbo.usp_event_outbox_drop",
+		params: []string{"ERO_ID"},
+		write:  true,
+	},
+	"event_outbox.drop_batch": {
+		query:  "DELETE FROM event_outbox WHERE SENT_AT IS NULL AND ERO_ID IN (SELECT ID FROM ero WHERE BATCH_ID = ?)",
+		proc:   "dbo.usp_event_outbox_drop_batch",
+		params: []string{"BATCH_ID"},
+		write:  true,
+	},
+	"event_outbox.next": {
+		query: `SELECT TOP (?) ID, EVENT_TYPE, PAYLOAD, CREATED_AT FROM event_outbox
+			WHERE SENT_AT IS NULL AND HELD = 0 AND ATTEMPTS < ?
+			ORDER BY ID`,
+	},
+	"event_outbox.depth": {
+		query: `SELECT COUNT(*), COALESCE(SUM(CASE WHEN ATTEMPTS >= ? THEN 1 ELSE 0 END), 0) FROM event_outbox
+			WHERE SENT_AT IS NULL AND HELD = 0`,
+	},
+	"event_outbox.sent": {
+		query:  "UPDATE event_outbox SET SENT_AT = ? WHERE ID = ?",
+		proc:   "dbo.usp_event_outbox_sent",
+		params: []string{"SENT_AT", "ID"},
+		write:  true,
+	},
+	"event_outbox.failed": {
+		query:  "UPDATE event_outbox SET ATTEMPTS = ATTEMPTS + 1, LAST_ERROR = ?, LAST_TRIED_AT = ? WHERE ID = ?",
+		proc:   "dbo.usp_event_outbox_failed",
+		params: []string{"LAST_ERROR", "LAST_TRIED_AT", "ID"},
+		write:  true,
+	},
+	"email_verification.add": {
+		query:  "INSERT INTO email_verification(TOKEN_HASH, TOKEN, ERO_ID, EMAIL, HELD, CREATED_AT) VALUES (?, ?, ?, ?, ?, ?)",
+		proc:   "dbo.usp_email_verification_add",
+		params: []string{"TOKEN_HASH", "TOKEN", "ERO_ID", "EMAIL", "HELD", "CREATED_AT"},
+		write:  true,
+	},
+	"email_verification.release": {
+		query:  "UPDATE email_verification SET HELD = 0 WHERE ERO_ID = ? AND HELD = 1",
+		proc:   "dbo.usp_email_verification_release",
+		params: []string{"ERO_ID"},
+		write:  true,
+	},
+	"email_verification.drop": {
+		query:  "DELETE FROM email_verification WHERE ERO_ID = ? AND HELD = 1",
+		proc:   "dbo.usp_email_verification_drop",
+		params: []string{"ERO_ID"},
+		write:  true,
+	},
+	"email_verification.drop_batch": {
+		query:  "DELETE FROM email_verification WHERE VERIFIED_AT IS NULL AND ERO_ID IN (SELECT ID FROM ero WHERE BATCH_ID = ?)",
+		proc:   "dbo.usp_email_verification_drop_batch",
+		params: []string{"BATCH_ID"},
+		write:  true,
+	},
+	"email_verification.next": {
+		query: `SELECT TOP (?) v.TOKEN_HASH, v.TOKEN, v.ERO_ID, v.EMAIL, COALESCE(e.EFIN, ''), COALESCE(e.COMPANY, ''), COALESCE(e.CONFIRMATION, '')
+			FROM email_verification v JOIN ero e ON e.ID = v.ERO_ID
+			WHERE v.SENT_AT IS NULL AND v.HELD = 0 AND v.TOKEN IS NOT NULL AND v.ATTEMPTS < ?
+			ORDER BY v.CREATED_AT`,
+	},
+	"email_verification.sent": {
+		query:  "UPDATE email_verification SET SENT_AT = ?, TOKEN = NULL WHERE TOKEN_HASH = ?",
+		proc:   "dbo.usp_email_verification_sent",
+		params: []string{"SENT_AT", "TOKEN_HASH"},
+		write:  true,
+	},
+	"email_verification.failed": {
+		query:  "UPDATE email_verification SET ATTEMPTS = ATTEMPTS + 1, LAST_ERROR = ? WHERE TOKEN_HASH = ?",
+		proc:   "dbo.usp_email_verification_failed",
+		params: []string{"LAST_ERROR", "TOKEN_HASH"},
+		write:  true,
+	},
+	"email_verification.verify": {
+		// VERIFIED_AT is passed twice. Returns the verified record's ID.
+		query: `DECLARE @ids TABLE (ERO_ID INT);
+			UPDATE email_verification SET VERIFIED_AT = COALESCE(VERIFIED_AT, ?)
+			OUTPUT inserted.ERO_ID INTO @ids
+			WHERE TOKEN_HASH = ? AND SENT_AT >= ?;
+			UPDATE e SET EMAIL_VERIFIED_AT = COALESCE(e.EMAIL_VERIFIED_AT, ?)
+			OUTPUT inserted.ID
+			FROM ero e JOIN @ids i ON i.ERO_ID = e.ID
+			WHERE e.STATUS = 'loaded'`,
+		proc:   "dbo.usp_email_verification_verify",
+		params: []string{"VERIFIED_AT", "TOKEN_HASH", "SENT_AFTER"},
+		write:  true,
+	},
+	"schema.ero_columns": {
+		// Text columns' lengths and collations, for lengths.go and
+		// collation.go. A length of -1 is (N)VARCHAR(MAX).
+		query: `SELECT COLUMN_NAME, CHARACTER_MAXIMUM_LENGTH, COALESCE(COLLATION_NAME, '') FROM INFORMATION_SCHEMA.COLUMNS
+			WHERE TABLE_SCHEMA = 'dbo' AND TABLE_NAME = 'ero' AND CHARACTER_MAXIMUM_LENGTH IS NOT NULL`,
+	},
+	"sequence.confirmation": {
+		query: "SELECT NEXT VALUE FOR dbo.seq_confirmation",
+		proc:  "dbo.usp_sequence_confirmation",
+		write: true,
+	},
+	"eod.counts": {
+		// One row per report section and key; see eod.go.
+		query: `SELECT 'STATUS', e.STATUS, COUNT(*) FROM ero e JOIN batch b ON b.ID = e.BATCH_ID
+				WHERE b.STARTED_AT >= ? AND b.STARTED_AT < ? AND b.REPLAY_OF IS NULL GROUP BY e.STATUS
+			UNION ALL
+			SELECT 'STATE', COALESCE(e.STATE, ''), COUNT(*) FROM ero e JOIN batch b ON b.ID = e.BATCH_ID
+				WHERE b.STARTED_AT >= ? AND b.STARTED_AT < ? AND b.REPLAY_OF IS NULL GROUP BY e.STATE
+			UNION ALL
+			SELECT 'BANK', COALESCE(e.PRIOR_BANK, ''), COUNT(*) FROM ero e JOIN batch b ON b.ID = e.BATCH_ID
+				WHERE b.STARTED_AT >= ? AND b.STARTED_AT < ? AND b.REPLAY_OF IS NULL GROUP BY e.PRIOR_BANK
+			UNION ALL
+			SELECT 'TYPE', CASE WHEN e.AMENDED = 1 THEN 'AMENDED' ELSE 'NEW' END, COUNT(*) FROM ero e JOIN batch b ON b.ID = e.BATCH_ID
+				WHERE b.STARTED_AT >= ? AND b.STARTED_AT < ? AND b.REPLAY_OF IS NULL GROUP BY e.AMENDED
+			UNION ALL
+			SELECT 'STATUS', 'rejected', COALESCE(SUM(REJECTED), 0) FROM batch
+				WHERE STARTED_AT >= ? AND STARTED_AT < ? AND REPLAY_OF IS NULL`,
+	},
+	// The API shows a transmitter only the records its own batches loaded.
+	"ero.lookup": {
+		query: "SELECT e.ID, e.EFIN, e.COMPANY, e.TAX_YEAR, e.RECEIVED_DATE, e.BATCH_ID, e.STATUS, e.CORRELATION_ID, e.CONFIRMATION, e.EMAIL_VERIFIED_AT FROM ero e JOIN batch b ON b.ID = e.BATCH_ID WHERE e.EFIN = ? AND b.TRANSMITTER_ID = ? AND e.DELETED_AT IS NULL ORDER BY e.RECEIVED_DATE DESC",
+	},
+	"ero.lookup_confirmation": {
+		query: "SELECT e.ID, e.EFIN, e.COMPANY, e.TAX_YEAR, e.RECEIVED_DATE, e.BATCH_ID, e.STATUS, e.CORRELATION_ID, e.CONFIRMATION, e.EMAIL_VERIFIED_AT FROM ero e JOIN batch b ON b.ID = e.BATCH_ID WHERE e.CONFIRMATION = ? AND b.TRANSMITTER_ID = ? AND e.DELETED_AT IS NULL",
+	},
+	"ero.list": {
+		query: "SELECT TOP (?) ID, EFIN, COMPANY, TAX_YEAR, RECEIVED_DATE, DELETED_AT FROM ero WHERE TAX_YEAR = ? AND (? = 1 OR DELETED_AT IS NULL) ORDER BY ID DESC",
+	},
+	"ero.list_asof": {
+		query: "SELECT TOP (?) ID, EFIN, COMPANY, TAX_YEAR, RECEIVED_DATE, DELETED_AT FROM ero FOR SYSTEM_TIME AS OF ? WHERE TAX_YEAR = ? AND (? = 1 OR DELETED_AT IS NULL) ORDER BY ID DESC",
+	},
+	"ero.export": {
+		query: "SELECT ID, EFIN, COMPANY, TAX_YEAR, RECEIVED_DATE, BATCH_ID, STATUS, DELETED_AT FROM ero WHERE TAX_YEAR = ? AND (? = 1 OR DELETED_AT IS NULL) ORDER BY ID",
+	},
+	"ero.export_asof": {
+		query: "SELECT ID, EFIN, COMPANY, TAX_YEAR, RECEIVED_DATE, BATCH_ID, STATUS, DELETED_AT FROM ero FOR SYSTEM_TIME AS OF ? WHERE TAX_YEAR = ? AND (? = 1 OR DELETED_AT IS NULL) ORDER BY ID",
+	},
+	"subject_key.current": {
+		// The data keys and the details they encrypt are described in
+		// subject.go and sql/031_data_subjects.sql.
+		query: "SELECT TOP 1 ID, DATA_KEY FROM subject_key WHERE SSN_HASH = ? AND DATA_KEY IS NOT NULL ORDER BY ID DESC",
+	},
+	"subject_key.add": {
+		query:  "INSERT INTO subject_key (SSN_HASH, DATA_KEY, CREATED_AT) OUTPUT INSERTED.ID VALUES (?,?,?)",
+		proc:   "dbo.usp_subject_key_add",
+		params: []string{"SSN_HASH", "DATA_KEY", "CREATED_AT"},
+		write:  true,
+	},
+	"subject_key.erase": {
+		query:  "UPDATE subject_key SET DATA_KEY = NULL, ERASED_AT = ?, ERASED_BY = ? WHERE SSN_HASH = ? AND DATA_KEY IS NOT NULL",
+		proc:   "dbo.usp_subject_key_erase",
+		params: []string{"ERASED_AT", "ERASED_BY", "SSN_HASH"},
+		write:  true,
+	},
+	"ero_subject.add": {
+		query:  "INSERT INTO ero_subject (ERO_ID, ROLE, SSN_HASH, KEY_ID, PERSONAL) VALUES (?,?,?,?,?)",
+		proc:   "dbo.usp_ero_subject_add",
+		params: []string{"ERO_ID", "ROLE", "SSN_HASH", "KEY_ID", "PERSONAL"},
+		write:  true,
+	},
+	"ero_sensitive.add": {
+		// Always Encrypted (sql/033_always_encrypted.sql): SSN and
+		// DATE_OF_BIRTH are encrypted by the driver, so they must stay
+		// plain placeholders.
+		query:  "INSERT INTO ero_sensitive (ERO_ID, ROLE, SSN, DATE_OF_BIRTH) VALUES (?,?,?,?)",
+		proc:   "dbo.usp_ero_sensitive_add",
+		params: []string{"ERO_ID", "ROLE", "SSN", "DATE_OF_BIRTH"},
+		write:  true,
+	},
+	"ero_enrichment.add": {
+		query:  "INSERT INTO ero_enrichment (ERO_ID, NAME, VALUE) VALUES (?,?,?)",
+		proc:   "dbo.usp_ero_enrichment_add",
+		params: []string{"ERO_ID", "NAME", "VALUE"},
+		write:  true,
+	},
+	"ero_office.add": {
+		// The parts of a record (parts.go, sql/036_ero_parts.sql).
+		query:  "INSERT INTO ero_office (ERO_ID, OFFICE_NAME, CONTACT_FIRST, CONTACT_LAST, PHONE, FAX, EMAIL, ADDRESS1, ADDRESS2, CITY, STATE, ZIP) VALUES (?,?,?,?,?,?,?,?,?,?,?,?)",
+		proc:   "dbo.usp_ero_office_add",
+		params: []string{"ERO_ID", "OFFICE_NAME", "CONTACT_FIRST", "CONTACT_LAST", "PHONE", "FAX", "EMAIL", "ADDRESS1", "ADDRESS2", "CITY", "STATE", "ZIP"},
+		write:  true,
+	},
+	"ero_owner.add": {
+		query:  "INSERT INTO ero_owner (ERO_ID, FIRST_NAME, LAST_NAME, PHONE, EMAIL, ADDRESS1, ADDRESS2, CITY, STATE, ZIP) VALUES (?,?,?,?,?,?,?,?,?,?)",
+		proc:   "dbo.usp_ero_owner_add",
+		params: []string{"ERO_ID", "FIRST_NAME", "LAST_NAME", "PHONE", "EMAIL", "ADDRESS1", "ADDRESS2", "CITY", "STATE", "ZIP"},
+		write:  true,
+	},
+	"ero_efin_owner.add": {
+		query:  "INSERT INTO ero_efin_owner (ERO_ID, FIRST_NAME, LAST_NAME, PHONE, EMAIL, ADDRESS1, ADDRESS2, CITY, STATE, ZIP) VALUES (?,?,?,?,?,?,?,?,?,?)",
+		proc:   "dbo.usp_ero_efin_owner_add",
+		params: []string{"ERO_ID", "FIRST_NAME", "LAST_NAME", "PHONE", "EMAIL", "ADDRESS1", "ADDRESS2", "CITY", "STATE", "ZIP"},
+		write:  true,
+	},
+	"ero_prior_year.add": {
+		query:  "INSERT INTO ero_prior_year (ERO_ID, BANK, CLIENT_OF_YOURS_LAST_YEAR) VALUES (?,?,?)",
+		proc:   "dbo.usp_ero_prior_year_add",
+		params: []string{"ERO_ID", "BANK", "CLIENT_OF_YOURS_LAST_YEAR"},
+		write:  true,
+	},
+	"ero_sensitive.erase": {
+		query:  "DELETE FROM ero_sensitive WHERE ERO_ID IN (SELECT ERO_ID FROM ero_subject WHERE SSN_HASH = ?)",
+		proc:   "dbo.usp_ero_sensitive_erase",
+		params: []string{"SSN_HASH"},
+		write:  true,
+	},
+	"ero_subject.erase": {
+		query:  "UPDATE ero_subject SET PERSONAL = NULL WHERE SSN_HASH = ? AND PERSONAL IS NOT NULL",
+		proc:   "dbo.usp_ero_subject_erase",
+		params: []string{"SSN_HASH"},
+		write:  true,
+	},
+	"ero_subject.ids": {
+		query: "SELECT DISTINCT ERO_ID FROM ero_subject WHERE SSN_HASH = ? ORDER BY ERO_ID",
+	},
+	"ero_subject.records": {
+		query: `SELECT e.ID, s.ROLE, e.EFIN, COALESCE(e.COMPANY, ''), e.TAX_YEAR, e.STATUS, e.RECEIVED_DATE, e.DELETED_AT, k.DATA_KEY, s.PERSONAL
+			FROM ero_subject s JOIN ero e ON e.ID = s.ERO_ID LEFT JOIN subject_key k ON k.ID = s.KEY_ID
+			WHERE s.SSN_HASH = ?
+			ORDER BY e.ID, s.ROLE`,
+	},
+	"ero_subject.emails": {
+		query: `SELECT ERO_ID, EMAIL, CREATED_AT, VERIFIED_AT FROM email_verification
+			WHERE ERO_ID IN (SELECT ERO_ID FROM ero_subject WHERE SSN_HASH = ?)
+			ORDER BY CREATED_AT`,
+	},
+	"ero_subject.events": {
+		query: `SELECT ERO_ID, EVENT_TYPE, CREATED_AT, SENT_AT, PAYLOAD FROM event_outbox
+			WHERE ERO_ID IN (SELECT ERO_ID FROM ero_subject WHERE SSN_HASH = ?)
+			ORDER BY CREATED_AT`,
+	},
+	"ero_subject.edits": {
+		// Edits of the person's records, and edits that made them.
+		query: `SELECT d.ERO_ID, d.EDITED_BY, d.EDITED_AT, d.NOTE, d.CHANGES FROM enrollment_edit d
+			WHERE EXISTS (SELECT 1 FROM ero_subject s WHERE s.SSN_HASH = ? AND s.ERO_ID IN (d.ERO_ID, d.NEW_ID))
+			ORDER BY d.EDITED_AT`,
+	},
+	"subject.erase_preview": {
+		// What erasing a person would touch (see subject.go). The hash is
+		// passed once per subquery.
+		query: `SELECT
+				(SELECT COUNT(DISTINCT ERO_ID) FROM ero_subject WHERE SSN_HASH = ?),
+				(SELECT COUNT(*) FROM subject_key WHERE SSN_HASH = ? AND DATA_KEY IS NOT NULL),
+				(SELECT COUNT(*) FROM ero_subject WHERE SSN_HASH = ? AND PERSONAL IS NOT NULL),
+				(SELECT COUNT(*) FROM email_verification WHERE EMAIL <> '' AND ERO_ID IN (SELECT ERO_ID FROM ero_subject WHERE SSN_HASH = ?)),
+				(SELECT COUNT(*) FROM event_outbox WHERE PAYLOAD <> '{}' AND ERO_ID IN (SELECT ERO_ID FROM ero_subject WHERE SSN_HASH = ?)),
+				(SELECT COUNT(*) FROM enrollment_edit d WHERE d.CHANGES <> '{}'
+					AND EXISTS (SELECT 1 FROM ero_subject s WHERE s.SSN_HASH = ? AND s.ERO_ID IN (d.ERO_ID, d.NEW_ID)))`,
+	},
+	"email_verification.erase": {
+		query: `UPDATE email_verification SET EMAIL = '', TOKEN = NULL
+			WHERE EMAIL <> '' AND ERO_ID IN (SELECT ERO_ID FROM ero_subject WHERE SSN_HASH = ?)`,
+		proc:   "dbo.usp_email_verification_erase",
+		params: []string{"SSN_HASH"},
+		write:  true,
+	},
+	"event_outbox.erase": {
+		// An event not sent yet never will be.
+		query: `UPDATE event_outbox SET PAYLOAD = '{}', SENT_AT = COALESCE(SENT_AT, ?),
+				LAST_ERROR = CASE WHEN SENT_AT IS NULL THEN 'erased before it was sent' ELSE LAST_ERROR END
+			WHERE PAYLOAD <> '{}' AND ERO_ID IN (SELECT ERO_ID FROM ero_subject WHERE SSN_HASH = ?)`,
+		proc:   "dbo.usp_event_outbox_erase",
+		params: []string{"ERASED_AT", "SSN_HASH"},
+		write:  true,
+	},
+	"enrollment_edit.erase": {
+		query: `UPDATE d SET CHANGES = '{}', NOTE = NULL FROM enrollment_edit d
+			WHERE d.CHANGES <> '{}' AND EXISTS (SELECT 1 FROM ero_subject s WHERE s.SSN_HASH = ? AND s.ERO_ID IN (d.ERO_ID, d.NEW_ID))`,
+		proc:   "dbo.usp_enrollment_edit_erase",
+		params: []string{"SSN_HASH"},
+		write:  true,
+	},
+	"subject_erasure.add": {
+		query:  "INSERT INTO subject_erasure (SSN_HASH, ERASED_AT, ERASED_BY, TICKET, CERTIFICATE) OUTPUT INSERTED.ID VALUES (?,?,?,?,?)",
+		proc:   "dbo.usp_subject_erasure_add",
+		params: []string{"SSN_HASH", "ERASED_AT", "ERASED_BY", "TICKET", "CERTIFICATE"},
+		write:  true,
+	},
+	"subject_erasure.list": {
+		query: "SELECT ID, ERASED_AT, TICKET FROM subject_erasure WHERE SSN_HASH = ? ORDER BY ID",
+	},
+	"credential.add": {
+		// Transmitter credentials (credentials.go); SECRET is sealed.
+		query:  "INSERT INTO transmitter_credential (TRANSMITTER_ID, KIND, SECRET, FINGERPRINT, CREATED_AT, CREATED_BY) OUTPUT INSERTED.ID VALUES (?,?,?,?,?,?)",
+		proc:   "dbo.usp_transmitter_credential_add",
+		params: []string{"TRANSMITTER_ID", "KIND", "SECRET", "FINGERPRINT", "CREATED_AT", "CREATED_BY"},
+		write:  true,
+	},
+	"credential.expire": {
+		// The others of the kind that haven't expired yet.
+		query: `UPDATE transmitter_credential SET EXPIRES_AT = ?
+			WHERE TRANSMITTER_ID = ? AND KIND = ? AND ID <> ? AND (EXPIRES_AT IS NULL OR EXPIRES_AT > ?)`,
+		proc:   "dbo.usp_transmitter_credential_expire",
+		params: []string{"EXPIRES_AT", "TRANSMITTER_ID", "KIND", "ID", "NOW"},
+		write:  true,
+	},
+	"credential.current": {
+		query: `SELECT TOP 1 SECRET FROM transmitter_credential
+			WHERE TRANSMITTER_ID = ? AND KIND = ? AND (EXPIRES_AT IS NULL OR EXPIRES_AT > ?)
+			ORDER BY ID DESC`,
+	},
+	"credential.api_keys": {
+		query: "SELECT TRANSMITTER_ID, SECRET FROM transmitter_credential WHERE KIND = 'api-key' AND (EXPIRES_AT IS NULL OR EXPIRES_AT > ?)",
+	},
+	"credential.list": {
+		query: `SELECT ID, TRANSMITTER_ID, KIND, FINGERPRINT, CREATED_AT, CREATED_BY, EXPIRES_AT FROM transmitter_credential
+			WHERE ? = '' OR TRANSMITTER_ID = ?
+			ORDER BY TRANSMITTER_ID, KIND, ID`,
+	},
+	"legal_hold.add": {
+		query:  "INSERT INTO legal_hold (KIND, VALUE, REASON, PLACED_BY, PLACED_AT) OUTPUT INSERTED.ID VALUES (?,?,?,?,?)",
+		proc:   "dbo.usp_legal_hold_add",
+		params: []string{"KIND", "VALUE", "REASON", "PLACED_BY", "PLACED_AT"},
+		write:  true,
+	},
+	"legal_hold.release": {
+		query:  "UPDATE legal_hold SET RELEASED_AT = ?, RELEASED_BY = ? WHERE ID = ? AND RELEASED_AT IS NULL",
+		proc:   "dbo.usp_legal_hold_release",
+		params: []string{"RELEASED_AT", "RELEASED_BY", "ID"},
+		write:  true,
+	},
+	"legal_hold.list": {
+		// Holds in place, and how many records each covers.
+		query: `SELECT h.ID, h.KIND, h.VALUE, h.REASON, h.PLACED_BY, h.PLACED_AT,
+				CASE WHEN h.KIND = 'efin' THEN (SELECT COUNT(*) FROM ero WHERE EFIN = h.VALUE)
+					ELSE (SELECT COUNT(DISTINCT ERO_ID) FROM ero_subject WHERE SSN_HASH = h.VALUE) END
+			FROM legal_hold h
+			WHERE h.RELEASED_AT IS NULL
+			ORDER BY h.PLACED_AT`,
+	},
+	"legal_hold.subject": {
+		// Holds on the person, or on an EFIN they are part of.
+		query: `SELECT KIND, VALUE, REASON FROM legal_hold
+			WHERE RELEASED_AT IS NULL AND ((KIND = 'owner' AND VALUE = ?)
+				OR (KIND = 'efin' AND VALUE IN (SELECT e.EFIN FROM ero e JOIN ero_subject s ON s.ERO_ID = e.ID WHERE s.SSN_HASH = ?)))`,
+	},
+	"db.isolation_options": {
+		query: "SELECT is_read_committed_snapshot_on, snapshot_isolation_state FROM sys.databases WHERE name = DB_NAME()",
+	},
+}
+
+// preparer is satisfied by both *sql.DB and *sql.Tx.
+type preparer interface {
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+// statementText returns the SQL we will actually send for a catalog entry:
+// either the raw statement or an EXEC of its stored procedure.
+func statementText(name string) (string, error) {
+	s, ok := statements[name]
+	if !ok {
+		return "", fmt.Errorf("unknown statement %q", name)
+	}
+
+	if !viper.GetBool("mssql.storedprocedures") {
+		return s.query, nil
+	}
+
+	if s.proc == "" {
+		if s.write {
+			return "", fmt.Errorf("statement %q has no stored procedure; refusing raw DML with mssql.storedprocedures enabled", name)
+		}
+		return s.query, nil
+	}
+
+	args := make([]string, len(s.params))
+	for i, p := range s.params {
+		args[i] = "@" + p + " = ?"
+	}
+	return "EXEC " + s.proc + " " + strings.Join(args, ", "), nil
+}
+
+// prepare looks a statement up in the catalog and prepares it on p.
+func prepare(p preparer, name string) (*sql.Stmt, error) {
+	text, err := statementText(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := chaosStatement(name); err != nil { // see chaos.go
+		return nil, err
+	}
+	return p.Prepare(text)
+}
@@ -0,0 +1,66 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"time"
+)
+
+// After every batch we add its reject counts to error_stats, one row per
+// transmitter, field, error code and day. Over a season that tells us
+// which vendors keep sending the same broken field, which is the data we
+// need to get them to fix their software instead of us fixing their files.
+
+type errorStatKey struct {
+	Transmitter string
+	Field       string
+	Code        string
+}
+
+// countErrors tallies the errors in a batch's rejects.
+func countErrors(summary loadSummary) map[errorStatKey]int {
+	counts := map[errorStatKey]int{}
+	for _, r := range summary.Rejected {
+		for _, e := range r.Errors {
+			counts[errorStatKey{Transmitter: r.Transmitter, Field: e.Field, Code: e.Code}]++
+		}
+	}
+	return counts
+}
+
+// recordErrorStats adds a batch's error counts to today's statistics.
+func recordErrorStats(db *sql.DB, summary loadSummary) error {
+	counts := countErrors(summary)
+	if len(counts) == 0 {
+		return nil
+	}
+
+	stmt, err := prepare(db, "error_stats.add")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for k, n := range counts {
+		if _, err := stmt.Exec(k.Transmitter, k.Field, k.Code, today, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+)
+
+// The status and list commands only read, so they go to the replica when
+// one is configured (see databases.reader).
+//
+// With --as-of they show what we had loaded at the end of that day
+// instead of now, from the ero history (sql/008_ero_history.sql).
+//
+// Records a revert --delete marked deleted (sql/030_soft_delete.sql) are
+// left out unless --include-deleted; the API never shows them.
+
+var (
+	statusEFIN         string
+	statusConfirmation string
+	asOf               string // --as-of, shared by status, list and export
+	includeDeleted     bool   // --include-deleted, likewise
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show what we have loaded for an EFIN (or confirmation number)",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if (statusEFIN == "") == (statusConfirmation == "") {
+			check(fmt.Errorf("give one of --efin or --confirmation"))
+		}
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		if statusConfirmation != "" {
+			check(printEnrollments(dbs.reader(), "ero.status_confirmation", statusConfirmation, includeDeleted))
+			return
+		}
+
+		if t, ok := parseAsOf(asOf); ok {
+			check(printEnrollments(dbs.reader(), "ero.status_asof", t, statusEFIN, includeDeleted))
+			return
+		}
+		check(printEnrollments(dbs.reader(), "ero.status", statusEFIN, includeDeleted))
+	},
+}
+
+var (
+	listYear  int
+	listLimit int
+)
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the most recently loaded enrollments",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		if t, ok := parseAsOf(asOf); ok {
+			check(printEnrollments(dbs.reader(), "ero.list_asof", listLimit, t, listYear, includeDeleted))
+			return
+		}
+		check(printEnrollments(dbs.reader(), "ero.list", listLimit, listYear, includeDeleted))
+	},
+}
+
+func init() {
+	statusCmd.Flags().StringVar(&statusEFIN, "efin", "", "EFIN to look up")
+	statusCmd.Flags().StringVar(&statusConfirmation, "confirmation", "", "confirmation number to look up")
+	listCmd.Flags().IntVar(&listYear, "year", 2016, "tax year")
+	listCmd.Flags().IntVar(&listLimit, "limit", 50, "maximum rows to show")
+	for _, cmd := range []*cobra.Command{statusCmd, listCmd} {
+		cmd.Flags().StringVar(&asOf, "as-of", "", "show what was loaded as of this date (2016-02-15) or time (RFC 3339)")
+		cmd.Flags().BoolVar(&includeDeleted, "include-deleted", false, "show deleted records too")
+	}
+
+	rootCmd.AddCommand(statusCmd, listCmd)
+}
+
+// parseAsOf reads an --as-of value. A date means the end of that day,
+// local time, so "--as-of 2016-02-15" includes everything loaded that day.
+// The history is kept in UTC, so the time is returned in UTC. ok is false
+// if there is no --as-of.
+func parseAsOf(s string) (t time.Time, ok bool) {
+	if s == "" {
+		return time.Time{}, false
+	}
+	if d, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return d.AddDate(0, 0, 1).Add(-time.Nanosecond).UTC(), true
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		check(fmt.Errorf("--as-of must be a date (2016-02-15) or an RFC 3339 time"))
+	}
+	return t.UTC(), true
+}
+
+// printEnrollments runs one of the ero queries and prints the rows, with
+// when each was deleted if deleted ones are included.
+func printEnrollments(db *sql.DB, name string, args ...interface{}) error {
+	stmt, err := prepare(db, name)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if includeDeleted {
+		fmt.Fprintln(w, "ID\tEFIN\tCOMPANY\tTAX YEAR\tRECEIVED\tDELETED")
+	} else {
+		fmt.Fprintln(w, "ID\tEFIN\tCOMPANY\tTAX YEAR\tRECEIVED")
+	}
+	for rows.Next() {
+		var (
+			id       int64
+			efin     string
+			company  string
+			year     int
+			received time.Time
+			deleted  sql.NullTime
+		)
+		if err := rows.Scan(&id, &efin, &company, &year, &received, &deleted); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s", id, efin, company, year, received.Format(time.RFC3339))
+		if includeDeleted && deleted.Valid {
+			fmt.Fprintf(w, "\t%s", deleted.Time.Format(time.RFC3339))
+		}
+		fmt.Fprintln(w)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// enrollmentRecord is an ero row as the API returns it.
+type enrollmentRecord struct {
+	ID       int64     `json:"id"`
+	EFIN     string    `json:"efin"`
+	Company  string    `json:"company"`
+	TaxYear  int       `json:"taxYear"`
+	Received time.Time `json:"received"`
+	Batch    int64     `json:"batch,omitempty"`
+	Status   string    `json:"status"`
+
+	Correlation   string     `json:"correlationId,omitempty"`
+	Confirmation  string     `json:"confirmation,omitempty"`
+	EmailVerified *time.Time `json:"emailVerified,omitempty"` // see verify.go
+}
+
+// findEnrollments returns what transmitter's batches have loaded for an
+// EFIN, newest first - or, with a confirmation number, the record that
+// has it.
+func findEnrollments(db *sql.DB, transmitter, efin, confirmation string) ([]enrollmentRecord, error) {
+	name, arg := "ero.lookup", efin
+	if confirmation != "" {
+		name, arg = "ero.lookup_confirmation", confirmation
+	}
+	stmt, err := prepare(db, name)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(arg, transmitter)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := []enrollmentRecord{}
+	for rows.Next() {
+		var e enrollmentRecord
+		var batch sql.NullInt64
+		var correlation, confirmation sql.NullString
+		var verified sql.NullTime
+		if err := rows.Scan(&e.ID, &e.EFIN, &e.Company, &e.TaxYear, &e.Received, &batch, &e.Status, &correlation, &confirmation, &verified); err != nil {
+			return nil, err
+		}
+		e.Batch, e.Correlation, e.Confirmation = batch.Int64, correlation.String, confirmation.String
+		if verified.Valid {
+			e.EmailVerified = &verified.Time
+		}
+		found = append(found, e)
+	}
+	return found, rows.Err()
+}
+
+// registerEnrollmentRoutes adds GET /v1/enrollments?efin=123456 (or
+// ?confirmation=E2016...). A transmitter sees only the records it sent;
+// if there are none, it's a 404, whether or not someone else sent some.
+func registerEnrollmentRoutes(mux *http.ServeMux, dbs *databases, limits *rateLimiter) {
+	mux.HandleFunc("/v1/enrollments", authorized(limits, func(w http.ResponseWriter, r *http.Request, transmitter string) {
+		if r.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		efin, confirmation := r.URL.Query().Get("efin"), r.URL.Query().Get("confirmation")
+		if (efin == "") == (confirmation == "") {
+			httpError(w, http.StatusBadRequest, "give one of efin or confirmation")
+			return
+		}
+
+		found, err := findEnrollments(dbs.reader(), transmitter, efin, confirmation)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(found) == 0 {
+			httpError(w, http.StatusNotFound, "no such enrollment")
+			return
+		}
+		writeJSON(w, http.StatusOK, found)
+	}))
+}
@@ -0,0 +1,680 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Data-subject requests (GDPR/CCPA). A person is known by the hash of
+// their SSN: HMAC-SHA256 under privacy.ssnkey (a secret reference, see
+// secrets.go) of its nine digits, in hex. "enroll subject hash" prints it
+// for an SSN typed on stdin, so the SSN never goes in a command line.
+//
+// With privacy.ssnkey set, the loader links every record it loads to the
+// owner and EFIN owner by that hash (ero_subject, sql/031_data_subjects.sql)
+// and keeps their personal details there - the OwnerInformation and
+// EFINOwnerInfo blocks as sent - encrypted with a key of the subject's own
+// (subject_key, itself sealed with storage.key unless storage.plaintext
+// is set).
+//
+//	enroll subject export --ssn-hash X [--out subject.json]
+//
+// gathers everything we hold tied to the person: the records and their
+// personal details, the verification emails and welcome events sent for
+// them, and support edits to them.
+//
+//	enroll subject erase --ssn-hash X --ticket DSR-123 [--dry-run]
+//
+// crypto-shreds it: the subject's keys are destroyed, so every copy of
+// their details - in backups and the row history too - can't be read,
+// and the plain-text copies (verification email addresses, welcome event
+// payloads, edit details) are blanked. The ero rows stay: they are the
+// office's enrollment and the bank's. Erasure is refused while an EFIN
+// or the owner is under legal hold (legal_hold). It writes an erasure
+// certificate - what was erased, when, by whom, under which ticket - to
+// privacy.certificates, signed with privacy.certificatekey if set
+// (see signing.go), and keeps a copy of it in subject_erasure.
+func init() {
+	viper.SetDefault("privacy.certificates", "./certificates")
+}
+
+// Subject roles: which part of a record a person is.
+const (
+	roleOwner     = "owner"
+	roleEFINOwner = "efinowner"
+)
+
+var errNoSSNKey = errors.New("privacy.ssnkey isn't set")
+
+var ssnKey struct {
+	sync.Once
+	key []byte
+	err error
+}
+
+// ssnHashKey returns the privacy.ssnkey, or nil if it isn't set.
+func ssnHashKey() ([]byte, error) {
+	ssnKey.Do(func() {
+		ref := viper.GetString("privacy.ssnkey")
+		if ref == "" {
+			return
+		}
+		value, err := secretValue(ref)
+		if err != nil {
+			ssnKey.err = fmt.Errorf("config: privacy.ssnkey: %v", err)
+			return
+		}
+		ssnKey.key = []byte(value)
+	})
+	return ssnKey.key, ssnKey.err
+}
+
+// ssnHash is the subject hash of an SSN, "" if it isn't nine digits.
+func ssnHash(key []byte, ssn string) string {
+	digits := ssnDigits(ssn)
+	if digits == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(digits))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ssnDigits is the nine digits of an SSN, dashes and spaces dropped, or
+// "" if that isn't what it is.
+func ssnDigits(ssn string) string {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return 'x'
+	}, ssn)
+	if len(digits) != 9 || strings.Contains(digits, "x") {
+		return ""
+	}
+	return digits
+}
+
+// parseSubjectHash checks a subject hash given as flag.
+func parseSubjectHash(flag, s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if b, err := hex.DecodeString(s); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("--%s must be 64 hex digits (see enroll subject hash)", flag)
+	}
+	return s, nil
+}
+
+// subjectAEAD is the cipher for a subject's data key as stored.
+func subjectAEAD(stored []byte) (cipher.AEAD, error) {
+	key, err := unseal(stored)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// storeSubjects links record id to its owner and EFIN owner and keeps
+// their details, encrypted with each subject's key. It does nothing
+// without privacy.ssnkey.
+func storeSubjects(p preparer, id int64, e Enrollment) error {
+	key, err := ssnHashKey()
+	if err != nil || key == nil {
+		return err
+	}
+	people := []struct {
+		role   string
+		ssn    string
+		fields interface{}
+	}{
+		{roleOwner, e.OwnerInformation.SSN, e.OwnerInformation},
+		{roleEFINOwner, e.EFINOwnerInfo.SSN, e.EFINOwnerInfo},
+	}
+	for _, who := range people {
+		hash := ssnHash(key, who.ssn)
+		if hash == "" {
+			continue
+		}
+		keyID, aead, err := subjectDataKey(p, hash)
+		if err != nil {
+			return err
+		}
+		plain, err := json.Marshal(who.fields)
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return err
+		}
+		personal := aead.Seal(nonce, nonce, plain, []byte(hash+who.role))
+		if _, err := execStatement(p, "ero_subject.add", id, who.role, hash, keyID, personal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subjectDataKey returns the subject's current data key, making one if
+// they have none (or only erased ones).
+func subjectDataKey(p preparer, hash string) (int64, cipher.AEAD, error) {
+	stmt, err := prepare(p, "subject_key.current")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer stmt.Close()
+	var id int64
+	var stored []byte
+	err = stmt.QueryRow(hash).Scan(&id, &stored)
+	if err == sql.ErrNoRows {
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return 0, nil, err
+		}
+		if stored, err = seal(key); err != nil {
+			return 0, nil, err
+		}
+		if id, err = addSubjectKey(p, hash, stored); err != nil {
+			return 0, nil, err
+		}
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	aead, err := subjectAEAD(stored)
+	return id, aead, err
+}
+
+func addSubjectKey(p preparer, hash string, stored []byte) (int64, error) {
+	stmt, err := prepare(p, "subject_key.add")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	var id int64
+	err = stmt.QueryRow(hash, stored, time.Now()).Scan(&id)
+	return id, err
+}
+
+// subjectExport is everything we hold tied to a person.
+type subjectExport struct {
+	SSNHash    string               `json:"ssnHash"`
+	ExportedAt time.Time            `json:"exportedAt"`
+	Records    []subjectRecord      `json:"records"`
+	Emails     []subjectEmail       `json:"verificationEmails"`
+	Events     []subjectEvent       `json:"events"`
+	Edits      []subjectEdit        `json:"edits"`
+	Erasures   []subjectErasureNote `json:"erasures,omitempty"`
+	Unreadable int                  `json:"unreadable,omitempty"` // details whose key was destroyed
+}
+
+// subjectRecord is a record the person is part of.
+type subjectRecord struct {
+	ID       int64           `json:"id"`
+	Role     string          `json:"role"`
+	EFIN     string          `json:"efin"`
+	Company  string          `json:"company"`
+	TaxYear  int             `json:"taxYear"`
+	Status   string          `json:"status"`
+	Received time.Time       `json:"received"`
+	Deleted  *time.Time      `json:"deleted,omitempty"`
+	Details  json.RawMessage `json:"details,omitempty"` // the owner block as sent; absent once erased
+}
+
+type subjectEmail struct {
+	RecordID int64      `json:"recordId"`
+	Email    string     `json:"email"`
+	Created  time.Time  `json:"created"`
+	Verified *time.Time `json:"verified,omitempty"`
+}
+
+type subjectEvent struct {
+	RecordID int64           `json:"recordId"`
+	Type     string          `json:"type"`
+	Created  time.Time       `json:"created"`
+	Sent     *time.Time      `json:"sent,omitempty"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+type subjectEdit struct {
+	RecordID int64           `json:"recordId"`
+	EditedBy string          `json:"editedBy"`
+	EditedAt time.Time       `json:"editedAt"`
+	Note     string          `json:"note,omitempty"`
+	Changes  json.RawMessage `json:"changes"`
+}
+
+type subjectErasureNote struct {
+	ID       int64     `json:"id"`
+	ErasedAt time.Time `json:"erasedAt"`
+	Ticket   string    `json:"ticket"`
+}
+
+// exportSubject gathers what we hold for hash.
+func exportSubject(db *sql.DB, hash string) (subjectExport, error) {
+	x := subjectExport{SSNHash: hash, ExportedAt: time.Now().UTC()}
+	err := eachRow(db, "ero_subject.records", func(rows *sql.Rows) error {
+		var r subjectRecord
+		var deleted sql.NullTime
+		var stored, personal []byte
+		if err := rows.Scan(&r.ID, &r.Role, &r.EFIN, &r.Company, &r.TaxYear, &r.Status, &r.Received, &deleted, &stored, &personal); err != nil {
+			return err
+		}
+		if deleted.Valid {
+			r.Deleted = &deleted.Time
+		}
+		if stored == nil || personal == nil {
+			x.Unreadable++
+		} else {
+			aead, err := subjectAEAD(stored)
+			if err != nil {
+				return err
+			}
+			if len(personal) < aead.NonceSize() {
+				return fmt.Errorf("record %d: %s details are truncated", r.ID, r.Role)
+			}
+			plain, err := aead.Open(nil, personal[:aead.NonceSize()], personal[aead.NonceSize():], []byte(hash+r.Role))
+			if err != nil {
+				return fmt.Errorf("record %d: decrypting %s details: %v", r.ID, r.Role, err)
+			}
+			r.Details = plain
+		}
+		x.Records = append(x.Records, r)
+		return nil
+	}, hash)
+	if err != nil {
+		return x, err
+	}
+	err = eachRow(db, "ero_subject.emails", func(rows *sql.Rows) error {
+		var m subjectEmail
+		var verified sql.NullTime
+		if err := rows.Scan(&m.RecordID, &m.Email, &m.Created, &verified); err != nil {
+			return err
+		}
+		if verified.Valid {
+			m.Verified = &verified.Time
+		}
+		x.Emails = append(x.Emails, m)
+		return nil
+	}, hash)
+	if err != nil {
+		return x, err
+	}
+	err = eachRow(db, "ero_subject.events", func(rows *sql.Rows) error {
+		var ev subjectEvent
+		var sent sql.NullTime
+		var payload string
+		if err := rows.Scan(&ev.RecordID, &ev.Type, &ev.Created, &sent, &payload); err != nil {
+			return err
+		}
+		if sent.Valid {
+			ev.Sent = &sent.Time
+		}
+		ev.Payload = json.RawMessage(payload)
+		x.Events = append(x.Events, ev)
+		return nil
+	}, hash)
+	if err != nil {
+		return x, err
+	}
+	err = eachRow(db, "ero_subject.edits", func(rows *sql.Rows) error {
+		var ed subjectEdit
+		var note sql.NullString
+		var changes string
+		if err := rows.Scan(&ed.RecordID, &ed.EditedBy, &ed.EditedAt, &note, &changes); err != nil {
+			return err
+		}
+		ed.Note, ed.Changes = note.String, json.RawMessage(changes)
+		x.Edits = append(x.Edits, ed)
+		return nil
+	}, hash)
+	if err != nil {
+		return x, err
+	}
+	err = eachRow(db, "subject_erasure.list", func(rows *sql.Rows) error {
+		var n subjectErasureNote
+		if err := rows.Scan(&n.ID, &n.ErasedAt, &n.Ticket); err != nil {
+			return err
+		}
+		x.Erasures = append(x.Erasures, n)
+		return nil
+	}, hash)
+	return x, err
+}
+
+// eachRow runs a catalog query and calls fn for each row, like
+// queryRows (canary.go) but returning the first error.
+func eachRow(db *sql.DB, name string, fn func(*sql.Rows) error, args ...interface{}) error {
+	stmt, err := prepare(db, name)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// subjectHold is a legal hold that stops an erasure.
+type subjectHold struct {
+	Kind, Value, Reason string
+}
+
+// subjectHolds returns the holds on the person or any of their EFINs.
+func subjectHolds(db *sql.DB, hash string) ([]subjectHold, error) {
+	var holds []subjectHold
+	err := eachRow(db, "legal_hold.subject", func(rows *sql.Rows) error {
+		var h subjectHold
+		if err := rows.Scan(&h.Kind, &h.Value, &h.Reason); err != nil {
+			return err
+		}
+		holds = append(holds, h)
+		return nil
+	}, hash, hash)
+	return holds, err
+}
+
+// erasureCounts is what an erasure touches, by table.
+type erasureCounts struct {
+	Records   int `json:"records"` // ero rows linked to the person (kept)
+	Keys      int `json:"keysDestroyed"`
+	Details   int `json:"detailsErased"`
+	Emails    int `json:"verificationEmailsBlanked"`
+	Events    int `json:"eventPayloadsBlanked"`
+	Edits     int `json:"editsBlanked"`
+	Sensitive int `json:"sensitiveErased,omitempty"` // ero_sensitive rows, with Always Encrypted
+}
+
+// erasureCertificate is what erase writes and keeps.
+type erasureCertificate struct {
+	ID       int64         `json:"id"`
+	SSNHash  string        `json:"ssnHash"`
+	Ticket   string        `json:"ticket"`
+	ErasedBy string        `json:"erasedBy"`
+	ErasedAt time.Time     `json:"erasedAt"`
+	Records  []int64       `json:"recordIds"`
+	Counts   erasureCounts `json:"counts"`
+	Retained []string      `json:"retained"`
+}
+
+// erasureRetained is what an erasure leaves, for the certificate.
+var erasureRetained = []string{
+	"ero rows (EFIN, company, tax year, status): the office's enrollment, kept for the bank",
+	"enrollment files in watch.done and watch.failed, until they age out",
+}
+
+// previewErasure counts what erasing hash would touch.
+func previewErasure(db *sql.DB, hash string) (erasureCounts, error) {
+	var c erasureCounts
+	stmt, err := prepare(db, "subject.erase_preview")
+	if err != nil {
+		return c, err
+	}
+	defer stmt.Close()
+	args := make([]interface{}, 6)
+	for i := range args {
+		args[i] = hash
+	}
+	err = stmt.QueryRow(args...).Scan(&c.Records, &c.Keys, &c.Details, &c.Emails, &c.Events, &c.Edits)
+	return c, err
+}
+
+// eraseSubject crypto-shreds hash in one transaction and returns the
+// certificate, with its ID in subject_erasure.
+func eraseSubject(db *sql.DB, hash, by, ticket string) (erasureCertificate, error) {
+	cert := erasureCertificate{SSNHash: hash, Ticket: ticket, ErasedBy: by, ErasedAt: time.Now().UTC(), Retained: erasureRetained}
+	holds, err := subjectHolds(db, hash)
+	if err != nil {
+		return cert, err
+	}
+	if len(holds) > 0 {
+		var held []string
+		for _, h := range holds {
+			held = append(held, fmt.Sprintf("%s %s (%s)", h.Kind, h.Value, h.Reason))
+		}
+		return cert, fmt.Errorf("under legal hold: %s", strings.Join(held, "; "))
+	}
+	err = eachRow(db, "ero_subject.ids", func(rows *sql.Rows) error {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		cert.Records = append(cert.Records, id)
+		return nil
+	}, hash)
+	if err != nil {
+		return cert, err
+	}
+	cert.Counts.Records = len(cert.Records)
+
+	level, err := isolationLevel(db)
+	if err != nil {
+		return cert, err
+	}
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: level})
+	if err != nil {
+		return cert, err
+	}
+	if err := eraseSubjectTx(tx, &cert); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return cert, fmt.Errorf("erasing: %v (and rollback failed: %v)", err, rbErr)
+		}
+		return cert, fmt.Errorf("erasing: %w", err)
+	}
+	return cert, tx.Commit()
+}
+
+func eraseSubjectTx(tx *sql.Tx, cert *erasureCertificate) error {
+	type step struct {
+		name string
+		args []interface{}
+		n    *int
+	}
+	steps := []step{
+		{"subject_key.erase", []interface{}{cert.ErasedAt, truncate(cert.ErasedBy, 100), cert.SSNHash}, &cert.Counts.Keys},
+		{"ero_subject.erase", []interface{}{cert.SSNHash}, &cert.Counts.Details},
+		{"email_verification.erase", []interface{}{cert.SSNHash}, &cert.Counts.Emails},
+		{"event_outbox.erase", []interface{}{cert.ErasedAt, cert.SSNHash}, &cert.Counts.Events},
+		{"enrollment_edit.erase", []interface{}{cert.SSNHash}, &cert.Counts.Edits},
+	}
+	if alwaysEncrypted() {
+		steps = append(steps, step{"ero_sensitive.erase", []interface{}{cert.SSNHash}, &cert.Counts.Sensitive})
+	}
+	for _, s := range steps {
+		n, err := execStatement(tx, s.name, s.args...)
+		if err != nil {
+			return err
+		}
+		*s.n = int(n)
+	}
+
+	body, err := json.Marshal(cert)
+	if err != nil {
+		return err
+	}
+	stmt, err := prepare(tx, "subject_erasure.add")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	return stmt.QueryRow(cert.SSNHash, cert.ErasedAt, truncate(cert.ErasedBy, 100), truncate(cert.Ticket, 100), string(body)).Scan(&cert.ID)
+}
+
+// writeCertificate writes cert to path (or privacy.certificates) and signs
+// it if there is a privacy.certificatekey. It returns the path.
+func writeCertificate(cert erasureCertificate, path string) (string, error) {
+	if path == "" {
+		dir := viper.GetString("privacy.certificates")
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return "", err
+		}
+		path = filepath.Join(dir, fmt.Sprintf("erasure-%d.json", cert.ID))
+	}
+	b, err := json.MarshalIndent(cert, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, append(b, '\n'), 0640); err != nil {
+		return "", err
+	}
+	if key := viper.GetString("privacy.certificatekey"); key != "" {
+		k, err := secretValue(key)
+		if err != nil {
+			return path, fmt.Errorf("config: privacy.certificatekey: %v", err)
+		}
+		return path, signFile(path, []byte(k))
+	}
+	return path, nil
+}
+
+var (
+	subjectHashFlag, subjectOut string
+	subjectTicket, subjectBy    string
+	subjectDryRun               bool
+)
+
+var subjectCmd = &cobra.Command{
+	Use:   "subject",
+	Short: "Export or erase what we hold about a person (GDPR/CCPA)",
+}
+
+var subjectHashCmd = &cobra.Command{
+	Use:   "hash",
+	Short: "Print the subject hash of an SSN read from stdin",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		key, err := ssnHashKey()
+		check(err)
+		if key == nil {
+			check(errNoSSNKey)
+		}
+		in := bufio.NewScanner(os.Stdin)
+		if !in.Scan() {
+			check(fmt.Errorf("no SSN on stdin"))
+		}
+		hash := ssnHash(key, in.Text())
+		if hash == "" {
+			check(fmt.Errorf("an SSN is nine digits"))
+		}
+		fmt.Println(hash)
+	},
+}
+
+var subjectExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export everything tied to a person",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		hash, err := parseSubjectHash("ssn-hash", subjectHashFlag)
+		check(err)
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		x, err := exportSubject(dbs.reader(), hash)
+		check(err)
+		b, err := json.MarshalIndent(x, "", "  ")
+		check(err)
+		if subjectOut == "" {
+			fmt.Println(string(b))
+			return
+		}
+		check(os.WriteFile(subjectOut, append(b, '\n'), 0600))
+		fmt.Printf("%d records, %d emails, %d events, %d edits written to %s\n", len(x.Records), len(x.Emails), len(x.Events), len(x.Edits), subjectOut)
+	},
+}
+
+var subjectEraseCmd = &cobra.Command{
+	Use:   "erase",
+	Short: "Crypto-shred everything tied to a person and write an erasure certificate",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		hash, err := parseSubjectHash("ssn-hash", subjectHashFlag)
+		check(err)
+		if strings.TrimSpace(subjectTicket) == "" {
+			check(fmt.Errorf("--ticket is required"))
+		}
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		c, err := previewErasure(dbs.primary, hash)
+		check(err)
+		fmt.Printf("%d records linked; %d keys to destroy, %d details, %d emails, %d event payloads, %d edits to erase\n",
+			c.Records, c.Keys, c.Details, c.Emails, c.Events, c.Edits)
+		if subjectDryRun {
+			holds, err := subjectHolds(dbs.primary, hash)
+			check(err)
+			for _, h := range holds {
+				fmt.Printf("held: %s %s (%s)\n", h.Kind, h.Value, h.Reason)
+			}
+			return
+		}
+
+		cert, err := eraseSubject(dbs.primary, hash, subjectBy, subjectTicket)
+		check(err)
+		path, err := writeCertificate(cert, subjectOut)
+		check(err)
+		fmt.Printf("Erasure %d by %s: certificate %s\n", cert.ID, subjectBy, path)
+	},
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{subjectExportCmd, subjectEraseCmd} {
+		cmd.Flags().StringVar(&subjectHashFlag, "ssn-hash", "", "the person's subject hash (see enroll subject hash)")
+		cmd.Flags().StringVar(&subjectOut, "out", "", "file to write")
+	}
+	subjectEraseCmd.Flags().StringVar(&subjectTicket, "ticket", "", "the data-subject request this is for")
+	subjectEraseCmd.Flags().StringVar(&subjectBy, "by", currentUser(), "who is erasing")
+	subjectEraseCmd.Flags().BoolVar(&subjectDryRun, "dry-run", false, "show what would be erased without erasing it")
+	subjectCmd.AddCommand(subjectHashCmd, subjectExportCmd, subjectEraseCmd)
+	rootCmd.AddCommand(subjectCmd)
+}
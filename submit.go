@@ -0,0 +1,211 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/dstroot/go_enrollment/enrollment"
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Vendors can submit a file over the API instead of SFTP:
+//
+//	POST /v1/files?name=ERO20160104.xml    (body: the XML, CSV or JSON file)
+//
+// The file is saved to server.spooldir, so it can be replayed like any
+// other, and loaded as a batch. The response is the batch summary.
+//
+// Submissions must be authenticated (see auth.go), and a client can only
+// submit records for its own transmitter.
+//
+// An upload can be no bigger than input.maxbytes, the most we would load
+// (records.go). server.maxupload can lower that for the API alone; 0, the
+// default, leaves it at input.maxbytes.
+func init() {
+	viper.SetDefault("server.spooldir", "./inbox")
+	viper.SetDefault("server.maxupload", 0)
+}
+
+// maxUpload is the most an upload may be, or 0 for no limit.
+func maxUpload() int64 {
+	max, upload := viper.GetInt64("input.maxbytes"), viper.GetInt64("server.maxupload")
+	if upload > 0 && (max <= 0 || upload < max) {
+		return upload
+	}
+	return max
+}
+
+// submitResult is the response to a submission.
+type submitResult struct {
+	Batch    int64 `json:"batch"`
+	Loaded   int   `json:"loaded"`
+	Rejected int   `json:"rejected"`
+
+	Deactivated   int                  `json:"deactivated"`
+	Repeated      int                  `json:"repeated"`                // loaded lately already (see recent.go)
+	AlreadyLoaded bool                 `json:"alreadyLoaded,omitempty"` // the file was, by Batch (see ledger.go)
+	Correlation   string               `json:"correlationId"`
+	Confirmations []submitConfirmation `json:"confirmations"`
+}
+
+// submitConfirmation is the confirmation number of one accepted record.
+type submitConfirmation struct {
+	Index        int    `json:"index"`
+	EFIN         string `json:"efin"`
+	ID           int64  `json:"id"`
+	Confirmation string `json:"confirmation"`
+}
+
+func registerSubmitRoutes(mux *http.ServeMux, dbs *databases, limits *rateLimiter) {
+	mux.HandleFunc("/v1/files", authorized(limits, func(w http.ResponseWriter, r *http.Request, identity string) {
+		if r.Method != http.MethodPost {
+			httpError(w, http.StatusMethodNotAllowed, "use POST")
+			return
+		}
+
+		over, wait, err := overQuota(dbs.reader(), identity)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if over {
+			tooManyRequests(w, wait, "daily file quota reached")
+			return
+		}
+
+		name := filepath.Base(r.URL.Query().Get("name"))
+		if name == "." || name == "/" || !isInputName(name) {
+			httpError(w, http.StatusBadRequest, "name must be the file name, ending .xml, .csv or .json")
+			return
+		}
+
+		body := r.Body
+		if max := maxUpload(); max > 0 {
+			body = http.MaxBytesReader(w, body, max)
+		}
+		path, err := spoolUpload(body, identity, name)
+		var overMax *http.MaxBytesError
+		if errors.As(err, &overMax) {
+			httpError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("%s: too large: more than the limit of %d bytes", name, overMax.Limit))
+			return
+		}
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// A file too big, that we can't read or whose header doesn't
+		// match is the client's mistake; records for someone else's
+		// transmitter are forbidden.
+		f, err := readInputFile(path)
+		var tooLarge *tooLargeError
+		var mismatch *enrollment.HeaderError
+		switch {
+		case errors.As(err, &tooLarge):
+			os.Remove(path)
+			httpError(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		case errors.As(err, &mismatch), errors.Is(err, errNoHeader):
+			os.Remove(path)
+			httpError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		case err != nil:
+			os.Remove(path)
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := authorizeFile(f, identity); err != nil {
+			os.Remove(path)
+			httpError(w, http.StatusForbidden, err.Error())
+			return
+		}
+
+		job := &batchJob{File: f, Correlation: r.Header.Get(correlationHeader)}
+		summary, err := loadFile(dbs, job)
+		var already *alreadyLoadedError
+		if errors.As(err, &already) {
+			// Sent again: the answer is the batch that loaded it (see
+			// ledger.go).
+			os.Remove(path)
+			b := already.Batch
+			writeJSON(w, http.StatusOK, submitResult{Batch: b.ID, Loaded: b.Loaded, Rejected: b.Rejected, Correlation: b.Correlation,
+				AlreadyLoaded: true, Confirmations: []submitConfirmation{}})
+			return
+		}
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		result := submitResult{Batch: job.ID, Loaded: len(summary.Loaded), Rejected: len(summary.Rejected), Correlation: job.Correlation,
+			Deactivated:   len(summary.Deactivated),
+			Repeated:      len(summary.Repeated),
+			Confirmations: []submitConfirmation{}}
+		for _, l := range summary.Loaded {
+			if l.Confirmation != "" {
+				result.Confirmations = append(result.Confirmations, submitConfirmation{Index: l.Index, EFIN: l.EFIN, ID: l.ID, Confirmation: l.Confirmation})
+			}
+		}
+		writeJSON(w, http.StatusOK, result)
+	}))
+}
+
+// spoolUpload saves an uploaded file as <spooldir>/<transmitter>/<name>.
+func spoolUpload(body io.Reader, transmitter, name string) (string, error) {
+	dir := filepath.Join(viper.GetString("server.spooldir"), transmitter)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, name)
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if os.IsExist(err) {
+		return "", fmt.Errorf("%s has already been submitted", name)
+	}
+	if err != nil {
+		return "", err
+	}
+	// Encrypted at rest if storage.key is set (see atrest.go).
+	b, err := io.ReadAll(body)
+	if err == nil {
+		b, err = seal(b)
+	}
+	if err == nil {
+		_, err = out.Write(b)
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(path)
+		return "", err
+	}
+	return path, out.Close()
+}
+
+// authorizeFile checks that every record in the file belongs to the
+// submitting transmitter.
+func authorizeFile(f inputFile, transmitter string) error {
+	for i, e := range f.Records {
+		if e.TransmitterID != transmitter {
+			return fmt.Errorf("record %d is for transmitter %q; you may only submit for %s", i, e.TransmitterID, transmitter)
+		}
+	}
+	return nil
+}
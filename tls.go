@@ -0,0 +1,92 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"crypto/tls" // https://golang.org/pkg/crypto/tls/
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// "enroll serve" speaks HTTPS when server.tls.cert and server.tls.key are
+// set. Setting server.tls.clientca as well turns on mutual TLS: every
+// client must present a certificate issued by that CA (our internal CA),
+// and the certificate's CN says who the client is.
+//
+// server.tls.clients maps CNs to transmitter IDs, e.g.
+//
+//	"clients": {"acme-tax-uploader": "98765"}
+//
+// A client whose CN maps to a transmitter may submit files for that
+// transmitter only. CNs are matched case-insensitively.
+func init() {
+	viper.SetDefault("server.tls.cert", "")
+	viper.SetDefault("server.tls.key", "")
+	viper.SetDefault("server.tls.clientca", "")
+}
+
+// serverTLSConfig builds the listener's TLS config, or returns nil if the
+// server is to run plain HTTP.
+func serverTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := viper.GetString("server.tls.cert"), viper.GetString("server.tls.key")
+	caFile := viper.GetString("server.tls.clientca")
+	if certFile == "" && keyFile == "" {
+		if caFile != "" {
+			return nil, errors.New("config: server.tls.clientca needs server.tls.cert and server.tls.key")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("config: server.tls.cert/key: %v", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("config: server.tls.clientca: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("config: server.tls.clientca: no certificates in %s", caFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// certTransmitter returns the transmitter the request's client certificate
+// is mapped to, or "" if there is no certificate or no mapping.
+func certTransmitter(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	cn := r.TLS.PeerCertificates[0].Subject.CommonName
+	// viper lower-cases map keys.
+	return viper.GetStringMapString("server.tls.clients")[strings.ToLower(cn)]
+}
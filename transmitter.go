@@ -0,0 +1,400 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Taking on a new software vendor used to be a page of steps on the wiki.
+//
+//	enroll transmitter add --id 98765 --name VendorX --sftp acks@sftp.vendorx.com/outbound --profile strict
+//
+// does them:
+//
+//   - adds the transmitter to the transmitter reference list, as a new
+//     version in effect now (see refdataload.go)
+//   - writes its settings to transmitters.dir/<id>.json: its file and
+//     record limits (quota.go), SLA cutoff (sla.go), delivery calendar
+//     (calendar.go), return-file delivery over SFTP (delivery.go), ACK
+//     language (messages.go) and ACK signing key (signing.go), and an API
+//     key (auth.go)
+//   - makes transmitters.secrets/<id>/ for the SFTP private key and the
+//     vendor's known_hosts, which are left for us to put there
+//
+// The API key and ACK signing key are made up on the spot and printed
+// once, to hand to the vendor; only the API key's SHA-256 is kept.
+//
+// Its keys can be moved into the database afterwards with "enroll
+// transmitter creds" (credentials.go).
+//
+// Every file in transmitters.dir is read after the config file and
+// merged over it, and the server.apikeys in them are added to the
+// config's. "enroll serve" reads them when it starts.
+//
+// A profile is the settings a kind of vendor starts with. Two are built
+// in, and transmitters.profiles.<name> adds more or replaces them:
+//
+//	standard  the watch.limits defaults, no calendar, ACKs unsigned
+//	strict    one file at a time and 600 records a minute, files
+//	          expected weekdays at 09:00 with an hour's grace, a 15:00
+//	          SLA cutoff, and signed ACKs
+func init() {
+	viper.SetDefault("transmitters.dir", "./config/transmitters")
+	viper.SetDefault("transmitters.secrets", "./secrets/transmitters")
+	viper.SetDefault("transmitters.profiles", map[string]interface{}{})
+}
+
+// transmitterProfile is a transmitters.profiles entry.
+type transmitterProfile struct {
+	MaxFiles         int      `mapstructure:"maxfiles"`         // 0 = watch.limits.maxfiles
+	RecordsPerMinute int      `mapstructure:"recordsperminute"` // 0 = watch.limits.recordsperminute
+	Cutoff           string   `mapstructure:"cutoff"`           // "" = sla.cutoff
+	Days             []string `mapstructure:"days"`
+	Times            []string `mapstructure:"times"` // none = no calendar
+	Grace            string   `mapstructure:"grace"`
+	SignAcks         bool     `mapstructure:"signacks"`
+}
+
+var builtinTransmitterProfiles = map[string]transmitterProfile{
+	"standard": {},
+	"strict": {MaxFiles: 1, RecordsPerMinute: 600, Cutoff: "15:00",
+		Days: []string{"mon", "tue", "wed", "thu", "fri"}, Times: []string{"09:00"}, Grace: "1h", SignAcks: true},
+}
+
+// transmitterProfileNamed is the profile called name.
+func transmitterProfileNamed(name string) (transmitterProfile, error) {
+	var configured map[string]transmitterProfile
+	if err := viper.UnmarshalKey("transmitters.profiles", &configured); err != nil {
+		return transmitterProfile{}, fmt.Errorf("config: transmitters.profiles: %v", err)
+	}
+	p, ok := configured[strings.ToLower(name)]
+	if !ok {
+		if p, ok = builtinTransmitterProfiles[strings.ToLower(name)]; !ok {
+			return p, fmt.Errorf("unknown profile %q", name)
+		}
+	}
+	if p.Cutoff != "" {
+		if _, err := time.Parse("15:04", p.Cutoff); err != nil {
+			return p, fmt.Errorf("profile %s: bad cutoff %q", name, p.Cutoff)
+		}
+	}
+	for _, d := range p.Days {
+		day := strings.ToLower(d)
+		if len(day) > 3 {
+			day = day[:3] // "Monday" as well as "mon", as in calendar.go
+		}
+		if _, ok := weekdays[day]; !ok {
+			return p, fmt.Errorf("profile %s: unknown day %q", name, d)
+		}
+	}
+	for _, t := range p.Times {
+		if _, err := time.Parse("15:04", t); err != nil {
+			return p, fmt.Errorf("profile %s: bad time %q", name, t)
+		}
+	}
+	if p.Grace != "" {
+		if _, err := time.ParseDuration(p.Grace); err != nil {
+			return p, fmt.Errorf("profile %s: grace: %v", name, err)
+		}
+	}
+	return p, nil
+}
+
+// mergeTransmitterConfigs merges the files in transmitters.dir over the
+// config, in name order.
+func mergeTransmitterConfigs() error {
+	paths, err := filepath.Glob(filepath.Join(viper.GetString("transmitters.dir"), "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		cfg := viper.New()
+		cfg.SetConfigFile(path)
+		if err := cfg.ReadInConfig(); err != nil {
+			return fmt.Errorf("config: %s: %v", path, err)
+		}
+		// Merging replaces lists rather than adding to them.
+		keys, _ := viper.Get("server.apikeys").([]interface{})
+		more, _ := cfg.Get("server.apikeys").([]interface{})
+		if err := viper.MergeConfigMap(cfg.AllSettings()); err != nil {
+			return fmt.Errorf("config: %s: %v", path, err)
+		}
+		if len(more) > 0 {
+			viper.Set("server.apikeys", append(keys, more...))
+		}
+	}
+	return nil
+}
+
+// transmitterSFTP reads --sftp: [sftp://]user@host[:port][/dir].
+func transmitterSFTP(s string) (map[string]interface{}, error) {
+	if !strings.Contains(s, "://") {
+		s = "sftp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "sftp" || u.User == nil || u.User.Username() == "" || u.Hostname() == "" {
+		return nil, fmt.Errorf("--sftp must be user@host[:port][/dir] (got %q)", s)
+	}
+	if _, ok := u.User.Password(); ok {
+		return nil, fmt.Errorf("--sftp: we log in with a key, not a password")
+	}
+	target := map[string]interface{}{
+		"type": "sftp",
+		"host": u.Hostname(),
+		"user": u.User.Username(),
+		"dir":  strings.TrimPrefix(u.Path, "/"),
+	}
+	if p := u.Port(); p != "" {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("--sftp: bad port %q", p)
+		}
+		target["port"] = port
+	}
+	return target, nil
+}
+
+// newTransmitterSecret is a random key, in hex.
+func newTransmitterSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// transmitterOnboarding is what "enroll transmitter add" sets up.
+type transmitterOnboarding struct {
+	ID, Name string
+	Profile  string
+	Config   map[string]interface{} // the transmitters.dir file
+	Path     string                 // where it goes
+	Secrets  string                 // the directory for the SFTP key
+	APIKey   string
+	AckKey   string // none unless the profile signs ACKs
+}
+
+// planTransmitter works out the settings for a new transmitter.
+func planTransmitter(id, name, profile, sftp, language string) (*transmitterOnboarding, error) {
+	p, err := transmitterProfileNamed(profile)
+	if err != nil {
+		return nil, err
+	}
+	o := &transmitterOnboarding{ID: id, Name: name, Profile: profile,
+		Path:    filepath.Join(viper.GetString("transmitters.dir"), id+".json"),
+		Secrets: filepath.Join(viper.GetString("transmitters.secrets"), id),
+	}
+	if o.APIKey, err = newTransmitterSecret(); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(o.APIKey))
+
+	// Each section holds just this transmitter's entry.
+	section := func(v interface{}) map[string]interface{} {
+		return map[string]interface{}{"transmitters": map[string]interface{}{id: v}}
+	}
+	o.Config = map[string]interface{}{
+		"server": map[string]interface{}{"apikeys": []interface{}{
+			map[string]interface{}{"name": name, "sha256": hex.EncodeToString(sum[:]), "transmitter": id},
+		}},
+	}
+	limits := map[string]interface{}{}
+	if p.MaxFiles > 0 {
+		limits["maxfiles"] = p.MaxFiles
+	}
+	if p.RecordsPerMinute > 0 {
+		limits["recordsperminute"] = p.RecordsPerMinute
+	}
+	if len(limits) > 0 {
+		o.Config["watch"] = section(limits)
+	}
+	if p.Cutoff != "" {
+		o.Config["sla"] = section(map[string]interface{}{"cutoff": p.Cutoff})
+	}
+	if len(p.Times) > 0 {
+		cal := map[string]interface{}{"days": p.Days, "times": p.Times}
+		if p.Grace != "" {
+			cal["grace"] = p.Grace
+		}
+		o.Config["calendar"] = section(cal)
+	}
+	if sftp != "" {
+		target, err := transmitterSFTP(sftp)
+		if err != nil {
+			return nil, err
+		}
+		target["keyfile"] = filepath.Join(o.Secrets, "id_ed25519")
+		target["knownhosts"] = filepath.Join(o.Secrets, "known_hosts")
+		o.Config["delivery"] = section(target)
+	}
+	if language != "" {
+		o.Config["messages"] = section(strings.ToLower(language))
+	}
+	if p.SignAcks {
+		if o.AckKey, err = newTransmitterSecret(); err != nil {
+			return nil, err
+		}
+		o.Config["signing"] = section(map[string]interface{}{"ackkey": o.AckKey})
+	}
+	return o, nil
+}
+
+// writeTransmitterConfig writes the transmitter's settings file and makes
+// its secrets directory. The file holds keys, so only we can read it.
+func writeTransmitterConfig(o *transmitterOnboarding) error {
+	b, err := json.MarshalIndent(o.Config, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(o.Path), 0750); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(o.Secrets, 0700); err != nil {
+		return err
+	}
+	tmp := o.Path + ".new"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, o.Path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------
+// enroll transmitter add
+
+var (
+	transmitterID          string
+	transmitterName        string
+	transmitterSFTPFlag    string
+	transmitterProfileName string
+	transmitterLang        string
+	transmitterDryRun      bool
+	transmitterForce       bool
+)
+
+var transmitterCmd = &cobra.Command{
+	Use:   "transmitter",
+	Short: "Take on software vendors",
+}
+
+var transmitterAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Set up everything needed to accept files from a new transmitter",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		id, name := strings.TrimSpace(transmitterID), strings.TrimSpace(transmitterName)
+		if id == "" || name == "" {
+			check(fmt.Errorf("--id and --name are required"))
+		}
+		l, err := refListNamed("transmitters")
+		check(err)
+		if problem := l.Check(id); problem != "" {
+			check(fmt.Errorf("--id %s %s", id, problem))
+		}
+		// It becomes a config key, so no dots.
+		if strings.IndexFunc(id, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' }) >= 0 {
+			check(fmt.Errorf("--id may only have letters, digits, - and _ (got %q)", id))
+		}
+		o, err := planTransmitter(id, name, transmitterProfileName, transmitterSFTPFlag, transmitterLang)
+		check(err)
+		if _, err := os.Stat(o.Path); err == nil && !transmitterForce {
+			check(fmt.Errorf("%s already exists (use --force to replace it)", o.Path))
+		}
+
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		// The reference list first: if writing the file fails, running
+		// this again finds the transmitter already on the list.
+		latest, err := maxRefVersion(dbs.primary, l)
+		check(err)
+		rows, err := readRefVersion(dbs.primary, l, latest)
+		check(err)
+		listed, onList := rows[id]
+		switch {
+		case onList && listed != name && !transmitterForce:
+			check(fmt.Errorf("transmitter %s is already on the list as %q (use --force to rename it)", id, listed))
+		case onList && listed == name:
+			fmt.Printf("Transmitter %s is already on the transmitter list (version %d)\n", id, latest)
+		case transmitterDryRun:
+			fmt.Printf("Would add transmitter %s (%s) to the transmitter list as version %d\n", id, name, latest+1)
+		default:
+			rows[id] = name
+			version, err := storeRefVersion(dbs.primary, l, rows, time.Now(), "enroll transmitter add", currentUser())
+			check(err)
+			fmt.Printf("Added transmitter %s (%s) to the transmitter list: version %d, in effect now\n", id, name, version)
+		}
+
+		if transmitterDryRun {
+			sections := make([]string, 0, len(o.Config))
+			for k := range o.Config {
+				sections = append(sections, k)
+			}
+			sort.Strings(sections)
+			fmt.Printf("Would write %s (profile %s) with settings for: %s\n", o.Path, o.Profile, strings.Join(sections, ", "))
+			return
+		}
+		check(writeTransmitterConfig(o))
+		fmt.Printf("Wrote %s (profile %s)\n", o.Path, o.Profile)
+
+		fmt.Println()
+		fmt.Println("Give these to the vendor; they aren't shown again:")
+		fmt.Printf("  API key:           %s\n", o.APIKey)
+		if o.AckKey != "" {
+			fmt.Printf("  ACK signing key:   %s\n", o.AckKey)
+		}
+		fmt.Println()
+		fmt.Println("Still to do:")
+		if _, ok := o.Config["delivery"]; ok {
+			fmt.Printf("  - put our SFTP private key in %s\n", filepath.Join(o.Secrets, "id_ed25519"))
+			fmt.Printf("  - put the vendor's SFTP host key in %s\n", filepath.Join(o.Secrets, "known_hosts"))
+		}
+		fmt.Println("  - restart enroll serve to pick up the new settings")
+	},
+}
+
+func init() {
+	transmitterAddCmd.Flags().StringVar(&transmitterID, "id", "", "transmitter ID, as in the files' TransmitterID")
+	transmitterAddCmd.Flags().StringVar(&transmitterName, "name", "", "the vendor's name")
+	transmitterAddCmd.Flags().StringVar(&transmitterSFTPFlag, "sftp", "", "where return files go: user@host[:port][/dir]")
+	transmitterAddCmd.Flags().StringVar(&transmitterProfileName, "profile", "standard", "the settings to start with: standard, strict or one in transmitters.profiles")
+	transmitterAddCmd.Flags().StringVar(&transmitterLang, "language", "", "language of its ACK files (default messages.language)")
+	transmitterAddCmd.Flags().BoolVar(&transmitterDryRun, "dry-run", false, "show what would be set up without changing anything")
+	transmitterAddCmd.Flags().BoolVar(&transmitterForce, "force", false, "replace an existing settings file, or rename a listed transmitter")
+	transmitterCmd.AddCommand(transmitterAddCmd)
+	rootCmd.AddCommand(transmitterCmd)
+}
@@ -0,0 +1,478 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml" // https://golang.org/pkg/encoding/xml/
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// "enroll triage --batch N" pages through the records a batch rejected,
+// with their errors next to the fields they are about, lets one fix them
+// and loads the fixed records again, instead of sending a spreadsheet of
+// rejects around. The rejects and their errors come from the batch's ACK
+// (ack.go) or, if there is none, from checking its file again.
+//
+// At the prompt:
+//
+//	n, p           next and previous reject
+//	set FIELD VAL  set a field, e.g. "set OfficeInfo.State TX"
+//	fix            apply the suggested fixes (trimmed spaces, upper-case
+//	               states, digits-only EFINs, values cut to their limit)
+//	check          check the record again against the rules now
+//	drop           don't resubmit this record after all
+//	list           every reject and what has been done with it
+//	submit         load the edited records as a new batch
+//	quit           leave without loading anything
+//
+// An edited record is checked again straight away. The records to
+// resubmit are written to triage.dir (so they can be replayed like any
+// file) and loaded as a batch that replays the original, which keeps them
+// out of the SLA reports as a new arrival would not.
+
+func init() {
+	viper.SetDefault("triage.dir", "./triage")
+}
+
+var triageBatch int64
+
+// triageRecord is a rejected record being triaged.
+type triageRecord struct {
+	Index  int
+	Record Enrollment
+	Errors []recordError // from the ACK, then from the last check
+	Edited bool          // to be resubmitted
+}
+
+type triageSession struct {
+	db      preparer
+	job     *batchJob // the original file, checked as a trial
+	records []*triageRecord
+	at      int
+	in      *bufio.Scanner
+	out     io.Writer
+}
+
+var triageCmd = &cobra.Command{
+	Use:   "triage",
+	Short: "Page through a batch's rejects, fix them and load them again",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if triageBatch == 0 {
+			check(fmt.Errorf("--batch is required"))
+		}
+		check(requireStorageKey()) // fixed files are written for loading (see atrest.go)
+		dbs, err := openDatabases()
+		check(err)
+		defer dbs.Close()
+
+		orig, err := getBatch(dbs.primary, triageBatch)
+		check(err)
+		f, err := readInputFile(orig.FileName)
+		check(err)
+		if f.SHA256 != orig.SHA256 {
+			check(fmt.Errorf("%s has changed since batch %d was loaded (sha256 %s, was %s)", orig.FileName, orig.ID, f.SHA256, orig.SHA256))
+		}
+
+		job := &batchJob{File: f, Trial: true}
+		versions, err := currentRefVersions(dbs.reader())
+		check(err)
+		check(loadPolicies(viper.GetViper(), dbs.primary, dbs.reader(), job, versions))
+
+		t := &triageSession{db: dbs.reader(), job: job, in: bufio.NewScanner(os.Stdin), out: os.Stdout}
+		check(t.findRejects(orig))
+		if len(t.records) == 0 {
+			fmt.Printf("Batch %d has no rejected records.\n", orig.ID)
+			return
+		}
+		if !t.run() {
+			return
+		}
+
+		path, err := t.write(orig)
+		check(err)
+		resubmit, err := readInputFile(path)
+		check(err)
+		fmt.Printf("Loading %d record(s) from %s\n", len(resubmit.Records), path)
+		summary, err := loadFile(dbs, &batchJob{File: resubmit, ReplayOf: orig.ID})
+		check(err)
+		summary.print()
+	},
+}
+
+func init() {
+	triageCmd.Flags().Int64Var(&triageBatch, "batch", 0, "batch whose rejects to go through")
+	rootCmd.AddCommand(triageCmd)
+}
+
+// findRejects reads the batch's rejects from its ACK, or by checking its
+// records again if the ACK isn't there.
+func (t *triageSession) findRejects(b batchInfo) error {
+	name := strings.TrimSuffix(filepath.Base(b.FileName), filepath.Ext(b.FileName))
+	content, err := os.ReadFile(filepath.Join(viper.GetString("ack.dir"), fmt.Sprintf("%s.%d.ack.xml", name, b.ID)))
+	if err == nil {
+		var ack ackFile
+		if err := xml.Unmarshal(content, &ack); err != nil {
+			return fmt.Errorf("ACK for batch %d: %v", b.ID, err)
+		}
+		for _, r := range ack.Records {
+			if r.Status != ackRejected || r.Index >= len(t.job.File.Records) {
+				continue
+			}
+			tr := &triageRecord{Index: r.Index, Record: t.job.File.Records[r.Index]}
+			for _, e := range r.Errors {
+				tr.Errors = append(tr.Errors, recordError{Code: e.Code, Field: e.Field, Message: e.Message})
+			}
+			t.records = append(t.records, tr)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	fmt.Fprintf(t.out, "No ACK for batch %d; checking its records again.\n", b.ID)
+	for i, e := range t.job.File.Records {
+		if recordAction(e) != actionEnroll {
+			continue
+		}
+		tr := &triageRecord{Index: i, Record: e}
+		if err := t.check(tr); err != nil {
+			return err
+		}
+		if len(tr.Errors) > 0 {
+			t.records = append(t.records, tr)
+		}
+	}
+	return nil
+}
+
+// check checks r again and keeps what it finds.
+func (t *triageSession) check(r *triageRecord) error {
+	e := r.Record
+	c, err := t.job.checkRecord(t.db, r.Index, &e)
+	if err != nil {
+		return err
+	}
+	r.Errors = c.Problems
+	return nil
+}
+
+// run is the prompt. It returns true if the edited records are to be
+// loaded.
+func (t *triageSession) run() bool {
+	t.show()
+	for {
+		fmt.Fprint(t.out, "triage> ")
+		if !t.in.Scan() {
+			fmt.Fprintln(t.out)
+			return false
+		}
+		fields := strings.Fields(t.in.Text())
+		cmd := ""
+		if len(fields) > 0 {
+			cmd = fields[0]
+		}
+		r := t.records[t.at]
+
+		switch cmd {
+		case "", "n", "next":
+			if t.at < len(t.records)-1 {
+				t.at++
+			}
+			t.show()
+		case "p", "prev":
+			if t.at > 0 {
+				t.at--
+			}
+			t.show()
+		case "set":
+			if len(fields) < 2 {
+				fmt.Fprintln(t.out, "usage: set FIELD VALUE")
+				continue
+			}
+			line := strings.TrimSpace(t.in.Text())
+			value := strings.TrimSpace(strings.TrimSpace(line[len(cmd):])[len(fields[1]):])
+			if err := t.set(r, fields[1], value); err != nil {
+				fmt.Fprintln(t.out, err)
+				continue
+			}
+			t.recheck(r)
+		case "fix":
+			n := 0
+			for _, e := range r.Errors {
+				if v, ok := t.suggest(r.Record, e); ok {
+					if t.set(r, e.Field, v) == nil {
+						n++
+					}
+				}
+			}
+			if n == 0 {
+				fmt.Fprintln(t.out, "Nothing to fix automatically.")
+				continue
+			}
+			t.recheck(r)
+		case "check":
+			t.recheck(r)
+		case "drop":
+			r.Edited = false
+			fmt.Fprintf(t.out, "Record %d won't be resubmitted.\n", r.Index)
+		case "list":
+			t.list()
+		case "submit":
+			n := t.edited()
+			if n == 0 {
+				fmt.Fprintln(t.out, "No records have been edited.")
+				continue
+			}
+			if t.confirm(fmt.Sprintf("Load %d edited record(s) as a new batch?", n)) {
+				return true
+			}
+		case "q", "quit":
+			if t.edited() == 0 || t.confirm("Leave without loading the edited records?") {
+				return false
+			}
+		default:
+			fmt.Fprintln(t.out, "n, p, set FIELD VALUE, fix, check, drop, list, submit or quit")
+		}
+	}
+}
+
+func (t *triageSession) show() {
+	r := t.records[t.at]
+	e := r.Record
+	fmt.Fprintf(t.out, "\nReject %d of %d: record %d, EFIN %s, %s", t.at+1, len(t.records), r.Index, e.EFIN, e.OfficeInfo.OfficeName)
+	if r.Edited {
+		fmt.Fprint(t.out, " (edited)")
+	}
+	fmt.Fprintln(t.out)
+	if len(r.Errors) == 0 {
+		fmt.Fprintln(t.out, "  passes the rules now")
+	}
+	for _, err := range r.Errors {
+		if err.Field == "" {
+			fmt.Fprintf(t.out, "  %s: %s\n", err.Code, err.Message)
+			continue
+		}
+		v, _ := fieldValue(e, err.Field)
+		fmt.Fprintf(t.out, "  %s = %q\n      %s: %s\n", err.Field, v, err.Code, err.Message)
+		if s, ok := t.suggest(e, err); ok {
+			fmt.Fprintf(t.out, "      fix: %q\n", s)
+		}
+	}
+}
+
+func (t *triageSession) list() {
+	for i, r := range t.records {
+		state := "rejected"
+		switch {
+		case r.Edited && len(r.Errors) == 0:
+			state = "fixed"
+		case r.Edited:
+			state = "edited, still failing"
+		}
+		var codes []string
+		for _, e := range r.Errors {
+			codes = append(codes, e.Code)
+		}
+		fmt.Fprintf(t.out, "%3d  record %-5d EFIN %-6s  %-22s %s\n", i+1, r.Index, r.Record.EFIN, state, strings.Join(codes, ", "))
+	}
+}
+
+func (t *triageSession) recheck(r *triageRecord) {
+	if err := t.check(r); err != nil {
+		fmt.Fprintf(t.out, "checking record %d: %v\n", r.Index, err)
+		return
+	}
+	t.show()
+}
+
+// set sets a field of r, which marks it for resubmitting.
+func (t *triageSession) set(r *triageRecord, field, value string) error {
+	path, err := setField(&r.Record, field, value)
+	if err != nil {
+		return err
+	}
+	if present := t.job.File.present(r.Index); present != nil {
+		present[path] = true
+	}
+	r.Edited = true
+	return nil
+}
+
+// suggest is the obvious fix for an error, if there is one.
+func (t *triageSession) suggest(e Enrollment, err recordError) (string, bool) {
+	if err.Field == "" {
+		return "", false
+	}
+	v, ok := fieldValue(e, err.Field)
+	if !ok {
+		return "", false
+	}
+	fixed := strings.TrimSpace(v)
+	switch {
+	case strings.HasSuffix(err.Field, "State"):
+		fixed = strings.ToUpper(fixed)
+	case err.Field == "EFIN" || err.Field == "MasterEfin":
+		fixed = strings.Map(func(r rune) rune {
+			if r >= '0' && r <= '9' {
+				return r
+			}
+			return -1
+		}, fixed)
+	}
+	if err.Code == errFieldTooLong {
+		rules := t.job.rulesFor(e)
+		if max := rules.Lengths.max[err.Field]; max > 0 && len([]rune(fixed)) > max {
+			fixed = string([]rune(fixed)[:max])
+		}
+	}
+	return fixed, fixed != v
+}
+
+func (t *triageSession) edited() int {
+	n := 0
+	for _, r := range t.records {
+		if r.Edited {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *triageSession) confirm(question string) bool {
+	fmt.Fprintf(t.out, "%s [y/N] ", question)
+	if !t.in.Scan() {
+		return false
+	}
+	return strings.EqualFold(strings.TrimSpace(t.in.Text()), "y")
+}
+
+// write saves the edited records as a file in triage.dir and returns its
+// path.
+func (t *triageSession) write(b batchInfo) (string, error) {
+	var records []Enrollment
+	var present []fieldSet
+	for _, r := range t.records {
+		if r.Edited {
+			records = append(records, r.Record)
+			present = append(present, t.job.File.present(r.Index))
+		}
+	}
+
+	dir := viper.GetString("triage.dir")
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+	name := strings.TrimSuffix(filepath.Base(b.FileName), filepath.Ext(b.FileName))
+	path := filepath.Join(dir, fmt.Sprintf("%s.triage-%d-%s.xml", name, b.ID, time.Now().Format("20060102150405")))
+	content, err := encodeRecords(records, present)
+	if err != nil {
+		return "", err
+	}
+	return path, writeSealed(path, content, 0640) // see atrest.go
+}
+
+// encodeRecords writes records as an enrollment file. Each record only
+// has the elements it had when it arrived (and those set since), so a
+// partial amendment is still partial (see amend.go).
+func encodeRecords(records []Enrollment, present []fieldSet) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+
+	root := xml.StartElement{Name: xml.Name{Local: "EnrollmentCollection"}}
+	if err := enc.EncodeToken(root); err != nil {
+		return nil, err
+	}
+	for i, e := range records {
+		start := xml.StartElement{Name: xml.Name{Local: "Enrollment"}}
+		if e.Action != "" {
+			start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "action"}, Value: e.Action})
+		}
+		if e.Reason != "" {
+			start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "reason"}, Value: e.Reason})
+		}
+		if err := encodeFields(enc, start, reflect.ValueOf(e), "", present[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := enc.EncodeToken(root.End()); err != nil {
+		return nil, err
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
+
+// encodeFields writes v as the element start, with the fields under
+// prefix that present has.
+func encodeFields(enc *xml.Encoder, start xml.StartElement, v reflect.Value, prefix string, present fieldSet) error {
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("xml")
+		if strings.HasSuffix(tag, ",attr") {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		path := prefix + f.Name
+		elem := xml.StartElement{Name: xml.Name{Local: name}}
+
+		if f.Type.Kind() == reflect.Struct {
+			if !sectionPresent(present, path) {
+				continue
+			}
+			if err := encodeFields(enc, elem, v.Field(i), path+".", present); err != nil {
+				return err
+			}
+			continue
+		}
+		if !present.has(path) {
+			continue
+		}
+		if err := enc.EncodeElement(fmt.Sprint(v.Field(i).Interface()), elem); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+func sectionPresent(present fieldSet, section string) bool {
+	for _, leaf := range leafFields {
+		if strings.HasPrefix(leaf, section+".") && present.has(leaf) {
+			return true
+		}
+	}
+	return false
+}
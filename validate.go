@@ -0,0 +1,94 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/dstroot/go_enrollment/enrollment"
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// Field validation from the `valid` tags on the Valid* structs is the
+// enrollment package's (enrollment.Validate, which has the generated
+// validators); validateFields reports what it finds as FIELD_INVALID.
+// validation.policy says what that does to the record:
+//
+//	"validation": {"policy": "warn"}
+//
+// "reject" rejects it; "warn" (the default) loads it with the problems
+// as warnings in the ACK; "off" skips the check. Look at what warn
+// reports before choosing reject. Like the other policies it can differ
+// between rule versions.
+func init() {
+	viper.SetDefault("validation.policy", validationWarn)
+}
+
+// What a record failing a valid tag gets.
+const (
+	validationReject = "reject"
+	validationWarn   = "warn"
+	validationOff    = "off"
+)
+
+const errFieldInvalid = "FIELD_INVALID"
+
+// loadValidationPolicy reads validation.policy.
+func loadValidationPolicy(cfg *viper.Viper) (string, error) {
+	switch policy := cfg.GetString("validation.policy"); policy {
+	case validationReject, validationWarn, validationOff:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("config: validation.policy must be %s, %s or %s (got %q)", validationReject, validationWarn, validationOff, policy)
+	}
+}
+
+// validateFields checks e against the valid tags.
+func validateFields(e Enrollment) ([]recordError, error) {
+	result, err := enrollment.Validate(e)
+	if err != nil {
+		return nil, err
+	}
+	var problems []recordError
+	for _, fe := range result.Errors {
+		r := recordError{Field: fe.Field, Code: errFieldInvalid, Message: fe.Message}
+		if fe.Rule != "" {
+			r.Args = map[string]string{"rule": fe.Rule}
+		}
+		problems = append(problems, r)
+	}
+	return problems, nil
+}
+
+// transactionDateProblem is the problem with a record whose date, s,
+// doesn't parse: what the TransactionDate tag says of it.
+func transactionDateProblem(s string) recordError {
+	rule, msg := "date", "TransactionDate is not a valid date"
+	if s == "" {
+		rule, msg = "required", "TransactionDate is required"
+	}
+	return recordError{Field: "TransactionDate", Code: errFieldInvalid, Message: msg, Args: map[string]string{"rule": rule}}
+}
+
+// hasProblem reports whether problems has one with field.
+func hasProblem(problems []recordError, field string) bool {
+	for _, p := range problems {
+		if p.Field == field {
+			return true
+		}
+	}
+	return false
+}
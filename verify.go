@@ -0,0 +1,365 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql" // https://golang.org/pkg/database/sql/
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// When verification.url is set, each enrollment we accept gets a random
+// token and our email service is asked to send the office (OfficeInfo
+// Email) a confirm-your-enrollment message with a link to
+// <server.publicurl>/v1/verify?token=<token>. Following the link shows a
+// page with a Confirm button; submitting it marks the enrollment's email
+// verified (ero.EMAIL_VERIFIED_AT, shown as emailVerified by
+// GET /v1/enrollments). The button is there because mail scanners open
+// links: a GET never verifies anything.
+//
+// Tokens are queued in the email_verification table
+// (sql/024_email_verification.sql) in the same transaction as the record,
+// held for records that go to review until they are approved, and sent by
+// "enroll serve" every verification.interval: one POST per message to
+// verification.url with verification.apikey as a bearer token. A token is
+// good for verification.ttl (72h) from when it is sent. If the email
+// service is down we try again next round; a message it refuses is
+// retried up to verification.maxattempts (10) times.
+func init() {
+	viper.SetDefault("verification.timeout", "30s")
+	viper.SetDefault("verification.interval", "1m")
+	viper.SetDefault("verification.batchsize", 100)
+	viper.SetDefault("verification.maxattempts", 10)
+	viper.SetDefault("verification.ttl", "72h")
+}
+
+func verificationEnabled() bool {
+	return viper.GetString("verification.url") != ""
+}
+
+// hashToken is how a token is stored and looked up.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newVerificationToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand doesn't fail on supported platforms
+	}
+	return hex.EncodeToString(b)
+}
+
+// queueVerification gives a record we just wrote a verification token,
+// if it has an email address. held is for records going to review.
+func queueVerification(p preparer, id int64, e Enrollment, held bool) error {
+	email := strings.TrimSpace(e.OfficeInfo.Email)
+	if !verificationEnabled() || email == "" {
+		return nil
+	}
+	token := newVerificationToken()
+
+	stmt, err := prepare(p, "email_verification.add")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(hashToken(token), token, id, email, held, time.Now())
+	return err
+}
+
+// releaseVerification releases (approve) or drops the token held for a
+// record decided in review.
+func releaseVerification(db *sql.DB, id int64, approve bool) error {
+	if !verificationEnabled() {
+		return nil
+	}
+	name := "email_verification.drop"
+	if approve {
+		name = "email_verification.release"
+	}
+	_, err := execStatement(db, name, id)
+	return err
+}
+
+// verificationEmail is what we ask the email service to send.
+type verificationEmail struct {
+	To           string    `json:"to"`
+	EnrollmentID int64     `json:"enrollmentId"`
+	EFIN         string    `json:"efin"`
+	Company      string    `json:"company"`
+	Confirmation string    `json:"confirmation,omitempty"`
+	Link         string    `json:"link"`
+	Expires      time.Time `json:"expiresAt"`
+
+	hash, token string
+}
+
+// verificationSender sends queued tokens to the email service.
+type verificationSender struct {
+	db          *sql.DB
+	url, apikey string
+	link        string
+	client      *http.Client
+	interval    time.Duration
+	ttl         time.Duration
+	batchSize   int
+	maxAttempts int
+}
+
+func newVerificationSender(db *sql.DB) (*verificationSender, error) {
+	public := strings.TrimRight(viper.GetString("server.publicurl"), "/")
+	if public == "" {
+		return nil, errors.New("config: verification needs server.publicurl for its links")
+	}
+	durations := map[string]time.Duration{}
+	for _, key := range []string{"verification.timeout", "verification.interval", "verification.ttl"} {
+		d, err := configDuration(key)
+		if err != nil {
+			return nil, err
+		}
+		durations[key] = d
+	}
+	apikey, err := secretValue(viper.GetString("verification.apikey"))
+	if err != nil {
+		return nil, fmt.Errorf("config: verification.apikey: %v", err)
+	}
+
+	return &verificationSender{
+		db:          db,
+		url:         viper.GetString("verification.url"),
+		apikey:      apikey,
+		link:        public + "/v1/verify",
+		client:      &http.Client{Timeout: durations["verification.timeout"]},
+		interval:    durations["verification.interval"],
+		ttl:         durations["verification.ttl"],
+		batchSize:   viper.GetInt("verification.batchsize"),
+		maxAttempts: viper.GetInt("verification.maxattempts"),
+	}, nil
+}
+
+// run sends queued messages every interval until stop is closed.
+func (s *verificationSender) run(stop <-chan struct{}) {
+	log.Printf("Sending verification emails through %s\n", s.url)
+	for {
+		s.flush()
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(s.interval):
+		}
+	}
+}
+
+// flush sends what is queued, a batch at a time, until the service is
+// unavailable.
+func (s *verificationSender) flush() {
+	for {
+		queued, err := s.next()
+		if err != nil {
+			log.Printf("reading email verifications: %v", err)
+			return
+		}
+		if len(queued) == 0 {
+			return
+		}
+
+		for _, m := range queued {
+			err := s.send(m)
+			switch {
+			case err == nil:
+				metricCount("verification.sent", 1, tag("status", "sent"))
+				if _, err := execStatement(s.db, "email_verification.sent", time.Now().UTC(), m.hash); err != nil {
+					log.Printf("recording verification email for record %d sent: %v", m.EnrollmentID, err)
+				}
+			case isAPIOutage(err):
+				metricCount("verification.sent", 1, tag("status", "unavailable"))
+				log.Printf("email service: %v", err)
+				return
+			default:
+				metricCount("verification.sent", 1, tag("status", "refused"))
+				log.Printf("email service refused the verification email for record %d: %v", m.EnrollmentID, err)
+				if _, err := execStatement(s.db, "email_verification.failed", truncate(err.Error(), 1000), m.hash); err != nil {
+					log.Printf("recording verification email for record %d refused: %v", m.EnrollmentID, err)
+				}
+			}
+		}
+		if len(queued) < s.batchSize {
+			return
+		}
+	}
+}
+
+func (s *verificationSender) next() ([]verificationEmail, error) {
+	stmt, err := prepare(s.db, "email_verification.next")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(s.batchSize, s.maxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var queued []verificationEmail
+	for rows.Next() {
+		var m verificationEmail
+		if err := rows.Scan(&m.hash, &m.token, &m.EnrollmentID, &m.To, &m.EFIN, &m.Company, &m.Confirmation); err != nil {
+			return nil, err
+		}
+		queued = append(queued, m)
+	}
+	return queued, rows.Err()
+}
+
+func (s *verificationSender) send(m verificationEmail) error {
+	m.Link = s.link + "?token=" + url.QueryEscape(m.token)
+	m.Expires = time.Now().Add(s.ttl).UTC()
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "verify-"+m.hash[:16])
+	if s.apikey != "" {
+		req.Header.Set("Authorization", "Bearer "+s.apikey)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return &callError{API: "email service", Status: resp.StatusCode, Text: resp.Status}
+	}
+	return nil
+}
+
+// verifyEmail marks the enrollment with this token email-verified. It
+// reports false for a token we don't know, one that has expired or one
+// whose record is no longer active.
+func verifyEmail(db *sql.DB, token string) (bool, error) {
+	ttl, err := configDuration("verification.ttl")
+	if err != nil {
+		return false, err
+	}
+	now := time.Now().UTC()
+	args := []interface{}{now, hashToken(token), now.Add(-ttl)}
+	if !viper.GetBool("mssql.storedprocedures") {
+		args = append(args, now) // for the ero UPDATE
+	}
+
+	stmt, err := prepare(db, "email_verification.verify")
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	var id int64
+	switch err := stmt.QueryRow(args...).Scan(&id); err {
+	case nil:
+		metricCount("verification.verified", 1)
+		return true, nil
+	case sql.ErrNoRows:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+var verifyPage = template.Must(template.New("verify").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Confirm your enrollment</title></head>
+<body>
+{{if .Token}}<form method="post" action="/v1/verify">
+<p>Confirm the email address for your enrollment.</p>
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Confirm</button>
+</form>{{else}}<p>{{.Message}}</p>{{end}}
+</body></html>
+`))
+
+// registerVerifyRoutes adds /v1/verify, the link in verification emails.
+// It needs no credentials - the token is one - but is rate limited per
+// client address.
+func registerVerifyRoutes(mux *http.ServeMux, dbs *databases, limits *rateLimiter) {
+	if !verificationEnabled() {
+		return
+	}
+	mux.HandleFunc("/v1/verify", func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if ok, wait := limits.allow("verify:" + host); !ok {
+			tooManyRequests(w, wait, "rate limit exceeded")
+			return
+		}
+
+		page := struct{ Token, Message string }{}
+		status := http.StatusOK
+		switch r.Method {
+		case http.MethodGet:
+			page.Token = r.URL.Query().Get("token")
+			if page.Token == "" {
+				status, page.Message = http.StatusBadRequest, "This link is incomplete."
+			}
+		case http.MethodPost:
+			ok, err := verifyEmail(dbs.primary, r.FormValue("token"))
+			switch {
+			case err != nil:
+				log.Printf("verifying an email address: %v", err)
+				status, page.Message = http.StatusInternalServerError, "Something went wrong. Please try again later."
+			case !ok:
+				status, page.Message = http.StatusNotFound, "This link is invalid or has expired."
+			default:
+				page.Message = "Thank you. Your email address is confirmed."
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			httpError(w, http.StatusMethodNotAllowed, "use GET or POST")
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		if err := verifyPage.Execute(w, page); err != nil {
+			log.Printf("writing response: %v", err)
+		}
+	})
+}
@@ -0,0 +1,530 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// When watch.enabled is set, "enroll serve" also watches the SFTP inbox
+// and loads each file that lands there, oldest first, up to watch.workers
+// at a time (see quota.go for the per-transmitter limits). Loaded files
+// are moved to watch.done; files that fail are moved to watch.failed,
+// from where an operator can requeue them (see admin.go).
+func init() {
+	viper.SetDefault("watch.enabled", false)
+	viper.SetDefault("watch.inbox", "./inbox")
+	viper.SetDefault("watch.done", "./inbox/done")
+	viper.SetDefault("watch.failed", "./inbox/failed")
+	viper.SetDefault("watch.interval", "30s")
+	viper.SetDefault("watch.draintimeout", "10m")
+}
+
+// watcher is the inbox loop.
+type watcher struct {
+	dbs                 *databases
+	inbox, done, failed string
+	quarantine          string
+	interval            time.Duration
+	lanes               *priorities
+	calendar            *calendarWatch
+	spool               *offlineSpool // nil unless offline.enabled
+	quotas              *transmitterQuotas
+	workers             int
+
+	mu         sync.Mutex
+	paused     bool
+	loading    map[string]loadingFile // files being loaded, by name
+	duplicates map[string]bool        // requeued to load even if they repeat a batch (see duplicates.go)
+	wake       chan struct{}
+}
+
+// loadingFile is a file a worker is loading.
+type loadingFile struct {
+	sha     string
+	started time.Time
+	paged   bool // we've reported it stuck
+}
+
+// watcherStatus is what the admin API reports about the watcher.
+type watcherStatus struct {
+	Paused  bool     `json:"paused"`
+	Idle    bool     `json:"idle"` // not loading anything right now
+	Loading []string `json:"loading"`
+	Depth   int      `json:"depth"`
+	Urgent  int      `json:"urgent"` // how many of Queue, at the front, are urgent
+	Queue   []string `json:"queue"`
+}
+
+func newWatcher(dbs *databases) (*watcher, error) {
+	interval, err := time.ParseDuration(viper.GetString("watch.interval"))
+	if err != nil {
+		return nil, fmt.Errorf("config: watch.interval: %v", err)
+	}
+
+	lanes, err := newPriorities()
+	if err != nil {
+		return nil, err
+	}
+	calendars, err := loadCalendars()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &watcher{
+		dbs:        dbs,
+		lanes:      lanes,
+		calendar:   &calendarWatch{calendars: calendars, paged: map[string]time.Time{}},
+		quotas:     newTransmitterQuotas(),
+		workers:    viper.GetInt("watch.workers"),
+		loading:    map[string]loadingFile{},
+		duplicates: map[string]bool{},
+		inbox:      viper.GetString("watch.inbox"),
+		done:       viper.GetString("watch.done"),
+		failed:     viper.GetString("watch.failed"),
+		quarantine: viper.GetString("watch.quarantine"),
+		interval:   interval,
+		wake:       make(chan struct{}, 1),
+	}
+	if w.workers < 1 {
+		w.workers = 1
+	}
+	if viper.GetBool("offline.enabled") {
+		if w.spool, err = openOfflineSpool(); err != nil {
+			return nil, err
+		}
+	}
+	for _, dir := range []string{w.inbox, w.done, w.failed, w.quarantine} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// run loads queued files until stop is closed.
+func (w *watcher) run(stop <-chan struct{}) {
+	log.Printf("Watching %s (%d workers)\n", w.inbox, w.workers)
+	retryEvery, err := time.ParseDuration(viper.GetString("delivery.retryevery"))
+	if err != nil {
+		log.Printf("config: delivery.retryevery: %v; not retrying deliveries", err)
+	}
+	lastRetry := time.Now()
+	deadlineEvery, err := time.ParseDuration(viper.GetString("sla.record.checkevery"))
+	if err != nil {
+		log.Printf("config: sla.record.checkevery: %v; not checking record deadlines", err)
+	}
+	var lastDeadlines time.Time
+	calendarEvery, err := time.ParseDuration(viper.GetString("calendar.checkevery"))
+	if err != nil {
+		log.Printf("config: calendar.checkevery: %v; not checking delivery calendars", err)
+	}
+	var lastCalendar time.Time
+
+	for {
+		if !w.isPaused() {
+			w.dispatch()
+		}
+		w.checkStuck()
+		w.gauges()
+		if dbIsDown() {
+			// Nothing else may be talking to it; see if it's back.
+			if err := w.dbs.primary.Ping(); err != nil {
+				dbDown(err)
+			} else {
+				dbUp()
+			}
+		}
+		if w.spool != nil && !w.isPaused() && !dbIsDown() && w.spool.len() > 0 {
+			go w.flushSpool() // see offline.go
+		}
+		if retryEvery > 0 && time.Since(lastRetry) >= retryEvery {
+			lastRetry = time.Now()
+			if _, err := retryDeliveries(w.dbs.primary); err != nil {
+				log.Printf("retrying deliveries: %v", err)
+			}
+		}
+		if deadlineEvery > 0 && time.Since(lastDeadlines) >= deadlineEvery {
+			lastDeadlines = time.Now()
+			checkDeadlines(w.dbs.reader())
+		}
+		if calendarEvery > 0 && len(w.calendar.calendars) > 0 && time.Since(lastCalendar) >= calendarEvery {
+			lastCalendar = time.Now()
+			w.calendar.check(w.dbs.reader(), lastCalendar)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-w.wake:
+		case <-time.After(w.interval):
+		}
+	}
+}
+
+// dispatch starts loading queued files, in queue order, while there are
+// free workers. It skips files whose transmitter is at its limit and
+// files another instance has claimed.
+func (w *watcher) dispatch() {
+	queue, _, err := w.queue()
+	if err != nil {
+		log.Printf("reading %s: %v", w.inbox, err)
+		return
+	}
+
+	for _, name := range queue {
+		w.mu.Lock()
+		_, busy := w.loading[name]
+		full := len(w.loading) >= w.workers
+		w.mu.Unlock()
+		if full || w.isPaused() {
+			return
+		}
+		if busy {
+			continue
+		}
+
+		transmitter := w.lanes.scan(w.inbox, name).transmitter
+		if !w.quotas.startFile(transmitter) {
+			continue
+		}
+		if !w.start(name, transmitter) {
+			w.quotas.doneFile(transmitter)
+		}
+	}
+}
+
+// start claims a file and loads it in the background. It returns false,
+// leaving the file be, if the file has gone or another instance has it.
+func (w *watcher) start(name, transmitter string) bool {
+	path := filepath.Join(w.inbox, name)
+	f, err := readInputFile(path)
+	if os.IsNotExist(err) {
+		return false // another instance finished it
+	}
+
+	// The claim is held until the file has been moved, so the other
+	// instance can't pick it up in between.
+	var claim *fileClaim
+	if err == nil {
+		claim, err = claimFile(w.dbs.primary, f)
+		if errors.Is(err, errClaimed) {
+			if debug {
+				log.Println(err)
+			}
+			return false
+		}
+	}
+
+	w.mu.Lock()
+	w.loading[name] = loadingFile{sha: f.SHA256, started: time.Now()}
+	w.mu.Unlock()
+
+	go func() {
+		defer w.poke() // a worker is free
+		defer w.quotas.doneFile(transmitter)
+		defer func() {
+			w.mu.Lock()
+			delete(w.loading, name)
+			w.mu.Unlock()
+		}()
+		defer claim.release()
+		w.process(name, f, err, claim)
+	}()
+	return true
+}
+
+// gauges reports the queue depth and how many files are loading.
+func (w *watcher) gauges() {
+	queue, urgent, err := w.queue()
+	if err != nil {
+		return
+	}
+	w.mu.Lock()
+	loading := len(w.loading)
+	w.mu.Unlock()
+	metricGauge("watch.queue", len(queue)-loading)
+	metricGauge("watch.urgent", urgent)
+	metricGauge("watch.loading", loading)
+}
+
+// checkStuck pages for files that have been loading too long. The
+// incident is resolved when the file finishes (see fileIncidents).
+func (w *watcher) checkStuck() {
+	after, err := time.ParseDuration(viper.GetString("incidents.stuckafter"))
+	if err != nil || after <= 0 {
+		return
+	}
+
+	w.mu.Lock()
+	stuck := map[string]loadingFile{}
+	for name, l := range w.loading {
+		if !l.paged && time.Since(l.started) > after {
+			l.paged = true
+			w.loading[name] = l
+			stuck[name] = l
+		}
+	}
+	w.mu.Unlock()
+
+	for name, l := range stuck {
+		triggerIncident(fileIncidentKey(l.sha), fmt.Sprintf("enroll: %s has been loading for %s", name, time.Since(l.started).Round(time.Minute)),
+			map[string]interface{}{"file": name, "started": l.started.Format(time.RFC3339)})
+	}
+}
+
+// process loads one file and files it under done or failed (or, if it
+// can't be decoded, quarantine). readErr is the error, if any, from
+// reading it.
+func (w *watcher) process(name string, f inputFile, readErr error, claim *fileClaim) {
+	path := filepath.Join(w.inbox, name)
+	var undecodable *decodeError
+	if errors.As(readErr, &undecodable) {
+		if err := w.quarantineFile(name, undecodable); err != nil {
+			log.Printf("quarantining %s: %v; pausing", name, err)
+			w.pause()
+		}
+		w.lanes.forget(name)
+		return
+	}
+	dest := w.done
+	err := readErr
+	job := &batchJob{File: f, Claim: claim, Pace: w.quotas.pacer(f.Transmitter()), Correlation: fileCorrelation(f)}
+	w.mu.Lock()
+	job.AllowDuplicate = w.duplicates[name]
+	delete(w.duplicates, name)
+	w.mu.Unlock()
+	if err == nil {
+		checkArrival(w.calendar.calendars, f)
+		var summary loadSummary
+		summary, err = loadFile(w.dbs, job)
+		var already *alreadyLoadedError
+		if errors.As(err, &already) { // see ledger.go
+			job.logf("%s %v; nothing to do\n", name, err)
+			err = nil
+		}
+		summary.print()
+	}
+	if errors.Is(err, errClaimed) {
+		// Another instance took the file over mid-load; it's theirs to move.
+		job.logf("%s: %v\n", name, err)
+		w.lanes.forget(name)
+		return
+	}
+	if w.spool != nil && isOffline(err) && f.SHA256 != "" {
+		if serr := w.spool.add(f, job.Correlation, err); serr != nil {
+			log.Printf("spooling %s: %v", name, serr)
+		} else {
+			job.logf("%s spooled for when the database is back: %v", name, err)
+			metricGauge("offline.spooled", w.spool.len())
+			err = nil
+		}
+	}
+	if err != nil {
+		job.logf("%s failed: %v", name, err)
+		dest = w.failed
+	}
+	if err := os.Rename(path, filepath.Join(dest, name)); err != nil {
+		// Leaving it would load it again and again; stop instead.
+		log.Printf("moving %s to %s: %v; pausing", name, dest, err)
+		w.pause()
+	} else if err := sealFile(filepath.Join(dest, name)); err != nil { // see atrest.go
+		log.Printf("encrypting %s: %v", filepath.Join(dest, name), err)
+	}
+	w.lanes.forget(name)
+}
+
+// queue lists the files waiting in the inbox in the order we'll load
+// them: urgent files, then the rest, oldest first in each lane. It also
+// returns how many are urgent.
+func (w *watcher) queue() ([]string, int, error) {
+	files, err := xmlFiles(w.inbox)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var urgent, bulk []string
+	for _, name := range files {
+		if w.lanes.urgent(w.inbox, name) {
+			urgent = append(urgent, name)
+		} else {
+			bulk = append(bulk, name)
+		}
+	}
+	return append(urgent, bulk...), len(urgent), nil
+}
+
+// isInputName reports whether a file in the inbox is one to load:
+// *.xml, *.csv or *.json, maybe gzipped (*.xml.gz).
+func isInputName(name string) bool {
+	switch filepath.Ext(strings.TrimSuffix(strings.ToLower(name), ".gz")) {
+	case ".xml", ".csv", ".json":
+		return true
+	}
+	return false
+}
+
+func xmlFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type file struct {
+		name string
+		mod  time.Time
+	}
+	var files []file
+	for _, e := range entries {
+		if e.IsDir() || !isInputName(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue // gone since we listed it
+		}
+		files = append(files, file{e.Name(), info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].mod.Before(files[j].mod) })
+
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = f.name
+	}
+	return names, nil
+}
+
+func (w *watcher) isPaused() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.paused
+}
+
+// pause stops the watcher starting new files; those loading finish.
+func (w *watcher) pause() {
+	w.mu.Lock()
+	w.paused = true
+	w.mu.Unlock()
+}
+
+func (w *watcher) resume() {
+	w.mu.Lock()
+	w.paused = false
+	w.mu.Unlock()
+	w.poke()
+}
+
+// drain pauses the watcher and waits for the files in progress to finish.
+// Once it returns nil nothing is being loaded, so it is safe to stop.
+func (w *watcher) drain(ctx context.Context) error {
+	w.pause()
+	tick := time.NewTicker(200 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		w.mu.Lock()
+		idle := len(w.loading) == 0
+		w.mu.Unlock()
+		if idle {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
+
+// poke makes the watcher look at the inbox now.
+func (w *watcher) poke() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+var errNotFailed = errors.New("no such file in the failed directory")
+
+// requeue moves a failed file back into the inbox, in the urgent lane
+// if asked. With duplicate it is loaded even if it repeats an earlier
+// batch (see duplicates.go).
+func (w *watcher) requeue(name string, urgent, duplicate bool) error {
+	name = filepath.Base(name)
+	from := filepath.Join(w.failed, name)
+	if _, err := os.Stat(from); err != nil {
+		return errNotFailed
+	}
+	if urgent {
+		w.lanes.bump(name)
+	}
+	if duplicate {
+		w.mu.Lock()
+		w.duplicates[name] = true
+		w.mu.Unlock()
+	}
+	if err := os.Rename(from, filepath.Join(w.inbox, name)); err != nil {
+		w.lanes.forget(name)
+		w.mu.Lock()
+		delete(w.duplicates, name)
+		w.mu.Unlock()
+		return err
+	}
+	w.poke()
+	return nil
+}
+
+func (w *watcher) status() (watcherStatus, error) {
+	queue, urgent, err := w.queue()
+	if err != nil {
+		return watcherStatus{}, err
+	}
+	if queue == nil {
+		queue = []string{}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	loading := []string{}
+	for name := range w.loading {
+		loading = append(loading, name)
+	}
+	sort.Strings(loading)
+
+	// Files being loaded are still in the inbox; they aren't queued.
+	waiting, waitingUrgent := []string{}, 0
+	for i, name := range queue {
+		if _, ok := w.loading[name]; ok {
+			continue
+		}
+		waiting = append(waiting, name)
+		if i < urgent {
+			waitingUrgent++
+		}
+	}
+	return watcherStatus{Paused: w.paused, Idle: len(loading) == 0, Loading: loading, Depth: len(waiting), Urgent: waitingUrgent, Queue: waiting}, nil
+}
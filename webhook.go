@@ -0,0 +1,183 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// When a file finishes we POST a JSON summary to each configured webhook,
+// so partner portals can show status without polling us:
+//
+//	"webhooks": [
+//	  {"url": "https://portal.example.com/enroll/callback", "secret": "..."}
+//	]
+//
+// The secret may be a secret reference (secrets.go).
+//
+// Each request is signed. X-Enroll-Timestamp is the Unix time we sent it
+// and X-Enroll-Signature is "sha256=" + hex(HMAC-SHA256(secret,
+// timestamp + "." + body)). Receivers should recompute the signature and
+// refuse requests whose timestamp is more than a few minutes old.
+//
+// Only https URLs are called. Delivery is retried as the "api" retry
+// policy says (see retry.go); a webhook that keeps failing is logged, it
+// never fails the load.
+func init() {
+	viper.SetDefault("server.publicurl", "")
+}
+
+type webhook struct {
+	URL    string `mapstructure:"url"`
+	Secret string `mapstructure:"secret"`
+}
+
+// webhookPayload is the body we send.
+type webhookPayload struct {
+	Event       string            `json:"event"`
+	Batch       int64             `json:"batch"`
+	File        string            `json:"file"`
+	SHA256      string            `json:"sha256"`
+	Transmitter string            `json:"transmitter"`
+	Status      string            `json:"status"`
+	Counts      webhookCounts     `json:"counts"`
+	Links       map[string]string `json:"links,omitempty"`
+	Finished    time.Time         `json:"finished"`
+	Correlation string            `json:"correlationId"`
+}
+
+type webhookCounts struct {
+	Records  int `json:"records"`
+	Loaded   int `json:"loaded"`
+	Pending  int `json:"pending"`
+	Rejected int `json:"rejected"`
+
+	Deactivated int `json:"deactivated"`
+}
+
+func newWebhookPayload(job *batchJob, status string, summary loadSummary) webhookPayload {
+	p := webhookPayload{
+		Event:       "file.completed",
+		Batch:       job.ID,
+		File:        job.File.Path,
+		SHA256:      job.File.SHA256,
+		Transmitter: job.File.Transmitter(),
+		Status:      status,
+		Counts: webhookCounts{
+			Records:  len(job.File.Records),
+			Loaded:   len(summary.Loaded),
+			Rejected: len(summary.Rejected),
+
+			Deactivated: len(summary.Deactivated),
+		},
+		Finished:    time.Now(),
+		Correlation: job.Correlation,
+	}
+	for _, r := range summary.Loaded {
+		if r.Flagged != "" {
+			p.Counts.Pending++
+		}
+	}
+
+	// Links only make sense if the API is reachable from outside.
+	if base := strings.TrimRight(viper.GetString("server.publicurl"), "/"); base != "" {
+		p.Links = map[string]string{
+			"batch": fmt.Sprintf("%s/v1/batches/%d", base, job.ID),
+		}
+	}
+	return p
+}
+
+// signWebhook returns the signature header value for a body.
+func signWebhook(secret, timestamp string, body []byte) string {
+	return hmacSignature([]byte(secret), []byte(timestamp), []byte("."), body)
+}
+
+// notifyWebhooks sends the completion payload to every configured hook.
+func notifyWebhooks(job *batchJob, status string, summary loadSummary) {
+	var hooks []webhook
+	if err := viper.UnmarshalKey("webhooks", &hooks); err != nil {
+		log.Printf("config: webhooks: %v", err)
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(newWebhookPayload(job, status, summary))
+	if err != nil {
+		job.logf("webhook payload for batch %d: %v", job.ID, err)
+		return
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, h := range hooks {
+		secret, err := secretValue(h.Secret)
+		if err != nil {
+			job.logf("config: webhook %s: secret: %v", h.URL, err)
+			continue
+		}
+		h.Secret = secret
+		if err := deliverWebhook(client, h, body); err != nil {
+			job.logf("webhook %s for batch %d: %v", h.URL, job.ID, err)
+		}
+	}
+}
+
+func deliverWebhook(client *http.Client, h webhook, body []byte) error {
+	u, err := url.Parse(h.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("refusing to call a non-https webhook")
+	}
+
+	return retrying("api", "calling webhook "+h.URL, func() error { return postWebhook(client, h, body) })
+}
+
+func postWebhook(client *http.Client, h webhook, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Enroll-Timestamp", timestamp)
+	req.Header.Set("X-Enroll-Signature", signWebhook(h.Secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
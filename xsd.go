@@ -0,0 +1,278 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/xml" // https://golang.org/pkg/encoding/xml/
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A small XSD reader: enough of XML Schema to get the element tree of a
+// partner's enrollment schema - elements (inline, by type or by ref),
+// named and anonymous complex types with sequence/all/choice and
+// complexContent extension, and simple types with their restrictions.
+// It is not a validator.
+
+// xsdElement is one element in the tree.
+type xsdElement struct {
+	Name     string
+	Type     string // built-in simple type, e.g. "string", "boolean"; "" if complex
+	Min      int    // minOccurs
+	Many     bool   // maxOccurs > 1 or unbounded
+	Doc      string // xs:documentation
+	Children []*xsdElement
+
+	// Restrictions on a simple type.
+	MaxLength int
+	MinLength int
+	Pattern   string
+	Enum      []string
+}
+
+// xsdNode is the raw XML.
+type xsdNode struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Children []xsdNode  `xml:",any"`
+	Text     string     `xml:",chardata"`
+}
+
+func (n xsdNode) attr(name string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// local strips a namespace prefix ("xs:string" -> "string").
+func local(name string) string {
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+type xsdSchema struct {
+	elements     map[string]xsdNode // global elements
+	complexTypes map[string]xsdNode
+	simpleTypes  map[string]xsdNode
+	order        []string // global element names, in file order
+}
+
+// parseXSD reads a schema and returns its global elements, expanded.
+func parseXSD(r io.Reader) ([]*xsdElement, error) {
+	var root xsdNode
+	if err := xml.NewDecoder(r).Decode(&root); err != nil {
+		return nil, err
+	}
+	if root.XMLName.Local != "schema" {
+		return nil, fmt.Errorf("not an XML schema (root element is %s)", root.XMLName.Local)
+	}
+
+	s := &xsdSchema{elements: map[string]xsdNode{}, complexTypes: map[string]xsdNode{}, simpleTypes: map[string]xsdNode{}}
+	for _, n := range root.Children {
+		name := n.attr("name")
+		switch n.XMLName.Local {
+		case "element":
+			s.elements[name] = n
+			s.order = append(s.order, name)
+		case "complexType":
+			s.complexTypes[name] = n
+		case "simpleType":
+			s.simpleTypes[name] = n
+		}
+	}
+
+	var elems []*xsdElement
+	for _, name := range s.order {
+		e, err := s.element(s.elements[name], 0)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, e)
+	}
+	return elems, nil
+}
+
+// Deeper than this is a recursive schema; enrollment files aren't.
+const xsdMaxDepth = 20
+
+func (s *xsdSchema) element(n xsdNode, depth int) (*xsdElement, error) {
+	if depth > xsdMaxDepth {
+		return nil, fmt.Errorf("element %s: schema nests too deep (recursive type?)", n.attr("name"))
+	}
+	if ref := n.attr("ref"); ref != "" {
+		g, ok := s.elements[local(ref)]
+		if !ok {
+			return nil, fmt.Errorf("element ref %s: no such element", ref)
+		}
+		e, err := s.element(g, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		e.Min, e.Many = occurs(n)
+		return e, nil
+	}
+
+	e := &xsdElement{Name: n.attr("name"), Doc: documentation(n)}
+	e.Min, e.Many = occurs(n)
+
+	if t := n.attr("type"); t != "" {
+		return e, s.applyType(e, local(t), depth)
+	}
+	for _, c := range n.Children {
+		switch c.XMLName.Local {
+		case "complexType":
+			return e, s.complex(e, c, depth)
+		case "simpleType":
+			s.simple(e, c, depth)
+			return e, nil
+		}
+	}
+	e.Type = "string" // no type at all is anyType; treat it as text
+	return e, nil
+}
+
+// applyType fills in e from a named type.
+func (s *xsdSchema) applyType(e *xsdElement, name string, depth int) error {
+	if ct, ok := s.complexTypes[name]; ok {
+		return s.complex(e, ct, depth)
+	}
+	if st, ok := s.simpleTypes[name]; ok {
+		s.simple(e, st, depth)
+		return nil
+	}
+	e.Type = name // built in
+	return nil
+}
+
+// complex adds a complex type's child elements to e.
+func (s *xsdSchema) complex(e *xsdElement, n xsdNode, depth int) error {
+	for _, c := range n.Children {
+		switch c.XMLName.Local {
+		case "sequence", "all", "choice":
+			if err := s.particles(e, c, depth, c.XMLName.Local == "choice"); err != nil {
+				return err
+			}
+		case "complexContent":
+			for _, ext := range c.Children {
+				if ext.XMLName.Local != "extension" && ext.XMLName.Local != "restriction" {
+					continue
+				}
+				if base := ext.attr("base"); base != "" && ext.XMLName.Local == "extension" {
+					if err := s.applyType(e, local(base), depth+1); err != nil {
+						return err
+					}
+				}
+				if err := s.complex(e, ext, depth+1); err != nil {
+					return err
+				}
+			}
+		case "simpleContent":
+			e.Type = "string"
+		}
+	}
+	return nil
+}
+
+// particles adds the elements of a sequence, all or choice to e. The
+// elements of a choice are all optional.
+func (s *xsdSchema) particles(e *xsdElement, n xsdNode, depth int, choice bool) error {
+	for _, c := range n.Children {
+		switch c.XMLName.Local {
+		case "element":
+			child, err := s.element(c, depth+1)
+			if err != nil {
+				return err
+			}
+			if choice {
+				child.Min = 0
+			}
+			e.Children = append(e.Children, child)
+		case "sequence", "all", "choice":
+			if err := s.particles(e, c, depth, choice || c.XMLName.Local == "choice"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// simple fills in a simple type: its base and restrictions.
+func (s *xsdSchema) simple(e *xsdElement, n xsdNode, depth int) {
+	for _, c := range n.Children {
+		if c.XMLName.Local != "restriction" {
+			continue
+		}
+		base := local(c.attr("base"))
+		if st, ok := s.simpleTypes[base]; ok && depth < xsdMaxDepth {
+			s.simple(e, st, depth+1)
+		} else {
+			e.Type = base
+		}
+		for _, f := range c.Children {
+			v := f.attr("value")
+			switch f.XMLName.Local {
+			case "maxLength", "length":
+				e.MaxLength, _ = strconv.Atoi(v)
+				if f.XMLName.Local == "length" {
+					e.MinLength = e.MaxLength
+				}
+			case "minLength":
+				e.MinLength, _ = strconv.Atoi(v)
+			case "pattern":
+				e.Pattern = v
+			case "enumeration":
+				e.Enum = append(e.Enum, v)
+			}
+		}
+	}
+	if e.Type == "" {
+		e.Type = "string"
+	}
+}
+
+func occurs(n xsdNode) (min int, many bool) {
+	min = 1
+	if v := n.attr("minOccurs"); v != "" {
+		min, _ = strconv.Atoi(v)
+	}
+	max := n.attr("maxOccurs")
+	if max == "unbounded" {
+		return min, true
+	}
+	m, _ := strconv.Atoi(max)
+	return min, m > 1
+}
+
+func documentation(n xsdNode) string {
+	for _, c := range n.Children {
+		if c.XMLName.Local != "annotation" {
+			continue
+		}
+		for _, d := range c.Children {
+			if d.XMLName.Local == "documentation" {
+				return strings.Join(strings.Fields(d.Text), " ")
+			}
+		}
+	}
+	return ""
+}
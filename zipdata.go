@@ -0,0 +1,325 @@
+// Copyright 2015 Tax Products Group
+// ----------------------------------------------------------------
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ---------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra" // https://github.com/spf13/cobra
+	"github.com/spf13/viper" // https://github.com/spf13/viper
+)
+
+// ZIP code reference data is a CSV file, refdata.zip.file, with a header
+// row naming the columns zip, city, state, county and fips (in any order,
+// others ignored) and a row per five-digit ZIP. With it, each address in
+// a record (OfficeInfo, OwnerInformation, EFINOwnerInfo) is checked
+// against its ZIP: a ZIP that isn't in the file is a ZIP_UNKNOWN warning,
+// and a state other than the ZIP's a ZIP_STATE_MISMATCH warning. The
+// record loads either way. Unless enrich.zip.url is set, the zip enricher
+// (enrich.go) takes OFFICE_COUNTY and OFFICE_COUNTY_FIPS from the file
+// instead of calling out. Without the file neither happens.
+//
+// "enroll refdata update" fetches a new file from refdata.zip.url and its
+// detached signature (signing.go) from refdata.zip.url + ".sig", checks
+// the signature with refdata.zip.key (an env: or file: reference, see
+// secrets.go) and that the file reads, and only then puts it in place. A
+// loader that is already running picks the new file up at its next batch.
+// The file's version is the start of its SHA-256, which check-record
+// shows.
+func init() {
+	viper.SetDefault("refdata.zip.file", "refdata/zipcodes.csv")
+	viper.SetDefault("refdata.zip.url", "")
+	viper.SetDefault("refdata.zip.key", "")
+	viper.SetDefault("refdata.zip.timeout", "2m")
+}
+
+// Codes for an address that doesn't agree with the ZIP data.
+const (
+	errZipUnknown       = "ZIP_UNKNOWN"
+	errZipStateMismatch = "ZIP_STATE_MISMATCH"
+)
+
+// zipPlace is what the ZIP data has for a ZIP.
+type zipPlace struct {
+	City, State, County, FIPS string
+}
+
+// zipData is one version of the ZIP data, loaded into memory.
+type zipData struct {
+	Version string // the first 12 hex digits of the file's SHA-256
+	places  map[string]zipPlace
+}
+
+// The ZIP data the process has, and the file it was read from.
+var zips struct {
+	sync.Mutex
+	data    *zipData
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// currentZipData is the ZIP data in refdata.zip.file, read again if the
+// file has changed since it was last read. It is nil if there is no file.
+func currentZipData() (*zipData, error) {
+	path := viper.GetString("refdata.zip.file")
+	if path == "" {
+		return nil, nil
+	}
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ZIP data: %v", err)
+	}
+
+	zips.Lock()
+	defer zips.Unlock()
+	if zips.data != nil && zips.path == path && zips.modTime.Equal(fi.ModTime()) && zips.size == fi.Size() {
+		return zips.data, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ZIP data: %v", err)
+	}
+	z, err := parseZipData(b)
+	if err != nil {
+		return nil, fmt.Errorf("ZIP data %s: %v", path, err)
+	}
+	zips.data, zips.path, zips.modTime, zips.size = z, path, fi.ModTime(), fi.Size()
+	return z, nil
+}
+
+// loadedZipData is the ZIP data last read, without looking at the file.
+func loadedZipData() *zipData {
+	zips.Lock()
+	defer zips.Unlock()
+	return zips.data
+}
+
+// parseZipData reads a ZIP data file.
+func parseZipData(b []byte) (*zipData, error) {
+	r := csv.NewReader(bytes.NewReader(b))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading the header: %v", err)
+	}
+	col := map[string]int{}
+	for i, name := range header {
+		col[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"zip", "city", "state", "county", "fips"} {
+		if _, ok := col[name]; !ok {
+			return nil, fmt.Errorf("there is no %s column", name)
+		}
+	}
+
+	sum := sha256.Sum256(b)
+	z := &zipData{Version: hex.EncodeToString(sum[:])[:12], places: map[string]zipPlace{}}
+	for line := 2; ; line++ {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		get := func(name string) string {
+			if i := col[name]; i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		zip := zip5(get("zip"))
+		if zip == "" {
+			return nil, fmt.Errorf("line %d: %q is not a five-digit ZIP", line, get("zip"))
+		}
+		z.places[zip] = zipPlace{City: get("city"), State: strings.ToUpper(get("state")), County: get("county"), FIPS: get("fips")}
+	}
+	if len(z.places) == 0 {
+		return nil, errors.New("there are no ZIP codes in it")
+	}
+	return z, nil
+}
+
+// lookup is what z has for zip, a ZIP or ZIP+4.
+func (z *zipData) lookup(zip string) (zipPlace, bool) {
+	if z == nil {
+		return zipPlace{}, false
+	}
+	p, ok := z.places[zip5(zip)]
+	return p, ok
+}
+
+// check returns a warning for each address in e that doesn't agree with
+// its ZIP. An address without a five-digit ZIP isn't checked.
+func (z *zipData) check(e Enrollment) []recordError {
+	if z == nil {
+		return nil
+	}
+	var warnings []recordError
+	for _, a := range []struct{ prefix, zip, state string }{
+		{"OfficeInfo.", e.OfficeInfo.Zip, e.OfficeInfo.State},
+		{"OwnerInformation.", e.OwnerInformation.Zip, e.OwnerInformation.State},
+		{"EFINOwnerInfo.", e.EFINOwnerInfo.Zip, e.EFINOwnerInfo.State},
+	} {
+		zip := zip5(a.zip)
+		if zip == "" {
+			continue
+		}
+		p, ok := z.places[zip]
+		switch {
+		case !ok:
+			warnings = append(warnings, recordError{
+				Field:   a.prefix + "Zip",
+				Code:    errZipUnknown,
+				Message: fmt.Sprintf("ZIP %s is not a ZIP code we know", zip),
+				Args:    map[string]string{"zip": zip},
+			})
+		case p.State != "" && strings.TrimSpace(a.state) != "" && !strings.EqualFold(strings.TrimSpace(a.state), p.State):
+			warnings = append(warnings, recordError{
+				Field:   a.prefix + "State",
+				Code:    errZipStateMismatch,
+				Message: fmt.Sprintf("ZIP %s is in %s, not %s", zip, p.State, strings.TrimSpace(a.state)),
+				Args:    map[string]string{"zip": zip, "state": p.State},
+			})
+		}
+	}
+	return warnings
+}
+
+// zipEnricher is the zip enricher when it works from the ZIP data.
+type zipEnricher struct{}
+
+func (zipEnricher) Name() string { return "zip" }
+
+func (zipEnricher) Enrich(e Enrollment) (map[string]string, error) {
+	p, ok := loadedZipData().lookup(e.OfficeInfo.Zip)
+	if !ok {
+		return nil, nil
+	}
+	columns := map[string]string{}
+	if p.County != "" {
+		columns["OFFICE_COUNTY"] = p.County
+	}
+	if p.FIPS != "" {
+		columns["OFFICE_COUNTY_FIPS"] = p.FIPS
+	}
+	return columns, nil
+}
+
+// updateZipData fetches, checks and installs a new ZIP data file.
+func updateZipData() (*zipData, error) {
+	src := viper.GetString("refdata.zip.url")
+	if src == "" {
+		return nil, errors.New("config: refdata.zip.url is not set")
+	}
+	ref := viper.GetString("refdata.zip.key")
+	if ref == "" {
+		return nil, errors.New("config: refdata.zip.key is not set")
+	}
+	key, err := secretValue(ref)
+	if err != nil {
+		return nil, fmt.Errorf("config: refdata.zip.key: %v", err)
+	}
+	timeout, err := configDuration("refdata.zip.timeout")
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: timeout}
+	b, err := download(client, src)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := download(client, src+".sig")
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(bytes.TrimSpace(sig), []byte(hmacSignature([]byte(key), b))) {
+		return nil, fmt.Errorf("%s: %v", src, errBadSignature)
+	}
+	z, err := parseZipData(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", src, err)
+	}
+
+	// Write it beside the old one and rename it over, so a batch starting
+	// meanwhile reads one file or the other, never half of one.
+	path := viper.GetString("refdata.zip.file")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	tmp := path + ".new"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path+".sig", append(bytes.TrimSpace(sig), '\n'), 0644); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return z, nil
+}
+
+// download GETs url.
+func download(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// ---------------------------------------------------------------------
+// enroll refdata update
+
+var refdataUpdateCmd = &cobra.Command{
+	Use:   "update",
+	Short: "Fetch, verify and install the latest ZIP code data",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		z, err := updateZipData()
+		check(err)
+		fmt.Printf("ZIP data version %s installed in %s: %d ZIP codes\n", z.Version, viper.GetString("refdata.zip.file"), len(z.places))
+	},
+}
+
+func init() {
+	refdataCmd.AddCommand(refdataUpdateCmd) // see refdataload.go
+}